@@ -0,0 +1,3 @@
+module github.com/ecommerce/customerimport
+
+go 1.21
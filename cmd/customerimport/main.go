@@ -0,0 +1,219 @@
+// Command customerimport uploads a customer export from the legacy platform
+// to the auth service's bulk import endpoint and prints the import report:
+//
+//	customerimport [-dry-run] [-format json|jsonl|csv] FILE...
+//
+// Each file is sent as one import, so exports larger than the service's
+// upload limit should be split first; JSONL and CSV split cleanly by line.
+// Re-running an import is safe, customers whose email already exists are
+// skipped. The exit status is 1 when any file failed or any record was
+// rejected. See README.md for configuration.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type config struct {
+	authURL    string
+	token      string
+	staffEmail string
+	staffPass  string
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func loadConfig() config {
+	return config{
+		authURL:    envOr("AUTH_SERVICE_URL", "http://user-auth-service:8001"),
+		token:      os.Getenv("IMPORT_TOKEN"),
+		staffEmail: os.Getenv("IMPORT_STAFF_EMAIL"),
+		staffPass:  os.Getenv("IMPORT_STAFF_PASSWORD"),
+	}
+}
+
+// ImportError and ImportReport mirror the service's response.
+type ImportError struct {
+	Row   int    `json:"row"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	DryRun    bool          `json:"dry_run"`
+	Total     int           `json:"total"`
+	Created   int           `json:"created"`
+	Skipped   int           `json:"skipped"`
+	Addresses int           `json:"addresses"`
+	Orders    int           `json:"orders"`
+	Errors    []ImportError `json:"errors"`
+}
+
+var contentTypes = map[string]string{
+	"json":  "application/json",
+	"jsonl": "application/x-ndjson",
+	"csv":   "text/csv",
+}
+
+// formatFor picks the import format from the flag, or the file extension.
+func formatFor(flagFormat, path string) (string, error) {
+	format := flagFormat
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if format == "ndjson" {
+			format = "jsonl"
+		}
+	}
+	if _, ok := contentTypes[format]; !ok {
+		return "", fmt.Errorf("%s: unknown format %q, pass -format", path, format)
+	}
+	return format, nil
+}
+
+func login(ctx context.Context, client *http.Client, cfg config) (string, error) {
+	if cfg.token != "" {
+		return cfg.token, nil
+	}
+	if cfg.staffEmail == "" || cfg.staffPass == "" {
+		return "", fmt.Errorf("set IMPORT_TOKEN, or IMPORT_STAFF_EMAIL and IMPORT_STAFF_PASSWORD")
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"email":     cfg.staffEmail,
+		"password":  cfg.staffPass,
+		"device_id": "customerimport",
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.authURL+"/api/v1/auth/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("login returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.AccessToken == "" {
+		return "", fmt.Errorf("login returned no access token")
+	}
+	return tokens.AccessToken, nil
+}
+
+func importFile(ctx context.Context, client *http.Client, cfg config, token, path, format string, dryRun bool) (*ImportReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	query := url.Values{"format": {format}}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		cfg.authURL+"/api/v1/admin/import/customers?"+query.Encode(), file)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentTypes[format])
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("import returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var report ImportReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("decoding report: %w", err)
+	}
+	return &report, nil
+}
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "validate every record without writing anything")
+	format := flag.String("format", "", "json, jsonl or csv; taken from the file extension by default")
+	timeout := flag.Duration("timeout", 10*time.Minute, "give up on each file after this long")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: customerimport [-dry-run] [-format json|jsonl|csv] FILE...")
+		os.Exit(2)
+	}
+
+	cfg := loadConfig()
+	client := &http.Client{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	token, err := login(ctx, client, cfg)
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to sign in: %v", err)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		fileFormat, err := formatFor(*format, path)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		report, err := importFile(ctx, client, cfg, token, path, fileFormat, *dryRun)
+		cancel()
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			failed = true
+			continue
+		}
+
+		log.Printf("%s: %d records, %d created, %d skipped, %d addresses, %d orders, %d errors",
+			path, report.Total, report.Created, report.Skipped, report.Addresses, report.Orders, len(report.Errors))
+		for _, e := range report.Errors {
+			log.Printf("%s: row %d %s: %s", path, e.Row, e.Email, e.Error)
+		}
+		if len(report.Errors) > 0 {
+			failed = true
+		}
+	}
+
+	if *dryRun {
+		log.Print("Dry run, nothing was written")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
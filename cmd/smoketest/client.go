@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// run carries the state handed from one step to the next.
+type run struct {
+	cfg     config
+	id      string
+	client  *http.Client
+	current *StepResult
+
+	email         string
+	password      string
+	userID        string
+	customerToken string
+	staffToken    string
+
+	product  catalogProduct
+	reserved bool
+	// Set once the reserved unit left stock for good, so cleanup leaves it
+	committed bool
+
+	quote     orderQuote
+	orderID   string
+	paymentID string
+}
+
+// apiError is a response with an unexpected status.
+type apiError struct {
+	Method string
+	URL    string
+	Status int
+	Body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// call sends a JSON request and decodes the response into out. Any status
+// other than want is an error carrying the start of the response body.
+func (r *run) call(ctx context.Context, method, url, token string, payload, out interface{}, want int) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", "smoketest/"+r.id)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &apiError{Method: method, URL: url, Status: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: decoding response: %w", method, url, err)
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/ecommerce/smoketest
+
+go 1.21
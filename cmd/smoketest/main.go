@@ -0,0 +1,250 @@
+// Command smoketest runs the storefront happy path against a deployed
+// environment and fails if any step or invariant breaks, for use as a
+// post-deploy gate:
+//
+//	register → login → browse → quote → order → pay → ship → refund
+//
+// Each run signs up a fresh customer and buys one unit of a real product,
+// then refunds it, so point it at environments where that's acceptable.
+// The order of a failed run is cancelled before exiting, releasing its
+// stock.
+//
+//	smoketest [-report FILE] [-product ID] [-timeout 2m]
+//
+// The machine-readable report is written as JSON to -report, or stdout,
+// and progress is logged to stderr. The exit status is 1 when the run
+// failed. See README.md for configuration.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type config struct {
+	authURL      string
+	productURL   string
+	inventoryURL string
+	orderURL     string
+	paymentURL   string
+	emailDomain  string
+	staffEmail   string
+	staffPass    string
+	productID    string
+	currency     string
+	country      string
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func loadConfig() config {
+	return config{
+		authURL:      envOr("AUTH_SERVICE_URL", "http://user-auth-service:8001"),
+		productURL:   envOr("PRODUCT_SERVICE_URL", "http://product-service:8002"),
+		inventoryURL: envOr("INVENTORY_SERVICE_URL", "http://inventory-service:8006"),
+		orderURL:     envOr("ORDER_SERVICE_URL", "http://order-service:8004"),
+		paymentURL:   envOr("PAYMENT_SERVICE_URL", "http://payment-service:8005"),
+		emailDomain:  envOr("SMOKE_EMAIL_DOMAIN", "example.com"),
+		staffEmail:   os.Getenv("SMOKE_STAFF_EMAIL"),
+		staffPass:    os.Getenv("SMOKE_STAFF_PASSWORD"),
+		productID:    os.Getenv("SMOKE_PRODUCT_ID"),
+		currency:     envOr("SMOKE_CURRENCY", "USD"),
+		country:      envOr("SMOKE_COUNTRY", "US"),
+	}
+}
+
+// Check is one invariant asserted during a step.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	statusPassed  = "passed"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// StepResult is a step's outcome in the report.
+type StepResult struct {
+	Name       string                 `json:"name"`
+	Status     string                 `json:"status"`
+	DurationMS int64                  `json:"duration_ms"`
+	Error      string                 `json:"error,omitempty"`
+	Checks     []Check                `json:"checks"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+// Report is the machine-readable result of a run.
+type Report struct {
+	RunID       string            `json:"run_id"`
+	Passed      bool              `json:"passed"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	DurationMS  int64             `json:"duration_ms"`
+	Environment map[string]string `json:"environment"`
+	Steps       []StepResult      `json:"steps"`
+}
+
+// step is one stage of the happy path. Cleanup steps run even after an
+// earlier step failed.
+type step struct {
+	name    string
+	run     func(ctx context.Context, r *run) error
+	cleanup bool
+}
+
+var steps = []step{
+	{name: "health", run: checkHealth},
+	{name: "register", run: registerCustomer},
+	{name: "login", run: loginCustomer},
+	{name: "staff_login", run: loginStaff},
+	{name: "browse", run: browseCatalog},
+	{name: "quote", run: quoteOrder},
+	{name: "order", run: placeOrder},
+	{name: "pay", run: payOrder},
+	{name: "ship", run: shipOrder},
+	{name: "refund", run: refundOrder},
+	{name: "release", run: releaseStock, cleanup: true},
+}
+
+// errCheckFailed marks a step that ran but broke an invariant.
+var errCheckFailed = errors.New("invariant violated")
+
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+func main() {
+	reportPath := flag.String("report", "", "write the JSON report here instead of stdout")
+	productID := flag.String("product", "", "product to buy, instead of the first one in stock")
+	timeout := flag.Duration("timeout", 2*time.Minute, "give up on the whole run after this long")
+	flag.Parse()
+
+	cfg := loadConfig()
+	if *productID != "" {
+		cfg.productID = *productID
+	}
+
+	r := &run{
+		cfg:    cfg,
+		id:     newRunID(),
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+	report := Report{
+		RunID:     r.id,
+		StartedAt: time.Now().UTC(),
+		Environment: map[string]string{
+			"auth":      cfg.authURL,
+			"product":   cfg.productURL,
+			"inventory": cfg.inventoryURL,
+			"order":     cfg.orderURL,
+			"payment":   cfg.paymentURL,
+		},
+		Passed: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	log.Printf("Smoke test %s starting", r.id)
+	for _, s := range steps {
+		result := StepResult{Name: s.name, Checks: []Check{}}
+		if !report.Passed && !s.cleanup {
+			result.Status = statusSkipped
+			report.Steps = append(report.Steps, result)
+			log.Printf("%-12s skipped", s.name)
+			continue
+		}
+
+		r.current = &result
+		started := time.Now()
+		err := s.run(ctx, r)
+		result.DurationMS = time.Since(started).Milliseconds()
+		r.current = nil
+
+		result.Status = statusPassed
+		if err != nil {
+			result.Status = statusFailed
+			result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Steps = append(report.Steps, result)
+		if err != nil {
+			log.Printf("%-12s FAILED after %dms: %v", s.name, result.DurationMS, err)
+		} else {
+			log.Printf("%-12s passed in %dms", s.name, result.DurationMS)
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	report.DurationMS = report.FinishedAt.Sub(report.StartedAt).Milliseconds()
+	if err := writeReport(*reportPath, &report); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+
+	if !report.Passed {
+		log.Printf("Smoke test %s failed", r.id)
+		os.Exit(1)
+	}
+	log.Printf("Smoke test %s passed in %dms", r.id, report.DurationMS)
+}
+
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// check records an invariant on the current step. The step carries on so
+// every broken invariant is reported, then fails at its end.
+func (r *run) check(name string, ok bool, format string, args ...interface{}) {
+	c := Check{Name: name, OK: ok}
+	if !ok {
+		c.Detail = fmt.Sprintf(format, args...)
+	}
+	r.current.Checks = append(r.current.Checks, c)
+}
+
+// verdict fails the step if any of its checks failed.
+func (r *run) verdict() error {
+	for _, c := range r.current.Checks {
+		if !c.OK {
+			return fmt.Errorf("%w: %s: %s", errCheckFailed, c.Name, c.Detail)
+		}
+	}
+	return nil
+}
+
+// record adds a value to the current step's report data, such as an ID
+// needed to look into a failure.
+func (r *run) record(key string, value interface{}) {
+	if r.current.Data == nil {
+		r.current.Data = map[string]interface{}{}
+	}
+	r.current.Data[key] = value
+}
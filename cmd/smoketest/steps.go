@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type catalogProduct struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Price    float64    `json:"price"`
+	Stock    int        `json:"stock"`
+	Status   string     `json:"status"`
+	Drop     bool       `json:"drop"`
+	Digital  bool       `json:"digital"`
+	Variants []struct{} `json:"variants"`
+}
+
+type inventoryLevel struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Reserved  int    `json:"reserved"`
+	// Totals above are across these
+	Warehouses []struct {
+		Warehouse string `json:"warehouse"`
+	} `json:"warehouses"`
+}
+
+type pricingStep struct {
+	Rule   string  `json:"rule"`
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+}
+
+type orderLine struct {
+	ProductID         string  `json:"product_id"`
+	Quantity          int     `json:"quantity"`
+	Price             float64 `json:"price"`
+	LineID            string  `json:"line_id"`
+	Fulfillment       string  `json:"fulfillment"`
+	FulfillmentStatus string  `json:"fulfillment_status"`
+	TrackingNumber    string  `json:"tracking_number"`
+}
+
+type orderQuote struct {
+	Currency string      `json:"currency"`
+	Items    []orderLine `json:"items"`
+	Subtotal float64     `json:"subtotal"`
+	Fees     []struct {
+		Amount float64 `json:"amount"`
+	} `json:"fees"`
+	Tax                float64       `json:"tax"`
+	RoundingAdjustment float64       `json:"rounding_adjustment"`
+	Total              float64       `json:"total"`
+	PricingTrace       []pricingStep `json:"pricing_trace"`
+}
+
+type order struct {
+	orderQuote
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// sameAmount compares money to the cent, which is as exact as any service
+// rounds.
+func sameAmount(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+func checkHealth(ctx context.Context, r *run) error {
+	services := []struct{ name, url string }{
+		{"auth", r.cfg.authURL},
+		{"product", r.cfg.productURL},
+		{"inventory", r.cfg.inventoryURL},
+		{"order", r.cfg.orderURL},
+		{"payment", r.cfg.paymentURL},
+	}
+	for _, svc := range services {
+		err := r.call(ctx, http.MethodGet, svc.url+"/health", "", nil, nil, http.StatusOK)
+		detail := ""
+		if err != nil {
+			detail = err.Error()
+		}
+		r.check(svc.name+"_healthy", err == nil, "%s", detail)
+	}
+	return r.verdict()
+}
+
+func registerCustomer(ctx context.Context, r *run) error {
+	r.email = fmt.Sprintf("smoke+%s@%s", r.id, r.cfg.emailDomain)
+	r.password = "Smoke-" + r.id
+
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	err := r.call(ctx, http.MethodPost, r.cfg.authURL+"/api/v1/auth/register", "", map[string]interface{}{
+		"email":           r.email,
+		"password":        r.password,
+		"name":            "Smoke Test " + r.id,
+		"accept_policies": true,
+	}, &resp, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	r.userID = resp.UserID
+	r.record("email", r.email)
+	r.record("user_id", r.userID)
+	r.check("user_id_returned", r.userID != "", "register returned no user_id")
+	return r.verdict()
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (r *run) login(ctx context.Context, email, password string) (string, error) {
+	var resp tokenResponse
+	err := r.call(ctx, http.MethodPost, r.cfg.authURL+"/api/v1/auth/login", "", map[string]interface{}{
+		"email":     email,
+		"password":  password,
+		"device_id": "smoketest",
+	}, &resp, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	r.check("access_token_issued", resp.AccessToken != "", "login returned no access_token")
+	r.check("refresh_token_issued", resp.RefreshToken != "", "login returned no refresh_token")
+	r.check("token_expires", resp.ExpiresIn > 0, "expires_in is %d", resp.ExpiresIn)
+	return resp.AccessToken, r.verdict()
+}
+
+func loginCustomer(ctx context.Context, r *run) error {
+	token, err := r.login(ctx, r.email, r.password)
+	r.customerToken = token
+	return err
+}
+
+func loginStaff(ctx context.Context, r *run) error {
+	if r.cfg.staffEmail == "" || r.cfg.staffPass == "" {
+		return errors.New("SMOKE_STAFF_EMAIL and SMOKE_STAFF_PASSWORD are required to ship and refund")
+	}
+	token, err := r.login(ctx, r.cfg.staffEmail, r.cfg.staffPass)
+	r.staffToken = token
+	return err
+}
+
+// buyable reports whether the smoke test can order a product without a
+// drop admission, a variant choice or a digital-only fulfillment.
+func (p *catalogProduct) buyable() bool {
+	return p.Stock > 0 && !p.Drop && !p.Digital && len(p.Variants) == 0 &&
+		(p.Status == "" || p.Status == "published")
+}
+
+func browseCatalog(ctx context.Context, r *run) error {
+	var list struct {
+		Products []catalogProduct `json:"products"`
+		Count    int              `json:"count"`
+	}
+	if err := r.call(ctx, http.MethodGet, r.cfg.productURL+"/api/v1/products", "", nil, &list, http.StatusOK); err != nil {
+		return err
+	}
+	r.check("list_count_matches", list.Count == len(list.Products), "count %d, %d products", list.Count, len(list.Products))
+
+	var listed *catalogProduct
+	for i := range list.Products {
+		p := &list.Products[i]
+		if (r.cfg.productID != "" && p.ID == r.cfg.productID) || (r.cfg.productID == "" && p.buyable()) {
+			listed = p
+			break
+		}
+	}
+	if listed == nil {
+		if r.cfg.productID != "" {
+			return fmt.Errorf("product %s is not in the catalog listing", r.cfg.productID)
+		}
+		return errors.New("no published, in-stock physical product to buy")
+	}
+
+	if err := r.call(ctx, http.MethodGet, r.cfg.productURL+"/api/v1/products/"+url.PathEscape(listed.ID), "", nil, &r.product, http.StatusOK); err != nil {
+		return err
+	}
+	r.record("product_id", r.product.ID)
+	r.check("detail_matches_listing", r.product.ID == listed.ID, "detail returned %q", r.product.ID)
+	r.check("price_matches_listing", sameAmount(r.product.Price, listed.Price), "detail %.2f, listing %.2f", r.product.Price, listed.Price)
+	r.check("in_stock", r.product.Stock > 0, "stock is %d", r.product.Stock)
+
+	var search struct {
+		Products []catalogProduct `json:"products"`
+		Count    int              `json:"count"`
+		Total    int              `json:"total"`
+		Engine   string           `json:"engine"`
+	}
+	q := url.Values{"q": {r.product.Name}}
+	if err := r.call(ctx, http.MethodGet, r.cfg.productURL+"/api/v1/products/search?"+q.Encode(), "", nil, &search, http.StatusOK); err != nil {
+		return err
+	}
+	r.record("search_engine", search.Engine)
+	r.check("search_count_matches", search.Count == len(search.Products) && search.Total >= search.Count,
+		"count %d, total %d, %d products", search.Count, search.Total, len(search.Products))
+	found := false
+	for _, p := range search.Products {
+		found = found || p.ID == r.product.ID
+	}
+	r.check("search_finds_product", found, "searching %q did not return %s", r.product.Name, r.product.ID)
+	return r.verdict()
+}
+
+func (r *run) inventory(ctx context.Context) (inventoryLevel, error) {
+	var level inventoryLevel
+	err := r.call(ctx, http.MethodGet, r.cfg.inventoryURL+"/api/v1/inventory/"+url.PathEscape(r.product.ID), "", nil, &level, http.StatusOK)
+	return level, err
+}
+
+// checkHeld compares stock levels from before and after the order's stock
+// moved: held moves from available to reserved when the order is placed,
+// and out of reserved, as a sale, when it's paid.
+func (r *run) checkHeld(name string, before, after inventoryLevel, available, reserved int) {
+	r.check(name, after.Quantity == before.Quantity+available && after.Reserved == before.Reserved+reserved,
+		"quantity %d → %d, reserved %d → %d", before.Quantity, after.Quantity, before.Reserved, after.Reserved)
+}
+
+func (r *run) orderRequest() map[string]interface{} {
+	return map[string]interface{}{
+		"user_id":        r.userID,
+		"items":          []map[string]interface{}{{"product_id": r.product.ID, "quantity": 1}},
+		"currency":       r.cfg.currency,
+		"payment_method": "card",
+		"shipping_address": map[string]string{
+			"name":        "Smoke Test",
+			"line1":       "1 Test Street",
+			"city":        "Testville",
+			"postal_code": "00000",
+			"country":     r.cfg.country,
+		},
+	}
+}
+
+// checkTotals asserts that a quote or order adds up and matches its
+// pricing trace.
+func (r *run) checkTotals(prefix string, q *orderQuote) {
+	fees := 0.0
+	for _, fee := range q.Fees {
+		fees += fee.Amount
+	}
+	sum := q.Subtotal + fees + q.Tax + q.RoundingAdjustment
+	r.check(prefix+"total_adds_up", sameAmount(sum, q.Total),
+		"subtotal %.2f + fees %.2f + tax %.2f + rounding %.2f = %.2f, total %.2f", q.Subtotal, fees, q.Tax, q.RoundingAdjustment, sum, q.Total)
+
+	if len(q.PricingTrace) == 0 {
+		r.check(prefix+"pricing_traced", false, "no pricing trace")
+		return
+	}
+	last := q.PricingTrace[len(q.PricingTrace)-1]
+	r.check(prefix+"trace_ends_at_total", sameAmount(last.After, q.Total), "last step %s ends at %.2f, total %.2f", last.Rule, last.After, q.Total)
+}
+
+func quoteOrder(ctx context.Context, r *run) error {
+	if err := r.call(ctx, http.MethodPost, r.cfg.orderURL+"/api/v1/orders/quote", "", r.orderRequest(), &r.quote, http.StatusOK); err != nil {
+		return err
+	}
+	r.record("total", r.quote.Total)
+	r.check("currency_kept", r.quote.Currency == r.cfg.currency, "quoted in %q", r.quote.Currency)
+	r.check("one_line", len(r.quote.Items) == 1, "%d lines", len(r.quote.Items))
+	if len(r.quote.Items) == 1 {
+		// Only holds without a sale or tier rule on the product
+		r.check("catalog_price", sameAmount(r.quote.Items[0].Price, r.product.Price),
+			"line priced %.2f, catalog %.2f", r.quote.Items[0].Price, r.product.Price)
+	}
+	r.checkTotals("", &r.quote)
+	return r.verdict()
+}
+
+func (r *run) adminOrder(ctx context.Context) (order, error) {
+	var resp struct {
+		Order order `json:"order"`
+	}
+	err := r.call(ctx, http.MethodGet, r.cfg.orderURL+"/api/v1/admin/orders/"+url.PathEscape(r.orderID), r.staffToken, nil, &resp, http.StatusOK)
+	return resp.Order, err
+}
+
+// placeOrder places the order, which reserves its unit in the inventory
+// service under the order's ID.
+func placeOrder(ctx context.Context, r *run) error {
+	before, err := r.inventory(ctx)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := r.call(ctx, http.MethodPost, r.cfg.orderURL+"/api/v1/orders", "", r.orderRequest(), &created, http.StatusCreated); err != nil {
+		return err
+	}
+	r.orderID = created.OrderID
+	r.record("order_id", r.orderID)
+	if r.orderID == "" {
+		return errors.New("create order returned no order_id")
+	}
+	r.reserved = true
+
+	after, err := r.inventory(ctx)
+	if err != nil {
+		return err
+	}
+	warehouses := []string{}
+	for _, w := range after.Warehouses {
+		warehouses = append(warehouses, w.Warehouse)
+	}
+	r.record("warehouses", warehouses)
+	r.checkHeld("order_reserved_stock", before, after, -1, 1)
+
+	var mine struct {
+		Orders []order `json:"orders"`
+	}
+	if err := r.call(ctx, http.MethodGet, r.cfg.orderURL+"/api/v1/orders/user/"+url.PathEscape(r.userID), "", nil, &mine, http.StatusOK); err != nil {
+		return err
+	}
+	listed := false
+	for _, o := range mine.Orders {
+		listed = listed || o.ID == r.orderID
+	}
+	r.check("in_customer_orders", listed, "order %s missing from the customer's %d orders", r.orderID, len(mine.Orders))
+
+	placed, err := r.adminOrder(ctx)
+	if err != nil {
+		return err
+	}
+	r.check("owned_by_customer", placed.UserID == r.userID, "user_id %q", placed.UserID)
+	r.check("pending", placed.Status == "pending", "status %q", placed.Status)
+	r.check("total_matches_quote", sameAmount(placed.Total, r.quote.Total), "order %.2f, quote %.2f", placed.Total, r.quote.Total)
+	r.checkTotals("order_", &placed.orderQuote)
+	return r.verdict()
+}
+
+func payOrder(ctx context.Context, r *run) error {
+	var paid struct {
+		PaymentID string `json:"payment_id"`
+		Status    string `json:"status"`
+	}
+	err := r.call(ctx, http.MethodPost, r.cfg.paymentURL+"/api/v1/payments", r.customerToken, map[string]interface{}{
+		"order_id": r.orderID,
+		"user_id":  r.userID,
+		"amount":   r.quote.Total,
+		"currency": r.quote.Currency,
+		"method":   "card",
+	}, &paid, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	r.paymentID = paid.PaymentID
+	r.record("payment_id", r.paymentID)
+	r.check("payment_completed", paid.Status == "completed", "status %q", paid.Status)
+
+	var payment struct {
+		OrderID string  `json:"order_id"`
+		Amount  float64 `json:"amount"`
+		Status  string  `json:"status"`
+	}
+	if err := r.call(ctx, http.MethodGet, r.cfg.paymentURL+"/api/v1/payments/"+url.PathEscape(r.paymentID), "", nil, &payment, http.StatusOK); err != nil {
+		return err
+	}
+	r.check("payment_for_order", payment.OrderID == r.orderID, "order_id %q", payment.OrderID)
+	r.check("payment_amount", sameAmount(payment.Amount, r.quote.Total), "charged %.2f, total %.2f", payment.Amount, r.quote.Total)
+
+	// Paying the order sells its reserved unit
+	before, err := r.inventory(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.call(ctx, http.MethodPut, r.cfg.orderURL+"/api/v1/orders/"+url.PathEscape(r.orderID)+"/status", r.staffToken,
+		map[string]string{"status": "paid"}, nil, http.StatusOK); err != nil {
+		return err
+	}
+	r.committed = true
+	placed, err := r.adminOrder(ctx)
+	if err != nil {
+		return err
+	}
+	r.check("order_paid", placed.Status == "paid", "status %q", placed.Status)
+	after, err := r.inventory(ctx)
+	if err != nil {
+		return err
+	}
+	r.checkHeld("reservation_committed", before, after, 0, -1)
+	return r.verdict()
+}
+
+func (r *run) moveLine(ctx context.Context, lineID string, body map[string]string) error {
+	return r.call(ctx, http.MethodPut, r.cfg.orderURL+"/api/v1/admin/orders/"+url.PathEscape(r.orderID)+"/items/"+url.PathEscape(lineID)+"/fulfillment",
+		r.staffToken, body, nil, http.StatusOK)
+}
+
+func shipOrder(ctx context.Context, r *run) error {
+	placed, err := r.adminOrder(ctx)
+	if err != nil {
+		return err
+	}
+
+	tracking := "SMOKE" + r.id
+	shipped := 0
+	for _, line := range placed.Items {
+		if line.Fulfillment != "ship" {
+			continue
+		}
+		if err := r.moveLine(ctx, line.LineID, map[string]string{"status": "packed"}); err != nil {
+			return err
+		}
+		if err := r.moveLine(ctx, line.LineID, map[string]string{"status": "shipped", "tracking_number": tracking, "carrier": "smoketest"}); err != nil {
+			return err
+		}
+		shipped++
+	}
+	r.check("has_ship_lines", shipped > 0, "no lines to ship")
+
+	placed, err = r.adminOrder(ctx)
+	if err != nil {
+		return err
+	}
+	for _, line := range placed.Items {
+		if line.Fulfillment != "ship" {
+			continue
+		}
+		r.check("line_"+line.LineID+"_shipped", line.FulfillmentStatus == "shipped" && line.TrackingNumber == tracking,
+			"status %q, tracking %q", line.FulfillmentStatus, line.TrackingNumber)
+	}
+
+	return r.verdict()
+}
+
+func refundOrder(ctx context.Context, r *run) error {
+	err := r.call(ctx, http.MethodPost, r.cfg.paymentURL+"/api/v1/payments/"+url.PathEscape(r.paymentID)+"/refund", r.staffToken,
+		map[string]string{"reason": "Smoke test " + r.id}, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	var payment struct {
+		Status string `json:"status"`
+	}
+	if err := r.call(ctx, http.MethodGet, r.cfg.paymentURL+"/api/v1/payments/"+url.PathEscape(r.paymentID), "", nil, &payment, http.StatusOK); err != nil {
+		return err
+	}
+	r.check("payment_refunded", payment.Status == "refunded", "status %q", payment.Status)
+	return r.verdict()
+}
+
+// releaseStock cancels the order of a failed run that never got paid,
+// which hands back the unit it reserved.
+func releaseStock(_ context.Context, r *run) error {
+	if !r.reserved || r.committed {
+		return nil
+	}
+	// The run's context may be what ran out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.call(ctx, http.MethodDelete, r.cfg.orderURL+"/api/v1/orders/"+url.PathEscape(r.orderID), r.staffToken, nil, nil, http.StatusOK); err != nil {
+		return err
+	}
+	r.reserved = false
+	r.record("released", 1)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sealer compresses and encrypts backup objects with AES-256-GCM under
+// BACKUP_ENCRYPTION_KEY (32 bytes, base64). Each object is stored as
+// nonce || ciphertext.
+type sealer struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+func newSealer() (*sealer, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("BACKUP_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("BACKUP_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identifies the key in manifests without revealing it, so restores
+	// with the wrong key fail up front
+	sum := sha256.Sum256(append([]byte("backup-key-id:"), key...))
+	return &sealer{aead: aead, keyID: hex.EncodeToString(sum[:8])}, nil
+}
+
+// seal gzips plaintext and encrypts it. The object key is authenticated
+// too, so parts can't be swapped between collections.
+func (s *sealer) seal(objectKey string, plaintext []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, compressed.Bytes(), []byte(objectKey)), nil
+}
+
+func (s *sealer) open(objectKey string, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: object too short", objectKey)
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	compressed, err := s.aead.Open(nil, nonce, ciphertext, []byte(objectKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: decryption failed: %w", objectKey, err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
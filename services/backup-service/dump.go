@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Manifest describes a completed backup. It is written last, so a backup
+// without one is incomplete and ignored.
+type Manifest struct {
+	ID          string         `json:"id"`
+	StartedAt   time.Time      `json:"started_at"`
+	CompletedAt time.Time      `json:"completed_at"`
+	Consistent  bool           `json:"consistent"`
+	KeyID       string         `json:"key_id"`
+	Databases   []DatabaseDump `json:"databases"`
+}
+
+type DatabaseDump struct {
+	Name        string           `json:"name"`
+	Collections []CollectionDump `json:"collections"`
+}
+
+// CollectionDump holds a collection's options and index definitions as
+// canonical extended JSON, and its documents split into parts.
+type CollectionDump struct {
+	Name      string   `json:"name"`
+	Options   string   `json:"options,omitempty"`
+	Indexes   []string `json:"indexes"`
+	Documents int64    `json:"documents"`
+	Parts     []Part   `json:"parts"`
+}
+
+// Part is one object of concatenated BSON documents. SHA256 is over the
+// plaintext, checked on verify and restore.
+type Part struct {
+	Key       string `json:"key"`
+	Documents int64  `json:"documents"`
+	Bytes     int    `json:"bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// backupID names backups so they sort chronologically.
+func backupID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func manifestKey(id string) string {
+	return path.Join(cfg.prefix, id, "manifest.json")
+}
+
+// runBackup dumps every configured database. With a consistent backup all
+// collections are read from one snapshot (MongoDB 5.0+ replica set), so
+// the backup reflects a single point in time across services.
+func runBackup(ctx context.Context, client *mongo.Client, store *objectStore, seal *sealer) (*Manifest, error) {
+	manifest := &Manifest{
+		ID:         backupID(time.Now()),
+		StartedAt:  time.Now(),
+		Consistent: cfg.consistent,
+		KeyID:      seal.keyID,
+	}
+	log.Printf("Starting backup %s of %s", manifest.ID, strings.Join(cfg.databases, ", "))
+
+	sessionOpts := options.Session()
+	if cfg.consistent {
+		sessionOpts.SetSnapshot(true)
+	}
+	session, err := client.StartSession(sessionOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(context.Background())
+
+	err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		for _, name := range cfg.databases {
+			dump, err := dumpDatabase(sc, client.Database(name), manifest.ID, store, seal)
+			if err != nil {
+				return fmt.Errorf("database %s: %w", name, err)
+			}
+			manifest.Databases = append(manifest.Databases, *dump)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.CompletedAt = time.Now()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := store.put(ctx, manifestKey(manifest.ID), data); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Backup %s completed in %s", manifest.ID, manifest.CompletedAt.Sub(manifest.StartedAt).Round(time.Second))
+	return manifest, nil
+}
+
+func dumpDatabase(ctx context.Context, db *mongo.Database, id string, store *objectStore, seal *sealer) (*DatabaseDump, error) {
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "type", Value: "collection"}})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+	dump := &DatabaseDump{Name: db.Name(), Collections: []CollectionDump{}}
+	for _, spec := range specs {
+		if strings.HasPrefix(spec.Name, "system.") {
+			continue
+		}
+
+		collection := CollectionDump{Name: spec.Name, Indexes: []string{}, Parts: []Part{}}
+		if len(spec.Options) > 0 {
+			options, err := bson.MarshalExtJSON(spec.Options, true, false)
+			if err != nil {
+				return nil, err
+			}
+			collection.Options = string(options)
+		}
+
+		if collection.Indexes, err = dumpIndexes(ctx, db.Collection(spec.Name)); err != nil {
+			return nil, fmt.Errorf("%s indexes: %w", spec.Name, err)
+		}
+		if err := dumpDocuments(ctx, db.Collection(spec.Name), &collection, path.Join(cfg.prefix, id, db.Name(), spec.Name), store, seal); err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+
+		log.Printf("Dumped %s.%s: %d documents in %d parts", db.Name(), spec.Name, collection.Documents, len(collection.Parts))
+		dump.Collections = append(dump.Collections, collection)
+	}
+	return dump, nil
+}
+
+func dumpIndexes(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	indexes := []string{}
+	for cursor.Next(ctx) {
+		if cursor.Current.Lookup("name").StringValue() == "_id_" {
+			continue
+		}
+		index, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, string(index))
+	}
+	return indexes, cursor.Err()
+}
+
+// dumpDocuments streams the collection in _id order into parts of about
+// BACKUP_PART_SIZE bytes of BSON each.
+func dumpDocuments(ctx context.Context, collection *mongo.Collection, dump *CollectionDump, keyPrefix string, store *objectStore, seal *sealer) error {
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var buf bytes.Buffer
+	var documents int64
+	flush := func() error {
+		if documents == 0 {
+			return nil
+		}
+		key := fmt.Sprintf("%s/%05d.bson.gz.enc", keyPrefix, len(dump.Parts))
+		sealed, err := seal.seal(key, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := store.put(ctx, key, sealed); err != nil {
+			return err
+		}
+		dump.Parts = append(dump.Parts, Part{Key: key, Documents: documents, Bytes: buf.Len(), SHA256: sha256Hex(buf.Bytes())})
+		dump.Documents += documents
+		buf.Reset()
+		documents = 0
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		buf.Write(cursor.Current)
+		documents++
+		if buf.Len() >= cfg.partSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// splitDocuments splits a part back into its BSON documents.
+func splitDocuments(data []byte) ([]bson.Raw, error) {
+	var docs []bson.Raw
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated document")
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 5 || size > len(data) {
+			return nil, fmt.Errorf("invalid document length %d", size)
+		}
+		docs = append(docs, bson.Raw(data[:size]))
+		data = data[size:]
+	}
+	return docs, nil
+}
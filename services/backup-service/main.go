@@ -0,0 +1,180 @@
+// Command backup-service takes encrypted, consistent backups of the
+// platform's MongoDB databases into object storage and restores them.
+//
+//	backup-service schedule            back up every BACKUP_INTERVAL (default)
+//	backup-service backup              take one backup now
+//	backup-service list                list completed backups
+//	backup-service verify  [-backup ID] decrypt and checksum every part
+//	backup-service restore [-backup ID] [-uri URI] [-suffix S] [-force]
+//	backup-service drill   [-uri URI]   timed restore of the latest backup
+//
+// See README.md for configuration and the restore drill.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type config struct {
+	mongoURI   string
+	databases  []string
+	prefix     string
+	interval   time.Duration
+	partSize   int
+	consistent bool
+	rpoTarget  time.Duration
+	rtoTarget  time.Duration
+}
+
+var cfg config
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+func loadConfig() {
+	cfg = config{
+		mongoURI:   envOr("MONGODB_URI", "mongodb://localhost:27017"),
+		databases:  strings.Split(envOr("BACKUP_DATABASES", "ecommerce"), ","),
+		prefix:     strings.Trim(envOr("BACKUP_PREFIX", "backups"), "/"),
+		interval:   envDuration("BACKUP_INTERVAL", 24*time.Hour),
+		partSize:   64 << 20,
+		consistent: os.Getenv("BACKUP_CONSISTENT") != "false",
+	}
+	if n, err := strconv.Atoi(os.Getenv("BACKUP_PART_SIZE")); err == nil && n > 0 {
+		cfg.partSize = n
+	}
+	// A restore can lose at most one interval of writes when backups run
+	// on time, plus however long the backup itself takes
+	cfg.rpoTarget = envDuration("BACKUP_RPO_TARGET", cfg.interval+time.Hour)
+	cfg.rtoTarget = envDuration("BACKUP_RTO_TARGET", time.Hour)
+}
+
+func connect(ctx context.Context, uri string) *mongo.Client {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	return client
+}
+
+func main() {
+	loadConfig()
+
+	command := "schedule"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	backup := flags.String("backup", "latest", "backup ID, or latest")
+	uri := flags.String("uri", envOr("RESTORE_MONGODB_URI", cfg.mongoURI), "MongoDB to restore into")
+	suffix := flags.String("suffix", "", "appended to each restored database name")
+	force := flags.Bool("force", false, "restore over existing collections")
+	flags.Parse(args)
+
+	store, err := newObjectStore()
+	if err != nil {
+		log.Fatalf("Storage not configured: %v", err)
+	}
+	seal, err := newSealer()
+	if err != nil {
+		log.Fatalf("Encryption not configured: %v", err)
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "schedule":
+		client := connect(ctx, cfg.mongoURI)
+		defer client.Disconnect(context.Background())
+		schedule(ctx, client, store, seal)
+
+	case "backup":
+		client := connect(ctx, cfg.mongoURI)
+		defer client.Disconnect(context.Background())
+		if _, err := runBackup(ctx, client, store, seal); err != nil {
+			log.Fatalf("Backup failed: %v", err)
+		}
+
+	case "list":
+		ids, err := listBackups(ctx, store)
+		if err != nil {
+			log.Fatalf("Failed to list backups: %v", err)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+
+	case "verify":
+		manifest, err := loadManifest(ctx, store, *backup)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := verifyBackup(ctx, store, seal, manifest); err != nil {
+			log.Fatalf("Verification failed: %v", err)
+		}
+
+	case "restore":
+		manifest, err := loadManifest(ctx, store, *backup)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		client := connect(ctx, *uri)
+		defer client.Disconnect(context.Background())
+
+		started := time.Now()
+		if err := restoreBackup(ctx, client, store, seal, manifest, *suffix, *force); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		log.Printf("Restored backup %s in %s", manifest.ID, time.Since(started).Round(time.Second))
+
+	case "drill":
+		client := connect(ctx, *uri)
+		report := runDrill(ctx, client, store, seal)
+		client.Disconnect(context.Background())
+
+		json.NewEncoder(os.Stdout).Encode(report)
+		if !report.Passed {
+			os.Exit(1)
+		}
+
+	default:
+		log.Fatalf("Unknown command %q", command)
+	}
+}
+
+// schedule takes a backup every interval until the process is stopped.
+// Failed backups are retried after a tenth of the interval.
+func schedule(ctx context.Context, client *mongo.Client, store *objectStore, seal *sealer) {
+	log.Printf("Backing up %s every %s", strings.Join(cfg.databases, ", "), cfg.interval)
+	for {
+		next := cfg.interval
+		if _, err := runBackup(ctx, client, store, seal); err != nil {
+			log.Printf("Backup failed: %v", err)
+			next = cfg.interval / 10
+		}
+		time.Sleep(next)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const restoreBatchSize = 1000
+
+// loadManifest fetches a backup's manifest; "latest" picks the most
+// recent completed backup.
+func loadManifest(ctx context.Context, store *objectStore, id string) (*Manifest, error) {
+	if id == "latest" {
+		ids, err := listBackups(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no backups found under %s/", cfg.prefix)
+		}
+		id = ids[len(ids)-1]
+	}
+
+	data, err := store.get(ctx, manifestKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("backup %s has no manifest: %w", id, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// listBackups returns the IDs of completed backups, oldest first.
+func listBackups(ctx context.Context, store *objectStore) ([]string, error) {
+	prefixes, err := store.listPrefixes(ctx, cfg.prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, p := range prefixes {
+		id := strings.TrimSuffix(strings.TrimPrefix(p, cfg.prefix+"/"), "/")
+		// Skip backups that never finished
+		if _, err := store.get(ctx, manifestKey(id)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// readPart downloads, decrypts and checks a part against its manifest
+// entry.
+func readPart(ctx context.Context, store *objectStore, seal *sealer, part Part) ([]bson.Raw, error) {
+	sealed, err := store.get(ctx, part.Key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := seal.open(part.Key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if sha256Hex(data) != part.SHA256 {
+		return nil, fmt.Errorf("%s: checksum mismatch", part.Key)
+	}
+	docs, err := splitDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", part.Key, err)
+	}
+	if int64(len(docs)) != part.Documents {
+		return nil, fmt.Errorf("%s: expected %d documents, found %d", part.Key, part.Documents, len(docs))
+	}
+	return docs, nil
+}
+
+func checkKey(manifest *Manifest, seal *sealer) error {
+	if manifest.KeyID != seal.keyID {
+		return fmt.Errorf("backup %s was encrypted with key %s, not the configured key %s", manifest.ID, manifest.KeyID, seal.keyID)
+	}
+	return nil
+}
+
+// verifyBackup reads back every part of a backup without touching a
+// database.
+func verifyBackup(ctx context.Context, store *objectStore, seal *sealer, manifest *Manifest) error {
+	if err := checkKey(manifest, seal); err != nil {
+		return err
+	}
+	for _, db := range manifest.Databases {
+		for _, collection := range db.Collections {
+			for _, part := range collection.Parts {
+				if _, err := readPart(ctx, store, seal, part); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	log.Printf("Backup %s verified", manifest.ID)
+	return nil
+}
+
+// restoreBackup loads a backup into the databases on client, each named
+// after the original plus suffix. Targets must be empty unless force is
+// set, so a restore can't silently mix with live data. After loading, the
+// document counts are checked against the manifest.
+func restoreBackup(ctx context.Context, client *mongo.Client, store *objectStore, seal *sealer, manifest *Manifest, suffix string, force bool) error {
+	if err := checkKey(manifest, seal); err != nil {
+		return err
+	}
+
+	for _, dump := range manifest.Databases {
+		db := client.Database(dump.Name + suffix)
+		if !force {
+			if err := requireEmpty(ctx, db); err != nil {
+				return err
+			}
+		}
+
+		for _, collection := range dump.Collections {
+			if err := restoreCollection(ctx, db, store, seal, collection, force); err != nil {
+				return fmt.Errorf("%s.%s: %w", db.Name(), collection.Name, err)
+			}
+			log.Printf("Restored %s.%s: %d documents", db.Name(), collection.Name, collection.Documents)
+		}
+	}
+	return nil
+}
+
+func requireEmpty(ctx context.Context, db *mongo.Database) error {
+	names, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		n, err := db.Collection(name).EstimatedDocumentCount(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("target database %s is not empty (%s has %d documents), use -force to restore anyway", db.Name(), name, n)
+		}
+	}
+	return nil
+}
+
+func restoreCollection(ctx context.Context, db *mongo.Database, store *objectStore, seal *sealer, dump CollectionDump, force bool) error {
+	if force {
+		if err := db.Collection(dump.Name).Drop(ctx); err != nil {
+			return err
+		}
+	}
+
+	create := bson.D{{Key: "create", Value: dump.Name}}
+	if dump.Options != "" {
+		var opts bson.D
+		if err := bson.UnmarshalExtJSON([]byte(dump.Options), true, &opts); err != nil {
+			return err
+		}
+		create = append(create, opts...)
+	}
+	if err := db.RunCommand(ctx, create).Err(); err != nil {
+		return err
+	}
+
+	collection := db.Collection(dump.Name)
+	for _, part := range dump.Parts {
+		docs, err := readPart(ctx, store, seal, part)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(docs); start += restoreBatchSize {
+			end := start + restoreBatchSize
+			if end > len(docs) {
+				end = len(docs)
+			}
+			batch := make([]interface{}, 0, end-start)
+			for _, doc := range docs[start:end] {
+				batch = append(batch, doc)
+			}
+			if _, err := collection.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Build indexes after loading, which is much faster than maintaining
+	// them during the inserts
+	if len(dump.Indexes) > 0 {
+		indexes := bson.A{}
+		for _, raw := range dump.Indexes {
+			var index bson.D
+			if err := bson.UnmarshalExtJSON([]byte(raw), true, &index); err != nil {
+				return err
+			}
+			spec := bson.D{}
+			for _, field := range index {
+				if field.Key != "v" && field.Key != "ns" {
+					spec = append(spec, field)
+				}
+			}
+			indexes = append(indexes, spec)
+		}
+		err := db.RunCommand(ctx, bson.D{{Key: "createIndexes", Value: dump.Name}, {Key: "indexes", Value: indexes}}).Err()
+		if err != nil {
+			return fmt.Errorf("indexes: %w", err)
+		}
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	if count != dump.Documents {
+		return fmt.Errorf("restored %d documents, backup has %d", count, dump.Documents)
+	}
+	return nil
+}
+
+// DrillReport is the outcome of a restore drill. RPO is how much data a
+// restore right now would lose (the age of the latest backup); RTO is how
+// long the restore took.
+type DrillReport struct {
+	BackupID         string  `json:"backup_id"`
+	RPOSeconds       float64 `json:"rpo_seconds"`
+	RTOSeconds       float64 `json:"rto_seconds"`
+	RPOTargetSeconds float64 `json:"rpo_target_seconds"`
+	RTOTargetSeconds float64 `json:"rto_target_seconds"`
+	Documents        int64   `json:"documents"`
+	Passed           bool    `json:"passed"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// runDrill restores the latest backup into scratch databases on client,
+// verifies it, drops the scratch databases and measures RPO and RTO
+// against BACKUP_RPO_TARGET and BACKUP_RTO_TARGET.
+func runDrill(ctx context.Context, client *mongo.Client, store *objectStore, seal *sealer) *DrillReport {
+	report := &DrillReport{RPOTargetSeconds: cfg.rpoTarget.Seconds(), RTOTargetSeconds: cfg.rtoTarget.Seconds()}
+
+	manifest, err := loadManifest(ctx, store, "latest")
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.BackupID = manifest.ID
+	rpo := time.Since(manifest.StartedAt)
+	report.RPOSeconds = rpo.Seconds()
+	for _, db := range manifest.Databases {
+		for _, collection := range db.Collections {
+			report.Documents += collection.Documents
+		}
+	}
+
+	suffix := "_drill_" + backupID(time.Now())
+	started := time.Now()
+	err = restoreBackup(ctx, client, store, seal, manifest, suffix, false)
+	rto := time.Since(started)
+	report.RTOSeconds = rto.Seconds()
+
+	for _, db := range manifest.Databases {
+		if dropErr := client.Database(db.Name + suffix).Drop(context.Background()); dropErr != nil {
+			log.Printf("Failed to drop drill database %s: %v", db.Name+suffix, dropErr)
+		}
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Passed = rpo <= cfg.rpoTarget && rto <= cfg.rtoTarget
+	return report
+}
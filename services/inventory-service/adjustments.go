@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Adjustment is a correction to on-hand stock outside receipts and sales,
+// made for a reason by the staff member whose token made the request.
+// Adjustments moving at least ADJUSTMENT_APPROVAL_THRESHOLD units (default
+// 100) wait for someone else to approve them; smaller ones apply straight
+// away. Applied adjustments are recorded in the movement ledger with their
+// reason, actor and ID.
+type Adjustment struct {
+	ID        string `bson:"_id" json:"id"`
+	ProductID string `bson:"product_id" json:"product_id"`
+	Warehouse string `bson:"warehouse" json:"warehouse"`
+	// Signed change to on-hand stock
+	Delta  int    `bson:"delta" json:"delta"`
+	Reason string `bson:"reason" json:"reason"`
+	Note   string `bson:"note,omitempty" json:"note,omitempty"`
+	Actor  string `bson:"actor" json:"actor"`
+	Status string `bson:"status" json:"status"`
+	// Who approved or rejected it, when it needed approval
+	DecidedBy    string     `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	DecisionNote string     `bson:"decision_note,omitempty" json:"decision_note,omitempty"`
+	DecidedAt    *time.Time `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+	CreatedAt    time.Time  `bson:"created_at" json:"created_at"`
+	AppliedAt    *time.Time `bson:"applied_at,omitempty" json:"applied_at,omitempty"`
+}
+
+const (
+	adjustmentPending  = "pending"
+	adjustmentApplied  = "applied"
+	adjustmentRejected = "rejected"
+)
+
+const (
+	reasonDamage     = "damage"
+	reasonShrinkage  = "shrinkage"
+	reasonRecount    = "recount"
+	reasonCorrection = "correction"
+)
+
+var (
+	errNegativeStock     = errors.New("adjustment would take stock below zero")
+	errAdjustmentDecided = errors.New("adjustment was already approved or rejected")
+)
+
+func adjustmentApprovalThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("ADJUSTMENT_APPROVAL_THRESHOLD")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
+
+// applyAdjustment changes the stock and records the movement. Stock is
+// never taken below zero.
+func applyAdjustment(ctx context.Context, adj *Adjustment) error {
+	filter := bson.M{"product_id": adj.ProductID, "warehouse": adj.Warehouse}
+	if adj.Delta < 0 {
+		filter["quantity"] = bson.M{"$gte": -adj.Delta}
+	}
+	result, err := inventoryService.db.Collection("inventory").UpdateOne(ctx, filter,
+		bson.M{
+			"$inc": bson.M{"quantity": adj.Delta},
+			"$set": bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNegativeStock
+	}
+
+	recordMovement(ctx, Movement{
+		ProductID: adj.ProductID,
+		Warehouse: adj.Warehouse,
+		Type:      movementAdjust,
+		Quantity:  adj.Delta,
+		Reason:    adj.Reason,
+		Actor:     adj.Actor,
+		Reference: adj.ID,
+	})
+	return nil
+}
+
+func adjustmentError(c *gin.Context, err error, message string) {
+	switch err {
+	case errWarehouseRequired:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errNegativeStock, errAdjustmentDecided:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// createAdjustment answers POST /api/v1/inventory/adjustments. The change
+// is given as a delta, or for recounts as the counted quantity. Damage and
+// shrinkage only ever remove stock.
+func createAdjustment(c *gin.Context) {
+	var req struct {
+		ProductID string `json:"product_id" binding:"required"`
+		// Needed if the product is stocked in several warehouses
+		Warehouse string `json:"warehouse"`
+		Delta     int    `json:"delta"`
+		Count     *int   `json:"count" binding:"omitempty,min=0"`
+		Reason    string `json:"reason" binding:"required,oneof=damage shrinkage recount correction"`
+		Note      string `json:"note" binding:"max=500"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Count == nil) == (req.Delta == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either a non-zero delta or a count"})
+		return
+	}
+	if req.Count != nil && req.Reason != reasonRecount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count is only for recounts"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	filter, err := inventoryRow(ctx, req.ProductID, req.Warehouse)
+	if err != nil {
+		adjustmentError(c, err, "Failed to adjust inventory")
+		return
+	}
+	var inventory Inventory
+	if err := inventoryService.db.Collection("inventory").FindOne(ctx, filter).Decode(&inventory); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Inventory not found"})
+			return
+		}
+		adjustmentError(c, err, "Failed to adjust inventory")
+		return
+	}
+
+	delta := req.Delta
+	if req.Count != nil {
+		delta = *req.Count - inventory.Quantity
+	}
+	if delta > 0 && (req.Reason == reasonDamage || req.Reason == reasonShrinkage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": req.Reason + " can only remove stock"})
+		return
+	}
+	if delta == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Count matches stock, nothing to adjust"})
+		return
+	}
+
+	adj := Adjustment{
+		ID:        primitive.NewObjectID().Hex(),
+		ProductID: inventory.ProductID,
+		Warehouse: inventory.Warehouse,
+		Delta:     delta,
+		Reason:    req.Reason,
+		Note:      req.Note,
+		Actor:     c.GetString("user_id"),
+		Status:    adjustmentPending,
+		CreatedAt: time.Now(),
+	}
+	collection := inventoryService.db.Collection("inventory_adjustments")
+	if _, err := collection.InsertOne(ctx, adj); err != nil {
+		adjustmentError(c, err, "Failed to record adjustment")
+		return
+	}
+	if delta >= adjustmentApprovalThreshold() || -delta >= adjustmentApprovalThreshold() {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Adjustment awaits approval", "adjustment": adj})
+		return
+	}
+
+	if err := applyAdjustment(ctx, &adj); err != nil {
+		collection.DeleteOne(context.Background(), bson.M{"_id": adj.ID})
+		adjustmentError(c, err, "Failed to adjust inventory")
+		return
+	}
+	adj.Status = adjustmentApplied
+	adj.AppliedAt = &adj.CreatedAt
+	collection.UpdateOne(ctx, bson.M{"_id": adj.ID},
+		bson.M{"$set": bson.M{"status": adj.Status, "applied_at": adj.AppliedAt}})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Inventory adjusted", "adjustment": adj})
+}
+
+// decideAdjustment approves or rejects a pending adjustment. Nobody decides
+// on their own adjustment.
+func decideAdjustment(c *gin.Context, approve bool) {
+	var req struct {
+		Note string `json:"note" binding:"max=500"`
+	}
+	// The note is optional, and with it the body
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := inventoryService.db.Collection("inventory_adjustments")
+	var adj Adjustment
+	if err := collection.FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&adj); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Adjustment not found"})
+			return
+		}
+		adjustmentError(c, err, "Failed to fetch adjustment")
+		return
+	}
+	actor := c.GetString("user_id")
+	if adj.Actor == actor {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Adjustments must be decided by someone other than who made them"})
+		return
+	}
+
+	now := time.Now()
+	status := adjustmentRejected
+	set := bson.M{"decided_by": actor, "decision_note": req.Note, "decided_at": now}
+	if approve {
+		status = adjustmentApplied
+		set["applied_at"] = now
+	}
+	set["status"] = status
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": adj.ID, "status": adjustmentPending},
+		bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&adj)
+	if err == mongo.ErrNoDocuments {
+		err = errAdjustmentDecided
+	}
+	if err != nil {
+		adjustmentError(c, err, "Failed to update adjustment")
+		return
+	}
+
+	if approve {
+		if err := applyAdjustment(ctx, &adj); err != nil {
+			// Leave it pending to approve again once stock allows
+			collection.UpdateOne(context.Background(), bson.M{"_id": adj.ID, "status": adjustmentApplied},
+				bson.M{"$set": bson.M{"status": adjustmentPending},
+					"$unset": bson.M{"decided_by": "", "decision_note": "", "decided_at": "", "applied_at": ""}})
+			adjustmentError(c, err, "Failed to adjust inventory")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Adjustment " + status, "adjustment": adj})
+}
+
+func approveAdjustment(c *gin.Context) {
+	decideAdjustment(c, true)
+}
+
+func rejectAdjustment(c *gin.Context) {
+	decideAdjustment(c, false)
+}
+
+// listAdjustments answers GET /api/v1/inventory/adjustments, newest first,
+// filtered by ?status=, ?product_id= and ?warehouse=.
+func listAdjustments(c *gin.Context) {
+	filter := bson.M{}
+	for _, field := range []string{"status", "product_id", "warehouse"} {
+		if v := c.Query(field); v != "" {
+			filter[field] = v
+		}
+	}
+	cursor, err := inventoryService.db.Collection("inventory_adjustments").Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(200))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch adjustments"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	adjustments := []Adjustment{}
+	if err := cursor.All(context.Background(), &adjustments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode adjustments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"adjustments": adjustments, "count": len(adjustments)})
+}
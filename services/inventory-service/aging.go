@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AgingEntry describes how long stock has been sitting for one SKU in one
+// warehouse.
+type AgingEntry struct {
+	ProductID       string     `json:"product_id"`
+	Warehouse       string     `json:"warehouse"`
+	Quantity        int        `json:"quantity"`
+	FirstReceivedAt *time.Time `json:"first_received_at"`
+	LastReceivedAt  *time.Time `json:"last_received_at"`
+	LastSoldAt      *time.Time `json:"last_sold_at"`
+	DaysOnHand      int        `json:"days_on_hand"`
+	DaysSinceSale   *int       `json:"days_since_sale"`
+}
+
+// buildAgingReport joins current stock levels with the first receipt and
+// last sale found in the movement ledger.
+func buildAgingReport(ctx context.Context) ([]AgingEntry, error) {
+	pipeline := bson.A{
+		bson.M{"$group": bson.M{
+			"_id": bson.M{"product_id": "$product_id", "warehouse": "$warehouse"},
+			"first_received_at": bson.M{"$min": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$type", movementReceipt}}, "$created_at", nil,
+			}}},
+			"last_received_at": bson.M{"$max": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$type", movementReceipt}}, "$created_at", nil,
+			}}},
+			"last_sold_at": bson.M{"$max": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$type", movementSale}}, "$created_at", nil,
+			}}},
+		}},
+	}
+
+	cursor, err := inventoryService.db.Collection("inventory_movements").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		ID struct {
+			ProductID string `bson:"product_id"`
+			Warehouse string `bson:"warehouse"`
+		} `bson:"_id"`
+		FirstReceivedAt *time.Time `bson:"first_received_at"`
+		LastReceivedAt  *time.Time `bson:"last_received_at"`
+		LastSoldAt      *time.Time `bson:"last_sold_at"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	type key struct{ productID, warehouse string }
+	history := map[key]int{}
+	for i, row := range rows {
+		history[key{row.ID.ProductID, row.ID.Warehouse}] = i
+	}
+
+	invCursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer invCursor.Close(ctx)
+
+	var inventory []Inventory
+	if err := invCursor.All(ctx, &inventory); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	report := []AgingEntry{}
+	for _, inv := range inventory {
+		entry := AgingEntry{
+			ProductID: inv.ProductID,
+			Warehouse: inv.Warehouse,
+			Quantity:  inv.Quantity,
+		}
+
+		if i, ok := history[key{inv.ProductID, inv.Warehouse}]; ok {
+			entry.FirstReceivedAt = rows[i].FirstReceivedAt
+			entry.LastReceivedAt = rows[i].LastReceivedAt
+			entry.LastSoldAt = rows[i].LastSoldAt
+		}
+		if entry.FirstReceivedAt != nil {
+			entry.DaysOnHand = int(now.Sub(*entry.FirstReceivedAt).Hours() / 24)
+		}
+		if entry.LastSoldAt != nil {
+			days := int(now.Sub(*entry.LastSoldAt).Hours() / 24)
+			entry.DaysSinceSale = &days
+		}
+
+		report = append(report, entry)
+	}
+
+	return report, nil
+}
+
+// deadStock filters the aging report down to SKUs with more than minStock
+// units on hand and no sale in the last days days.
+func deadStock(report []AgingEntry, days, minStock int) []AgingEntry {
+	dead := []AgingEntry{}
+	for _, entry := range report {
+		if entry.Quantity <= minStock {
+			continue
+		}
+		if entry.DaysSinceSale != nil && *entry.DaysSinceSale < days {
+			continue
+		}
+		if entry.DaysSinceSale == nil && entry.DaysOnHand < days {
+			continue
+		}
+		dead = append(dead, entry)
+	}
+	return dead
+}
+
+func deadStockParams(c *gin.Context) (int, int) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "90"))
+	if err != nil || days < 1 {
+		days = 90
+	}
+	minStock, err := strconv.Atoi(c.DefaultQuery("min_stock", "0"))
+	if err != nil || minStock < 0 {
+		minStock = 0
+	}
+	return days, minStock
+}
+
+func getAgingReport(c *gin.Context) {
+	report, err := buildAgingReport(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build aging report"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": report,
+		"count": len(report),
+	})
+}
+
+func getDeadStockReport(c *gin.Context) {
+	days, minStock := deadStockParams(c)
+
+	report, err := buildAgingReport(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build aging report"})
+		return
+	}
+
+	dead := deadStock(report, days, minStock)
+	c.JSON(http.StatusOK, gin.H{
+		"days":      days,
+		"min_stock": minStock,
+		"items":     dead,
+		"count":     len(dead),
+	})
+}
+
+func promotionsServiceURL() string {
+	if url := os.Getenv("PROMOTIONS_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://promotion-service:8007"
+}
+
+// sendClearanceCandidates hands the current dead-stock SKUs to the
+// promotions service, which decides whether to run a clearance campaign.
+func sendClearanceCandidates(c *gin.Context) {
+	days, minStock := deadStockParams(c)
+
+	report, err := buildAgingReport(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build aging report"})
+		return
+	}
+
+	dead := deadStock(report, days, minStock)
+	body, _ := json.Marshal(gin.H{
+		"reason": fmt.Sprintf("no sales in %d days", days),
+		"items":  dead,
+	})
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost,
+		promotionsServiceURL()+"/api/v1/promotions/clearance-candidates", bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build request"})
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.GetHeader("Authorization"))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Promotions service unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Promotions service returned %d", resp.StatusCode)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Clearance candidates sent",
+		"count":   len(dead),
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Allocation picks the warehouses an order ships from and reserves its
+// stock there. Disabled warehouses and those not shipping to the
+// destination country are skipped; the rest are ranked by priority, then
+// by distance to the destination where both have coordinates. The best
+// warehouse able to supply the whole order does, so it ships in one
+// parcel. Failing that, each item takes what it can from each warehouse in
+// rank order, splitting the reservation.
+type AllocationRequest struct {
+	OrderID     string         `json:"order_id" binding:"required"`
+	Items       []dispatchLine `json:"items" binding:"required,min=1,dive"`
+	Destination Destination    `json:"destination"`
+	// How long to hold the stock, RESERVATION_TTL if unset
+	TTLSeconds int `json:"ttl_seconds" binding:"omitempty,min=1,max=86400"`
+	// Plan the allocation without reserving anything
+	DryRun bool `json:"dry_run"`
+}
+
+type Destination struct {
+	Country   string   `json:"country" binding:"omitempty,len=2"`
+	Latitude  *float64 `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude *float64 `json:"longitude" binding:"omitempty,min=-180,max=180"`
+}
+
+// Allocation is stock of a product to take from a warehouse.
+type Allocation struct {
+	ProductID string `json:"product_id"`
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+}
+
+// Shortfall is how much of a product no warehouse can supply.
+type Shortfall struct {
+	ProductID string `json:"product_id"`
+	Missing   int    `json:"missing"`
+}
+
+type rankedWarehouse struct {
+	code     string
+	priority int
+	// Kilometres, or +Inf when unknown
+	distance float64
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+func (w *Warehouse) shipsTo(country string) bool {
+	if country == "" || len(w.Countries) == 0 {
+		return true
+	}
+	for _, served := range w.Countries {
+		if strings.EqualFold(served, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// rankWarehouses orders the warehouses holding stock for the destination.
+func rankWarehouses(ctx context.Context, codes []string, dest Destination) ([]string, error) {
+	cursor, err := inventoryService.db.Collection("warehouses").Find(ctx, bson.M{"_id": bson.M{"$in": codes}})
+	if err != nil {
+		return nil, err
+	}
+	var described []Warehouse
+	if err := cursor.All(ctx, &described); err != nil {
+		return nil, err
+	}
+	byCode := make(map[string]*Warehouse, len(described))
+	for i := range described {
+		byCode[described[i].Code] = &described[i]
+	}
+
+	ranked := make([]rankedWarehouse, 0, len(codes))
+	for _, code := range codes {
+		entry := rankedWarehouse{code: code, priority: defaultWarehousePriority, distance: math.Inf(1)}
+		if w, ok := byCode[code]; ok {
+			if w.Disabled || !w.shipsTo(dest.Country) {
+				continue
+			}
+			entry.priority = w.Priority
+			if w.Latitude != nil && dest.Latitude != nil && dest.Longitude != nil {
+				entry.distance = distanceKm(*w.Latitude, *w.Longitude, *dest.Latitude, *dest.Longitude)
+			}
+		}
+		ranked = append(ranked, entry)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].priority != ranked[j].priority {
+			return ranked[i].priority < ranked[j].priority
+		}
+		if ranked[i].distance != ranked[j].distance {
+			return ranked[i].distance < ranked[j].distance
+		}
+		return ranked[i].code < ranked[j].code
+	})
+
+	order := make([]string, len(ranked))
+	for i, entry := range ranked {
+		order[i] = entry.code
+	}
+	return order, nil
+}
+
+// planAllocation decides where the items come from, listing what can't be
+// supplied if the stock falls short.
+func planAllocation(ctx context.Context, items []dispatchLine, dest Destination) ([]Allocation, []Shortfall, error) {
+	productIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	cursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{"product_id": bson.M{"$in": productIDs}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []Inventory
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, nil, err
+	}
+
+	// available[warehouse][product]
+	available := map[string]map[string]int{}
+	codes := []string{}
+	for _, row := range rows {
+		if available[row.Warehouse] == nil {
+			available[row.Warehouse] = map[string]int{}
+			codes = append(codes, row.Warehouse)
+		}
+		available[row.Warehouse][row.ProductID] += row.Quantity
+	}
+	order, err := rankWarehouses(ctx, codes, dest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allocations := []Allocation{}
+	for _, code := range order {
+		if canShip(available[code], items) {
+			for _, item := range items {
+				allocations = append(allocations, Allocation{ProductID: item.ProductID, Warehouse: code, Quantity: item.Quantity})
+			}
+			return allocations, nil, nil
+		}
+	}
+
+	shortfalls := []Shortfall{}
+	for _, item := range items {
+		remaining := item.Quantity
+		for _, code := range order {
+			take := available[code][item.ProductID]
+			if take > remaining {
+				take = remaining
+			}
+			if take <= 0 {
+				continue
+			}
+			available[code][item.ProductID] -= take
+			remaining -= take
+			allocations = append(allocations, Allocation{ProductID: item.ProductID, Warehouse: code, Quantity: take})
+		}
+		if remaining > 0 {
+			shortfalls = append(shortfalls, Shortfall{ProductID: item.ProductID, Missing: remaining})
+		}
+	}
+	return allocations, shortfalls, nil
+}
+
+// allocateInventory answers POST /api/v1/inventory/allocate, reserving the
+// order's items from the warehouses picked for them. Nothing is reserved
+// unless all of it can be.
+func allocateInventory(c *gin.Context) {
+	var req AllocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Destination.Latitude == nil) != (req.Destination.Longitude == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latitude and longitude go together"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	allocations, shortfalls, err := planAllocation(ctx, req.Items, req.Destination)
+	if err != nil {
+		reservationError(c, err, "Failed to allocate inventory")
+		return
+	}
+	if len(shortfalls) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient inventory", "shortfalls": shortfalls})
+		return
+	}
+	warehouses := map[string]bool{}
+	for _, a := range allocations {
+		warehouses[a.Warehouse] = true
+	}
+	if req.DryRun {
+		c.JSON(http.StatusOK, gin.H{"allocations": allocations, "split": len(warehouses) > 1})
+		return
+	}
+
+	ttl := reservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	var reservation *Reservation
+	for i, a := range allocations {
+		reservation, err = reserveStock(ctx, req.OrderID, a.ProductID, a.Warehouse, a.Quantity, ttl)
+		if err != nil {
+			// Stock moved since planning; undo what this allocation took
+			for _, done := range allocations[:i] {
+				settleStock(ctx, req.OrderID, done.ProductID, done.Warehouse, done.Quantity, false)
+			}
+			reservationError(c, err, "Failed to allocate inventory")
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Inventory allocated successfully",
+		"allocations": allocations,
+		"split":       len(warehouses) > 1,
+		"reservation": reservation,
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The availability endpoint backs stock badges on category pages, so it is
+// answered entirely from an in-memory projection of available quantity per
+// SKU, summed across warehouses. The projection is loaded once at start
+// and then follows the inventory collection's change stream. A full reload
+// every few minutes corrects any drift, and stands in for the change
+// stream on deployments where Mongo doesn't support one.
+const (
+	maxAvailabilitySKUs    = 100
+	availabilityRebuild    = 5 * time.Minute
+	availabilityPoll       = 5 * time.Second
+	availabilityRetryDelay = 5 * time.Second
+)
+
+type stockRow struct {
+	productID string
+	quantity  int
+}
+
+type availabilityProjection struct {
+	mu     sync.RWMutex
+	rows   map[string]stockRow
+	totals map[string]int
+	ready  bool
+}
+
+var availability = &availabilityProjection{}
+
+// lowStockThreshold is the level at or below which badges show a count,
+// from LOW_STOCK_THRESHOLD (default 5).
+func lowStockThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("LOW_STOCK_THRESHOLD")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+func startAvailabilityProjection() {
+	if err := availability.rebuild(context.Background()); err != nil {
+		log.Printf("Failed to load availability: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(availabilityRebuild) {
+			if err := availability.rebuild(context.Background()); err != nil {
+				log.Printf("Failed to rebuild availability: %v", err)
+			}
+		}
+	}()
+
+	go availability.follow(context.Background())
+}
+
+func (p *availabilityProjection) rebuild(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"product_id": 1, "quantity": 1})
+	cursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	var inventory []Inventory
+	if err := cursor.All(ctx, &inventory); err != nil {
+		return err
+	}
+
+	rows := make(map[string]stockRow, len(inventory))
+	totals := make(map[string]int, len(inventory))
+	for _, inv := range inventory {
+		rows[inv.ID] = stockRow{productID: inv.ProductID, quantity: inv.Quantity}
+		totals[inv.ProductID] += inv.Quantity
+	}
+
+	p.mu.Lock()
+	p.rows, p.totals, p.ready = rows, totals, true
+	p.mu.Unlock()
+	return nil
+}
+
+// follow applies inventory changes as they happen. When the change stream
+// can't be opened or breaks, the projection is polled until it can be
+// reopened.
+func (p *availabilityProjection) follow(ctx context.Context) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	for {
+		stream, err := inventoryService.db.Collection("inventory").Watch(ctx, mongo.Pipeline{}, opts)
+		if err != nil {
+			log.Printf("Inventory change stream unavailable, polling instead: %v", err)
+			p.poll(ctx, availabilityRebuild)
+			continue
+		}
+
+		// Catch up on anything that changed while the stream was closed
+		p.rebuild(ctx)
+
+		for stream.Next(ctx) {
+			var event struct {
+				OperationType string `bson:"operationType"`
+				DocumentKey   struct {
+					ID string `bson:"_id"`
+				} `bson:"documentKey"`
+				FullDocument *Inventory `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&event); err != nil {
+				log.Printf("Failed to decode inventory change: %v", err)
+				continue
+			}
+
+			if event.OperationType == "delete" || event.FullDocument == nil {
+				p.apply(event.DocumentKey.ID, nil)
+			} else {
+				p.apply(event.DocumentKey.ID, event.FullDocument)
+			}
+		}
+		log.Printf("Inventory change stream closed: %v", stream.Err())
+		stream.Close(ctx)
+		time.Sleep(availabilityRetryDelay)
+	}
+}
+
+// poll rebuilds the projection frequently for the given duration.
+func (p *availabilityProjection) poll(ctx context.Context, d time.Duration) {
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		time.Sleep(availabilityPoll)
+		if err := p.rebuild(ctx); err != nil {
+			log.Printf("Failed to rebuild availability: %v", err)
+		}
+	}
+}
+
+// apply replaces one inventory row, or removes it when inv is nil.
+func (p *availabilityProjection) apply(rowID string, inv *Inventory) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rows == nil {
+		return
+	}
+
+	if old, ok := p.rows[rowID]; ok {
+		p.totals[old.productID] -= old.quantity
+		if p.totals[old.productID] == 0 {
+			delete(p.totals, old.productID)
+		}
+		delete(p.rows, rowID)
+	}
+	if inv != nil {
+		p.rows[rowID] = stockRow{productID: inv.ProductID, quantity: inv.Quantity}
+		p.totals[inv.ProductID] += inv.Quantity
+	}
+}
+
+// getAvailability answers GET /api/v1/availability?skus=a,b,c. Exact counts
+// are only disclosed for low stock, for "only 3 left" badges.
+func getAvailability(c *gin.Context) {
+	var skus []string
+	seen := map[string]bool{}
+	for _, sku := range strings.Split(c.Query("skus"), ",") {
+		if sku = strings.TrimSpace(sku); sku != "" && !seen[sku] {
+			seen[sku] = true
+			skus = append(skus, sku)
+		}
+	}
+	if len(skus) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "skus is required"})
+		return
+	}
+	if len(skus) > maxAvailabilitySKUs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most 100 skus per request"})
+		return
+	}
+
+	threshold := lowStockThreshold()
+	result := make(gin.H, len(skus))
+
+	availability.mu.RLock()
+	ready := availability.ready
+	for _, sku := range skus {
+		quantity := availability.totals[sku]
+		entry := gin.H{"in_stock": quantity > 0, "low_stock": quantity > 0 && quantity <= threshold}
+		if quantity > 0 && quantity <= threshold {
+			entry["quantity"] = quantity
+		}
+		result[sku] = entry
+	}
+	availability.mu.RUnlock()
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Availability is loading"})
+		return
+	}
+
+	// Badges tolerate a few seconds of staleness, so let CDNs absorb traffic
+	c.Header("Cache-Control", "public, max-age=5")
+	c.JSON(http.StatusOK, gin.H{"availability": result})
+}
+
+// getStockLevels answers GET /api/v1/inventory/levels with the available
+// quantity of every product, for the product service to mirror. Products
+// without inventory are left out.
+func getStockLevels(c *gin.Context) {
+	availability.mu.RLock()
+	ready := availability.ready
+	levels := make(map[string]int, len(availability.totals))
+	for productID, quantity := range availability.totals {
+		levels[productID] = quantity
+	}
+	availability.mu.RUnlock()
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Availability is loading"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"levels": levels, "count": len(levels)})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DispatchSchedule is when a warehouse hands parcels to its carriers. An
+// order dispatches on the first working day whose carrier cutoff it makes;
+// weekends and holidays are skipped. Times are local to the warehouse.
+type DispatchSchedule struct {
+	Warehouse string          `bson:"_id" json:"warehouse"`
+	TimeZone  string          `bson:"time_zone" json:"time_zone" binding:"required"`
+	Carriers  []CarrierCutoff `bson:"carriers" json:"carriers" binding:"required,min=1,dive"`
+	// Days the warehouse ships, "mon" to "sun"; Monday to Friday when empty
+	WorkingDays []string `bson:"working_days,omitempty" json:"working_days,omitempty" binding:"dive,oneof=mon tue wed thu fri sat sun"`
+	// Dates the warehouse doesn't ship, as 2006-01-02
+	Holidays  []string  `bson:"holidays,omitempty" json:"holidays,omitempty" binding:"dive,datetime=2006-01-02"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// CarrierCutoff is the last time in the day a carrier collects. Countries
+// limits it to destinations it serves; empty means anywhere.
+type CarrierCutoff struct {
+	Carrier   string   `bson:"carrier" json:"carrier" binding:"required"`
+	Cutoff    string   `bson:"cutoff" json:"cutoff" binding:"required,datetime=15:04"`
+	Countries []string `bson:"countries,omitempty" json:"countries,omitempty"`
+}
+
+// DispatchEstimate is when an order placed now would leave the warehouse.
+type DispatchEstimate struct {
+	Warehouse    string    `json:"warehouse"`
+	Carrier      string    `json:"carrier"`
+	DispatchDate string    `json:"dispatch_date"`
+	CutoffAt     time.Time `json:"cutoff_at"`
+	SameDay      bool      `json:"same_day"`
+	// Seconds left to make CutoffAt
+	OrderWithin int64  `json:"order_within"`
+	Message     string `json:"message"`
+}
+
+// dispatchLookahead bounds the search for a dispatch day, so a schedule
+// with every day a holiday doesn't loop forever.
+const dispatchLookahead = 30
+
+var weekdayNames = map[time.Weekday]string{
+	time.Monday: "mon", time.Tuesday: "tue", time.Wednesday: "wed", time.Thursday: "thu",
+	time.Friday: "fri", time.Saturday: "sat", time.Sunday: "sun",
+}
+
+func (s *DispatchSchedule) shipsOn(day time.Time) bool {
+	date := day.Format("2006-01-02")
+	for _, holiday := range s.Holidays {
+		if holiday == date {
+			return false
+		}
+	}
+	if len(s.WorkingDays) == 0 {
+		return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+	}
+	for _, name := range s.WorkingDays {
+		if name == weekdayNames[day.Weekday()] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CarrierCutoff) serves(country string) bool {
+	if len(c.Countries) == 0 {
+		return true
+	}
+	for _, served := range c.Countries {
+		if strings.EqualFold(served, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextDispatch finds the earliest cutoff after now for a carrier serving
+// country. It returns false when none does within the lookahead.
+func (s *DispatchSchedule) nextDispatch(now time.Time, country string) (*DispatchEstimate, bool) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, false
+	}
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	for offset := 0; offset < dispatchLookahead; offset++ {
+		day := today.AddDate(0, 0, offset)
+		if !s.shipsOn(day) {
+			continue
+		}
+
+		var best *DispatchEstimate
+		for _, carrier := range s.Carriers {
+			if !carrier.serves(country) {
+				continue
+			}
+			cutoff, err := time.ParseInLocation("2006-01-02 15:04", day.Format("2006-01-02")+" "+carrier.Cutoff, loc)
+			if err != nil || !cutoff.After(now) {
+				continue
+			}
+			// The latest collection leaves the most time to order
+			if best == nil || cutoff.After(best.CutoffAt) {
+				best = &DispatchEstimate{
+					Warehouse:    s.Warehouse,
+					Carrier:      carrier.Carrier,
+					DispatchDate: day.Format("2006-01-02"),
+					CutoffAt:     cutoff,
+					SameDay:      offset == 0,
+				}
+			}
+		}
+		if best != nil {
+			best.OrderWithin = int64(best.CutoffAt.Sub(now).Seconds())
+			best.Message = dispatchMessage(best, now.In(loc))
+			return best, true
+		}
+	}
+	return nil, false
+}
+
+// dispatchMessage phrases an estimate for the storefront, e.g. "Order
+// within 2h 13m for same-day dispatch".
+func dispatchMessage(e *DispatchEstimate, now time.Time) string {
+	if e.SameDay {
+		left := e.CutoffAt.Sub(now).Truncate(time.Minute)
+		hours, minutes := int(left.Hours()), int(left.Minutes())%60
+		if hours == 0 {
+			return fmt.Sprintf("Order within %dm for same-day dispatch", minutes)
+		}
+		return fmt.Sprintf("Order within %dh %dm for same-day dispatch", hours, minutes)
+	}
+
+	day, _ := time.ParseInLocation("2006-01-02", e.DispatchDate, now.Location())
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	if day.Equal(tomorrow) {
+		return "Dispatched tomorrow"
+	}
+	return "Dispatched " + day.Format("Monday 2 January")
+}
+
+func putDispatchSchedule(c *gin.Context) {
+	var schedule DispatchSchedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := time.LoadLocation(schedule.TimeZone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time_zone"})
+		return
+	}
+
+	schedule.Warehouse = c.Param("warehouse")
+	schedule.UpdatedAt = time.Now()
+	sort.Strings(schedule.Holidays)
+
+	_, err := inventoryService.db.Collection("dispatch_schedules").ReplaceOne(context.Background(),
+		bson.M{"_id": schedule.Warehouse}, schedule, options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, schedule)
+}
+
+func listDispatchSchedules(c *gin.Context) {
+	cursor, err := inventoryService.db.Collection("dispatch_schedules").Find(context.Background(), bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	schedules := []DispatchSchedule{}
+	if err := cursor.All(context.Background(), &schedules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+func deleteDispatchSchedule(c *gin.Context) {
+	result, err := inventoryService.db.Collection("dispatch_schedules").DeleteOne(context.Background(), bson.M{"_id": c.Param("warehouse")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted"})
+}
+
+type dispatchLine struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  int    `json:"quantity" binding:"required,min=1"`
+}
+
+// estimateDispatch answers when a cart shipped to a country would be
+// dispatched. A cart ships from the warehouse that can send all of it
+// soonest; when no warehouse holds everything, each line ships from its
+// own best warehouse and the cart is dispatched when the last one is.
+func estimateDispatch(c *gin.Context) {
+	var req struct {
+		Items   []dispatchLine `json:"items" binding:"required,min=1,dive"`
+		Country string         `json:"country" binding:"required,len=2"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+
+	productIDs := make([]string, 0, len(req.Items))
+	for _, item := range req.Items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	cursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{"product_id": bson.M{"$in": productIDs}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		return
+	}
+	var rows []Inventory
+	if err := cursor.All(ctx, &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode inventory"})
+		return
+	}
+
+	// available[warehouse][product]; quantity is already net of reservations
+	available := map[string]map[string]int{}
+	for _, row := range rows {
+		if available[row.Warehouse] == nil {
+			available[row.Warehouse] = map[string]int{}
+		}
+		available[row.Warehouse][row.ProductID] += row.Quantity
+	}
+
+	cursor, err = inventoryService.db.Collection("dispatch_schedules").Find(ctx, bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+	var schedules []DispatchSchedule
+	if err := cursor.All(ctx, &schedules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode schedules"})
+		return
+	}
+
+	estimates := map[string]*DispatchEstimate{}
+	for i := range schedules {
+		if estimate, ok := schedules[i].nextDispatch(now, req.Country); ok {
+			estimates[schedules[i].Warehouse] = estimate
+		}
+	}
+
+	// Whole cart from one warehouse
+	var best *DispatchEstimate
+	for warehouse, estimate := range estimates {
+		if canShip(available[warehouse], req.Items) && (best == nil || estimate.CutoffAt.Before(best.CutoffAt)) {
+			best = estimate
+		}
+	}
+	if best != nil {
+		c.JSON(http.StatusOK, gin.H{"dispatch": best, "split": false})
+		return
+	}
+
+	// Split across warehouses; the slowest line decides
+	var latest *DispatchEstimate
+	for _, item := range req.Items {
+		var line *DispatchEstimate
+		for warehouse, estimate := range estimates {
+			if canShip(available[warehouse], []dispatchLine{item}) && (line == nil || estimate.CutoffAt.Before(line.CutoffAt)) {
+				line = estimate
+			}
+		}
+		if line == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not in stock at a warehouse that ships here", "product_id": item.ProductID})
+			return
+		}
+		if latest == nil || line.CutoffAt.After(latest.CutoffAt) {
+			latest = line
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dispatch": latest, "split": true})
+}
+
+func canShip(stock map[string]int, items []dispatchLine) bool {
+	need := map[string]int{}
+	for _, item := range items {
+		need[item.ProductID] += item.Quantity
+	}
+	for productID, quantity := range need {
+		if stock[productID] < quantity {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Stock changes are appended to a Redis stream (INVENTORY_EVENTS_STREAM,
+// default "events:inventory") for the product service, search indexer,
+// notification service and so on to consume with consumer groups, like
+// the product service's catalog events. Each entry has the fields id,
+// type, product_id, warehouse, occurred_at and data (a JSON object).
+// Reservations, releases and adjustments raise an event each, with the
+// order or adjustment in data.reference. A product's stock across
+// warehouses running out or coming back raises out_of_stock or
+// back_in_stock once, however many instances see it.
+const (
+	EventInventoryReserved    = "inventory.reserved"
+	EventInventoryReleased    = "inventory.released"
+	EventInventoryAdjusted    = "inventory.adjusted"
+	EventInventoryOutOfStock  = "inventory.out_of_stock"
+	EventInventoryBackInStock = "inventory.back_in_stock"
+	// Raised by the low stock check, see lowstock.go
+	EventInventoryLowStock = "inventory.low_stock"
+)
+
+// inventoryEventsMaxLen caps the stream; consumers that fall further behind
+// than this lose events.
+const inventoryEventsMaxLen = 1000000
+
+var redisClient *redis.Client
+
+func connectRedis() {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379/0"
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Fatalf("Invalid REDIS_URL: %v", err)
+	}
+	redisClient = redis.NewClient(opts)
+}
+
+func inventoryEventsStream() string {
+	if stream := os.Getenv("INVENTORY_EVENTS_STREAM"); stream != "" {
+		return stream
+	}
+	return "events:inventory"
+}
+
+// setupEvents registers the consumer groups named in
+// INVENTORY_EVENT_CONSUMERS (comma separated), so they receive events from
+// the first start on even before their consumers run.
+func setupEvents() {
+	for _, name := range strings.Split(os.Getenv("INVENTORY_EVENT_CONSUMERS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		err := redisClient.XGroupCreateMkStream(context.Background(), inventoryEventsStream(), name, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			log.Printf("Failed to register event consumer %s: %v", name, err)
+		}
+	}
+}
+
+// publishInventoryEvent emits an event. Publishing is best effort: a broker
+// outage is logged and never fails the request.
+func publishInventoryEvent(ctx context.Context, eventType, productID, warehouse string, data bson.M) {
+	if data == nil {
+		data = bson.M{}
+	}
+	payload, _ := json.Marshal(data)
+
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: inventoryEventsStream(),
+		MaxLen: inventoryEventsMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"id":          primitive.NewObjectID().Hex(),
+			"type":        eventType,
+			"product_id":  productID,
+			"warehouse":   warehouse,
+			"occurred_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"data":        string(payload),
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("Failed to publish %s for %s: %v", eventType, productID, err)
+	}
+}
+
+// publishMovement emits the event for a ledger movement, then checks
+// whether it ran the product out of stock or brought it back.
+func publishMovement(ctx context.Context, movement Movement) {
+	eventType := map[string]string{
+		movementReserve: EventInventoryReserved,
+		movementRelease: EventInventoryReleased,
+		movementAdjust:  EventInventoryAdjusted,
+	}[movement.Type]
+	if eventType != "" {
+		data := bson.M{"quantity": movement.Quantity, "reference": movement.Reference}
+		if movement.Reason != "" {
+			data["reason"] = movement.Reason
+			data["actor"] = movement.Actor
+		}
+		publishInventoryEvent(ctx, eventType, movement.ProductID, movement.Warehouse, data)
+	}
+	if movement.Type != movementSale {
+		stockChanged(ctx, movement.ProductID)
+	}
+}
+
+// stockChanged raises out_of_stock or back_in_stock if the product's
+// available stock crossed zero. The last state seen is kept in
+// stock_states and flipped with a conditional update, so only one caller
+// raises each change. The first time a product is seen only running out
+// is raised.
+func stockChanged(ctx context.Context, productID string) {
+	cursor, err := inventoryService.db.Collection("inventory").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"product_id": productID}},
+		bson.M{"$group": bson.M{"_id": nil, "quantity": bson.M{"$sum": "$quantity"}}},
+	})
+	if err != nil {
+		log.Printf("Failed to check stock of %s: %v", productID, err)
+		return
+	}
+	var totals []struct {
+		Quantity int `bson:"quantity"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		log.Printf("Failed to check stock of %s: %v", productID, err)
+		return
+	}
+	available := 0
+	if len(totals) > 0 {
+		available = totals[0].Quantity
+	}
+	inStock := available > 0
+
+	states := inventoryService.db.Collection("stock_states")
+	now := time.Now()
+	result, err := states.UpdateOne(ctx, bson.M{"_id": productID, "in_stock": !inStock},
+		bson.M{"$set": bson.M{"in_stock": inStock, "changed_at": now}})
+	if err != nil {
+		log.Printf("Failed to record stock state of %s: %v", productID, err)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		_, err := states.InsertOne(ctx, bson.M{"_id": productID, "in_stock": inStock, "changed_at": now})
+		if err != nil || inStock {
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				log.Printf("Failed to record stock state of %s: %v", productID, err)
+			}
+			return
+		}
+	}
+
+	eventType := EventInventoryOutOfStock
+	if inStock {
+		eventType = EventInventoryBackInStock
+	}
+	publishInventoryEvent(ctx, eventType, productID, "", bson.M{"available": available})
+}
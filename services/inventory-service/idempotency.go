@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reserve, release and commit are safe to retry. A request with an
+// Idempotency-Key header, or with the order_id and line_id of the order
+// line it's for, is carried out once: repeats get the original response,
+// marked Idempotent-Replayed, without moving stock again. Each line is
+// therefore reserved, released and committed at most once. Outcomes are
+// kept in inventory_operations for IDEMPOTENCY_TTL (default 24h), except
+// server errors, which can be retried. A key reused for a different
+// request is refused, and so is a repeat while the first is in progress.
+type IdempotentOperation struct {
+	Key         string    `bson:"_id"`
+	Operation   string    `bson:"operation"`
+	Fingerprint string    `bson:"fingerprint"`
+	Status      string    `bson:"status"`
+	StatusCode  int       `bson:"status_code,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+const (
+	operationProcessing = "processing"
+	operationCompleted  = "completed"
+)
+
+var idempotencyTTL = envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+// A request still processing after this long is taken to have died, and a
+// repeat carries it out instead
+const idempotencyLockTimeout = time.Minute
+
+func setupIdempotency() {
+	_, err := inventoryService.db.Collection("inventory_operations").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(idempotencyTTL.Seconds())),
+	})
+	if err != nil {
+		log.Printf("Failed to create idempotency index: %v", err)
+	}
+}
+
+// recordingWriter keeps a copy of the response body as it's written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyKey identifies the request's operation, or returns "" if it
+// has nothing to identify it by.
+func idempotencyKey(c *gin.Context, operation string, body []byte) string {
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		return "key:" + key
+	}
+	var line struct {
+		OrderID string `json:"order_id"`
+		LineID  string `json:"line_id"`
+	}
+	if json.Unmarshal(body, &line) == nil && line.OrderID != "" && line.LineID != "" {
+		return "line:" + operation + ":" + line.OrderID + ":" + line.LineID
+	}
+	return ""
+}
+
+// idempotent makes the handlers after it run at most once per key.
+func idempotent(operation string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := idempotencyKey(c, operation, body)
+		if key == "" {
+			c.Next()
+			return
+		}
+		sum := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		ctx := c.Request.Context()
+		collection := inventoryService.db.Collection("inventory_operations")
+		op := IdempotentOperation{
+			Key:         key,
+			Operation:   operation,
+			Fingerprint: fingerprint,
+			Status:      operationProcessing,
+			CreatedAt:   time.Now(),
+		}
+		if !claimOperation(c, op) {
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		// Leave failures on our side to be retried
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			if _, err := collection.DeleteOne(context.Background(), bson.M{"_id": key}); err != nil {
+				log.Printf("Failed to clear %s operation %s: %v", operation, key, err)
+			}
+			return
+		}
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{
+			"status":      operationCompleted,
+			"status_code": c.Writer.Status(),
+			"body":        writer.body.Bytes(),
+		}})
+		if err != nil {
+			log.Printf("Failed to record %s operation %s: %v", operation, key, err)
+		}
+	}
+}
+
+// claimOperation records that the request is being carried out, or, if its
+// key was seen before, writes the response for the repeat and returns
+// false.
+func claimOperation(c *gin.Context, op IdempotentOperation) bool {
+	ctx := c.Request.Context()
+	collection := inventoryService.db.Collection("inventory_operations")
+	_, err := collection.InsertOne(ctx, op)
+	if err == nil {
+		return true
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Failed to record %s operation %s: %v", op.Operation, op.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request"})
+		return false
+	}
+
+	var previous IdempotentOperation
+	if err := collection.FindOne(ctx, bson.M{"_id": op.Key}).Decode(&previous); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this key is in progress, retry shortly"})
+		return false
+	}
+	if previous.Fingerprint != op.Fingerprint {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "This key was already used for a different request"})
+		return false
+	}
+	if previous.Status == operationCompleted {
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(previous.StatusCode, "application/json; charset=utf-8", previous.Body)
+		return false
+	}
+
+	if time.Since(previous.CreatedAt) > idempotencyLockTimeout {
+		result, err := collection.ReplaceOne(ctx,
+			bson.M{"_id": op.Key, "status": operationProcessing, "created_at": previous.CreatedAt}, op)
+		if err == nil && result.MatchedCount > 0 {
+			return true
+		}
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "A request with this key is in progress, retry shortly"})
+	return false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InboundShipment is stock on its way to a warehouse: a purchase order from
+// a supplier or a transfer from another warehouse. Stock only becomes
+// available once the shipment is received. Transfers don't touch the source
+// warehouse here, that stock leaves through the usual adjustments when it
+// ships.
+type InboundShipment struct {
+	ID            string        `bson:"_id" json:"id"`
+	Type          string        `bson:"type" json:"type" binding:"required,oneof=purchase_order transfer"`
+	Reference     string        `bson:"reference" json:"reference"`
+	Supplier      string        `bson:"supplier,omitempty" json:"supplier,omitempty"`
+	FromWarehouse string        `bson:"from_warehouse,omitempty" json:"from_warehouse,omitempty"`
+	Warehouse     string        `bson:"warehouse" json:"warehouse" binding:"required"`
+	Lines         []InboundLine `bson:"lines" json:"lines" binding:"required,min=1,dive"`
+	ExpectedAt    time.Time     `bson:"expected_at" json:"expected_at" binding:"required"`
+	Status        string        `bson:"status" json:"status"`
+	CreatedAt     time.Time     `bson:"created_at" json:"created_at"`
+	ReceivedAt    *time.Time    `bson:"received_at,omitempty" json:"received_at,omitempty"`
+}
+
+type InboundLine struct {
+	ProductID string `bson:"product_id" json:"product_id" binding:"required"`
+	Quantity  int    `bson:"quantity" json:"quantity" binding:"required,min=1"`
+	// What each unit cost landed, averaged into the stock's unit cost
+	UnitCost float64 `bson:"unit_cost,omitempty" json:"unit_cost,omitempty" binding:"min=0"`
+	// One per unit for serialized products, see serials.go
+	Serials []string `bson:"serials,omitempty" json:"serials,omitempty" binding:"omitempty,dive,required"`
+}
+
+const (
+	inboundOpen      = "open"
+	inboundReceived  = "received"
+	inboundCancelled = "cancelled"
+)
+
+// restockBuffer is added to a shipment's expected date to allow for
+// receiving and putaway before stock is sellable, from RESTOCK_ETA_BUFFER
+// (default 48h).
+func restockBuffer() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("RESTOCK_ETA_BUFFER")); err == nil && d >= 0 {
+		return d
+	}
+	return 48 * time.Hour
+}
+
+func createInboundShipment(c *gin.Context) {
+	var shipment InboundShipment
+	if err := c.ShouldBindJSON(&shipment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if shipment.Type == "transfer" && shipment.FromWarehouse == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from_warehouse is required for transfers"})
+		return
+	}
+	for _, line := range shipment.Lines {
+		if len(line.Serials) > 0 && len(line.Serials) != line.Quantity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Serials of " + line.ProductID + " don't match its quantity"})
+			return
+		}
+	}
+	serial, err := checkNewSerials(context.Background(), shipment.Lines)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check serials"})
+		return
+	}
+	if serial != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Serial " + serial + " is listed twice or already in stock"})
+		return
+	}
+
+	shipment.ID = primitive.NewObjectID().Hex()
+	shipment.Status = inboundOpen
+	shipment.CreatedAt = time.Now()
+	shipment.ReceivedAt = nil
+
+	if _, err := inventoryService.db.Collection("inbound_shipments").InsertOne(context.Background(), shipment); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, shipment)
+}
+
+func listInboundShipments(c *gin.Context) {
+	filter := bson.M{}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	if productID := c.Query("product_id"); productID != "" {
+		filter["lines.product_id"] = productID
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "expected_at", Value: 1}}).SetLimit(200)
+	cursor, err := inventoryService.db.Collection("inbound_shipments").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shipments"})
+		return
+	}
+
+	shipments := []InboundShipment{}
+	if err := cursor.All(context.Background(), &shipments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode shipments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shipments": shipments, "count": len(shipments)})
+}
+
+// receiveInboundShipment books an arrived shipment into the destination
+// warehouse's stock.
+func receiveInboundShipment(c *gin.Context) {
+	now := time.Now()
+	var shipment InboundShipment
+	err := inventoryService.db.Collection("inbound_shipments").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": c.Param("id"), "status": inboundOpen},
+		bson.M{"$set": bson.M{"status": inboundReceived, "received_at": now}},
+	).Decode(&shipment)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open shipment not found"})
+		return
+	}
+
+	collection := inventoryService.db.Collection("inventory")
+	for _, line := range shipment.Lines {
+		var update interface{} = bson.M{
+			"$inc":         bson.M{"quantity": line.Quantity},
+			"$set":         bson.M{"updated_at": now},
+			"$setOnInsert": bson.M{"reserved": 0},
+		}
+		if line.UnitCost > 0 {
+			update = receiptWithCost(line, now)
+		}
+		_, err := collection.UpdateOne(context.Background(),
+			bson.M{"product_id": line.ProductID, "warehouse": shipment.Warehouse},
+			update,
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to receive " + line.ProductID})
+			return
+		}
+
+		if err := registerSerials(context.Background(), line, shipment.Warehouse, shipment.ID, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register serials of " + line.ProductID})
+			return
+		}
+
+		recordMovement(context.Background(), Movement{
+			ProductID: line.ProductID,
+			Warehouse: shipment.Warehouse,
+			Type:      movementReceipt,
+			Quantity:  line.Quantity,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Shipment received successfully"})
+}
+
+// receiptWithCost books a line in and averages its cost with that of the
+// stock already on hand, in one update so concurrent receipts can't
+// interleave.
+func receiptWithCost(line InboundLine, now time.Time) bson.A {
+	quantity := bson.M{"$ifNull": bson.A{"$quantity", 0}}
+	reserved := bson.M{"$ifNull": bson.A{"$reserved", 0}}
+	onHand := bson.M{"$add": bson.A{quantity, reserved}}
+	averaged := bson.M{"$cond": bson.A{
+		bson.M{"$and": bson.A{bson.M{"$gt": bson.A{onHand, 0}}, bson.M{"$gt": bson.A{"$unit_cost", 0}}}},
+		bson.M{"$divide": bson.A{
+			bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{onHand, "$unit_cost"}}, float64(line.Quantity) * line.UnitCost}},
+			bson.M{"$add": bson.A{onHand, line.Quantity}},
+		}},
+		line.UnitCost,
+	}}
+	return bson.A{bson.M{"$set": bson.M{
+		"quantity":   bson.M{"$add": bson.A{quantity, line.Quantity}},
+		"reserved":   reserved,
+		"unit_cost":  averaged,
+		"updated_at": now,
+	}}}
+}
+
+func cancelInboundShipment(c *gin.Context) {
+	result, err := inventoryService.db.Collection("inbound_shipments").UpdateOne(context.Background(),
+		bson.M{"_id": c.Param("id"), "status": inboundOpen},
+		bson.M{"$set": bson.M{"status": inboundCancelled}})
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open shipment not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Shipment cancelled successfully"})
+}
+
+// getRestockETA estimates when an out-of-stock product will be sellable
+// again from the earliest open shipment that includes it. Overdue
+// shipments are assumed to arrive today.
+func getRestockETA(c *gin.Context) {
+	productID := c.Param("productId")
+
+	var shipment InboundShipment
+	err := inventoryService.db.Collection("inbound_shipments").FindOne(context.Background(),
+		bson.M{"status": inboundOpen, "lines.product_id": productID},
+		options.FindOne().SetSort(bson.D{{Key: "expected_at", Value: 1}}),
+	).Decode(&shipment)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No restock scheduled"})
+		return
+	}
+
+	arrival := shipment.ExpectedAt
+	if arrival.Before(time.Now()) {
+		arrival = time.Now()
+	}
+
+	quantity := 0
+	for _, line := range shipment.Lines {
+		if line.ProductID == productID {
+			quantity += line.Quantity
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product_id":  productID,
+		"restock_eta": arrival.Add(restockBuffer()),
+		"quantity":    quantity,
+		"source":      shipment.Type,
+	})
+}
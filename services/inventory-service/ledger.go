@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Movement is an entry in the inventory movement ledger. Quantity is the
+// signed change to on-hand stock; reservations move stock between quantity
+// and reserved and are recorded with the reserved amount.
+type Movement struct {
+	ID        string    `bson:"_id,omitempty" json:"id"`
+	ProductID string    `bson:"product_id" json:"product_id"`
+	Warehouse string    `bson:"warehouse" json:"warehouse"`
+	Type      string    `bson:"type" json:"type"`
+	Quantity  int       `bson:"quantity" json:"quantity"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// Why and who, on adjustments, and the adjustment or order it's for
+	Reason    string `bson:"reason,omitempty" json:"reason,omitempty"`
+	Actor     string `bson:"actor,omitempty" json:"actor,omitempty"`
+	Reference string `bson:"reference,omitempty" json:"reference,omitempty"`
+}
+
+const (
+	movementReceipt = "receipt"
+	movementReserve = "reserve"
+	movementRelease = "release"
+	movementAdjust  = "adjust"
+	movementSale    = "sale"
+)
+
+func recordMovement(ctx context.Context, movement Movement) {
+	movement.CreatedAt = time.Now()
+
+	collection := inventoryService.db.Collection("inventory_movements")
+	if _, err := collection.InsertOne(ctx, movement); err != nil {
+		log.Printf("Failed to record %s movement for %s: %v", movement.Type, movement.ProductID, err)
+	}
+	publishMovement(ctx, movement)
+}
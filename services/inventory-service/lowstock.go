@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reorder thresholds flag products to restock. A threshold is set for a
+// product in one warehouse, or for its stock across all of them. Every
+// LOW_STOCK_CHECK_INTERVAL (default 1m) available stock is checked against
+// them, and each one it drops below raises one alert, which isn't repeated
+// until stock recovers. Alerts are published as inventory.low_stock
+// events, see events.go, emailed to LOW_STOCK_ALERT_EMAILS (comma
+// separated) through the notification service, and posted to
+// LOW_STOCK_WEBHOOK_URL, signed with LOW_STOCK_WEBHOOK_SECRET if set. Delivery is best effort: an alert that
+// fails to send is logged and not retried.
+type ReorderThreshold struct {
+	ID        string `bson:"_id" json:"-"`
+	ProductID string `bson:"product_id" json:"product_id"`
+	// Empty for the product's stock across warehouses
+	Warehouse string `bson:"warehouse" json:"warehouse"`
+	// The reorder point; 0 leaves the stock unwatched
+	Threshold int `bson:"threshold" json:"threshold"`
+	// Held back from what can be promised, see replenishment.go
+	SafetyStock int `bson:"safety_stock" json:"safety_stock"`
+	// How much to order when stock drops below the threshold
+	ReorderQuantity int `bson:"reorder_quantity" json:"reorder_quantity"`
+	// When the alert went out, while stock stays below the threshold
+	AlertedAt *time.Time `bson:"alerted_at,omitempty" json:"alerted_at,omitempty"`
+	UpdatedAt time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// LowStockItem is stock below its reorder threshold.
+type LowStockItem struct {
+	ProductID string     `json:"product_id"`
+	Warehouse string     `json:"warehouse,omitempty"`
+	Available int        `json:"available"`
+	Threshold int        `json:"threshold"`
+	AlertedAt *time.Time `json:"alerted_at,omitempty"`
+
+	safetyStock     int
+	reorderQuantity int
+}
+
+const (
+	// Thresholds checked per inventory query
+	thresholdBatch = 500
+)
+
+var lowStockCheckInterval = envDuration("LOW_STOCK_CHECK_INTERVAL", time.Minute)
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+func thresholdID(productID, warehouse string) string {
+	return productID + "/" + warehouse
+}
+
+func startLowStockChecker() {
+	go func() {
+		for range time.Tick(lowStockCheckInterval) {
+			if n, err := runLowStockCheck(context.Background()); err != nil {
+				log.Printf("Low stock check failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Raised %d low stock alerts", n)
+			}
+		}
+	}()
+}
+
+// checkThresholds compares stock with the thresholds matching filter,
+// returning those it's below and, separately, those it isn't.
+func checkThresholds(ctx context.Context, filter bson.M) ([]LowStockItem, []ReorderThreshold, error) {
+	cursor, err := inventoryService.db.Collection("reorder_thresholds").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	low := []LowStockItem{}
+	var stocked []ReorderThreshold
+	var batch []ReorderThreshold
+	check := func() error {
+		productIDs := make([]string, 0, len(batch))
+		for _, t := range batch {
+			productIDs = append(productIDs, t.ProductID)
+		}
+		rows, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{"product_id": bson.M{"$in": productIDs}})
+		if err != nil {
+			return err
+		}
+		var inventory []Inventory
+		if err := rows.All(ctx, &inventory); err != nil {
+			return err
+		}
+		available := map[string]int{}
+		for _, row := range inventory {
+			if row.Warehouse != "" {
+				available[thresholdID(row.ProductID, row.Warehouse)] += row.Quantity
+			}
+			available[thresholdID(row.ProductID, "")] += row.Quantity
+		}
+
+		for _, t := range batch {
+			if n := available[t.ID]; n < t.Threshold {
+				low = append(low, LowStockItem{
+					ProductID: t.ProductID,
+					Warehouse: t.Warehouse,
+					Available: n,
+					Threshold: t.Threshold,
+					AlertedAt: t.AlertedAt,
+
+					safetyStock:     t.SafetyStock,
+					reorderQuantity: t.ReorderQuantity,
+				})
+			} else {
+				stocked = append(stocked, t)
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var t ReorderThreshold
+		if err := cursor.Decode(&t); err != nil {
+			return nil, nil, err
+		}
+		batch = append(batch, t)
+		if len(batch) >= thresholdBatch {
+			if err := check(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(batch) > 0 {
+		if err := check(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return low, stocked, nil
+}
+
+// runLowStockCheck raises alerts for stock newly below its threshold and
+// rearms those of stock that recovered, returning how many were raised.
+// Alerts are claimed with a conditional update, so with several instances
+// running only one sends each.
+func runLowStockCheck(ctx context.Context) (int, error) {
+	low, stocked, err := checkThresholds(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	collection := inventoryService.db.Collection("reorder_thresholds")
+
+	for _, t := range stocked {
+		if t.AlertedAt == nil {
+			continue
+		}
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": t.ID, "alerted_at": t.AlertedAt},
+			bson.M{"$unset": bson.M{"alerted_at": ""}})
+		if err != nil {
+			log.Printf("Failed to rearm low stock alert for %s: %v", t.ID, err)
+		}
+	}
+
+	alerts := []LowStockItem{}
+	for _, item := range low {
+		if item.AlertedAt != nil {
+			continue
+		}
+		now := time.Now()
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": thresholdID(item.ProductID, item.Warehouse), "alerted_at": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"alerted_at": now}})
+		if err != nil {
+			log.Printf("Failed to claim low stock alert for %s: %v", item.ProductID, err)
+			continue
+		}
+		if result.ModifiedCount > 0 {
+			item.AlertedAt = &now
+			alerts = append(alerts, item)
+		}
+	}
+	if len(alerts) > 0 {
+		sendLowStockAlerts(ctx, alerts)
+		suggestPurchases(ctx, alerts)
+	}
+	return len(alerts), nil
+}
+
+// sendLowStockAlerts delivers alerts on every configured channel.
+func sendLowStockAlerts(ctx context.Context, alerts []LowStockItem) {
+	for _, item := range alerts {
+		publishInventoryEvent(ctx, EventInventoryLowStock, item.ProductID, item.Warehouse,
+			bson.M{"available": item.Available, "threshold": item.Threshold})
+	}
+
+	if recipients := os.Getenv("LOW_STOCK_ALERT_EMAILS"); recipients != "" {
+		subject, body := lowStockEmail(alerts)
+		for _, to := range strings.Split(recipients, ",") {
+			if to = strings.TrimSpace(to); to == "" {
+				continue
+			}
+			if err := sendEmail(ctx, to, subject, body); err != nil {
+				log.Printf("Failed to email low stock alert to %s: %v", to, err)
+			}
+		}
+	}
+
+	if url := os.Getenv("LOW_STOCK_WEBHOOK_URL"); url != "" {
+		if err := postLowStockWebhook(ctx, url, alerts); err != nil {
+			log.Printf("Failed to post low stock webhook: %v", err)
+		}
+	}
+}
+
+func lowStockEmail(alerts []LowStockItem) (string, string) {
+	var body strings.Builder
+	body.WriteString("Stock has dropped below its reorder threshold:\n\n")
+	for _, item := range alerts {
+		where := "all warehouses"
+		if item.Warehouse != "" {
+			where = item.Warehouse
+		}
+		fmt.Fprintf(&body, "- %s (%s): %d available, threshold %d\n", item.ProductID, where, item.Available, item.Threshold)
+	}
+	return fmt.Sprintf("Low stock: %d items below reorder threshold", len(alerts)), body.String()
+}
+
+// postLowStockWebhook posts the alerts as JSON. With a secret, the body's
+// HMAC-SHA256 is sent hex encoded in X-Signature.
+func postLowStockWebhook(ctx context.Context, url string, alerts []LowStockItem) error {
+	payload, _ := json.Marshal(gin.H{"type": EventInventoryLowStock, "items": alerts})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := os.Getenv("LOW_STOCK_WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func notificationServiceURL() string {
+	if url := os.Getenv("NOTIFICATION_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://notification-service:8008"
+}
+
+func sendEmail(ctx context.Context, to, subject, body string) error {
+	payload, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"subject": subject,
+		"body":    body,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notificationServiceURL()+"/api/v1/notifications/email", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// putReorderThreshold sets the product's reorder point, safety stock and
+// reorder quantity in the warehouse given, or across warehouses if none is.
+func putReorderThreshold(c *gin.Context) {
+	var req struct {
+		Warehouse       string `json:"warehouse"`
+		Threshold       int    `json:"threshold" binding:"min=0"`
+		SafetyStock     int    `json:"safety_stock" binding:"min=0"`
+		ReorderQuantity int    `json:"reorder_quantity" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Threshold == 0 && req.SafetyStock == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set a threshold, safety stock or both"})
+		return
+	}
+
+	productID := c.Param("productId")
+	var threshold ReorderThreshold
+	err := inventoryService.db.Collection("reorder_thresholds").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": thresholdID(productID, req.Warehouse)},
+		bson.M{"$set": bson.M{
+			"product_id":       productID,
+			"warehouse":        req.Warehouse,
+			"threshold":        req.Threshold,
+			"safety_stock":     req.SafetyStock,
+			"reorder_quantity": req.ReorderQuantity,
+			"updated_at":       time.Now(),
+		}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&threshold)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save threshold"})
+		return
+	}
+
+	c.JSON(http.StatusOK, threshold)
+}
+
+func deleteReorderThreshold(c *gin.Context) {
+	result, err := inventoryService.db.Collection("reorder_thresholds").DeleteOne(context.Background(),
+		bson.M{"_id": thresholdID(c.Param("productId"), c.Query("warehouse"))})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete threshold"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Threshold not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Threshold deleted"})
+}
+
+// listReorderThresholds answers GET /api/v1/inventory/thresholds, for one
+// product with ?product_id=.
+func listReorderThresholds(c *gin.Context) {
+	filter := bson.M{}
+	if productID := c.Query("product_id"); productID != "" {
+		filter["product_id"] = productID
+	}
+	cursor, err := inventoryService.db.Collection("reorder_thresholds").Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch thresholds"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	thresholds := []ReorderThreshold{}
+	if err := cursor.All(context.Background(), &thresholds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode thresholds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"thresholds": thresholds})
+}
+
+// getLowStock answers GET /api/v1/inventory/low-stock with everything
+// currently below its threshold, in one warehouse with ?warehouse=.
+func getLowStock(c *gin.Context) {
+	filter := bson.M{}
+	if warehouse := c.Query("warehouse"); warehouse != "" {
+		filter["warehouse"] = warehouse
+	}
+	low, _, err := checkThresholds(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check stock"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": low, "count": len(low)})
+}
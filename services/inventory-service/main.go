@@ -15,11 +15,13 @@ import (
 
 type Inventory struct {
 	ID        string    `bson:"_id,omitempty" json:"id"`
-	ProductID string    `bson:"product_id" json:"product_id"`
+	ProductID string    `bson:"product_id" json:"product_id" binding:"required"`
 	Quantity  int       `bson:"quantity" json:"quantity"`
 	Reserved  int       `bson:"reserved" json:"reserved"`
-	Warehouse string    `bson:"warehouse" json:"warehouse"`
+	Warehouse string    `bson:"warehouse" json:"warehouse" binding:"required"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	// Average cost of a unit on hand, for valuation
+	UnitCost float64 `bson:"unit_cost" json:"unit_cost" binding:"min=0"`
 }
 
 type InventoryService struct {
@@ -45,17 +47,20 @@ func main() {
 
 	db := client.Database("ecommerce")
 	inventoryService = &InventoryService{db: db}
+	verifier = newTokenVerifier()
+	connectRedis()
+	setupEvents()
+
+	startAvailabilityProjection()
+	startReservationSweeper()
+	setupIdempotency()
+	setupInventoryIndexes()
+	startLowStockChecker()
+	startSnapshots()
+	setupSerials()
 
 	router := gin.Default()
-
-	router.GET("/health", healthCheck)
-	router.GET("/ready", readinessCheck)
-
-	router.GET("/api/v1/inventory/:productId", getInventory)
-	router.POST("/api/v1/inventory", createInventory)
-	router.PUT("/api/v1/inventory/:productId/reserve", reserveInventory)
-	router.PUT("/api/v1/inventory/:productId/release", releaseInventory)
-	router.PUT("/api/v1/inventory/:productId/update", updateInventory)
+	setupRoutes(router)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -68,6 +73,76 @@ func main() {
 	}
 }
 
+// setupRoutes registers every route, with the middleware guarding it.
+func setupRoutes(router *gin.Engine) {
+	router.GET("/health", healthCheck)
+	router.GET("/ready", readinessCheck)
+
+	// Storefront stock badges and product stock levels, served from memory
+	router.GET("/api/v1/availability", getAvailability)
+	router.GET("/api/v1/inventory/levels", getStockLevels)
+
+	// Stock is reserved, released and committed by the order service,
+	// with a service token carrying inventory:reserve
+	router.GET("/api/v1/inventory/:productId", getInventory)
+	router.POST("/api/v1/inventory", scopedAuthMiddleware, requirePermission("inventory:manage"), createInventory)
+	router.POST("/api/v1/inventory/reserve", scopedAuthMiddleware, requirePermission("inventory:reserve"), idempotent("reserve-items"), reserveInventoryItems)
+	router.PUT("/api/v1/inventory/:productId/reserve", scopedAuthMiddleware, requirePermission("inventory:reserve"), idempotent("reserve"), reserveInventory)
+	router.PUT("/api/v1/inventory/:productId/release", scopedAuthMiddleware, requirePermission("inventory:reserve"), idempotent("release"), releaseInventory)
+	router.PUT("/api/v1/inventory/:productId/commit", scopedAuthMiddleware, requirePermission("inventory:reserve"), idempotent("commit"), commitInventory)
+
+	// Adjustment Routes
+	router.POST("/api/v1/inventory/adjustments", scopedAuthMiddleware, requirePermission("inventory:adjust"), createAdjustment)
+	router.GET("/api/v1/inventory/adjustments", scopedAuthMiddleware, requirePermission("inventory:read"), listAdjustments)
+	router.POST("/api/v1/inventory/adjustments/:id/approve", scopedAuthMiddleware, requirePermission("inventory:approve"), approveAdjustment)
+	router.POST("/api/v1/inventory/adjustments/:id/reject", scopedAuthMiddleware, requirePermission("inventory:approve"), rejectAdjustment)
+
+	// Warehouse Routes
+	router.GET("/api/v1/inventory/warehouses", listWarehouses)
+	router.PUT("/api/v1/inventory/warehouses/:code", scopedAuthMiddleware, requirePermission("inventory:manage"), putWarehouse)
+	router.DELETE("/api/v1/inventory/warehouses/:code", scopedAuthMiddleware, requirePermission("inventory:manage"), deleteWarehouse)
+	router.POST("/api/v1/inventory/allocate", scopedAuthMiddleware, requirePermission("inventory:reserve"), idempotent("allocate"), allocateInventory)
+
+	// Low Stock Routes
+	router.GET("/api/v1/inventory/low-stock", getLowStock)
+	router.GET("/api/v1/inventory/thresholds", listReorderThresholds)
+	router.PUT("/api/v1/inventory/:productId/threshold", scopedAuthMiddleware, requirePermission("inventory:manage"), putReorderThreshold)
+	router.DELETE("/api/v1/inventory/:productId/threshold", scopedAuthMiddleware, requirePermission("inventory:manage"), deleteReorderThreshold)
+	router.GET("/api/v1/inventory/:productId/atp", getAvailableToPromise)
+	router.GET("/api/v1/inventory/purchase-suggestions", listPurchaseSuggestions)
+	router.POST("/api/v1/inventory/purchase-suggestions/:id/accept", scopedAuthMiddleware, requirePermission("inventory:manage"), acceptPurchaseSuggestion)
+	router.POST("/api/v1/inventory/purchase-suggestions/:id/dismiss", scopedAuthMiddleware, requirePermission("inventory:manage"), dismissPurchaseSuggestion)
+
+	// Reservation Routes
+	router.GET("/api/v1/inventory/reservations/:orderId", getReservation)
+	router.DELETE("/api/v1/inventory/reservations/:orderId", scopedAuthMiddleware, requirePermission("inventory:reserve"), cancelReservation)
+	router.POST("/api/v1/inventory/reservations/:orderId/commit", scopedAuthMiddleware, requirePermission("inventory:reserve"), commitReservation)
+	router.GET("/api/v1/inventory/reservations/:orderId/serials", listOrderSerials)
+	router.POST("/api/v1/inventory/reservations/:orderId/serials", scopedAuthMiddleware, requirePermission("inventory:adjust"), reserveOrderSerials)
+	router.GET("/api/v1/inventory/serials/:serial", lookupSerial)
+
+	// Inbound Routes
+	router.POST("/api/v1/inventory/inbound", scopedAuthMiddleware, requirePermission("inventory:manage"), createInboundShipment)
+	router.GET("/api/v1/inventory/inbound", listInboundShipments)
+	router.PUT("/api/v1/inventory/inbound/:id/receive", scopedAuthMiddleware, requirePermission("inventory:receive"), receiveInboundShipment)
+	router.PUT("/api/v1/inventory/inbound/:id/cancel", scopedAuthMiddleware, requirePermission("inventory:manage"), cancelInboundShipment)
+	router.GET("/api/v1/inventory/:productId/restock", getRestockETA)
+
+	// Dispatch Routes
+	router.POST("/api/v1/inventory/dispatch/estimate", estimateDispatch)
+	router.GET("/api/v1/inventory/dispatch/schedules", listDispatchSchedules)
+	router.PUT("/api/v1/inventory/dispatch/schedules/:warehouse", scopedAuthMiddleware, requirePermission("inventory:manage"), putDispatchSchedule)
+	router.DELETE("/api/v1/inventory/dispatch/schedules/:warehouse", scopedAuthMiddleware, requirePermission("inventory:manage"), deleteDispatchSchedule)
+
+	// Report Routes
+	router.GET("/api/v1/inventory/reports/snapshots", getStockHistory)
+	router.GET("/api/v1/inventory/reports/valuation", getValuation)
+	router.PUT("/api/v1/inventory/:productId/cost", scopedAuthMiddleware, requirePermission("inventory:manage"), setUnitCost)
+	router.GET("/api/v1/inventory/reports/aging", getAgingReport)
+	router.GET("/api/v1/inventory/reports/dead-stock", getDeadStockReport)
+	router.POST("/api/v1/inventory/reports/dead-stock/clearance", scopedAuthMiddleware, requirePermission("inventory:manage"), sendClearanceCandidates)
+}
+
 func healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status": "healthy",
@@ -95,18 +170,44 @@ func readinessCheck(c *gin.Context) {
 	})
 }
 
+// getInventory returns the product's stock across warehouses, or its row
+// in one with ?warehouse=.
 func getInventory(c *gin.Context) {
 	productID := c.Param("productId")
 	collection := inventoryService.db.Collection("inventory")
 
-	var inventory Inventory
-	err := collection.FindOne(context.Background(), bson.M{"product_id": productID}).Decode(&inventory)
+	if warehouse := c.Query("warehouse"); warehouse != "" {
+		var inventory Inventory
+		err := collection.FindOne(context.Background(), bson.M{"product_id": productID, "warehouse": warehouse}).Decode(&inventory)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Inventory not found"})
+			return
+		}
+		c.JSON(http.StatusOK, inventory)
+		return
+	}
+
+	cursor, err := collection.Find(context.Background(), bson.M{"product_id": productID},
+		options.Find().SetSort(bson.D{{Key: "warehouse", Value: 1}}))
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		return
+	}
+	stock := ProductStock{ProductID: productID}
+	if err := cursor.All(context.Background(), &stock.Warehouses); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode inventory"})
+		return
+	}
+	if len(stock.Warehouses) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Inventory not found"})
 		return
 	}
+	for _, row := range stock.Warehouses {
+		stock.Quantity += row.Quantity
+		stock.Reserved += row.Reserved
+	}
 
-	c.JSON(http.StatusOK, inventory)
+	c.JSON(http.StatusOK, stock)
 }
 
 func createInventory(c *gin.Context) {
@@ -119,11 +220,22 @@ func createInventory(c *gin.Context) {
 	inventory.UpdatedAt = time.Now()
 	collection := inventoryService.db.Collection("inventory")
 	result, err := collection.InsertOne(context.Background(), inventory)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Inventory for this product already exists in this warehouse"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create inventory"})
 		return
 	}
 
+	recordMovement(context.Background(), Movement{
+		ProductID: inventory.ProductID,
+		Warehouse: inventory.Warehouse,
+		Type:      movementReceipt,
+		Quantity:  inventory.Quantity,
+	})
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Inventory created successfully",
 		"inventory_id": result.InsertedID,
@@ -133,7 +245,13 @@ func createInventory(c *gin.Context) {
 func reserveInventory(c *gin.Context) {
 	productID := c.Param("productId")
 	var req struct {
-		Quantity int `json:"quantity" binding:"required"`
+		OrderID  string `json:"order_id" binding:"required"`
+		Quantity int    `json:"quantity" binding:"required,min=1"`
+		// Any warehouse with enough if unset; see allocation.go for
+		// choosing by priority and distance
+		Warehouse string `json:"warehouse"`
+		// How long to hold the stock, RESERVATION_TTL if unset
+		TTLSeconds int `json:"ttl_seconds" binding:"omitempty,min=1,max=86400"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -141,31 +259,28 @@ func reserveInventory(c *gin.Context) {
 		return
 	}
 
-	collection := inventoryService.db.Collection("inventory")
-	result, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"product_id": productID, "quantity": bson.M{"$gte": req.Quantity}},
-		bson.M{
-			"$inc": bson.M{
-				"quantity": -req.Quantity,
-				"reserved": req.Quantity,
-			},
-			"$set": bson.M{"updated_at": time.Now()},
-		},
-	)
-
-	if err != nil || result.ModifiedCount == 0 {
-		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient inventory"})
+	ttl := reservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	reservation, err := reserveStock(c.Request.Context(), req.OrderID, productID, req.Warehouse, req.Quantity, ttl)
+	if err != nil {
+		reservationError(c, err, "Failed to reserve inventory")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Inventory reserved successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Inventory reserved successfully", "reservation": reservation})
 }
 
+// releaseInventory returns stock reserved for an order, all of the
+// product's if no quantity is given.
 func releaseInventory(c *gin.Context) {
 	productID := c.Param("productId")
 	var req struct {
-		Quantity int `json:"quantity" binding:"required"`
+		OrderID  string `json:"order_id" binding:"required"`
+		Quantity int    `json:"quantity" binding:"omitempty,min=1"`
+		// Only what's held in this warehouse if set
+		Warehouse string `json:"warehouse"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -173,31 +288,26 @@ func releaseInventory(c *gin.Context) {
 		return
 	}
 
-	collection := inventoryService.db.Collection("inventory")
-	_, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"product_id": productID},
-		bson.M{
-			"$inc": bson.M{
-				"quantity": req.Quantity,
-				"reserved": -req.Quantity,
-			},
-			"$set": bson.M{"updated_at": time.Now()},
-		},
-	)
-
+	released, err := settleStock(c.Request.Context(), req.OrderID, productID, req.Warehouse, req.Quantity, false)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release inventory"})
+		reservationError(c, err, "Failed to release inventory")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Inventory released successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Inventory released successfully", "quantity": released})
 }
 
-func updateInventory(c *gin.Context) {
+// commitInventory turns stock reserved for an order into a sale once the
+// order ships, all of the product's if no quantity is given.
+func commitInventory(c *gin.Context) {
 	productID := c.Param("productId")
 	var req struct {
-		Quantity int `json:"quantity" binding:"required"`
+		OrderID  string `json:"order_id" binding:"required"`
+		Quantity int    `json:"quantity" binding:"omitempty,min=1"`
+		// Only what's held in this warehouse if set
+		Warehouse string `json:"warehouse"`
+		// Units of a serialized product to ship, reserved first
+		Serials []string `json:"serials" binding:"omitempty,dive,required"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -205,22 +315,26 @@ func updateInventory(c *gin.Context) {
 		return
 	}
 
-	collection := inventoryService.db.Collection("inventory")
-	_, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"product_id": productID},
-		bson.M{
-			"$set": bson.M{
-				"quantity": req.Quantity,
-				"updated_at": time.Now(),
-			},
-		},
-	)
+	if len(req.Serials) > 0 {
+		warehouse := req.Warehouse
+		if warehouse == "" {
+			var err error
+			if warehouse, err = reservationWarehouse(c.Request.Context(), req.OrderID, productID); err != nil {
+				serialError(c, err, "")
+				return
+			}
+		}
+		if serial, err := reserveSerials(c.Request.Context(), req.OrderID, productID, warehouse, req.Serials); err != nil {
+			serialError(c, err, serial)
+			return
+		}
+	}
 
+	committed, err := settleStock(c.Request.Context(), req.OrderID, productID, req.Warehouse, req.Quantity, true)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update inventory"})
+		reservationError(c, err, "Failed to commit inventory")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Inventory updated successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Inventory committed successfully", "quantity": committed})
 }
\ No newline at end of file
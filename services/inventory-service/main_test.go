@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// guardedRoutes change stock or inventory settings and must never reach
+// their handler without the permission.
+var guardedRoutes = []struct{ method, path string }{
+	{http.MethodPost, "/api/v1/inventory"},
+	{http.MethodPost, "/api/v1/inventory/reserve"},
+	{http.MethodPut, "/api/v1/inventory/p1/reserve"},
+	{http.MethodPut, "/api/v1/inventory/p1/release"},
+	{http.MethodPut, "/api/v1/inventory/p1/commit"},
+	{http.MethodPost, "/api/v1/inventory/adjustments"},
+	{http.MethodGet, "/api/v1/inventory/adjustments"},
+	{http.MethodPost, "/api/v1/inventory/adjustments/a1/approve"},
+	{http.MethodPut, "/api/v1/inventory/warehouses/w1"},
+	{http.MethodDelete, "/api/v1/inventory/warehouses/w1"},
+	{http.MethodPost, "/api/v1/inventory/allocate"},
+	{http.MethodPut, "/api/v1/inventory/p1/threshold"},
+	{http.MethodDelete, "/api/v1/inventory/p1/threshold"},
+	{http.MethodPost, "/api/v1/inventory/purchase-suggestions/s1/accept"},
+	{http.MethodPost, "/api/v1/inventory/purchase-suggestions/s1/dismiss"},
+	{http.MethodDelete, "/api/v1/inventory/reservations/o1"},
+	{http.MethodPost, "/api/v1/inventory/reservations/o1/commit"},
+	{http.MethodPost, "/api/v1/inventory/inbound"},
+	{http.MethodPut, "/api/v1/inventory/inbound/i1/receive"},
+	{http.MethodPut, "/api/v1/inventory/inbound/i1/cancel"},
+	{http.MethodPut, "/api/v1/inventory/dispatch/schedules/w1"},
+	{http.MethodDelete, "/api/v1/inventory/dispatch/schedules/w1"},
+	{http.MethodPut, "/api/v1/inventory/p1/cost"},
+}
+
+func testRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	verifier = newTokenVerifier()
+	// Nothing listens here, so no token reads as revoked
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 50 * time.Millisecond, MaxRetries: -1})
+	router := gin.New()
+	setupRoutes(router)
+	return router
+}
+
+func testToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(verifier.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGuardedRoutesRefuseCallers(t *testing.T) {
+	router := testRouter(t)
+	customer := testToken(t, jwt.MapClaims{"sub": "u1", "role": "customer", "permissions": []string{}})
+	// Warehouse staff can adjust stock but not reserve it for orders
+	warehouse := testToken(t, jwt.MapClaims{"sub": "u2", "role": "warehouse", "permissions": []string{"orders:read"}})
+	refresh := testToken(t, jwt.MapClaims{"sub": "u1", "role": "admin", "permissions": []string{"*"}, "typ": "refresh"})
+
+	for _, route := range guardedRoutes {
+		for _, tc := range []struct {
+			name  string
+			token string
+			want  int
+		}{
+			{"anonymous", "", http.StatusUnauthorized},
+			{"refresh token", refresh, http.StatusUnauthorized},
+			{"customer", customer, http.StatusForbidden},
+			{"warehouse", warehouse, http.StatusForbidden},
+		} {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("%s %s as %s: got %d, want %d", route.method, route.path, tc.name, rec.Code, tc.want)
+			}
+		}
+	}
+}
+
+func TestReserveTakesTheServiceToken(t *testing.T) {
+	router := testRouter(t)
+	service := testToken(t, jwt.MapClaims{"sub": "service:order-service", "role": "service", "permissions": []string{"inventory:reserve"}})
+
+	// Bodies the handler refuses before touching stock, which shows the
+	// token got past the gate
+	for _, body := range []string{
+		`{"order_id": "o1", "items": []}`,
+		`{"order_id": "o1", "items": [{"product_id": "p1", "quantity": 1}], "ttl_seconds": 7776001}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory/reserve", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+service)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("reserve %s: got %d, want 400", body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Safety stock is held back from what's promised to customers: available
+// to promise is available stock less the safety stock set alongside the
+// reorder point in reorder_thresholds, per warehouse and then across them.
+// When stock drops below a reorder point, the low stock check also
+// suggests a purchase order for the reorder quantity, or enough to get
+// back to the reorder point plus safety stock, counting what's already on
+// order. Accepting a suggestion opens the inbound shipment for it.
+type PurchaseSuggestion struct {
+	ID          string `bson:"_id" json:"id"`
+	ThresholdID string `bson:"threshold_id" json:"-"`
+	ProductID   string `bson:"product_id" json:"product_id"`
+	// Empty when the reorder point is across warehouses
+	Warehouse string `bson:"warehouse,omitempty" json:"warehouse,omitempty"`
+	Available int    `bson:"available" json:"available"`
+	OnOrder   int    `bson:"on_order" json:"on_order"`
+	Threshold int    `bson:"threshold" json:"threshold"`
+	Quantity  int    `bson:"quantity" json:"quantity"`
+	Status    string `bson:"status" json:"status"`
+	// The shipment opened when it was accepted
+	InboundID string    `bson:"inbound_id,omitempty" json:"inbound_id,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+const (
+	suggestionOpen      = "open"
+	suggestionAccepted  = "accepted"
+	suggestionDismissed = "dismissed"
+)
+
+// onOrder is how much of the product open inbound shipments bring to the
+// warehouse, or to any warehouse if it's "".
+func onOrder(ctx context.Context, productID, warehouse string) (int, error) {
+	match := bson.M{"status": inboundOpen, "lines.product_id": productID}
+	if warehouse != "" {
+		match["warehouse"] = warehouse
+	}
+	cursor, err := inventoryService.db.Collection("inbound_shipments").Aggregate(ctx, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$unwind": "$lines"},
+		bson.M{"$match": bson.M{"lines.product_id": productID}},
+		bson.M{"$group": bson.M{"_id": nil, "quantity": bson.M{"$sum": "$lines.quantity"}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var totals []struct {
+		Quantity int `bson:"quantity"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil || len(totals) == 0 {
+		return 0, err
+	}
+	return totals[0].Quantity, nil
+}
+
+// suggestPurchases records a purchase suggestion for each newly low item
+// that isn't already covered by what's on order. An open suggestion for
+// the same stock is brought up to date rather than repeated.
+func suggestPurchases(ctx context.Context, items []LowStockItem) {
+	collection := inventoryService.db.Collection("purchase_suggestions")
+	for _, item := range items {
+		ordered, err := onOrder(ctx, item.ProductID, item.Warehouse)
+		if err != nil {
+			log.Printf("Failed to check stock on order for %s: %v", item.ProductID, err)
+			continue
+		}
+		quantity := item.Threshold + item.safetyStock - item.Available - ordered
+		if quantity <= 0 {
+			continue
+		}
+		if item.reorderQuantity > quantity {
+			quantity = item.reorderQuantity
+		}
+
+		now := time.Now()
+		_, err = collection.UpdateOne(ctx,
+			bson.M{"threshold_id": thresholdID(item.ProductID, item.Warehouse), "status": suggestionOpen},
+			bson.M{
+				"$set": bson.M{
+					"product_id": item.ProductID,
+					"warehouse":  item.Warehouse,
+					"available":  item.Available,
+					"on_order":   ordered,
+					"threshold":  item.Threshold,
+					"quantity":   quantity,
+					"updated_at": now,
+				},
+				"$setOnInsert": bson.M{"_id": primitive.NewObjectID().Hex(), "created_at": now},
+			},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			log.Printf("Failed to suggest a purchase of %s: %v", item.ProductID, err)
+		}
+	}
+}
+
+// getAvailableToPromise answers GET /api/v1/inventory/:productId/atp with
+// what can be promised of the product per warehouse and in all.
+func getAvailableToPromise(c *gin.Context) {
+	ctx := c.Request.Context()
+	productID := c.Param("productId")
+
+	cursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{"product_id": productID},
+		options.Find().SetSort(bson.D{{Key: "warehouse", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inventory"})
+		return
+	}
+	var rows []Inventory
+	if err := cursor.All(ctx, &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode inventory"})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inventory not found"})
+		return
+	}
+
+	cursor, err = inventoryService.db.Collection("reorder_thresholds").Find(ctx, bson.M{"product_id": productID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch safety stock"})
+		return
+	}
+	var policies []ReorderThreshold
+	if err := cursor.All(ctx, &policies); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode safety stock"})
+		return
+	}
+	safety := map[string]int{}
+	for _, p := range policies {
+		safety[p.Warehouse] = p.SafetyStock
+	}
+
+	type warehouseATP struct {
+		Warehouse   string `json:"warehouse"`
+		Available   int    `json:"available"`
+		SafetyStock int    `json:"safety_stock"`
+		ATP         int    `json:"available_to_promise"`
+	}
+	warehouses := make([]warehouseATP, 0, len(rows))
+	available, atp := 0, 0
+	for _, row := range rows {
+		w := warehouseATP{Warehouse: row.Warehouse, Available: row.Quantity, SafetyStock: safety[row.Warehouse]}
+		if w.ATP = w.Available - w.SafetyStock; w.ATP < 0 {
+			w.ATP = 0
+		}
+		available += w.Available
+		atp += w.ATP
+		warehouses = append(warehouses, w)
+	}
+	if atp -= safety[""]; atp < 0 {
+		atp = 0
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product_id":           productID,
+		"available":            available,
+		"safety_stock":         safety[""],
+		"available_to_promise": atp,
+		"warehouses":           warehouses,
+	})
+}
+
+// listPurchaseSuggestions answers GET /api/v1/inventory/purchase-suggestions,
+// open ones unless ?status= says otherwise.
+func listPurchaseSuggestions(c *gin.Context) {
+	cursor, err := inventoryService.db.Collection("purchase_suggestions").Find(context.Background(),
+		bson.M{"status": c.DefaultQuery("status", suggestionOpen)},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(500))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch suggestions"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	suggestions := []PurchaseSuggestion{}
+	if err := cursor.All(context.Background(), &suggestions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode suggestions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"suggestions": suggestions, "count": len(suggestions)})
+}
+
+// acceptPurchaseSuggestion turns an open suggestion into a purchase order
+// inbound shipment. The quantity and, for suggestions across warehouses,
+// the receiving warehouse can be given.
+func acceptPurchaseSuggestion(c *gin.Context) {
+	var req struct {
+		Supplier   string    `json:"supplier"`
+		Reference  string    `json:"reference"`
+		Warehouse  string    `json:"warehouse"`
+		Quantity   int       `json:"quantity" binding:"omitempty,min=1"`
+		ExpectedAt time.Time `json:"expected_at" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := inventoryService.db.Collection("purchase_suggestions")
+	var suggestion PurchaseSuggestion
+	if err := collection.FindOne(ctx, bson.M{"_id": c.Param("id"), "status": suggestionOpen}).Decode(&suggestion); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open suggestion not found"})
+		return
+	}
+	warehouse := suggestion.Warehouse
+	if warehouse == "" {
+		warehouse = req.Warehouse
+	}
+	if warehouse == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "warehouse is required, the suggestion is across warehouses"})
+		return
+	}
+	quantity := suggestion.Quantity
+	if req.Quantity > 0 {
+		quantity = req.Quantity
+	}
+
+	shipment := InboundShipment{
+		ID:         primitive.NewObjectID().Hex(),
+		Type:       "purchase_order",
+		Reference:  req.Reference,
+		Supplier:   req.Supplier,
+		Warehouse:  warehouse,
+		Lines:      []InboundLine{{ProductID: suggestion.ProductID, Quantity: quantity}},
+		ExpectedAt: req.ExpectedAt,
+		Status:     inboundOpen,
+		CreatedAt:  time.Now(),
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": suggestion.ID, "status": suggestionOpen},
+		bson.M{"$set": bson.M{"status": suggestionAccepted, "inbound_id": shipment.ID, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept suggestion"})
+		return
+	}
+	if result.ModifiedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Suggestion was accepted or dismissed meanwhile"})
+		return
+	}
+	if _, err := inventoryService.db.Collection("inbound_shipments").InsertOne(ctx, shipment); err != nil {
+		collection.UpdateOne(context.Background(), bson.M{"_id": suggestion.ID},
+			bson.M{"$set": bson.M{"status": suggestionOpen}, "$unset": bson.M{"inbound_id": ""}})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shipment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, shipment)
+}
+
+func dismissPurchaseSuggestion(c *gin.Context) {
+	result, err := inventoryService.db.Collection("purchase_suggestions").UpdateOne(context.Background(),
+		bson.M{"_id": c.Param("id"), "status": suggestionOpen},
+		bson.M{"$set": bson.M{"status": suggestionDismissed, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to dismiss suggestion"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open suggestion not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Suggestion dismissed"})
+}
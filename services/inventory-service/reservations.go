@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stock reserved for an order is recorded in the reservations collection,
+// one reservation per order with a line for each product and warehouse the
+// stock came from, so releases and commits go back to the right row. A
+// reservation holds its stock until RESERVATION_TTL (default 15m) after
+// the last reserve, or the ttl_seconds that reserve asked for. Whatever
+// the order hasn't committed or released by then is returned to stock by
+// a sweeper running every RESERVATION_SWEEP_INTERVAL (default 30s). An
+// expired reservation can be reserved again, e.g. when payment for the
+// order arrives late.
+type Reservation struct {
+	OrderID   string            `bson:"_id" json:"order_id"`
+	Lines     []ReservationLine `bson:"lines" json:"lines"`
+	Status    string            `bson:"status" json:"status"`
+	ExpiresAt time.Time         `bson:"expires_at" json:"expires_at"`
+	CreatedAt time.Time         `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time         `bson:"updated_at" json:"updated_at"`
+}
+
+// ReservationLine is the stock of one product reserved in one warehouse.
+// Quantity is what's still held; committed and released stock is counted
+// separately.
+type ReservationLine struct {
+	ProductID string `bson:"product_id" json:"product_id"`
+	Warehouse string `bson:"warehouse" json:"warehouse"`
+	Quantity  int    `bson:"quantity" json:"quantity"`
+	Committed int    `bson:"committed" json:"committed"`
+	Released  int    `bson:"released" json:"released"`
+}
+
+const (
+	reservationActive    = "active"
+	reservationCommitted = "committed"
+	reservationReleased  = "released"
+	reservationExpired   = "expired"
+)
+
+var (
+	errInsufficientInventory = errors.New("insufficient inventory")
+	errReservationClosed     = errors.New("reservation is no longer active")
+	errNotReserved           = errors.New("not enough reserved for this order")
+)
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+var (
+	reservationTTL           = envDuration("RESERVATION_TTL", 15*time.Minute)
+	reservationSweepInterval = envDuration("RESERVATION_SWEEP_INTERVAL", 30*time.Second)
+)
+
+func startReservationSweeper() {
+	_, err := inventoryService.db.Collection("reservations").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create reservation index: %v", err)
+	}
+
+	go func() {
+		for range time.Tick(reservationSweepInterval) {
+			if n, err := expireReservations(context.Background()); err != nil {
+				log.Printf("Reservation sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Expired %d reservations", n)
+			}
+		}
+	}()
+}
+
+// reserveStock takes quantity of the product out of available stock in the
+// warehouse, or any warehouse holding enough if it's "", for the order and
+// records it on the order's reservation, which then expires ttl from now.
+func reserveStock(ctx context.Context, orderID, productID, warehouse string, quantity int, ttl time.Duration) (*Reservation, error) {
+	filter := bson.M{"product_id": productID, "quantity": bson.M{"$gte": quantity}}
+	if warehouse != "" {
+		filter["warehouse"] = warehouse
+	}
+	var inventory Inventory
+	err := inventoryService.db.Collection("inventory").FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$inc": bson.M{"quantity": -quantity, "reserved": quantity},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+	).Decode(&inventory)
+	if err == mongo.ErrNoDocuments {
+		return nil, errInsufficientInventory
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordMovement(ctx, Movement{
+		ProductID: productID,
+		Warehouse: inventory.Warehouse,
+		Type:      movementReserve,
+		Quantity:  quantity,
+		Reference: orderID,
+	})
+	if err := addToReservation(ctx, orderID, productID, inventory.Warehouse, quantity, ttl); err != nil {
+		// Put the stock back rather than hold it for nobody
+		returnStock(ctx, orderID, ReservationLine{ProductID: productID, Warehouse: inventory.Warehouse, Quantity: quantity})
+		return nil, err
+	}
+	return findReservation(ctx, orderID)
+}
+
+// addToReservation records stock reserved for the order, creating its
+// reservation on the first reserve.
+func addToReservation(ctx context.Context, orderID, productID, warehouse string, quantity int, ttl time.Duration) error {
+	collection := inventoryService.db.Collection("reservations")
+	now := time.Now()
+	line := bson.M{"product_id": productID, "warehouse": warehouse}
+	set := bson.M{"expires_at": now.Add(ttl), "updated_at": now}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": orderID, "status": reservationActive, "lines": bson.M{"$elemMatch": line}},
+			bson.M{"$inc": bson.M{"lines.$.quantity": quantity}, "$set": set})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount > 0 {
+			return nil
+		}
+
+		// A first reserve of this product and warehouse, or of the order.
+		// The upsert fails on a duplicate key if the reservation exists
+		// but isn't active, or the line was added meanwhile.
+		_, err = collection.UpdateOne(ctx,
+			bson.M{"_id": orderID, "status": reservationActive, "lines": bson.M{"$not": bson.M{"$elemMatch": line}}},
+			bson.M{
+				"$push":        bson.M{"lines": ReservationLine{ProductID: productID, Warehouse: warehouse, Quantity: quantity}},
+				"$set":         set,
+				"$setOnInsert": bson.M{"created_at": now},
+			},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return errReservationClosed
+}
+
+// settleStock releases or commits quantity of the product held for the
+// order, all of it if quantity is 0, returning how much was settled. A
+// warehouse limits it to the stock held there. Released stock goes back to
+// available; committed stock leaves as a sale.
+func settleStock(ctx context.Context, orderID, productID, warehouse string, quantity int, commit bool) (int, error) {
+	reservation, err := findReservation(ctx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	if reservation.Status != reservationActive {
+		return 0, errReservationClosed
+	}
+	matches := func(line ReservationLine) bool {
+		return line.ProductID == productID && (warehouse == "" || line.Warehouse == warehouse)
+	}
+	held := 0
+	for _, line := range reservation.Lines {
+		if matches(line) {
+			held += line.Quantity
+		}
+	}
+	if quantity == 0 {
+		quantity = held
+	}
+	if quantity == 0 || quantity > held {
+		return 0, errNotReserved
+	}
+
+	field := "lines.$.released"
+	if commit {
+		field = "lines.$.committed"
+	}
+	settled := 0
+	for _, line := range reservation.Lines {
+		n := quantity - settled
+		if line.Quantity < n {
+			n = line.Quantity
+		}
+		if !matches(line) || n <= 0 {
+			continue
+		}
+		result, err := inventoryService.db.Collection("reservations").UpdateOne(ctx,
+			bson.M{"_id": orderID, "status": reservationActive, "lines": bson.M{"$elemMatch": bson.M{
+				"product_id": productID, "warehouse": line.Warehouse, "quantity": bson.M{"$gte": n},
+			}}},
+			bson.M{"$inc": bson.M{"lines.$.quantity": -n, field: n}, "$set": bson.M{"updated_at": time.Now()}})
+		if err != nil {
+			return settled, err
+		}
+		if result.MatchedCount == 0 {
+			// Expired or settled by another request meanwhile
+			continue
+		}
+		line.Quantity = n
+		if commit {
+			commitStock(ctx, orderID, line)
+			shipSerials(ctx, orderID, line, n)
+		} else {
+			returnStock(ctx, orderID, line)
+			releaseSerials(ctx, orderID, line, n)
+		}
+		settled += n
+	}
+	closeIfSettled(ctx, orderID)
+	if settled < quantity {
+		return settled, errNotReserved
+	}
+	return settled, nil
+}
+
+// returnStock puts a line's quantity held for the order back into
+// available stock.
+func returnStock(ctx context.Context, orderID string, line ReservationLine) {
+	_, err := inventoryService.db.Collection("inventory").UpdateOne(ctx,
+		bson.M{"product_id": line.ProductID, "warehouse": line.Warehouse},
+		bson.M{
+			"$inc": bson.M{"quantity": line.Quantity, "reserved": -line.Quantity},
+			"$set": bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		log.Printf("Failed to return %d of %s to %s: %v", line.Quantity, line.ProductID, line.Warehouse, err)
+		return
+	}
+	recordMovement(ctx, Movement{
+		ProductID: line.ProductID,
+		Warehouse: line.Warehouse,
+		Type:      movementRelease,
+		Quantity:  line.Quantity,
+		Reference: orderID,
+	})
+}
+
+// commitStock turns a line's quantity held for the order into a sale.
+func commitStock(ctx context.Context, orderID string, line ReservationLine) {
+	_, err := inventoryService.db.Collection("inventory").UpdateOne(ctx,
+		bson.M{"product_id": line.ProductID, "warehouse": line.Warehouse},
+		bson.M{
+			"$inc": bson.M{"reserved": -line.Quantity},
+			"$set": bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		log.Printf("Failed to commit %d of %s from %s: %v", line.Quantity, line.ProductID, line.Warehouse, err)
+		return
+	}
+	recordMovement(ctx, Movement{
+		ProductID: line.ProductID,
+		Warehouse: line.Warehouse,
+		Type:      movementSale,
+		Quantity:  -line.Quantity,
+		Reference: orderID,
+	})
+}
+
+// closeIfSettled marks a reservation with nothing left held committed, or
+// released if none of it was committed.
+func closeIfSettled(ctx context.Context, orderID string) {
+	collection := inventoryService.db.Collection("reservations")
+	settled := bson.M{"_id": orderID, "status": reservationActive, "lines.quantity": bson.M{"$not": bson.M{"$gt": 0}}}
+	update := func(status string) bson.M {
+		return bson.M{"$set": bson.M{"status": status, "updated_at": time.Now()}}
+	}
+
+	committed := bson.M{"lines.committed": bson.M{"$gt": 0}}
+	for k, v := range settled {
+		committed[k] = v
+	}
+	result, err := collection.UpdateOne(ctx, committed, update(reservationCommitted))
+	if err == nil && result.MatchedCount == 0 {
+		_, err = collection.UpdateOne(ctx, settled, update(reservationReleased))
+	}
+	if err != nil {
+		log.Printf("Failed to close reservation %s: %v", orderID, err)
+	}
+}
+
+// closeReservation ends an active reservation with the status, returning
+// everything it still holds to stock.
+func closeReservation(ctx context.Context, filter bson.M, status string) (*Reservation, error) {
+	filter["status"] = reservationActive
+	var reservation Reservation
+	err := inventoryService.db.Collection("reservations").FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"status": status, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&reservation)
+	if err != nil {
+		return nil, err
+	}
+
+	set, inc := bson.M{}, bson.M{}
+	for i, line := range reservation.Lines {
+		if line.Quantity == 0 {
+			continue
+		}
+		returnStock(ctx, reservation.OrderID, line)
+		releaseSerials(ctx, reservation.OrderID, line, line.Quantity)
+		set[fmt.Sprintf("lines.%d.quantity", i)] = 0
+		inc[fmt.Sprintf("lines.%d.released", i)] = line.Quantity
+		reservation.Lines[i].Released += line.Quantity
+		reservation.Lines[i].Quantity = 0
+	}
+	if len(set) > 0 {
+		_, err = inventoryService.db.Collection("reservations").UpdateOne(ctx, bson.M{"_id": reservation.OrderID},
+			bson.M{"$set": set, "$inc": inc})
+		if err != nil {
+			log.Printf("Failed to record release of reservation %s: %v", reservation.OrderID, err)
+		}
+	}
+	return &reservation, nil
+}
+
+// expireReservations releases reservations past their expiry, one at a
+// time so instances sweeping together never release one twice.
+func expireReservations(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		_, err := closeReservation(ctx, bson.M{"expires_at": bson.M{"$lte": time.Now()}}, reservationExpired)
+		if err == mongo.ErrNoDocuments {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func findReservation(ctx context.Context, orderID string) (*Reservation, error) {
+	var reservation Reservation
+	err := inventoryService.db.Collection("reservations").FindOne(ctx, bson.M{"_id": orderID}).Decode(&reservation)
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// reservationError writes the response for an error from reserving,
+// releasing or committing stock.
+func reservationError(c *gin.Context, err error, message string) {
+	switch err {
+	case errInsufficientInventory:
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient inventory"})
+	case errReservationClosed:
+		c.JSON(http.StatusConflict, gin.H{"error": "Reservation for this order is no longer active"})
+	case errNotReserved:
+		c.JSON(http.StatusConflict, gin.H{"error": "Not enough of this product is reserved for the order"})
+	case mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+	default:
+		log.Printf("%s: %v", message, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+func getReservation(c *gin.Context) {
+	reservation, err := findReservation(c.Request.Context(), c.Param("orderId"))
+	if err != nil {
+		reservationError(c, err, "Failed to fetch reservation")
+		return
+	}
+	c.JSON(http.StatusOK, reservation)
+}
+
+// cancelReservation releases everything still held for an order, e.g. when
+// it's cancelled or checkout is abandoned.
+func cancelReservation(c *gin.Context) {
+	reservation, err := closeReservation(c.Request.Context(), bson.M{"_id": c.Param("orderId")}, reservationReleased)
+	if err == mongo.ErrNoDocuments {
+		if _, findErr := findReservation(c.Request.Context(), c.Param("orderId")); findErr == nil {
+			err = errReservationClosed
+		}
+	}
+	if err != nil {
+		reservationError(c, err, "Failed to release reservation")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Reservation released", "reservation": reservation})
+}
+
+// commitReservation turns everything still held for an order into a sale,
+// once the order is paid or leaves the warehouse.
+func commitReservation(c *gin.Context) {
+	ctx := c.Request.Context()
+	orderID := c.Param("orderId")
+	reservation, err := findReservation(ctx, orderID)
+	if err == nil && reservation.Status != reservationActive {
+		err = errReservationClosed
+	}
+	if err != nil {
+		reservationError(c, err, "Failed to commit reservation")
+		return
+	}
+
+	committed := map[string]bool{}
+	for _, line := range reservation.Lines {
+		if line.Quantity == 0 || committed[line.ProductID] {
+			continue
+		}
+		committed[line.ProductID] = true
+		if _, err := settleStock(ctx, orderID, line.ProductID, "", 0, true); err != nil {
+			reservationError(c, err, "Failed to commit reservation")
+			return
+		}
+	}
+
+	reservation, err = findReservation(ctx, orderID)
+	if err != nil {
+		reservationError(c, err, "Failed to fetch reservation")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Reservation committed", "reservation": reservation})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// An order's items are reserved together in one Mongo transaction, so
+// either all of them are held or none are and nothing is left half
+// reserved. This needs Mongo running as a replica set.
+type ReserveItem struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  int    `json:"quantity" binding:"required,min=1"`
+	// Any warehouse with enough if unset
+	Warehouse string `json:"warehouse"`
+}
+
+// ReserveFailure is why an item couldn't be reserved.
+type ReserveFailure struct {
+	ProductID string `json:"product_id"`
+	Warehouse string `json:"warehouse,omitempty"`
+	Requested int    `json:"requested"`
+	// The most held by any one warehouse, or the one asked for
+	Available int    `json:"available"`
+	Reason    string `json:"reason"`
+}
+
+const (
+	reserveReasonNotStocked   = "not_stocked"
+	reserveReasonInsufficient = "insufficient_stock"
+)
+
+// errReserveFailed aborts the transaction when an item can't be reserved.
+var errReserveFailed = errors.New("items could not be reserved")
+
+// reserveItems reserves every item for the order or none, returning why
+// each failed item couldn't be.
+func reserveItems(ctx context.Context, orderID string, items []ReserveItem, ttl time.Duration) (*Reservation, []ReserveFailure, error) {
+	existing, err := findReservation(ctx, orderID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+	if existing != nil && existing.Status == reservationExpired {
+		// Its stock went back on sale; take it out again under the order
+		_, err := inventoryService.db.Collection("reservations").UpdateOne(ctx,
+			bson.M{"_id": orderID, "status": reservationExpired},
+			bson.M{"$set": bson.M{"status": reservationActive, "expires_at": time.Now().Add(ttl), "updated_at": time.Now()}})
+		if err != nil {
+			return nil, nil, err
+		}
+		existing.Status = reservationActive
+	}
+	if existing != nil && existing.Status != reservationActive {
+		return nil, nil, errReservationClosed
+	}
+
+	session, err := inventoryService.db.Client().StartSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var lines []ReservationLine
+	var failures []ReserveFailure
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// The transaction is retried from the start on transient errors
+		lines, failures = nil, nil
+		for _, item := range items {
+			line, failure, err := reserveItem(sc, item)
+			if err != nil {
+				return nil, err
+			}
+			if failure != nil {
+				failures = append(failures, *failure)
+				continue
+			}
+			lines = append(lines, *line)
+		}
+		if len(failures) > 0 {
+			return nil, errReserveFailed
+		}
+		for _, line := range lines {
+			if err := addToReservation(sc, orderID, line.ProductID, line.Warehouse, line.Quantity, ttl); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err == errReserveFailed {
+		return nil, failures, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, line := range lines {
+		recordMovement(ctx, Movement{
+			ProductID: line.ProductID,
+			Warehouse: line.Warehouse,
+			Type:      movementReserve,
+			Quantity:  line.Quantity,
+			Reference: orderID,
+		})
+	}
+	reservation, err := findReservation(ctx, orderID)
+	return reservation, nil, err
+}
+
+// reserveItem takes one item out of available stock within the
+// transaction, or says why it can't.
+func reserveItem(sc mongo.SessionContext, item ReserveItem) (*ReservationLine, *ReserveFailure, error) {
+	collection := inventoryService.db.Collection("inventory")
+	filter := bson.M{"product_id": item.ProductID}
+	if item.Warehouse != "" {
+		filter["warehouse"] = item.Warehouse
+	}
+
+	enough := bson.M{"quantity": bson.M{"$gte": item.Quantity}}
+	for k, v := range filter {
+		enough[k] = v
+	}
+	var inventory Inventory
+	err := collection.FindOneAndUpdate(sc, enough,
+		bson.M{
+			"$inc": bson.M{"quantity": -item.Quantity, "reserved": item.Quantity},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+	).Decode(&inventory)
+	if err == nil {
+		return &ReservationLine{ProductID: item.ProductID, Warehouse: inventory.Warehouse, Quantity: item.Quantity}, nil, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	cursor, err := collection.Find(sc, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []Inventory
+	if err := cursor.All(sc, &rows); err != nil {
+		return nil, nil, err
+	}
+	failure := &ReserveFailure{
+		ProductID: item.ProductID,
+		Warehouse: item.Warehouse,
+		Requested: item.Quantity,
+		Reason:    reserveReasonNotStocked,
+	}
+	if len(rows) > 0 {
+		failure.Reason = reserveReasonInsufficient
+	}
+	for _, row := range rows {
+		if row.Quantity > failure.Available {
+			failure.Available = row.Quantity
+		}
+	}
+	return nil, failure, nil
+}
+
+// reserveInventoryItems answers POST /api/v1/inventory/reserve, reserving
+// all of an order's items or, if any can't be, none of them.
+func reserveInventoryItems(c *gin.Context) {
+	var req struct {
+		OrderID string        `json:"order_id" binding:"required"`
+		Items   []ReserveItem `json:"items" binding:"required,min=1,dive"`
+		// How long to hold the stock, RESERVATION_TTL if unset. Orders
+		// paid later, by transfer or on terms, hold it for up to 90 days.
+		TTLSeconds int `json:"ttl_seconds" binding:"omitempty,min=1,max=7776000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ttl := reservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	reservation, failures, err := reserveItems(c.Request.Context(), req.OrderID, req.Items, ttl)
+	if err != nil {
+		reservationError(c, err, "Failed to reserve inventory")
+		return
+	}
+	if len(failures) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient inventory", "failures": failures})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Inventory reserved successfully", "reservation": reservation})
+}
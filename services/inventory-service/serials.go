@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Serialized products are tracked unit by unit as well as by count. Serials
+// are registered as inbound shipments are received, reserved for an order
+// on request, and shipped when the order's stock is committed: the units
+// reserved for it first, then the longest in stock. Releasing or expiring
+// a reservation puts its units back. Products received without serials
+// aren't tracked this way, and nothing here changes how they're counted.
+type SerialUnit struct {
+	ID        string `bson:"_id" json:"-"`
+	Serial    string `bson:"serial" json:"serial"`
+	ProductID string `bson:"product_id" json:"product_id"`
+	Warehouse string `bson:"warehouse" json:"warehouse"`
+	Status    string `bson:"status" json:"status"`
+	// The order it's reserved for or last shipped on
+	OrderID    string           `bson:"order_id,omitempty" json:"order_id,omitempty"`
+	InboundID  string           `bson:"inbound_id,omitempty" json:"inbound_id,omitempty"`
+	ReceivedAt time.Time        `bson:"received_at" json:"received_at"`
+	Shipments  []SerialShipment `bson:"shipments,omitempty" json:"shipments,omitempty"`
+}
+
+// SerialShipment is an order a unit shipped on, kept across returns and
+// re-receipts for warranty claims.
+type SerialShipment struct {
+	OrderID   string    `bson:"order_id" json:"order_id"`
+	ShippedAt time.Time `bson:"shipped_at" json:"shipped_at"`
+}
+
+const (
+	serialInStock  = "in_stock"
+	serialReserved = "reserved"
+	serialShipped  = "shipped"
+)
+
+var (
+	errSerialUnavailable = errors.New("serial is not in stock in this warehouse")
+	errTooManySerials    = errors.New("more serials than the order holds of this product")
+)
+
+func serialID(productID, serial string) string {
+	return productID + "/" + serial
+}
+
+func setupSerials() {
+	_, err := inventoryService.db.Collection("inventory_serials").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "serial", Value: 1}}},
+		{Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "product_id", Value: 1}}},
+		{Keys: bson.D{{Key: "shipments.order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "warehouse", Value: 1}, {Key: "status", Value: 1}, {Key: "received_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create serial indexes: %v", err)
+	}
+}
+
+// checkNewSerials refuses serials that are listed twice or already in
+// stock, before a shipment bringing them is accepted.
+func checkNewSerials(ctx context.Context, lines []InboundLine) (string, error) {
+	seen := map[string]bool{}
+	var ids []string
+	for _, line := range lines {
+		for _, serial := range line.Serials {
+			id := serialID(line.ProductID, serial)
+			if seen[id] {
+				return serial, nil
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+
+	var existing SerialUnit
+	err := inventoryService.db.Collection("inventory_serials").FindOne(ctx, bson.M{
+		"_id":    bson.M{"$in": ids},
+		"status": bson.M{"$in": bson.A{serialInStock, serialReserved}},
+	}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return existing.Serial, nil
+}
+
+// registerSerials puts a received line's units in stock. Units coming back
+// after shipping keep their shipment history.
+func registerSerials(ctx context.Context, line InboundLine, warehouse, inboundID string, now time.Time) error {
+	if len(line.Serials) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(line.Serials))
+	for _, serial := range line.Serials {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": serialID(line.ProductID, serial)}).
+			SetUpdate(bson.M{
+				"$set": bson.M{
+					"serial":      serial,
+					"product_id":  line.ProductID,
+					"warehouse":   warehouse,
+					"status":      serialInStock,
+					"inbound_id":  inboundID,
+					"received_at": now,
+				},
+				"$unset": bson.M{"order_id": ""},
+			}).
+			SetUpsert(true))
+	}
+	_, err := inventoryService.db.Collection("inventory_serials").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// reserveSerials sets specific units aside for the order, which must hold
+// enough of the product to cover them. It returns the serial that isn't
+// available if one isn't, having reserved none of them.
+func reserveSerials(ctx context.Context, orderID, productID, warehouse string, serials []string) (string, error) {
+	reservation, err := findReservation(ctx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if reservation.Status != reservationActive {
+		return "", errReservationClosed
+	}
+	held := 0
+	for _, line := range reservation.Lines {
+		if line.ProductID == productID && line.Warehouse == warehouse {
+			held += line.Quantity
+		}
+	}
+	collection := inventoryService.db.Collection("inventory_serials")
+	already, err := collection.CountDocuments(ctx, bson.M{
+		"order_id": orderID, "product_id": productID, "warehouse": warehouse, "status": serialReserved,
+	})
+	if err != nil {
+		return "", err
+	}
+	if int(already)+len(serials) > held {
+		return "", errTooManySerials
+	}
+
+	for i, serial := range serials {
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": serialID(productID, serial), "warehouse": warehouse, "status": serialInStock},
+			bson.M{"$set": bson.M{"status": serialReserved, "order_id": orderID}})
+		if err == nil && result.MatchedCount > 0 {
+			continue
+		}
+		for _, done := range serials[:i] {
+			collection.UpdateOne(ctx,
+				bson.M{"_id": serialID(productID, done), "status": serialReserved, "order_id": orderID},
+				bson.M{"$set": bson.M{"status": serialInStock}, "$unset": bson.M{"order_id": ""}})
+		}
+		if err != nil {
+			return "", err
+		}
+		return serial, errSerialUnavailable
+	}
+	return "", nil
+}
+
+// shipSerials marks n units of a committed line shipped on the order: those
+// reserved for it, then the longest in stock.
+func shipSerials(ctx context.Context, orderID string, line ReservationLine, n int) {
+	collection := inventoryService.db.Collection("inventory_serials")
+	shipment := SerialShipment{OrderID: orderID, ShippedAt: time.Now()}
+	ship := func(filter bson.M) int {
+		cursor, err := collection.Find(ctx, filter,
+			options.Find().SetSort(bson.D{{Key: "received_at", Value: 1}}).SetLimit(int64(n)).SetProjection(bson.M{"_id": 1, "status": 1}))
+		if err != nil {
+			log.Printf("Failed to find serials of %s for order %s: %v", line.ProductID, orderID, err)
+			return 0
+		}
+		var units []SerialUnit
+		if err := cursor.All(ctx, &units); err != nil {
+			log.Printf("Failed to find serials of %s for order %s: %v", line.ProductID, orderID, err)
+			return 0
+		}
+		shipped := 0
+		for _, unit := range units {
+			result, err := collection.UpdateOne(ctx, bson.M{"_id": unit.ID, "status": unit.Status},
+				bson.M{"$set": bson.M{"status": serialShipped, "order_id": orderID}, "$push": bson.M{"shipments": shipment}})
+			if err == nil && result.ModifiedCount > 0 {
+				shipped++
+			}
+		}
+		return shipped
+	}
+
+	n -= ship(bson.M{"order_id": orderID, "product_id": line.ProductID, "warehouse": line.Warehouse, "status": serialReserved})
+	if n > 0 {
+		ship(bson.M{"product_id": line.ProductID, "warehouse": line.Warehouse, "status": serialInStock})
+	}
+}
+
+// releaseSerials puts up to n units reserved for the order back in stock.
+func releaseSerials(ctx context.Context, orderID string, line ReservationLine, n int) {
+	collection := inventoryService.db.Collection("inventory_serials")
+	cursor, err := collection.Find(ctx,
+		bson.M{"order_id": orderID, "product_id": line.ProductID, "warehouse": line.Warehouse, "status": serialReserved},
+		options.Find().SetLimit(int64(n)).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Printf("Failed to release serials of %s for order %s: %v", line.ProductID, orderID, err)
+		return
+	}
+	var units []SerialUnit
+	if err := cursor.All(ctx, &units); err != nil || len(units) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(units))
+	for _, unit := range units {
+		ids = append(ids, unit.ID)
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "status": serialReserved},
+		bson.M{"$set": bson.M{"status": serialInStock}, "$unset": bson.M{"order_id": ""}})
+	if err != nil {
+		log.Printf("Failed to release serials of %s for order %s: %v", line.ProductID, orderID, err)
+	}
+}
+
+// serialError writes the response for an error from reserveSerials or
+// reservationWarehouse.
+func serialError(c *gin.Context, err error, serial string) {
+	switch err {
+	case errWarehouseRequired:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "warehouse is required, the order holds the product in several"})
+	case errSerialUnavailable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "serial": serial})
+	case errTooManySerials:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		reservationError(c, err, "Failed to reserve serials")
+	}
+}
+
+// reservationWarehouse is the warehouse the order holds the product in, if
+// it holds it in only one.
+func reservationWarehouse(ctx context.Context, orderID, productID string) (string, error) {
+	reservation, err := findReservation(ctx, orderID)
+	if err != nil {
+		return "", err
+	}
+	warehouse := ""
+	for _, line := range reservation.Lines {
+		if line.ProductID != productID || line.Quantity == 0 {
+			continue
+		}
+		if warehouse != "" && warehouse != line.Warehouse {
+			return "", errWarehouseRequired
+		}
+		warehouse = line.Warehouse
+	}
+	if warehouse == "" {
+		return "", errNotReserved
+	}
+	return warehouse, nil
+}
+
+// reserveOrderSerials answers POST
+// /api/v1/inventory/reservations/:orderId/serials, setting specific units
+// of stock the order holds aside for it.
+func reserveOrderSerials(c *gin.Context) {
+	var req struct {
+		ProductID string `json:"product_id" binding:"required"`
+		// Needed if the order holds the product in several warehouses
+		Warehouse string   `json:"warehouse"`
+		Serials   []string `json:"serials" binding:"required,min=1,dive,required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	orderID := c.Param("orderId")
+	if req.Warehouse == "" {
+		warehouse, err := reservationWarehouse(ctx, orderID, req.ProductID)
+		if err != nil {
+			serialError(c, err, "")
+			return
+		}
+		req.Warehouse = warehouse
+	}
+	if serial, err := reserveSerials(ctx, orderID, req.ProductID, req.Warehouse, req.Serials); err != nil {
+		serialError(c, err, serial)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Serials reserved", "serials": req.Serials})
+}
+
+// lookupSerial answers GET /api/v1/inventory/serials/:serial with the
+// units carrying the serial, narrowed to a product with ?product_id=,
+// including the orders they shipped on.
+func lookupSerial(c *gin.Context) {
+	filter := bson.M{"serial": c.Param("serial")}
+	if productID := c.Query("product_id"); productID != "" {
+		filter["product_id"] = productID
+	}
+	cursor, err := inventoryService.db.Collection("inventory_serials").Find(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch serial"})
+		return
+	}
+	units := []SerialUnit{}
+	if err := cursor.All(c.Request.Context(), &units); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode serial"})
+		return
+	}
+	if len(units) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Serial not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"units": units})
+}
+
+// listOrderSerials answers GET /api/v1/inventory/reservations/:orderId/serials
+// with the units reserved for or shipped on the order.
+func listOrderSerials(c *gin.Context) {
+	orderID := c.Param("orderId")
+	cursor, err := inventoryService.db.Collection("inventory_serials").Find(c.Request.Context(),
+		bson.M{"$or": bson.A{bson.M{"order_id": orderID}, bson.M{"shipments.order_id": orderID}}},
+		options.Find().SetSort(bson.D{{Key: "product_id", Value: 1}, {Key: "serial", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch serials"})
+		return
+	}
+	units := []SerialUnit{}
+	if err := cursor.All(c.Request.Context(), &units); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode serials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"units": units, "count": len(units)})
+}
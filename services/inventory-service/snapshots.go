@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stock is snapshotted once a day (UTC) into inventory_snapshots, a row per
+// product per warehouse, for historical stock levels and valuation. Every
+// INVENTORY_SNAPSHOT_INTERVAL (default 1h) each instance checks whether
+// today's is taken; the first to claim it in inventory_snapshot_runs takes
+// it, and one that died halfway is retaken after snapshotRunTimeout.
+// Stock is valued on hand, available plus reserved, at its unit cost.
+type StockSnapshot struct {
+	ID        string    `bson:"_id" json:"-"`
+	Date      string    `bson:"date" json:"date"`
+	ProductID string    `bson:"product_id" json:"product_id"`
+	Warehouse string    `bson:"warehouse" json:"warehouse"`
+	Quantity  int       `bson:"quantity" json:"quantity"`
+	Reserved  int       `bson:"reserved" json:"reserved"`
+	UnitCost  float64   `bson:"unit_cost" json:"unit_cost"`
+	Value     float64   `bson:"value" json:"value"`
+	TakenAt   time.Time `bson:"taken_at" json:"taken_at"`
+}
+
+// StockLevel is stock on one day, summed over the snapshot rows asked for.
+type StockLevel struct {
+	Date     string  `bson:"_id" json:"date"`
+	Quantity int     `bson:"quantity" json:"quantity"`
+	Reserved int     `bson:"reserved" json:"reserved"`
+	Value    float64 `bson:"value" json:"value"`
+}
+
+// ValuationLine is the value of stock in a warehouse or of a product.
+type ValuationLine struct {
+	Key   string  `bson:"_id" json:"key"`
+	Units int     `bson:"units" json:"units"`
+	Value float64 `bson:"value" json:"value"`
+	// Units with no unit cost, valued at nothing
+	Uncosted int `bson:"uncosted" json:"uncosted"`
+}
+
+const (
+	snapshotDateLayout = "2006-01-02"
+	snapshotRunTimeout = time.Hour
+	snapshotBatch      = 1000
+	maxHistoryDays     = 400
+)
+
+var snapshotInterval = envDuration("INVENTORY_SNAPSHOT_INTERVAL", time.Hour)
+
+func startSnapshots() {
+	collection := inventoryService.db.Collection("inventory_snapshots")
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "date", Value: 1}, {Key: "warehouse", Value: 1}}},
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "date", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create snapshot indexes: %v", err)
+	}
+
+	go func() {
+		for {
+			if taken, err := takeDailySnapshot(context.Background(), time.Now().UTC()); err != nil {
+				log.Printf("Inventory snapshot failed: %v", err)
+			} else if taken > 0 {
+				log.Printf("Snapshotted %d inventory rows", taken)
+			}
+			time.Sleep(snapshotInterval)
+		}
+	}()
+}
+
+// takeDailySnapshot snapshots stock for the day unless it's been done or
+// another instance is doing it, returning how many rows it wrote.
+func takeDailySnapshot(ctx context.Context, now time.Time) (int, error) {
+	date := now.Format(snapshotDateLayout)
+	runs := inventoryService.db.Collection("inventory_snapshot_runs")
+	_, err := runs.InsertOne(ctx, bson.M{"_id": date, "started_at": now})
+	if mongo.IsDuplicateKeyError(err) {
+		result, err := runs.UpdateOne(ctx,
+			bson.M{"_id": date, "completed_at": bson.M{"$exists": false}, "started_at": bson.M{"$lt": now.Add(-snapshotRunTimeout)}},
+			bson.M{"$set": bson.M{"started_at": now}})
+		if err != nil || result.ModifiedCount == 0 {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	cursor, err := inventoryService.db.Collection("inventory").Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	snapshots := inventoryService.db.Collection("inventory_snapshots")
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := snapshots.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	taken := 0
+	for cursor.Next(ctx) {
+		var inv Inventory
+		if err := cursor.Decode(&inv); err != nil {
+			return taken, err
+		}
+		row := StockSnapshot{
+			ID:        date + "/" + inv.Warehouse + "/" + inv.ProductID,
+			Date:      date,
+			ProductID: inv.ProductID,
+			Warehouse: inv.Warehouse,
+			Quantity:  inv.Quantity,
+			Reserved:  inv.Reserved,
+			UnitCost:  inv.UnitCost,
+			Value:     float64(inv.Quantity+inv.Reserved) * inv.UnitCost,
+			TakenAt:   now,
+		}
+		// Rows are replaced, so a retaken snapshot doesn't duplicate them
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": row.ID}).SetReplacement(row).SetUpsert(true))
+		taken++
+		if len(models) >= snapshotBatch {
+			if err := flush(); err != nil {
+				return taken, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return taken, err
+	}
+	if err := flush(); err != nil {
+		return taken, err
+	}
+
+	_, err = runs.UpdateOne(ctx, bson.M{"_id": date}, bson.M{"$set": bson.M{"completed_at": time.Now(), "rows": taken}})
+	return taken, err
+}
+
+// getStockHistory answers GET /api/v1/inventory/reports/snapshots with
+// daily stock levels from ?from= to ?to= (YYYY-MM-DD, default the last 30
+// days), for a ?product_id=, a ?warehouse= or both.
+func getStockHistory(c *gin.Context) {
+	filter := bson.M{}
+	for _, field := range []string{"product_id", "warehouse"} {
+		if v := c.Query(field); v != "" {
+			filter[field] = v
+		}
+	}
+	if len(filter) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "product_id or warehouse is required"})
+		return
+	}
+
+	now := time.Now().UTC()
+	from, err := time.Parse(snapshotDateLayout, c.DefaultQuery("from", now.AddDate(0, 0, -30).Format(snapshotDateLayout)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date like 2024-01-31"})
+		return
+	}
+	to, err := time.Parse(snapshotDateLayout, c.DefaultQuery("to", now.Format(snapshotDateLayout)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date like 2024-01-31"})
+		return
+	}
+	if to.Before(from) || to.Sub(from) > maxHistoryDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to, and at most 400 days earlier"})
+		return
+	}
+	filter["date"] = bson.M{"$gte": from.Format(snapshotDateLayout), "$lte": to.Format(snapshotDateLayout)}
+
+	cursor, err := inventoryService.db.Collection("inventory_snapshots").Aggregate(c.Request.Context(), bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$group": bson.M{
+			"_id":      "$date",
+			"quantity": bson.M{"$sum": "$quantity"},
+			"reserved": bson.M{"$sum": "$reserved"},
+			"value":    bson.M{"$sum": "$value"},
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch stock history"})
+		return
+	}
+	levels := []StockLevel{}
+	if err := cursor.All(c.Request.Context(), &levels); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode stock history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"levels": levels, "count": len(levels)})
+}
+
+// getValuation answers GET /api/v1/inventory/reports/valuation with the
+// value of stock by warehouse, or by product with ?group_by=product. It
+// values current stock, or that of a past day's snapshot with ?date=.
+func getValuation(c *gin.Context) {
+	groupBy := c.DefaultQuery("group_by", "warehouse")
+	if groupBy != "warehouse" && groupBy != "product" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be warehouse or product"})
+		return
+	}
+	key := "$warehouse"
+	if groupBy == "product" {
+		key = "$product_id"
+	}
+
+	collection := inventoryService.db.Collection("inventory")
+	match := bson.M{}
+	date := c.Query("date")
+	if date != "" {
+		if _, err := time.Parse(snapshotDateLayout, date); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date must be a date like 2024-01-31"})
+			return
+		}
+		collection = inventoryService.db.Collection("inventory_snapshots")
+		match["date"] = date
+	}
+
+	units := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$quantity", 0}}, bson.M{"$ifNull": bson.A{"$reserved", 0}}}}
+	cost := bson.M{"$ifNull": bson.A{"$unit_cost", 0}}
+	cursor, err := collection.Aggregate(c.Request.Context(), bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":   key,
+			"units": bson.M{"$sum": units},
+			"value": bson.M{"$sum": bson.M{"$multiply": bson.A{units, cost}}},
+			"uncosted": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{cost, 0}}, 0, units,
+			}}},
+		}},
+		bson.M{"$sort": bson.M{"value": -1}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to value inventory"})
+		return
+	}
+	lines := []ValuationLine{}
+	if err := cursor.All(c.Request.Context(), &lines); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode valuation"})
+		return
+	}
+	if date != "" && len(lines) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No snapshot for " + date})
+		return
+	}
+
+	total := ValuationLine{Key: "total"}
+	for _, line := range lines {
+		total.Units += line.Units
+		total.Value += line.Value
+		total.Uncosted += line.Uncosted
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"group_by": groupBy,
+		"date":     date,
+		"lines":    lines,
+		"total":    total,
+	})
+}
+
+// setUnitCost answers PUT /api/v1/inventory/:productId/cost, setting what a
+// unit of the product on hand cost, where receipts don't carry it.
+func setUnitCost(c *gin.Context) {
+	var req struct {
+		// Needed if the product is stocked in several warehouses
+		Warehouse string  `json:"warehouse"`
+		UnitCost  float64 `json:"unit_cost" binding:"required,gt=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	filter, err := inventoryRow(ctx, c.Param("productId"), req.Warehouse)
+	if err == errWarehouseRequired {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set unit cost"})
+		return
+	}
+	result, err := inventoryService.db.Collection("inventory").UpdateOne(ctx, filter,
+		bson.M{"$set": bson.M{"unit_cost": req.UnitCost, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set unit cost"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inventory not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unit cost updated"})
+}
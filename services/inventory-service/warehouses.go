@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Inventory is kept per product per warehouse, one row each, which a
+// unique index enforces. Warehouses are described in the warehouses
+// collection for allocation, see allocation.go; stock can be held in a
+// warehouse that isn't described there, which is then allocated from last.
+type Warehouse struct {
+	Code string `bson:"_id" json:"code"`
+	Name string `bson:"name" json:"name" binding:"required"`
+	// Lower goes first; warehouses of equal priority go nearest first
+	Priority  int      `bson:"priority" json:"priority" binding:"min=0"`
+	Latitude  *float64 `bson:"latitude,omitempty" json:"latitude,omitempty" binding:"omitempty,min=-90,max=90"`
+	Longitude *float64 `bson:"longitude,omitempty" json:"longitude,omitempty" binding:"omitempty,min=-180,max=180"`
+	// ISO country codes the warehouse ships to; empty means anywhere
+	Countries []string `bson:"countries,omitempty" json:"countries,omitempty" binding:"dive,len=2"`
+	// Disabled warehouses keep their stock but aren't allocated from
+	Disabled  bool      `bson:"disabled" json:"disabled"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// Priority of warehouses that aren't described
+const defaultWarehousePriority = 1000
+
+var errWarehouseRequired = errors.New("warehouse is required, the product is stocked in several")
+
+// ProductStock is a product's inventory across warehouses.
+type ProductStock struct {
+	ProductID  string      `json:"product_id"`
+	Quantity   int         `json:"quantity"`
+	Reserved   int         `json:"reserved"`
+	Warehouses []Inventory `json:"warehouses"`
+}
+
+func setupInventoryIndexes() {
+	_, err := inventoryService.db.Collection("inventory").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "warehouse", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create inventory index, products may have duplicate warehouse rows: %v", err)
+	}
+}
+
+// inventoryRow picks the product's row in the warehouse. The warehouse can
+// be left out for products stocked in only one.
+func inventoryRow(ctx context.Context, productID, warehouse string) (bson.M, error) {
+	filter := bson.M{"product_id": productID}
+	if warehouse != "" {
+		filter["warehouse"] = warehouse
+		return filter, nil
+	}
+	rows, err := inventoryService.db.Collection("inventory").CountDocuments(ctx, filter, options.Count().SetLimit(2))
+	if err != nil {
+		return nil, err
+	}
+	if rows > 1 {
+		return nil, errWarehouseRequired
+	}
+	return filter, nil
+}
+
+func putWarehouse(c *gin.Context) {
+	var warehouse Warehouse
+	if err := c.ShouldBindJSON(&warehouse); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (warehouse.Latitude == nil) != (warehouse.Longitude == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latitude and longitude go together"})
+		return
+	}
+
+	warehouse.Code = c.Param("code")
+	warehouse.UpdatedAt = time.Now()
+	_, err := inventoryService.db.Collection("warehouses").ReplaceOne(context.Background(),
+		bson.M{"_id": warehouse.Code}, warehouse, options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save warehouse"})
+		return
+	}
+
+	c.JSON(http.StatusOK, warehouse)
+}
+
+func listWarehouses(c *gin.Context) {
+	cursor, err := inventoryService.db.Collection("warehouses").Find(context.Background(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "priority", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch warehouses"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	warehouses := []Warehouse{}
+	if err := cursor.All(context.Background(), &warehouses); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode warehouses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"warehouses": warehouses})
+}
+
+// deleteWarehouse forgets a warehouse's description; its stock stays.
+func deleteWarehouse(c *gin.Context) {
+	result, err := inventoryService.db.Collection("warehouses").DeleteOne(context.Background(), bson.M{"_id": c.Param("code")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete warehouse"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Warehouse not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Warehouse deleted"})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var authClient = &http.Client{Timeout: 5 * time.Second}
+
+func authServiceURL() string {
+	if url := os.Getenv("AUTH_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://user-auth-service:8001"
+}
+
+// fetchAddress resolves an address-book entry on behalf of the caller by
+// forwarding their Authorization header, so users can only embed their own
+// addresses.
+func fetchAddress(ctx context.Context, authorization, id string) (*Address, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authServiceURL()+"/api/v1/auth/addresses/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("address %s: auth service returned %d", id, resp.StatusCode)
+	}
+
+	var address Address
+	if err := json.NewDecoder(resp.Body).Decode(&address); err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// resolveAddresses embeds the referenced address-book entries into the order.
+// Addresses already given inline take precedence.
+func resolveAddresses(c *gin.Context, order *Order) error {
+	authorization := c.GetHeader("Authorization")
+
+	if order.ShippingAddress == nil && order.ShippingAddressID != "" {
+		address, err := fetchAddress(c.Request.Context(), authorization, order.ShippingAddressID)
+		if err != nil {
+			return err
+		}
+		order.ShippingAddress = address
+	}
+
+	if order.BillingAddress == nil && order.BillingAddressID != "" {
+		address, err := fetchAddress(c.Request.Context(), authorization, order.BillingAddressID)
+		if err != nil {
+			return err
+		}
+		order.BillingAddress = address
+	}
+
+	return nil
+}
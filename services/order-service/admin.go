@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CustomerInsight is the staff-only view of the customer shown next to an
+// order: their tags (VIP, fraud-risk, ...) and internal support notes.
+type CustomerInsight struct {
+	Tags  []string `json:"tags"`
+	Notes []struct {
+		Body      string `json:"body"`
+		AuthorID  string `json:"author_id"`
+		CreatedAt string `json:"created_at"`
+	} `json:"notes"`
+}
+
+func fetchCustomerInsight(ctx context.Context, authorization, userID string) (*CustomerInsight, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authServiceURL()+"/api/v1/admin/users/"+userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var insight CustomerInsight
+	if resp.StatusCode != http.StatusOK {
+		return &insight, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&insight); err != nil {
+		return nil, err
+	}
+	return &insight, nil
+}
+
+func adminGetOrder(c *gin.Context) {
+	collection := orderService.db.Collection("orders")
+
+	var order Order
+	err := collection.FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&order)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	response := gin.H{"order": order}
+
+	// The order is still useful to support when the auth service is down.
+	insight, err := fetchCustomerInsight(c.Request.Context(), c.GetHeader("Authorization"), order.UserID)
+	if err == nil {
+		response["customer"] = insight
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Attachment struct {
+	ID          string    `bson:"_id,omitempty" json:"id"`
+	OrderID     string    `bson:"order_id" json:"order_id"`
+	Kind        string    `bson:"kind" json:"kind"`
+	FileName    string    `bson:"file_name" json:"file_name"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int64     `bson:"size" json:"size"`
+	MediaID     string    `bson:"media_id" json:"media_id"`
+	URL         string    `bson:"url" json:"url"`
+	StaffOnly   bool      `bson:"staff_only" json:"staff_only"`
+	UploadedBy  string    `bson:"uploaded_by" json:"uploaded_by"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+}
+
+// attachmentPolicy controls who may upload and see each kind of attachment.
+type attachmentPolicy struct {
+	customerUpload  bool
+	customerVisible bool
+}
+
+var attachmentKinds = map[string]attachmentPolicy{
+	"proof_of_delivery": {customerUpload: false, customerVisible: true},
+	"damage_photo":      {customerUpload: true, customerVisible: true},
+	"customs_document":  {customerUpload: false, customerVisible: true},
+	"internal":          {customerUpload: false, customerVisible: false},
+}
+
+var allowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"application/pdf": true,
+}
+
+func maxAttachmentBytes() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("MAX_ATTACHMENT_BYTES"), 10, 64); err == nil {
+		return v
+	}
+	return 10 << 20
+}
+
+func mediaServiceURL() string {
+	if url := os.Getenv("MEDIA_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://media-service:8009"
+}
+
+var mediaClient = &http.Client{Timeout: 30 * time.Second}
+
+// uploadToMedia stores the file with the media service and returns its media
+// ID and URL.
+func uploadToMedia(ctx context.Context, folder string, file *multipart.FileHeader) (string, string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("folder", folder)
+	part, err := writer.CreateFormFile("file", file.Filename)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(part, src); err != nil {
+		return "", "", err
+	}
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, mediaServiceURL()+"/api/v1/media", &body)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("media service returned %d", resp.StatusCode)
+	}
+
+	var media struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil {
+		return "", "", err
+	}
+	return media.ID, media.URL, nil
+}
+
+// sniffContentType decides the file's type from its content; the type the
+// client sent is not trusted.
+func sniffContentType(file *multipart.FileHeader) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+func uploadAttachment(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := loadAccessibleOrder(c, id); !ok {
+		return
+	}
+
+	kind := c.PostForm("kind")
+	policy, ok := attachmentKinds[kind]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown attachment kind"})
+		return
+	}
+	if !policy.customerUpload && !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if file.Size > maxAttachmentBytes() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+		return
+	}
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if !allowedAttachmentTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type"})
+		return
+	}
+
+	mediaID, url, err := uploadToMedia(c.Request.Context(), "orders/"+id, file)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	attachment := Attachment{
+		OrderID:     id,
+		Kind:        kind,
+		FileName:    file.Filename,
+		ContentType: contentType,
+		Size:        file.Size,
+		MediaID:     mediaID,
+		URL:         url,
+		StaffOnly:   !policy.customerVisible,
+		UploadedBy:  c.GetString("user_id"),
+		CreatedAt:   time.Now(),
+	}
+
+	collection := orderService.db.Collection("order_attachments")
+	result, err := collection.InsertOne(context.Background(), attachment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+	attachment.ID = idString(result.InsertedID)
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID:   id,
+		Type:      "attachment_added",
+		Message:   fmt.Sprintf("Attached %s", file.Filename),
+		Actor:     attachment.UploadedBy,
+		StaffOnly: attachment.StaffOnly,
+		Data:      bson.M{"attachment_id": attachment.ID, "kind": kind, "url": url},
+	})
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+func listAttachments(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := loadAccessibleOrder(c, id); !ok {
+		return
+	}
+
+	filter := bson.M{"order_id": id}
+	if !isStaff(c) {
+		filter["staff_only"] = false
+	}
+
+	collection := orderService.db.Collection("order_attachments")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachments"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	attachments := []Attachment{}
+	if err = cursor.All(context.Background(), &attachments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode attachments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"attachments": attachments,
+		"count":       len(attachments),
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// purchasedStatuses are the order states in which the customer has paid.
+var purchasedStatuses = bson.A{"paid", "partially_fulfilled", "fulfilled", "shipped", "delivered"}
+
+const (
+	defaultCoPurchaseDays  = 180
+	defaultCoPurchaseLimit = 20
+	// Larger orders are restocking or B2B, not a customer's picks, and
+	// would pair everything with everything
+	maxCoPurchaseItems = 50
+)
+
+// CoPurchase is a product bought in the same orders as another.
+type CoPurchase struct {
+	ProductID string `bson:"product_id" json:"product_id"`
+	Orders    int    `bson:"orders" json:"orders"`
+}
+
+// getCoPurchases answers GET /api/v1/orders/co-purchases with, for every
+// product, the products most often bought in the same paid order, for the
+// product service's recommendations. ?days= sets the window (default 180),
+// ?min_orders= how many orders a pair needs (default 2) and ?limit= how
+// many products are listed for each (default 20).
+func getCoPurchases(c *gin.Context) {
+	days := queryInt(c, "days", defaultCoPurchaseDays)
+	minOrders := queryInt(c, "min_orders", 2)
+	limit := queryInt(c, "limit", defaultCoPurchaseLimit)
+	since := time.Now().AddDate(0, 0, -days)
+
+	products, err := coPurchases(c.Request.Context(), since, minOrders, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to aggregate co-purchases"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"products": products, "count": len(products), "since": since})
+}
+
+func queryInt(c *gin.Context, key string, fallback int) int {
+	if n, err := strconv.Atoi(c.Query(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// coPurchases pairs up the distinct products of each paid order since the
+// time and counts the orders of each pair.
+func coPurchases(ctx context.Context, since time.Time, minOrders, limit int) (map[string][]CoPurchase, error) {
+	cursor, err := orderService.db.Collection("orders").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": bson.M{"$in": purchasedStatuses}, "created_at": bson.M{"$gte": since}}}},
+		{{Key: "$project", Value: bson.M{"products": bson.M{"$setUnion": bson.A{"$items.product_id", bson.A{}}}}}},
+		{{Key: "$match", Value: bson.M{"products.1": bson.M{"$exists": true}, "products." + strconv.Itoa(maxCoPurchaseItems): bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bson.M{"product": "$products", "related": "$products"}}},
+		{{Key: "$unwind", Value: "$product"}},
+		{{Key: "$unwind", Value: "$related"}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$ne": bson.A{"$product", "$related"}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"product": "$product", "related": "$related"},
+			"orders": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"orders": bson.M{"$gte": minOrders}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.product", Value: 1}, {Key: "orders", Value: -1}, {Key: "_id.related", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$_id.product",
+			"related": bson.M{"$push": bson.M{"product_id": "$_id.related", "orders": "$orders"}},
+		}}},
+		{{Key: "$project", Value: bson.M{"related": bson.M{"$slice": bson.A{"$related", limit}}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ProductID string       `bson:"_id"`
+		Related   []CoPurchase `bson:"related"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	products := make(map[string][]CoPurchase, len(rows))
+	for _, row := range rows {
+		products[row.ProductID] = row.Related
+	}
+	return products, nil
+}
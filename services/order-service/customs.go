@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DutyCalculator estimates import duties for goods shipped to a destination
+// country.
+type DutyCalculator interface {
+	Estimate(ctx context.Context, country string, items []OrderItem) (*DutyEstimate, error)
+}
+
+type DutyEstimate struct {
+	Country          string     `json:"country"`
+	Currency         string     `json:"currency"`
+	GoodsValue       float64    `json:"goods_value"`
+	DeMinimisApplied bool       `json:"de_minimis_applied"`
+	Lines            []DutyLine `json:"lines"`
+	Total            float64    `json:"total"`
+}
+
+type DutyLine struct {
+	ProductID string  `json:"product_id"`
+	HSCode    string  `json:"hs_code,omitempty"`
+	Value     float64 `json:"value"`
+	Rate      float64 `json:"rate"`
+	Duty      float64 `json:"duty"`
+}
+
+// DutyRule is the per-country duty configuration. HSRates maps HS code
+// prefixes to a rate overriding the country default; the longest matching
+// prefix wins.
+type DutyRule struct {
+	Rate      float64            `json:"rate"`
+	DeMinimis float64            `json:"de_minimis"`
+	HSRates   map[string]float64 `json:"hs_rates"`
+}
+
+// tableDutyCalculator applies rates configured through DUTY_RATES, e.g.
+// {"GB": {"rate": 0.04, "de_minimis": 135, "hs_rates": {"6109": 0.12}}}.
+// The "*" key is used for countries without an explicit rule.
+type tableDutyCalculator struct {
+	rules    map[string]DutyRule
+	currency string
+}
+
+var dutyCalculator DutyCalculator
+
+func newDutyCalculator() DutyCalculator {
+	calc := &tableDutyCalculator{
+		rules:    map[string]DutyRule{},
+		currency: customsCurrency(),
+	}
+
+	if raw := os.Getenv("DUTY_RATES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &calc.rules); err != nil {
+			log.Printf("Invalid DUTY_RATES, duties will not be estimated: %v", err)
+		}
+	}
+
+	return calc
+}
+
+func (t *tableDutyCalculator) Estimate(ctx context.Context, country string, items []OrderItem) (*DutyEstimate, error) {
+	country = strings.ToUpper(country)
+	estimate := &DutyEstimate{Country: country, Currency: t.currency, Lines: []DutyLine{}}
+
+	rule, ok := t.rules[country]
+	if !ok {
+		rule = t.rules["*"]
+	}
+
+	for _, item := range items {
+		product, err := fetchProduct(ctx, item.ProductID)
+		if err != nil {
+			return nil, err
+		}
+
+		line := DutyLine{ProductID: item.ProductID, Value: item.Price * float64(item.Quantity)}
+		if product.Customs != nil {
+			line.HSCode = product.Customs.HSCode
+			if product.Customs.Value > 0 {
+				line.Value = product.Customs.Value * float64(item.Quantity)
+			}
+		}
+		line.Rate = rule.rateFor(line.HSCode)
+		line.Duty = roundAmount(t.currency, line.Value*line.Rate)
+
+		estimate.GoodsValue += line.Value
+		estimate.Lines = append(estimate.Lines, line)
+	}
+
+	if rule.DeMinimis > 0 && estimate.GoodsValue <= rule.DeMinimis {
+		estimate.DeMinimisApplied = true
+		return estimate, nil
+	}
+
+	for _, line := range estimate.Lines {
+		estimate.Total += line.Duty
+	}
+	estimate.Total = roundAmount(t.currency, estimate.Total)
+
+	return estimate, nil
+}
+
+func (r DutyRule) rateFor(hsCode string) float64 {
+	rate, matched := r.Rate, 0
+	for prefix, prefixRate := range r.HSRates {
+		if strings.HasPrefix(hsCode, prefix) && len(prefix) > matched {
+			rate, matched = prefixRate, len(prefix)
+		}
+	}
+	return rate
+}
+
+func shipFromCountry() string {
+	if country := os.Getenv("SHIP_FROM_COUNTRY"); country != "" {
+		return strings.ToUpper(country)
+	}
+	return "US"
+}
+
+func customsCurrency() string {
+	if currency := os.Getenv("CUSTOMS_CURRENCY"); currency != "" {
+		return currency
+	}
+	return "USD"
+}
+
+func isInternational(address *Address) bool {
+	return address != nil && address.Country != "" && strings.ToUpper(address.Country) != shipFromCountry()
+}
+
+func estimateDuties(c *gin.Context) {
+	var req struct {
+		Country string      `json:"country" binding:"required"`
+		Items   []OrderItem `json:"items" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !isInternational(&Address{Country: req.Country}) {
+		c.JSON(http.StatusOK, &DutyEstimate{Country: strings.ToUpper(req.Country), Currency: customsCurrency(), Lines: []DutyLine{}})
+		return
+	}
+
+	estimate, err := dutyCalculator.Estimate(c.Request.Context(), req.Country, req.Items)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to estimate duties"})
+		return
+	}
+
+	c.JSON(http.StatusOK, estimate)
+}
+
+// CustomsDeclaration is the payload handed to carriers for international
+// shipments. Low-value parcels use a CN22 form, everything else a
+// commercial invoice.
+type CustomsDeclaration struct {
+	FormType      string        `json:"form_type"`
+	OrderID       string        `json:"order_id"`
+	SenderCountry string        `json:"sender_country"`
+	Recipient     *Address      `json:"recipient"`
+	ContentsType  string        `json:"contents_type"`
+	Currency      string        `json:"currency"`
+	Items         []CustomsItem `json:"items"`
+	TotalValue    float64       `json:"total_value"`
+	TotalWeightKg float64       `json:"total_weight_kg"`
+	CreatedAt     time.Time     `json:"created_at"`
+}
+
+type CustomsItem struct {
+	Description     string  `json:"description"`
+	Quantity        int     `json:"quantity"`
+	Value           float64 `json:"value"`
+	WeightKg        float64 `json:"weight_kg"`
+	HSCode          string  `json:"hs_code"`
+	CountryOfOrigin string  `json:"country_of_origin"`
+}
+
+func cn22MaxValue() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("CN22_MAX_VALUE"), 64); err == nil {
+		return v
+	}
+	return 300
+}
+
+func getCustomsDeclaration(c *gin.Context) {
+	id := c.Param("id")
+	collection := orderService.db.Collection("orders")
+
+	var order Order
+	err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	if !isInternational(order.ShippingAddress) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Order is not an international shipment"})
+		return
+	}
+
+	declaration := CustomsDeclaration{
+		OrderID:       order.ID,
+		SenderCountry: shipFromCountry(),
+		Recipient:     order.ShippingAddress,
+		ContentsType:  "merchandise",
+		Currency:      customsCurrency(),
+		Items:         []CustomsItem{},
+		CreatedAt:     time.Now(),
+	}
+
+	for _, item := range shippableItems(order.Items) {
+		product, err := fetchProduct(c.Request.Context(), item.ProductID)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load product customs data"})
+			return
+		}
+
+		customsItem := CustomsItem{
+			Description: product.Name,
+			Quantity:    item.Quantity,
+			Value:       item.Price * float64(item.Quantity),
+		}
+		if product.Customs != nil {
+			customsItem.HSCode = product.Customs.HSCode
+			customsItem.CountryOfOrigin = product.Customs.CountryOfOrigin
+			customsItem.WeightKg = product.Customs.WeightKg * float64(item.Quantity)
+			if product.Customs.Value > 0 {
+				customsItem.Value = product.Customs.Value * float64(item.Quantity)
+			}
+		}
+
+		declaration.Items = append(declaration.Items, customsItem)
+		declaration.TotalValue += customsItem.Value
+		declaration.TotalWeightKg += customsItem.WeightKg
+	}
+
+	declaration.TotalValue = roundAmount(declaration.Currency, declaration.TotalValue)
+	declaration.FormType = "cn22"
+	if declaration.TotalValue > cn22MaxValue() {
+		declaration.FormType = "commercial_invoice"
+	}
+
+	c.JSON(http.StatusOK, declaration)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DispatchPromise is when the customer was told the order would leave the
+// warehouse, as estimated by the inventory service from carrier cutoffs
+// when the order was placed.
+type DispatchPromise struct {
+	Date      string    `bson:"date" json:"date"`
+	Warehouse string    `bson:"warehouse" json:"warehouse"`
+	Carrier   string    `bson:"carrier" json:"carrier"`
+	CutoffAt  time.Time `bson:"cutoff_at" json:"cutoff_at"`
+	SameDay   bool      `bson:"same_day" json:"same_day"`
+	Split     bool      `bson:"split,omitempty" json:"split,omitempty"`
+}
+
+var inventoryClient = &http.Client{Timeout: 2 * time.Second}
+
+func inventoryServiceURL() string {
+	if url := os.Getenv("INVENTORY_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://inventory-service:8006"
+}
+
+// promiseDispatch asks the inventory service when the shippable lines would
+// be dispatched to the shipping address.
+func promiseDispatch(ctx context.Context, items []OrderItem, address *Address) (*DispatchPromise, error) {
+	lines := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, map[string]interface{}{"product_id": item.ProductID, "quantity": item.Quantity})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"items": lines, "country": address.Country})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inventoryServiceURL()+"/api/v1/inventory/dispatch/estimate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory service returned %d", resp.StatusCode)
+	}
+
+	var estimate struct {
+		Dispatch DispatchPromise `json:"dispatch"`
+		Split    bool            `json:"split"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&estimate); err != nil {
+		return nil, err
+	}
+	estimate.Dispatch.Split = estimate.Split
+	return &estimate.Dispatch, nil
+}
+
+// stampDispatchPromise records the promised dispatch on a new order. An
+// order is never refused for want of an estimate; it just goes without,
+// rather than keeping a promise sent in the order body.
+func stampDispatchPromise(ctx context.Context, order *Order, shippable []OrderItem) {
+	order.PromisedDispatch = nil
+	if len(shippable) == 0 || order.ShippingAddress == nil {
+		return
+	}
+	promise, err := promiseDispatch(ctx, shippable, order.ShippingAddress)
+	if err != nil {
+		log.Printf("Failed to estimate dispatch for order by %s: %v", order.UserID, err)
+		return
+	}
+	order.PromisedDispatch = promise
+}
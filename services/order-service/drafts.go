@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DraftOrder is an order a sales rep composes for a B2B customer with
+// negotiated prices, then sends as a quote. The customer accepts it online
+// before it expires, which turns it into a real order.
+type DraftOrder struct {
+	ID              string      `bson:"_id,omitempty" json:"id"`
+	CustomerID      string      `bson:"customer_id" json:"customer_id"`
+	SalesRepID      string      `bson:"sales_rep_id" json:"sales_rep_id"`
+	Items           []DraftItem `bson:"items" json:"items"`
+	Discount        float64     `bson:"discount" json:"discount"`
+	Currency        string      `bson:"currency" json:"currency"`
+	ShippingAddress *Address    `bson:"shipping_address,omitempty" json:"shipping_address,omitempty"`
+	BillingAddress  *Address    `bson:"billing_address,omitempty" json:"billing_address,omitempty"`
+	// Net days the customer may pay in after accepting; 0 means pay now
+	PaymentTermsDays int        `bson:"payment_terms_days" json:"payment_terms_days"`
+	Notes            string     `bson:"notes,omitempty" json:"notes,omitempty"`
+	InternalNotes    string     `bson:"internal_notes,omitempty" json:"internal_notes,omitempty"`
+	Status           string     `bson:"status" json:"status"`
+	ExpiresAt        *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	SentAt           *time.Time `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+	AcceptedAt       *time.Time `bson:"accepted_at,omitempty" json:"accepted_at,omitempty"`
+	OrderID          string     `bson:"order_id,omitempty" json:"order_id,omitempty"`
+	CreatedAt        time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// DraftItem carries the catalog price alongside the negotiated one so the
+// quote can show the saving.
+type DraftItem struct {
+	ProductID string  `bson:"product_id" json:"product_id" binding:"required"`
+	Quantity  int     `bson:"quantity" json:"quantity" binding:"required,min=1"`
+	Price     float64 `bson:"price" json:"price"`
+	ListPrice float64 `bson:"list_price" json:"list_price"`
+}
+
+const (
+	draftOpen      = "draft"
+	draftSent      = "sent"
+	draftAccepted  = "accepted"
+	draftCancelled = "cancelled"
+)
+
+const defaultQuoteValidity = 14 * 24 * time.Hour
+
+type draftRequest struct {
+	CustomerID       string      `json:"customer_id" binding:"required"`
+	Items            []DraftItem `json:"items" binding:"required,min=1,dive"`
+	Discount         float64     `json:"discount" binding:"min=0"`
+	Currency         string      `json:"currency"`
+	ShippingAddress  *Address    `json:"shipping_address"`
+	BillingAddress   *Address    `json:"billing_address"`
+	PaymentTermsDays int         `json:"payment_terms_days" binding:"min=0,max=120"`
+	Notes            string      `json:"notes"`
+	InternalNotes    string      `json:"internal_notes"`
+}
+
+// apply copies the request onto the draft, looking up list prices. Lines
+// without a negotiated price are quoted at list price.
+func (req *draftRequest) apply(ctx context.Context, draft *DraftOrder) error {
+	for i := range req.Items {
+		item := &req.Items[i]
+		product, err := fetchProduct(ctx, item.ProductID)
+		if err != nil {
+			return fmt.Errorf("product %s: %w", item.ProductID, err)
+		}
+		item.ListPrice = product.Price
+		if item.Price <= 0 {
+			item.Price = product.Price
+		}
+	}
+
+	draft.CustomerID = req.CustomerID
+	draft.Items = req.Items
+	draft.Discount = req.Discount
+	draft.Currency = req.Currency
+	draft.ShippingAddress = req.ShippingAddress
+	draft.BillingAddress = req.BillingAddress
+	draft.PaymentTermsDays = req.PaymentTermsDays
+	draft.Notes = req.Notes
+	draft.InternalNotes = req.InternalNotes
+	return nil
+}
+
+// toOrder builds the order the draft would become.
+func (d *DraftOrder) toOrder() Order {
+	order := Order{
+		UserID:          d.CustomerID,
+		Currency:        d.Currency,
+		Discount:        d.Discount,
+		ShippingAddress: d.ShippingAddress,
+		BillingAddress:  d.BillingAddress,
+		DraftOrderID:    d.ID,
+	}
+	for _, item := range d.Items {
+		order.Items = append(order.Items, OrderItem{ProductID: item.ProductID, Quantity: item.Quantity, Price: item.Price})
+	}
+	return order
+}
+
+// quoteView is a draft with its totals priced the same way checkout would.
+func quoteView(d *DraftOrder, staff bool) gin.H {
+	order := d.toOrder()
+	if err := priceQuotedOrder(context.Background(), &order, d); err != nil {
+		log.Printf("Failed to price draft order %s: %v", d.ID, err)
+	}
+
+	status := d.Status
+	if status == draftSent && d.ExpiresAt != nil && d.ExpiresAt.Before(time.Now()) {
+		status = "expired"
+	}
+
+	view := gin.H{
+		"id":                 d.ID,
+		"customer_id":        d.CustomerID,
+		"items":              d.Items,
+		"status":             status,
+		"expires_at":         d.ExpiresAt,
+		"payment_terms_days": d.PaymentTermsDays,
+		"notes":              d.Notes,
+		"order_id":           d.OrderID,
+		"currency":           order.Currency,
+		"subtotal":           order.Subtotal,
+		"fees":               order.Fees,
+		"tax":                order.Tax,
+		"total":              order.Total,
+	}
+	if staff {
+		view["sales_rep_id"] = d.SalesRepID
+		view["internal_notes"] = d.InternalNotes
+		view["created_at"] = d.CreatedAt
+		view["updated_at"] = d.UpdatedAt
+		view["pricing_trace"] = order.PricingTrace
+	}
+	return view
+}
+
+func createDraftOrder(c *gin.Context) {
+	var req draftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	draft := DraftOrder{
+		SalesRepID: c.GetString("user_id"),
+		Status:     draftOpen,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	if err := req.apply(c.Request.Context(), &draft); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := orderService.db.Collection("draft_orders").InsertOne(context.Background(), draft)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create draft order"})
+		return
+	}
+	draft.ID = idString(result.InsertedID)
+
+	c.JSON(http.StatusCreated, quoteView(&draft, true))
+}
+
+// updateDraftOrder edits a draft or a sent quote. Editing a sent quote
+// withdraws it, so the rep has to send the new version.
+func updateDraftOrder(c *gin.Context) {
+	var req draftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := orderService.db.Collection("draft_orders")
+	var draft DraftOrder
+	if err := collection.FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&draft); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft order not found"})
+		return
+	}
+	if draft.Status != draftOpen && draft.Status != draftSent {
+		c.JSON(http.StatusConflict, gin.H{"error": "Draft order is " + draft.Status})
+		return
+	}
+
+	if err := req.apply(c.Request.Context(), &draft); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	draft.Status = draftOpen
+	draft.ExpiresAt = nil
+	draft.UpdatedAt = time.Now()
+
+	// The stored _id may be an ObjectID, so leave it out of the replacement
+	id := draft.ID
+	filter := idFilter(id)
+	filter["status"] = bson.M{"$in": bson.A{draftOpen, draftSent}}
+	draft.ID = ""
+	result, err := collection.ReplaceOne(context.Background(), filter, draft)
+	draft.ID = id
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update draft order"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Draft order was accepted or cancelled meanwhile"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quoteView(&draft, true))
+}
+
+func listDraftOrders(c *gin.Context) {
+	filter := bson.M{}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	if customerID := c.Query("customer_id"); customerID != "" {
+		filter["customer_id"] = customerID
+	}
+	findDraftOrders(c, filter, true)
+}
+
+func adminGetDraftOrder(c *gin.Context) {
+	var draft DraftOrder
+	err := orderService.db.Collection("draft_orders").FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&draft)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft order not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quoteView(&draft, true))
+}
+
+// sendQuote emails the draft to the customer as a quote valid until
+// expires_at (default 14 days).
+func sendQuote(c *gin.Context) {
+	var req struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	c.ShouldBindJSON(&req)
+
+	expiresAt := time.Now().Add(defaultQuoteValidity)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	collection := orderService.db.Collection("draft_orders")
+	filter := idFilter(c.Param("id"))
+	filter["status"] = bson.M{"$in": bson.A{draftOpen, draftSent}}
+
+	now := time.Now()
+	var draft DraftOrder
+	err := collection.FindOneAndUpdate(context.Background(), filter,
+		bson.M{"$set": bson.M{"status": draftSent, "expires_at": expiresAt, "sent_at": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&draft)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open draft order not found"})
+		return
+	}
+
+	contact, err := fetchCustomerContact(c.Request.Context(), draft.CustomerID)
+	if err != nil {
+		log.Printf("Failed to look up customer %s for quote %s: %v", draft.CustomerID, draft.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Quote saved but the customer could not be emailed"})
+		return
+	}
+
+	body := fmt.Sprintf("We've prepared a quote for you. Review and accept it online before %s:\n%s",
+		expiresAt.Format("2 January 2006"), storefrontURL("/account/quotes/"+draft.ID))
+	if draft.Notes != "" {
+		body += "\n\n" + draft.Notes
+	}
+	if err := sendEmail(c.Request.Context(), contact.Email, "Your quote is ready", body); err != nil {
+		log.Printf("Failed to email quote %s: %v", draft.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Quote saved but the customer could not be emailed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quoteView(&draft, true))
+}
+
+func cancelDraftOrder(c *gin.Context) {
+	filter := idFilter(c.Param("id"))
+	filter["status"] = bson.M{"$in": bson.A{draftOpen, draftSent}}
+
+	result, err := orderService.db.Collection("draft_orders").UpdateOne(context.Background(), filter,
+		bson.M{"$set": bson.M{"status": draftCancelled, "updated_at": time.Now()}})
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Open draft order not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Draft order cancelled"})
+}
+
+// listQuotes shows customers the quotes they have been sent.
+func listQuotes(c *gin.Context) {
+	findDraftOrders(c, bson.M{
+		"customer_id": c.GetString("user_id"),
+		"status":      bson.M{"$in": bson.A{draftSent, draftAccepted}},
+	}, false)
+}
+
+func getQuote(c *gin.Context) {
+	draft, ok := loadCustomerQuote(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, quoteView(draft, false))
+}
+
+func loadCustomerQuote(c *gin.Context) (*DraftOrder, bool) {
+	var draft DraftOrder
+	err := orderService.db.Collection("draft_orders").FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&draft)
+	if err != nil || draft.CustomerID != c.GetString("user_id") || (draft.Status != draftSent && draft.Status != draftAccepted) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quote not found"})
+		return nil, false
+	}
+	return &draft, true
+}
+
+// acceptQuote converts a sent, unexpired quote into an order at the quoted
+// prices. Quotes with payment terms are confirmed straight away and invoiced
+// with a due date; the rest wait for payment like any other order.
+func acceptQuote(c *gin.Context) {
+	var req struct {
+		PaymentMethod string `json:"payment_method"`
+	}
+	c.ShouldBindJSON(&req)
+
+	draft, ok := loadCustomerQuote(c)
+	if !ok {
+		return
+	}
+
+	order := draft.toOrder()
+	order.PaymentMethod = req.PaymentMethod
+	if err := prepareFulfillment(c.Request.Context(), &order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyTaxExemption(c, &order)
+	if err := priceQuotedOrder(c.Request.Context(), &order, draft); err != nil {
+		pricingFailed(c, err)
+		return
+	}
+
+	now := time.Now()
+	order.Status = "pending"
+	if draft.PaymentTermsDays > 0 {
+		due := now.AddDate(0, 0, draft.PaymentTermsDays)
+		order.Status = "confirmed"
+		order.PaymentMethod = "invoice"
+		order.PaymentDueAt = &due
+	}
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	// Claim the quote first so it can only be accepted once
+	drafts := orderService.db.Collection("draft_orders")
+	filter := idFilter(draft.ID)
+	filter["status"] = draftSent
+	filter["expires_at"] = bson.M{"$gt": now}
+	claimed, err := drafts.UpdateOne(context.Background(), filter,
+		bson.M{"$set": bson.M{"status": draftAccepted, "accepted_at": now, "updated_at": now}})
+	if err != nil || claimed.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Quote has expired or was already accepted"})
+		return
+	}
+
+	result, err := orderService.db.Collection("orders").InsertOne(context.Background(), order)
+	if err != nil {
+		drafts.UpdateOne(context.Background(), idFilter(draft.ID),
+			bson.M{"$set": bson.M{"status": draftSent}, "$unset": bson.M{"accepted_at": ""}})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+		return
+	}
+	orderID := idString(result.InsertedID)
+	drafts.UpdateOne(context.Background(), idFilter(draft.ID), bson.M{"$set": bson.M{"order_id": orderID}})
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID: orderID,
+		Type:    "order_created",
+		Message: "Order placed from quote",
+		Actor:   order.UserID,
+		Data:    bson.M{"draft_order_id": draft.ID, "sales_rep_id": draft.SalesRepID},
+	})
+	recordTaxExemption(orderID, &order)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":        "Quote accepted",
+		"order_id":       orderID,
+		"status":         order.Status,
+		"total":          order.Total,
+		"currency":       order.Currency,
+		"payment_due_at": order.PaymentDueAt,
+	})
+}
+
+func findDraftOrders(c *gin.Context, filter bson.M, staff bool) {
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}}).SetLimit(100)
+	cursor, err := orderService.db.Collection("draft_orders").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch draft orders"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	var drafts []DraftOrder
+	if err := cursor.All(context.Background(), &drafts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode draft orders"})
+		return
+	}
+
+	views := []gin.H{}
+	for i := range drafts {
+		views = append(views, quoteView(&drafts[i], staff))
+	}
+	c.JSON(http.StatusOK, views)
+}
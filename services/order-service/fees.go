@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+)
+
+// FeeLine is an explicit charge on top of the goods total.
+type FeeLine struct {
+	Code        string  `bson:"code" json:"code"`
+	Description string  `bson:"description" json:"description"`
+	Amount      float64 `bson:"amount" json:"amount"`
+	Taxable     bool    `bson:"taxable" json:"taxable"`
+	Refundable  bool    `bson:"refundable" json:"refundable"`
+}
+
+// FeeConfig is read from ORDER_FEES, e.g.
+//
+//	{"shipping": {"amount": 5.99, "free_over": 50},
+//	 "small_order": {"amount": 4.99, "threshold": 25},
+//	 "gift_wrap": 5,
+//	 "payment_surcharges": {"amex": 0.02},
+//	 "surcharge_blocked_countries": ["DE", "FR"]}
+//
+// Payment surcharges are a rate of the goods subtotal and are skipped for
+// destinations where surcharging is not legal. Shipping is only charged on
+// lines that ship, and free_over applies to the value of those lines.
+type FeeConfig struct {
+	Shipping *struct {
+		Amount   float64 `json:"amount"`
+		FreeOver float64 `json:"free_over"`
+	} `json:"shipping"`
+	SmallOrder *struct {
+		Amount    float64 `json:"amount"`
+		Threshold float64 `json:"threshold"`
+	} `json:"small_order"`
+	GiftWrap                  float64            `json:"gift_wrap"`
+	PaymentSurcharges         map[string]float64 `json:"payment_surcharges"`
+	SurchargeBlockedCountries []string           `json:"surcharge_blocked_countries"`
+}
+
+var feeConfig FeeConfig
+
+func loadFeeConfig() {
+	raw := os.Getenv("ORDER_FEES")
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(raw), &feeConfig); err != nil {
+		log.Printf("Invalid ORDER_FEES, no fees will be charged: %v", err)
+		feeConfig = FeeConfig{}
+	}
+}
+
+func computeFees(order *Order, subtotal float64) []FeeLine {
+	fees := []FeeLine{}
+
+	if shipping := feeConfig.Shipping; shipping != nil {
+		shippable := shippableItems(order.Items)
+		shippableValue := 0.0
+		for _, item := range shippable {
+			shippableValue += item.Price * float64(item.Quantity)
+		}
+		if len(shippable) > 0 && (shipping.FreeOver <= 0 || shippableValue < shipping.FreeOver) {
+			fees = append(fees, FeeLine{
+				Code:        "shipping",
+				Description: "Shipping",
+				Amount:      shipping.Amount,
+				Taxable:     true,
+				Refundable:  false,
+			})
+		}
+	}
+
+	if small := feeConfig.SmallOrder; small != nil && subtotal < small.Threshold {
+		fees = append(fees, FeeLine{
+			Code:        "small_order",
+			Description: "Small order fee",
+			Amount:      small.Amount,
+			Taxable:     true,
+			Refundable:  true,
+		})
+	}
+
+	if order.GiftWrap && feeConfig.GiftWrap > 0 {
+		fees = append(fees, FeeLine{
+			Code:        "gift_wrap",
+			Description: "Gift wrapping",
+			Amount:      feeConfig.GiftWrap,
+			Taxable:     true,
+			Refundable:  true,
+		})
+	}
+
+	if rate, ok := feeConfig.PaymentSurcharges[order.PaymentMethod]; ok && surchargeAllowed(order.ShippingAddress) {
+		fees = append(fees, FeeLine{
+			Code:        "payment_surcharge",
+			Description: "Payment method surcharge (" + order.PaymentMethod + ")",
+			Amount:      roundAmount(order.Currency, subtotal*rate),
+			Taxable:     false,
+			Refundable:  false,
+		})
+	}
+
+	return fees
+}
+
+func surchargeAllowed(address *Address) bool {
+	if address == nil {
+		return true
+	}
+	for _, country := range feeConfig.SurchargeBlockedCountries {
+		if strings.EqualFold(country, address.Country) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fulfillment types. An order can mix them; each line is fulfilled and
+// tracked on its own.
+const (
+	FulfillShip    = "ship"
+	FulfillPickup  = "pickup"
+	FulfillDigital = "digital"
+)
+
+// lineTransitions lists the fulfillment states each line can move to, per
+// fulfillment type. Every line starts as "pending".
+var lineTransitions = map[string]map[string][]string{
+	FulfillShip: {
+		"pending": {"packed"},
+		"packed":  {"shipped"},
+		"shipped": {"delivered"},
+	},
+	FulfillPickup: {
+		"pending":          {"ready_for_pickup"},
+		"ready_for_pickup": {"picked_up"},
+	},
+	FulfillDigital: {
+		"pending": {"delivered"},
+	},
+}
+
+func lineDone(item OrderItem) bool {
+	return len(lineTransitions[item.Fulfillment][item.FulfillmentStatus]) == 0
+}
+
+var (
+	errDigitalMismatch = errors.New("digital fulfillment doesn't match product")
+	errPickupLocation  = errors.New("pickup lines need a pickup_location")
+)
+
+// prepareFulfillment assigns line IDs and fulfillment types to new order
+// lines. Digital products are always delivered digitally; other lines ship
+// unless the customer chose pickup.
+func prepareFulfillment(ctx context.Context, order *Order) error {
+	for i := range order.Items {
+		item := &order.Items[i]
+
+		product, err := fetchProduct(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case product.Digital:
+			if item.Fulfillment != "" && item.Fulfillment != FulfillDigital {
+				return errDigitalMismatch
+			}
+			item.Fulfillment = FulfillDigital
+		case item.Fulfillment == FulfillDigital:
+			return errDigitalMismatch
+		case item.Fulfillment == FulfillPickup:
+			if item.PickupLocation == "" {
+				return errPickupLocation
+			}
+		case item.Fulfillment == "" || item.Fulfillment == FulfillShip:
+			item.Fulfillment = FulfillShip
+		default:
+			return errors.New("unknown fulfillment type " + item.Fulfillment)
+		}
+
+		if item.Fulfillment != FulfillPickup {
+			item.PickupLocation = ""
+		}
+		item.LineID = primitive.NewObjectID().Hex()
+		item.FulfillmentStatus = "pending"
+	}
+	return nil
+}
+
+// shippableItems returns the lines that go out by carrier. Orders placed
+// before mixed fulfillment have no type set and are all shippable.
+func shippableItems(items []OrderItem) []OrderItem {
+	shippable := []OrderItem{}
+	for _, item := range items {
+		if item.Fulfillment == "" || item.Fulfillment == FulfillShip {
+			shippable = append(shippable, item)
+		}
+	}
+	return shippable
+}
+
+// rollupStatus derives the order status from its lines once fulfillment
+// has started.
+func rollupStatus(order *Order) string {
+	done := 0
+	for _, item := range order.Items {
+		if lineDone(item) {
+			done++
+		}
+	}
+	switch {
+	case done == len(order.Items):
+		return "fulfilled"
+	case done > 0:
+		return "partially_fulfilled"
+	}
+	return order.Status
+}
+
+// updateLineFulfillment moves a single order line to its next state.
+func updateLineFulfillment(c *gin.Context) {
+	var req struct {
+		Status         string `json:"status" binding:"required"`
+		TrackingNumber string `json:"tracking_number"`
+		Carrier        string `json:"carrier"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	collection := orderService.db.Collection("orders")
+	var order Order
+	if err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	if rejectIfHeld(c, &order) {
+		return
+	}
+
+	var line *OrderItem
+	for i := range order.Items {
+		if order.Items[i].LineID == c.Param("lineId") {
+			line = &order.Items[i]
+		}
+	}
+	if line == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order line not found"})
+		return
+	}
+
+	allowed := false
+	for _, next := range lineTransitions[line.Fulfillment][line.FulfillmentStatus] {
+		allowed = allowed || next == req.Status
+	}
+	if !allowed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot move line from " + line.FulfillmentStatus + " to " + req.Status})
+		return
+	}
+
+	if req.TrackingNumber != "" && req.Carrier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "carrier is required with a tracking number"})
+		return
+	}
+
+	now := time.Now()
+	line.FulfillmentStatus = req.Status
+	if req.TrackingNumber != "" {
+		line.TrackingNumber = req.TrackingNumber
+		addShipment(&order, req.Carrier, req.TrackingNumber, line.LineID)
+	}
+	if lineDone(*line) {
+		line.FulfilledAt = &now
+	}
+	order.Status = rollupStatus(&order)
+
+	_, err := collection.UpdateOne(
+		context.Background(),
+		idFilter(id),
+		bson.M{"$set": bson.M{"items": order.Items, "shipments": order.Shipments, "status": order.Status, "updated_at": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order line"})
+		return
+	}
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID: id,
+		Type:    "line_" + req.Status,
+		Message: "Item " + line.ProductID + " " + req.Status,
+		Actor:   c.GetString("user_id"),
+		Data:    bson.M{"line_id": line.LineID, "fulfillment": line.Fulfillment},
+	})
+
+	// Stock that leaves the warehouse is sold, paid for yet or not
+	if req.Status == "shipped" || req.Status == "picked_up" {
+		commitOrderStock(context.Background(), &order)
+	}
+	if order.Status == "fulfilled" {
+		orderDelivered(context.Background(), id)
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// deliverDigitalLines completes every digital line on an order. It runs as
+// soon as the order is paid since there is nothing to pick or pack.
+func deliverDigitalLines(ctx context.Context, orderID string) {
+	collection := orderService.db.Collection("orders")
+	var order Order
+	if err := collection.FindOne(ctx, idFilter(orderID)).Decode(&order); err != nil {
+		log.Printf("Failed to load order %s for digital delivery: %v", orderID, err)
+		return
+	}
+
+	now := time.Now()
+	delivered := 0
+	for i := range order.Items {
+		item := &order.Items[i]
+		if item.Fulfillment == FulfillDigital && item.FulfillmentStatus == "pending" {
+			item.FulfillmentStatus = "delivered"
+			item.FulfilledAt = &now
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		return
+	}
+	order.Status = rollupStatus(&order)
+
+	_, err := collection.UpdateOne(
+		ctx,
+		idFilter(orderID),
+		bson.M{"$set": bson.M{"items": order.Items, "status": order.Status, "updated_at": now}},
+	)
+	if err != nil {
+		log.Printf("Failed to deliver digital lines for order %s: %v", orderID, err)
+		return
+	}
+
+	recordTimelineEvent(ctx, TimelineEvent{
+		OrderID: orderID,
+		Type:    "digital_delivered",
+		Message: "Digital items are available in your account",
+		Data:    bson.M{"lines": delivered},
+	})
+
+	if order.Status == "fulfilled" {
+		orderDelivered(ctx, orderID)
+	}
+}
+
+// listPickQueue is the next picking wave: paid orders with lines still to
+// be picked for shipping or pickup, oldest first. Held orders stay out of
+// it until they are released.
+func listPickQueue(c *gin.Context) {
+	filter := bson.M{
+		"status": bson.M{"$in": bson.A{"paid", "partially_fulfilled"}},
+		"hold":   bson.M{"$exists": false},
+		"items": bson.M{"$elemMatch": bson.M{
+			"fulfillment":        bson.M{"$in": bson.A{FulfillShip, FulfillPickup}},
+			"fulfillment_status": "pending",
+		}},
+	}
+
+	limit := int64(100)
+	if n, err := strconv.ParseInt(c.Query("limit"), 10, 64); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(limit)
+	cursor, err := orderService.db.Collection("orders").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+		return
+	}
+
+	orders := []Order{}
+	if err := cursor.All(context.Background(), &orders); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "count": len(orders)})
+}
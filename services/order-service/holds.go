@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrderHold pauses fulfillment of an order until staff release it. While
+// held the order's status is "on_hold"; releasing restores PreviousStatus.
+type OrderHold struct {
+	Reason           string    `bson:"reason" json:"reason"`
+	Note             string    `bson:"note,omitempty" json:"note,omitempty"`
+	PreviousStatus   string    `bson:"previous_status" json:"previous_status"`
+	PlacedBy         string    `bson:"placed_by" json:"placed_by"`
+	PlacedAt         time.Time `bson:"placed_at" json:"placed_at"`
+	CustomerNotified bool      `bson:"customer_notified" json:"customer_notified"`
+}
+
+const (
+	holdPaymentReview   = "payment_review"
+	holdAddressProblem  = "address_problem"
+	holdCustomerRequest = "customer_request"
+
+	statusOnHold = "on_hold"
+)
+
+// holdMessages are what the customer is told about each reason, both in
+// the notification email and on their order timeline.
+var holdMessages = map[string]string{
+	holdPaymentReview:   "We're reviewing the payment for your order and will ship it as soon as that's done.",
+	holdAddressProblem:  "We couldn't verify your shipping address. Please contact us so we can get your order on its way.",
+	holdCustomerRequest: "Your order is on hold as you requested. Let us know when you'd like us to ship it.",
+}
+
+// holdNotifyReasons returns the reasons that email the customer, from
+// ORDER_HOLD_NOTIFY (comma separated, e.g. "address_problem,customer_request").
+// Holds are silent by default.
+func holdNotifyReasons() map[string]bool {
+	reasons := map[string]bool{}
+	for _, reason := range strings.Split(os.Getenv("ORDER_HOLD_NOTIFY"), ",") {
+		if reason = strings.TrimSpace(reason); reason != "" {
+			reasons[reason] = true
+		}
+	}
+	return reasons
+}
+
+// rejectIfHeld writes the error response for requests that would move a
+// held order along, reporting whether the order is on hold.
+func rejectIfHeld(c *gin.Context, order *Order) bool {
+	if order.Hold == nil {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "Order is on hold (" + order.Hold.Reason + ")"})
+	return true
+}
+
+func holdOrder(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason" binding:"required,oneof=payment_review address_problem customer_request"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := c.Param("id")
+	collection := orderService.db.Collection("orders")
+	var order Order
+	if err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if order.Hold != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is already on hold"})
+		return
+	}
+	if order.Status == "fulfilled" || order.Status == "delivered" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order has already been fulfilled"})
+		return
+	}
+
+	hold := OrderHold{
+		Reason:         req.Reason,
+		Note:           req.Note,
+		PreviousStatus: order.Status,
+		PlacedBy:       c.GetString("user_id"),
+		PlacedAt:       time.Now(),
+	}
+
+	// Matching on the status guards against a concurrent hold or update
+	filter := idFilter(id)
+	filter["status"] = order.Status
+	filter["hold"] = bson.M{"$exists": false}
+	err := collection.FindOneAndUpdate(context.Background(), filter,
+		bson.M{"$set": bson.M{"status": statusOnHold, "hold": hold, "updated_at": hold.PlacedAt}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&order)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order changed, please retry"})
+		return
+	}
+
+	if holdNotifyReasons()[req.Reason] {
+		order.Hold.CustomerNotified = notifyHold(c.Request.Context(), &order, "Your order is on hold", holdMessages[req.Reason])
+		if order.Hold.CustomerNotified {
+			collection.UpdateOne(context.Background(), idFilter(id), bson.M{"$set": bson.M{"hold.customer_notified": true}})
+		}
+	}
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID:   id,
+		Type:      "order_held",
+		Message:   holdMessages[req.Reason],
+		Actor:     hold.PlacedBy,
+		StaffOnly: !order.Hold.CustomerNotified,
+		Data:      bson.M{"reason": req.Reason, "note": req.Note},
+	})
+
+	c.JSON(http.StatusOK, order)
+}
+
+// releaseOrder lifts a hold and puts the order back where it was, so it
+// rejoins the pick queue if it was waiting to be picked.
+func releaseOrder(c *gin.Context) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	c.ShouldBindJSON(&req)
+
+	id := c.Param("id")
+	collection := orderService.db.Collection("orders")
+	var order Order
+	if err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if order.Hold == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is not on hold"})
+		return
+	}
+	hold := *order.Hold
+
+	filter := idFilter(id)
+	filter["hold.placed_at"] = hold.PlacedAt
+	err := collection.FindOneAndUpdate(context.Background(), filter,
+		bson.M{
+			"$set":   bson.M{"status": hold.PreviousStatus, "updated_at": time.Now()},
+			"$unset": bson.M{"hold": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&order)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order changed, please retry"})
+		return
+	}
+
+	// Payment may have been confirmed while the order was held
+	if order.Status == "paid" {
+		commitOrderStock(context.Background(), &order)
+		deliverDigitalLines(context.Background(), id)
+	}
+
+	// Customers who were told about the hold hear when it's lifted
+	notified := false
+	if hold.CustomerNotified {
+		notified = notifyHold(c.Request.Context(), &order, "Your order is on its way again",
+			"Your order is no longer on hold and we're getting it ready to ship.")
+	}
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID:   id,
+		Type:      "order_released",
+		Message:   "Order released from hold",
+		Actor:     c.GetString("user_id"),
+		StaffOnly: !hold.CustomerNotified,
+		Data:      bson.M{"reason": hold.Reason, "note": req.Note, "held_since": hold.PlacedAt, "customer_notified": notified},
+	})
+
+	c.JSON(http.StatusOK, order)
+}
+
+// notifyHold emails the customer about their order's hold. It's best
+// effort and reports whether the email was handed off.
+func notifyHold(ctx context.Context, order *Order, subject, message string) bool {
+	contact, err := fetchCustomerContact(ctx, order.UserID)
+	if err != nil {
+		log.Printf("Failed to look up customer %s for order %s hold: %v", order.UserID, order.ID, err)
+		return false
+	}
+
+	body := message + "\n\n" + storefrontURL("/orders/"+order.ID)
+	if err := sendEmail(ctx, contact.Email, subject, body); err != nil {
+		log.Printf("Failed to email hold notice for order %s: %v", order.ID, err)
+		return false
+	}
+	return true
+}
+
+// listHeldOrders is the support queue of orders waiting on a decision,
+// oldest hold first.
+func listHeldOrders(c *gin.Context) {
+	filter := bson.M{"hold": bson.M{"$exists": true}}
+	if reason := c.Query("reason"); reason != "" {
+		filter["hold.reason"] = reason
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "hold.placed_at", Value: 1}}).SetLimit(200)
+	cursor, err := orderService.db.Collection("orders").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+		return
+	}
+
+	orders := []Order{}
+	if err := cursor.All(context.Background(), &orders); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "count": len(orders)})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// idFilter matches a document by _id whether it was stored as an ObjectID
+// (driver generated) or as a plain string.
+func idFilter(id string) bson.M {
+	if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+		return bson.M{"_id": bson.M{"$in": bson.A{oid, id}}}
+	}
+	return bson.M{"_id": id}
+}
+
+// idString renders an InsertedID as the string form clients use.
+func idString(id interface{}) string {
+	switch v := id.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type LegacyOrder struct {
+	LegacyID  string    `json:"legacy_id" binding:"required"`
+	PlacedAt  time.Time `json:"placed_at" binding:"required"`
+	Total     float64   `json:"total"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	ItemCount int       `json:"item_count"`
+}
+
+type LegacyImportRequest struct {
+	UserID string        `json:"user_id" binding:"required"`
+	Orders []LegacyOrder `json:"orders" binding:"required,dive"`
+}
+
+// importLegacyOrders stores order history migrated from the previous
+// platform. Orders are keyed by their legacy ID so re-running an import
+// updates rather than duplicates them.
+func importLegacyOrders(c *gin.Context) {
+	var req LegacyImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := orderService.db.Collection("orders")
+	imported := 0
+	for _, legacy := range req.Orders {
+		currency := strings.ToUpper(legacy.Currency)
+		if currency == "" {
+			currency = defaultCurrency()
+		}
+		status := legacy.Status
+		if status == "" {
+			status = "delivered"
+		}
+
+		update := bson.M{
+			"$set": bson.M{
+				"user_id":    req.UserID,
+				"total":      legacy.Total,
+				"currency":   currency,
+				"status":     status,
+				"item_count": legacy.ItemCount,
+				"legacy":     true,
+				"updated_at": time.Now(),
+			},
+			"$setOnInsert": bson.M{
+				"_id":        "legacy-" + legacy.LegacyID,
+				"created_at": legacy.PlacedAt,
+			},
+		}
+		_, err := collection.UpdateOne(context.Background(),
+			bson.M{"legacy_id": legacy.LegacyID}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import orders"})
+			return
+		}
+		imported++
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": imported})
+}
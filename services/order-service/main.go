@@ -17,8 +17,41 @@ type Order struct {
 	ID        string    `bson:"_id,omitempty" json:"id"`
 	UserID    string    `bson:"user_id" json:"user_id"`
 	Items     []OrderItem `bson:"items" json:"items"`
+	Subtotal  float64   `bson:"subtotal" json:"subtotal"`
+	Fees      []FeeLine `bson:"fees" json:"fees"`
+	Tax       float64   `bson:"tax" json:"tax"`
+	TaxRate   float64   `bson:"tax_rate" json:"tax_rate"`
+	TaxExemptionID string `bson:"tax_exemption_id,omitempty" json:"tax_exemption_id,omitempty"`
+	// Negotiated discount, only set on orders converted from a quote
+	Discount     float64    `bson:"discount,omitempty" json:"discount,omitempty"`
+	PromoCode    string     `bson:"promo_code,omitempty" json:"promo_code,omitempty"`
+	// How each price and the total were arrived at, see pricing.go
+	PricingTrace []PricingStep `bson:"pricing_trace,omitempty" json:"pricing_trace,omitempty"`
+	DraftOrderID string     `bson:"draft_order_id,omitempty" json:"draft_order_id,omitempty"`
+	// Organization order request this was approved as, see organizations.go
+	OrderRequestID string   `bson:"order_request_id,omitempty" json:"order_request_id,omitempty"`
+	PaymentDueAt *time.Time `bson:"payment_due_at,omitempty" json:"payment_due_at,omitempty"`
+	RoundingAdjustment float64 `bson:"rounding_adjustment,omitempty" json:"rounding_adjustment,omitempty"`
 	Total     float64   `bson:"total" json:"total"`
+	Currency  string    `bson:"currency" json:"currency"`
+	PaymentMethod string `bson:"payment_method,omitempty" json:"payment_method,omitempty"`
+	GiftWrap      bool   `bson:"gift_wrap" json:"gift_wrap"`
+	DeliverySlot   *SlotBooking `bson:"delivery_slot,omitempty" json:"delivery_slot,omitempty"`
+	DeliverySlotID string       `bson:"-" json:"delivery_slot_id,omitempty"`
 	Status    string    `bson:"status" json:"status"`
+	ShippingAddress *Address `bson:"shipping_address,omitempty" json:"shipping_address,omitempty"`
+	BillingAddress  *Address `bson:"billing_address,omitempty" json:"billing_address,omitempty"`
+	// Address book references, resolved into the embedded addresses above
+	ShippingAddressID string `bson:"-" json:"shipping_address_id,omitempty"`
+	BillingAddressID  string `bson:"-" json:"billing_address_id,omitempty"`
+	EstimatedDuties float64  `bson:"estimated_duties,omitempty" json:"estimated_duties,omitempty"`
+	Shipments       []Shipment `bson:"shipments,omitempty" json:"shipments,omitempty"`
+	Hold            *OrderHold `bson:"hold,omitempty" json:"hold,omitempty"`
+	PromisedDispatch *DispatchPromise `bson:"promised_dispatch,omitempty" json:"promised_dispatch,omitempty"`
+	// Order history migrated from the previous platform
+	Legacy    bool   `bson:"legacy,omitempty" json:"legacy,omitempty"`
+	LegacyID  string `bson:"legacy_id,omitempty" json:"legacy_id,omitempty"`
+	ItemCount int    `bson:"item_count,omitempty" json:"item_count,omitempty"`
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
@@ -27,6 +60,23 @@ type OrderItem struct {
 	ProductID string  `bson:"product_id" json:"product_id"`
 	Quantity  int     `bson:"quantity" json:"quantity"`
 	Price     float64 `bson:"price" json:"price"`
+	// Per-line fulfillment, see fulfillment.go
+	LineID            string     `bson:"line_id,omitempty" json:"line_id,omitempty"`
+	Fulfillment       string     `bson:"fulfillment,omitempty" json:"fulfillment,omitempty"`
+	FulfillmentStatus string     `bson:"fulfillment_status,omitempty" json:"fulfillment_status,omitempty"`
+	PickupLocation    string     `bson:"pickup_location,omitempty" json:"pickup_location,omitempty"`
+	TrackingNumber    string     `bson:"tracking_number,omitempty" json:"tracking_number,omitempty"`
+	FulfilledAt       *time.Time `bson:"fulfilled_at,omitempty" json:"fulfilled_at,omitempty"`
+}
+
+type Address struct {
+	Name       string `bson:"name" json:"name"`
+	Line1      string `bson:"line1" json:"line1"`
+	Line2      string `bson:"line2,omitempty" json:"line2,omitempty"`
+	City       string `bson:"city" json:"city"`
+	Region     string `bson:"region,omitempty" json:"region,omitempty"`
+	PostalCode string `bson:"postal_code" json:"postal_code"`
+	Country    string `bson:"country" json:"country"`
 }
 
 type OrderService struct {
@@ -52,6 +102,18 @@ func main() {
 
 	db := client.Database("ecommerce")
 	orderService = &OrderService{db: db}
+	dutyCalculator = newDutyCalculator()
+	connectRedis()
+	verifier = newTokenVerifier()
+	loadFeeConfig()
+	loadTaxRates()
+	loadWaitingRoomSecret()
+	loadDeliveryZones()
+	loadCurrencyRules()
+	loadCarriers()
+	startTrackingPoller()
+	loadReviewSettings()
+	startReviewReminders()
 
 	router := gin.Default()
 
@@ -59,10 +121,66 @@ func main() {
 	router.GET("/ready", readinessCheck)
 
 	router.POST("/api/v1/orders", createOrder)
+	router.POST("/api/v1/orders/quote", quoteOrder)
 	router.GET("/api/v1/orders/:id", getOrder)
 	router.GET("/api/v1/orders/user/:userId", getUserOrders)
-	router.PUT("/api/v1/orders/:id/status", updateOrderStatus)
-	router.DELETE("/api/v1/orders/:id", cancelOrder)
+	router.PUT("/api/v1/orders/:id/status", scopedAuthMiddleware, requirePermission("orders:status"), updateOrderStatus)
+	router.DELETE("/api/v1/orders/:id", scopedAuthMiddleware, requirePermission("orders:status"), cancelOrder)
+	router.POST("/api/v1/orders/:id/refund-quote", authMiddleware, refundQuote)
+	router.GET("/api/v1/orders/co-purchases", getCoPurchases)
+
+	// Delivery Slot Routes
+	router.GET("/api/v1/delivery-slots", listDeliverySlots)
+
+	// Customs Routes
+	router.POST("/api/v1/orders/duties/estimate", estimateDuties)
+	router.GET("/api/v1/orders/:id/customs", getCustomsDeclaration)
+
+	// Attachment & Timeline Routes
+	router.POST("/api/v1/orders/:id/attachments", authMiddleware, uploadAttachment)
+	router.GET("/api/v1/orders/:id/attachments", authMiddleware, listAttachments)
+	router.GET("/api/v1/orders/:id/timeline", authMiddleware, getOrderTimeline)
+
+	// Tracking Routes
+	router.GET("/api/v1/orders/:id/tracking", authMiddleware, getOrderTracking)
+	router.POST("/api/v1/tracking/webhooks/:carrier", trackingWebhook)
+
+	// Tax Exemption Routes
+	router.POST("/api/v1/tax-exemptions", authMiddleware, uploadTaxCertificate)
+	router.GET("/api/v1/tax-exemptions", authMiddleware, listTaxCertificates)
+
+	// Quote Routes
+	router.GET("/api/v1/quotes", authMiddleware, listQuotes)
+	router.GET("/api/v1/quotes/:id", authMiddleware, getQuote)
+	router.POST("/api/v1/quotes/:id/accept", authMiddleware, acceptQuote)
+
+	// Review Routes
+	router.POST("/api/v1/reviews/drafts", saveReviewDraft)
+
+	// Admin Routes
+	admin := router.Group("/api/v1/admin", scopedAuthMiddleware)
+	admin.GET("/orders/:id", requirePermission("orders:read"), adminGetOrder)
+	admin.GET("/orders/:id/pricing", requirePermission("orders:read"), getOrderPricing)
+	admin.POST("/delivery-slots", requirePermission("delivery_slots:manage"), createDeliverySlot)
+	admin.POST("/orders/import", requirePermission("orders:import"), importLegacyOrders)
+	admin.POST("/customers/reassign", requirePermission("orders:reassign"), reassignCustomer)
+	admin.PUT("/orders/:id/items/:lineId/fulfillment", requirePermission("orders:fulfill"), updateLineFulfillment)
+	admin.GET("/orders/queue/picking", requirePermission("orders:fulfill"), listPickQueue)
+	admin.GET("/orders/held", requirePermission("orders:hold"), listHeldOrders)
+	admin.POST("/orders/:id/hold", requirePermission("orders:hold"), holdOrder)
+	admin.DELETE("/orders/:id/hold", requirePermission("orders:hold"), releaseOrder)
+	admin.GET("/draft-orders", requirePermission("orders:drafts"), listDraftOrders)
+	admin.POST("/draft-orders", requirePermission("orders:drafts"), createDraftOrder)
+	admin.GET("/draft-orders/:id", requirePermission("orders:drafts"), adminGetDraftOrder)
+	admin.PUT("/draft-orders/:id", requirePermission("orders:drafts"), updateDraftOrder)
+	admin.POST("/draft-orders/:id/send", requirePermission("orders:drafts"), sendQuote)
+	admin.DELETE("/draft-orders/:id", requirePermission("orders:drafts"), cancelDraftOrder)
+	admin.GET("/tax-exemptions", requirePermission("tax_exemptions:review"), adminListTaxCertificates)
+	admin.PUT("/tax-exemptions/:id/review", requirePermission("tax_exemptions:review"), reviewTaxCertificate)
+	admin.GET("/price-rules", requirePermission("pricing:manage"), listPriceRules)
+	admin.POST("/price-rules", requirePermission("pricing:manage"), createPriceRule)
+	admin.PUT("/price-rules/:id", requirePermission("pricing:manage"), updatePriceRule)
+	admin.DELETE("/price-rules/:id", requirePermission("pricing:manage"), deletePriceRule)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -109,6 +227,52 @@ func createOrder(c *gin.Context) {
 		return
 	}
 
+	admissions, ok := checkDropAdmission(c, order.Items)
+	if !ok {
+		return
+	}
+
+	if ok := checkOrganizationOrder(c, &order); !ok {
+		return
+	}
+
+	if err := prepareFulfillment(c.Request.Context(), &order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	shippable := shippableItems(order.Items)
+
+	if err := resolveAddresses(c, &order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address"})
+		return
+	}
+
+	if len(shippable) > 0 && isInternational(order.ShippingAddress) {
+		estimate, err := dutyCalculator.Estimate(context.Background(), order.ShippingAddress.Country, shippable)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to estimate duties"})
+			return
+		}
+		order.EstimatedDuties = estimate.Total
+	}
+
+	applyTaxExemption(c, &order)
+	if err := priceOrder(c.Request.Context(), &order); err != nil {
+		pricingFailed(c, err)
+		return
+	}
+
+	if order.DeliverySlotID != "" && len(shippable) > 0 {
+		booking, err := bookDeliverySlot(context.Background(), order.DeliverySlotID, order.ShippingAddress)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		order.DeliverySlot = booking
+	}
+
+	stampDispatchPromise(c.Request.Context(), &order, shippable)
+
 	order.Status = "pending"
 	order.CreatedAt = time.Now()
 	order.UpdatedAt = time.Now()
@@ -116,10 +280,61 @@ func createOrder(c *gin.Context) {
 	collection := orderService.db.Collection("orders")
 	result, err := collection.InsertOne(context.Background(), order)
 	if err != nil {
+		releaseDeliverySlot(context.Background(), order.DeliverySlot)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
 		return
 	}
 
+	// Stock is held under the order's ID, so the order has to exist first;
+	// it's withdrawn if the stock isn't there
+	failures, err := reserveOrder(c.Request.Context(), idString(result.InsertedID), order.Items, reservationTTL(&order))
+	if err != nil || len(failures) > 0 {
+		collection.DeleteOne(context.Background(), bson.M{"_id": result.InsertedID})
+		releaseDeliverySlot(context.Background(), order.DeliverySlot)
+		if err != nil {
+			log.Printf("Failed to reserve stock for order %s: %v", idString(result.InsertedID), err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reserve inventory"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient inventory", "failures": failures})
+		return
+	}
+
+	// Waiting room admissions are spent once the order exists too, like the
+	// promo code below
+	if err := spendAdmissions(c.Request.Context(), idString(result.InsertedID), admissions); err != nil {
+		collection.DeleteOne(context.Background(), bson.M{"_id": result.InsertedID})
+		releaseDeliverySlot(context.Background(), order.DeliverySlot)
+		releaseReservation(context.Background(), idString(result.InsertedID))
+		if err == errAdmissionUsed {
+			c.JSON(http.StatusConflict, gin.H{"error": "Waiting room admission already used"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to check waiting room admission"})
+		return
+	}
+
+	// The code is only spent once the order exists; if someone else spent
+	// it meanwhile, the order is withdrawn rather than given the discount
+	if order.PromoCode != "" {
+		if err := redeemPromoCode(c.Request.Context(), &order, idString(result.InsertedID)); err != nil {
+			collection.DeleteOne(context.Background(), bson.M{"_id": result.InsertedID})
+			releaseDeliverySlot(context.Background(), order.DeliverySlot)
+			releaseReservation(context.Background(), idString(result.InsertedID))
+			returnAdmissions(admissions)
+			pricingFailed(c, err)
+			return
+		}
+	}
+
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID: idString(result.InsertedID),
+		Type:    "order_created",
+		Message: "Order placed",
+		Actor:   order.UserID,
+	})
+	recordTaxExemption(idString(result.InsertedID), &order)
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Order created successfully",
 		"order_id": result.InsertedID,
@@ -131,7 +346,7 @@ func getOrder(c *gin.Context) {
 	collection := orderService.db.Collection("orders")
 
 	var order Order
-	err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&order)
+	err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
@@ -175,29 +390,38 @@ func updateOrderStatus(c *gin.Context) {
 	}
 
 	collection := orderService.db.Collection("orders")
-	_, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"status": req.Status, "updated_at": time.Now()}},
-	)
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+	// Payment confirmations for held orders apply once the hold is lifted
+	var held Order
+	heldFilter := idFilter(id)
+	heldFilter["hold"] = bson.M{"$exists": true}
+	if collection.FindOne(context.Background(), heldFilter).Decode(&held) == nil {
+		if req.Status != "paid" {
+			rejectIfHeld(c, &held)
+			return
+		}
+		collection.UpdateOne(context.Background(), idFilter(id), bson.M{"$set": bson.M{"hold.previous_status": req.Status}})
+		c.JSON(http.StatusAccepted, gin.H{"message": "Order is on hold, status will apply when released"})
+		return
+	}
+
+	order, ok := transitionOrder(c, id, req.Status)
+	if !ok {
 		return
 	}
+	orderStatusChanged(context.Background(), order, c.GetString("user_id"))
 
 	c.JSON(http.StatusOK, gin.H{"message": "Order status updated"})
 }
 
+// cancelOrder cancels an order that hasn't been paid yet. The order is
+// kept, with its timeline, as cancelled.
 func cancelOrder(c *gin.Context) {
-	id := c.Param("id")
-	collection := orderService.db.Collection("orders")
-
-	result, err := collection.DeleteOne(context.Background(), bson.M{"_id": id})
-	if err != nil || result.DeletedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	order, ok := transitionOrder(c, c.Param("id"), "cancelled")
+	if !ok {
 		return
 	}
+	orderStatusChanged(context.Background(), order, c.GetString("user_id"))
 
 	c.JSON(http.StatusOK, gin.H{"message": "Order cancelled"})
-}
\ No newline at end of file
+}
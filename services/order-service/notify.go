@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+func notificationServiceURL() string {
+	if url := os.Getenv("NOTIFICATION_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://notification-service:8008"
+}
+
+// sendEmail hands an email to the notification service and reports whether
+// it was accepted, so background jobs can retry.
+func sendEmail(ctx context.Context, to, subject, body string) error {
+	payload, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"subject": subject,
+		"body":    body,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notificationServiceURL()+"/api/v1/notifications/email", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification service returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PriceRule is a catalog pricing rule managed by merchandisers: quantity
+// breaks (tier) or a percentage sale. A rule covers the listed products and
+// categories, or the whole catalog when it lists neither, and only runs
+// while active and within its dates.
+type PriceRule struct {
+	ID         string   `bson:"_id,omitempty" json:"id"`
+	Type       string   `bson:"type" json:"type" binding:"required,oneof=tier sale"`
+	Name       string   `bson:"name" json:"name" binding:"required"`
+	ProductIDs []string `bson:"product_ids,omitempty" json:"product_ids,omitempty"`
+	Categories []string `bson:"categories,omitempty" json:"categories,omitempty"`
+	// Tier rules only
+	Tiers []PriceTier `bson:"tiers,omitempty" json:"tiers,omitempty" binding:"dive"`
+	// Sale rules only
+	PercentOff float64    `bson:"percent_off,omitempty" json:"percent_off,omitempty" binding:"min=0,max=100"`
+	StartsAt   *time.Time `bson:"starts_at,omitempty" json:"starts_at,omitempty"`
+	EndsAt     *time.Time `bson:"ends_at,omitempty" json:"ends_at,omitempty"`
+	Active     bool       `bson:"active" json:"active"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// PriceTier takes PercentOff off the unit price from MinQuantity units.
+type PriceTier struct {
+	MinQuantity int     `bson:"min_quantity" json:"min_quantity" binding:"required,min=2"`
+	PercentOff  float64 `bson:"percent_off" json:"percent_off" binding:"required,gt=0,max=100"`
+}
+
+const (
+	priceRuleTier = "tier"
+	priceRuleSale = "sale"
+)
+
+func (r *PriceRule) matches(product *ProductInfo) bool {
+	if len(r.ProductIDs) == 0 && len(r.Categories) == 0 {
+		return true
+	}
+	for _, id := range r.ProductIDs {
+		if id == product.ID {
+			return true
+		}
+	}
+	for _, category := range r.Categories {
+		if strings.EqualFold(category, product.Category) {
+			return true
+		}
+	}
+	return false
+}
+
+// tierFor returns the highest tier the quantity reaches.
+func (r *PriceRule) tierFor(quantity int) (PriceTier, bool) {
+	var best PriceTier
+	found := false
+	for _, tier := range r.Tiers {
+		if quantity >= tier.MinQuantity && (!found || tier.MinQuantity > best.MinQuantity) {
+			best, found = tier, true
+		}
+	}
+	return best, found
+}
+
+// activePriceRules loads the running rules once per pricing.
+func (p *Pricing) activePriceRules(ctx context.Context, ruleType string) ([]PriceRule, error) {
+	if !p.rulesReady {
+		now := time.Now()
+		cursor, err := orderService.db.Collection("price_rules").Find(ctx, bson.M{
+			"active": true,
+			"$and": bson.A{
+				bson.M{"$or": bson.A{bson.M{"starts_at": nil}, bson.M{"starts_at": bson.M{"$lte": now}}}},
+				bson.M{"$or": bson.A{bson.M{"ends_at": nil}, bson.M{"ends_at": bson.M{"$gt": now}}}},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := cursor.All(ctx, &p.priceRules); err != nil {
+			return nil, err
+		}
+		p.rulesReady = true
+	}
+
+	var rules []PriceRule
+	for _, rule := range p.priceRules {
+		if rule.Type == ruleType {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func validatePriceRule(rule *PriceRule) string {
+	switch rule.Type {
+	case priceRuleTier:
+		if len(rule.Tiers) == 0 {
+			return "Tier rules need at least one tier"
+		}
+		rule.PercentOff = 0
+		sort.Slice(rule.Tiers, func(i, j int) bool { return rule.Tiers[i].MinQuantity < rule.Tiers[j].MinQuantity })
+	case priceRuleSale:
+		if rule.PercentOff <= 0 {
+			return "Sale rules need percent_off"
+		}
+		rule.Tiers = nil
+	}
+	if rule.StartsAt != nil && rule.EndsAt != nil && !rule.EndsAt.After(*rule.StartsAt) {
+		return "ends_at must be after starts_at"
+	}
+	return ""
+}
+
+func listPriceRules(c *gin.Context) {
+	filter := bson.M{}
+	if ruleType := c.Query("type"); ruleType != "" {
+		filter["type"] = ruleType
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}})
+	cursor, err := orderService.db.Collection("price_rules").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch price rules"})
+		return
+	}
+	rules := []PriceRule{}
+	if err := cursor.All(context.Background(), &rules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode price rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "count": len(rules)})
+}
+
+func createPriceRule(c *gin.Context) {
+	var rule PriceRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := validatePriceRule(&rule); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	rule.ID = primitive.NewObjectID().Hex()
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = rule.CreatedAt
+	if _, err := orderService.db.Collection("price_rules").InsertOne(context.Background(), rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create price rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func updatePriceRule(c *gin.Context) {
+	var rule PriceRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := validatePriceRule(&rule); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	collection := orderService.db.Collection("price_rules")
+	var existing PriceRule
+	if err := collection.FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&existing); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price rule not found"})
+		return
+	}
+
+	rule.ID = existing.ID
+	rule.CreatedAt = existing.CreatedAt
+	rule.UpdatedAt = time.Now()
+	if _, err := collection.ReplaceOne(context.Background(), bson.M{"_id": rule.ID}, rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update price rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func deletePriceRule(c *gin.Context) {
+	result, err := orderService.db.Collection("price_rules").DeleteOne(context.Background(), bson.M{"_id": c.Param("id")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete price rule"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Price rule deleted"})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every order is priced by running it through pricingRules in order: unit
+// prices first, then the subtotal, order-level adjustments, tax and
+// rounding. Each rule records what it changed in the order's pricing
+// trace, so support can explain any total after the fact. Cart, checkout
+// quotes, draft quotes and order creation all price through here.
+
+// PricingStep is one entry in the trace. Line steps change a unit price;
+// order steps move the running total.
+type PricingStep struct {
+	Rule        string `bson:"rule" json:"rule"`
+	Description string `bson:"description" json:"description"`
+	LineID      string `bson:"line_id,omitempty" json:"line_id,omitempty"`
+	ProductID   string `bson:"product_id,omitempty" json:"product_id,omitempty"`
+	// The price rule or promo code responsible, if any
+	Reference string  `bson:"reference,omitempty" json:"reference,omitempty"`
+	Before    float64 `bson:"before" json:"before"`
+	After     float64 `bson:"after" json:"after"`
+}
+
+// PricingRule is one stage of the engine. Rules see the prices left by the
+// rules before them.
+type PricingRule interface {
+	Name() string
+	Apply(ctx context.Context, p *Pricing) error
+}
+
+var pricingRules = []PricingRule{
+	basePriceRule{},
+	tierPriceRule{},
+	salePriceRule{},
+	subtotalRule{},
+	feesRule{},
+	negotiatedDiscountRule{},
+	promotionRule{},
+	taxRule{},
+	cashRoundingRule{},
+}
+
+// Pricing is the state shared by the rules while an order is priced.
+type Pricing struct {
+	Order *Order
+	Trace []PricingStep
+	// The accepted or draft quote whose prices the order keeps, if any
+	quote *DraftOrder
+	// Running total of the order-level steps
+	total      float64
+	products   map[string]*ProductInfo
+	priceRules []PriceRule
+	rulesReady bool
+}
+
+// pricingError is a problem with the order itself, such as an invalid
+// promo code, rather than with a service it depends on.
+type pricingError struct {
+	message string
+}
+
+func (e *pricingError) Error() string {
+	return e.message
+}
+
+// priceOrder computes the unit prices, subtotal, fee lines, tax and total
+// for an order. Client-supplied prices, discounts and totals are never
+// trusted: they are all overwritten here. Every amount is rounded to the
+// order currency, and cash orders are rounded to the smallest coin with the
+// difference recorded as a rounding adjustment.
+func priceOrder(ctx context.Context, order *Order) error {
+	return priceQuotedOrder(ctx, order, nil)
+}
+
+// priceQuotedOrder prices an order made from a quote. Unit prices and the
+// discount are taken from the quote itself, not from the order.
+func priceQuotedOrder(ctx context.Context, order *Order, quote *DraftOrder) error {
+	order.Discount = 0
+	order.DraftOrderID = ""
+	if quote != nil {
+		order.Discount = quote.Discount
+		order.DraftOrderID = quote.ID
+	}
+	if order.Currency == "" {
+		order.Currency = defaultCurrency()
+	}
+	order.Currency = strings.ToUpper(order.Currency)
+	order.Fees = []FeeLine{}
+
+	p := &Pricing{Order: order, quote: quote, products: map[string]*ProductInfo{}}
+	for _, rule := range pricingRules {
+		if err := rule.Apply(ctx, p); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name(), err)
+		}
+	}
+	order.PricingTrace = p.Trace
+	return nil
+}
+
+// pricingFailed writes the response for an order that couldn't be priced.
+func pricingFailed(c *gin.Context, err error) {
+	var invalid *pricingError
+	if errors.As(err, &invalid) || errors.Is(err, errProductNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to price order"})
+}
+
+func (p *Pricing) product(ctx context.Context, id string) (*ProductInfo, error) {
+	if product, ok := p.products[id]; ok {
+		return product, nil
+	}
+	product, err := fetchProduct(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("product %s: %w", id, err)
+	}
+	p.products[id] = product
+	return product, nil
+}
+
+// negotiated reports whether the order carries prices agreed in a quote,
+// which catalog pricing must leave alone.
+func (p *Pricing) negotiated() bool {
+	return p.quote != nil
+}
+
+// quotedPrice is the unit price the quote agreed for a product.
+func (p *Pricing) quotedPrice(productID string) (float64, bool) {
+	for _, item := range p.quote.Items {
+		if item.ProductID == productID {
+			return item.Price, true
+		}
+	}
+	return 0, false
+}
+
+// setUnitPrice changes a line's unit price and records why.
+func (p *Pricing) setUnitPrice(i int, rule, description, reference string, price float64) {
+	item := &p.Order.Items[i]
+	price = roundAmount(p.Order.Currency, price)
+	p.Trace = append(p.Trace, PricingStep{
+		Rule:        rule,
+		Description: description,
+		LineID:      item.LineID,
+		ProductID:   item.ProductID,
+		Reference:   reference,
+		Before:      item.Price,
+		After:       price,
+	})
+	item.Price = price
+}
+
+// adjust moves the running total by amount and records why.
+func (p *Pricing) adjust(rule, description, reference string, amount float64) {
+	before := p.total
+	p.total = roundAmount(p.Order.Currency, p.total+amount)
+	p.Trace = append(p.Trace, PricingStep{
+		Rule:        rule,
+		Description: description,
+		Reference:   reference,
+		Before:      before,
+		After:       p.total,
+	})
+}
+
+// addFee adds a fee line and moves the running total by its amount.
+func (p *Pricing) addFee(rule, reference string, fee FeeLine) {
+	fee.Amount = roundAmount(p.Order.Currency, fee.Amount)
+	p.Order.Fees = append(p.Order.Fees, fee)
+	p.adjust(rule, fee.Description, reference, fee.Amount)
+}
+
+// basePriceRule prices every line at the catalog price, or keeps the price
+// negotiated in a quote.
+type basePriceRule struct{}
+
+func (basePriceRule) Name() string { return "base_price" }
+
+func (r basePriceRule) Apply(ctx context.Context, p *Pricing) error {
+	for i := range p.Order.Items {
+		item := &p.Order.Items[i]
+		item.Price = 0
+		if p.negotiated() {
+			price, ok := p.quotedPrice(item.ProductID)
+			if !ok {
+				return &pricingError{message: "Product " + item.ProductID + " is not part of the quote"}
+			}
+			p.setUnitPrice(i, r.Name(), "Price negotiated in quote", p.Order.DraftOrderID, price)
+			continue
+		}
+		product, err := p.product(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		p.setUnitPrice(i, r.Name(), "Catalog price", "", product.Price)
+	}
+	return nil
+}
+
+// tierPriceRule applies quantity breaks. The quantity counts every line of
+// the product, so splitting a line across fulfillment types doesn't lose
+// the break.
+type tierPriceRule struct{}
+
+func (tierPriceRule) Name() string { return "tier_price" }
+
+func (r tierPriceRule) Apply(ctx context.Context, p *Pricing) error {
+	if p.negotiated() {
+		return nil
+	}
+	rules, err := p.activePriceRules(ctx, priceRuleTier)
+	if err != nil {
+		return err
+	}
+
+	quantities := map[string]int{}
+	for _, item := range p.Order.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	for i, item := range p.Order.Items {
+		product, err := p.product(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		var best *PriceRule
+		var bestTier PriceTier
+		for j := range rules {
+			if !rules[j].matches(product) {
+				continue
+			}
+			if tier, ok := rules[j].tierFor(quantities[item.ProductID]); ok && tier.PercentOff > bestTier.PercentOff {
+				best, bestTier = &rules[j], tier
+			}
+		}
+		if best == nil {
+			continue
+		}
+		description := fmt.Sprintf("%s: %g%% off for %d or more", best.Name, bestTier.PercentOff, bestTier.MinQuantity)
+		p.setUnitPrice(i, r.Name(), description, best.ID, item.Price*(1-bestTier.PercentOff/100))
+	}
+	return nil
+}
+
+// salePriceRule applies the best running sale to each line. Sales don't
+// stack with each other, only with quantity breaks.
+type salePriceRule struct{}
+
+func (salePriceRule) Name() string { return "sale" }
+
+func (r salePriceRule) Apply(ctx context.Context, p *Pricing) error {
+	if p.negotiated() {
+		return nil
+	}
+	rules, err := p.activePriceRules(ctx, priceRuleSale)
+	if err != nil {
+		return err
+	}
+
+	for i, item := range p.Order.Items {
+		product, err := p.product(ctx, item.ProductID)
+		if err != nil {
+			return err
+		}
+		var best *PriceRule
+		for j := range rules {
+			if rules[j].matches(product) && (best == nil || rules[j].PercentOff > best.PercentOff) {
+				best = &rules[j]
+			}
+		}
+		if best == nil {
+			continue
+		}
+		description := fmt.Sprintf("%s: %g%% off", best.Name, best.PercentOff)
+		p.setUnitPrice(i, r.Name(), description, best.ID, item.Price*(1-best.PercentOff/100))
+	}
+	return nil
+}
+
+type subtotalRule struct{}
+
+func (subtotalRule) Name() string { return "subtotal" }
+
+func (r subtotalRule) Apply(ctx context.Context, p *Pricing) error {
+	subtotal := 0.0
+	for _, item := range p.Order.Items {
+		subtotal += item.Price * float64(item.Quantity)
+	}
+	p.Order.Subtotal = roundAmount(p.Order.Currency, subtotal)
+	p.adjust(r.Name(), "Goods subtotal", "", p.Order.Subtotal)
+	return nil
+}
+
+// feesRule adds shipping and the other charges configured in ORDER_FEES.
+type feesRule struct{}
+
+func (feesRule) Name() string { return "fees" }
+
+func (r feesRule) Apply(ctx context.Context, p *Pricing) error {
+	for _, fee := range computeFees(p.Order, p.Order.Subtotal) {
+		p.addFee(r.Name(), fee.Code, fee)
+	}
+	return nil
+}
+
+// negotiatedDiscountRule applies the discount agreed in a quote.
+type negotiatedDiscountRule struct{}
+
+func (negotiatedDiscountRule) Name() string { return "negotiated_discount" }
+
+func (r negotiatedDiscountRule) Apply(ctx context.Context, p *Pricing) error {
+	if p.Order.Discount <= 0 {
+		return nil
+	}
+	discount := math.Min(p.Order.Discount, p.Order.Subtotal)
+	p.addFee(r.Name(), p.Order.DraftOrderID, FeeLine{
+		Code:        "discount",
+		Description: "Negotiated discount",
+		Amount:      -discount,
+		Taxable:     true,
+		Refundable:  true,
+	})
+	return nil
+}
+
+// promotionRule checks the order's promo code with the promotion service
+// and takes its discount off. Redeeming the code happens once the order is
+// placed, see redeemPromoCode.
+type promotionRule struct{}
+
+func (promotionRule) Name() string { return "promotion" }
+
+func (r promotionRule) Apply(ctx context.Context, p *Pricing) error {
+	code := strings.ToUpper(strings.TrimSpace(p.Order.PromoCode))
+	p.Order.PromoCode = code
+	if code == "" {
+		return nil
+	}
+
+	result, err := validatePromoCode(ctx, code, p.Order.Subtotal)
+	if err != nil {
+		return err
+	}
+	if !result.Valid {
+		reason := result.Reason
+		if reason == "" {
+			reason = "invalid or already used"
+		}
+		return &pricingError{message: "Promo code " + code + " can't be applied: " + reason}
+	}
+
+	p.addFee(r.Name(), code, FeeLine{
+		Code:        "promotion",
+		Description: "Promo code " + code,
+		Amount:      -math.Min(result.Discount, p.Order.Subtotal),
+		Taxable:     true,
+		Refundable:  true,
+	})
+	return nil
+}
+
+// taxRule charges sales tax for the destination on the goods and taxable
+// fees, unless the order has an approved exemption.
+type taxRule struct{}
+
+func (taxRule) Name() string { return "tax" }
+
+func (r taxRule) Apply(ctx context.Context, p *Pricing) error {
+	taxable := p.Order.Subtotal
+	for _, fee := range p.Order.Fees {
+		if fee.Taxable {
+			taxable += fee.Amount
+		}
+	}
+
+	order := p.Order
+	order.TaxRate = taxRateFor(order.ShippingAddress)
+	description := fmt.Sprintf("Sales tax at %g%%", order.TaxRate*100)
+	if order.TaxExemptionID != "" {
+		order.TaxRate = 0
+		description = "Tax exempt"
+	}
+	order.Tax = roundAmount(order.Currency, taxable*order.TaxRate)
+	p.adjust(r.Name(), description, order.TaxExemptionID, order.Tax)
+	order.Total = p.total
+	return nil
+}
+
+// cashRoundingRule rounds cash orders to the smallest coin.
+type cashRoundingRule struct{}
+
+func (cashRoundingRule) Name() string { return "cash_rounding" }
+
+func (r cashRoundingRule) Apply(ctx context.Context, p *Pricing) error {
+	order := p.Order
+	order.RoundingAdjustment = 0
+	if !cashPaymentMethods[order.PaymentMethod] {
+		return nil
+	}
+	order.Total, order.RoundingAdjustment = cashRound(order.Currency, order.Total)
+	if order.RoundingAdjustment != 0 {
+		p.adjust(r.Name(), "Rounded to the smallest coin for cash payment", "", order.RoundingAdjustment)
+	}
+	return nil
+}
+
+// getOrderPricing shows support how an order's total came about.
+func getOrderPricing(c *gin.Context) {
+	var order Order
+	if err := orderService.db.Collection("orders").FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&order); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	response := gin.H{
+		"order_id":      order.ID,
+		"currency":      order.Currency,
+		"items":         order.Items,
+		"subtotal":      order.Subtotal,
+		"fees":          order.Fees,
+		"tax":           order.Tax,
+		"total":         order.Total,
+		"promo_code":    order.PromoCode,
+		"pricing_trace": order.PricingTrace,
+	}
+	if len(order.PricingTrace) == 0 {
+		response["message"] = "Order was placed before pricing traces were recorded"
+	}
+	c.JSON(http.StatusOK, response)
+}
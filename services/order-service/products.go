@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ProductInfo is the subset of the product-service representation the order
+// service relies on.
+type ProductInfo struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Price    float64      `json:"price"`
+	Category string       `json:"category"`
+	Drop     bool         `json:"drop"`
+	Digital  bool         `json:"digital"`
+	Customs  *CustomsInfo `json:"customs,omitempty"`
+}
+
+type CustomsInfo struct {
+	HSCode          string  `json:"hs_code"`
+	CountryOfOrigin string  `json:"country_of_origin"`
+	Value           float64 `json:"value"`
+	WeightKg        float64 `json:"weight_kg"`
+}
+
+var errProductNotFound = errors.New("product not found")
+
+var productClient = &http.Client{Timeout: 5 * time.Second}
+
+func productServiceURL() string {
+	if url := os.Getenv("PRODUCT_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://product-service:8002"
+}
+
+func fetchProduct(ctx context.Context, id string) (*ProductInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, productServiceURL()+"/api/v1/products/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := productClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errProductNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("product service returned %d", resp.StatusCode)
+	}
+
+	var product ProductInfo
+	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var promotionClient = &http.Client{Timeout: 2 * time.Second}
+
+func promotionServiceURL() string {
+	if url := os.Getenv("PROMOTION_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://promotion-service:8007"
+}
+
+type promoValidation struct {
+	Valid    bool    `json:"valid"`
+	Reason   string  `json:"reason"`
+	Discount float64 `json:"discount"`
+}
+
+func callPromotionService(ctx context.Context, path string, payload interface{}, out interface{}) (int, error) {
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, promotionServiceURL()+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := authorizeAsService(req); err != nil {
+		return 0, err
+	}
+
+	resp, err := promotionClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return resp.StatusCode, fmt.Errorf("promotion service returned %d", resp.StatusCode)
+	}
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// validatePromoCode prices a code against the goods subtotal without using
+// it up.
+func validatePromoCode(ctx context.Context, code string, subtotal float64) (*promoValidation, error) {
+	var result promoValidation
+	_, err := callPromotionService(ctx, "/api/v1/promotions/codes/validate",
+		map[string]interface{}{"code": code, "order_total": subtotal}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// redeemPromoCode uses the order's code up. It fails if the code was spent
+// elsewhere since the order was priced.
+func redeemPromoCode(ctx context.Context, order *Order, orderID string) error {
+	status, err := callPromotionService(ctx, "/api/v1/promotions/codes/redeem", map[string]interface{}{
+		"code":        order.PromoCode,
+		"user_id":     order.UserID,
+		"order_id":    orderID,
+		"order_total": order.Subtotal,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return &pricingError{message: "Promo code " + order.PromoCode + " is no longer valid"}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// customerOwnedCollections lists where this service keeps data by customer,
+// and the field holding the customer's ID.
+var customerOwnedCollections = map[string]string{
+	"orders":           "user_id",
+	"draft_orders":     "customer_id",
+	"tax_certificates": "user_id",
+	"review_reminders": "user_id",
+	"review_drafts":    "user_id",
+}
+
+// reassignCustomer moves everything a customer owns here to another
+// account. The auth service calls it when two accounts are merged.
+func reassignCustomer(c *gin.Context) {
+	var req struct {
+		FromUserID string `json:"from_user_id" binding:"required"`
+		ToUserID   string `json:"to_user_id" binding:"required,nefield=FromUserID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	moved := gin.H{}
+	for name, field := range customerOwnedCollections {
+		result, err := orderService.db.Collection(name).UpdateMany(context.Background(),
+			bson.M{field: req.FromUserID},
+			bson.M{"$set": bson.M{field: req.ToUserID}})
+		if err != nil {
+			log.Printf("Failed to reassign %s from %s to %s: %v", name, req.FromUserID, req.ToUserID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reassign " + name, "moved": moved})
+			return
+		}
+		moved[name] = result.ModifiedCount
+	}
+
+	c.JSON(http.StatusOK, gin.H{"moved": moved})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// An order's stock is reserved in the inventory service when the order is
+// placed and held for as long as it may take to pay: PAYMENT_WINDOW
+// (default 1h) for payment at checkout, OFFLINE_PAYMENT_WINDOW (default 7
+// days) for bank transfer and cash on delivery, and the payment terms of
+// invoice orders. It's committed as a sale once the order is paid or
+// leaves the warehouse, and released if the order is cancelled first. The
+// inventory service takes these calls only with the service token, whose
+// client needs inventory:reserve.
+var (
+	paymentWindow        = envDuration("PAYMENT_WINDOW", time.Hour)
+	offlinePaymentWindow = envDuration("OFFLINE_PAYMENT_WINDOW", 7*24*time.Hour)
+)
+
+// The inventory service holds stock for at most 90 days
+const maxReservationTTL = 90 * 24 * time.Hour
+
+// errReservationLapsed means the order's reservation expired or was never
+// made, so its stock may have been sold to someone else.
+var errReservationLapsed = errors.New("reservation is no longer held")
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// reservationTTL is how long to hold the order's stock waiting for
+// payment.
+func reservationTTL(order *Order) time.Duration {
+	ttl := paymentWindow
+	switch {
+	case order.PaymentDueAt != nil:
+		ttl = time.Until(*order.PaymentDueAt)
+	case order.PaymentMethod == "bank_transfer" || order.PaymentMethod == "cash_on_delivery":
+		ttl = offlinePaymentWindow
+	}
+	if ttl > maxReservationTTL {
+		ttl = maxReservationTTL
+	}
+	if ttl < time.Minute {
+		ttl = time.Minute
+	}
+	return ttl
+}
+
+// holdsStock reports whether any of the items is reserved in the inventory
+// service. Digital products have no stock.
+func holdsStock(items []OrderItem) bool {
+	for _, item := range items {
+		if item.Fulfillment != FulfillDigital {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveOrder has the inventory service hold the stock for the order's
+// physical lines under the order's ID for ttl, so cancelling the order
+// releases exactly what it reserved. Every line is held or none is;
+// failures says which lines couldn't be, in the inventory service's words.
+func reserveOrder(ctx context.Context, orderID string, items []OrderItem, ttl time.Duration) (failures []json.RawMessage, err error) {
+	quantities := map[string]int{}
+	lines := []map[string]interface{}{}
+	for _, item := range items {
+		if !holdsStock([]OrderItem{item}) {
+			continue
+		}
+		if _, ok := quantities[item.ProductID]; !ok {
+			lines = append(lines, map[string]interface{}{"product_id": item.ProductID})
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	for _, line := range lines {
+		line["quantity"] = quantities[line["product_id"].(string)]
+	}
+	body, _ := json.Marshal(map[string]interface{}{"order_id": orderID, "items": lines, "ttl_seconds": int(ttl.Seconds())})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inventoryServiceURL()+"/api/v1/inventory/reserve", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeAsService(req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil, nil
+	case http.StatusConflict:
+		var result struct {
+			Failures []json.RawMessage `json:"failures"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, err
+		}
+		return result.Failures, nil
+	}
+	return nil, fmt.Errorf("inventory service returned %d", resp.StatusCode)
+}
+
+// releaseReservation has the inventory service return whatever stock is
+// still reserved for a cancelled order. The inventory service keeps the
+// quantities per order, so nothing is passed back but the order ID. It's
+// best effort: stock left held expires with the reservation.
+func releaseReservation(ctx context.Context, orderID string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
+		inventoryServiceURL()+"/api/v1/inventory/reservations/"+url.PathEscape(orderID), nil)
+	if err == nil {
+		err = authorizeAsService(req)
+	}
+	if err != nil {
+		log.Printf("Failed to release reservation for order %s: %v", orderID, err)
+		return
+	}
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to release reservation for order %s: %v", orderID, err)
+		return
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusConflict:
+		// Nothing reserved, or already released, expired or shipped
+	default:
+		log.Printf("Failed to release reservation for order %s: %v", orderID,
+			fmt.Errorf("inventory service returned %d", resp.StatusCode))
+	}
+}
+
+// commitReservation has the inventory service turn the stock still held
+// for the order into a sale. An order with nothing left held, e.g. one
+// committed before, is fine; one whose reservation lapsed isn't.
+func commitReservation(ctx context.Context, orderID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		inventoryServiceURL()+"/api/v1/inventory/reservations/"+url.PathEscape(orderID)+"/commit", nil)
+	if err != nil {
+		return err
+	}
+	if err := authorizeAsService(req); err != nil {
+		return err
+	}
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errReservationLapsed
+	case http.StatusConflict:
+		// Closed already: committed before, or lapsed
+		if status, err := reservationStatus(ctx, orderID); err == nil && status == "committed" {
+			return nil
+		}
+		return errReservationLapsed
+	}
+	return fmt.Errorf("inventory service returned %d", resp.StatusCode)
+}
+
+// reservationStatus returns the status of the order's reservation.
+func reservationStatus(ctx context.Context, orderID string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		inventoryServiceURL()+"/api/v1/inventory/reservations/"+url.PathEscape(orderID), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("inventory service returned %d", resp.StatusCode)
+	}
+	var reservation struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+		return "", err
+	}
+	return reservation.Status, nil
+}
+
+// commitOrderStock commits the order's stock once it's paid or leaves the
+// warehouse. If the reservation lapsed first, e.g. payment came after the
+// window, the stock is reserved again if it's still there; if it isn't,
+// staff are told on the timeline, as the order can't be filled as it is.
+func commitOrderStock(ctx context.Context, order *Order) {
+	if !holdsStock(order.Items) {
+		return
+	}
+	err := commitReservation(ctx, order.ID)
+	if err == errReservationLapsed {
+		var failures []json.RawMessage
+		failures, err = reserveOrder(ctx, order.ID, order.Items, time.Minute)
+		if err == nil && len(failures) > 0 {
+			log.Printf("Stock for order %s lapsed and is no longer available", order.ID)
+			recordTimelineEvent(ctx, TimelineEvent{
+				OrderID:   order.ID,
+				Type:      "stock_shortfall",
+				Message:   "Reserved stock lapsed before payment and is no longer available",
+				StaffOnly: true,
+				Data:      bson.M{"failures": failures},
+			})
+			return
+		}
+		if err == nil {
+			err = commitReservation(ctx, order.ID)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to commit stock for order %s: %v", order.ID, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReservationTTL(t *testing.T) {
+	soon := time.Now().Add(10 * time.Second)
+	terms := time.Now().Add(30 * 24 * time.Hour)
+	far := time.Now().Add(365 * 24 * time.Hour)
+
+	for _, tc := range []struct {
+		name  string
+		order Order
+		want  time.Duration
+	}{
+		{"card", Order{PaymentMethod: "card"}, paymentWindow},
+		{"bank transfer", Order{PaymentMethod: "bank_transfer"}, offlinePaymentWindow},
+		{"cash on delivery", Order{PaymentMethod: "cash_on_delivery"}, offlinePaymentWindow},
+		{"invoice terms", Order{PaymentMethod: "invoice", PaymentDueAt: &terms}, 30 * 24 * time.Hour},
+		{"terms beyond the inventory limit", Order{PaymentDueAt: &far}, maxReservationTTL},
+		{"due now", Order{PaymentDueAt: &soon}, time.Minute},
+	} {
+		got := reservationTTL(&tc.order)
+		// Terms run from now, which moves on while the test runs
+		if diff := tc.want - got; diff < 0 || diff > time.Second {
+			t.Errorf("%s: reservationTTL = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHoldsStock(t *testing.T) {
+	digital := OrderItem{ProductID: "e-book", Quantity: 1, Fulfillment: FulfillDigital}
+	shipped := OrderItem{ProductID: "mug", Quantity: 1, Fulfillment: FulfillShip}
+
+	if holdsStock([]OrderItem{digital}) {
+		t.Error("an all-digital order holds stock")
+	}
+	if !holdsStock([]OrderItem{digital, shipped}) {
+		t.Error("an order with a shipped line holds no stock")
+	}
+	if holdsStock(nil) {
+		t.Error("an empty order holds stock")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReviewReminder is a scheduled post-purchase review request, one per
+// order, created when the order is delivered.
+type ReviewReminder struct {
+	OrderID string     `bson:"_id" json:"order_id"`
+	UserID  string     `bson:"user_id" json:"user_id"`
+	SendAt  time.Time  `bson:"send_at" json:"send_at"`
+	Status  string     `bson:"status" json:"status"`
+	Reason  string     `bson:"reason,omitempty" json:"reason,omitempty"`
+	SentAt  *time.Time `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+}
+
+// ReviewDraft is a review started from an emailed link. The reviews
+// subsystem publishes it once the customer finishes it.
+type ReviewDraft struct {
+	ID        string    `bson:"_id" json:"id"`
+	OrderID   string    `bson:"order_id" json:"order_id"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	ProductID string    `bson:"product_id" json:"product_id"`
+	Rating    int       `bson:"rating" json:"rating"`
+	Title     string    `bson:"title" json:"title"`
+	Body      string    `bson:"body" json:"body"`
+	Status    string    `bson:"status" json:"status"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+const (
+	reviewLinkTTL = 30 * 24 * time.Hour
+	// How long a reminder that failed for a transient reason waits
+	reviewReminderRetry = 30 * time.Minute
+)
+
+var reviewLinkSecret []byte
+
+// loadReviewSettings reads REVIEW_LINK_SECRET, which signs the one-click
+// rating links. The links stand in for a login, so there is no default.
+func loadReviewSettings() {
+	reviewLinkSecret = []byte(os.Getenv("REVIEW_LINK_SECRET"))
+	if len(reviewLinkSecret) == 0 {
+		log.Fatal("REVIEW_LINK_SECRET must be set")
+	}
+}
+
+// reviewReminderDelay is REVIEW_REMINDER_DAYS after delivery (default 7).
+func reviewReminderDelay() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("REVIEW_REMINDER_DAYS"))
+	if err != nil || days < 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// orderDelivered is called whenever an order reaches a delivered state and
+// schedules its review request. Scheduling is idempotent per order.
+func orderDelivered(ctx context.Context, orderID string) {
+	var order Order
+	if err := orderService.db.Collection("orders").FindOne(ctx, idFilter(orderID)).Decode(&order); err != nil {
+		log.Printf("Failed to load delivered order %s: %v", orderID, err)
+		return
+	}
+
+	_, err := orderService.db.Collection("review_reminders").UpdateOne(ctx,
+		bson.M{"_id": orderID},
+		bson.M{"$setOnInsert": ReviewReminder{
+			OrderID: orderID,
+			UserID:  order.UserID,
+			SendAt:  time.Now().Add(reviewReminderDelay()),
+			Status:  "pending",
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("Failed to schedule review reminder for order %s: %v", orderID, err)
+	}
+}
+
+// customerContact is what the auth service tells us about a customer's
+// consent. Requests use the service token, which needs users:read.
+type customerContact struct {
+	Email       string `json:"email"`
+	Preferences struct {
+		MarketingOptIn bool `json:"marketing_opt_in"`
+		Notifications  struct {
+			Email bool `json:"email"`
+		} `json:"notifications"`
+	} `json:"preferences"`
+}
+
+func fetchCustomerContact(ctx context.Context, userID string) (*customerContact, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, authServiceURL()+"/api/v1/admin/users/"+userID+"/preferences", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeAsService(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returned %d", resp.StatusCode)
+	}
+
+	var contact customerContact
+	if err := json.NewDecoder(resp.Body).Decode(&contact); err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+func signReviewLink(order *Order, productID string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ": "review",
+		"sub": order.UserID,
+		"oid": order.ID,
+		"pid": productID,
+		"exp": time.Now().Add(reviewLinkTTL).Unix(),
+		"iat": time.Now().Unix(),
+	})
+	return token.SignedString(reviewLinkSecret)
+}
+
+func parseReviewLink(tokenString string) (jwt.MapClaims, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return reviewLinkSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["typ"] != "review" {
+		return nil, false
+	}
+	for _, key := range []string{"sub", "oid", "pid"} {
+		if _, ok := claims[key].(string); !ok {
+			return nil, false
+		}
+	}
+	return claims, true
+}
+
+func storefrontURL(path string) string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return base + path
+}
+
+// reviewEmail builds the email body with a row of one-click star links per
+// purchased product.
+func reviewEmail(ctx context.Context, order *Order) (string, error) {
+	var b strings.Builder
+	b.WriteString("Thanks for your order! How did we do? Rate your items with one click:\n")
+
+	seen := map[string]bool{}
+	for _, item := range order.Items {
+		if seen[item.ProductID] {
+			continue
+		}
+		seen[item.ProductID] = true
+
+		name := item.ProductID
+		if product, err := fetchProduct(ctx, item.ProductID); err == nil {
+			name = product.Name
+		}
+
+		token, err := signReviewLink(order, item.ProductID)
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString("\n" + name + "\n")
+		for rating := 1; rating <= 5; rating++ {
+			fmt.Fprintf(&b, "  %s %s\n", strings.Repeat("★", rating),
+				storefrontURL("/reviews/new?token="+token+"&rating="+strconv.Itoa(rating)))
+		}
+	}
+	return b.String(), nil
+}
+
+// startReviewReminders sends due review requests every few minutes.
+func startReviewReminders() {
+	go func() {
+		for range time.Tick(5 * time.Minute) {
+			sendDueReviewReminders(context.Background())
+		}
+	}()
+}
+
+func sendDueReviewReminders(ctx context.Context) {
+	reminders := orderService.db.Collection("review_reminders")
+	cursor, err := reminders.Find(ctx, bson.M{"status": "pending", "send_at": bson.M{"$lte": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "send_at", Value: 1}}).SetLimit(200))
+	if err != nil {
+		log.Printf("Failed to load review reminders: %v", err)
+		return
+	}
+
+	var due []ReviewReminder
+	if err := cursor.All(ctx, &due); err != nil {
+		log.Printf("Failed to decode review reminders: %v", err)
+		return
+	}
+
+	for _, reminder := range due {
+		status, reason := sendReviewReminder(ctx, reminder)
+
+		// Retries go to the back of the queue so they can't crowd out the
+		// reminders behind them
+		set := bson.M{"status": status, "reason": reason}
+		switch status {
+		case "pending":
+			set["send_at"] = time.Now().Add(reviewReminderRetry)
+		case "sent":
+			set["sent_at"] = time.Now()
+		}
+		if _, err := reminders.UpdateOne(ctx, bson.M{"_id": reminder.OrderID}, bson.M{"$set": set}); err != nil {
+			log.Printf("Failed to update review reminder for order %s: %v", reminder.OrderID, err)
+		}
+	}
+}
+
+// sendReviewReminder returns the reminder's new status. Transient failures
+// leave it pending to be retried on the next run.
+func sendReviewReminder(ctx context.Context, reminder ReviewReminder) (string, string) {
+	var order Order
+	if err := orderService.db.Collection("orders").FindOne(ctx, idFilter(reminder.OrderID)).Decode(&order); err != nil {
+		return "skipped", "order not found"
+	}
+	if len(order.Items) == 0 {
+		return "skipped", "no items"
+	}
+
+	contact, err := fetchCustomerContact(ctx, reminder.UserID)
+	if err != nil {
+		log.Printf("Failed to load contact preferences for %s: %v", reminder.UserID, err)
+		return "pending", ""
+	}
+	if !contact.Preferences.MarketingOptIn || !contact.Preferences.Notifications.Email {
+		return "skipped", "no consent"
+	}
+
+	body, err := reviewEmail(ctx, &order)
+	if err != nil {
+		return "pending", ""
+	}
+
+	if err := sendEmail(ctx, contact.Email, "How was your order?", body); err != nil {
+		log.Printf("Failed to send review reminder for order %s: %v", order.ID, err)
+		return "pending", ""
+	}
+	return "sent", ""
+}
+
+// saveReviewDraft is where the emailed links land. The signed link stands
+// in for a login, so customers can rate without signing in; it creates the
+// draft on first use and updates it afterwards.
+func saveReviewDraft(c *gin.Context) {
+	var req struct {
+		Token  string `json:"token" binding:"required"`
+		Rating int    `json:"rating" binding:"required,min=1,max=5"`
+		Title  string `json:"title" binding:"max=200"`
+		Body   string `json:"body" binding:"max=5000"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, ok := parseReviewLink(req.Token)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired review link"})
+		return
+	}
+
+	orderID, productID := claims["oid"].(string), claims["pid"].(string)
+	draft := ReviewDraft{
+		ID:        orderID + ":" + productID,
+		OrderID:   orderID,
+		UserID:    claims["sub"].(string),
+		ProductID: productID,
+		Rating:    req.Rating,
+		Title:     req.Title,
+		Body:      req.Body,
+		Status:    "draft",
+		UpdatedAt: time.Now(),
+	}
+
+	// Published reviews can't be edited through the link
+	_, err := orderService.db.Collection("review_drafts").UpdateOne(context.Background(),
+		bson.M{"_id": draft.ID, "status": bson.M{"$ne": "published"}},
+		bson.M{"$set": draft},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Review has already been published"})
+		return
+	}
+
+	c.JSON(http.StatusOK, draft)
+}
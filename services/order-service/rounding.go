@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// CurrencyRule controls how amounts in a currency are rounded. CashIncrement
+// is the smallest coin in circulation (e.g. 0.05 CHF) and only applies when
+// the customer pays in cash.
+type CurrencyRule struct {
+	Decimals      int     `json:"decimals"`
+	CashIncrement float64 `json:"cash_increment"`
+}
+
+var currencyRules = map[string]CurrencyRule{
+	"JPY": {Decimals: 0},
+	"KRW": {Decimals: 0},
+	"VND": {Decimals: 0},
+	"CLP": {Decimals: 0},
+	"ISK": {Decimals: 0},
+	"CHF": {Decimals: 2, CashIncrement: 0.05},
+}
+
+var cashPaymentMethods = map[string]bool{
+	"cash":             true,
+	"cash_on_delivery": true,
+}
+
+// loadCurrencyRules merges CURRENCY_ROUNDING, e.g.
+// {"SEK": {"decimals": 2, "cash_increment": 1}}, over the built-in rules.
+func loadCurrencyRules() {
+	raw := os.Getenv("CURRENCY_ROUNDING")
+	if raw == "" {
+		return
+	}
+
+	var overrides map[string]CurrencyRule
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Invalid CURRENCY_ROUNDING, using defaults: %v", err)
+		return
+	}
+	for currency, rule := range overrides {
+		currencyRules[strings.ToUpper(currency)] = rule
+	}
+}
+
+func currencyRule(currency string) CurrencyRule {
+	if rule, ok := currencyRules[strings.ToUpper(currency)]; ok {
+		return rule
+	}
+	return CurrencyRule{Decimals: 2}
+}
+
+// roundAmount rounds half away from zero to the currency's minor unit.
+func roundAmount(currency string, v float64) float64 {
+	scale := math.Pow10(currencyRule(currency).Decimals)
+	return math.Round(v*scale) / scale
+}
+
+// cashRound rounds a total to the currency's cash increment and returns the
+// rounded total together with the adjustment that was applied.
+func cashRound(currency string, total float64) (float64, float64) {
+	increment := currencyRule(currency).CashIncrement
+	if increment <= 0 {
+		return total, 0
+	}
+
+	rounded := roundAmount(currency, math.Round(total/increment)*increment)
+	return rounded, roundAmount(currency, rounded-total)
+}
+
+func defaultCurrency() string {
+	if currency := os.Getenv("DEFAULT_CURRENCY"); currency != "" {
+		return strings.ToUpper(currency)
+	}
+	return "USD"
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeliverySlot is a bookable delivery window for a local-delivery zone.
+type DeliverySlot struct {
+	ID        string    `bson:"_id" json:"id"`
+	Zone      string    `bson:"zone" json:"zone"`
+	Date      string    `bson:"date" json:"date"`
+	Start     string    `bson:"start" json:"start"`
+	End       string    `bson:"end" json:"end"`
+	Capacity  int       `bson:"capacity" json:"capacity"`
+	Booked    int       `bson:"booked" json:"booked"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// SlotBooking is the slot as persisted on the order.
+type SlotBooking struct {
+	SlotID string `bson:"slot_id" json:"slot_id"`
+	Zone   string `bson:"zone" json:"zone"`
+	Date   string `bson:"date" json:"date"`
+	Start  string `bson:"start" json:"start"`
+	End    string `bson:"end" json:"end"`
+}
+
+var (
+	errSlotUnavailable = errors.New("delivery slot is full or does not exist")
+	errSlotWrongZone   = errors.New("delivery slot is not available for this address")
+)
+
+// deliveryZones maps zone names to postal code prefixes, read from
+// DELIVERY_ZONES, e.g. {"london-central": ["SW1", "WC2", "EC1"]}.
+var deliveryZones map[string][]string
+
+func loadDeliveryZones() {
+	deliveryZones = map[string][]string{}
+	raw := os.Getenv("DELIVERY_ZONES")
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(raw), &deliveryZones); err != nil {
+		log.Printf("Invalid DELIVERY_ZONES, slot booking disabled: %v", err)
+		deliveryZones = map[string][]string{}
+	}
+}
+
+func zoneFor(postalCode string) string {
+	postalCode = strings.ToUpper(strings.ReplaceAll(postalCode, " ", ""))
+	for zone, prefixes := range deliveryZones {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(postalCode, strings.ToUpper(prefix)) {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+func createDeliverySlot(c *gin.Context) {
+	var req struct {
+		Zone     string `json:"zone" binding:"required"`
+		Date     string `json:"date" binding:"required,datetime=2006-01-02"`
+		Start    string `json:"start" binding:"required,datetime=15:04"`
+		End      string `json:"end" binding:"required,datetime=15:04"`
+		Capacity int    `json:"capacity" binding:"required,min=1"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id := req.Zone + "|" + req.Date + "|" + req.Start
+	collection := orderService.db.Collection("delivery_slots")
+	_, err := collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": id},
+		bson.M{
+			"$set": bson.M{
+				"zone":       req.Zone,
+				"date":       req.Date,
+				"start":      req.Start,
+				"end":        req.End,
+				"capacity":   req.Capacity,
+				"updated_at": time.Now(),
+			},
+			"$setOnInsert": bson.M{"booked": 0},
+		},
+		options.Update().SetUpsert(true),
+	)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save delivery slot"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Delivery slot saved", "slot_id": id})
+}
+
+// listDeliverySlots returns slots with remaining capacity for the zone the
+// postal code falls into, starting tomorrow.
+func listDeliverySlots(c *gin.Context) {
+	zone := zoneFor(c.Query("postal_code"))
+	if zone == "" {
+		c.JSON(http.StatusOK, gin.H{"zone": nil, "slots": []DeliverySlot{}, "count": 0})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days < 1 || days > 31 {
+		days = 7
+	}
+	from := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	to := time.Now().AddDate(0, 0, days).Format("2006-01-02")
+
+	collection := orderService.db.Collection("delivery_slots")
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "start", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{
+		"zone":  zone,
+		"date":  bson.M{"$gte": from, "$lte": to},
+		"$expr": bson.M{"$lt": bson.A{"$booked", "$capacity"}},
+	}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery slots"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	slots := []DeliverySlot{}
+	if err = cursor.All(context.Background(), &slots); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode delivery slots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zone":  zone,
+		"slots": slots,
+		"count": len(slots),
+	})
+}
+
+// bookDeliverySlot takes one unit of capacity from the slot, provided the
+// shipping address is in the slot's zone.
+func bookDeliverySlot(ctx context.Context, slotID string, address *Address) (*SlotBooking, error) {
+	if address == nil {
+		return nil, errSlotWrongZone
+	}
+
+	collection := orderService.db.Collection("delivery_slots")
+	var slot DeliverySlot
+	err := collection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":   slotID,
+			"zone":  zoneFor(address.PostalCode),
+			"$expr": bson.M{"$lt": bson.A{"$booked", "$capacity"}},
+		},
+		bson.M{"$inc": bson.M{"booked": 1}},
+	).Decode(&slot)
+	if err != nil {
+		return nil, errSlotUnavailable
+	}
+
+	return &SlotBooking{SlotID: slot.ID, Zone: slot.Zone, Date: slot.Date, Start: slot.Start, End: slot.End}, nil
+}
+
+func releaseDeliverySlot(ctx context.Context, booking *SlotBooking) {
+	if booking == nil {
+		return
+	}
+
+	collection := orderService.db.Collection("delivery_slots")
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": booking.SlotID, "booked": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"booked": -1}},
+	)
+	if err != nil {
+		log.Printf("Failed to release delivery slot %s: %v", booking.SlotID, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// statusTransitions lists the statuses an order can be moved to from each
+// status, through updateOrderStatus or cancelOrder. Orders can only be
+// cancelled before they're paid; cancelled, delivered and fulfilled orders
+// are done. Fulfillment moves orders along line by line on its own.
+var statusTransitions = map[string][]string{
+	"pending":             {"confirmed", "awaiting_payment", "paid", "cancelled"},
+	"confirmed":           {"awaiting_payment", "paid", "cancelled"},
+	"awaiting_payment":    {"paid", "cancelled"},
+	"paid":                {"shipped", "delivered", "fulfilled"},
+	"partially_fulfilled": {"shipped", "delivered", "fulfilled"},
+	"shipped":             {"delivered", "fulfilled"},
+}
+
+// statusesBefore returns the statuses an order can move to status from.
+func statusesBefore(status string) bson.A {
+	from := bson.A{}
+	for before, next := range statusTransitions {
+		for _, s := range next {
+			if s == status {
+				from = append(from, before)
+			}
+		}
+	}
+	return from
+}
+
+// transitionOrder moves the order to status if it's in one it can move
+// from, returning the updated order. The check and the update are one
+// write, so the side effects of a transition happen once. It writes the
+// error response itself.
+func transitionOrder(c *gin.Context, id, status string) (*Order, bool) {
+	from := statusesBefore(status)
+	if len(from) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status " + status})
+		return nil, false
+	}
+
+	collection := orderService.db.Collection("orders")
+	filter := idFilter(id)
+	filter["status"] = bson.M{"$in": from}
+	var order Order
+	err := collection.FindOneAndUpdate(context.Background(), filter,
+		bson.M{"$set": bson.M{"status": status, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		var current Order
+		if collection.FindOne(context.Background(), idFilter(id)).Decode(&current) != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Order can't go from " + current.Status + " to " + status})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+		return nil, false
+	}
+	return &order, true
+}
+
+// orderStatusChanged records the order's new status on its timeline and
+// does what the status calls for: paid orders commit their stock and
+// deliver their digital lines, orders leaving the warehouse commit their
+// stock if they haven't yet, and cancelled orders give back their stock
+// and delivery slot.
+func orderStatusChanged(ctx context.Context, order *Order, actor string) {
+	recordTimelineEvent(ctx, TimelineEvent{
+		OrderID: order.ID,
+		Type:    "status_changed",
+		Message: "Order status changed to " + order.Status,
+		Actor:   actor,
+		Data:    bson.M{"status": order.Status},
+	})
+
+	switch order.Status {
+	case "paid":
+		commitOrderStock(ctx, order)
+		deliverDigitalLines(ctx, order.ID)
+	case "shipped":
+		commitOrderStock(ctx, order)
+	case "delivered", "fulfilled":
+		commitOrderStock(ctx, order)
+		orderDelivered(ctx, order.ID)
+	case "cancelled":
+		releaseDeliverySlot(ctx, order.DeliverySlot)
+		releaseReservation(ctx, order.ID)
+	}
+}
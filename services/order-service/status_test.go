@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestStatusesBefore(t *testing.T) {
+	for _, tc := range []struct {
+		status string
+		want   []string
+	}{
+		{"confirmed", []string{"pending"}},
+		{"awaiting_payment", []string{"confirmed", "pending"}},
+		{"paid", []string{"awaiting_payment", "confirmed", "pending"}},
+		// Paid orders can't be cancelled, only unpaid ones
+		{"cancelled", []string{"awaiting_payment", "confirmed", "pending"}},
+		{"shipped", []string{"paid", "partially_fulfilled"}},
+		{"fulfilled", []string{"paid", "partially_fulfilled", "shipped"}},
+		{"pending", []string{}},
+		{"refunded", []string{}},
+	} {
+		got := []string{}
+		for _, s := range statusesBefore(tc.status) {
+			got = append(got, s.(string))
+		}
+		sort.Strings(got)
+		if len(got) != len(tc.want) {
+			t.Errorf("statusesBefore(%q) = %v, want %v", tc.status, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("statusesBefore(%q) = %v, want %v", tc.status, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFinishedOrdersDontMove(t *testing.T) {
+	for _, status := range []string{"cancelled", "delivered", "fulfilled"} {
+		if next := statusTransitions[status]; len(next) > 0 {
+			t.Errorf("%s orders can move to %v", status, next)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TaxCertificate is a B2B customer's tax-exemption certificate. It only
+// takes effect once staff have approved it, and only for orders shipping to
+// one of its jurisdictions before it expires.
+type TaxCertificate struct {
+	ID                string     `bson:"_id,omitempty" json:"id"`
+	UserID            string     `bson:"user_id" json:"user_id"`
+	Organization      string     `bson:"organization" json:"organization"`
+	CertificateNumber string     `bson:"certificate_number" json:"certificate_number"`
+	Jurisdictions     []string   `bson:"jurisdictions" json:"jurisdictions"`
+	FileName          string     `bson:"file_name" json:"file_name"`
+	MediaID           string     `bson:"media_id" json:"media_id"`
+	URL               string     `bson:"url" json:"url"`
+	Status            string     `bson:"status" json:"status"`
+	ExpiresAt         *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	ReviewedBy        string     `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewedAt        *time.Time `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	ReviewNotes       string     `bson:"review_notes,omitempty" json:"review_notes,omitempty"`
+	CreatedAt         time.Time  `bson:"created_at" json:"created_at"`
+}
+
+const (
+	certificatePending  = "pending"
+	certificateApproved = "approved"
+	certificateRejected = "rejected"
+)
+
+// jurisdictionPattern accepts a country ("US") or a country and region
+// ("US-CA").
+var jurisdictionPattern = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+
+// covers reports whether the certificate exempts orders shipping to address.
+// A country-wide jurisdiction covers all of its regions.
+func (cert *TaxCertificate) covers(address *Address) bool {
+	if address == nil {
+		return false
+	}
+	country := strings.ToUpper(address.Country)
+	region := country + "-" + strings.ToUpper(address.Region)
+	for _, j := range cert.Jurisdictions {
+		if j == country || (address.Region != "" && j == region) {
+			return true
+		}
+	}
+	return false
+}
+
+func uploadTaxCertificate(c *gin.Context) {
+	if c.GetString("role") == "guest" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Sign in to upload a tax-exemption certificate"})
+		return
+	}
+
+	organization := strings.TrimSpace(c.PostForm("organization"))
+	number := strings.TrimSpace(c.PostForm("certificate_number"))
+	if organization == "" || number == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization and certificate_number are required"})
+		return
+	}
+
+	var jurisdictions []string
+	for _, raw := range strings.Split(c.PostForm("jurisdictions"), ",") {
+		j := strings.ToUpper(strings.TrimSpace(raw))
+		if j == "" {
+			continue
+		}
+		if !jurisdictionPattern.MatchString(j) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid jurisdiction " + j})
+			return
+		}
+		jurisdictions = append(jurisdictions, j)
+	}
+	if len(jurisdictions) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one jurisdiction is required"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if file.Size > maxAttachmentBytes() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+		return
+	}
+	if !allowedAttachmentTypes[file.Header.Get("Content-Type")] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	mediaID, url, err := uploadToMedia(c.Request.Context(), "tax-certificates/"+userID, file)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	cert := TaxCertificate{
+		UserID:            userID,
+		Organization:      organization,
+		CertificateNumber: number,
+		Jurisdictions:     jurisdictions,
+		FileName:          file.Filename,
+		MediaID:           mediaID,
+		URL:               url,
+		Status:            certificatePending,
+		CreatedAt:         time.Now(),
+	}
+
+	result, err := orderService.db.Collection("tax_certificates").InsertOne(context.Background(), cert)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save certificate"})
+		return
+	}
+	cert.ID = idString(result.InsertedID)
+
+	c.JSON(http.StatusCreated, cert)
+}
+
+func listTaxCertificates(c *gin.Context) {
+	findCertificates(c, bson.M{"user_id": c.GetString("user_id")})
+}
+
+// adminListTaxCertificates is the review queue; ?status=pending by default.
+func adminListTaxCertificates(c *gin.Context) {
+	filter := bson.M{"status": c.DefaultQuery("status", certificatePending)}
+	if userID := c.Query("user_id"); userID != "" {
+		filter["user_id"] = userID
+	}
+	findCertificates(c, filter)
+}
+
+func findCertificates(c *gin.Context, filter bson.M) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := orderService.db.Collection("tax_certificates").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch certificates"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	certs := []TaxCertificate{}
+	if err := cursor.All(context.Background(), &certs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode certificates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, certs)
+}
+
+// reviewTaxCertificate approves or rejects a pending certificate. Approval
+// requires an expiry date, after which the certificate stops applying.
+func reviewTaxCertificate(c *gin.Context) {
+	var req struct {
+		Decision  string     `json:"decision" binding:"required,oneof=approved rejected"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Notes     string     `json:"notes"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"status":       req.Decision,
+		"reviewed_by":  c.GetString("user_id"),
+		"reviewed_at":  now,
+		"review_notes": req.Notes,
+	}
+	if req.Decision == certificateApproved {
+		if req.ExpiresAt == nil || !req.ExpiresAt.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Approved certificates need a future expires_at"})
+			return
+		}
+		set["expires_at"] = req.ExpiresAt
+	}
+
+	collection := orderService.db.Collection("tax_certificates")
+	filter := idFilter(c.Param("id"))
+	filter["status"] = certificatePending
+
+	var cert TaxCertificate
+	err := collection.FindOneAndUpdate(context.Background(), filter, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&cert)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pending certificate not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cert)
+}
+
+// findTaxExemption returns the caller's approved, unexpired certificate
+// covering the order's shipping address, if any.
+func findTaxExemption(ctx context.Context, userID string, address *Address) *TaxCertificate {
+	if userID == "" || address == nil {
+		return nil
+	}
+
+	cursor, err := orderService.db.Collection("tax_certificates").Find(ctx, bson.M{
+		"user_id":    userID,
+		"status":     certificateApproved,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return nil
+	}
+	defer cursor.Close(ctx)
+
+	var certs []TaxCertificate
+	if err := cursor.All(ctx, &certs); err != nil {
+		return nil
+	}
+	for i := range certs {
+		if certs[i].covers(address) {
+			return &certs[i]
+		}
+	}
+	return nil
+}
+
+// applyTaxExemption marks the order tax-exempt when the authenticated caller
+// owns it and holds a certificate for its destination. The order body alone
+// is never enough, since user_id there is client-supplied.
+func applyTaxExemption(c *gin.Context, order *Order) {
+	order.TaxExemptionID = ""
+	if order.UserID == "" || bearerSubject(c) != order.UserID {
+		return
+	}
+	if cert := findTaxExemption(c.Request.Context(), order.UserID, order.ShippingAddress); cert != nil {
+		order.TaxExemptionID = cert.ID
+	}
+}
+
+// bearerSubject returns the subject of a valid bearer token, or "" on
+// routes that don't require authentication.
+func bearerSubject(c *gin.Context) string {
+	sub, _ := bearerClaims(c)["sub"].(string)
+	return sub
+}
+
+// bearerClaims returns the claims of a valid bearer token, or nil.
+func bearerClaims(c *gin.Context) jwt.MapClaims {
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil
+	}
+	token, err := jwt.Parse(strings.TrimPrefix(authHeader, "Bearer "), verifier.keyFunc)
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if refreshToken(claims) || revoked(c.Request.Context(), claims) {
+		return nil
+	}
+	return claims
+}
+
+func recordTaxExemption(orderID string, order *Order) {
+	if order.TaxExemptionID == "" {
+		return
+	}
+	recordTimelineEvent(context.Background(), TimelineEvent{
+		OrderID: orderID,
+		Type:    "tax_exempt",
+		Message: fmt.Sprintf("Tax exemption applied (certificate %s)", order.TaxExemptionID),
+		Actor:   order.UserID,
+		Data:    bson.M{"certificate_id": order.TaxExemptionID},
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TimelineEvent is one entry in an order's history as shown to customers
+// and support staff. StaffOnly events are hidden from customers.
+type TimelineEvent struct {
+	ID        string    `bson:"_id,omitempty" json:"id"`
+	OrderID   string    `bson:"order_id" json:"order_id"`
+	Type      string    `bson:"type" json:"type"`
+	Message   string    `bson:"message" json:"message"`
+	Actor     string    `bson:"actor,omitempty" json:"actor,omitempty"`
+	StaffOnly bool      `bson:"staff_only" json:"staff_only"`
+	Data      bson.M    `bson:"data,omitempty" json:"data,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+func recordTimelineEvent(ctx context.Context, event TimelineEvent) {
+	event.CreatedAt = time.Now()
+
+	collection := orderService.db.Collection("order_timeline")
+	if _, err := collection.InsertOne(ctx, event); err != nil {
+		log.Printf("Failed to record timeline event %s for order %s: %v", event.Type, event.OrderID, err)
+	}
+}
+
+// loadAccessibleOrder fetches the order for the authenticated caller, who
+// must either own it or be staff. It writes the error response itself.
+func loadAccessibleOrder(c *gin.Context, id string) (*Order, bool) {
+	collection := orderService.db.Collection("orders")
+
+	var order Order
+	err := collection.FindOne(context.Background(), idFilter(id)).Decode(&order)
+	if err != nil || (order.UserID != c.GetString("user_id") && !isStaff(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return nil, false
+	}
+
+	return &order, true
+}
+
+func getOrderTimeline(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := loadAccessibleOrder(c, id); !ok {
+		return
+	}
+
+	filter := bson.M{"order_id": id}
+	if !isStaff(c) {
+		filter["staff_only"] = false
+	}
+
+	collection := orderService.db.Collection("order_timeline")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := collection.Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch timeline"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	events := []TimelineEvent{}
+	if err = cursor.All(context.Background(), &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode timeline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"count":  len(events),
+	})
+}
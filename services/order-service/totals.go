@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var taxRates map[string]float64
+
+// loadTaxRates reads TAX_RATES, a map of destination country to sales tax
+// rate, e.g. {"GB": 0.2, "DE": 0.19, "*": 0}.
+func loadTaxRates() {
+	taxRates = map[string]float64{}
+	raw := os.Getenv("TAX_RATES")
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(raw), &taxRates); err != nil {
+		log.Printf("Invalid TAX_RATES, no tax will be charged: %v", err)
+		taxRates = map[string]float64{}
+	}
+}
+
+func taxRateFor(address *Address) float64 {
+	if address != nil {
+		if rate, ok := taxRates[strings.ToUpper(address.Country)]; ok {
+			return rate
+		}
+	}
+	return taxRates["*"]
+}
+
+// quoteOrder prices a prospective order for the cart and checkout without
+// persisting it.
+func quoteOrder(c *gin.Context) {
+	var order Order
+	if err := c.ShouldBindJSON(&order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := prepareFulfillment(c.Request.Context(), &order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := resolveAddresses(c, &order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address"})
+		return
+	}
+
+	applyTaxExemption(c, &order)
+	if err := priceOrder(c.Request.Context(), &order); err != nil {
+		pricingFailed(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency":            order.Currency,
+		"items":               order.Items,
+		"subtotal":            order.Subtotal,
+		"fees":                order.Fees,
+		"tax":                 order.Tax,
+		"tax_rate":            order.TaxRate,
+		"tax_exemption_id":    order.TaxExemptionID,
+		"promo_code":          order.PromoCode,
+		"rounding_adjustment": order.RoundingAdjustment,
+		"total":               order.Total,
+		"pricing_trace":       order.PricingTrace,
+	})
+}
+
+// RefundQuote is the amount owed back to the customer for returned items,
+// including the tax charged on them. Refundable fees are only returned when
+// the whole order is refunded.
+type RefundQuote struct {
+	Currency           string    `json:"currency"`
+	Items              float64   `json:"items"`
+	Fees               []FeeLine `json:"fees"`
+	Tax                float64   `json:"tax"`
+	RoundingAdjustment float64   `json:"rounding_adjustment"`
+	Total              float64   `json:"total"`
+	FullRefund         bool      `json:"full_refund"`
+}
+
+func refundQuote(c *gin.Context) {
+	var req struct {
+		Items []struct {
+			ProductID string `json:"product_id" binding:"required"`
+			Quantity  int    `json:"quantity" binding:"required,min=1"`
+		} `json:"items" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := orderService.db.Collection("orders")
+	var order Order
+	err := collection.FindOne(context.Background(), idFilter(c.Param("id"))).Decode(&order)
+	if err != nil || (order.UserID != c.GetString("user_id") && !isStaff(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	remaining := map[string]int{}
+	prices := map[string]float64{}
+	for _, item := range order.Items {
+		remaining[item.ProductID] += item.Quantity
+		prices[item.ProductID] = item.Price
+	}
+
+	quote := RefundQuote{Currency: order.Currency, Fees: []FeeLine{}}
+	for _, item := range req.Items {
+		if remaining[item.ProductID] < item.Quantity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Refund quantity exceeds ordered quantity for " + item.ProductID})
+			return
+		}
+		remaining[item.ProductID] -= item.Quantity
+		quote.Items += prices[item.ProductID] * float64(item.Quantity)
+	}
+
+	quote.FullRefund = true
+	for _, qty := range remaining {
+		if qty > 0 {
+			quote.FullRefund = false
+		}
+	}
+
+	taxable := quote.Items
+	quote.Total = quote.Items
+	if quote.FullRefund {
+		for _, fee := range order.Fees {
+			if !fee.Refundable {
+				continue
+			}
+			quote.Fees = append(quote.Fees, fee)
+			quote.Total += fee.Amount
+			if fee.Taxable {
+				taxable += fee.Amount
+			}
+		}
+	}
+
+	quote.Items = roundAmount(order.Currency, quote.Items)
+	quote.Tax = roundAmount(order.Currency, taxable*order.TaxRate)
+	quote.Total = roundAmount(order.Currency, quote.Total+quote.Tax)
+
+	if cashPaymentMethods[order.PaymentMethod] {
+		quote.Total, quote.RoundingAdjustment = cashRound(order.Currency, quote.Total)
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Normalized tracking statuses, in the order a parcel normally goes
+// through them. Carrier-specific codes are mapped onto these.
+const (
+	TrackingLabelCreated   = "label_created"
+	TrackingInTransit      = "in_transit"
+	TrackingOutForDelivery = "out_for_delivery"
+	TrackingDelivered      = "delivered"
+	TrackingException      = "exception"
+)
+
+// Shipment is one parcel on an order. A shipment can carry several lines,
+// and an order can be split across shipments and carriers.
+type Shipment struct {
+	Carrier        string    `bson:"carrier" json:"carrier"`
+	TrackingNumber string    `bson:"tracking_number" json:"tracking_number"`
+	LineIDs        []string  `bson:"line_ids" json:"line_ids"`
+	Status         string    `bson:"status" json:"status"`
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+}
+
+// TrackingEvent is a normalized carrier scan.
+type TrackingEvent struct {
+	OrderID        string    `bson:"order_id" json:"-"`
+	Carrier        string    `bson:"carrier" json:"carrier"`
+	TrackingNumber string    `bson:"tracking_number" json:"tracking_number"`
+	Status         string    `bson:"status" json:"status"`
+	CarrierStatus  string    `bson:"carrier_status,omitempty" json:"carrier_status,omitempty"`
+	Description    string    `bson:"description,omitempty" json:"description,omitempty"`
+	Location       string    `bson:"location,omitempty" json:"location,omitempty"`
+	OccurredAt     time.Time `bson:"occurred_at" json:"occurred_at"`
+}
+
+// CarrierConfig is read per carrier from CARRIERS, e.g.
+//
+//	{"ups": {"track_url": "https://track.example/ups/{tracking_number}",
+//	         "api_key": "...", "status_map": {"I": "in_transit", "D": "delivered"}},
+//	 "dhl": {"webhook_secret": "...", "status_map": {"transit": "in_transit"}}}
+//
+// Carriers with a track_url are polled; carriers with a webhook_secret push
+// events to /api/v1/tracking/webhooks/:carrier. Both report events as
+// {"events": [{"status", "description", "location", "time"}]}.
+type CarrierConfig struct {
+	TrackURL      string            `json:"track_url"`
+	APIKey        string            `json:"api_key"`
+	WebhookSecret string            `json:"webhook_secret"`
+	StatusMap     map[string]string `json:"status_map"`
+}
+
+type carrierEvent struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Location    string    `json:"location"`
+	Time        time.Time `json:"time"`
+}
+
+var carriers map[string]CarrierConfig
+
+func loadCarriers() {
+	carriers = map[string]CarrierConfig{}
+	raw := os.Getenv("CARRIERS")
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(raw), &carriers); err != nil {
+		log.Printf("Invalid CARRIERS, tracking updates are disabled: %v", err)
+		carriers = map[string]CarrierConfig{}
+	}
+}
+
+// normalize maps a carrier's own status code onto a tracking status.
+// Unknown codes are treated as in transit rather than dropped.
+func (cfg CarrierConfig) normalize(event carrierEvent, orderID, carrier, trackingNumber string) TrackingEvent {
+	status, ok := cfg.StatusMap[event.Status]
+	if !ok {
+		status = TrackingInTransit
+	}
+	occurredAt := event.Time
+	if occurredAt.IsZero() {
+		occurredAt = time.Now()
+	}
+	return TrackingEvent{
+		OrderID:        orderID,
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		Status:         status,
+		CarrierStatus:  event.Status,
+		Description:    event.Description,
+		Location:       event.Location,
+		OccurredAt:     occurredAt,
+	}
+}
+
+// addShipment records a new parcel for the given line, or adds the line to
+// an existing parcel with the same tracking number.
+func addShipment(order *Order, carrier, trackingNumber, lineID string) {
+	for i := range order.Shipments {
+		s := &order.Shipments[i]
+		if s.Carrier == carrier && s.TrackingNumber == trackingNumber {
+			s.LineIDs = append(s.LineIDs, lineID)
+			return
+		}
+	}
+
+	order.Shipments = append(order.Shipments, Shipment{
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		LineIDs:        []string{lineID},
+		Status:         TrackingLabelCreated,
+		CreatedAt:      time.Now(),
+	})
+	storeTrackingEvents(context.Background(), []TrackingEvent{{
+		OrderID:        order.ID,
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		Status:         TrackingLabelCreated,
+		Description:    "Shipping label created",
+		OccurredAt:     time.Now(),
+	}})
+}
+
+// storeTrackingEvents saves events, ignoring ones already seen (carriers
+// resend their full history), and updates the shipment's latest status.
+func storeTrackingEvents(ctx context.Context, events []TrackingEvent) {
+	collection := orderService.db.Collection("tracking_events")
+	for _, event := range events {
+		key := bson.M{
+			"carrier":         event.Carrier,
+			"tracking_number": event.TrackingNumber,
+			"carrier_status":  event.CarrierStatus,
+			"status":          event.Status,
+			"occurred_at":     event.OccurredAt,
+		}
+		_, err := collection.UpdateOne(ctx, key, bson.M{"$setOnInsert": event}, options.Update().SetUpsert(true))
+		if err != nil {
+			log.Printf("Failed to store tracking event for %s %s: %v", event.Carrier, event.TrackingNumber, err)
+		}
+	}
+
+	if len(events) == 0 {
+		return
+	}
+	latest := events[0]
+	for _, event := range events {
+		if event.OccurredAt.After(latest.OccurredAt) {
+			latest = event
+		}
+	}
+	_, err := orderService.db.Collection("orders").UpdateOne(
+		ctx,
+		bson.M{"shipments": bson.M{"$elemMatch": bson.M{"carrier": latest.Carrier, "tracking_number": latest.TrackingNumber}}},
+		bson.M{"$set": bson.M{"shipments.$.status": latest.Status}},
+	)
+	if err != nil {
+		log.Printf("Failed to update shipment status for %s %s: %v", latest.Carrier, latest.TrackingNumber, err)
+	}
+}
+
+// getOrderTracking merges the events of every shipment on the order into
+// a single timeline.
+func getOrderTracking(c *gin.Context) {
+	id := c.Param("id")
+	order, ok := loadAccessibleOrder(c, id)
+	if !ok {
+		return
+	}
+
+	cursor, err := orderService.db.Collection("tracking_events").Find(context.Background(), bson.M{"order_id": id},
+		options.Find().SetSort(bson.D{{Key: "occurred_at", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tracking"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	events := []TrackingEvent{}
+	if err := cursor.All(context.Background(), &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode tracking"})
+		return
+	}
+
+	type shipmentTracking struct {
+		Shipment
+		Events []TrackingEvent `json:"events"`
+	}
+	shipments := []shipmentTracking{}
+	for _, shipment := range order.Shipments {
+		tracked := shipmentTracking{Shipment: shipment, Events: []TrackingEvent{}}
+		for _, event := range events {
+			if event.Carrier == shipment.Carrier && event.TrackingNumber == shipment.TrackingNumber {
+				tracked.Events = append(tracked.Events, event)
+			}
+		}
+		shipments = append(shipments, tracked)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].OccurredAt.Before(events[j].OccurredAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"order_id":  id,
+		"shipments": shipments,
+		"timeline":  events,
+	})
+}
+
+// trackingWebhook accepts pushed events from carriers that support it,
+// signed with HMAC-SHA256 of the body in X-Tracking-Signature.
+func trackingWebhook(c *gin.Context) {
+	carrier := c.Param("carrier")
+	cfg, ok := carriers[carrier]
+	if !ok || cfg.WebhookSecret == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown carrier"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(c.GetHeader("X-Tracking-Signature"))) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	var payload struct {
+		TrackingNumber string         `json:"tracking_number"`
+		Events         []carrierEvent `json:"events"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.TrackingNumber == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+		return
+	}
+
+	var order Order
+	err = orderService.db.Collection("orders").FindOne(context.Background(), bson.M{
+		"shipments": bson.M{"$elemMatch": bson.M{"carrier": carrier, "tracking_number": payload.TrackingNumber}},
+	}).Decode(&order)
+	if err != nil {
+		// Acknowledge so the carrier doesn't keep retrying parcels we don't know
+		c.JSON(http.StatusOK, gin.H{"message": "Unknown shipment ignored"})
+		return
+	}
+
+	events := []TrackingEvent{}
+	for _, event := range payload.Events {
+		events = append(events, cfg.normalize(event, order.ID, carrier, payload.TrackingNumber))
+	}
+	storeTrackingEvents(context.Background(), events)
+
+	c.JSON(http.StatusOK, gin.H{"received": len(events)})
+}
+
+var trackingClient = &http.Client{Timeout: 10 * time.Second}
+
+func pollCarrier(ctx context.Context, cfg CarrierConfig, trackingNumber string) ([]carrierEvent, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(cfg.TrackURL, "{tracking_number}", trackingNumber), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := trackingClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("carrier returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Events []carrierEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Events, nil
+}
+
+// startTrackingPoller refreshes undelivered shipments on polled carriers
+// every TRACKING_POLL_INTERVAL (default 15m).
+func startTrackingPoller() {
+	interval, err := time.ParseDuration(os.Getenv("TRACKING_POLL_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 15 * time.Minute
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			pollShipments(context.Background())
+		}
+	}()
+}
+
+func pollShipments(ctx context.Context) {
+	cursor, err := orderService.db.Collection("orders").Find(ctx, bson.M{
+		"shipments": bson.M{"$elemMatch": bson.M{"status": bson.M{"$ne": TrackingDelivered}}},
+	}, options.Find().SetProjection(bson.M{"shipments": 1}))
+	if err != nil {
+		log.Printf("Failed to load shipments to poll: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			continue
+		}
+		for _, shipment := range order.Shipments {
+			cfg, ok := carriers[shipment.Carrier]
+			if !ok || cfg.TrackURL == "" || shipment.Status == TrackingDelivered {
+				continue
+			}
+
+			polled, err := pollCarrier(ctx, cfg, shipment.TrackingNumber)
+			if err != nil {
+				log.Printf("Failed to poll %s for %s: %v", shipment.Carrier, shipment.TrackingNumber, err)
+				continue
+			}
+
+			events := []TrackingEvent{}
+			for _, event := range polled {
+				events = append(events, cfg.normalize(event, order.ID, shipment.Carrier, shipment.TrackingNumber))
+			}
+			storeTrackingEvents(ctx, events)
+		}
+	}
+}
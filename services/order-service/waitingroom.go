@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var waitingRoomSecret []byte
+
+func loadWaitingRoomSecret() {
+	waitingRoomSecret = []byte(os.Getenv("WAITING_ROOM_SECRET"))
+	if len(waitingRoomSecret) == 0 {
+		waitingRoomSecret = []byte("waiting-room-secret-change-in-production")
+	}
+}
+
+// admission is a waiting room admission token presented at checkout. Each
+// one buys a single order: its ID is spent once the order exists.
+type admission struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
+// errAdmissionUsed withdraws an order whose admission was spent on another
+// order meanwhile.
+var errAdmissionUsed = errors.New("waiting room admission already used")
+
+func admissionKey(id string) string {
+	return "waiting_room_admission:" + id
+}
+
+// checkDropAdmission rejects checkout for products flagged as a drop unless
+// the request carries an admission token from the waiting room for that
+// product in X-Queue-Token, issued to the caller and not yet used. An order
+// with several drops sends one token per product, comma-separated or as
+// repeated headers. It returns the admissions to spend and writes the error
+// response itself.
+func checkDropAdmission(c *gin.Context, items []OrderItem) ([]admission, bool) {
+	tokens := admissionTokens(c)
+	var admissions []admission
+	for _, item := range items {
+		product, err := fetchProduct(c.Request.Context(), item.ProductID)
+		if err == errProductNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Product not found: " + item.ProductID})
+			return nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to load products"})
+			return nil, false
+		}
+		if !product.Drop {
+			continue
+		}
+
+		granted, ok := admitted(c, tokens, item.ProductID)
+		if !ok {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":      "Waiting room admission required",
+				"product_id": item.ProductID,
+			})
+			return nil, false
+		}
+		admissions = append(admissions, granted)
+	}
+	return admissions, true
+}
+
+func admissionTokens(c *gin.Context) []string {
+	var tokens []string
+	for _, value := range c.Request.Header.Values("X-Queue-Token") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func admitted(c *gin.Context, tokens []string, productID string) (admission, bool) {
+	caller := bearerSubject(c)
+	for _, token := range tokens {
+		granted, ok := validAdmission(token, productID, caller)
+		if !ok {
+			continue
+		}
+		n, err := redisClient.Exists(c.Request.Context(), admissionKey(granted.ID)).Result()
+		if err == nil && n == 0 {
+			return granted, true
+		}
+	}
+	return admission{}, false
+}
+
+// validAdmission checks an admission token is for the product and was
+// issued to userID. Anonymous callers are never admitted.
+func validAdmission(tokenString, productID, userID string) (admission, bool) {
+	if tokenString == "" || userID == "" {
+		return admission{}, false
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return waitingRoomSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid {
+		return admission{}, false
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	id, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if claims["typ"] != "admitted" || claims["pid"] != productID || claims["sub"] != userID || id == "" || err != nil || exp == nil {
+		return admission{}, false
+	}
+	return admission{ID: id, ExpiresAt: exp.Time}, true
+}
+
+// spendAdmissions marks the order's admissions used. If another order
+// spent one first, the ones spent here are given back and errAdmissionUsed
+// returned. Each is remembered until its token expires.
+func spendAdmissions(ctx context.Context, orderID string, admissions []admission) error {
+	var spent []string
+	for _, a := range admissions {
+		ok, err := redisClient.SetNX(ctx, admissionKey(a.ID), orderID, time.Until(a.ExpiresAt)+time.Minute).Result()
+		if err == nil && !ok {
+			err = errAdmissionUsed
+		}
+		if err != nil {
+			if len(spent) > 0 {
+				redisClient.Del(context.Background(), spent...)
+			}
+			return err
+		}
+		spent = append(spent, admissionKey(a.ID))
+	}
+	return nil
+}
+
+// returnAdmissions gives back the admissions of an order that was withdrawn
+// after spending them.
+func returnAdmissions(admissions []admission) {
+	for _, a := range admissions {
+		redisClient.Del(context.Background(), admissionKey(a.ID))
+	}
+}
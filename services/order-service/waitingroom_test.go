@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func admissionToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(waitingRoomSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidAdmission(t *testing.T) {
+	loadWaitingRoomSecret()
+	token := admissionToken(t, jwt.MapClaims{"typ": "admitted", "pid": "drop-1", "sub": "u1", "jti": "drop-1:7"})
+
+	granted, ok := validAdmission(token, "drop-1", "u1")
+	if !ok || granted.ID != "drop-1:7" {
+		t.Fatalf("validAdmission = %+v, %v, want the admission drop-1:7", granted, ok)
+	}
+	if _, ok := validAdmission(token, "drop-1", "u2"); ok {
+		t.Error("another shopper was admitted with u1's token")
+	}
+	if _, ok := validAdmission(token, "drop-1", ""); ok {
+		t.Error("an anonymous caller was admitted")
+	}
+	if _, ok := validAdmission(token, "drop-2", "u1"); ok {
+		t.Error("the token admitted to another product")
+	}
+
+	ticket := admissionToken(t, jwt.MapClaims{"typ": "queue", "pid": "drop-1", "sub": "u1", "jti": "drop-1:7"})
+	if _, ok := validAdmission(ticket, "drop-1", "u1"); ok {
+		t.Error("a queue ticket was taken as an admission")
+	}
+	unspendable := admissionToken(t, jwt.MapClaims{"typ": "admitted", "pid": "drop-1", "sub": "u1"})
+	if _, ok := validAdmission(unspendable, "drop-1", "u1"); ok {
+		t.Error("an admission without a jti was accepted")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Journal is one day's payments and refunds in one currency, normalized
+// into balanced double-entry lines that any accounting adapter can post.
+type Journal struct {
+	ID        string        `json:"id"`
+	Date      string        `json:"date"`
+	Currency  string        `json:"currency"`
+	Narration string        `json:"narration"`
+	Lines     []JournalLine `json:"lines"`
+}
+
+type JournalLine struct {
+	Account     string  `json:"account"`
+	Description string  `json:"description"`
+	Debit       float64 `json:"debit,omitempty"`
+	Credit      float64 `json:"credit,omitempty"`
+}
+
+// hash fingerprints the journal content so an unchanged day is never
+// pushed twice.
+func (j *Journal) hash() string {
+	b, _ := json.Marshal(j.Lines)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AccountingAdapter posts journals to an external accounting system. When
+// externalRef is set the journal was pushed before and the adapter must
+// update that entry in place rather than create a duplicate.
+type AccountingAdapter interface {
+	Name() string
+	PushJournal(ctx context.Context, journal *Journal, externalRef string) (string, error)
+}
+
+var accountingAdapters = map[string]AccountingAdapter{}
+
+func registerAccountingAdapter(adapter AccountingAdapter) {
+	accountingAdapters[adapter.Name()] = adapter
+}
+
+// JournalPush records the last push of a journal to one adapter.
+type JournalPush struct {
+	ID          string    `bson:"_id" json:"id"`
+	Adapter     string    `bson:"adapter" json:"adapter"`
+	Date        string    `bson:"date" json:"date"`
+	Currency    string    `bson:"currency" json:"currency"`
+	Hash        string    `bson:"hash" json:"hash"`
+	ExternalRef string    `bson:"external_ref,omitempty" json:"external_ref,omitempty"`
+	Status      string    `bson:"status" json:"status"`
+	Error       string    `bson:"error,omitempty" json:"error,omitempty"`
+	Attempts    int       `bson:"attempts" json:"attempts"`
+	PushedAt    time.Time `bson:"pushed_at" json:"pushed_at"`
+}
+
+// accountMap maps journal roles to ledger account codes, from
+// ACCOUNTING_ACCOUNTS, e.g. {"revenue": "200", "refunds": "210",
+// "clearing": "090", "clearing:bnpl": "091"}. "clearing:<method>" overrides
+// the clearing account for one payment method.
+var accountMap = map[string]string{
+	"revenue":  "revenue",
+	"refunds":  "refunds",
+	"clearing": "clearing",
+}
+
+var accountingLocation = time.UTC
+
+func loadAccountingConfig() {
+	if raw := os.Getenv("ACCOUNTING_ACCOUNTS"); raw != "" {
+		var overrides map[string]string
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			log.Printf("Invalid ACCOUNTING_ACCOUNTS, using defaults: %v", err)
+		}
+		for role, account := range overrides {
+			accountMap[role] = account
+		}
+	}
+
+	if tz := os.Getenv("ACCOUNTING_TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Printf("Invalid ACCOUNTING_TIMEZONE %q, using UTC: %v", tz, err)
+		} else {
+			accountingLocation = loc
+		}
+	}
+
+	if xero := newXeroAdapter(); xero != nil {
+		registerAccountingAdapter(xero)
+	}
+	if qbo := newQuickBooksAdapter(); qbo != nil {
+		registerAccountingAdapter(qbo)
+	}
+}
+
+func clearingAccount(method string) string {
+	if account, ok := accountMap["clearing:"+method]; ok {
+		return account
+	}
+	return accountMap["clearing"]
+}
+
+// buildJournals turns the payments captured and refunded on date into one
+// balanced journal per currency. Captures debit the method's clearing
+// account against revenue; refunds reverse into the refunds account.
+func buildJournals(ctx context.Context, date string) ([]*Journal, error) {
+	start, err := time.ParseInLocation("2006-01-02", date, accountingLocation)
+	if err != nil {
+		return nil, err
+	}
+	end := start.AddDate(0, 0, 1)
+	window := bson.M{"$gte": start, "$lt": end}
+
+	cursor, err := paymentService.db.Collection("payments").Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"status": bson.M{"$in": bson.A{"completed", "refunded"}}, "created_at": window},
+		bson.M{"status": "refunded", "refunded_at": window},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var payments []Payment
+	if err := cursor.All(ctx, &payments); err != nil {
+		return nil, err
+	}
+
+	// currency -> "<kind>:<method>" -> amount
+	totals := map[string]map[string]float64{}
+	for _, p := range payments {
+		if totals[p.Currency] == nil {
+			totals[p.Currency] = map[string]float64{}
+		}
+		if !p.CreatedAt.Before(start) && p.CreatedAt.Before(end) {
+			totals[p.Currency]["capture:"+p.Method] += p.Amount
+		}
+		if p.RefundedAt != nil && !p.RefundedAt.Before(start) && p.RefundedAt.Before(end) {
+			totals[p.Currency]["refund:"+p.Method] += p.Amount
+		}
+	}
+
+	journals := []*Journal{}
+	for currency, byKey := range totals {
+		keys := make([]string, 0, len(byKey))
+		for key := range byKey {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		journal := &Journal{
+			ID:        fmt.Sprintf("PAY-%s-%s", strings.ReplaceAll(date, "-", ""), currency),
+			Date:      date,
+			Currency:  currency,
+			Narration: fmt.Sprintf("Payments and refunds %s (%s)", date, currency),
+		}
+		for _, key := range keys {
+			kind, method, _ := strings.Cut(key, ":")
+			amount := roundAmount(currency, byKey[key])
+			if amount == 0 {
+				continue
+			}
+			switch kind {
+			case "capture":
+				journal.Lines = append(journal.Lines,
+					JournalLine{Account: clearingAccount(method), Description: method + " payments", Debit: amount},
+					JournalLine{Account: accountMap["revenue"], Description: method + " payments", Credit: amount},
+				)
+			case "refund":
+				journal.Lines = append(journal.Lines,
+					JournalLine{Account: accountMap["refunds"], Description: method + " refunds", Debit: amount},
+					JournalLine{Account: clearingAccount(method), Description: method + " refunds", Credit: amount},
+				)
+			}
+		}
+		if len(journal.Lines) > 0 {
+			journals = append(journals, journal)
+		}
+	}
+
+	sort.Slice(journals, func(i, j int) bool { return journals[i].Currency < journals[j].Currency })
+	return journals, nil
+}
+
+// pushJournal sends a journal to an adapter unless the same content was
+// already pushed. force re-pushes regardless, updating the existing entry.
+func pushJournal(ctx context.Context, adapter AccountingAdapter, journal *Journal, force bool) (*JournalPush, error) {
+	collection := paymentService.db.Collection("journal_pushes")
+	id := adapter.Name() + ":" + journal.ID
+	hash := journal.hash()
+
+	var previous JournalPush
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if !force && previous.Status == "pushed" && previous.Hash == hash {
+		return &previous, nil
+	}
+
+	push := JournalPush{
+		ID:          id,
+		Adapter:     adapter.Name(),
+		Date:        journal.Date,
+		Currency:    journal.Currency,
+		Hash:        hash,
+		ExternalRef: previous.ExternalRef,
+		Status:      "pushed",
+		Attempts:    previous.Attempts + 1,
+		PushedAt:    time.Now(),
+	}
+
+	ref, pushErr := adapter.PushJournal(ctx, journal, previous.ExternalRef)
+	if pushErr != nil {
+		push.Status = "failed"
+		push.Error = pushErr.Error()
+	} else {
+		push.ExternalRef = ref
+	}
+
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": id}, push, options.Replace().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return &push, pushErr
+}
+
+// pushDay builds and pushes every journal for date to every adapter.
+func pushDay(ctx context.Context, date string, force bool) ([]JournalPush, error) {
+	journals, err := buildJournals(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+
+	pushes := []JournalPush{}
+	for _, adapter := range accountingAdapters {
+		for _, journal := range journals {
+			push, err := pushJournal(ctx, adapter, journal, force)
+			if push != nil {
+				pushes = append(pushes, *push)
+			}
+			if err != nil {
+				log.Printf("Accounting push %s %s failed: %v", adapter.Name(), journal.ID, err)
+			}
+		}
+	}
+	return pushes, nil
+}
+
+// startAccountingPush pushes the previous day's journals every hour. Pushes
+// are idempotent, so repeated runs only retry failures and late changes.
+func startAccountingPush() {
+	if len(accountingAdapters) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			yesterday := time.Now().In(accountingLocation).AddDate(0, 0, -1).Format("2006-01-02")
+			if _, err := pushDay(context.Background(), yesterday, false); err != nil {
+				log.Printf("Accounting push for %s failed: %v", yesterday, err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func getJournals(c *gin.Context) {
+	journals, err := buildJournals(c.Request.Context(), c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date, expected YYYY-MM-DD"})
+		return
+	}
+
+	c.JSON(http.StatusOK, journals)
+}
+
+// pushJournals (re-)pushes a day on demand. ?force=true updates entries
+// already pushed even if nothing changed.
+func pushJournals(c *gin.Context) {
+	if len(accountingAdapters) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No accounting adapters configured"})
+		return
+	}
+
+	pushes, err := pushDay(c.Request.Context(), c.Param("date"), c.Query("force") == "true")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, pushes)
+}
+
+func listJournalPushes(c *gin.Context) {
+	filter := bson.M{}
+	if date := c.Query("date"); date != "" {
+		filter["date"] = date
+	}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(200)
+	cursor, err := paymentService.db.Collection("journal_pushes").Find(c.Request.Context(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch pushes"})
+		return
+	}
+	defer cursor.Close(c.Request.Context())
+
+	pushes := []JournalPush{}
+	if err := cursor.All(c.Request.Context(), &pushes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode pushes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pushes)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var accountingClient = &http.Client{Timeout: 30 * time.Second}
+
+// callAccountingAPI sends body as JSON and decodes a 2xx response into out.
+func callAccountingAPI(ctx context.Context, method, url string, headers map[string]string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := accountingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// xeroAdapter posts journals as Xero manual journals. Xero updates a manual
+// journal in place when its ManualJournalID is sent again.
+type xeroAdapter struct {
+	baseURL     string
+	accessToken string
+	tenantID    string
+}
+
+func newXeroAdapter() *xeroAdapter {
+	token := os.Getenv("XERO_ACCESS_TOKEN")
+	if token == "" {
+		return nil
+	}
+	baseURL := os.Getenv("XERO_API_URL")
+	if baseURL == "" {
+		baseURL = "https://api.xero.com/api.xro/2.0"
+	}
+	return &xeroAdapter{
+		baseURL:     baseURL,
+		accessToken: token,
+		tenantID:    os.Getenv("XERO_TENANT_ID"),
+	}
+}
+
+func (x *xeroAdapter) Name() string { return "xero" }
+
+func (x *xeroAdapter) PushJournal(ctx context.Context, journal *Journal, externalRef string) (string, error) {
+	type line struct {
+		LineAmount  float64 `json:"LineAmount"`
+		AccountCode string  `json:"AccountCode"`
+		Description string  `json:"Description"`
+	}
+	manual := map[string]interface{}{
+		"Narration": journal.Narration,
+		"Date":      journal.Date,
+		"Status":    "POSTED",
+	}
+	if externalRef != "" {
+		manual["ManualJournalID"] = externalRef
+	}
+
+	// Xero takes debits as positive and credits as negative amounts
+	lines := []line{}
+	for _, l := range journal.Lines {
+		amount := l.Debit - l.Credit
+		lines = append(lines, line{LineAmount: amount, AccountCode: l.Account, Description: l.Description})
+	}
+	manual["JournalLines"] = lines
+
+	headers := map[string]string{
+		"Authorization":   "Bearer " + x.accessToken,
+		"Xero-tenant-id":  x.tenantID,
+		"Idempotency-Key": journal.ID + ":" + journal.hash(),
+	}
+
+	var resp struct {
+		ManualJournals []struct {
+			ManualJournalID string `json:"ManualJournalID"`
+		} `json:"ManualJournals"`
+	}
+	body := map[string]interface{}{"ManualJournals": []interface{}{manual}}
+	if err := callAccountingAPI(ctx, http.MethodPost, x.baseURL+"/ManualJournals", headers, body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.ManualJournals) == 0 {
+		return "", fmt.Errorf("xero returned no manual journal")
+	}
+	return resp.ManualJournals[0].ManualJournalID, nil
+}
+
+// quickBooksAdapter posts journals as QuickBooks Online journal entries.
+// Updates need the entry's current SyncToken, so it is read back first.
+type quickBooksAdapter struct {
+	baseURL     string
+	accessToken string
+	realmID     string
+}
+
+func newQuickBooksAdapter() *quickBooksAdapter {
+	token := os.Getenv("QUICKBOOKS_ACCESS_TOKEN")
+	if token == "" {
+		return nil
+	}
+	baseURL := os.Getenv("QUICKBOOKS_API_URL")
+	if baseURL == "" {
+		baseURL = "https://quickbooks.api.intuit.com"
+	}
+	return &quickBooksAdapter{
+		baseURL:     baseURL,
+		accessToken: token,
+		realmID:     os.Getenv("QUICKBOOKS_REALM_ID"),
+	}
+}
+
+func (q *quickBooksAdapter) Name() string { return "quickbooks" }
+
+func (q *quickBooksAdapter) endpoint(path string) string {
+	return fmt.Sprintf("%s/v3/company/%s/%s", q.baseURL, q.realmID, path)
+}
+
+func (q *quickBooksAdapter) PushJournal(ctx context.Context, journal *Journal, externalRef string) (string, error) {
+	headers := map[string]string{"Authorization": "Bearer " + q.accessToken}
+
+	lines := []map[string]interface{}{}
+	for _, l := range journal.Lines {
+		posting, amount := "Debit", l.Debit
+		if l.Credit > 0 {
+			posting, amount = "Credit", l.Credit
+		}
+		lines = append(lines, map[string]interface{}{
+			"Amount":      amount,
+			"Description": l.Description,
+			"DetailType":  "JournalEntryLineDetail",
+			"JournalEntryLineDetail": map[string]interface{}{
+				"PostingType": posting,
+				"AccountRef":  map[string]string{"value": l.Account},
+			},
+		})
+	}
+
+	entry := map[string]interface{}{
+		"TxnDate":     journal.Date,
+		"DocNumber":   journal.ID,
+		"PrivateNote": journal.Narration,
+		"CurrencyRef": map[string]string{"value": journal.Currency},
+		"Line":        lines,
+	}
+
+	if externalRef != "" {
+		var current struct {
+			JournalEntry struct {
+				SyncToken string `json:"SyncToken"`
+			} `json:"JournalEntry"`
+		}
+		if err := callAccountingAPI(ctx, http.MethodGet, q.endpoint("journalentry/"+externalRef), headers, nil, &current); err != nil {
+			return "", err
+		}
+		entry["Id"] = externalRef
+		entry["SyncToken"] = current.JournalEntry.SyncToken
+	}
+
+	// requestid makes QuickBooks drop retries of a request it already handled
+	url := q.endpoint("journalentry") + "?requestid=" + journal.hash()[:32]
+	var resp struct {
+		JournalEntry struct {
+			ID string `json:"Id"`
+		} `json:"JournalEntry"`
+	}
+	if err := callAccountingAPI(ctx, http.MethodPost, url, headers, entry, &resp); err != nil {
+		return "", err
+	}
+	return resp.JournalEntry.ID, nil
+}
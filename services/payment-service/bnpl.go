@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Settlement records how a BNPL provider paid out an order. The customer pays
+// the provider in installments; we reconcile the provider's payouts against
+// the single order total.
+type Settlement struct {
+	Installments []Installment `bson:"installments" json:"installments"`
+	ProviderFee  float64       `bson:"provider_fee" json:"provider_fee"`
+	Settled      float64       `bson:"settled" json:"settled"`
+	Status       string        `bson:"status" json:"status"`
+	UpdatedAt    time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+type Installment struct {
+	Number    int       `bson:"number" json:"number"`
+	Amount    float64   `bson:"amount" json:"amount"`
+	SettledAt time.Time `bson:"settled_at" json:"settled_at"`
+}
+
+var errNotEligible = errors.New("basket is not eligible for installments")
+
+// bnplProvider talks to a buy-now-pay-later provider over its checkout API.
+type bnplProvider struct {
+	baseURL       string
+	apiKey        string
+	webhookSecret string
+	returnURL     string
+	minAmount     float64
+	maxAmount     float64
+	client        *http.Client
+}
+
+func newBNPLProvider() *bnplProvider {
+	return &bnplProvider{
+		baseURL:       os.Getenv("BNPL_API_URL"),
+		apiKey:        os.Getenv("BNPL_API_KEY"),
+		webhookSecret: os.Getenv("BNPL_WEBHOOK_SECRET"),
+		returnURL:     os.Getenv("BNPL_RETURN_URL"),
+		minAmount:     envFloat("BNPL_MIN_AMOUNT", 50),
+		maxAmount:     envFloat("BNPL_MAX_AMOUNT", 1000),
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func envFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func (p *bnplProvider) Name() string { return "bnpl" }
+
+func (p *bnplProvider) Eligible(amount float64) bool {
+	return p.baseURL != "" && amount >= p.minAmount && amount <= p.maxAmount
+}
+
+func (p *bnplProvider) Authorize(ctx context.Context, payment *Payment) (*ProviderResult, error) {
+	if !p.Eligible(payment.Amount) {
+		return nil, errNotEligible
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"amount":     payment.Amount,
+		"currency":   payment.Currency,
+		"reference":  payment.OrderID,
+		"return_url": p.returnURL,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/checkouts", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("bnpl provider returned %d", resp.StatusCode)
+	}
+
+	var checkout struct {
+		ID          string `json:"id"`
+		RedirectURL string `json:"redirect_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&checkout); err != nil {
+		return nil, err
+	}
+
+	return &ProviderResult{
+		Status:      "pending_approval",
+		ProviderRef: checkout.ID,
+		RedirectURL: checkout.RedirectURL,
+	}, nil
+}
+
+// verifySignature checks the provider's HMAC-SHA256 webhook signature.
+func (p *bnplProvider) verifySignature(body []byte, signature string) bool {
+	if p.webhookSecret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(p.webhookSecret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+var bnpl *bnplProvider
+
+func bnplEligibility(c *gin.Context) {
+	amount, err := strconv.ParseFloat(c.Query("amount"), 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount is required"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"provider":   bnpl.Name(),
+		"eligible":   bnpl.Eligible(amount),
+		"min_amount": bnpl.minAmount,
+		"max_amount": bnpl.maxAmount,
+	})
+}
+
+// readSignedWebhook returns the raw body of a provider webhook after
+// verifying its signature.
+func readSignedWebhook(c *gin.Context) ([]byte, bool) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return nil, false
+	}
+
+	if !bnpl.verifySignature(body, c.GetHeader("X-BNPL-Signature")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return nil, false
+	}
+
+	return body, true
+}
+
+func bnplApprovalCallback(c *gin.Context) {
+	body, ok := readSignedWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ProviderRef string `json:"provider_ref"`
+		Status      string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.ProviderRef == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callback payload"})
+		return
+	}
+
+	status := "failed"
+	if req.Status == "approved" {
+		status = "completed"
+	}
+
+	collection := paymentService.db.Collection("payments")
+	result, err := collection.UpdateOne(
+		context.Background(),
+		bson.M{"provider_ref": req.ProviderRef, "status": "pending_approval"},
+		bson.M{"$set": bson.M{"status": status, "updated_at": time.Now()}},
+	)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update payment"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pending payment not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Payment updated", "status": status})
+}
+
+func bnplSettlementWebhook(c *gin.Context) {
+	body, ok := readSignedWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ProviderRef  string        `json:"provider_ref"`
+		Installments []Installment `json:"installments"`
+		ProviderFee  float64       `json:"provider_fee"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.ProviderRef == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid settlement payload"})
+		return
+	}
+
+	collection := paymentService.db.Collection("payments")
+	var payment Payment
+	err := collection.FindOne(context.Background(), bson.M{"provider_ref": req.ProviderRef}).Decode(&payment)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	settlement := reconcileSettlement(payment.Currency, payment.Amount, req.Installments, req.ProviderFee)
+
+	_, err = collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": payment.ID},
+		bson.M{"$set": bson.M{"settlement": settlement, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record settlement"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settlement)
+}
+
+// reconcileSettlement compares the provider's payouts plus its fee against
+// the order total: "matched" when they agree to the currency's minor unit,
+// "partially_settled" while installments are outstanding and "mismatch" on
+// overpayment.
+func reconcileSettlement(currency string, total float64, installments []Installment, fee float64) *Settlement {
+	settlement := &Settlement{
+		Installments: installments,
+		ProviderFee:  fee,
+		UpdatedAt:    time.Now(),
+	}
+
+	for _, installment := range installments {
+		settlement.Settled += installment.Amount
+	}
+
+	settlement.Settled = roundAmount(currency, settlement.Settled)
+	diff := roundAmount(currency, settlement.Settled+fee-total)
+	switch {
+	case diff == 0:
+		settlement.Status = "matched"
+	case diff < 0:
+		settlement.Status = "partially_settled"
+	default:
+		settlement.Status = "mismatch"
+	}
+
+	return settlement
+}
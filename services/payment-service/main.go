@@ -5,24 +5,32 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Payment struct {
-	ID        string    `bson:"_id,omitempty" json:"id"`
-	OrderID   string    `bson:"order_id" json:"order_id"`
-	UserID    string    `bson:"user_id" json:"user_id"`
-	Amount    float64   `bson:"amount" json:"amount"`
-	Currency  string    `bson:"currency" json:"currency"`
-	Status    string    `bson:"status" json:"status"`
-	Method    string    `bson:"method" json:"method"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ID          string      `bson:"_id,omitempty" json:"id"`
+	OrderID     string      `bson:"order_id" json:"order_id"`
+	UserID      string      `bson:"user_id" json:"user_id"`
+	Amount      float64     `bson:"amount" json:"amount"`
+	Currency    string      `bson:"currency" json:"currency"`
+	Status      string      `bson:"status" json:"status"`
+	Method      string      `bson:"method" json:"method"`
+	ProviderRef string      `bson:"provider_ref,omitempty" json:"provider_ref,omitempty"`
+	RedirectURL string      `bson:"redirect_url,omitempty" json:"redirect_url,omitempty"`
+	Settlement  *Settlement `bson:"settlement,omitempty" json:"settlement,omitempty"`
+	RefundedAt  *time.Time  `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"`
+	CreatedAt   time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time   `bson:"updated_at" json:"updated_at"`
+	// Funds recorded against a bank transfer or cash on delivery payment
+	Receipts []OfflineReceipt `bson:"receipts,omitempty" json:"receipts,omitempty"`
 }
 
 type PaymentService struct {
@@ -48,6 +56,18 @@ func main() {
 
 	db := client.Database("ecommerce")
 	paymentService = &PaymentService{db: db}
+	connectRedis()
+	verifier = newTokenVerifier()
+
+	bnpl = newBNPLProvider()
+	loadCurrencyRules()
+	loadRefundLimits()
+	registerProvider(cardProvider{})
+	registerProvider(bnpl)
+	registerProvider(offlineProvider{method: methodBankTransfer})
+	registerProvider(offlineProvider{method: methodCashOnDelivery})
+	loadAccountingConfig()
+	startAccountingPush()
 
 	router := gin.Default()
 
@@ -56,7 +76,24 @@ func main() {
 
 	router.POST("/api/v1/payments", processPayment)
 	router.GET("/api/v1/payments/:id", getPayment)
-	router.POST("/api/v1/payments/:id/refund", refundPayment)
+	router.POST("/api/v1/payments/:id/refund", scopedAuthMiddleware, requirePermission("payments:refund"), refundPayment)
+
+	// Buy-now-pay-later Routes
+	router.GET("/api/v1/payments/bnpl/eligibility", bnplEligibility)
+	router.POST("/api/v1/payments/bnpl/callback", bnplApprovalCallback)
+	router.POST("/api/v1/payments/bnpl/settlements", bnplSettlementWebhook)
+
+	// Admin Routes
+	admin := router.Group("/api/v1/admin", scopedAuthMiddleware)
+	admin.GET("/refunds", requirePermission("payments:refunds:read"), listRefunds)
+	admin.GET("/refunds/staff", requirePermission("payments:refunds:read"), getStaffRefundTotals)
+	admin.GET("/payments/awaiting", requirePermission("payments:offline"), listAwaitingPayments)
+	admin.POST("/payments/:id/receipts", requirePermission("payments:offline"), recordOfflineReceipt)
+	admin.GET("/payments/cod/remittances", requirePermission("payments:offline"), listRemittances)
+	admin.POST("/payments/cod/remittances", requirePermission("payments:offline"), uploadRemittance)
+	admin.GET("/accounting/journals/:date", requirePermission("accounting:read"), getJournals)
+	admin.POST("/accounting/journals/:date/push", requirePermission("accounting:push"), pushJournals)
+	admin.GET("/accounting/pushes", requirePermission("accounting:read"), listJournalPushes)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -103,13 +140,39 @@ func processPayment(c *gin.Context) {
 		return
 	}
 
+	// Receipts, settlement and refunds are recorded by the service, never
+	// taken from the request
+	payment.Receipts = nil
+	payment.Settlement = nil
+	payment.RefundedAt = nil
+	payment.ProviderRef = ""
+	payment.RedirectURL = ""
+
+	provider := providerFor(payment.Method)
+
+	payment.ID = primitive.NewObjectID().Hex()
+	payment.Currency = strings.ToUpper(payment.Currency)
+	payment.Amount = roundAmount(payment.Currency, payment.Amount)
 	payment.Status = "processing"
 	payment.CreatedAt = time.Now()
 	payment.UpdatedAt = time.Now()
 
-	// Simulate payment processing
-	time.Sleep(1 * time.Second)
-	payment.Status = "completed"
+	providerResult, err := provider.Authorize(c.Request.Context(), &payment)
+	if err == errNotEligible {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payment provider unavailable"})
+		return
+	}
+
+	if payment.Method == "" {
+		payment.Method = provider.Name()
+	}
+	payment.Status = providerResult.Status
+	payment.ProviderRef = providerResult.ProviderRef
+	payment.RedirectURL = providerResult.RedirectURL
 
 	collection := paymentService.db.Collection("payments")
 	result, err := collection.InsertOne(context.Background(), payment)
@@ -118,11 +181,22 @@ func processPayment(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	response := gin.H{
 		"message": "Payment processed successfully",
 		"payment_id": result.InsertedID,
-		"status": "completed",
-	})
+		"status": payment.Status,
+	}
+	if payment.RedirectURL != "" {
+		response["message"] = "Payment awaiting customer approval"
+		response["redirect_url"] = payment.RedirectURL
+	}
+	if payment.Status == statusAwaitingPayment {
+		setOrderStatus(c.Request.Context(), payment.OrderID, statusAwaitingPayment)
+		response["message"] = "Payment awaiting funds"
+		response["reference"] = payment.ProviderRef
+	}
+
+	c.JSON(http.StatusCreated, response)
 }
 
 func getPayment(c *gin.Context) {
@@ -138,21 +212,3 @@ func getPayment(c *gin.Context) {
 
 	c.JSON(http.StatusOK, payment)
 }
-
-func refundPayment(c *gin.Context) {
-	id := c.Param("id")
-	collection := paymentService.db.Collection("payments")
-
-	_, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"status": "refunded", "updated_at": time.Now()}},
-	)
-
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Payment refunded successfully"})
-}
\ No newline at end of file
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Offline payments are paid outside any processor: by bank transfer quoting
+// the payment's reference, or in cash to the carrier on delivery. They sit
+// in "awaiting_payment", as does their order, until staff record the funds
+// arriving; part payments add up until the amount is covered. Carriers remit
+// cash on delivery takings with a CSV file, which is reconciled against the
+// awaiting payments line by line.
+type OfflineReceipt struct {
+	Amount     float64   `bson:"amount" json:"amount"`
+	Reference  string    `bson:"reference,omitempty" json:"reference,omitempty"`
+	Note       string    `bson:"note,omitempty" json:"note,omitempty"`
+	ReceivedAt time.Time `bson:"received_at" json:"received_at"`
+	// Staff member who recorded it, or the remittance it came from
+	RecordedBy   string    `bson:"recorded_by,omitempty" json:"recorded_by,omitempty"`
+	RemittanceID string    `bson:"remittance_id,omitempty" json:"remittance_id,omitempty"`
+	RecordedAt   time.Time `bson:"recorded_at" json:"recorded_at"`
+}
+
+// RemittanceLine is one row of a carrier's remittance file and how it
+// reconciled.
+type RemittanceLine struct {
+	Row       int     `bson:"row" json:"row"`
+	OrderID   string  `bson:"order_id" json:"order_id"`
+	Tracking  string  `bson:"tracking,omitempty" json:"tracking,omitempty"`
+	Amount    float64 `bson:"amount" json:"amount"`
+	PaymentID string  `bson:"payment_id,omitempty" json:"payment_id,omitempty"`
+	Status    string  `bson:"status" json:"status"`
+	// What's still owed after the line, or how much it overpaid by
+	Difference float64 `bson:"difference,omitempty" json:"difference,omitempty"`
+	Error      string  `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+type Remittance struct {
+	ID         string           `bson:"_id" json:"id"`
+	Carrier    string           `bson:"carrier" json:"carrier"`
+	Reference  string           `bson:"reference" json:"reference"`
+	Currency   string           `bson:"currency" json:"currency"`
+	Lines      []RemittanceLine `bson:"lines" json:"lines"`
+	Total      float64          `bson:"total" json:"total"`
+	Matched    int              `bson:"matched" json:"matched"`
+	Exceptions int              `bson:"exceptions" json:"exceptions"`
+	UploadedBy string           `bson:"uploaded_by" json:"uploaded_by"`
+	CreatedAt  time.Time        `bson:"created_at" json:"created_at"`
+}
+
+const (
+	methodBankTransfer   = "bank_transfer"
+	methodCashOnDelivery = "cash_on_delivery"
+
+	statusAwaitingPayment = "awaiting_payment"
+)
+
+// Remittance line outcomes. Only matched lines are paid in full; the rest
+// are exceptions for finance to chase.
+const (
+	remittanceMatched     = "matched"
+	remittanceShort       = "short"
+	remittanceOverpaid    = "overpaid"
+	remittanceNotFound    = "not_found"
+	remittanceAlreadyPaid = "already_paid"
+	remittanceInvalid     = "invalid"
+)
+
+const maxRemittanceSize = 5 << 20
+
+var errPaymentNotAwaiting = errors.New("payment is not awaiting funds")
+
+// offlineProvider authorizes nothing; the payment waits for the funds to
+// be recorded.
+type offlineProvider struct {
+	method string
+}
+
+func (p offlineProvider) Name() string { return p.method }
+
+func (p offlineProvider) Authorize(ctx context.Context, payment *Payment) (*ProviderResult, error) {
+	// Customers quote this on their transfer, carriers on their remittance
+	ref := strings.ToUpper(primitive.NewObjectID().Hex()[12:])
+	return &ProviderResult{Status: statusAwaitingPayment, ProviderRef: "PAY-" + ref}, nil
+}
+
+func isOffline(method string) bool {
+	return method == methodBankTransfer || method == methodCashOnDelivery
+}
+
+var orderClient = &http.Client{Timeout: 5 * time.Second}
+
+func orderServiceURL() string {
+	if url := os.Getenv("ORDER_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://order-service:8004"
+}
+
+// setOrderStatus moves the payment's order along. A failure is logged and
+// left for staff to put right on the order; the payment stands.
+func setOrderStatus(ctx context.Context, orderID, status string) {
+	if orderID == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"status": status})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, orderServiceURL()+"/api/v1/orders/"+orderID+"/status", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to set order %s %s: %v", orderID, status, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := authorizeAsService(req); err != nil {
+		log.Printf("Failed to set order %s %s: %v", orderID, status, err)
+		return
+	}
+
+	resp, err := orderClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to set order %s %s: %v", orderID, status, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Failed to set order %s %s: order service returned %d", orderID, status, resp.StatusCode)
+	}
+}
+
+// recordReceipt adds funds received to an awaiting payment, completing it
+// and marking its order paid once they cover the amount. The payment is
+// updated only if it's unchanged since it was read, so receipts recorded
+// at once don't lose each other.
+func recordReceipt(ctx context.Context, payment *Payment, receipt OfflineReceipt) error {
+	collection := paymentService.db.Collection("payments")
+	for attempt := 0; attempt < 3; attempt++ {
+		if payment.Status != statusAwaitingPayment {
+			return errPaymentNotAwaiting
+		}
+		status := statusAwaitingPayment
+		if roundAmount(payment.Currency, payment.received()+receipt.Amount-payment.Amount) >= 0 {
+			status = "completed"
+		}
+
+		now := time.Now()
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": payment.ID, "status": statusAwaitingPayment, "updated_at": payment.UpdatedAt},
+			bson.M{
+				"$push": bson.M{"receipts": receipt},
+				"$set":  bson.M{"status": status, "updated_at": now},
+			})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 1 {
+			payment.Receipts = append(payment.Receipts, receipt)
+			payment.Status = status
+			payment.UpdatedAt = now
+			if status == "completed" {
+				setOrderStatus(ctx, payment.OrderID, "paid")
+			}
+			return nil
+		}
+
+		if err := collection.FindOne(ctx, bson.M{"_id": payment.ID}).Decode(payment); err != nil {
+			return err
+		}
+	}
+	return errors.New("payment kept changing, try again")
+}
+
+// received is how much has been recorded against an offline payment.
+func (p *Payment) received() float64 {
+	total := 0.0
+	for _, r := range p.Receipts {
+		total += r.Amount
+	}
+	return roundAmount(p.Currency, total)
+}
+
+// listAwaitingPayments answers GET /api/v1/admin/payments/awaiting, the
+// offline payments still waiting for funds, oldest first, optionally of one
+// ?method=.
+func listAwaitingPayments(c *gin.Context) {
+	filter := bson.M{"status": statusAwaitingPayment}
+	if method := c.Query("method"); method != "" {
+		filter["method"] = method
+	}
+
+	cursor, err := paymentService.db.Collection("payments").Find(c.Request.Context(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(500))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+		return
+	}
+	payments := []Payment{}
+	if err := cursor.All(c.Request.Context(), &payments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payments": payments, "count": len(payments)})
+}
+
+// recordOfflineReceipt answers POST /api/v1/admin/payments/:id/receipts,
+// where staff record funds arriving for a bank transfer or cash on
+// delivery payment.
+func recordOfflineReceipt(c *gin.Context) {
+	var req struct {
+		Amount float64 `json:"amount" binding:"required,gt=0"`
+		// The bank's transaction reference, say
+		Reference  string    `json:"reference"`
+		Note       string    `json:"note"`
+		ReceivedAt time.Time `json:"received_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var payment Payment
+	if err := paymentService.db.Collection("payments").FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&payment); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if !isOffline(payment.Method) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Receipts can only be recorded for bank transfer and cash on delivery payments"})
+		return
+	}
+
+	now := time.Now()
+	if req.ReceivedAt.IsZero() {
+		req.ReceivedAt = now
+	}
+	receipt := OfflineReceipt{
+		Amount:     roundAmount(payment.Currency, req.Amount),
+		Reference:  req.Reference,
+		Note:       req.Note,
+		ReceivedAt: req.ReceivedAt,
+		RecordedBy: c.GetString("user_id"),
+		RecordedAt: now,
+	}
+	err := recordReceipt(ctx, &payment, receipt)
+	if err == errPaymentNotAwaiting {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment is " + payment.Status + ", not awaiting funds"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record receipt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payment":     payment,
+		"received":    payment.received(),
+		"outstanding": roundAmount(payment.Currency, payment.Amount-payment.received()),
+	})
+}
+
+// uploadRemittance answers POST /api/v1/admin/payments/cod/remittances. It
+// takes a carrier's remittance file as the multipart "file", a CSV with a
+// header row and the columns order_id, amount and optionally tracking, and
+// records each line against the order's cash on delivery payment. The
+// carrier, its remittance reference and the currency come as form fields.
+// A file is reconciled once per carrier and reference; lines for orders
+// already paid are reported rather than counted again.
+func uploadRemittance(c *gin.Context) {
+	carrier := strings.TrimSpace(c.PostForm("carrier"))
+	reference := strings.TrimSpace(c.PostForm("reference"))
+	currency := strings.ToUpper(strings.TrimSpace(c.PostForm("currency")))
+	if carrier == "" || reference == "" || currency == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "carrier, reference and currency are required"})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if header.Size > maxRemittanceSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Remittance file is too large"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	lines, err := parseRemittance(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	remittance := Remittance{
+		ID:         carrier + "/" + reference,
+		Carrier:    carrier,
+		Reference:  reference,
+		Currency:   currency,
+		UploadedBy: c.GetString("user_id"),
+		CreatedAt:  time.Now(),
+	}
+	// Claimed before reconciling so the same file uploaded twice at once
+	// isn't applied twice
+	remittances := paymentService.db.Collection("cod_remittances")
+	if _, err := remittances.InsertOne(ctx, remittance); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Remittance " + reference + " from " + carrier + " was already uploaded"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record remittance"})
+		return
+	}
+
+	for i := range lines {
+		reconcileRemittanceLine(ctx, &remittance, &lines[i])
+		if lines[i].Status == remittanceMatched {
+			remittance.Matched++
+		} else {
+			remittance.Exceptions++
+		}
+		remittance.Total += lines[i].Amount
+	}
+	remittance.Lines = lines
+	remittance.Total = roundAmount(currency, remittance.Total)
+
+	_, err = remittances.UpdateOne(ctx, bson.M{"_id": remittance.ID}, bson.M{"$set": bson.M{
+		"lines":      remittance.Lines,
+		"total":      remittance.Total,
+		"matched":    remittance.Matched,
+		"exceptions": remittance.Exceptions,
+	}})
+	if err != nil {
+		log.Printf("Failed to save remittance %s: %v", remittance.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, remittance)
+}
+
+// parseRemittance reads the remittance CSV. Rows that can't be read are
+// kept as invalid lines so they show up in the report.
+func parseRemittance(r io.Reader) ([]RemittanceLine, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	head, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("remittance file is empty or not CSV")
+	}
+	columns := map[string]int{}
+	for i, name := range head {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["order_id"]; !ok {
+		return nil, errors.New("remittance file needs an order_id column")
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, errors.New("remittance file needs an amount column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var lines []RemittanceLine
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		line := RemittanceLine{Row: row, OrderID: field(record, "order_id"), Tracking: field(record, "tracking")}
+		amount, err := strconv.ParseFloat(field(record, "amount"), 64)
+		switch {
+		case line.OrderID == "":
+			line.Status, line.Error = remittanceInvalid, "order_id is missing"
+		case err != nil || amount <= 0:
+			line.Status, line.Error = remittanceInvalid, "amount is not a positive number"
+		default:
+			line.Amount = amount
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("remittance file has no lines")
+	}
+	return lines, nil
+}
+
+// reconcileRemittanceLine records one remittance line against the order's
+// cash on delivery payment and sets how it reconciled.
+func reconcileRemittanceLine(ctx context.Context, remittance *Remittance, line *RemittanceLine) {
+	if line.Status == remittanceInvalid {
+		return
+	}
+	line.Amount = roundAmount(remittance.Currency, line.Amount)
+
+	var payment Payment
+	err := paymentService.db.Collection("payments").FindOne(ctx,
+		bson.M{"order_id": line.OrderID, "method": methodCashOnDelivery},
+		options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	).Decode(&payment)
+	if err != nil {
+		line.Status = remittanceNotFound
+		if err != mongo.ErrNoDocuments {
+			line.Error = "lookup failed, record the line by hand"
+		}
+		return
+	}
+	line.PaymentID = payment.ID
+	if payment.Currency != remittance.Currency {
+		line.Status, line.Error = remittanceInvalid, "payment is in "+payment.Currency
+		return
+	}
+
+	err = recordReceipt(ctx, &payment, OfflineReceipt{
+		Amount:       line.Amount,
+		Reference:    remittance.ID + "#" + strconv.Itoa(line.Row),
+		ReceivedAt:   remittance.CreatedAt,
+		RemittanceID: remittance.ID,
+		RecordedBy:   remittance.UploadedBy,
+		RecordedAt:   time.Now(),
+	})
+	switch {
+	case err == errPaymentNotAwaiting:
+		line.Status = remittanceAlreadyPaid
+		return
+	case err != nil:
+		line.Status, line.Error = remittanceInvalid, "failed to record, record the line by hand"
+		return
+	}
+
+	diff := roundAmount(payment.Currency, payment.received()-payment.Amount)
+	switch {
+	case diff == 0:
+		line.Status = remittanceMatched
+	case diff < 0:
+		line.Status, line.Difference = remittanceShort, -diff
+	default:
+		line.Status, line.Difference = remittanceOverpaid, diff
+	}
+}
+
+// listRemittances answers GET /api/v1/admin/payments/cod/remittances,
+// newest first, optionally for one ?carrier=.
+func listRemittances(c *gin.Context) {
+	filter := bson.M{}
+	if carrier := c.Query("carrier"); carrier != "" {
+		filter["carrier"] = carrier
+	}
+
+	cursor, err := paymentService.db.Collection("cod_remittances").Find(c.Request.Context(), filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(100))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch remittances"})
+		return
+	}
+	remittances := []Remittance{}
+	if err := cursor.All(c.Request.Context(), &remittances); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode remittances"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"remittances": remittances, "count": len(remittances)})
+}
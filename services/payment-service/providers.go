@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// PaymentProvider authorizes a payment with an external processor. Providers
+// either settle synchronously or return a redirect the customer must follow
+// to approve the payment.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, payment *Payment) (*ProviderResult, error)
+}
+
+type ProviderResult struct {
+	Status      string
+	ProviderRef string
+	RedirectURL string
+}
+
+// cardProvider simulates a synchronous card processor.
+type cardProvider struct{}
+
+func (cardProvider) Name() string { return "card" }
+
+func (cardProvider) Authorize(ctx context.Context, payment *Payment) (*ProviderResult, error) {
+	// Simulate payment processing
+	time.Sleep(1 * time.Second)
+	return &ProviderResult{Status: "completed"}, nil
+}
+
+var paymentProviders = map[string]PaymentProvider{}
+
+func registerProvider(provider PaymentProvider) {
+	paymentProviders[provider.Name()] = provider
+}
+
+// providerFor picks the provider for a method. Methods without a provider
+// of their own take the card path, as every method did before providers.
+func providerFor(method string) PaymentProvider {
+	if provider, ok := paymentProviders[method]; ok {
+		return provider
+	}
+	return paymentProviders["card"]
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Refund records who refunded a payment and why, so refunds can be
+// totalled per staff member and reviewed.
+type Refund struct {
+	ID         string    `bson:"_id" json:"id"`
+	PaymentID  string    `bson:"payment_id" json:"payment_id"`
+	OrderID    string    `bson:"order_id" json:"order_id"`
+	CustomerID string    `bson:"customer_id" json:"customer_id"`
+	Amount     float64   `bson:"amount" json:"amount"`
+	Currency   string    `bson:"currency" json:"currency"`
+	StaffID    string    `bson:"staff_id" json:"staff_id"`
+	StaffRole  string    `bson:"staff_role" json:"staff_role"`
+	Reason     string    `bson:"reason" json:"reason"`
+	ReturnID   string    `bson:"return_id,omitempty" json:"return_id,omitempty"`
+	Anomalies  []string  `bson:"anomalies,omitempty" json:"anomalies,omitempty"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Refund anomalies. They don't block the refund, they flag it for review.
+const (
+	anomalySelfRefund     = "self_refund"
+	anomalyNoReturn       = "no_matching_return"
+	anomalyLimitExceeded  = "daily_limit_exceeded"
+	refundAuditCollection = "audit_events"
+)
+
+// refundableStatuses are the payments whose funds have been taken. BNPL
+// payments stay completed once the provider settles them.
+var refundableStatuses = bson.A{"completed"}
+
+func refundable(status string) bool {
+	for _, s := range refundableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// refundLimits caps what each role may refund per UTC day, per currency as
+// amounts aren't converted. Read from REFUND_DAILY_LIMITS, e.g.
+// {"support": 500, "default": 2000}; "default" covers unlisted roles. No
+// entry for a role means no limit.
+var refundLimits = map[string]float64{}
+
+func loadRefundLimits() {
+	refundLimits = map[string]float64{}
+	raw := os.Getenv("REFUND_DAILY_LIMITS")
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(raw), &refundLimits); err != nil {
+		log.Printf("Invalid REFUND_DAILY_LIMITS, refunds are not limited: %v", err)
+		refundLimits = map[string]float64{}
+	}
+}
+
+func refundLimit(role string) (float64, bool) {
+	if limit, ok := refundLimits[role]; ok {
+		return limit, true
+	}
+	limit, ok := refundLimits["default"]
+	return limit, ok
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// refundDayKey names a staff member's running refund total for currency on
+// the day of t.
+func refundDayKey(staffID, currency string, t time.Time) string {
+	return staffID + ":" + currency + ":" + startOfDay(t).Format("2006-01-02")
+}
+
+// claimRefundAllowance adds amount to the staff member's refunds today if
+// that keeps them within limit, reporting whether it did and the total
+// refunded before it. The check and the add are one update, so concurrent
+// refunds can't both squeeze under the limit.
+func claimRefundAllowance(ctx context.Context, staffID, currency string, amount, limit float64) (bool, float64, error) {
+	collection := paymentService.db.Collection("refund_totals")
+	key := refundDayKey(staffID, currency, time.Now())
+	if amount > limit {
+		// The upsert below would start the day with it regardless
+		total, err := refundTotal(ctx, key)
+		return false, total, err
+	}
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": key, "total": bson.M{"$lte": limit - amount}},
+		bson.M{
+			"$inc":         bson.M{"total": amount},
+			"$setOnInsert": bson.M{"staff_id": staffID, "currency": currency, "day": startOfDay(time.Now())},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err == nil {
+		return true, 0, nil
+	}
+	// The day's total is already too high, so the upsert collided with it
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, 0, err
+	}
+	total, err := refundTotal(ctx, key)
+	return false, total, err
+}
+
+// refundTotal is the running total under key, zero before the first refund
+// of the day.
+func refundTotal(ctx context.Context, key string) (float64, error) {
+	var day struct {
+		Total float64 `bson:"total"`
+	}
+	err := paymentService.db.Collection("refund_totals").FindOne(ctx, bson.M{"_id": key}).Decode(&day)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return day.Total, err
+}
+
+// returnRefundAllowance gives back an allowance claimed for a refund that
+// didn't go through.
+func returnRefundAllowance(ctx context.Context, staffID, currency string, amount float64) {
+	_, err := paymentService.db.Collection("refund_totals").UpdateOne(ctx,
+		bson.M{"_id": refundDayKey(staffID, currency, time.Now())},
+		bson.M{"$inc": bson.M{"total": -amount}})
+	if err != nil {
+		log.Printf("Failed to return refund allowance of %.2f %s to %s: %v", amount, currency, staffID, err)
+	}
+}
+
+// returnMatches reports whether the return exists and is for the payment's
+// order. Returns naming a payment must name this one.
+func returnMatches(ctx context.Context, returnID string, payment *Payment) (bool, error) {
+	var ret struct {
+		OrderID   string `bson:"order_id"`
+		PaymentID string `bson:"payment_id"`
+	}
+	err := paymentService.db.Collection("returns").FindOne(ctx, bson.M{"_id": returnID}).Decode(&ret)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ret.OrderID != payment.OrderID {
+		return false, nil
+	}
+	return ret.PaymentID == "" || ret.PaymentID == payment.ID, nil
+}
+
+// recordRefundAudit writes to the audit trail the auth service keeps, so
+// refund activity shows up next to the staff member's other actions.
+func recordRefundAudit(c *gin.Context, eventType string, refund *Refund) {
+	event := bson.M{
+		"type":       eventType,
+		"user_id":    refund.CustomerID,
+		"actor_id":   refund.StaffID,
+		"ip":         c.ClientIP(),
+		"user_agent": c.Request.UserAgent(),
+		"data": bson.M{
+			"payment_id": refund.PaymentID,
+			"order_id":   refund.OrderID,
+			"amount":     refund.Amount,
+			"currency":   refund.Currency,
+			"reason":     refund.Reason,
+			"return_id":  refund.ReturnID,
+			"anomalies":  refund.Anomalies,
+		},
+		"created_at": time.Now(),
+	}
+	if impersonator := c.GetString("impersonated_by"); impersonator != "" {
+		event["impersonated_by"] = impersonator
+	}
+	if _, err := paymentService.db.Collection(refundAuditCollection).InsertOne(context.Background(), event); err != nil {
+		log.Printf("Failed to record audit event %s for payment %s: %v", eventType, refund.PaymentID, err)
+	}
+}
+
+// alertRefundAnomaly flags a refund for review in the audit trail and the
+// logs.
+func alertRefundAnomaly(c *gin.Context, refund *Refund) {
+	log.Printf("Refund anomaly %v: %s refunded %.2f %s on payment %s", refund.Anomalies, refund.StaffID, refund.Amount, refund.Currency, refund.PaymentID)
+	recordRefundAudit(c, "refund.anomaly", refund)
+}
+
+func refundPayment(c *gin.Context) {
+	id := c.Param("id")
+	var req struct {
+		Reason   string `json:"reason" binding:"required"`
+		ReturnID string `json:"return_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := paymentService.db.Collection("payments")
+
+	var payment Payment
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&payment); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if payment.Status == "refunded" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment already refunded"})
+		return
+	}
+	if !refundable(payment.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment can't be refunded while " + payment.Status})
+		return
+	}
+
+	staffID := c.GetString("user_id")
+	refund := Refund{
+		ID:         primitive.NewObjectID().Hex(),
+		PaymentID:  id,
+		OrderID:    payment.OrderID,
+		CustomerID: payment.UserID,
+		Amount:     payment.Amount,
+		Currency:   payment.Currency,
+		StaffID:    staffID,
+		StaffRole:  c.GetString("role"),
+		Reason:     req.Reason,
+		ReturnID:   req.ReturnID,
+		CreatedAt:  time.Now(),
+	}
+	if payment.UserID == staffID {
+		refund.Anomalies = append(refund.Anomalies, anomalySelfRefund)
+	}
+	matched := false
+	if req.ReturnID != "" {
+		var err error
+		if matched, err = returnMatches(ctx, req.ReturnID, &payment); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check return"})
+			return
+		}
+	}
+	if !matched {
+		refund.Anomalies = append(refund.Anomalies, anomalyNoReturn)
+	}
+
+	limit, limited := refundLimit(refund.StaffRole)
+	if limited {
+		ok, total, err := claimRefundAllowance(ctx, staffID, refund.Currency, refund.Amount, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check refund limit"})
+			return
+		}
+		if !ok {
+			refund.Anomalies = append(refund.Anomalies, anomalyLimitExceeded)
+			alertRefundAnomaly(c, &refund)
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":     "Refund exceeds your daily limit",
+				"code":      "refund_limit_exceeded",
+				"limit":     limit,
+				"refunded":  total,
+				"remaining": roundAmount(refund.Currency, limit-total),
+			})
+			return
+		}
+	}
+
+	// Only one refund can win a payment
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": refundableStatuses}},
+		bson.M{"$set": bson.M{"status": "refunded", "refunded_at": time.Now(), "updated_at": time.Now()}},
+	)
+	if err != nil || result.ModifiedCount == 0 {
+		if limited {
+			returnRefundAllowance(context.Background(), staffID, refund.Currency, refund.Amount)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment already refunded"})
+		return
+	}
+
+	if _, err := paymentService.db.Collection("refunds").InsertOne(context.Background(), refund); err != nil {
+		log.Printf("Failed to record refund of payment %s by %s: %v", id, staffID, err)
+	}
+	recordRefundAudit(c, "payment.refunded", &refund)
+	if len(refund.Anomalies) > 0 {
+		alertRefundAnomaly(c, &refund)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Payment refunded successfully", "refund": refund})
+}
+
+// listRefunds lists refunds for review, filtered by staff_id, anomalous=true
+// and a from/to date range.
+func listRefunds(c *gin.Context) {
+	filter := bson.M{}
+	if staffID := c.Query("staff_id"); staffID != "" {
+		filter["staff_id"] = staffID
+	}
+	if c.Query("anomalous") == "true" {
+		filter["anomalies.0"] = bson.M{"$exists": true}
+	}
+	created := bson.M{}
+	if from, err := time.Parse("2006-01-02", c.Query("from")); err == nil {
+		created["$gte"] = from
+	}
+	if to, err := time.Parse("2006-01-02", c.Query("to")); err == nil {
+		created["$lt"] = to.AddDate(0, 0, 1)
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(200)
+	cursor, err := paymentService.db.Collection("refunds").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refunds"})
+		return
+	}
+	refunds := []Refund{}
+	if err := cursor.All(context.Background(), &refunds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode refunds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"refunds": refunds, "count": len(refunds)})
+}
+
+// getStaffRefundTotals reports each staff member's refunds for a day
+// (?date=2006-01-02, default today) against their limit.
+func getStaffRefundTotals(c *gin.Context) {
+	day := startOfDay(time.Now())
+	if date, err := time.Parse("2006-01-02", c.Query("date")); err == nil {
+		day = date
+	}
+
+	cursor, err := paymentService.db.Collection("refunds").Aggregate(context.Background(), []bson.M{
+		{"$match": bson.M{"created_at": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}},
+		{"$group": bson.M{
+			"_id":       bson.M{"staff_id": "$staff_id", "currency": "$currency"},
+			"role":      bson.M{"$last": "$staff_role"},
+			"total":     bson.M{"$sum": "$amount"},
+			"count":     bson.M{"$sum": 1},
+			"anomalous": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{bson.M{"$size": bson.M{"$ifNull": []interface{}{"$anomalies", []string{}}}}, 0}}, 1, 0}}},
+		}},
+		{"$sort": bson.M{"total": -1}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total refunds"})
+		return
+	}
+	var rows []struct {
+		Key struct {
+			StaffID  string `bson:"staff_id"`
+			Currency string `bson:"currency"`
+		} `bson:"_id"`
+		Role      string  `bson:"role"`
+		Total     float64 `bson:"total"`
+		Count     int     `bson:"count"`
+		Anomalous int     `bson:"anomalous"`
+	}
+	if err := cursor.All(context.Background(), &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode refund totals"})
+		return
+	}
+
+	staff := []gin.H{}
+	for _, row := range rows {
+		entry := gin.H{
+			"staff_id":  row.Key.StaffID,
+			"role":      row.Role,
+			"currency":  row.Key.Currency,
+			"total":     roundAmount(row.Key.Currency, row.Total),
+			"count":     row.Count,
+			"anomalous": row.Anomalous,
+		}
+		if limit, ok := refundLimit(row.Role); ok {
+			entry["limit"] = limit
+		}
+		staff = append(staff, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"date": day.Format("2006-01-02"), "staff": staff})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefundLimit(t *testing.T) {
+	t.Setenv("REFUND_DAILY_LIMITS", `{"support": 500, "default": 2000}`)
+	loadRefundLimits()
+	defer func() { refundLimits = map[string]float64{} }()
+
+	if limit, ok := refundLimit("support"); !ok || limit != 500 {
+		t.Errorf("support limit = %v, %v, want 500", limit, ok)
+	}
+	if limit, ok := refundLimit("finance"); !ok || limit != 2000 {
+		t.Errorf("unlisted role limit = %v, %v, want the default 2000", limit, ok)
+	}
+
+	t.Setenv("REFUND_DAILY_LIMITS", `{"support": 500}`)
+	loadRefundLimits()
+	if _, ok := refundLimit("finance"); ok {
+		t.Error("an unlisted role is limited with no default")
+	}
+
+	t.Setenv("REFUND_DAILY_LIMITS", `not json`)
+	loadRefundLimits()
+	if _, ok := refundLimit("support"); ok {
+		t.Error("invalid limits still limit refunds")
+	}
+}
+
+func TestRefundDayKey(t *testing.T) {
+	late := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	early := time.Date(2026, 3, 2, 0, 1, 0, 0, time.UTC)
+	// 01:00 in UTC+2 is still the 1st in UTC
+	offset := time.Date(2026, 3, 2, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+
+	if refundDayKey("s1", "EUR", late) == refundDayKey("s1", "EUR", early) {
+		t.Error("refunds either side of midnight UTC share a total")
+	}
+	if refundDayKey("s1", "EUR", late) != refundDayKey("s1", "EUR", offset) {
+		t.Error("days aren't counted in UTC")
+	}
+	if refundDayKey("s1", "EUR", late) == refundDayKey("s1", "USD", late) {
+		t.Error("currencies share a total")
+	}
+	if refundDayKey("s1", "EUR", late) == refundDayKey("s2", "EUR", late) {
+		t.Error("staff share a total")
+	}
+}
+
+func TestRefundable(t *testing.T) {
+	for status, want := range map[string]bool{
+		"completed":        true,
+		"processing":       false,
+		"pending_approval": false,
+		"awaiting_payment": false,
+		"refunded":         false,
+	} {
+		if got := refundable(status); got != want {
+			t.Errorf("refundable(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
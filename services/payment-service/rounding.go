@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// CurrencyRule controls how amounts in a currency are rounded. CashIncrement
+// is the smallest coin in circulation and only applies to cash payments.
+type CurrencyRule struct {
+	Decimals      int     `json:"decimals"`
+	CashIncrement float64 `json:"cash_increment"`
+}
+
+var currencyRules = map[string]CurrencyRule{
+	"JPY": {Decimals: 0},
+	"KRW": {Decimals: 0},
+	"VND": {Decimals: 0},
+	"CLP": {Decimals: 0},
+	"ISK": {Decimals: 0},
+	"CHF": {Decimals: 2, CashIncrement: 0.05},
+}
+
+// loadCurrencyRules merges CURRENCY_ROUNDING over the built-in rules. It
+// takes the same format as the order service so both agree on totals.
+func loadCurrencyRules() {
+	raw := os.Getenv("CURRENCY_ROUNDING")
+	if raw == "" {
+		return
+	}
+
+	var overrides map[string]CurrencyRule
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Invalid CURRENCY_ROUNDING, using defaults: %v", err)
+		return
+	}
+	for currency, rule := range overrides {
+		currencyRules[strings.ToUpper(currency)] = rule
+	}
+}
+
+func currencyRule(currency string) CurrencyRule {
+	if rule, ok := currencyRules[strings.ToUpper(currency)]; ok {
+		return rule
+	}
+	return CurrencyRule{Decimals: 2}
+}
+
+// roundAmount rounds half away from zero to the currency's minor unit.
+func roundAmount(currency string, v float64) float64 {
+	scale := math.Pow10(currencyRule(currency).Decimals)
+	return math.Round(v*scale) / scale
+}
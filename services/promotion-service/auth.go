@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// tokenVerifier validates access tokens issued by the user-auth-service.
+// When AUTH_JWKS_URL is set, public keys are fetched from the auth service's
+// JWKS endpoint and refreshed on unknown kids; otherwise the shared
+// JWT_SECRET is used (HS256).
+type tokenVerifier struct {
+	secret    []byte
+	jwksURL   string
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+var verifier *tokenVerifier
+
+func newTokenVerifier() *tokenVerifier {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		secret = "your-secret-key-change-in-production"
+	}
+
+	return &tokenVerifier{
+		secret:  []byte(secret),
+		jwksURL: os.Getenv("AUTH_JWKS_URL"),
+		keys:    map[string]interface{}{},
+	}
+}
+
+func (v *tokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	if v.jwksURL == "" {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return v.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.key(kid); ok {
+		return key, nil
+	}
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	if key, ok := v.key(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (v *tokenVerifier) key(kid string) (interface{}, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// refresh reloads the JWKS, at most once a minute so that tokens with bogus
+// kids can't be used to hammer the auth service.
+func (v *tokenVerifier) refresh() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if time.Since(v.fetchedAt) < time.Minute {
+		return nil
+	}
+	v.fetchedAt = time.Now()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := decodeBigInt(k.N)
+			e, errE := decodeBigInt(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			x, errX := decodeBigInt(k.X)
+			y, errY := decodeBigInt(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	v.keys = keys
+
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// authMiddleware requires a valid access token on routes acting as the
+// caller. Scoped tokens need the account scope to get through, so a token
+// scoped to, say, orders:read can't be used as its holder everywhere else.
+func authMiddleware(c *gin.Context) {
+	authenticate(c, true)
+}
+
+// scopedAuthMiddleware is authMiddleware for routes guarded by
+// requirePermission, which checks a scoped token's scopes itself.
+func scopedAuthMiddleware(c *gin.Context) {
+	authenticate(c, false)
+}
+
+func authenticate(c *gin.Context, asAccount bool) {
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization header"})
+		c.Abort()
+		return
+	}
+
+	token, err := jwt.Parse(strings.TrimPrefix(authHeader, "Bearer "), verifier.keyFunc)
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	// Tokens addressed to other services only can't be used here, nor can
+	// refresh tokens
+	if !audienceAllowed(claims) || refreshToken(claims) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	if revoked(c.Request.Context(), claims) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+		c.Abort()
+		return
+	}
+
+	if asAccount && !accountScoped(claims) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", claims["sub"])
+	c.Set("email", claims["email"])
+	c.Set("role", claims["role"])
+	c.Set("permissions", claims["permissions"])
+
+	// Support staff acting as a customer; keep a trail of what they did
+	if impersonator, ok := claims["impersonated_by"].(string); ok {
+		c.Set("impersonated_by", impersonator)
+		c.Next()
+		auditImpersonatedRequest(c)
+		return
+	}
+	c.Next()
+}
+
+// accountScope lets a scoped token act as its holder on routes without a
+// permission of their own. Unscoped tokens always can.
+const accountScope = "account"
+
+func accountScoped(claims jwt.MapClaims) bool {
+	scope, ok := claims["scope"].(string)
+	if !ok {
+		return true
+	}
+	for _, s := range strings.Fields(scope) {
+		if s == accountScope {
+			return true
+		}
+	}
+	return false
+}
+
+// auditImpersonatedRequest records a request made with an impersonation
+// token in audit_events, next to the auth service's record of the
+// impersonation itself, so support activity can be reviewed in one place.
+func auditImpersonatedRequest(c *gin.Context) {
+	_, err := promotionService.db.Collection("audit_events").InsertOne(context.Background(), bson.M{
+		"type":            "impersonation.request",
+		"user_id":         c.GetString("user_id"),
+		"actor_id":        c.GetString("user_id"),
+		"ip":              c.ClientIP(),
+		"user_agent":      c.Request.UserAgent(),
+		"impersonated_by": c.GetString("impersonated_by"),
+		"data": bson.M{
+			"service": "promotion-service",
+			"method":  c.Request.Method,
+			"path":    c.FullPath(),
+			"status":  c.Writer.Status(),
+		},
+		"created_at": time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record impersonated request by %s: %v", c.GetString("impersonated_by"), err)
+	}
+}
+
+// audienceAllowed accepts tokens without an aud claim, and tokens addressed
+// to this service, named by TOKEN_AUDIENCE (default "promotion-service").
+func audienceAllowed(claims jwt.MapClaims) bool {
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return false
+	}
+	if len(aud) == 0 {
+		return true
+	}
+	self := os.Getenv("TOKEN_AUDIENCE")
+	if self == "" {
+		self = "promotion-service"
+	}
+	for _, a := range aud {
+		if a == self {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshToken reports whether the token is a refresh token, which only
+// the auth service takes.
+func refreshToken(claims jwt.MapClaims) bool {
+	typ, _ := claims["typ"].(string)
+	return typ == "refresh"
+}
+
+// revoked reports whether the auth service has revoked the token, e.g. on
+// logout. It keeps revoked token IDs in the Redis the services share, under
+// revoked_token:<jti>, until the tokens would have expired anyway.
+func revoked(ctx context.Context, claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return false
+	}
+	n, err := redisClient.Exists(ctx, "revoked_token:"+jti).Result()
+	return err == nil && n > 0
+}
+
+// hasPermission checks the permissions the auth service embedded in the
+// token. "*" grants everything and "promotions:*" everything on promotions.
+func hasPermission(c *gin.Context, permission string) bool {
+	perms, _ := c.Get("permissions")
+	list, _ := perms.([]interface{})
+	for _, p := range list {
+		granted, _ := p.(string)
+		if granted == "*" || granted == permission {
+			return true
+		}
+		if strings.HasSuffix(granted, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(granted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission only lets requests through whose token grants
+// permission. It must run after scopedAuthMiddleware.
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
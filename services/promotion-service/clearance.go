@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ClearanceCandidate is a dead-stock SKU reported by the inventory service.
+// Merchandisers review the list and decide whether to run a clearance
+// campaign; nothing here discounts stock on its own.
+type ClearanceCandidate struct {
+	ID            string    `bson:"_id" json:"id"`
+	ProductID     string    `bson:"product_id" json:"product_id"`
+	Warehouse     string    `bson:"warehouse" json:"warehouse"`
+	Quantity      int       `bson:"quantity" json:"quantity"`
+	DaysOnHand    int       `bson:"days_on_hand" json:"days_on_hand"`
+	DaysSinceSale *int      `bson:"days_since_sale,omitempty" json:"days_since_sale,omitempty"`
+	Reason        string    `bson:"reason" json:"reason"`
+	Status        string    `bson:"status" json:"status"`
+	ReportedAt    time.Time `bson:"reported_at" json:"reported_at"`
+	UpdatedAt     time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type clearanceCandidatesRequest struct {
+	Reason string `json:"reason"`
+	Items  []struct {
+		ProductID     string `json:"product_id" binding:"required"`
+		Warehouse     string `json:"warehouse" binding:"required"`
+		Quantity      int    `json:"quantity"`
+		DaysOnHand    int    `json:"days_on_hand"`
+		DaysSinceSale *int   `json:"days_since_sale"`
+	} `json:"items" binding:"required,dive"`
+}
+
+const candidateOpen = "open"
+
+// receiveClearanceCandidates upserts one candidate per product and
+// warehouse, so repeated reports refresh the figures without reopening a
+// candidate that has already been dealt with.
+func receiveClearanceCandidates(c *gin.Context) {
+	var req clearanceCandidatesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := promotionService.db.Collection("clearance_candidates")
+	now := time.Now()
+	for _, item := range req.Items {
+		_, err := collection.UpdateOne(context.Background(),
+			bson.M{"_id": item.ProductID + ":" + item.Warehouse},
+			bson.M{
+				"$set": bson.M{
+					"product_id":      item.ProductID,
+					"warehouse":       item.Warehouse,
+					"quantity":        item.Quantity,
+					"days_on_hand":    item.DaysOnHand,
+					"days_since_sale": item.DaysSinceSale,
+					"reason":          req.Reason,
+					"updated_at":      now,
+				},
+				"$setOnInsert": bson.M{
+					"status":      candidateOpen,
+					"reported_at": now,
+				},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store clearance candidates"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Clearance candidates received",
+		"count":   len(req.Items),
+	})
+}
+
+func listClearanceCandidates(c *gin.Context) {
+	filter := bson.M{"status": c.DefaultQuery("status", candidateOpen)}
+
+	opts := options.Find().SetSort(bson.D{{Key: "days_on_hand", Value: -1}})
+	cursor, err := promotionService.db.Collection("clearance_candidates").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load clearance candidates"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	candidates := []ClearanceCandidate{}
+	if err := cursor.All(context.Background(), &candidates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode clearance candidates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"items": candidates,
+		"count": len(candidates),
+	})
+}
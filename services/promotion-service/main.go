@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type PromotionService struct {
+	db *mongo.Database
+}
+
+var promotionService *PromotionService
+
+func main() {
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database("ecommerce")
+	promotionService = &PromotionService{db: db}
+
+	connectRedis()
+	verifier = newTokenVerifier()
+	createIndexes(db)
+	go runPoolExpiry()
+	go runPoolGeneration()
+
+	router := gin.Default()
+
+	router.GET("/health", healthCheck)
+	router.GET("/ready", readinessCheck)
+
+	// Code Pool Routes
+	router.POST("/api/v1/promotions/pools", scopedAuthMiddleware, requirePermission("promotions:manage"), createPool)
+	router.GET("/api/v1/promotions/pools/:id", scopedAuthMiddleware, requirePermission("promotions:manage"), getPool)
+	router.GET("/api/v1/promotions/pools/:id/export", scopedAuthMiddleware, requirePermission("promotions:manage"), exportPool)
+	router.POST("/api/v1/promotions/pools/:id/invalidate", scopedAuthMiddleware, requirePermission("promotions:manage"), invalidatePool)
+
+	// Code Routes, validate and redeem are called by the order service
+	router.GET("/api/v1/promotions/codes/:code", scopedAuthMiddleware, requirePermission("promotions:manage"), getCode)
+	router.POST("/api/v1/promotions/codes/validate", scopedAuthMiddleware, requirePermission("promotions:redeem"), validateCode)
+	router.POST("/api/v1/promotions/codes/redeem", scopedAuthMiddleware, requirePermission("promotions:redeem"), redeemCode)
+
+	// Clearance Routes
+	router.POST("/api/v1/promotions/clearance-candidates", scopedAuthMiddleware, requirePermission("promotions:manage"), receiveClearanceCandidates)
+	router.GET("/api/v1/promotions/clearance-candidates", scopedAuthMiddleware, requirePermission("promotions:manage"), listClearanceCandidates)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8007"
+	}
+
+	log.Printf("Promotion Service starting on port %s", port)
+	if err := router.Run(":" + port); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+func createIndexes(db *mongo.Database) {
+	_, err := db.Collection("promo_codes").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "pool_id", Value: 1}, {Key: "status", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
+
+func healthCheck(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "healthy",
+		"service":   "promotion-service",
+		"timestamp": time.Now(),
+	})
+}
+
+func readinessCheck(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := promotionService.db.Client().Ping(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not ready",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ready",
+		"service": "promotion-service",
+	})
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Discount is what a code is worth: a percentage off or a fixed amount.
+type Discount struct {
+	Type     string  `bson:"type" json:"type" binding:"required,oneof=percent fixed"`
+	Value    float64 `bson:"value" json:"value" binding:"required,gt=0"`
+	MinOrder float64 `bson:"min_order" json:"min_order"`
+}
+
+// CodePool is a batch of unique single-use codes, e.g. for a print
+// campaign. Each code can be redeemed once; the pool is invalidated as a
+// whole when it expires, reaches MaxRedemptions, or is voided by hand.
+// Codes are generated in the background and can't be redeemed until the
+// pool has all of them and turns active.
+type CodePool struct {
+	ID             string     `bson:"_id" json:"id"`
+	Name           string     `bson:"name" json:"name"`
+	Prefix         string     `bson:"prefix" json:"prefix"`
+	Discount       Discount   `bson:"discount" json:"discount"`
+	Size           int        `bson:"size" json:"size"`
+	MaxRedemptions int        `bson:"max_redemptions,omitempty" json:"max_redemptions,omitempty"`
+	Redeemed       int        `bson:"redeemed" json:"redeemed"`
+	Status         string     `bson:"status" json:"status"`
+	ExpiresAt      time.Time  `bson:"expires_at" json:"expires_at"`
+	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
+	InvalidatedAt  *time.Time `bson:"invalidated_at,omitempty" json:"invalidated_at,omitempty"`
+	// Codes generated so far, and the replica generating them until when
+	Generated       int        `bson:"generated" json:"generated"`
+	GenerationLease *time.Time `bson:"generation_lease,omitempty" json:"-"`
+}
+
+// PromoCode is one code from a pool, keyed by the code itself.
+type PromoCode struct {
+	Code       string     `bson:"_id" json:"code"`
+	PoolID     string     `bson:"pool_id" json:"pool_id"`
+	Status     string     `bson:"status" json:"status"`
+	RedeemedBy string     `bson:"redeemed_by,omitempty" json:"redeemed_by,omitempty"`
+	OrderID    string     `bson:"order_id,omitempty" json:"order_id,omitempty"`
+	RedeemedAt *time.Time `bson:"redeemed_at,omitempty" json:"redeemed_at,omitempty"`
+}
+
+const (
+	maxPoolSize     = 500000
+	codeLength      = 10
+	insertBatch     = 1000
+	generationLease = time.Minute
+	codeAlphabet    = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I for print
+	poolGenerating  = "generating"
+	poolActive      = "active"
+	poolInvalid     = "invalidated"
+	codeUnused      = "unused"
+	codeRedeemed    = "redeemed"
+	codeVoid        = "void"
+)
+
+func generateCode(prefix string) string {
+	b := make([]byte, codeLength)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		b[i] = codeAlphabet[n.Int64()]
+	}
+	return prefix + string(b)
+}
+
+// createPool records the pool and leaves generating its codes to
+// runPoolGeneration, so a large pool doesn't hold the request open. Poll
+// the pool until its status is active.
+func createPool(c *gin.Context) {
+	var req struct {
+		Name           string    `json:"name" binding:"required"`
+		Prefix         string    `json:"prefix" binding:"omitempty,alphanum,max=8"`
+		Discount       Discount  `json:"discount" binding:"required"`
+		Size           int       `json:"size" binding:"required,min=1"`
+		MaxRedemptions int       `json:"max_redemptions" binding:"min=0"`
+		ExpiresAt      time.Time `json:"expires_at" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size > maxPoolSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size may not exceed " + strconv.Itoa(maxPoolSize)})
+		return
+	}
+	if !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	pool := CodePool{
+		ID:             primitive.NewObjectID().Hex(),
+		Name:           req.Name,
+		Prefix:         strings.ToUpper(req.Prefix),
+		Discount:       req.Discount,
+		Size:           req.Size,
+		MaxRedemptions: req.MaxRedemptions,
+		Status:         poolGenerating,
+		ExpiresAt:      req.ExpiresAt,
+		CreatedAt:      time.Now(),
+	}
+
+	if _, err := promotionService.db.Collection("promo_pools").InsertOne(context.Background(), pool); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pool"})
+		return
+	}
+
+	select {
+	case poolCreated <- struct{}{}:
+	default:
+	}
+
+	c.JSON(http.StatusAccepted, pool)
+}
+
+// poolCreated wakes runPoolGeneration so new pools don't wait for the tick.
+var poolCreated = make(chan struct{}, 1)
+
+// runPoolGeneration generates the codes of pools in the generating state.
+// Each pool is leased to one replica at a time; a lease left behind by a
+// replica that died runs out and the pool is picked up again where it
+// stopped.
+func runPoolGeneration() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for {
+			now := time.Now()
+			var pool CodePool
+			err := promotionService.db.Collection("promo_pools").FindOneAndUpdate(context.Background(),
+				bson.M{"status": poolGenerating, "$or": bson.A{
+					bson.M{"generation_lease": bson.M{"$exists": false}},
+					bson.M{"generation_lease": bson.M{"$lt": now}},
+				}},
+				bson.M{"$set": bson.M{"generation_lease": now.Add(generationLease)}},
+			).Decode(&pool)
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					log.Printf("Failed to claim pool for generation: %v", err)
+				}
+				break
+			}
+			if err := generatePoolCodes(context.Background(), &pool); err != nil {
+				log.Printf("Failed to generate codes for pool %s: %v", pool.ID, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-poolCreated:
+		}
+	}
+}
+
+// generatePoolCodes inserts the codes a claimed pool is still missing in
+// batches, then activates it. Collisions with codes from other pools are
+// rejected by the unique _id and simply regenerated. It stops early if the
+// pool is invalidated meanwhile.
+func generatePoolCodes(ctx context.Context, pool *CodePool) error {
+	pools := promotionService.db.Collection("promo_pools")
+	codes := promotionService.db.Collection("promo_codes")
+
+	existing, err := codes.CountDocuments(ctx, bson.M{"pool_id": pool.ID})
+	if err != nil {
+		return err
+	}
+	generated := int(existing)
+
+	for generated < pool.Size {
+		batch := make([]interface{}, 0, min(pool.Size-generated, insertBatch))
+		for len(batch) < cap(batch) {
+			batch = append(batch, PromoCode{Code: generateCode(pool.Prefix), PoolID: pool.ID, Status: codeUnused})
+		}
+
+		_, err := codes.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		inserted := len(batch)
+		if err != nil {
+			var bulkErr mongo.BulkWriteException
+			if !errors.As(err, &bulkErr) || !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+			inserted -= len(bulkErr.WriteErrors)
+		}
+		generated += inserted
+
+		result, err := pools.UpdateOne(ctx,
+			bson.M{"_id": pool.ID, "status": poolGenerating},
+			bson.M{"$set": bson.M{"generated": generated, "generation_lease": time.Now().Add(generationLease)}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return nil
+		}
+	}
+
+	_, err = pools.UpdateOne(ctx,
+		bson.M{"_id": pool.ID, "status": poolGenerating},
+		bson.M{
+			"$set":   bson.M{"status": poolActive, "generated": generated},
+			"$unset": bson.M{"generation_lease": ""},
+		},
+	)
+	return err
+}
+
+func getPool(c *gin.Context) {
+	var pool CodePool
+	err := promotionService.db.Collection("promo_pools").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&pool)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pool not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pool)
+}
+
+// exportPool streams the pool's codes as CSV for the print vendor, with
+// their redemption state. ?status=unused limits it to unused codes.
+func exportPool(c *gin.Context) {
+	poolID := c.Param("id")
+	filter := bson.M{"pool_id": poolID}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := promotionService.db.Collection("promo_codes").Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export codes"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=pool-"+poolID+".csv")
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"code", "status", "redeemed_by", "order_id", "redeemed_at"})
+	for cursor.Next(context.Background()) {
+		var code PromoCode
+		if err := cursor.Decode(&code); err != nil {
+			continue
+		}
+		redeemedAt := ""
+		if code.RedeemedAt != nil {
+			redeemedAt = code.RedeemedAt.Format(time.RFC3339)
+		}
+		w.Write([]string{code.Code, code.Status, code.RedeemedBy, code.OrderID, redeemedAt})
+	}
+	w.Flush()
+}
+
+func invalidatePool(c *gin.Context) {
+	if err := voidPool(context.Background(), c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pool not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Pool invalidated"})
+}
+
+// voidPool invalidates a pool and all of its unused codes. Redeemed codes
+// keep their history.
+func voidPool(ctx context.Context, poolID string) error {
+	result, err := promotionService.db.Collection("promo_pools").UpdateOne(ctx,
+		bson.M{"_id": poolID},
+		bson.M{"$set": bson.M{"status": poolInvalid, "invalidated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	_, err = promotionService.db.Collection("promo_codes").UpdateMany(ctx,
+		bson.M{"pool_id": poolID, "status": codeUnused},
+		bson.M{"$set": bson.M{"status": codeVoid}},
+	)
+	return err
+}
+
+// runPoolExpiry invalidates pools once they pass their expiry date.
+func runPoolExpiry() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		cursor, err := promotionService.db.Collection("promo_pools").Find(ctx,
+			bson.M{"status": poolActive, "expires_at": bson.M{"$lte": time.Now()}})
+		if err != nil {
+			cancel()
+			log.Printf("Failed to load expired pools: %v", err)
+			continue
+		}
+
+		var pools []CodePool
+		if err := cursor.All(ctx, &pools); err != nil {
+			log.Printf("Failed to decode expired pools: %v", err)
+		}
+		for _, pool := range pools {
+			if err := voidPool(ctx, pool.ID); err != nil {
+				log.Printf("Failed to invalidate pool %s: %v", pool.ID, err)
+			}
+		}
+		cancel()
+	}
+}
+
+var errCodeInvalid = errors.New("code is not valid")
+
+// lookupCode returns the code and its pool if it can still be redeemed.
+func lookupCode(ctx context.Context, raw string) (*PromoCode, *CodePool, error) {
+	var code PromoCode
+	err := promotionService.db.Collection("promo_codes").FindOne(ctx, bson.M{"_id": strings.ToUpper(strings.TrimSpace(raw))}).Decode(&code)
+	if err != nil || code.Status != codeUnused {
+		return nil, nil, errCodeInvalid
+	}
+
+	var pool CodePool
+	err = promotionService.db.Collection("promo_pools").FindOne(ctx, bson.M{"_id": code.PoolID}).Decode(&pool)
+	if err != nil || pool.Status != poolActive || time.Now().After(pool.ExpiresAt) {
+		return nil, nil, errCodeInvalid
+	}
+
+	return &code, &pool, nil
+}
+
+func (d Discount) amount(orderTotal float64) float64 {
+	if orderTotal < d.MinOrder {
+		return 0
+	}
+	amount := d.Value
+	if d.Type == "percent" {
+		amount = orderTotal * d.Value / 100
+	}
+	return math.Round(math.Min(amount, orderTotal)*100) / 100
+}
+
+func getCode(c *gin.Context) {
+	var code PromoCode
+	err := promotionService.db.Collection("promo_codes").FindOne(context.Background(), bson.M{"_id": strings.ToUpper(c.Param("code"))}).Decode(&code)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Code not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, code)
+}
+
+// validateCode prices a code against an order total without using it up.
+func validateCode(c *gin.Context) {
+	var req struct {
+		Code       string  `json:"code" binding:"required"`
+		OrderTotal float64 `json:"order_total" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, pool, err := lookupCode(context.Background(), req.Code)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"valid": false})
+		return
+	}
+	if req.OrderTotal < pool.Discount.MinOrder {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "reason": "minimum order not met", "min_order": pool.Discount.MinOrder})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"valid":    true,
+		"discount": pool.Discount.amount(req.OrderTotal),
+		"pool_id":  pool.ID,
+	})
+}
+
+// redeemCode uses a code up for an order. The pool's redemption count is
+// only raised while it is under MaxRedemptions, and the code only changes
+// while unused, so neither a code nor the pool can be overspent by
+// concurrent redemptions.
+func redeemCode(c *gin.Context) {
+	var req struct {
+		Code       string  `json:"code" binding:"required"`
+		UserID     string  `json:"user_id" binding:"required"`
+		OrderID    string  `json:"order_id" binding:"required"`
+		OrderTotal float64 `json:"order_total" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	code, pool, err := lookupCode(ctx, req.Code)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Code is invalid or already used"})
+		return
+	}
+	if req.OrderTotal < pool.Discount.MinOrder {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Minimum order not met"})
+		return
+	}
+
+	pools := promotionService.db.Collection("promo_pools")
+	var updated CodePool
+	err = pools.FindOneAndUpdate(ctx,
+		bson.M{"_id": pool.ID, "status": poolActive, "$or": bson.A{
+			bson.M{"max_redemptions": bson.M{"$in": bson.A{nil, 0}}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$redeemed", "$max_redemptions"}}},
+		}},
+		bson.M{"$inc": bson.M{"redeemed": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Code is invalid or already used"})
+		return
+	}
+
+	now := time.Now()
+	result, err := promotionService.db.Collection("promo_codes").UpdateOne(ctx,
+		bson.M{"_id": code.Code, "status": codeUnused},
+		bson.M{"$set": bson.M{"status": codeRedeemed, "redeemed_by": req.UserID, "order_id": req.OrderID, "redeemed_at": now}},
+	)
+	if err != nil || result.ModifiedCount == 0 {
+		// Give the pool's slot back
+		if _, err := pools.UpdateOne(ctx, bson.M{"_id": pool.ID}, bson.M{"$inc": bson.M{"redeemed": -1}}); err != nil {
+			log.Printf("Failed to return redemption to pool %s: %v", pool.ID, err)
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Code is invalid or already used"})
+		return
+	}
+
+	if updated.MaxRedemptions > 0 && updated.Redeemed >= updated.MaxRedemptions {
+		if err := voidPool(ctx, pool.ID); err != nil {
+			log.Printf("Failed to invalidate exhausted pool %s: %v", pool.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":     code.Code,
+		"discount": pool.Discount.amount(req.OrderTotal),
+	})
+}
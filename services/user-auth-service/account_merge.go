@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const accountMergeTTL = time.Hour
+
+// AccountMerge is a request to fold a duplicate account (the source) into
+// the signed-in one (the target). It only happens once the source's owner
+// confirms from its inbox, so knowing an email isn't enough to take over
+// its orders.
+type AccountMerge struct {
+	TokenHash string    `bson:"token_hash"`
+	SourceID  string    `bson:"source_id"`
+	TargetID  string    `bson:"target_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+	Used      bool      `bson:"used"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// requestAccountMerge starts merging the account registered to email into
+// the caller's.
+func requestAccountMerge(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := authService.db.Collection("users")
+	var target User
+	if err := collection.FindOne(ctx, userFilter(c.GetString("user_id"))).Decode(&target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var source User
+	err := collection.FindOne(ctx, emailFilter(c, strings.ToLower(req.Email))).Decode(&source)
+	if err != nil || source.ID == target.ID || !source.Active || source.Role != "customer" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "There is no other customer account with this email"})
+		return
+	}
+	if source.Organization != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Accounts that belong to a company can't be merged", "code": "organization_member"})
+		return
+	}
+
+	now := time.Now()
+	token, tokenHash := newOneTimeToken()
+	_, err = authService.db.Collection("account_merges").InsertOne(ctx, AccountMerge{
+		TokenHash: tokenHash,
+		SourceID:  source.ID,
+		TargetID:  target.ID,
+		ExpiresAt: now.Add(accountMergeTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request merge"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "account.merge_requested", UserID: target.ID, ActorID: target.ID, Data: bson.M{"source_id": source.ID}})
+
+	sendEmail(source.Email, "Confirm merging your accounts",
+		"Someone signed in as "+target.Email+" asked to merge this account into theirs. "+
+			"Your orders and addresses will move to "+target.Email+" and this account will be closed.\n\n"+
+			"If that was you, confirm within the hour:\n\n"+appURL("/account/merge/confirm?token="+token)+
+			"\n\nIf it wasn't, ignore this email and nothing will change.")
+	sendEmail(target.Email, "Account merge requested",
+		"We've emailed "+source.Email+" a link to confirm merging it into this account.")
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Confirmation sent to " + source.Email})
+}
+
+// confirmAccountMerge moves the source account's orders, addresses and
+// sign-in methods to the target and closes the source.
+func confirmAccountMerge(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	merges := authService.db.Collection("account_merges")
+	var merge AccountMerge
+	err := merges.FindOne(ctx, bson.M{
+		"token_hash": hashToken(req.Token),
+		"used":       false,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&merge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	users := authService.db.Collection("users")
+	var source, target User
+	if users.FindOne(ctx, userFilter(merge.SourceID)).Decode(&source) != nil || !source.Active ||
+		users.FindOne(ctx, userFilter(merge.TargetID)).Decode(&target) != nil || !target.Active {
+		c.JSON(http.StatusConflict, gin.H{"error": "One of the accounts is no longer active"})
+		return
+	}
+
+	// Orders first: if they can't move, nothing else does and the link can
+	// be used again
+	var reassigned struct {
+		Moved map[string]int64 `json:"moved"`
+	}
+	authorization, err := reassignToken(source.TenantID)
+	if err == nil {
+		err = callOrderService(ctx, "/api/v1/admin/customers/reassign", "Bearer "+authorization,
+			gin.H{"from_user_id": source.ID, "to_user_id": target.ID}, &reassigned)
+	}
+	if err != nil {
+		log.Printf("Failed to reassign orders from %s to %s: %v", source.ID, target.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to move orders, please try again"})
+		return
+	}
+
+	// Claim the link now the orders have moved; a concurrent confirm stops here
+	result, err := merges.UpdateOne(ctx, bson.M{"token_hash": merge.TokenHash, "used": false},
+		bson.M{"$set": bson.M{"used": true, "used_at": time.Now()}})
+	if err != nil || result.ModifiedCount == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	addresses, err := authService.db.Collection("addresses").UpdateMany(ctx,
+		bson.M{"user_id": source.ID}, bson.M{"$set": bson.M{"user_id": target.ID}})
+	if err != nil {
+		log.Printf("Failed to move addresses from %s to %s: %v", source.ID, target.ID, err)
+	}
+
+	targetUpdate := bson.M{}
+	var moved []Identity
+	for _, identity := range source.Identities {
+		if !target.hasIdentity(identity.Issuer, identity.Subject) {
+			moved = append(moved, identity)
+		}
+	}
+
+	// The source closes first so the unique phone index allows the move
+	_, err = users.UpdateOne(ctx, userFilter(source.ID), bson.M{
+		"$set":   bson.M{"active": false, "deactivated_at": time.Now(), "merged_into": target.ID},
+		"$unset": bson.M{"identities": "", "phone": "", "phone_verified": ""},
+		"$inc":   bson.M{"token_version": 1},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close merged account"})
+		return
+	}
+
+	if len(moved) > 0 {
+		targetUpdate["$push"] = bson.M{"identities": bson.M{"$each": moved}}
+	}
+	if target.Phone == "" && source.PhoneVerified {
+		targetUpdate["$set"] = bson.M{"phone": source.Phone, "phone_verified": true}
+	}
+	if len(targetUpdate) > 0 {
+		if _, err := users.UpdateOne(ctx, userFilter(target.ID), targetUpdate); err != nil {
+			log.Printf("Failed to move sign-in methods from %s to %s: %v", source.ID, target.ID, err)
+		}
+	}
+
+	moves := gin.H{"addresses": int64(0), "identities": len(moved)}
+	if addresses != nil {
+		moves["addresses"] = addresses.ModifiedCount
+	}
+	for name, n := range reassigned.Moved {
+		moves[name] = n
+	}
+
+	recordAudit(c, AuditEvent{Type: "account.merged", UserID: target.ID, ActorID: source.ID, Data: bson.M{"source_id": source.ID, "moved": moves}})
+	publishUserEvent(context.Background(), EventUserMerged, source.ID, bson.M{"merged_into": target.ID})
+
+	sendEmail(source.Email, "Your accounts have been merged",
+		"This account was merged into "+target.Email+" and closed. Sign in as "+target.Email+" to see your orders.")
+	sendEmail(target.Email, "Your accounts have been merged",
+		"The orders and addresses from "+source.Email+" are now part of this account.")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Accounts merged", "merged_into": target.Email, "moved": moves})
+}
+
+// reassignToken mints a one-minute token that can do nothing but move a
+// customer's orders.
+func reassignToken(tenantID string) (string, error) {
+	return authService.keys.sign(newClaims(tenantID, selfAudience, "service").
+		permissions("service", []string{"orders:reassign"}).
+		audience([]string{envOr("ORDER_SERVICE_AUDIENCE", "order-service")}).
+		expiresAt(time.Now().Add(time.Minute)).
+		build())
+}
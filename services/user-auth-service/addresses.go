@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Address struct {
+	ID              string    `bson:"_id" json:"id"`
+	UserID          string    `bson:"user_id" json:"user_id"`
+	Label           string    `bson:"label" json:"label"`
+	Name            string    `bson:"name" json:"name"`
+	Line1           string    `bson:"line1" json:"line1"`
+	Line2           string    `bson:"line2,omitempty" json:"line2,omitempty"`
+	City            string    `bson:"city" json:"city"`
+	Region          string    `bson:"region,omitempty" json:"region,omitempty"`
+	PostalCode      string    `bson:"postal_code" json:"postal_code"`
+	Country         string    `bson:"country" json:"country"`
+	Phone           string    `bson:"phone,omitempty" json:"phone,omitempty"`
+	DefaultShipping bool      `bson:"default_shipping" json:"default_shipping"`
+	DefaultBilling  bool      `bson:"default_billing" json:"default_billing"`
+	CreatedAt       time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type AddressRequest struct {
+	Label           string `json:"label"`
+	Name            string `json:"name" binding:"required"`
+	Line1           string `json:"line1" binding:"required"`
+	Line2           string `json:"line2"`
+	City            string `json:"city" binding:"required"`
+	Region          string `json:"region"`
+	PostalCode      string `json:"postal_code" binding:"required"`
+	Country         string `json:"country" binding:"required,iso3166_1_alpha2"`
+	Phone           string `json:"phone" binding:"omitempty,e164"`
+	DefaultShipping bool   `json:"default_shipping"`
+	DefaultBilling  bool   `json:"default_billing"`
+}
+
+func listAddresses(c *gin.Context) {
+	userID := c.GetString("user_id")
+	collection := authService.db.Collection("addresses")
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := collection.Find(context.Background(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch addresses"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	addresses := []Address{}
+	if err = cursor.All(context.Background(), &addresses); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode addresses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"addresses": addresses,
+		"count":     len(addresses),
+	})
+}
+
+// getAddress also resolves the caller's organization addresses, so orders
+// can ship to them by ID.
+func getAddress(c *gin.Context) {
+	collection := authService.db.Collection("addresses")
+
+	var address Address
+	err := collection.FindOne(context.Background(), bson.M{"_id": c.Param("id"), "user_id": bson.M{"$in": addressOwners(c)}}).Decode(&address)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, address)
+}
+
+func createAddress(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := authService.db.Collection("addresses")
+
+	// The first address a user saves becomes their default for both.
+	count, err := collection.CountDocuments(context.Background(), bson.M{"user_id": userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+	if count == 0 {
+		req.DefaultShipping = true
+		req.DefaultBilling = true
+	}
+
+	address := Address{
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	}
+	address.apply(req)
+
+	if err := clearDefaults(userID, address.ID, req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+
+	if _, err := collection.InsertOne(context.Background(), address); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, address)
+}
+
+func updateAddress(c *gin.Context) {
+	userID := c.GetString("user_id")
+	id := c.Param("id")
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := authService.db.Collection("addresses")
+	var address Address
+	err := collection.FindOne(context.Background(), bson.M{"_id": id, "user_id": userID}).Decode(&address)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	address.apply(req)
+
+	if err := clearDefaults(userID, id, req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+
+	_, err = collection.ReplaceOne(context.Background(), bson.M{"_id": id, "user_id": userID}, address)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, address)
+}
+
+func deleteAddress(c *gin.Context) {
+	userID := c.GetString("user_id")
+	collection := authService.db.Collection("addresses")
+
+	result, err := collection.DeleteOne(context.Background(), bson.M{"_id": c.Param("id"), "user_id": userID})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+}
+
+func (a *Address) apply(req AddressRequest) {
+	a.Label = req.Label
+	a.Name = req.Name
+	a.Line1 = req.Line1
+	a.Line2 = req.Line2
+	a.City = req.City
+	a.Region = req.Region
+	a.PostalCode = req.PostalCode
+	a.Country = req.Country
+	a.Phone = req.Phone
+	a.DefaultShipping = req.DefaultShipping
+	a.DefaultBilling = req.DefaultBilling
+	a.UpdatedAt = time.Now()
+}
+
+// clearDefaults unsets the default flags on the user's other addresses when
+// the request claims them, so there is at most one default of each kind.
+func clearDefaults(userID, keepID string, req AddressRequest) error {
+	unset := bson.M{}
+	if req.DefaultShipping {
+		unset["default_shipping"] = false
+	}
+	if req.DefaultBilling {
+		unset["default_billing"] = false
+	}
+	if len(unset) == 0 {
+		return nil
+	}
+
+	collection := authService.db.Collection("addresses")
+	_, err := collection.UpdateMany(
+		context.Background(),
+		bson.M{"user_id": userID, "_id": bson.M{"$ne": keepID}},
+		bson.M{"$set": unset},
+	)
+	return err
+}
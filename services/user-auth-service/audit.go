@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AuditEvent records a security-relevant action on an account.
+type AuditEvent struct {
+	Type      string `bson:"type" json:"type"`
+	UserID    string `bson:"user_id" json:"user_id"`
+	ActorID   string `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	IP        string `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	// Set when the action was taken with an impersonation token
+	ImpersonatedBy string    `bson:"impersonated_by,omitempty" json:"impersonated_by,omitempty"`
+	Data           bson.M    `bson:"data,omitempty" json:"data,omitempty"`
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+}
+
+func recordAudit(c *gin.Context, event AuditEvent) {
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.CreatedAt = time.Now()
+	if event.ActorID == "" {
+		event.ActorID = c.GetString("user_id")
+	}
+	event.ImpersonatedBy = c.GetString("impersonated_by")
+
+	collection := authService.db.Collection("audit_events")
+	if _, err := collection.InsertOne(context.Background(), event); err != nil {
+		log.Printf("Failed to record audit event %s for %s: %v", event.Type, event.UserID, err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	// Decoders for the accepted upload formats
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Avatars are cropped to a centred square, scaled to AVATAR_SIZE pixels
+// (default 256) and re-encoded as JPEG, which also strips any metadata
+// such as GPS tags from the original.
+const (
+	defaultAvatarSize = 256
+	maxAvatarBytes    = 5 << 20
+	maxAvatarPixels   = 40_000_000
+	avatarJPEGQuality = 85
+	avatarContentType = "image/jpeg"
+)
+
+func avatarSize() int {
+	if n, err := strconv.Atoi(os.Getenv("AVATAR_SIZE")); err == nil && n >= 32 && n <= 1024 {
+		return n
+	}
+	return defaultAvatarSize
+}
+
+func uploadAvatar(c *gin.Context) {
+	if storage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Avatar uploads are not configured"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarBytes+1<<20)
+
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "avatar file is required"})
+		return
+	}
+	if file.Size > maxAvatarBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar must be 5MB or smaller"})
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+
+	// Check dimensions before decoding so a small file can't expand into a
+	// huge bitmap
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a JPEG, PNG or GIF image"})
+		return
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar dimensions are too large"})
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a JPEG, PNG or GIF image"})
+		return
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, squareThumbnail(img, avatarSize()), &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process avatar"})
+		return
+	}
+
+	// A new key per upload, so CDN caches never serve the previous image
+	key := "avatars/" + tenantID(c) + "/" + userID + "/" + newTokenID() + ".jpg"
+	avatarURL, err := storage.put(c.Request.Context(), key, avatarContentType, out.Bytes())
+	if err != nil {
+		log.Printf("Failed to store avatar for %s: %v", userID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	_, err = authService.db.Collection("users").UpdateOne(context.Background(),
+		userFilter(userID), bson.M{"$set": bson.M{"avatar_url": avatarURL}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"avatar_url"}, "avatar_url": avatarURL})
+
+	c.JSON(http.StatusOK, gin.H{"avatar_url": avatarURL})
+}
+
+func deleteAvatar(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	_, err := authService.db.Collection("users").UpdateOne(context.Background(),
+		userFilter(userID), bson.M{"$unset": bson.M{"avatar_url": ""}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"avatar_url"}, "avatar_url": ""})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar removed"})
+}
+
+// squareThumbnail crops img to its centred square and scales it to size
+// pixels, averaging each output pixel over the source pixels it covers.
+func squareThumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	// Never upscale small images
+	if side < size {
+		size = side
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			if sx1 == sx0 {
+				sx1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			// JPEG has no alpha, so transparent areas become white
+			alpha := a / n
+			white := 0xffff - alpha
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
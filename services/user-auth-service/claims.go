@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token lifetimes and audiences, from ACCESS_TOKEN_TTL (default 15m),
+// REFRESH_TOKEN_TTL (default 168h), TOKEN_AUDIENCES (the downstream
+// services a token may be addressed to, e.g. "order-service,payment-service")
+// and TOKEN_DEFAULT_AUDIENCE (used when a client doesn't ask for one; empty
+// means tokens carry no aud and every service accepts them).
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+	knownAudiences  []string
+	defaultAudience []string
+	// selfAudience is how this service appears in aud claims
+	selfAudience = "user-auth-service"
+)
+
+func setupTokenClaims() {
+	if d, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL")); err == nil && d > 0 {
+		accessTokenTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		refreshTokenTTL = d
+	}
+	knownAudiences = splitList(os.Getenv("TOKEN_AUDIENCES"), ",")
+	defaultAudience = splitList(os.Getenv("TOKEN_DEFAULT_AUDIENCE"), ",")
+	selfAudience = envOr("TOKEN_AUDIENCE", selfAudience)
+}
+
+func splitList(s, sep string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// claimsBuilder assembles token claims. Every token gets a subject, tenant,
+// role, ID and issue time; the rest is opt-in.
+type claimsBuilder struct {
+	claims jwt.MapClaims
+}
+
+func newClaims(tenantID, userID, role string) *claimsBuilder {
+	return &claimsBuilder{claims: jwt.MapClaims{
+		"sub":  userID,
+		"tid":  tenantID,
+		"role": role,
+		"jti":  newTokenID(),
+		"iat":  time.Now().Unix(),
+	}}
+}
+
+func (b *claimsBuilder) email(email string) *claimsBuilder {
+	if email != "" {
+		b.claims["email"] = email
+	}
+	return b
+}
+
+func (b *claimsBuilder) expiresAt(t time.Time) *claimsBuilder {
+	b.claims["exp"] = t.Unix()
+	return b
+}
+
+// permissions embeds what the token may do, so downstream services don't
+// need to look the role up. Scoped tokens carry their scopes instead of
+// the role's full permissions.
+func (b *claimsBuilder) permissions(role string, scopes []string) *claimsBuilder {
+	if len(scopes) == 0 {
+		b.claims["permissions"] = roles.permissions(role)
+		return b
+	}
+	b.claims["permissions"] = scopes
+	b.claims["scope"] = strings.Join(scopes, " ")
+	return b
+}
+
+// accountScope lets a scoped token act as its holder on routes without a
+// permission of their own, like the profile and address book. Unscoped
+// tokens always can.
+const accountScope = "account"
+
+func accountScoped(claims jwt.MapClaims) bool {
+	scope, ok := claims["scope"].(string)
+	if !ok {
+		return true
+	}
+	for _, s := range strings.Fields(scope) {
+		if s == accountScope {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *claimsBuilder) audience(aud []string) *claimsBuilder {
+	if len(aud) > 0 {
+		b.claims["aud"] = aud
+	}
+	return b
+}
+
+func (b *claimsBuilder) set(key string, value interface{}) *claimsBuilder {
+	b.claims[key] = value
+	return b
+}
+
+func (b *claimsBuilder) build() jwt.MapClaims {
+	return b.claims
+}
+
+// tokenOptions narrows the tokens issued for a sign-in. Empty Scopes means
+// the role's full permissions.
+type tokenOptions struct {
+	Scopes   []string
+	Audience []string
+}
+
+var (
+	errInvalidScope  = errors.New("invalid_scope")
+	errInvalidTarget = errors.New("invalid_target")
+)
+
+// resolveTokenOptions validates a client's requested scope (space
+// separated, OAuth style) and audience. Scopes must be granted by the role
+// and, when the request refreshes a scoped token, by that token too, so
+// scopes can only ever narrow.
+func resolveTokenOptions(role, scope string, audience []string, within *tokenOptions) (tokenOptions, error) {
+	opts := tokenOptions{Scopes: splitList(scope, " "), Audience: audience}
+
+	if len(opts.Scopes) == 0 && within != nil {
+		opts.Scopes = within.Scopes
+	}
+	granted := roles.permissions(role)
+	for _, s := range opts.Scopes {
+		// Every account may act as itself, so only a narrower parent limits account
+		roleGrants := s == accountScope || grants(granted, s)
+		if !roleGrants || (within != nil && len(within.Scopes) > 0 && !grants(within.Scopes, s)) {
+			return opts, errInvalidScope
+		}
+	}
+
+	if len(opts.Audience) == 0 {
+		opts.Audience = defaultAudience
+		if within != nil && len(within.Audience) > 0 {
+			opts.Audience = within.Audience
+		}
+		return opts, nil
+	}
+	for _, aud := range opts.Audience {
+		if !containsString(knownAudiences, aud) && aud != selfAudience {
+			return opts, errInvalidTarget
+		}
+		if within != nil && len(within.Audience) > 0 && !containsString(within.Audience, aud) {
+			return opts, errInvalidTarget
+		}
+	}
+	return opts, nil
+}
+
+// tokenTypeRefresh marks refresh tokens in their typ claim. Every service
+// refuses them as access tokens; they're only good for POST
+// /api/v1/auth/refresh.
+const tokenTypeRefresh = "refresh"
+
+func isRefreshToken(claims jwt.MapClaims) bool {
+	typ, _ := claims["typ"].(string)
+	return typ == tokenTypeRefresh
+}
+
+// refreshTokenOptions reads back the scope and audience a refresh token
+// was issued for. The audience is kept in req_aud rather than aud, as it's
+// the access tokens issued from it that are addressed to those services.
+func refreshTokenOptions(claims jwt.MapClaims) tokenOptions {
+	scope, _ := claims["scope"].(string)
+	opts := tokenOptions{Scopes: splitList(scope, " ")}
+	list, _ := claims["req_aud"].([]interface{})
+	for _, aud := range list {
+		if s, ok := aud.(string); ok {
+			opts.Audience = append(opts.Audience, s)
+		}
+	}
+	return opts
+}
+
+// tokenOptionsError answers a sign-in whose requested scope or audience
+// can't be granted.
+func tokenOptionsError(c *gin.Context, err error) {
+	if err == errInvalidTarget {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or disallowed audience", "code": "invalid_target"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Requested scope exceeds what the account is allowed", "code": "invalid_scope"})
+}
+
+// audienceAllowed reports whether a token may be used with this service.
+// Tokens without an aud claim are accepted everywhere.
+func audienceAllowed(claims jwt.MapClaims) bool {
+	aud, err := claims.GetAudience()
+	return err == nil && (len(aud) == 0 || containsString(aud, selfAudience))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// InternalNote is a staff-only remark on a customer account.
+type InternalNote struct {
+	Body      string    `bson:"body" json:"body"`
+	AuthorID  string    `bson:"author_id" json:"author_id"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+func adminGetUser(c *gin.Context) {
+	collection := authService.db.Collection("users")
+
+	var user User
+	err := collection.FindOne(context.Background(), tenantUserFilter(c, c.Param("id"))).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	notes := user.Notes
+	if notes == nil {
+		notes = []InternalNote{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":  user,
+		"tags":  normalizedTags(user.Tags),
+		"notes": notes,
+	})
+}
+
+// getUserTags is used by promotions and risk rules to target customers.
+func getUserTags(c *gin.Context) {
+	collection := authService.db.Collection("users")
+
+	var user User
+	err := collection.FindOne(context.Background(), tenantUserFilter(c, c.Param("id"))).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": user.ID,
+		"tags":    normalizedTags(user.Tags),
+	})
+}
+
+func setUserTags(c *gin.Context) {
+	var req struct {
+		Tags []string `json:"tags" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tags := normalizedTags(req.Tags)
+	collection := authService.db.Collection("users")
+	result, err := collection.UpdateOne(
+		context.Background(),
+		tenantUserFilter(c, c.Param("id")),
+		bson.M{"$set": bson.M{"tags": tags}},
+	)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tags"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "user.tags_updated", UserID: c.Param("id"), Data: bson.M{"tags": tags}})
+
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+func addUserNote(c *gin.Context) {
+	var req struct {
+		Body string `json:"body" binding:"required,max=4000"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	note := InternalNote{
+		Body:      req.Body,
+		AuthorID:  c.GetString("user_id"),
+		CreatedAt: time.Now(),
+	}
+
+	collection := authService.db.Collection("users")
+	result, err := collection.UpdateOne(
+		context.Background(),
+		tenantUserFilter(c, c.Param("id")),
+		bson.M{"$push": bson.M{"internal_notes": note}},
+	)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add note"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+}
+
+// normalizedTags lower-cases, trims and de-duplicates tags so "VIP" and
+// " vip" target the same customers.
+func normalizedTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
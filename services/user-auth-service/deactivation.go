@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const reactivationTTL = 24 * time.Hour
+
+// isActive reports whether the account may still use its tokens.
+// Deactivated accounts are kept (soft delete) so they can be reactivated
+// and so orders keep pointing at a real user.
+func isActive(ctx context.Context, userID string) bool {
+	var user struct {
+		Active bool `bson:"active"`
+	}
+	err := authService.db.Collection("users").FindOne(ctx, userFilter(userID),
+		options.FindOne().SetProjection(bson.M{"active": 1})).Decode(&user)
+	return err == nil && user.Active
+}
+
+// deactivateAccount lets a user close their own account. Accounts with a
+// password must confirm it; SSO-only accounts have none.
+func deactivateAccount(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		Password string `json:"password"`
+		Reason   string `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := authService.db.Collection("users")
+	var user User
+	if err := collection.FindOne(context.Background(), userFilter(userID)).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.Password != "" && !passwordMatches(user.Password, req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	_, err := collection.UpdateOne(
+		context.Background(),
+		userFilter(userID),
+		bson.M{
+			"$set": bson.M{"active": false, "deactivated_at": time.Now()},
+			"$inc": bson.M{"token_version": 1},
+		},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate account"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "account.deactivated", UserID: userID, Data: bson.M{"reason": req.Reason}})
+	publishUserEvent(c.Request.Context(), EventUserDeleted, userID, bson.M{"soft_delete": true, "reason": req.Reason})
+
+	sendEmail(user.Email, "Your account has been deactivated",
+		"Your account was deactivated. You can reactivate it at any time from "+appURL("/account/reactivate")+".")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deactivated"})
+}
+
+// requestReactivation emails a confirmation link to a deactivated account.
+// The response doesn't reveal whether the account exists.
+func requestReactivation(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If the account can be reactivated, a confirmation link has been sent"}
+
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), emailFilter(c, req.Email)).Decode(&user)
+	if err != nil || user.Active {
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	token, tokenHash := newOneTimeToken()
+	_, err = authService.db.Collection("account_reactivations").InsertOne(context.Background(), bson.M{
+		"user_id":    user.ID,
+		"token_hash": tokenHash,
+		"expires_at": time.Now().Add(reactivationTTL),
+		"used":       false,
+		"created_at": time.Now(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start reactivation"})
+		return
+	}
+
+	sendEmail(user.Email, "Reactivate your account",
+		"Use this link to reactivate your account: "+appURL("/account/reactivate/confirm?token="+token))
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+func confirmReactivation(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reactivation struct {
+		UserID string `bson:"user_id"`
+	}
+	err := authService.db.Collection("account_reactivations").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true}},
+	).Decode(&reactivation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	_, err = authService.db.Collection("users").UpdateOne(
+		context.Background(),
+		userFilter(reactivation.UserID),
+		bson.M{
+			"$set":   bson.M{"active": true},
+			"$unset": bson.M{"deactivated_at": ""},
+		},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate account"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "account.reactivated", UserID: reactivation.UserID, ActorID: reactivation.UserID})
+	publishUserEvent(c.Request.Context(), EventUserUpdated, reactivation.UserID, bson.M{"fields": []string{"active"}, "active": true})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account reactivated, you can now log in"})
+}
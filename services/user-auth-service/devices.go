@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginDevice is a device a user has signed in from, identified by a
+// fingerprint of the client's device ID (or user agent when it sends none),
+// together with the countries it has been used from.
+type LoginDevice struct {
+	ID          string    `bson:"_id" json:"id"`
+	UserID      string    `bson:"user_id" json:"user_id"`
+	Fingerprint string    `bson:"fingerprint" json:"-"`
+	UserAgent   string    `bson:"user_agent" json:"user_agent"`
+	Countries   []string  `bson:"countries" json:"countries"`
+	LastIP      string    `bson:"last_ip" json:"last_ip"`
+	LastCountry string    `bson:"last_country,omitempty" json:"last_country,omitempty"`
+	Status      string    `bson:"status" json:"status"`
+	FirstSeen   time.Time `bson:"first_seen" json:"first_seen"`
+	LastSeen    time.Time `bson:"last_seen" json:"last_seen"`
+}
+
+const (
+	deviceTrusted = "trusted"
+	devicePending = "pending"
+	deviceRevoked = "revoked"
+)
+
+// loginChallengeTTL is how long the emailed sign-in confirmation stays valid.
+const loginChallengeTTL = 30 * time.Minute
+
+var suspiciousLoginCheck = os.Getenv("SUSPICIOUS_LOGIN_CHECK") != "false"
+
+var geoClient = &http.Client{Timeout: 2 * time.Second}
+
+// loginCountry resolves the client's country from the edge's geo header
+// (GEOIP_HEADER, default CF-IPCountry) or, failing that, a lookup service at
+// GEOIP_API_URL answering {"country_code": "GB"} for GET <url>/<ip>.
+func loginCountry(c *gin.Context) string {
+	header := os.Getenv("GEOIP_HEADER")
+	if header == "" {
+		header = "CF-IPCountry"
+	}
+	if country := c.GetHeader(header); country != "" && country != "XX" {
+		return country
+	}
+
+	apiURL := os.Getenv("GEOIP_API_URL")
+	if apiURL == "" {
+		return ""
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, apiURL+"/"+c.ClientIP(), nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := geoClient.Do(req)
+	if err != nil {
+		log.Printf("GeoIP lookup failed: %v", err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		CountryCode string `json:"country_code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.CountryCode
+}
+
+func deviceFingerprint(c *gin.Context, deviceID string) string {
+	if deviceID == "" {
+		deviceID = "ua:" + c.Request.UserAgent()
+	}
+	return hashToken(deviceID)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLoginDevice lets a password login through when it comes from a
+// trusted device in a country that device has been used from. Otherwise it
+// emails the user a security alert with a link to confirm the sign-in and
+// answers 403. A user's very first device is trusted without a challenge.
+func checkLoginDevice(c *gin.Context, user *User, deviceID string) bool {
+	if !suspiciousLoginCheck {
+		return true
+	}
+
+	ctx := c.Request.Context()
+	collection := authService.db.Collection("login_devices")
+	fingerprint := deviceFingerprint(c, deviceID)
+	country := loginCountry(c)
+	now := time.Now()
+
+	var device LoginDevice
+	err := collection.FindOne(ctx, bson.M{"user_id": user.ID, "fingerprint": fingerprint}).Decode(&device)
+	if err == mongo.ErrNoDocuments {
+		known, err := collection.CountDocuments(ctx, bson.M{"user_id": user.ID})
+		if err == nil && known == 0 {
+			trustDevice(ctx, user.ID, fingerprint, c.Request.UserAgent(), c.ClientIP(), country)
+			return true
+		}
+	} else if err != nil {
+		// Don't lock everyone out when the device store is unavailable
+		log.Printf("Device lookup failed for %s: %v", user.ID, err)
+		return true
+	}
+
+	if device.Status == deviceTrusted && (country == "" || containsString(device.Countries, country)) {
+		collection.UpdateOne(ctx, bson.M{"_id": device.ID}, bson.M{"$set": bson.M{
+			"last_seen": now, "last_ip": c.ClientIP(), "last_country": country,
+		}})
+		return true
+	}
+
+	reason, what := "new_device", "device"
+	if device.Status == deviceTrusted {
+		reason, what = "new_country", "location"
+	}
+
+	// Record the device as pending so it can be approved from a trusted one
+	if device.ID == "" {
+		device = LoginDevice{
+			ID:          primitive.NewObjectID().Hex(),
+			UserID:      user.ID,
+			Fingerprint: fingerprint,
+			UserAgent:   c.Request.UserAgent(),
+			Countries:   []string{},
+			Status:      devicePending,
+			FirstSeen:   now,
+		}
+	}
+	device.LastIP = c.ClientIP()
+	device.LastCountry = country
+	device.LastSeen = now
+	if device.Status == deviceRevoked {
+		device.Status = devicePending
+	}
+	collection.ReplaceOne(ctx, bson.M{"_id": device.ID}, device, options.Replace().SetUpsert(true))
+
+	token, tokenHash := newOneTimeToken()
+	_, err = authService.db.Collection("login_challenges").InsertOne(ctx, bson.M{
+		"user_id":    user.ID,
+		"device_id":  device.ID,
+		"country":    country,
+		"token_hash": tokenHash,
+		"expires_at": now.Add(loginChallengeTTL),
+		"used":       false,
+		"created_at": now,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify sign-in"})
+		return false
+	}
+
+	location := country
+	if location == "" {
+		location = "an unknown location"
+	}
+	sendEmail(user.Email, "New sign-in to your account",
+		fmt.Sprintf("Someone signed in to your account from a new %s in %s (IP %s, %s) at %s.\n\n",
+			what, location, c.ClientIP(), c.Request.UserAgent(), now.UTC().Format(time.RFC1123))+
+			"If this was you, confirm the sign-in: "+appURL("/account/login/confirm?token="+token)+
+			"\n\nIf it wasn't, reset your password right away: "+appURL("/account/password/forgot"))
+
+	recordAudit(c, AuditEvent{Type: "login.challenged", UserID: user.ID, ActorID: user.ID, Data: bson.M{
+		"reason": reason, "device_id": device.ID, "country": country,
+	}})
+
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": "Confirm this sign-in using the link we emailed you",
+		"code":  "login_confirmation_required",
+	})
+	return false
+}
+
+// trustDevice marks the device trusted and remembers the country it was
+// used from.
+func trustDevice(ctx context.Context, userID, fingerprint, userAgent, ip, country string) {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{"status": deviceTrusted, "last_seen": now, "last_ip": ip, "last_country": country, "user_agent": userAgent},
+		"$setOnInsert": bson.M{
+			"_id":        primitive.NewObjectID().Hex(),
+			"first_seen": now,
+		},
+	}
+	if country != "" {
+		update["$addToSet"] = bson.M{"countries": country}
+	}
+	_, err := authService.db.Collection("login_devices").UpdateOne(ctx,
+		bson.M{"user_id": userID, "fingerprint": fingerprint}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("Failed to trust device for %s: %v", userID, err)
+	}
+}
+
+// confirmLogin completes a challenged login from the emailed link, trusting
+// the device and country for future sign-ins.
+func confirmLogin(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var challenge struct {
+		UserID   string `bson:"user_id"`
+		DeviceID string `bson:"device_id"`
+		Country  string `bson:"country"`
+	}
+	err := authService.db.Collection("login_challenges").FindOneAndUpdate(ctx,
+		bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true, "used_at": time.Now()}},
+	).Decode(&challenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired confirmation link"})
+		return
+	}
+
+	var user User
+	err = authService.db.Collection("users").FindOne(ctx, userFilter(challenge.UserID)).Decode(&user)
+	if err != nil || !user.Active {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired confirmation link"})
+		return
+	}
+
+	var device LoginDevice
+	err = authService.db.Collection("login_devices").FindOne(ctx, bson.M{"_id": challenge.DeviceID}).Decode(&device)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired confirmation link"})
+		return
+	}
+	trustDevice(ctx, user.ID, device.Fingerprint, device.UserAgent, c.ClientIP(), challenge.Country)
+
+	if !requirePolicyAcceptance(c, &user) {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "login.confirmed", UserID: user.ID, ActorID: user.ID, Data: bson.M{"device_id": device.ID}})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
+
+func findDevices(c *gin.Context, userID string) {
+	opts := options.Find().SetSort(bson.D{{Key: "last_seen", Value: -1}})
+	cursor, err := authService.db.Collection("login_devices").Find(c.Request.Context(), bson.M{"user_id": userID}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return
+	}
+	defer cursor.Close(c.Request.Context())
+
+	devices := []LoginDevice{}
+	if err := cursor.All(c.Request.Context(), &devices); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode devices"})
+		return
+	}
+
+	c.JSON(http.StatusOK, devices)
+}
+
+func listDevices(c *gin.Context) {
+	findDevices(c, c.GetString("user_id"))
+}
+
+func adminListDevices(c *gin.Context) {
+	count, err := authService.db.Collection("users").CountDocuments(c.Request.Context(), tenantUserFilter(c, c.Param("id")))
+	if err != nil || count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	findDevices(c, c.Param("id"))
+}
+
+// approveDevice trusts a pending device from an existing session, e.g. when
+// the user sees the security alert on a device they already use.
+func approveDevice(c *gin.Context) {
+	setDeviceStatus(c, deviceTrusted, "device.approved")
+}
+
+// revokeDevice forgets a device, so the next sign-in from it is challenged.
+func revokeDevice(c *gin.Context) {
+	setDeviceStatus(c, deviceRevoked, "device.revoked")
+}
+
+func setDeviceStatus(c *gin.Context, status, auditType string) {
+	userID := c.GetString("user_id")
+	filter := bson.M{"_id": c.Param("id"), "user_id": userID}
+
+	var device LoginDevice
+	err := authService.db.Collection("login_devices").FindOne(c.Request.Context(), filter).Decode(&device)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"status": status}}
+	if status == deviceTrusted && device.LastCountry != "" {
+		update["$addToSet"] = bson.M{"countries": device.LastCountry}
+	}
+	if status == deviceRevoked {
+		update["$set"].(bson.M)["countries"] = []string{}
+	}
+	if _, err := authService.db.Collection("login_devices").UpdateOne(c.Request.Context(), filter, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: auditType, UserID: userID, Data: bson.M{"device_id": device.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device " + status, "id": device.ID, "status": status})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// EmailChange tracks a pending or completed change of account email. The old
+// address stays active until the new one is confirmed, and the old owner can
+// undo the change for a while afterwards.
+type EmailChange struct {
+	ID          string     `bson:"_id,omitempty" json:"id"`
+	UserID      string     `bson:"user_id" json:"user_id"`
+	OldEmail    string     `bson:"old_email" json:"old_email"`
+	NewEmail    string     `bson:"new_email" json:"new_email"`
+	ConfirmHash string     `bson:"confirm_hash" json:"-"`
+	UndoHash    string     `bson:"undo_hash" json:"-"`
+	Status      string     `bson:"status" json:"status"`
+	ExpiresAt   time.Time  `bson:"expires_at" json:"expires_at"`
+	ConfirmedAt *time.Time `bson:"confirmed_at,omitempty" json:"confirmed_at,omitempty"`
+	CreatedAt   time.Time  `bson:"created_at" json:"created_at"`
+}
+
+const (
+	emailChangeTTL     = 24 * time.Hour
+	emailChangeUndoTTL = 7 * 24 * time.Hour
+)
+
+func requestEmailChange(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		NewEmail string `json:"new_email" binding:"required,email"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !enforceEmailPolicy(c, "email_change", req.NewEmail) {
+		return
+	}
+
+	users := authService.db.Collection("users")
+	var user User
+	if err := users.FindOne(context.Background(), userFilter(userID)).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !passwordMatches(user.Password, req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+
+	if err := users.FindOne(context.Background(), emailFilter(c, req.NewEmail)).Err(); err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+
+	confirmToken, confirmHash := newOneTimeToken()
+	undoToken, undoHash := newOneTimeToken()
+
+	changes := authService.db.Collection("email_changes")
+
+	// Only the latest request per user can be confirmed.
+	_, err := changes.UpdateMany(
+		context.Background(),
+		bson.M{"user_id": userID, "status": "pending"},
+		bson.M{"$set": bson.M{"status": "superseded"}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request email change"})
+		return
+	}
+
+	change := EmailChange{
+		UserID:      userID,
+		OldEmail:    user.Email,
+		NewEmail:    req.NewEmail,
+		ConfirmHash: confirmHash,
+		UndoHash:    undoHash,
+		Status:      "pending",
+		ExpiresAt:   time.Now().Add(emailChangeTTL),
+		CreatedAt:   time.Now(),
+	}
+	if _, err := changes.InsertOne(context.Background(), change); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request email change"})
+		return
+	}
+
+	sendEmail(req.NewEmail, "Confirm your new email address",
+		"Confirm that this address should be used for your account: "+appURL("/account/email/confirm?token="+confirmToken))
+	sendEmail(user.Email, "Your account email is being changed",
+		"A request was made to change your account email to "+req.NewEmail+". If this wasn't you, cancel it here: "+
+			appURL("/account/email/undo?token="+undoToken))
+
+	recordAudit(c, AuditEvent{Type: "email.change_requested", UserID: userID, Data: bson.M{"new_email": req.NewEmail}})
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Confirmation sent to the new email address"})
+}
+
+func confirmEmailChange(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes := authService.db.Collection("email_changes")
+	var change EmailChange
+	err := changes.FindOne(context.Background(), bson.M{
+		"confirm_hash": hashToken(req.Token),
+		"status":       "pending",
+		"expires_at":   bson.M{"$gt": time.Now()},
+	}).Decode(&change)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	_, err = authService.db.Collection("users").UpdateOne(
+		context.Background(),
+		userFilter(change.UserID),
+		bson.M{
+			"$set": bson.M{"email": change.NewEmail},
+			"$inc": bson.M{"token_version": 1},
+		},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+
+	now := time.Now()
+	_, err = changes.UpdateOne(
+		context.Background(),
+		bson.M{"_id": change.ID},
+		bson.M{"$set": bson.M{"status": "confirmed", "confirmed_at": now, "expires_at": now.Add(emailChangeUndoTTL)}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "email.changed", UserID: change.UserID, ActorID: change.UserID,
+		Data: bson.M{"old_email": change.OldEmail, "new_email": change.NewEmail}})
+	publishUserEvent(c.Request.Context(), EventUserUpdated, change.UserID, bson.M{"fields": []string{"email"}, "email": change.NewEmail})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed successfully"})
+}
+
+// undoEmailChange lets the owner of the old address cancel a pending change
+// or revert a confirmed one within the undo window. Reverting also revokes
+// all sessions, since the change may have been made by an attacker.
+func undoEmailChange(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes := authService.db.Collection("email_changes")
+	var change EmailChange
+	err := changes.FindOne(context.Background(), bson.M{
+		"undo_hash":  hashToken(req.Token),
+		"status":     bson.M{"$in": bson.A{"pending", "confirmed"}},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&change)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	if change.Status == "confirmed" {
+		_, err = authService.db.Collection("users").UpdateOne(
+			context.Background(),
+			userFilter(change.UserID),
+			bson.M{
+				"$set": bson.M{"email": change.OldEmail},
+				"$inc": bson.M{"token_version": 1},
+			},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert email change"})
+			return
+		}
+	}
+
+	_, err = changes.UpdateOne(
+		context.Background(),
+		bson.M{"_id": change.ID},
+		bson.M{"$set": bson.M{"status": "reverted"}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert email change"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "email.change_reverted", UserID: change.UserID, ActorID: change.UserID,
+		Data: bson.M{"old_email": change.OldEmail, "new_email": change.NewEmail}})
+	if change.Status == "confirmed" {
+		publishUserEvent(c.Request.Context(), EventUserUpdated, change.UserID, bson.M{"fields": []string{"email"}, "email": change.OldEmail})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email change cancelled"})
+}
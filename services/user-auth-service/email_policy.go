@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// emailPolicy decides which email domains may own accounts. It is built
+// from env at startup:
+//
+//	EMAIL_DOMAIN_ALLOWLIST   only these domains may register (optional)
+//	EMAIL_DOMAIN_DENYLIST    these domains may never register
+//	STAFF_EMAIL_DOMAINS      domains whose accounts an admin may give a
+//	                         staff role; nobody self-registers as staff
+//	DISPOSABLE_DOMAINS_URL   plain-text list (one domain per line) of
+//	                         disposable providers, refreshed every
+//	                         DISPOSABLE_DOMAINS_REFRESH (default 24h)
+//
+// Domains match themselves and their subdomains.
+type emailPolicy struct {
+	allow      map[string]bool
+	deny       map[string]bool
+	staff      map[string]bool
+	mu         sync.RWMutex
+	disposable map[string]bool
+}
+
+var policy *emailPolicy
+
+// builtinDisposableDomains covers the most common providers until the
+// remote list has been fetched.
+var builtinDisposableDomains = []string{
+	"mailinator.com", "guerrillamail.com", "10minutemail.com", "tempmail.com",
+	"temp-mail.org", "yopmail.com", "trashmail.com", "getnada.com",
+	"sharklasers.com", "dispostable.com", "maildrop.cc", "throwawaymail.com",
+}
+
+var registrationRisk = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_registration_risk_signals_total",
+	Help: "Risk signals raised on registrations and email changes.",
+}, []string{"signal"})
+
+var (
+	errDomainNotAllowed  = errors.New("email domain is not allowed")
+	errDisposableEmail   = errors.New("disposable email addresses are not allowed")
+	errStaffDomainNeeded = errors.New("staff accounts require a corporate email address")
+)
+
+func domainSet(csv string) map[string]bool {
+	set := map[string]bool{}
+	for _, domain := range strings.Split(csv, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+func setupEmailPolicy() {
+	policy = &emailPolicy{
+		allow:      domainSet(os.Getenv("EMAIL_DOMAIN_ALLOWLIST")),
+		deny:       domainSet(os.Getenv("EMAIL_DOMAIN_DENYLIST")),
+		staff:      domainSet(os.Getenv("STAFF_EMAIL_DOMAINS")),
+		disposable: domainSet(strings.Join(builtinDisposableDomains, ",")),
+	}
+
+	url := os.Getenv("DISPOSABLE_DOMAINS_URL")
+	if url == "" {
+		return
+	}
+	interval, err := time.ParseDuration(os.Getenv("DISPOSABLE_DOMAINS_REFRESH"))
+	if err != nil || interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	go func() {
+		for {
+			if err := policy.refreshDisposable(url); err != nil {
+				log.Printf("Failed to refresh disposable domain list: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// refreshDisposable replaces the disposable list with the remote one,
+// keeping the built-in domains.
+func (p *emailPolicy) refreshDisposable(url string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+
+	domains := domainSet(strings.Join(builtinDisposableDomains, ","))
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.disposable = domains
+	p.mu.Unlock()
+	log.Printf("Loaded %d disposable email domains", len(domains))
+	return nil
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// matches reports whether domain or one of its parent domains is in set.
+func matches(set map[string]bool, domain string) bool {
+	for domain != "" {
+		if set[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return false
+}
+
+func (p *emailPolicy) isDisposable(domain string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return matches(p.disposable, domain)
+}
+
+// check returns an error if the address may not be used for an account.
+func (p *emailPolicy) check(email string) error {
+	domain := emailDomain(email)
+
+	if matches(p.deny, domain) || (len(p.allow) > 0 && !matches(p.allow, domain)) {
+		return errDomainNotAllowed
+	}
+	if p.isDisposable(domain) {
+		return errDisposableEmail
+	}
+	return nil
+}
+
+// checkRole returns an error if an account with the address may not be
+// given role. Every role but customer is a staff role.
+func (p *emailPolicy) checkRole(email, role string) error {
+	if role != "customer" && !matches(p.staff, emailDomain(email)) {
+		return errStaffDomainNeeded
+	}
+	return nil
+}
+
+// riskSignals flags addresses that are allowed but look like throwaway or
+// bulk sign-ups, for fraud review.
+func riskSignals(email string) []string {
+	signals := []string{}
+	local := strings.ToLower(email[:max(strings.LastIndex(email, "@"), 0)])
+
+	if strings.Contains(local, "+") {
+		signals = append(signals, "plus_address")
+	}
+
+	digits := 0
+	for _, r := range local {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if len(local) > 0 && digits*2 > len(local) {
+		signals = append(signals, "numeric_local_part")
+	}
+
+	if len(local) >= 20 && !strings.ContainsAny(local, "._-") {
+		signals = append(signals, "random_local_part")
+	}
+
+	return signals
+}
+
+// enforceEmailPolicy writes a 400 and returns false if email is rejected.
+// Rejections and risk signals are recorded for review.
+func enforceEmailPolicy(c *gin.Context, action, email string) bool {
+	if err := policy.check(email); err != nil {
+		signal := "blocked_domain"
+		if err == errDisposableEmail {
+			signal = "disposable_email"
+		}
+		registrationRisk.WithLabelValues(signal).Inc()
+		recordAudit(c, AuditEvent{
+			Type: action + ".blocked",
+			Data: bson.M{"email": email, "reason": err.Error()},
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": signal})
+		return false
+	}
+
+	if signals := riskSignals(email); len(signals) > 0 {
+		for _, signal := range signals {
+			registrationRisk.WithLabelValues(signal).Inc()
+		}
+		recordAudit(c, AuditEvent{
+			Type: action + ".risk",
+			Data: bson.M{"email": email, "signals": signals},
+		})
+	}
+	return true
+}
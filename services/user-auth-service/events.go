@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User lifecycle events are appended to a Redis stream (USER_EVENTS_STREAM,
+// default "events:users") for notifications, analytics and CRM to consume
+// with consumer groups. Each entry has the fields id, type, user_id,
+// occurred_at and data (a JSON object).
+const (
+	EventUserRegistered = "user.registered"
+	EventUserUpdated    = "user.updated"
+	EventUserDeleted    = "user.deleted"
+	// A duplicate account was folded into data.merged_into
+	EventUserMerged = "user.merged"
+)
+
+// userEventsMaxLen caps the stream; consumers that fall further behind
+// than this lose events.
+const userEventsMaxLen = 1000000
+
+func userEventsStream() string {
+	if stream := os.Getenv("USER_EVENTS_STREAM"); stream != "" {
+		return stream
+	}
+	return "events:users"
+}
+
+// publishUserEvent emits an event. Publishing is best effort: a broker
+// outage is logged and never fails the user's request.
+func publishUserEvent(ctx context.Context, eventType, userID string, data bson.M) {
+	if data == nil {
+		data = bson.M{}
+	}
+	payload, _ := json.Marshal(data)
+
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: userEventsStream(),
+		MaxLen: userEventsMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"id":          primitive.NewObjectID().Hex(),
+			"type":        eventType,
+			"user_id":     userID,
+			"occurred_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"data":        string(payload),
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("Failed to publish %s for %s: %v", eventType, userID, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	guestRole     = "guest"
+	guestIDPrefix = "guest_"
+	guestTokenTTL = 24 * time.Hour
+)
+
+// issueGuestToken gives an anonymous shopper a short-lived identity so the
+// cart and order services can attribute their activity.
+func issueGuestToken(c *gin.Context) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	guestID := guestIDPrefix + hex.EncodeToString(b)
+
+	expiry := time.Now().Add(guestTokenTTL)
+	token, err := authService.keys.sign(accessClaims(tenantID(c), guestID, "", guestRole, expiry))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue guest token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"expires_in":   expiry.Unix(),
+		"guest_id":     guestID,
+	})
+}
+
+// upgradeGuest registers a guest as a full customer. The new account keeps
+// the guest's ID, so carts and orders placed as a guest remain theirs.
+func upgradeGuest(c *gin.Context) {
+	guestID := c.GetString("user_id")
+	if c.GetString("role") != guestRole || !strings.HasPrefix(guestID, guestIDPrefix) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only guest sessions can be upgraded"})
+		return
+	}
+
+	var req struct {
+		Email    string `json:"email" binding:"required,email"`
+		Password string `json:"password" binding:"required,min=8"`
+		Name     string `json:"name" binding:"required"`
+
+		AcceptPolicies bool `json:"accept_policies"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !enforceEmailPolicy(c, "registration", req.Email) {
+		return
+	}
+	if !requireSignupAcceptance(c, req.AcceptPolicies) {
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	user := User{
+		ID:        guestID,
+		Email:     req.Email,
+		Password:  hashedPassword,
+		Name:      req.Name,
+		Role:      "customer",
+		Active:    true,
+		TenantID:  tenantID(c),
+		CreatedAt: time.Now(),
+
+		PolicyAcceptances: currentAcceptances(c),
+	}
+
+	collection := authService.db.Collection("users")
+	_, err = collection.InsertOne(context.Background(), user)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create account"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "guest.upgraded", UserID: guestID})
+	publishUserEvent(c.Request.Context(), EventUserRegistered, guestID, bson.M{
+		"email": user.Email, "name": user.Name, "role": user.Role, "source": "guest_upgrade",
+	})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusCreated, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
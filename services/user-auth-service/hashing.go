@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Params are the Argon2id cost parameters, read from ARGON2_MEMORY
+// (KiB), ARGON2_ITERATIONS and ARGON2_PARALLELISM. Raising them makes
+// existing hashes get upgraded on the user's next login.
+type argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+var (
+	hashAlgorithm = "argon2id"
+	argon2Config  = argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+)
+
+// setupPasswordHashing reads PASSWORD_HASH_ALGORITHM ("argon2id", the
+// default, or "bcrypt") and the Argon2id parameters.
+func setupPasswordHashing() {
+	if algo := os.Getenv("PASSWORD_HASH_ALGORITHM"); algo != "" {
+		if algo != "argon2id" && algo != "bcrypt" {
+			log.Printf("Unknown PASSWORD_HASH_ALGORITHM %q, using argon2id", algo)
+		} else {
+			hashAlgorithm = algo
+		}
+	}
+
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil && v >= 8*1024 {
+		argon2Config.Memory = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil && v > 0 {
+		argon2Config.Iterations = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil && v > 0 {
+		argon2Config.Parallelism = uint8(v)
+	}
+}
+
+// hashPassword hashes with the configured algorithm. Argon2id hashes use
+// the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>.
+func hashPassword(password string) (string, error) {
+	if hashAlgorithm == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	p := argon2Config
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+var errUnknownHash = errors.New("unrecognised password hash")
+
+// decodeArgon2Hash parses a PHC-format Argon2id hash.
+func decodeArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, errUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errUnknownHash
+	}
+	p.SaltLength = len(salt)
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// verifyPassword checks password against a bcrypt or Argon2id hash. When it
+// matches, rehash reports whether the hash should be replaced because it
+// uses another algorithm or weaker parameters than currently configured.
+func verifyPassword(hash, password string) (ok bool, rehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return false, false
+		}
+		candidate := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false
+		}
+		c := argon2Config
+		return true, hashAlgorithm != "argon2id" ||
+			p.Memory < c.Memory || p.Iterations < c.Iterations || p.Parallelism < c.Parallelism
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	return true, hashAlgorithm != "bcrypt"
+}
+
+// passwordMatches is verifyPassword for callers that don't upgrade hashes.
+func passwordMatches(hash, password string) bool {
+	ok, _ := verifyPassword(hash, password)
+	return ok
+}
+
+// rehashPassword replaces the user's hash with one using the current
+// algorithm and parameters. Sessions are left alone since the password
+// itself hasn't changed, and a failure only delays the upgrade.
+func rehashPassword(ctx context.Context, user *User, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for %s: %v", user.ID, err)
+		return
+	}
+
+	// Only replace the hash that was verified, not one changed meanwhile
+	filter := userFilter(user.ID)
+	filter["password"] = user.Password
+	_, err = authService.db.Collection("users").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		log.Printf("Failed to rehash password for %s: %v", user.ID, err)
+		return
+	}
+	user.Password = hash
+}
+
+// isPasswordHash reports whether hash is a bcrypt or Argon2id hash this
+// service can verify, e.g. for imported accounts.
+func isPasswordHash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, _, _, err := decodeArgon2Hash(hash)
+		return err == nil
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Handlers write their "error" and "message" strings in English, the source
+// locale. i18nMiddleware swaps them for the translation in the catalog
+// picked by Accept-Language, so call sites stay as they are. Translations
+// are keyed by the English text itself.
+//
+// Validation errors from request binding are translated line by line from
+// the "validation.<tag>" template (e.g. "validation.required": "El campo
+// {field} es obligatorio"), with {field} translated from "field.<name>".
+const sourceLocale = "en"
+
+// CatalogMessage is one translation in a catalog.
+type CatalogMessage struct {
+	Key  string `bson:"key" json:"key"`
+	Text string `bson:"text" json:"text"`
+}
+
+// MessageCatalog holds the translations for one locale, plus the English
+// messages that were served to its users without one, for translators.
+type MessageCatalog struct {
+	Locale    string           `bson:"_id" json:"locale"`
+	Messages  []CatalogMessage `bson:"messages" json:"messages"`
+	Missing   []string         `bson:"missing,omitempty" json:"missing"`
+	UpdatedAt time.Time        `bson:"updated_at" json:"updated_at"`
+	UpdatedBy string           `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+}
+
+// maxMissingMessages caps how many untranslated messages are tracked per
+// locale, since some errors embed user input.
+const maxMissingMessages = 500
+
+// catalogCache keeps translations in memory. Writes reload it locally and,
+// through Redis pub/sub, on every other replica.
+type catalogCache struct {
+	mu       sync.RWMutex
+	messages map[string]map[string]string
+	missing  map[string]map[string]bool
+}
+
+var catalogs = &catalogCache{}
+
+const catalogInvalidations = "auth:i18n:invalidate"
+
+func setupI18n() {
+	catalogs.reload(context.Background())
+
+	go func() {
+		for range redisClient.Subscribe(context.Background(), catalogInvalidations).Channel() {
+			catalogs.reload(context.Background())
+		}
+	}()
+}
+
+func (cc *catalogCache) reload(ctx context.Context) {
+	cursor, err := authService.db.Collection("message_catalogs").Find(ctx, bson.M{})
+	if err != nil {
+		log.Printf("Failed to load message catalogs: %v", err)
+		return
+	}
+
+	var loaded []MessageCatalog
+	if err := cursor.All(ctx, &loaded); err != nil {
+		log.Printf("Failed to decode message catalogs: %v", err)
+		return
+	}
+
+	messages := map[string]map[string]string{}
+	missing := map[string]map[string]bool{}
+	for _, catalog := range loaded {
+		messages[catalog.Locale] = map[string]string{}
+		for _, m := range catalog.Messages {
+			messages[catalog.Locale][m.Key] = m.Text
+		}
+		missing[catalog.Locale] = map[string]bool{}
+		for _, key := range catalog.Missing {
+			missing[catalog.Locale][key] = true
+		}
+	}
+
+	cc.mu.Lock()
+	cc.messages, cc.missing = messages, missing
+	cc.mu.Unlock()
+}
+
+// invalidate reloads the cache here and tells the other replicas to.
+func (cc *catalogCache) invalidate(ctx context.Context) {
+	cc.reload(ctx)
+	if err := redisClient.Publish(ctx, catalogInvalidations, "").Err(); err != nil {
+		log.Printf("Failed to broadcast catalog invalidation: %v", err)
+	}
+}
+
+func (cc *catalogCache) has(locale string) bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	_, ok := cc.messages[locale]
+	return ok
+}
+
+func (cc *catalogCache) lookup(locale, key string) (string, bool) {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	text, ok := cc.messages[locale][key]
+	return text, ok && text != ""
+}
+
+// reportMissing records a message served untranslated so translators can
+// find it in the catalog.
+func (cc *catalogCache) reportMissing(locale, key string) {
+	cc.mu.Lock()
+	seen := cc.missing[locale]
+	if seen == nil || seen[key] || len(seen) >= maxMissingMessages {
+		cc.mu.Unlock()
+		return
+	}
+	seen[key] = true
+	cc.mu.Unlock()
+
+	go func() {
+		_, err := authService.db.Collection("message_catalogs").UpdateOne(context.Background(),
+			bson.M{"_id": locale}, bson.M{"$addToSet": bson.M{"missing": key}})
+		if err != nil {
+			log.Printf("Failed to record missing translation for %s: %v", locale, err)
+		}
+	}()
+}
+
+var localeTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z]{2})?$`)
+
+// negotiateLocale picks the best catalog for an Accept-Language header,
+// e.g. "es-MX,es;q=0.9,en;q=0.8". A region falls back to its language. The
+// source locale is returned when nothing better matches.
+func negotiateLocale(header string) string {
+	type candidate struct {
+		tag string
+		q   float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if localeTagPattern.MatchString(tag) && q > 0 {
+			candidates = append(candidates, candidate{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, cand := range candidates {
+		lang, region, _ := strings.Cut(cand.tag, "-")
+		lang = strings.ToLower(lang)
+		if lang == sourceLocale {
+			return sourceLocale
+		}
+		if region != "" && catalogs.has(lang+"-"+strings.ToUpper(region)) {
+			return lang + "-" + strings.ToUpper(region)
+		}
+		if catalogs.has(lang) {
+			return lang
+		}
+	}
+	return sourceLocale
+}
+
+// translatingWriter holds back the response body so it can be translated
+// once the handler is done.
+type translatingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *translatingWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *translatingWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func i18nMiddleware(c *gin.Context) {
+	c.Header("Vary", "Accept-Language")
+	locale := negotiateLocale(c.GetHeader("Accept-Language"))
+	c.Set("locale", locale)
+	c.Header("Content-Language", locale)
+	if locale == sourceLocale {
+		c.Next()
+		return
+	}
+
+	original := c.Writer
+	writer := &translatingWriter{ResponseWriter: original}
+	c.Writer = writer
+	c.Next()
+	c.Writer = original
+
+	body := writer.body.Bytes()
+	if strings.HasPrefix(original.Header().Get("Content-Type"), "application/json") {
+		body = translateBody(locale, body)
+	}
+	original.Write(body)
+}
+
+// translateBody translates the top-level "error" and "message" fields of a
+// JSON object, leaving every other response untouched.
+func translateBody(locale string, body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+
+	changed := false
+	for _, name := range []string{"error", "message"} {
+		var text string
+		if raw, ok := fields[name]; !ok || json.Unmarshal(raw, &text) != nil {
+			continue
+		}
+		if translated := translateMessage(locale, text); translated != text {
+			fields[name], _ = json.Marshal(translated)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+
+	translated, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return translated
+}
+
+// validationErrorPattern matches one line of a binding validation error:
+// "Key: 'LoginRequest.Email' Error:Field validation for 'Email' failed on the 'required' tag".
+var validationErrorPattern = regexp.MustCompile(`^Key: '[^']*' Error:Field validation for '([^']*)' failed on the '([^']*)' tag$`)
+
+// translateMessage returns the catalog's translation of an English message.
+func translateMessage(locale, text string) string {
+	if translated, ok := catalogs.lookup(locale, text); ok {
+		return translated
+	}
+
+	lines := strings.Split(text, "\n")
+	validation := true
+	for i, line := range lines {
+		match := validationErrorPattern.FindStringSubmatch(line)
+		if match == nil {
+			validation = false
+			break
+		}
+		field, tag := snakeCase(match[1]), match[2]
+
+		template, ok := catalogs.lookup(locale, "validation."+tag)
+		if !ok {
+			if template, ok = catalogs.lookup(locale, "validation.default"); !ok {
+				catalogs.reportMissing(locale, "validation."+tag)
+				return text
+			}
+		}
+		if name, ok := catalogs.lookup(locale, "field."+field); ok {
+			field = name
+		}
+		lines[i] = strings.ReplaceAll(template, "{field}", field)
+	}
+	if validation {
+		return strings.Join(lines, "\n")
+	}
+
+	catalogs.reportMissing(locale, text)
+	return text
+}
+
+// snakeCase turns a Go field name into the JSON name clients send, e.g.
+// "NewPassword" -> "new_password".
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func listCatalogs(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := authService.db.Collection("message_catalogs").Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch catalogs"})
+		return
+	}
+
+	var loaded []MessageCatalog
+	if err := cursor.All(context.Background(), &loaded); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode catalogs"})
+		return
+	}
+
+	result := []gin.H{}
+	for _, catalog := range loaded {
+		result = append(result, gin.H{
+			"locale":     catalog.Locale,
+			"messages":   len(catalog.Messages),
+			"missing":    len(catalog.Missing),
+			"updated_at": catalog.UpdatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"source_locale": sourceLocale, "catalogs": result})
+}
+
+func getCatalog(c *gin.Context) {
+	var catalog MessageCatalog
+	err := authService.db.Collection("message_catalogs").FindOne(context.Background(), bson.M{"_id": c.Param("locale")}).Decode(&catalog)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Catalog not found"})
+		return
+	}
+	if catalog.Missing == nil {
+		catalog.Missing = []string{}
+	}
+
+	c.JSON(http.StatusOK, catalog)
+}
+
+// putCatalog adds or updates the given translations, creating the catalog
+// on first use. An empty text removes a translation.
+func putCatalog(c *gin.Context) {
+	locale := c.Param("locale")
+	if !localePattern.MatchString(locale) || locale == sourceLocale {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid locale"})
+		return
+	}
+
+	var req struct {
+		Messages map[string]string `json:"messages" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := authService.db.Collection("message_catalogs")
+	catalog := MessageCatalog{Locale: locale}
+	collection.FindOne(context.Background(), bson.M{"_id": locale}).Decode(&catalog)
+
+	merged := map[string]string{}
+	for _, m := range catalog.Messages {
+		merged[m.Key] = m.Text
+	}
+	for key, text := range req.Messages {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if text == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = text
+		}
+	}
+
+	catalog.Messages = []CatalogMessage{}
+	for key, text := range merged {
+		catalog.Messages = append(catalog.Messages, CatalogMessage{Key: key, Text: text})
+	}
+	sort.Slice(catalog.Messages, func(i, j int) bool { return catalog.Messages[i].Key < catalog.Messages[j].Key })
+
+	missing := []string{}
+	for _, key := range catalog.Missing {
+		if _, ok := merged[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	catalog.Missing = missing
+	catalog.UpdatedAt = time.Now()
+	catalog.UpdatedBy = c.GetString("user_id")
+
+	_, err := collection.ReplaceOne(context.Background(), bson.M{"_id": locale}, catalog, options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save catalog"})
+		return
+	}
+	catalogs.invalidate(c.Request.Context())
+
+	recordAudit(c, AuditEvent{Type: "i18n.catalog_updated", Data: bson.M{"locale": locale, "keys": len(req.Messages)}})
+
+	c.JSON(http.StatusOK, catalog)
+}
+
+func deleteCatalog(c *gin.Context) {
+	locale := c.Param("locale")
+	result, err := authService.db.Collection("message_catalogs").DeleteOne(context.Background(), bson.M{"_id": locale})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Catalog not found"})
+		return
+	}
+	catalogs.invalidate(c.Request.Context())
+
+	recordAudit(c, AuditEvent{Type: "i18n.catalog_deleted", Data: bson.M{"locale": locale}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Catalog deleted"})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ImportCustomer is one customer record exported from the legacy platform.
+type ImportCustomer struct {
+	Email              string           `json:"email"`
+	Name               string           `json:"name"`
+	PasswordHash       string           `json:"password_hash"`
+	ForcePasswordReset bool             `json:"force_password_reset"`
+	CreatedAt          *time.Time       `json:"created_at"`
+	Addresses          []AddressRequest `json:"addresses"`
+	Orders             []LegacyOrder    `json:"orders"`
+}
+
+// LegacyOrder is a historical order summary; line items aren't migrated.
+type LegacyOrder struct {
+	LegacyID  string    `json:"legacy_id"`
+	PlacedAt  time.Time `json:"placed_at"`
+	Total     float64   `json:"total"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	ItemCount int       `json:"item_count"`
+}
+
+type ImportError struct {
+	Row   int    `json:"row"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	DryRun    bool          `json:"dry_run"`
+	Total     int           `json:"total"`
+	Created   int           `json:"created"`
+	Skipped   int           `json:"skipped"`
+	Addresses int           `json:"addresses"`
+	Orders    int           `json:"orders"`
+	Errors    []ImportError `json:"errors"`
+}
+
+const maxImportBytes = 50 << 20
+
+// importCustomers migrates customers from JSON, JSONL or CSV exports of the
+// legacy platform. Customers whose email already exists are skipped, so an
+// import can safely be re-run. With ?dry_run=true every record is validated
+// and the report returned without writing anything. Files over
+// maxImportBytes are rejected with 413 rather than cut short. The
+// cmd/customerimport tool uploads exports from the command line.
+//
+// CSV exports carry one customer per row with the columns email, name,
+// password_hash, force_password_reset, created_at and optionally a single
+// address as address_name, address_line1, address_line2, address_city,
+// address_region, address_postal_code and address_country. Order summaries
+// can only be imported from JSON.
+func importCustomers(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Import file is larger than %d MB; split it into smaller files", maxImportBytes>>20),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read import file"})
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		format = importFormat(c.ContentType())
+	}
+
+	customers, err := parseImport(format, body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := ImportReport{DryRun: dryRun, Total: len(customers), Errors: []ImportError{}}
+	seen := map[string]bool{}
+	users := authService.db.Collection("users")
+
+	for i, customer := range customers {
+		row := i + 1
+		customer.Email = strings.ToLower(strings.TrimSpace(customer.Email))
+
+		if err := validateImportCustomer(customer); err != nil {
+			report.Errors = append(report.Errors, ImportError{Row: row, Email: customer.Email, Error: err.Error()})
+			continue
+		}
+		if seen[customer.Email] {
+			report.Errors = append(report.Errors, ImportError{Row: row, Email: customer.Email, Error: "duplicate email in import"})
+			continue
+		}
+		seen[customer.Email] = true
+
+		count, err := users.CountDocuments(context.Background(), emailFilter(c, customer.Email))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing users"})
+			return
+		}
+		if count > 0 {
+			report.Skipped++
+			continue
+		}
+
+		report.Created++
+		report.Addresses += len(customer.Addresses)
+		report.Orders += len(customer.Orders)
+		if dryRun {
+			continue
+		}
+
+		if err := writeImportCustomer(c, customer); err != nil {
+			report.Created--
+			report.Errors = append(report.Errors, ImportError{Row: row, Email: customer.Email, Error: err.Error()})
+		}
+	}
+
+	if !dryRun {
+		recordAudit(c, AuditEvent{Type: "users.imported", Data: bson.M{"created": report.Created, "skipped": report.Skipped}})
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func importFormat(contentType string) string {
+	switch contentType {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson", "application/jsonl":
+		return "jsonl"
+	}
+	return "json"
+}
+
+func parseImport(format string, body []byte) ([]ImportCustomer, error) {
+	var customers []ImportCustomer
+
+	switch format {
+	case "json":
+		if err := json.Unmarshal(body, &customers); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	case "jsonl":
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 1<<20), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var customer ImportCustomer
+			if err := json.Unmarshal(scanner.Bytes(), &customer); err != nil {
+				return nil, fmt.Errorf("invalid JSON on line %d: %w", line, err)
+			}
+			customers = append(customers, customer)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case "csv":
+		return parseImportCSV(body)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	return customers, nil
+}
+
+func parseImportCSV(body []byte) ([]ImportCustomer, error) {
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV has no header row")
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	get := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	customers := []ImportCustomer{}
+	for _, record := range records[1:] {
+		customer := ImportCustomer{
+			Email:        get(record, "email"),
+			Name:         get(record, "name"),
+			PasswordHash: get(record, "password_hash"),
+		}
+		customer.ForcePasswordReset, _ = strconv.ParseBool(get(record, "force_password_reset"))
+		if createdAt, err := time.Parse(time.RFC3339, get(record, "created_at")); err == nil {
+			customer.CreatedAt = &createdAt
+		}
+
+		if line1 := get(record, "address_line1"); line1 != "" {
+			customer.Addresses = append(customer.Addresses, AddressRequest{
+				Name:       get(record, "address_name"),
+				Line1:      line1,
+				Line2:      get(record, "address_line2"),
+				City:       get(record, "address_city"),
+				Region:     get(record, "address_region"),
+				PostalCode: get(record, "address_postal_code"),
+				Country:    get(record, "address_country"),
+			})
+		}
+
+		customers = append(customers, customer)
+	}
+
+	return customers, nil
+}
+
+func validateImportCustomer(customer ImportCustomer) error {
+	if _, err := mail.ParseAddress(customer.Email); err != nil {
+		return errors.New("invalid email")
+	}
+	if strings.TrimSpace(customer.Name) == "" {
+		return errors.New("name is required")
+	}
+
+	if customer.PasswordHash == "" && !customer.ForcePasswordReset {
+		return errors.New("either password_hash or force_password_reset is required")
+	}
+	if customer.PasswordHash != "" {
+		if !isPasswordHash(customer.PasswordHash) {
+			return errors.New("password_hash is not a bcrypt or argon2id hash")
+		}
+	}
+
+	for i, address := range customer.Addresses {
+		if err := binding.Validator.ValidateStruct(address); err != nil {
+			return fmt.Errorf("address %d: %v", i+1, err)
+		}
+	}
+
+	for i, order := range customer.Orders {
+		if order.LegacyID == "" || order.PlacedAt.IsZero() {
+			return fmt.Errorf("order %d: legacy_id and placed_at are required", i+1)
+		}
+	}
+
+	return nil
+}
+
+func writeImportCustomer(c *gin.Context, customer ImportCustomer) error {
+	createdAt := time.Now()
+	if customer.CreatedAt != nil {
+		createdAt = *customer.CreatedAt
+	}
+
+	user := User{
+		Email:                 customer.Email,
+		Password:              customer.PasswordHash,
+		Name:                  customer.Name,
+		Role:                  "customer",
+		Active:                true,
+		TenantID:              tenantID(c),
+		CreatedAt:             createdAt,
+		PasswordResetRequired: customer.ForcePasswordReset || customer.PasswordHash == "",
+	}
+
+	result, err := authService.db.Collection("users").InsertOne(context.Background(), user)
+	if err != nil {
+		return errors.New("failed to create user")
+	}
+	userID := idString(result.InsertedID)
+	publishUserEvent(c.Request.Context(), EventUserRegistered, userID, bson.M{
+		"email": user.Email, "name": user.Name, "role": user.Role, "source": "import",
+	})
+
+	for i, req := range customer.Addresses {
+		if i == 0 {
+			req.DefaultShipping = true
+			req.DefaultBilling = true
+		}
+		address := Address{ID: primitive.NewObjectID().Hex(), UserID: userID, CreatedAt: time.Now()}
+		address.apply(req)
+		if _, err := authService.db.Collection("addresses").InsertOne(context.Background(), address); err != nil {
+			return errors.New("failed to create address")
+		}
+	}
+
+	if len(customer.Orders) > 0 {
+		if err := importLegacyOrders(c.Request.Context(), c.GetHeader("Authorization"), userID, customer.Orders); err != nil {
+			return fmt.Errorf("user created but orders failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func orderServiceURL() string {
+	if url := os.Getenv("ORDER_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://order-service:8004"
+}
+
+// importLegacyOrders hands the order summaries to the order service, which
+// owns the orders collection.
+func importLegacyOrders(ctx context.Context, authorization, userID string, orders []LegacyOrder) error {
+	body, _ := json.Marshal(gin.H{"user_id": userID, "orders": orders})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, orderServiceURL()+"/api/v1/admin/orders/import", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	return nil
+}
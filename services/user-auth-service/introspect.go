@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// introspectionClients holds the credentials downstream services use for
+// HTTP Basic auth on the introspection endpoint, from INTROSPECTION_CLIENTS
+// as "order-service:secret,payment-service:secret".
+var introspectionClients map[string]string
+
+func setupIntrospection() {
+	introspectionClients = map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("INTROSPECTION_CLIENTS"), ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && id != "" && secret != "" {
+			introspectionClients[id] = secret
+		}
+	}
+	if len(introspectionClients) == 0 {
+		log.Printf("INTROSPECTION_CLIENTS not set, token introspection is disabled")
+	}
+}
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func revokedKey(jti string) string {
+	return "revoked_token:" + jti
+}
+
+// revokeToken blacklists a token until it would have expired anyway.
+func revokeToken(ctx context.Context, claims jwt.MapClaims) {
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		return
+	}
+	ttl := time.Until(exp.Time)
+	if ttl <= 0 {
+		return
+	}
+	if err := redisClient.Set(ctx, revokedKey(jti), 1, ttl).Err(); err != nil {
+		log.Printf("Failed to revoke token %s: %v", jti, err)
+	}
+}
+
+func isRevoked(ctx context.Context, claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return false
+	}
+	n, err := redisClient.Exists(ctx, revokedKey(jti)).Result()
+	return err == nil && n > 0
+}
+
+// activeClaims parses a token and checks everything that can make a
+// validly signed token unusable: revocation, a deactivated account and,
+// for refresh tokens, a password change since it was issued.
+func activeClaims(ctx context.Context, tokenString string) (jwt.MapClaims, bool) {
+	token, err := parseToken(tokenString)
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if isRevoked(ctx, claims) {
+		return nil, false
+	}
+
+	sub, _ := claims["sub"].(string)
+	if role, _ := claims["role"].(string); role == guestRole || serviceClient(claims) != "" {
+		return claims, true
+	}
+
+	var user User
+	if err := authService.db.Collection("users").FindOne(ctx, userFilter(sub)).Decode(&user); err != nil || !user.Active {
+		return nil, false
+	}
+	if version, ok := claims["ver"].(float64); ok && int(version) != user.TokenVersion {
+		return nil, false
+	}
+	return claims, true
+}
+
+// introspect implements RFC 7662 token introspection so other services
+// can validate tokens without holding signing keys. Inactive, unknown and
+// malformed tokens all answer {"active": false}.
+func introspect(c *gin.Context) {
+	if _, ok := authenticateClient(c, "introspect"); !ok {
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	claims, active := activeClaims(c.Request.Context(), token)
+	if !active {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	tokenType := "access_token"
+	if _, ok := claims["ver"]; ok {
+		tokenType = "refresh_token"
+	}
+
+	response := gin.H{
+		"active":     true,
+		"token_type": tokenType,
+		"sub":        claims["sub"],
+		"role":       claims["role"],
+		"exp":        claims["exp"],
+		"iat":        claims["iat"],
+		"jti":        claims["jti"],
+	}
+	for _, optional := range []string{"email", "permissions", "scope", "aud", "impersonated_by", "tid"} {
+		if value, ok := claims[optional]; ok {
+			response[optional] = value
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
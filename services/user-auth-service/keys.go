@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one entry of the key set, identified by its kid.
+type signingKey struct {
+	kid     string
+	private crypto.Signer
+}
+
+// keySet holds the keys used to sign and verify tokens. With HS256 the
+// shared JWT secret is used; with RS256/ES256 every PEM private key in
+// JWT_KEYS_DIR is loaded (file name = kid), the active one signs new tokens
+// and all of them keep verifying, which allows rotating keys without
+// invalidating tokens that are still in flight.
+type keySet struct {
+	method jwt.SigningMethod
+	secret []byte
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+func loadKeySet(secret string) (*keySet, error) {
+	ks := &keySet{secret: []byte(secret), keys: map[string]*signingKey{}}
+
+	alg := strings.ToUpper(os.Getenv("JWT_SIGNING_ALG"))
+	switch alg {
+	case "", "HS256":
+		ks.method = jwt.SigningMethodHS256
+		return ks, nil
+	case "RS256":
+		ks.method = jwt.SigningMethodRS256
+	case "ES256":
+		ks.method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported JWT_SIGNING_ALG %q", alg)
+	}
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		if err := ks.loadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ks.keys) == 0 {
+		log.Printf("No signing keys found, generating an ephemeral %s key", alg)
+		key, err := ks.generate()
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[key.kid] = key
+	}
+
+	activeKid := os.Getenv("JWT_ACTIVE_KID")
+	if activeKid == "" {
+		// Default to the newest key by name, e.g. 2024-01 over 2023-07.
+		kids := make([]string, 0, len(ks.keys))
+		for kid := range ks.keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		activeKid = kids[len(kids)-1]
+	}
+
+	ks.active = ks.keys[activeKid]
+	if ks.active == nil {
+		return nil, fmt.Errorf("active signing key %q not found", activeKid)
+	}
+
+	return ks, nil
+}
+
+func (ks *keySet) loadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM data", file)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if ks.method == jwt.SigningMethodRS256 {
+				parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			} else {
+				parsed, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		signer, ok := parsed.(crypto.Signer)
+		if !ok || !ks.matchesMethod(signer) {
+			return fmt.Errorf("%s: key type does not match %s", file, ks.method.Alg())
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		ks.keys[kid] = &signingKey{kid: kid, private: signer}
+	}
+
+	return nil
+}
+
+func (ks *keySet) matchesMethod(signer crypto.Signer) bool {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return ks.method == jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		return ks.method == jwt.SigningMethodES256
+	}
+	return false
+}
+
+func (ks *keySet) generate() (*signingKey, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	if ks.method == jwt.SigningMethodRS256 {
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kidBytes := make([]byte, 8)
+	rand.Read(kidBytes)
+	return &signingKey{kid: fmt.Sprintf("%x", kidBytes), private: signer}, nil
+}
+
+// sign serializes the claims with the active key and stamps its kid.
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+	if ks.active == nil {
+		return token.SignedString(ks.secret)
+	}
+	token.Header["kid"] = ks.active.kid
+	return token.SignedString(ks.active.private)
+}
+
+// keyFunc resolves the verification key from the token's kid and rejects
+// tokens signed with any other algorithm.
+func (ks *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != ks.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	if ks.active == nil {
+		return ks.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key.private.Public(), nil
+}
+
+func parseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, authService.keys.keyFunc)
+}
+
+func jwks(c *gin.Context) {
+	keys := []gin.H{}
+	for _, key := range authService.keys.keys {
+		keys = append(keys, publicJWK(key))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func publicJWK(key *signingKey) gin.H {
+	jwk := gin.H{
+		"kid": key.kid,
+		"use": "sig",
+		"alg": authService.keys.method.Alg(),
+	}
+
+	switch pub := key.private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64URL(pub.N)
+		jwk["e"] = base64URL(big.NewInt(int64(pub.E)))
+	case *ecdsa.PublicKey:
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+
+	return jwk
+}
+
+func base64URL(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
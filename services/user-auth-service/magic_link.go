@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// magicLinkTTL is how long an emailed login link stays valid, from
+// MAGIC_LINK_TTL (default 15m).
+func magicLinkTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("MAGIC_LINK_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 15 * time.Minute
+}
+
+// requestMagicLink emails a one-time login link. Like forgotPassword it
+// answers the same way whether or not the account exists.
+func requestMagicLink(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If the account exists, a login link has been sent"}
+
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), emailFilter(c, req.Email)).Decode(&user)
+	if err != nil || !user.Active {
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	token, tokenHash := newOneTimeToken()
+	_, err = authService.db.Collection("magic_links").InsertOne(context.Background(), bson.M{
+		"user_id":    user.ID,
+		"token_hash": tokenHash,
+		"expires_at": time.Now().Add(magicLinkTTL()),
+		"used":       false,
+		"created_at": time.Now(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+
+	sendEmail(user.Email, "Your login link",
+		"Use this link to sign in: "+appURL("/account/login/magic?token="+token)+
+			"\n\nIt expires in "+magicLinkTTL().String()+" and can only be used once.")
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+// exchangeMagicLink trades a login link token for a normal token pair.
+func exchangeMagicLink(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var link struct {
+		UserID string `bson:"user_id"`
+	}
+	err := authService.db.Collection("magic_links").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true, "used_at": time.Now()}},
+	).Decode(&link)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+
+	var user User
+	err = authService.db.Collection("users").FindOne(context.Background(), userFilter(link.UserID)).Decode(&user)
+	if err != nil || !user.Active {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+
+	if !requirePolicyAcceptance(c, &user) {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "login.magic_link", UserID: user.ID, ActorID: user.ID})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
@@ -2,33 +2,60 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID       string `bson:"_id,omitempty" json:"id"`
-	Email    string `bson:"email" json:"email"`
-	Password string `bson:"password" json:"-"`
-	Role     string `bson:"role" json:"role"`
-	Name     string `bson:"name" json:"name"`
-	Active   bool   `bson:"active" json:"active"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ID                    string    `bson:"_id,omitempty" json:"id"`
+	Email                 string    `bson:"email" json:"email"`
+	Password              string    `bson:"password" json:"-"`
+	Role                  string    `bson:"role" json:"role"`
+	Name                  string    `bson:"name" json:"name"`
+	Active                bool      `bson:"active" json:"active"`
+	TenantID              string    `bson:"tenant_id" json:"tenant_id"`
+	CreatedAt             time.Time `bson:"created_at" json:"created_at"`
+	TokenVersion          int       `bson:"token_version" json:"-"`
+	PasswordResetRequired bool      `bson:"password_reset_required,omitempty" json:"-"`
+	// Previous password hashes, newest first, see password_history.go
+	PasswordHistory []PasswordHistoryEntry `bson:"password_history,omitempty" json:"-"`
+	// Staff-only fields, exposed through the admin endpoints
+	Tags  []string       `bson:"tags,omitempty" json:"-"`
+	Notes []InternalNote `bson:"internal_notes,omitempty" json:"-"`
+	// External identity provider subjects linked to this account
+	Identities []Identity `bson:"identities,omitempty" json:"-"`
+	// Phone number for SMS login, only set once verified, see phone.go
+	Phone         string `bson:"phone,omitempty" json:"phone,omitempty"`
+	PhoneVerified bool   `bson:"phone_verified,omitempty" json:"phone_verified"`
+	// B2B company account the user orders for, see organizations.go
+	Organization *OrgMembership `bson:"organization,omitempty" json:"organization,omitempty"`
+	// Public URL of the profile picture, see avatar.go
+	AvatarURL string `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	// Locale, currency and notification settings, see preferences.go
+	Preferences *Preferences `bson:"preferences,omitempty" json:"preferences,omitempty"`
+	// Accepted terms and privacy policy versions by policy, see policies.go
+	PolicyAcceptances map[string]PolicyAcceptance `bson:"policy_acceptances,omitempty" json:"policy_acceptances,omitempty"`
 }
 
 type LoginRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Email        string `json:"email" binding:"required,email"`
+	Password     string `json:"password" binding:"required,min=6"`
+	CaptchaToken string `json:"captcha_token"`
+	// Stable per-install identifier used to recognise the device
+	DeviceID string `json:"device_id"`
+	// Optional least-privilege limits, see claims.go
+	Scope    string   `json:"scope"`
+	Audience []string `json:"audience"`
 }
 
 type TokenResponse struct {
@@ -40,6 +67,7 @@ type TokenResponse struct {
 type AuthService struct {
 	db        *mongo.Database
 	jwtSecret string
+	keys      *keySet
 }
 
 var authService *AuthService
@@ -74,23 +102,155 @@ func main() {
 		authService.jwtSecret = "your-secret-key-change-in-production"
 	}
 
+	authService.keys, err = loadKeySet(authService.jwtSecret)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
+	setupTenants()
+	setupPasswordHashing()
+
 	// Create indexes
 	createIndexes(db)
 
+	connectRedis()
+	setupSSO()
+	setupSocialLogin()
+	setupStorage()
+	setupCaptcha()
+	setupSMS()
+	setupEmailPolicy()
+	setupRoles()
+	setupI18n()
+	setupPolicies()
+	setupIntrospection()
+	setupServiceClients()
+	setupTokenClaims()
+	startPasswordHistoryPruner()
+	loginIPLimit := parseRateLimit("RATE_LIMIT_LOGIN_IP", "20/1m")
+	loginAccountLimit := parseRateLimit("RATE_LIMIT_LOGIN_ACCOUNT", "5/15m")
+	registerIPLimit := parseRateLimit("RATE_LIMIT_REGISTER_IP", "10/1h")
+	registerAccountLimit := parseRateLimit("RATE_LIMIT_REGISTER_ACCOUNT", "3/1h")
+	refreshIPLimit := parseRateLimit("RATE_LIMIT_REFRESH_IP", "60/1m")
+	guestIPLimit := parseRateLimit("RATE_LIMIT_GUEST_IP", "30/1m")
+	reactivateIPLimit := parseRateLimit("RATE_LIMIT_REACTIVATE_IP", "10/1h")
+	reactivateAccountLimit := parseRateLimit("RATE_LIMIT_REACTIVATE_ACCOUNT", "3/1h")
+	magicLinkIPLimit := parseRateLimit("RATE_LIMIT_MAGIC_LINK_IP", "10/1h")
+	magicLinkAccountLimit := parseRateLimit("RATE_LIMIT_MAGIC_LINK_ACCOUNT", "3/15m")
+	otpIPLimit := parseRateLimit("RATE_LIMIT_OTP_IP", "20/1h")
+	otpVerifyIPLimit := parseRateLimit("RATE_LIMIT_OTP_VERIFY_IP", "30/15m")
+
 	// Gin Router
 	router := gin.Default()
+	router.Use(i18nMiddleware, tenantMiddleware)
 
 	// Health Check
 	router.GET("/health", healthCheck)
 	router.GET("/ready", readinessCheck)
+	router.GET("/.well-known/jwks.json", jwks)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// Auth Routes
-	router.POST("/api/v1/auth/register", register)
-	router.POST("/api/v1/auth/login", login)
-	router.POST("/api/v1/auth/refresh", refreshToken)
+	router.POST("/api/v1/auth/register", rateLimitMiddleware("register", &registerIPLimit, &registerAccountLimit), register)
+	router.POST("/api/v1/auth/login", rateLimitMiddleware("login", &loginIPLimit, &loginAccountLimit), login)
+	router.POST("/api/v1/auth/login/confirm", rateLimitMiddleware("login_confirm", &refreshIPLimit, nil), confirmLogin)
+	router.POST("/api/v1/auth/refresh", rateLimitMiddleware("refresh", &refreshIPLimit, nil), refreshToken)
+	router.POST("/api/v1/auth/introspect", introspect)
+	router.POST("/api/v1/auth/service-token", issueServiceToken)
 	router.POST("/api/v1/auth/logout", logout)
+	router.POST("/api/v1/auth/guest", rateLimitMiddleware("guest", &guestIPLimit, nil), issueGuestToken)
+	router.POST("/api/v1/auth/guest/upgrade", authMiddleware, upgradeGuest)
+	router.GET("/api/v1/auth/sso/login", ssoLogin)
+	router.GET("/api/v1/auth/sso/callback", ssoCallback)
+	router.GET("/api/v1/auth/social/:provider/login", socialLogin)
+	router.GET("/api/v1/auth/social/:provider/callback", socialCallback)
+	router.POST("/api/v1/auth/social/:provider/callback", socialCallback)
+	router.POST("/api/v1/auth/social/:provider/link", authMiddleware, denyImpersonation, startIdentityLink)
+	router.GET("/api/v1/auth/identities", authMiddleware, listIdentities)
+	router.DELETE("/api/v1/auth/identities/:provider", authMiddleware, denyImpersonation, unlinkIdentity)
+	router.POST("/api/v1/auth/identities/confirm", rateLimitMiddleware("identity_confirm", &refreshIPLimit, nil), confirmIdentityLink)
+	router.POST("/api/v1/auth/account/merge", authMiddleware, denyImpersonation, rateLimitMiddleware("account_merge", &magicLinkIPLimit, nil), requestAccountMerge)
+	router.POST("/api/v1/auth/account/merge/confirm", rateLimitMiddleware("account_merge_confirm", &refreshIPLimit, nil), confirmAccountMerge)
 	router.GET("/api/v1/auth/profile", authMiddleware, getProfile)
 	router.PUT("/api/v1/auth/profile", authMiddleware, updateProfile)
+	router.POST("/api/v1/auth/profile/avatar", authMiddleware, denyImpersonation, uploadAvatar)
+	router.DELETE("/api/v1/auth/profile/avatar", authMiddleware, denyImpersonation, deleteAvatar)
+	router.GET("/api/v1/auth/profile/preferences", authMiddleware, getPreferences)
+	router.POST("/api/v1/auth/deactivate", authMiddleware, denyImpersonation, deactivateAccount)
+	router.POST("/api/v1/auth/reactivate", rateLimitMiddleware("reactivate", &reactivateIPLimit, &reactivateAccountLimit), requestReactivation)
+	router.POST("/api/v1/auth/reactivate/confirm", confirmReactivation)
+	router.PUT("/api/v1/auth/profile/preferences", authMiddleware, updatePreferences)
+	router.GET("/api/v1/auth/devices", authMiddleware, listDevices)
+	router.POST("/api/v1/auth/devices/:id/approve", authMiddleware, denyImpersonation, approveDevice)
+	router.DELETE("/api/v1/auth/devices/:id", authMiddleware, denyImpersonation, revokeDevice)
+	router.PUT("/api/v1/auth/password", authMiddleware, denyImpersonation, changePassword)
+	router.POST("/api/v1/auth/password/forgot", rateLimitMiddleware("forgot", &registerIPLimit, &registerAccountLimit), forgotPassword)
+	router.POST("/api/v1/auth/password/reset", resetPassword)
+	router.POST("/api/v1/auth/magic-link", rateLimitMiddleware("magic_link", &magicLinkIPLimit, &magicLinkAccountLimit), requestMagicLink)
+	router.POST("/api/v1/auth/magic-link/exchange", rateLimitMiddleware("magic_link_exchange", &refreshIPLimit, nil), exchangeMagicLink)
+	router.POST("/api/v1/auth/login/phone", rateLimitMiddleware("otp_send", &otpIPLimit, nil), requestPhoneLogin)
+	router.POST("/api/v1/auth/login/phone/verify", rateLimitMiddleware("otp_verify", &otpVerifyIPLimit, nil), exchangePhoneLogin)
+	router.POST("/api/v1/auth/phone", authMiddleware, denyImpersonation, rateLimitMiddleware("otp_send", &otpIPLimit, nil), requestPhoneVerification)
+	router.POST("/api/v1/auth/phone/verify", authMiddleware, denyImpersonation, rateLimitMiddleware("otp_verify", &otpVerifyIPLimit, nil), confirmPhoneVerification)
+	router.DELETE("/api/v1/auth/phone", authMiddleware, denyImpersonation, removePhone)
+	router.POST("/api/v1/auth/email/change", authMiddleware, denyImpersonation, requestEmailChange)
+	router.POST("/api/v1/auth/email/confirm", confirmEmailChange)
+	router.POST("/api/v1/auth/email/undo", undoEmailChange)
+	router.GET("/api/v1/auth/policies", listPolicies)
+	router.POST("/api/v1/auth/policies/accept", rateLimitMiddleware("policy_accept", &refreshIPLimit, nil), acceptPolicies)
+
+	// Admin Routes
+	admin := router.Group("/api/v1/admin", scopedAuthMiddleware)
+	admin.GET("/users", requirePermission("users:read"), searchUsers)
+	admin.GET("/users/:id", requirePermission("users:read"), adminGetUser)
+	admin.GET("/users/:id/tags", requirePermission("users:read"), getUserTags)
+	admin.PUT("/users/:id/tags", requirePermission("users:tags:write"), setUserTags)
+	admin.POST("/users/:id/notes", requirePermission("users:notes:write"), addUserNote)
+	admin.GET("/users/:id/preferences", requirePermission("users:read"), adminGetPreferences)
+	admin.GET("/users/:id/devices", requirePermission("users:read"), adminListDevices)
+	admin.PUT("/users/:id/role", requirePermission("users:roles:write"), setUserRole)
+	admin.POST("/import/customers", requirePermission("users:import"), importCustomers)
+	admin.POST("/users/:id/impersonate", requirePermission("users:impersonate"), impersonateUser)
+	admin.GET("/organizations", requirePermission("organizations:read"), adminListOrganizations)
+	admin.PUT("/organizations/:id/payment-terms", requirePermission("organizations:write"), setPaymentTerms)
+
+	// Role Routes
+	admin.GET("/roles", requirePermission("roles:manage"), listRoles)
+	admin.PUT("/roles/:name", requirePermission("roles:manage"), putRole)
+	admin.DELETE("/roles/:name", requirePermission("roles:manage"), deleteRole)
+
+	// Translation Routes
+	admin.GET("/i18n/catalogs", requirePermission("i18n:read"), listCatalogs)
+	admin.GET("/i18n/catalogs/:locale", requirePermission("i18n:read"), getCatalog)
+	admin.PUT("/i18n/catalogs/:locale", requirePermission("i18n:write"), putCatalog)
+	admin.DELETE("/i18n/catalogs/:locale", requirePermission("i18n:write"), deleteCatalog)
+
+	// Organization Routes
+	router.POST("/api/v1/organizations", authMiddleware, createOrganization)
+	router.GET("/api/v1/organization", authMiddleware, getOrganization)
+	router.PUT("/api/v1/organization", authMiddleware, updateOrganization)
+	router.POST("/api/v1/organization/members", authMiddleware, inviteOrganizationMember)
+	router.PUT("/api/v1/organization/members/:id", authMiddleware, updateOrganizationMember)
+	router.DELETE("/api/v1/organization/members/:id", authMiddleware, removeOrganizationMember)
+	router.GET("/api/v1/organization/invites", authMiddleware, listOrganizationInvites)
+	router.POST("/api/v1/organization/invites/:id/accept", authMiddleware, denyImpersonation, acceptOrganizationInvite)
+	router.POST("/api/v1/organization/invites/:id/decline", authMiddleware, denyImpersonation, declineOrganizationInvite)
+	router.GET("/api/v1/organization/addresses", authMiddleware, listOrganizationAddresses)
+	router.POST("/api/v1/organization/addresses", authMiddleware, createOrganizationAddress)
+	router.PUT("/api/v1/organization/addresses/:id", authMiddleware, updateOrganizationAddress)
+	router.DELETE("/api/v1/organization/addresses/:id", authMiddleware, deleteOrganizationAddress)
+	router.POST("/api/v1/organization/order-requests", authMiddleware, submitOrderRequest)
+	router.GET("/api/v1/organization/order-requests", authMiddleware, listOrderRequests)
+	router.POST("/api/v1/organization/order-requests/:id/approve", authMiddleware, denyImpersonation, approveOrderRequest)
+	router.POST("/api/v1/organization/order-requests/:id/reject", authMiddleware, denyImpersonation, rejectOrderRequest)
+	router.POST("/api/v1/organization/order-requests/:id/cancel", authMiddleware, cancelOrderRequest)
+
+	// Address Book Routes
+	router.GET("/api/v1/auth/addresses", authMiddleware, listAddresses)
+	router.POST("/api/v1/auth/addresses", authMiddleware, createAddress)
+	router.GET("/api/v1/auth/addresses/:id", authMiddleware, getAddress)
+	router.PUT("/api/v1/auth/addresses/:id", authMiddleware, updateAddress)
+	router.DELETE("/api/v1/auth/addresses/:id", authMiddleware, deleteAddress)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -104,12 +264,102 @@ func main() {
 }
 
 func createIndexes(db *mongo.Database) {
-	collection := db.Collection("users")
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{{Key: "email", Value: 1}},
+	// Emails are unique per tenant, see tenant.go
+	migrateTenants(db)
+	createUserSearchIndexes(db)
+
+	_, err := db.Collection("addresses").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	// Expired login links are cleaned up by Mongo
+	_, err = db.Collection("magic_links").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("login_challenges").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("policy_challenges").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("identity_links").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("account_merges").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("login_devices").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "fingerprint", Value: 1}},
 		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
 	}
-	_, err := collection.Indexes().CreateOne(context.Background(), indexModel)
+
+	_, err = db.Collection("users").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "organization.id", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	// Verified phone numbers identify an account for SMS login
+	_, err = db.Collection("users").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "phone", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"phone_verified": true}),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("phone_otps").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("order_requests").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "organization_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	_, err = db.Collection("organization_invites").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}},
+	})
 	if err != nil {
 		log.Printf("Failed to create index: %v", err)
 	}
@@ -144,9 +394,12 @@ func readinessCheck(c *gin.Context) {
 
 func register(c *gin.Context) {
 	var req struct {
-		Email    string `json:"email" binding:"required,email"`
-		Password string `json:"password" binding:"required,min=8"`
-		Name     string `json:"name" binding:"required"`
+		Email        string `json:"email" binding:"required,email"`
+		Password     string `json:"password" binding:"required,min=8"`
+		Name         string `json:"name" binding:"required"`
+		CaptchaToken string `json:"captcha_token"`
+		// The user ticked the terms of service and privacy policy box
+		AcceptPolicies bool `json:"accept_policies"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -154,8 +407,21 @@ func register(c *gin.Context) {
 		return
 	}
 
+	if captcha != nil && captchaOnRegister && !verifyCaptcha(c, req.CaptchaToken) {
+		return
+	}
+
+	if !requireSignupAcceptance(c, req.AcceptPolicies) {
+		return
+	}
+
+	// Everyone signs up as a customer; staff roles are given by an admin
+	if !enforceEmailPolicy(c, "registration", req.Email) {
+		return
+	}
+
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
@@ -163,11 +429,14 @@ func register(c *gin.Context) {
 
 	user := User{
 		Email:     req.Email,
-		Password:  string(hashedPassword),
+		Password:  hashedPassword,
 		Name:      req.Name,
 		Role:      "customer",
 		Active:    true,
+		TenantID:  tenantID(c),
 		CreatedAt: time.Now(),
+
+		PolicyAcceptances: currentAcceptances(c),
 	}
 
 	collection := authService.db.Collection("users")
@@ -177,6 +446,10 @@ func register(c *gin.Context) {
 		return
 	}
 
+	publishUserEvent(c.Request.Context(), EventUserRegistered, idString(result.InsertedID), bson.M{
+		"email": user.Email, "name": user.Name, "role": user.Role, "source": "register",
+	})
+
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "User registered successfully",
 		"user_id": result.InsertedID,
@@ -190,23 +463,61 @@ func login(c *gin.Context) {
 		return
 	}
 
+	ctx := c.Request.Context()
+	if loginCaptchaRequired(ctx, req.Email) && !verifyCaptcha(c, req.CaptchaToken) {
+		return
+	}
+
 	collection := authService.db.Collection("users")
 	var user User
-	err := collection.FindOne(context.Background(), bson.M{"email": req.Email}).Decode(&user)
+	err := collection.FindOne(context.Background(), emailFilter(c, req.Email)).Decode(&user)
 	if err != nil {
+		recordLoginFailure(ctx, req.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
 	// Verify password
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
-	if err != nil {
+	ok, rehash := verifyPassword(user.Password, req.Password)
+	if !ok {
+		recordLoginFailure(ctx, req.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	clearLoginFailures(ctx, req.Email)
+
+	// Upgrade bcrypt or outdated Argon2id hashes while we have the plaintext
+	if rehash {
+		rehashPassword(ctx, &user, req.Password)
+	}
+
+	if !user.Active {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated", "code": "account_deactivated"})
+		return
+	}
+
+	// Migrated accounts may have to choose a new password first
+	if user.PasswordResetRequired {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password reset required", "code": "password_reset_required"})
+		return
+	}
+
+	opts, err := resolveTokenOptions(user.Role, req.Scope, req.Audience, nil)
+	if err != nil {
+		tokenOptionsError(c, err)
+		return
+	}
+
+	if !checkLoginDevice(c, &user, req.DeviceID) {
+		return
+	}
+
+	if !requirePolicyAcceptance(c, &user) {
+		return
+	}
 
 	// Generate tokens
-	accessToken, refreshToken, expiresIn := generateTokens(user.ID, user.Email, user.Role)
+	accessToken, refreshToken, expiresIn := generateScopedTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion, opts)
 
 	c.JSON(http.StatusOK, TokenResponse{
 		AccessToken:  accessToken,
@@ -218,6 +529,9 @@ func login(c *gin.Context) {
 func refreshToken(c *gin.Context) {
 	var req struct {
 		RefreshToken string `json:"refresh_token" binding:"required"`
+		// Narrow the refreshed tokens further, see claims.go
+		Scope    string   `json:"scope"`
+		Audience []string `json:"audience"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -226,9 +540,7 @@ func refreshToken(c *gin.Context) {
 	}
 
 	// Validate refresh token
-	token, err := jwt.Parse(req.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-		return []byte(authService.jwtSecret), nil
-	})
+	token, err := parseToken(req.RefreshToken)
 
 	if err != nil || !token.Valid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
@@ -236,11 +548,29 @@ func refreshToken(c *gin.Context) {
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
+	if !isRefreshToken(claims) || isRevoked(c.Request.Context(), claims) || tokenTenant(claims) != tenantID(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
 	userID := claims["sub"].(string)
-	email := claims["email"].(string)
-	role := claims["role"].(string)
 
-	accessToken, newRefreshToken, expiresIn := generateTokens(userID, email, role)
+	// Refresh tokens issued before the last password change are revoked.
+	var user User
+	err = authService.db.Collection("users").FindOne(context.Background(), userFilter(userID)).Decode(&user)
+	version, _ := claims["ver"].(float64)
+	if err != nil || int(version) != user.TokenVersion || !user.Active {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	issued := refreshTokenOptions(claims)
+	opts, err := resolveTokenOptions(user.Role, req.Scope, req.Audience, &issued)
+	if err != nil {
+		tokenOptionsError(c, err)
+		return
+	}
+
+	accessToken, newRefreshToken, expiresIn := generateScopedTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion, opts)
 
 	c.JSON(http.StatusOK, TokenResponse{
 		AccessToken:  accessToken,
@@ -249,8 +579,40 @@ func refreshToken(c *gin.Context) {
 	})
 }
 
+// logout revokes the access token in the Authorization header and the
+// refresh token in the body. Either one is enough, so a client whose access
+// token has already expired can still end the session with its refresh
+// token; holding a refresh token is proof enough that the session is the
+// caller's.
 func logout(c *gin.Context) {
-	// In production, add token to blacklist
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	c.ShouldBindJSON(&req)
+
+	ctx := c.Request.Context()
+	revoked := false
+	if token, err := parseToken(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")); err == nil && token.Valid {
+		revokeToken(ctx, token.Claims.(jwt.MapClaims))
+		revoked = true
+	}
+
+	if req.RefreshToken != "" {
+		token, err := parseToken(req.RefreshToken)
+		if err == nil && token.Valid {
+			claims := token.Claims.(jwt.MapClaims)
+			if isRefreshToken(claims) {
+				revokeToken(ctx, claims)
+				revoked = true
+			}
+		}
+	}
+
+	if !revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No valid access or refresh token"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
@@ -259,7 +621,7 @@ func getProfile(c *gin.Context) {
 	
 	collection := authService.db.Collection("users")
 	var user User
-	err := collection.FindOne(context.Background(), bson.M{"_id": userID}).Decode(&user)
+	err := collection.FindOne(context.Background(), userFilter(userID)).Decode(&user)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
@@ -283,7 +645,7 @@ func updateProfile(c *gin.Context) {
 	collection := authService.db.Collection("users")
 	_, err := collection.UpdateOne(
 		context.Background(),
-		bson.M{"_id": userID},
+		userFilter(userID),
 		bson.M{"$set": bson.M{"name": req.Name}},
 	)
 
@@ -292,37 +654,58 @@ func updateProfile(c *gin.Context) {
 		return
 	}
 
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"name"}, "name": req.Name})
+
 	c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully"})
 }
 
-func generateTokens(userID, email, role string) (string, string, int64) {
-	accessTokenExpiry := time.Now().Add(15 * time.Minute)
-	refreshTokenExpiry := time.Now().Add(7 * 24 * time.Hour)
-
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":   userID,
-		"email": email,
-		"role":  role,
-		"exp":   accessTokenExpiry.Unix(),
-		"iat":   time.Now().Unix(),
-	})
-
-	accessTokenString, _ := accessToken.SignedString([]byte(authService.jwtSecret))
-
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":   userID,
-		"email": email,
-		"role":  role,
-		"exp":   refreshTokenExpiry.Unix(),
-		"iat":   time.Now().Unix(),
-	})
+func generateTokens(tenantID, userID, email, role string, tokenVersion int) (string, string, int64) {
+	return generateScopedTokens(tenantID, userID, email, role, tokenVersion, tokenOptions{Audience: defaultAudience})
+}
 
-	refreshTokenString, _ := refreshToken.SignedString([]byte(authService.jwtSecret))
+// generateScopedTokens issues an access and refresh token pair limited to
+// opts. Refreshing keeps the same limits.
+func generateScopedTokens(tenantID, userID, email, role string, tokenVersion int, opts tokenOptions) (string, string, int64) {
+	accessTokenExpiry := time.Now().Add(accessTokenTTL)
+	refreshTokenExpiry := time.Now().Add(refreshTokenTTL)
+
+	accessTokenString, _ := authService.keys.sign(newClaims(tenantID, userID, role).
+		email(email).
+		permissions(role, opts.Scopes).
+		audience(opts.Audience).
+		expiresAt(accessTokenExpiry).
+		build())
+
+	refresh := newClaims(tenantID, userID, role).
+		email(email).
+		set("typ", tokenTypeRefresh).
+		set("ver", tokenVersion).
+		expiresAt(refreshTokenExpiry)
+	if len(opts.Scopes) > 0 {
+		refresh.set("scope", strings.Join(opts.Scopes, " "))
+	}
+	if len(opts.Audience) > 0 {
+		refresh.set("req_aud", opts.Audience)
+	}
+	refreshTokenString, _ := authService.keys.sign(refresh.build())
 
 	return accessTokenString, refreshTokenString, accessTokenExpiry.Unix()
 }
 
+// authMiddleware requires a valid access token on routes acting as the
+// caller. Scoped tokens need the account scope to get through, so a token
+// scoped to, say, orders:read can't be used as its holder everywhere else.
 func authMiddleware(c *gin.Context) {
+	authenticate(c, true)
+}
+
+// scopedAuthMiddleware is authMiddleware for routes guarded by
+// requirePermission, which checks a scoped token's scopes itself.
+func scopedAuthMiddleware(c *gin.Context) {
+	authenticate(c, false)
+}
+
+func authenticate(c *gin.Context, asAccount bool) {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing authorization header"})
@@ -331,9 +714,7 @@ func authMiddleware(c *gin.Context) {
 	}
 
 	tokenString := authHeader[7:] // Remove "Bearer "
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(authService.jwtSecret), nil
-	})
+	token, err := parseToken(tokenString)
 
 	if err != nil || !token.Valid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -342,8 +723,57 @@ func authMiddleware(c *gin.Context) {
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
+
+	if isRevoked(c.Request.Context(), claims) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+		c.Abort()
+		return
+	}
+
+	// Tokens addressed to other services only can't be used here, nor can
+	// refresh tokens
+	if !audienceAllowed(claims) || isRefreshToken(claims) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	// Tokens are only valid for the store that issued them
+	if tokenTenant(claims) != tenantID(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	// Guests and services have no account to deactivate
+	if role, _ := claims["role"].(string); role != guestRole && serviceClient(claims) == "" {
+		if sub, _ := claims["sub"].(string); !isActive(c.Request.Context(), sub) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is deactivated"})
+			c.Abort()
+			return
+		}
+	}
+
+	if asAccount && !accountScoped(claims) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+		c.Abort()
+		return
+	}
+
 	c.Set("user_id", claims["sub"])
 	c.Set("email", claims["email"])
 	c.Set("role", claims["role"])
+	if client := serviceClient(claims); client != "" {
+		c.Set("service_client", client)
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		c.Set("scopes", splitList(scope, " "))
+	}
+	if impersonator, ok := claims["impersonated_by"].(string); ok {
+		c.Set("impersonated_by", impersonator)
+		c.Next()
+		auditImpersonatedRequest(c)
+		return
+	}
 	c.Next()
 }
\ No newline at end of file
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+func notificationServiceURL() string {
+	if url := os.Getenv("NOTIFICATION_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://notification-service:8008"
+}
+
+// sendEmail hands an email to the notification service in the background.
+// Delivery failures are logged and never fail the calling request.
+func sendEmail(to, subject, body string) {
+	payload, _ := json.Marshal(map[string]string{
+		"to":      to,
+		"subject": subject,
+		"body":    body,
+	})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, notificationServiceURL()+"/api/v1/notifications/email", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Failed to build notification request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := notificationClient.Do(req)
+		if err != nil {
+			log.Printf("Failed to send email %q to %s: %v", subject, to, err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			log.Printf("Notification service returned %d for email %q to %s", resp.StatusCode, subject, to)
+		}
+	}()
+}
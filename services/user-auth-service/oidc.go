@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+// Identity links a local account to a subject at an external identity
+// provider.
+type Identity struct {
+	// Social login provider name, see social.go; empty for corporate SSO
+	Provider string    `bson:"provider,omitempty" json:"provider,omitempty"`
+	Issuer   string    `bson:"issuer" json:"issuer"`
+	Subject  string    `bson:"subject" json:"subject"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// ssoProvider delegates authentication to a corporate OIDC identity
+// provider. IdP groups are mapped to local roles through OIDC_ROLE_MAPPING,
+// e.g. {"ecommerce-admins": "admin", "helpdesk": "support"}. The mapping
+// only sets the role of accounts created through SSO; later role changes
+// are made by an admin.
+type ssoProvider struct {
+	issuer      string
+	config      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	groupsClaim string
+	roleMapping map[string]string
+	defaultRole string
+}
+
+const oidcStateTTL = 10 * time.Minute
+
+// errSSOEmailTaken is returned when the IdP email belongs to a local
+// account that was never linked to this IdP subject.
+var errSSOEmailTaken = errors.New("email belongs to an unlinked account")
+
+var sso *ssoProvider
+
+func setupSSO() {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		log.Printf("OIDC discovery failed, SSO disabled: %v", err)
+		return
+	}
+
+	p := &ssoProvider{
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier:    provider.Verifier(&oidc.Config{ClientID: os.Getenv("OIDC_CLIENT_ID")}),
+		groupsClaim: os.Getenv("OIDC_GROUPS_CLAIM"),
+		roleMapping: map[string]string{},
+		defaultRole: os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if p.groupsClaim == "" {
+		p.groupsClaim = "groups"
+	}
+	if p.defaultRole == "" {
+		p.defaultRole = "customer"
+	}
+	if raw := os.Getenv("OIDC_ROLE_MAPPING"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &p.roleMapping); err != nil {
+			log.Printf("Invalid OIDC_ROLE_MAPPING, all SSO users get %s: %v", p.defaultRole, err)
+		}
+	}
+
+	sso = p
+}
+
+// roleFor picks the most privileged local role any of the groups maps to.
+func (p *ssoProvider) roleFor(groups []string) string {
+	rank := map[string]int{"customer": 0, "support": 1, "admin": 2}
+
+	role := p.defaultRole
+	for _, group := range groups {
+		mapped, ok := p.roleMapping[group]
+		if ok && rank[mapped] > rank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+func ssoLogin(c *gin.Context) {
+	if sso == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not configured"})
+		return
+	}
+
+	state, _ := newOneTimeToken()
+	nonce, _ := newOneTimeToken()
+
+	err := redisClient.Set(c.Request.Context(), "oidc:state:"+state, nonce, oidcStateTTL).Err()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SSO temporarily unavailable"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, sso.config.AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+func ssoCallback(c *gin.Context) {
+	if sso == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not configured"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	nonce, err := redisClient.GetDel(ctx, "oidc:state:"+c.Query("state")).Result()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired SSO state"})
+		return
+	}
+
+	oauthToken, err := sso.config.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "SSO code exchange failed"})
+		return
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "SSO response missing id_token"})
+		return
+	}
+
+	idToken, err := sso.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid id_token"})
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid id_token claims"})
+		return
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "IdP did not return an email"})
+		return
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "IdP email is not verified"})
+		return
+	}
+	name, _ := claims["name"].(string)
+
+	var groups []string
+	if raw, ok := claims[sso.groupsClaim].([]interface{}); ok {
+		for _, g := range raw {
+			if group, ok := g.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	user, err := upsertSSOUser(ctx, tenantID(c), idToken.Subject, strings.ToLower(email), name, sso.roleFor(groups))
+	if errors.Is(err, errSSOEmailTaken) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "An account with this email already exists and is not linked to SSO",
+			"code":  "account_exists",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	if !user.Active {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated", "code": "account_deactivated"})
+		return
+	}
+
+	if !requirePolicyAcceptance(c, user) {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "login.sso", UserID: user.ID, ActorID: user.ID, Data: bson.M{"issuer": sso.issuer}})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
+
+// upsertSSOUser finds the local account linked to the IdP subject, creating
+// it with the mapped role on first login. An existing account is never
+// linked by email alone, and its role is left as it is.
+func upsertSSOUser(ctx context.Context, tenant, subject, email, name, role string) (*User, error) {
+	collection := authService.db.Collection("users")
+
+	var user User
+	err := collection.FindOne(ctx, bson.M{
+		"tenant_id":  tenant,
+		"identities": bson.M{"$elemMatch": bson.M{"issuer": sso.issuer, "subject": subject}},
+	}).Decode(&user)
+	if err == nil {
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	taken, err := collection.CountDocuments(ctx, bson.M{"tenant_id": tenant, "email": email})
+	if err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, errSSOEmailTaken
+	}
+
+	user = User{
+		Email:      email,
+		Name:       name,
+		Role:       role,
+		Active:     true,
+		TenantID:   tenant,
+		CreatedAt:  time.Now(),
+		Identities: []Identity{{Issuer: sso.issuer, Subject: subject, LinkedAt: time.Now()}},
+	}
+	result, err := collection.InsertOne(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = idString(result.InsertedID)
+	publishUserEvent(ctx, EventUserRegistered, user.ID, bson.M{
+		"email": user.Email, "name": user.Name, "role": user.Role, "source": "sso",
+	})
+	return &user, nil
+}
+
+func (u *User) hasIdentity(issuer, subject string) bool {
+	for _, identity := range u.Identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrderRequest is an order a member of an organization submitted for
+// purchase. Order is the body for the order service's create endpoint. It
+// is priced through the order service's quote. Buyers' requests above the
+// organization's threshold wait for an approver to release them; everything
+// else is placed straight away. Orders are placed for the buyer, on the
+// organization's payment terms; the order service refuses members' orders
+// placed any other way.
+type OrderRequest struct {
+	ID             string     `bson:"_id" json:"id"`
+	OrganizationID string     `bson:"organization_id" json:"organization_id"`
+	BuyerID        string     `bson:"buyer_id" json:"buyer_id"`
+	BuyerEmail     string     `bson:"buyer_email" json:"buyer_email"`
+	Order          bson.M     `bson:"order" json:"order"`
+	Total          float64    `bson:"total" json:"total"`
+	Currency       string     `bson:"currency" json:"currency"`
+	Status         string     `bson:"status" json:"status"`
+	DecidedBy      string     `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	Reason         string     `bson:"reason,omitempty" json:"reason,omitempty"`
+	OrderID        string     `bson:"order_id,omitempty" json:"order_id,omitempty"`
+	Error          string     `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
+	DecidedAt      *time.Time `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+}
+
+const (
+	orderRequestPending   = "pending_approval"
+	orderRequestApproved  = "approved"
+	orderRequestRejected  = "rejected"
+	orderRequestCancelled = "cancelled"
+	orderRequestPlaced    = "placed"
+	orderRequestFailed    = "failed"
+)
+
+var orderServiceClient = &http.Client{Timeout: 30 * time.Second}
+
+// callOrderService posts payload to the order service and decodes the
+// response into out.
+func callOrderService(ctx context.Context, path, authorization string, payload interface{}, out interface{}) error {
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, orderServiceURL()+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := orderServiceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Error != "" {
+			return fmt.Errorf("order service: %s", failure.Error)
+		}
+		return fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// buyerToken mints a short-lived access token for placing an order as the
+// buyer, whose address book the order service reads with it. It names the
+// released request and carries the organization's payment terms, which the
+// order service takes from here rather than the order body. It is never
+// handed to the client.
+func buyerToken(buyer *User, org *Organization, request *OrderRequest) (string, error) {
+	return authService.keys.sign(newClaims(buyer.TenantID, buyer.ID, buyer.Role).
+		email(buyer.Email).
+		permissions(buyer.Role, nil).
+		set("order_request_id", request.ID).
+		set("payment_terms_days", org.PaymentTerms.NetDays).
+		expiresAt(time.Now().Add(5 * time.Minute)).
+		build())
+}
+
+func submitOrderRequest(c *gin.Context) {
+	user, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Order bson.M `json:"order" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Terms come from the organization when the order is placed
+	delete(req.Order, "payment_method")
+	delete(req.Order, "payment_due_at")
+	req.Order["user_id"] = user.ID
+
+	var quote struct {
+		Total    float64 `json:"total"`
+		Currency string  `json:"currency"`
+	}
+	if err := callOrderService(c.Request.Context(), "/api/v1/orders/quote", c.GetHeader("Authorization"), req.Order, &quote); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to price order: " + err.Error()})
+		return
+	}
+
+	request := OrderRequest{
+		ID:             primitive.NewObjectID().Hex(),
+		OrganizationID: org.ID,
+		BuyerID:        user.ID,
+		BuyerEmail:     user.Email,
+		Order:          req.Order,
+		Total:          quote.Total,
+		Currency:       quote.Currency,
+		Status:         orderRequestPending,
+		CreatedAt:      time.Now(),
+	}
+
+	needsApproval := !canApprove(user.Organization.Role) && quote.Total > org.ApprovalThreshold
+	if !needsApproval {
+		request.Status = orderRequestApproved
+	}
+
+	if _, err := authService.db.Collection("order_requests").InsertOne(context.Background(), request); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit order"})
+		return
+	}
+
+	if needsApproval {
+		notifyApprovers(context.Background(), org, &request)
+		c.JSON(http.StatusAccepted, request)
+		return
+	}
+
+	placeOrderRequest(context.Background(), org, user, &request)
+	if request.Status == orderRequestFailed {
+		c.JSON(http.StatusBadGateway, request)
+		return
+	}
+	c.JSON(http.StatusCreated, request)
+}
+
+// placeOrderRequest creates the order in the order service and records the
+// outcome on the request.
+func placeOrderRequest(ctx context.Context, org *Organization, buyer *User, request *OrderRequest) {
+	payload := bson.M{}
+	for k, v := range request.Order {
+		payload[k] = v
+	}
+	payload["user_id"] = buyer.ID
+
+	var created struct {
+		OrderID string `json:"order_id"`
+	}
+	token, err := buyerToken(buyer, org, request)
+	if err == nil {
+		err = callOrderService(ctx, "/api/v1/orders", "Bearer "+token, payload, &created)
+	}
+
+	var set bson.M
+	if err != nil {
+		log.Printf("Failed to place order request %s: %v", request.ID, err)
+		request.Status, request.Error = orderRequestFailed, err.Error()
+		set = bson.M{"status": request.Status, "error": request.Error}
+	} else {
+		request.Status, request.OrderID, request.Error = orderRequestPlaced, created.OrderID, ""
+		set = bson.M{"status": request.Status, "order_id": request.OrderID, "error": ""}
+	}
+
+	_, err = authService.db.Collection("order_requests").UpdateOne(ctx, bson.M{"_id": request.ID}, bson.M{"$set": set})
+	if err != nil {
+		log.Printf("Failed to update order request %s: %v", request.ID, err)
+	}
+}
+
+func notifyApprovers(ctx context.Context, org *Organization, request *OrderRequest) {
+	members, err := organizationMembers(ctx, org.ID)
+	if err != nil {
+		log.Printf("Failed to notify approvers of order request %s: %v", request.ID, err)
+		return
+	}
+
+	body := fmt.Sprintf("%s submitted an order of %.2f %s for %s, which needs your approval.\n\n%s",
+		request.BuyerEmail, request.Total, request.Currency, org.Name, appURL("/account/organization/approvals/"+request.ID))
+	for _, m := range members {
+		if canApprove(m.Role) {
+			sendEmail(m.Email, "Order awaiting approval", body)
+		}
+	}
+}
+
+func listOrderRequests(c *gin.Context) {
+	user, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"organization_id": org.ID}
+	if !canApprove(user.Organization.Role) {
+		filter["buyer_id"] = user.ID
+	}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(100)
+	cursor, err := authService.db.Collection("order_requests").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order requests"})
+		return
+	}
+
+	requests := []OrderRequest{}
+	if err := cursor.All(context.Background(), &requests); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode order requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"order_requests": requests, "count": len(requests)})
+}
+
+// decideOrderRequest applies set to a request in one of the from statuses
+// that the approver didn't submit, returning it as it was before.
+func decideOrderRequest(c *gin.Context, org *Organization, approver *User, from []string, set bson.M) (*OrderRequest, bool) {
+	set["decided_by"] = approver.ID
+	set["decided_at"] = time.Now()
+
+	var request OrderRequest
+	err := authService.db.Collection("order_requests").FindOneAndUpdate(context.Background(),
+		bson.M{
+			"_id":             c.Param("id"),
+			"organization_id": org.ID,
+			"status":          bson.M{"$in": from},
+			"buyer_id":        bson.M{"$ne": approver.ID},
+		},
+		bson.M{"$set": set}).Decode(&request)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No order request awaiting your decision"})
+		return nil, false
+	}
+	return &request, true
+}
+
+// approveOrderRequest releases a pending order, or retries one that failed
+// to be placed. Approvers can't release their own requests.
+func approveOrderRequest(c *gin.Context) {
+	user, org, ok := loadMembership(c, orgRoleApprover, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	request, ok := decideOrderRequest(c, org, user, []string{orderRequestPending, orderRequestFailed},
+		bson.M{"status": orderRequestApproved})
+	if !ok {
+		return
+	}
+
+	var buyer User
+	if err := authService.db.Collection("users").FindOne(context.Background(), userFilter(request.BuyerID)).Decode(&buyer); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Buyer not found"})
+		return
+	}
+
+	placeOrderRequest(context.Background(), org, &buyer, request)
+	recordAudit(c, AuditEvent{Type: "organization.order_approved", UserID: request.BuyerID,
+		Data: bson.M{"organization_id": org.ID, "order_request_id": request.ID, "order_id": request.OrderID}})
+
+	if request.Status == orderRequestFailed {
+		c.JSON(http.StatusBadGateway, request)
+		return
+	}
+	sendEmail(request.BuyerEmail, "Your order was approved",
+		fmt.Sprintf("Your order of %.2f %s has been approved and placed.\n\n%s", request.Total, request.Currency, appURL("/orders/"+request.OrderID)))
+
+	c.JSON(http.StatusOK, request)
+}
+
+func rejectOrderRequest(c *gin.Context) {
+	user, org, ok := loadMembership(c, orgRoleApprover, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	c.ShouldBindJSON(&req)
+
+	request, ok := decideOrderRequest(c, org, user, []string{orderRequestPending, orderRequestFailed},
+		bson.M{"status": orderRequestRejected, "reason": req.Reason})
+	if !ok {
+		return
+	}
+	request.Status, request.Reason = orderRequestRejected, req.Reason
+
+	recordAudit(c, AuditEvent{Type: "organization.order_rejected", UserID: request.BuyerID,
+		Data: bson.M{"organization_id": org.ID, "order_request_id": request.ID}})
+	body := fmt.Sprintf("Your order of %.2f %s was not approved.", request.Total, request.Currency)
+	if req.Reason != "" {
+		body += "\n\nReason: " + req.Reason
+	}
+	sendEmail(request.BuyerEmail, "Your order was not approved", body)
+
+	c.JSON(http.StatusOK, request)
+}
+
+// cancelOrderRequest lets buyers withdraw a request still awaiting approval.
+func cancelOrderRequest(c *gin.Context) {
+	user, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	result, err := authService.db.Collection("order_requests").UpdateOne(context.Background(),
+		bson.M{"_id": c.Param("id"), "organization_id": org.ID, "buyer_id": user.ID, "status": orderRequestPending},
+		bson.M{"$set": bson.M{"status": orderRequestCancelled}})
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending order request found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Order request cancelled"})
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Organization is a B2B company account. Several user logins belong to it,
+// each with an organization role, and share its address book and the
+// payment terms the store has granted it. Orders by buyers above
+// ApprovalThreshold wait for an approver, see org_approvals.go.
+type Organization struct {
+	ID       string `bson:"_id" json:"id"`
+	TenantID string `bson:"tenant_id" json:"-"`
+	Name     string `bson:"name" json:"name"`
+	// Buyer orders with a higher total need approval; 0 means all do
+	ApprovalThreshold float64      `bson:"approval_threshold" json:"approval_threshold"`
+	PaymentTerms      PaymentTerms `bson:"payment_terms" json:"payment_terms"`
+	CreatedAt         time.Time    `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time    `bson:"updated_at" json:"updated_at"`
+}
+
+// PaymentTerms are set by store staff. With NetDays set, the
+// organization's orders are invoiced and due that many days after they
+// are placed instead of being paid at checkout.
+type PaymentTerms struct {
+	NetDays int `bson:"net_days" json:"net_days"`
+}
+
+// OrgMembership links a user to their organization.
+type OrgMembership struct {
+	ID   string `bson:"id" json:"id"`
+	Role string `bson:"role" json:"role"`
+}
+
+const (
+	orgRoleBuyer    = "buyer"
+	orgRoleApprover = "approver"
+	orgRoleAdmin    = "admin"
+)
+
+var orgRoles = map[string]bool{orgRoleBuyer: true, orgRoleApprover: true, orgRoleAdmin: true}
+
+// canApprove reports whether an organization role may release orders.
+func canApprove(role string) bool {
+	return role == orgRoleApprover || role == orgRoleAdmin
+}
+
+// orgAddressOwner is the owner key of an organization's shared addresses
+// in the addresses collection, so they reuse the personal address book.
+func orgAddressOwner(orgID string) string {
+	return "org:" + orgID
+}
+
+// loadMembership loads the caller and their organization, responding with
+// an error when they don't belong to one or lack one of roles.
+func loadMembership(c *gin.Context, roles ...string) (*User, *Organization, bool) {
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), userFilter(c.GetString("user_id"))).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, nil, false
+	}
+	if user.Organization == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You are not a member of an organization"})
+		return nil, nil, false
+	}
+
+	var org Organization
+	err = authService.db.Collection("organizations").FindOne(context.Background(), bson.M{"_id": user.Organization.ID}).Decode(&org)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return nil, nil, false
+	}
+
+	if len(roles) > 0 && !containsString(roles, user.Organization.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient organization role"})
+		return nil, nil, false
+	}
+	return &user, &org, true
+}
+
+// addressOwners are the address book owners whose entries the caller may
+// use: their own and, for organization members, the organization's.
+func addressOwners(c *gin.Context) []string {
+	userID := c.GetString("user_id")
+	owners := []string{userID}
+
+	var user User
+	opts := options.FindOne().SetProjection(bson.M{"organization": 1})
+	if authService.db.Collection("users").FindOne(context.Background(), userFilter(userID), opts).Decode(&user) == nil &&
+		user.Organization != nil {
+		owners = append(owners, orgAddressOwner(user.Organization.ID))
+	}
+	return owners
+}
+
+type organizationMember struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+}
+
+func organizationMembers(ctx context.Context, orgID string) ([]organizationMember, error) {
+	cursor, err := authService.db.Collection("users").Find(ctx, bson.M{"organization.id": orgID},
+		options.Find().SetSort(bson.D{{Key: "email", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	members := []organizationMember{}
+	for _, u := range users {
+		members = append(members, organizationMember{ID: u.ID, Email: u.Email, Name: u.Name, Role: u.Organization.Role})
+	}
+	return members, nil
+}
+
+// createOrganization sets up a company account with the caller as its
+// first admin.
+func createOrganization(c *gin.Context) {
+	var req struct {
+		Name              string  `json:"name" binding:"required"`
+		ApprovalThreshold float64 `json:"approval_threshold" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	if c.GetString("role") == guestRole {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Create an account first"})
+		return
+	}
+
+	org := Organization{
+		ID:                primitive.NewObjectID().Hex(),
+		TenantID:          tenantID(c),
+		Name:              strings.TrimSpace(req.Name),
+		ApprovalThreshold: req.ApprovalThreshold,
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+	}
+
+	// Claim the user first so they can't end up in two organizations
+	filter := userFilter(userID)
+	filter["organization"] = bson.M{"$exists": false}
+	result, err := authService.db.Collection("users").UpdateOne(context.Background(), filter,
+		bson.M{"$set": bson.M{"organization": OrgMembership{ID: org.ID, Role: orgRoleAdmin}}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already belong to an organization"})
+		return
+	}
+
+	if _, err := authService.db.Collection("organizations").InsertOne(context.Background(), org); err != nil {
+		authService.db.Collection("users").UpdateOne(context.Background(), userFilter(userID),
+			bson.M{"$unset": bson.M{"organization": ""}})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.created", UserID: userID, Data: bson.M{"organization_id": org.ID}})
+
+	c.JSON(http.StatusCreated, org)
+}
+
+func getOrganization(c *gin.Context) {
+	user, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	members, err := organizationMembers(context.Background(), org.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"organization": org,
+		"role":         user.Organization.Role,
+		"members":      members,
+	})
+}
+
+func updateOrganization(c *gin.Context) {
+	_, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name              *string  `json:"name"`
+		ApprovalThreshold *float64 `json:"approval_threshold" binding:"omitempty,min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name cannot be empty"})
+			return
+		}
+		set["name"] = strings.TrimSpace(*req.Name)
+	}
+	if req.ApprovalThreshold != nil {
+		set["approval_threshold"] = *req.ApprovalThreshold
+	}
+
+	err := authService.db.Collection("organizations").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": org.ID}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update organization"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.updated", Data: bson.M{"organization_id": org.ID, "changes": set}})
+
+	c.JSON(http.StatusOK, org)
+}
+
+// OrgInvite is an admin's invitation for an existing account to join the
+// organization. The account only becomes a member once its owner accepts.
+type OrgInvite struct {
+	ID               string    `bson:"_id" json:"id"`
+	OrganizationID   string    `bson:"organization_id" json:"organization_id"`
+	OrganizationName string    `bson:"organization_name" json:"organization_name"`
+	UserID           string    `bson:"user_id" json:"-"`
+	Email            string    `bson:"email" json:"email"`
+	Role             string    `bson:"role" json:"role"`
+	InvitedBy        string    `bson:"invited_by" json:"invited_by"`
+	Status           string    `bson:"status" json:"status"`
+	CreatedAt        time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt        time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+const (
+	orgInvitePending  = "pending"
+	orgInviteAccepted = "accepted"
+	orgInviteDeclined = "declined"
+	orgInviteTTL      = 14 * 24 * time.Hour
+)
+
+// inviteOrganizationMember invites an existing account of the same store
+// to the organization. Only the latest invite per organization and account
+// can be accepted.
+func inviteOrganizationMember(c *gin.Context) {
+	admin, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+		Role  string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !orgRoles[req.Role] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be buyer, approver or admin"})
+		return
+	}
+
+	filter := emailFilter(c, req.Email)
+	filter["organization"] = bson.M{"$exists": false}
+	var member User
+	err := authService.db.Collection("users").FindOne(context.Background(), filter).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No account with that email that isn't already in an organization"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+
+	invites := authService.db.Collection("organization_invites")
+	_, err = invites.UpdateMany(context.Background(),
+		bson.M{"organization_id": org.ID, "user_id": member.ID, "status": orgInvitePending},
+		bson.M{"$set": bson.M{"status": "superseded"}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+
+	now := time.Now()
+	invite := OrgInvite{
+		ID:               primitive.NewObjectID().Hex(),
+		OrganizationID:   org.ID,
+		OrganizationName: org.Name,
+		UserID:           member.ID,
+		Email:            member.Email,
+		Role:             req.Role,
+		InvitedBy:        admin.ID,
+		Status:           orgInvitePending,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(orgInviteTTL),
+	}
+	if _, err := invites.InsertOne(context.Background(), invite); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.member_invited", UserID: member.ID,
+		Data: bson.M{"organization_id": org.ID, "role": req.Role}})
+	sendEmail(member.Email, "You've been invited to "+org.Name,
+		fmt.Sprintf("%s invited you to order on behalf of %s as %s. Sign in to accept or decline.\n\n%s",
+			admin.Email, org.Name, articleFor(req.Role), appURL("/account/organization/invites")))
+
+	c.JSON(http.StatusAccepted, invite)
+}
+
+// listOrganizationInvites shows the caller the invites waiting for them.
+func listOrganizationInvites(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := authService.db.Collection("organization_invites").Find(context.Background(), bson.M{
+		"user_id":    c.GetString("user_id"),
+		"status":     orgInvitePending,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invites"})
+		return
+	}
+
+	invites := []OrgInvite{}
+	if err := cursor.All(context.Background(), &invites); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode invites"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invites": invites, "count": len(invites)})
+}
+
+// claimOrganizationInvite moves one of the caller's pending, unexpired
+// invites to status.
+func claimOrganizationInvite(c *gin.Context, status string) (*OrgInvite, bool) {
+	var invite OrgInvite
+	err := authService.db.Collection("organization_invites").FindOneAndUpdate(context.Background(),
+		bson.M{
+			"_id":        c.Param("id"),
+			"user_id":    c.GetString("user_id"),
+			"status":     orgInvitePending,
+			"expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"status": status}}).Decode(&invite)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or expired"})
+		return nil, false
+	}
+	return &invite, true
+}
+
+// acceptOrganizationInvite makes the caller a member with the invited role.
+func acceptOrganizationInvite(c *gin.Context) {
+	invite, ok := claimOrganizationInvite(c, orgInviteAccepted)
+	if !ok {
+		return
+	}
+
+	reopen := func() {
+		authService.db.Collection("organization_invites").UpdateOne(context.Background(),
+			bson.M{"_id": invite.ID}, bson.M{"$set": bson.M{"status": orgInvitePending}})
+	}
+
+	var org Organization
+	if err := authService.db.Collection("organizations").FindOne(context.Background(), bson.M{"_id": invite.OrganizationID}).Decode(&org); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	filter := userFilter(invite.UserID)
+	filter["organization"] = bson.M{"$exists": false}
+	result, err := authService.db.Collection("users").UpdateOne(context.Background(), filter,
+		bson.M{"$set": bson.M{"organization": OrgMembership{ID: org.ID, Role: invite.Role}}})
+	if err != nil {
+		reopen()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invite"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		reopen()
+		c.JSON(http.StatusConflict, gin.H{"error": "You already belong to an organization"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.member_added", UserID: invite.UserID,
+		Data: bson.M{"organization_id": org.ID, "role": invite.Role, "invite_id": invite.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "You joined " + org.Name, "organization": org, "role": invite.Role})
+}
+
+func declineOrganizationInvite(c *gin.Context) {
+	invite, ok := claimOrganizationInvite(c, orgInviteDeclined)
+	if !ok {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.invite_declined", UserID: invite.UserID,
+		Data: bson.M{"organization_id": invite.OrganizationID, "invite_id": invite.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite declined"})
+}
+
+func articleFor(role string) string {
+	if role == orgRoleApprover || role == orgRoleAdmin {
+		return "an " + role
+	}
+	return "a " + role
+}
+
+// lastAdmin reports whether memberID is the organization's only admin, who
+// may not be removed or demoted.
+func lastAdmin(ctx context.Context, orgID, memberID string) bool {
+	cursor, err := authService.db.Collection("users").Find(ctx,
+		bson.M{"organization.id": orgID, "organization.role": orgRoleAdmin},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return true
+	}
+	var admins []User
+	if err := cursor.All(ctx, &admins); err != nil {
+		return true
+	}
+	return len(admins) == 1 && admins[0].ID == memberID
+}
+
+func updateOrganizationMember(c *gin.Context) {
+	_, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !orgRoles[req.Role] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be buyer, approver or admin"})
+		return
+	}
+
+	memberID := c.Param("id")
+	if req.Role != orgRoleAdmin && lastAdmin(context.Background(), org.ID, memberID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one admin"})
+		return
+	}
+
+	filter := userFilter(memberID)
+	filter["organization.id"] = org.ID
+	result, err := authService.db.Collection("users").UpdateOne(context.Background(), filter,
+		bson.M{"$set": bson.M{"organization.role": req.Role}})
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.member_role_changed", UserID: memberID,
+		Data: bson.M{"organization_id": org.ID, "role": req.Role}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated"})
+}
+
+// removeOrganizationMember lets an admin remove anyone, and any member
+// leave by removing themselves.
+func removeOrganizationMember(c *gin.Context) {
+	user, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	memberID := c.Param("id")
+	if memberID != user.ID && user.Organization.Role != orgRoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient organization role"})
+		return
+	}
+	if lastAdmin(context.Background(), org.ID, memberID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one admin"})
+		return
+	}
+
+	filter := userFilter(memberID)
+	filter["organization.id"] = org.ID
+	result, err := authService.db.Collection("users").UpdateOne(context.Background(), filter,
+		bson.M{"$unset": bson.M{"organization": ""}})
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.member_removed", UserID: memberID,
+		Data: bson.M{"organization_id": org.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+func listOrganizationAddresses(c *gin.Context) {
+	_, org, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := authService.db.Collection("addresses").Find(context.Background(),
+		bson.M{"user_id": orgAddressOwner(org.ID)}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch addresses"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	addresses := []Address{}
+	if err = cursor.All(context.Background(), &addresses); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode addresses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"addresses": addresses,
+		"count":     len(addresses),
+	})
+}
+
+func createOrganizationAddress(c *gin.Context) {
+	_, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	owner := orgAddressOwner(org.ID)
+	address := Address{
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    owner,
+		CreatedAt: time.Now(),
+	}
+	address.apply(req)
+
+	if err := clearDefaults(owner, address.ID, req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+	if _, err := authService.db.Collection("addresses").InsertOne(context.Background(), address); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create address"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, address)
+}
+
+func updateOrganizationAddress(c *gin.Context) {
+	_, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req AddressRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	owner := orgAddressOwner(org.ID)
+	id := c.Param("id")
+	collection := authService.db.Collection("addresses")
+	var address Address
+	if err := collection.FindOne(context.Background(), bson.M{"_id": id, "user_id": owner}).Decode(&address); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	address.apply(req)
+
+	if err := clearDefaults(owner, id, req); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+	if _, err := collection.ReplaceOne(context.Background(), bson.M{"_id": id, "user_id": owner}, address); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update address"})
+		return
+	}
+
+	c.JSON(http.StatusOK, address)
+}
+
+func deleteOrganizationAddress(c *gin.Context) {
+	_, org, ok := loadMembership(c, orgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	result, err := authService.db.Collection("addresses").DeleteOne(context.Background(),
+		bson.M{"_id": c.Param("id"), "user_id": orgAddressOwner(org.ID)})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted successfully"})
+}
+
+func adminListOrganizations(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := authService.db.Collection("organizations").Find(context.Background(),
+		bson.M{"tenant_id": tenantID(c)}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizations"})
+		return
+	}
+
+	orgs := []Organization{}
+	if err := cursor.All(context.Background(), &orgs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode organizations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organizations": orgs, "count": len(orgs)})
+}
+
+// setPaymentTerms lets staff grant an organization invoice terms.
+func setPaymentTerms(c *gin.Context) {
+	var terms PaymentTerms
+	if err := c.ShouldBindJSON(&terms); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if terms.NetDays < 0 || terms.NetDays > 120 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "net_days must be between 0 and 120"})
+		return
+	}
+
+	orgID := c.Param("id")
+	var org Organization
+	err := authService.db.Collection("organizations").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": orgID, "tenant_id": tenantID(c)},
+		bson.M{"$set": bson.M{"payment_terms": terms, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&org)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "organization.payment_terms_changed",
+		Data: bson.M{"organization_id": orgID, "net_days": terms.NetDays}})
+
+	c.JSON(http.StatusOK, org)
+}
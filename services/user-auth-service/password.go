@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func changePassword(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required,min=8"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := authService.db.Collection("users")
+	var user User
+	err := collection.FindOne(context.Background(), userFilter(userID)).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !passwordMatches(user.Password, req.CurrentPassword) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if passwordReused(&user, req.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Choose a password you haven't used recently", "code": "password_reused"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	// Bumping the token version invalidates every refresh token issued so far.
+	_, err = collection.UpdateOne(
+		context.Background(),
+		userFilter(userID),
+		retirePassword(bson.M{
+			"$set": bson.M{"password": hashedPassword, "password_changed_at": time.Now()},
+			"$inc": bson.M{"token_version": 1},
+		}, &user),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "password.changed", UserID: userID})
+	sendEmail(user.Email, "Your password was changed",
+		"The password for your account was just changed. If this wasn't you, reset your password immediately and contact support.")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
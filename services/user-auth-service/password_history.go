@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PasswordHistoryEntry is a previous password hash, kept only to stop the
+// user from switching back to it.
+type PasswordHistoryEntry struct {
+	Hash      string    `bson:"hash"`
+	RetiredAt time.Time `bson:"retired_at"`
+}
+
+// passwordHistorySize is how many previous passwords may not be reused,
+// from PASSWORD_HISTORY_SIZE (default 5, 0 disables the check).
+func passwordHistorySize() int {
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_HISTORY_SIZE")); err == nil && n >= 0 {
+		return n
+	}
+	return 5
+}
+
+// passwordHistoryMaxAge drops history entries older than
+// PASSWORD_HISTORY_MAX_AGE (e.g. "8760h"), so they stop blocking reuse.
+// Unset keeps entries until they are pushed out by newer ones.
+func passwordHistoryMaxAge() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PASSWORD_HISTORY_MAX_AGE")); err == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+// passwordReused reports whether password matches the user's current
+// password or one in their history.
+func passwordReused(user *User, password string) bool {
+	size := passwordHistorySize()
+	if size == 0 {
+		return false
+	}
+	if passwordMatches(user.Password, password) {
+		return true
+	}
+	maxAge := passwordHistoryMaxAge()
+	for i, entry := range user.PasswordHistory {
+		if i >= size {
+			break
+		}
+		if maxAge > 0 && time.Since(entry.RetiredAt) > maxAge {
+			continue
+		}
+		if passwordMatches(entry.Hash, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// retirePassword adds to update moving the user's current hash into their
+// history, newest first, capped at the configured size.
+func retirePassword(update bson.M, user *User) bson.M {
+	size := passwordHistorySize()
+	if size == 0 || user.Password == "" {
+		return update
+	}
+	update["$push"] = bson.M{"password_history": bson.M{
+		"$each":     []PasswordHistoryEntry{{Hash: user.Password, RetiredAt: time.Now()}},
+		"$position": 0,
+		"$slice":    size,
+	}}
+	return update
+}
+
+// startPasswordHistoryPruner trims histories to the configured size and
+// drops expired entries once a day, so lowering either setting takes effect
+// for users who don't change their password.
+func startPasswordHistoryPruner() {
+	go func() {
+		for {
+			prunePasswordHistory(context.Background())
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+func prunePasswordHistory(ctx context.Context) {
+	collection := authService.db.Collection("users")
+	size := passwordHistorySize()
+
+	if size == 0 {
+		_, err := collection.UpdateMany(ctx,
+			bson.M{"password_history": bson.M{"$exists": true}},
+			bson.M{"$unset": bson.M{"password_history": ""}})
+		if err != nil {
+			log.Printf("Failed to prune password history: %v", err)
+		}
+		return
+	}
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"password_history." + strconv.Itoa(size): bson.M{"$exists": true}},
+		bson.M{"$push": bson.M{"password_history": bson.M{"$each": bson.A{}, "$slice": size}}})
+	if err != nil {
+		log.Printf("Failed to prune password history: %v", err)
+	}
+
+	if maxAge := passwordHistoryMaxAge(); maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		_, err := collection.UpdateMany(ctx,
+			bson.M{"password_history.retired_at": bson.M{"$lt": cutoff}},
+			bson.M{"$pull": bson.M{"password_history": bson.M{"retired_at": bson.M{"$lt": cutoff}}}})
+		if err != nil {
+			log.Printf("Failed to prune password history: %v", err)
+		}
+	}
+}
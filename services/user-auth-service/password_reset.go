@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const passwordResetTTL = time.Hour
+
+// forgotPassword emails a reset link. It always answers the same way so it
+// can't be used to find out which emails have accounts.
+func forgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If the account exists, a reset link has been sent"}
+
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), emailFilter(c, req.Email)).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	token, tokenHash := newOneTimeToken()
+	_, err = authService.db.Collection("password_resets").InsertOne(context.Background(), bson.M{
+		"user_id":    user.ID,
+		"token_hash": tokenHash,
+		"expires_at": time.Now().Add(passwordResetTTL),
+		"used":       false,
+		"created_at": time.Now(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start password reset"})
+		return
+	}
+
+	sendEmail(user.Email, "Reset your password",
+		"Use this link to choose a new password: "+appURL("/account/password/reset?token="+token))
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+func resetPassword(c *gin.Context) {
+	var req struct {
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required,min=8"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reset struct {
+		UserID string `bson:"user_id"`
+	}
+	filter := bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}}
+	err := authService.db.Collection("password_resets").FindOne(context.Background(), filter).Decode(&reset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	var user User
+	err = authService.db.Collection("users").FindOne(context.Background(), userFilter(reset.UserID)).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	// Checked before the token is spent so the user can try another password
+	if passwordReused(&user, req.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Choose a password you haven't used recently", "code": "password_reused"})
+		return
+	}
+
+	result, err := authService.db.Collection("password_resets").UpdateOne(context.Background(), filter, bson.M{"$set": bson.M{"used": true}})
+	if err != nil || result.ModifiedCount == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	_, err = authService.db.Collection("users").UpdateOne(
+		context.Background(),
+		userFilter(reset.UserID),
+		retirePassword(bson.M{
+			"$set": bson.M{
+				"password":                hashedPassword,
+				"password_changed_at":     time.Now(),
+				"password_reset_required": false,
+			},
+			"$inc": bson.M{"token_version": 1},
+		}, &user),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "password.reset", UserID: reset.UserID, ActorID: reset.UserID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SMSSender delivers a text message to an E.164 phone number.
+type SMSSender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+// twilioSender sends through Twilio's Messages API. Other providers with
+// the same API shape can be used by pointing TWILIO_API_URL at them.
+type twilioSender struct {
+	baseURL    string
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+func (s *twilioSender) Send(ctx context.Context, to, body string) error {
+	form := url.Values{"To": {to}, "From": {s.from}, "Body": {body}}
+	endpoint := s.baseURL + "/2010-04-01/Accounts/" + s.accountSID + "/Messages.json"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.accountSID, s.authToken)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sms provider returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// logSender writes messages to the log instead of sending them, for local
+// development only.
+type logSender struct{}
+
+func (logSender) Send(ctx context.Context, to, body string) error {
+	log.Printf("SMS to %s: %s", to, body)
+	return nil
+}
+
+// sms is nil when SMS_PROVIDER isn't set, which disables phone features.
+var (
+	sms             SMSSender
+	otpPhoneLimit   rateLimit
+	otpTTL          = 5 * time.Minute
+	otpCooldown     = time.Minute
+	otpMaxAttempts  = 5
+	phoneE164Format = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// setupSMS configures the provider from SMS_PROVIDER ("twilio" or "log"),
+// plus OTP_TTL (default 5m), OTP_RESEND_COOLDOWN (default 1m),
+// OTP_MAX_ATTEMPTS (default 5) and RATE_LIMIT_OTP_PHONE, the number of
+// codes one phone number may be sent (default 5/1h).
+func setupSMS() {
+	switch provider := strings.ToLower(os.Getenv("SMS_PROVIDER")); provider {
+	case "":
+		return
+	case "twilio":
+		sms = &twilioSender{
+			baseURL:    strings.TrimSuffix(envOr("TWILIO_API_URL", "https://api.twilio.com"), "/"),
+			accountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+			authToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+			from:       os.Getenv("TWILIO_FROM"),
+			client:     &http.Client{Timeout: 10 * time.Second},
+		}
+	case "log":
+		sms = logSender{}
+	default:
+		log.Fatalf("Unknown SMS_PROVIDER %q", provider)
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("OTP_TTL")); err == nil && d > 0 {
+		otpTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("OTP_RESEND_COOLDOWN")); err == nil && d >= 0 {
+		otpCooldown = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("OTP_MAX_ATTEMPTS")); err == nil && n > 0 {
+		otpMaxAttempts = n
+	}
+	otpPhoneLimit = parseRateLimit("RATE_LIMIT_OTP_PHONE", "5/1h")
+}
+
+// phoneOTP is a one-time code sent by SMS. There is at most one per user
+// for verification and one per phone number for login, so sending a new
+// code replaces the old one.
+type phoneOTP struct {
+	ID        string    `bson:"_id"`
+	TenantID  string    `bson:"tenant_id"`
+	UserID    string    `bson:"user_id"`
+	Phone     string    `bson:"phone"`
+	CodeHash  string    `bson:"code_hash"`
+	Attempts  int       `bson:"attempts"`
+	SentAt    time.Time `bson:"sent_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func verifyOTPKey(userID string) string {
+	return "verify:" + userID
+}
+
+func loginOTPKey(tenant, phone string) string {
+	return "login:" + tenant + ":" + phone
+}
+
+func hashOTP(key, code string) string {
+	return hashToken(key + ":" + code)
+}
+
+func normalizePhone(phone string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(strings.TrimSpace(phone))
+}
+
+// otpCooldownError means a code was sent to the number within the cooldown.
+type otpCooldownError struct {
+	wait time.Duration
+}
+
+func (e *otpCooldownError) Error() string {
+	return fmt.Sprintf("code sent less than %s ago", otpCooldown)
+}
+
+var errSMSFailed = errors.New("failed to send SMS")
+
+// issueOTP stores and texts a new code, unless one was sent within the
+// cooldown.
+func issueOTP(ctx context.Context, otp phoneOTP, message string) error {
+	collection := authService.db.Collection("phone_otps")
+
+	var previous phoneOTP
+	if collection.FindOne(ctx, bson.M{"_id": otp.ID}).Decode(&previous) == nil {
+		if wait := otpCooldown - time.Since(previous.SentAt); wait > 0 {
+			return &otpCooldownError{wait: wait}
+		}
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	otp.CodeHash = hashOTP(otp.ID, code)
+	otp.SentAt = time.Now()
+	otp.ExpiresAt = time.Now().Add(otpTTL)
+	if _, err := collection.ReplaceOne(ctx, bson.M{"_id": otp.ID}, otp, options.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	if err := sms.Send(ctx, otp.Phone, fmt.Sprintf(message, code)); err != nil {
+		log.Printf("Failed to send SMS to %s: %v", otp.Phone, err)
+		return errSMSFailed
+	}
+	return nil
+}
+
+// sendOTP texts a new code unless one was sent within the cooldown or the
+// number has hit its hourly limit, in which case it responds 429 itself.
+func sendOTP(c *gin.Context, otp phoneOTP, message string) bool {
+	if ok, retryAfter := allow(c.Request.Context(), "ratelimit:otp_send:phone:"+otp.Phone, otpPhoneLimit); !ok {
+		throttle(c, "otp_send", "phone", retryAfter)
+		return false
+	}
+
+	err := issueOTP(c.Request.Context(), otp, message)
+	var cooldown *otpCooldownError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &cooldown):
+		throttle(c, "otp_send", "cooldown", cooldown.wait)
+	case err == errSMSFailed:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send SMS"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create code"})
+	}
+	return false
+}
+
+// checkOTP verifies code against the OTP stored under key, consuming it on
+// success. Each guess uses up an attempt before the code is compared, so
+// concurrent guesses can't get past the limit; the last one discards it.
+func checkOTP(ctx context.Context, key, code string) (*phoneOTP, bool) {
+	collection := authService.db.Collection("phone_otps")
+
+	var otp phoneOTP
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key, "expires_at": bson.M{"$gt": time.Now()}, "attempts": bson.M{"$lt": otpMaxAttempts}},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&otp)
+	if err != nil {
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(otp.CodeHash), []byte(hashOTP(key, code))) != 1 {
+		if otp.Attempts >= otpMaxAttempts {
+			collection.DeleteOne(ctx, bson.M{"_id": key, "code_hash": otp.CodeHash})
+		}
+		return nil, false
+	}
+
+	// Only one request may use the code
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": key, "code_hash": otp.CodeHash})
+	if err != nil || result.DeletedCount == 0 {
+		return nil, false
+	}
+	return &otp, true
+}
+
+func smsAvailable(c *gin.Context) bool {
+	if sms == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SMS is not configured"})
+		return false
+	}
+	return true
+}
+
+// requestPhoneVerification texts a code to the number the user wants to
+// add. The number is only saved once the code is confirmed.
+func requestPhoneVerification(c *gin.Context) {
+	if !smsAvailable(c) {
+		return
+	}
+
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	phone := normalizePhone(req.Phone)
+	if !phoneE164Format.MatchString(phone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone must be in international format, e.g. +14155550123"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	taken := authService.db.Collection("users").FindOne(context.Background(), bson.M{
+		"tenant_id": tenantID(c), "phone": phone, "phone_verified": true,
+	}).Err()
+	if taken != mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number is already in use"})
+		return
+	}
+
+	otp := phoneOTP{ID: verifyOTPKey(userID), TenantID: tenantID(c), UserID: userID, Phone: phone}
+	if !sendOTP(c, otp, "Your verification code is %s") {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification code sent", "expires_in": int(otpTTL.Seconds())})
+}
+
+func confirmPhoneVerification(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	otp, ok := checkOTP(c.Request.Context(), verifyOTPKey(userID), req.Code)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+
+	_, err := authService.db.Collection("users").UpdateOne(context.Background(), userFilter(userID),
+		bson.M{"$set": bson.M{"phone": otp.Phone, "phone_verified": true}})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number is already in use"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save phone number"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "phone.verified", UserID: userID})
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"phone"}, "phone": otp.Phone})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number verified", "phone": otp.Phone})
+}
+
+func removePhone(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	_, err := authService.db.Collection("users").UpdateOne(context.Background(), userFilter(userID),
+		bson.M{"$unset": bson.M{"phone": "", "phone_verified": ""}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove phone number"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "phone.removed", UserID: userID})
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"phone"}, "phone": ""})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number removed"})
+}
+
+// requestPhoneLogin texts a login code to a verified number. Like
+// requestMagicLink it answers the same way whether or not an account has
+// that number: the number is rate limited before the lookup, and the code
+// is sent in the background with failures only logged.
+func requestPhoneLogin(c *gin.Context) {
+	if !smsAvailable(c) {
+		return
+	}
+
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	phone := normalizePhone(req.Phone)
+	if !phoneE164Format.MatchString(phone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone must be in international format, e.g. +14155550123"})
+		return
+	}
+
+	response := gin.H{"message": "If the number belongs to an account, a code has been sent", "expires_in": int(otpTTL.Seconds())}
+
+	if ok, retryAfter := allow(c.Request.Context(), "ratelimit:otp_send:phone:"+phone, otpPhoneLimit); !ok {
+		throttle(c, "otp_send", "phone", retryAfter)
+		return
+	}
+
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), bson.M{
+		"tenant_id": tenantID(c), "phone": phone, "phone_verified": true,
+	}).Decode(&user)
+	if err != nil || !user.Active {
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	otp := phoneOTP{ID: loginOTPKey(tenantID(c), phone), TenantID: tenantID(c), UserID: user.ID, Phone: phone}
+	go func() {
+		if err := issueOTP(context.Background(), otp, "Your login code is %s"); err != nil {
+			log.Printf("Failed to send login code to %s: %v", phone, err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+// exchangePhoneLogin trades a login code for a normal token pair.
+func exchangePhoneLogin(c *gin.Context) {
+	var req struct {
+		Phone string `json:"phone" binding:"required"`
+		Code  string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	otp, ok := checkOTP(c.Request.Context(), loginOTPKey(tenantID(c), normalizePhone(req.Phone)), req.Code)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), userFilter(otp.UserID)).Decode(&user)
+	if err != nil || !user.Active || user.Phone != otp.Phone || !user.PhoneVerified {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+
+	if !requirePolicyAcceptance(c, &user) {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "login.phone", UserID: user.ID, ActorID: user.ID})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Policy is a legal document users must accept to use their account. When
+// its version changes every user has to accept it again on their next
+// sign-in.
+type Policy struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+}
+
+// PolicyAcceptance records which version of a policy a user accepted.
+type PolicyAcceptance struct {
+	Version    string    `bson:"version" json:"version"`
+	AcceptedAt time.Time `bson:"accepted_at" json:"accepted_at"`
+	IP         string    `bson:"ip,omitempty" json:"-"`
+}
+
+const policyChallengeTTL = 15 * time.Minute
+
+// policies are the current versions, from TERMS_VERSION / TERMS_URL and
+// PRIVACY_POLICY_VERSION / PRIVACY_POLICY_URL. A policy without a version
+// isn't enforced.
+var policies []Policy
+
+func setupPolicies() {
+	policies = nil
+	for _, p := range []struct{ typ, version, url string }{
+		{"terms", "TERMS_VERSION", "TERMS_URL"},
+		{"privacy", "PRIVACY_POLICY_VERSION", "PRIVACY_POLICY_URL"},
+	} {
+		if version := os.Getenv(p.version); version != "" {
+			policies = append(policies, Policy{Type: p.typ, Version: version, URL: os.Getenv(p.url)})
+		}
+	}
+}
+
+// outstandingPolicies returns the policies whose current version the user
+// hasn't accepted. Guests accept them when they sign up.
+func outstandingPolicies(user *User) []Policy {
+	outstanding := []Policy{}
+	if user.Role == guestRole {
+		return outstanding
+	}
+	for _, p := range policies {
+		if user.PolicyAcceptances[p.Type].Version != p.Version {
+			outstanding = append(outstanding, p)
+		}
+	}
+	return outstanding
+}
+
+// currentAcceptances accepts the current version of every policy, for new
+// accounts and for recordPolicyAcceptance.
+func currentAcceptances(c *gin.Context) map[string]PolicyAcceptance {
+	if len(policies) == 0 {
+		return nil
+	}
+	accepted := map[string]PolicyAcceptance{}
+	for _, p := range policies {
+		accepted[p.Type] = PolicyAcceptance{Version: p.Version, AcceptedAt: time.Now(), IP: c.ClientIP()}
+	}
+	return accepted
+}
+
+// requireSignupAcceptance checks that a new account's owner ticked the
+// policies box, writing the error response if not.
+func requireSignupAcceptance(c *gin.Context, accepted bool) bool {
+	if len(policies) == 0 || accepted {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":    "You must accept the terms of service and privacy policy",
+		"code":     "policy_acceptance_required",
+		"policies": policies,
+	})
+	return false
+}
+
+// recordPolicyAcceptance stores the user's acceptance of the current
+// version of every policy.
+func recordPolicyAcceptance(c *gin.Context, userID string) error {
+	accepted := currentAcceptances(c)
+	if accepted == nil {
+		return nil
+	}
+
+	set := bson.M{}
+	for typ, a := range accepted {
+		set["policy_acceptances."+typ] = a
+	}
+	_, err := authService.db.Collection("users").UpdateOne(context.Background(), userFilter(userID), bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	recordAudit(c, AuditEvent{Type: "policy.accepted", UserID: userID, ActorID: userID, Data: bson.M{"versions": policyVersions()}})
+	return nil
+}
+
+func policyVersions() bson.M {
+	versions := bson.M{}
+	for _, p := range policies {
+		versions[p.Type] = p.Version
+	}
+	return versions
+}
+
+// requirePolicyAcceptance lets a sign-in through once the user has accepted
+// the current policies. Otherwise it answers 428 with the policies to
+// accept and a short-lived token that completes the sign-in through
+// acceptPolicies.
+func requirePolicyAcceptance(c *gin.Context, user *User) bool {
+	outstanding := outstandingPolicies(user)
+	if len(outstanding) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	token, tokenHash := newOneTimeToken()
+	_, err := authService.db.Collection("policy_challenges").InsertOne(context.Background(), bson.M{
+		"user_id":    user.ID,
+		"token_hash": tokenHash,
+		"expires_at": now.Add(policyChallengeTTL),
+		"used":       false,
+		"created_at": now,
+	})
+	if err != nil {
+		log.Printf("Failed to create policy challenge for %s: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return false
+	}
+
+	c.JSON(http.StatusPreconditionRequired, gin.H{
+		"error":            "Please review and accept our updated policies",
+		"code":             "policy_acceptance_required",
+		"policies":         outstanding,
+		"acceptance_token": token,
+	})
+	return false
+}
+
+func listPolicies(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+// acceptPolicies records acceptance of the policies and completes the
+// sign-in that was blocked on them. The client sends back the versions it
+// showed the user, so a policy updated in the meantime isn't accepted
+// unseen.
+func acceptPolicies(c *gin.Context) {
+	var req struct {
+		Token    string            `json:"acceptance_token" binding:"required"`
+		Accepted map[string]string `json:"accepted" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, p := range policies {
+		if req.Accepted[p.Type] != p.Version {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":    "Policies have changed, please review the current versions",
+				"code":     "policy_version_mismatch",
+				"policies": policies,
+			})
+			return
+		}
+	}
+
+	var challenge struct {
+		UserID string `bson:"user_id"`
+	}
+	err := authService.db.Collection("policy_challenges").FindOneAndUpdate(context.Background(),
+		bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true, "used_at": time.Now()}},
+	).Decode(&challenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired acceptance token, please sign in again"})
+		return
+	}
+
+	var user User
+	err = authService.db.Collection("users").FindOne(context.Background(), userFilter(challenge.UserID)).Decode(&user)
+	if err != nil || !user.Active {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired acceptance token, please sign in again"})
+		return
+	}
+
+	if err := recordPolicyAcceptance(c, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record acceptance"})
+		return
+	}
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Preferences are per-user settings that other services read to localise
+// prices and content and to decide how to reach the customer.
+type Preferences struct {
+	Locale         string               `bson:"locale" json:"locale"`
+	Currency       string               `bson:"currency" json:"currency"`
+	MarketingOptIn bool                 `bson:"marketing_opt_in" json:"marketing_opt_in"`
+	Notifications  NotificationChannels `bson:"notifications" json:"notifications"`
+	UpdatedAt      time.Time            `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+// NotificationChannels says which channels transactional notifications
+// may use. Marketing is governed by MarketingOptIn on top of this.
+type NotificationChannels struct {
+	Email bool `bson:"email" json:"email"`
+	SMS   bool `bson:"sms" json:"sms"`
+	Push  bool `bson:"push" json:"push"`
+}
+
+// defaultPreferences applies to users who never saved any, from
+// DEFAULT_LOCALE and DEFAULT_CURRENCY.
+func defaultPreferences() Preferences {
+	prefs := Preferences{
+		Locale:        os.Getenv("DEFAULT_LOCALE"),
+		Currency:      os.Getenv("DEFAULT_CURRENCY"),
+		Notifications: NotificationChannels{Email: true},
+	}
+	if prefs.Locale == "" {
+		prefs.Locale = "en"
+	}
+	if prefs.Currency == "" {
+		prefs.Currency = "USD"
+	}
+	return prefs
+}
+
+func (u *User) preferences() Preferences {
+	if u.Preferences == nil {
+		return defaultPreferences()
+	}
+	return *u.Preferences
+}
+
+var (
+	localePattern   = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+func getPreferences(c *gin.Context) {
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), userFilter(c.GetString("user_id"))).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user.preferences())
+}
+
+// updatePreferences changes only the settings present in the request.
+func updatePreferences(c *gin.Context) {
+	var req struct {
+		Locale         *string `json:"locale"`
+		Currency       *string `json:"currency"`
+		MarketingOptIn *bool   `json:"marketing_opt_in"`
+		Notifications  *struct {
+			Email *bool `json:"email"`
+			SMS   *bool `json:"sms"`
+			Push  *bool `json:"push"`
+		} `json:"notifications"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	collection := authService.db.Collection("users")
+	var user User
+	if err := collection.FindOne(context.Background(), userFilter(userID)).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	prefs := user.preferences()
+	previousOptIn := prefs.MarketingOptIn
+
+	if req.Locale != nil {
+		if !localePattern.MatchString(*req.Locale) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid locale"})
+			return
+		}
+		prefs.Locale = *req.Locale
+	}
+	if req.Currency != nil {
+		currency := strings.ToUpper(*req.Currency)
+		if !currencyPattern.MatchString(currency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid currency"})
+			return
+		}
+		prefs.Currency = currency
+	}
+	if req.MarketingOptIn != nil {
+		prefs.MarketingOptIn = *req.MarketingOptIn
+	}
+	if n := req.Notifications; n != nil {
+		if n.Email != nil {
+			prefs.Notifications.Email = *n.Email
+		}
+		if n.SMS != nil {
+			prefs.Notifications.SMS = *n.SMS
+		}
+		if n.Push != nil {
+			prefs.Notifications.Push = *n.Push
+		}
+	}
+	prefs.UpdatedAt = time.Now()
+
+	_, err := collection.UpdateOne(context.Background(), userFilter(userID), bson.M{"$set": bson.M{"preferences": prefs}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preferences"})
+		return
+	}
+
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"preferences"}, "preferences": prefs})
+
+	// Marketing consent changes are kept as evidence of opt-in
+	if prefs.MarketingOptIn != previousOptIn {
+		recordAudit(c, AuditEvent{
+			Type:   "marketing.consent",
+			UserID: userID,
+			Data:   bson.M{"opt_in": prefs.MarketingOptIn},
+		})
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+// adminGetPreferences lets other services (notifications, pricing) read a
+// user's settings.
+func adminGetPreferences(c *gin.Context) {
+	var user User
+	err := authService.db.Collection("users").FindOne(context.Background(), tenantUserFilter(c, c.Param("id"))).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":     user.ID,
+		"email":       user.Email,
+		"preferences": user.preferences(),
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProductLink is a merchandiser's association from one product to another,
+// kept in product_links. Links of a type are shown in Position order.
+type ProductLink struct {
+	ProductID string    `bson:"product_id" json:"product_id"`
+	Type      string    `bson:"type" json:"type"`
+	RelatedID string    `bson:"related_id" json:"related_id"`
+	Position  int       `bson:"position" json:"position"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+const (
+	// Similar alternatives to the product
+	LinkRelated = "related"
+	// Pricier or better alternatives to suggest instead
+	LinkUpsell = "upsell"
+	// Complementary products to buy alongside it
+	LinkCrossSell = "cross_sell"
+)
+
+var linkTypes = map[string]bool{LinkRelated: true, LinkUpsell: true, LinkCrossSell: true}
+
+const (
+	maxLinksPerType     = 20
+	defaultRelatedLimit = 8
+	// Candidates scored for the automatic fallback
+	fallbackCandidates = 200
+)
+
+func setupAssociations() {
+	_, err := productService.db.Collection("product_links").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "type", Value: 1}, {Key: "related_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "related_id", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
+
+func linkTypeParam(c *gin.Context, value string) (string, bool) {
+	if !linkTypes[value] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be related, upsell or cross_sell"})
+		return "", false
+	}
+	return value, true
+}
+
+func loadLinks(ctx context.Context, productID, linkType string) ([]ProductLink, error) {
+	filter := bson.M{"product_id": productID}
+	if linkType != "" {
+		filter["type"] = linkType
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "type", Value: 1}, {Key: "position", Value: 1}})
+	cursor, err := productService.db.Collection("product_links").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	links := []ProductLink{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// listProductLinks shows a product's manual links for management, grouped
+// by type, including links to drafts.
+func listProductLinks(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	links, err := loadLinks(c.Request.Context(), product.ID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch links"})
+		return
+	}
+
+	grouped := gin.H{LinkRelated: []ProductLink{}, LinkUpsell: []ProductLink{}, LinkCrossSell: []ProductLink{}}
+	for _, link := range links {
+		grouped[link.Type] = append(grouped[link.Type].([]ProductLink), link)
+	}
+	c.JSON(http.StatusOK, grouped)
+}
+
+// putProductLinks replaces a product's links of one type with the given
+// products, in display order.
+func putProductLinks(c *gin.Context) {
+	linkType, ok := linkTypeParam(c, c.Param("type"))
+	if !ok {
+		return
+	}
+	var req struct {
+		ProductIDs []string `json:"product_ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.ProductIDs) > maxLinksPerType {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxLinksPerType) + " links per type"})
+		return
+	}
+
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range req.ProductIDs {
+		if id == product.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A product can't be linked to itself"})
+			return
+		}
+		if seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate product " + id})
+			return
+		}
+		seen[id] = true
+	}
+
+	ctx := c.Request.Context()
+	found, err := loadProductsInOrder(ctx, req.ProductIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	if len(found) != len(req.ProductIDs) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product in product_ids"})
+		return
+	}
+
+	links := make([]interface{}, 0, len(req.ProductIDs))
+	for i, id := range req.ProductIDs {
+		links = append(links, ProductLink{
+			ProductID: product.ID,
+			Type:      linkType,
+			RelatedID: id,
+			Position:  i,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	collection := productService.db.Collection("product_links")
+	if _, err := collection.DeleteMany(ctx, bson.M{"product_id": product.ID, "type": linkType}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save links"})
+		return
+	}
+	if len(links) > 0 {
+		if _, err := collection.InsertMany(ctx, links); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save links"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"type": linkType, "product_ids": req.ProductIDs})
+}
+
+func deleteProductLink(c *gin.Context) {
+	linkType, ok := linkTypeParam(c, c.Param("type"))
+	if !ok {
+		return
+	}
+	result, err := productService.db.Collection("product_links").DeleteOne(c.Request.Context(),
+		bson.M{"product_id": c.Param("id"), "type": linkType, "related_id": c.Param("relatedId")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete link"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Link deleted"})
+}
+
+// deleteLinksTo drops a deleted product's links in both directions.
+func deleteLinksTo(ctx context.Context, productID string) {
+	_, err := productService.db.Collection("product_links").DeleteMany(ctx,
+		bson.M{"$or": bson.A{bson.M{"product_id": productID}, bson.M{"related_id": productID}}})
+	if err != nil {
+		log.Printf("Failed to delete links of product %s: %v", productID, err)
+	}
+}
+
+// relatedProduct is a product as suggested alongside another, marked with
+// whether a merchandiser picked it or the fallback did.
+type relatedProduct struct {
+	Product
+	Source string `json:"source"`
+}
+
+// automaticRelated suggests products sharing the product's category or tags
+// when merchandisers haven't linked enough, ranked by how much they share
+// and then by rating. Upsells must also cost more.
+func automaticRelated(ctx context.Context, product *Product, linkType string, exclude []string, limit int) ([]Product, error) {
+	similar := bson.A{}
+	if product.CategoryID != "" {
+		similar = append(similar, bson.M{"category_id": product.CategoryID})
+	} else if product.Category != "" {
+		similar = append(similar, bson.M{"category": product.Category})
+	}
+	if len(product.Tags) > 0 {
+		similar = append(similar, bson.M{"tags": bson.M{"$in": product.Tags}})
+	}
+	if len(similar) == 0 {
+		return nil, nil
+	}
+
+	filter := publishedFilter(bson.M{"_id": bson.M{"$nin": append(exclude, product.ID)}, "$or": similar})
+	if linkType == LinkUpsell {
+		filter["price"] = bson.M{"$gt": product.Price}
+	}
+	opts := options.Find().SetLimit(fallbackCandidates).
+		SetSort(bson.D{{Key: "rating", Value: -1}}).
+		SetProjection(bson.M{"quality": 0})
+	cursor, err := productService.db.Collection("products").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Product
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]bool, len(product.Tags))
+	for _, tag := range product.Tags {
+		tags[tag] = true
+	}
+	score := func(p *Product) int {
+		s := 0
+		if (product.CategoryID != "" && p.CategoryID == product.CategoryID) || (product.CategoryID == "" && p.Category == product.Category) {
+			s += 3
+		}
+		for _, tag := range p.Tags {
+			if tags[tag] {
+				s++
+			}
+		}
+		return s
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		si, sj := score(&candidates[i]), score(&candidates[j])
+		if si != sj {
+			return si > sj
+		}
+		return candidates[i].Rating > candidates[j].Rating
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates, nil
+}
+
+// getRelatedProducts lists the published products linked to a product,
+// ?type= related (default), upsell or cross_sell, up to ?limit=. Unless
+// ?fallback=false, related and upsell lists are topped up automatically;
+// cross-sells are complementary, which shared category and tags don't
+// capture, so they're only topped up when asked with ?fallback=true.
+func getRelatedProducts(c *gin.Context) {
+	linkType, ok := linkTypeParam(c, c.DefaultQuery("type", LinkRelated))
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRelatedLimit)))
+	if err != nil || limit < 1 || limit > maxLinksPerType {
+		limit = defaultRelatedLimit
+	}
+	fallback := c.Query("fallback") == "true" || (c.Query("fallback") == "" && linkType != LinkCrossSell)
+
+	ctx := c.Request.Context()
+	var product Product
+	if err := productService.db.Collection("products").FindOne(ctx, publishedFilter(bson.M{"_id": c.Param("id")})).Decode(&product); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	links, err := loadLinks(ctx, product.ID, linkType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch related products"})
+		return
+	}
+	ids := make([]string, 0, len(links))
+	for _, link := range links {
+		ids = append(ids, link.RelatedID)
+	}
+	linked, err := loadProductsInOrder(ctx, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch related products"})
+		return
+	}
+
+	chain := storefrontLocales(c)
+	results := []relatedProduct{}
+	for _, p := range linked {
+		localizeProduct(&p, chain)
+		p.Availability = p.availability()
+		if p.published() && len(results) < limit {
+			p.Media = p.gallery()
+			results = append(results, relatedProduct{Product: p, Source: "manual"})
+		}
+	}
+
+	if fallback && len(results) < limit {
+		automatic, err := automaticRelated(ctx, &product, linkType, ids, limit-len(results))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch related products"})
+			return
+		}
+		for _, p := range automatic {
+			p.Media = p.gallery()
+			localizeProduct(&p, chain)
+			p.Availability = p.availability()
+			results = append(results, relatedProduct{Product: p, Source: "automatic"})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"type": linkType, "products": results, "count": len(results)})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AttributeDef declares a typed attribute for the products of a category,
+// such as "screen size" for TVs. Subcategories inherit their ancestors'
+// attributes and may redefine them. Values are stored on products as
+// strings in a canonical form, lowercase for text and enums, and filters
+// are put in the same form before they're compared exactly.
+type AttributeDef struct {
+	Name  string `bson:"name" json:"name"`
+	Label string `bson:"label,omitempty" json:"label,omitempty"`
+	Type  string `bson:"type" json:"type"`
+	// Shown after number values, e.g. "in"
+	Unit string `bson:"unit,omitempty" json:"unit,omitempty"`
+	// The allowed values of an enum
+	Values []string `bson:"values,omitempty" json:"values,omitempty"`
+	// Bounds of a number
+	Min      *float64 `bson:"min,omitempty" json:"min,omitempty"`
+	Max      *float64 `bson:"max,omitempty" json:"max,omitempty"`
+	Required bool     `bson:"required" json:"required"`
+	// Offered as a storefront filter
+	Facet bool `bson:"facet" json:"facet"`
+	// The ancestor the definition comes from, in effective schemas
+	InheritedFrom string `bson:"-" json:"inherited_from,omitempty"`
+}
+
+const (
+	AttributeText    = "text"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+const (
+	maxCategoryAttributes = 50
+	maxAttributeFilters   = 10
+)
+
+var attributeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]{0,49}$`)
+
+// setupAttributes indexes every product attribute for filtering.
+func setupAttributes() {
+	_, err := productService.db.Collection("products").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "attributes.$**", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
+
+// validateAttributeDefs normalizes a category's definitions and says what's
+// wrong with them, if anything.
+func validateAttributeDefs(defs []AttributeDef) string {
+	if len(defs) > maxCategoryAttributes {
+		return "At most " + strconv.Itoa(maxCategoryAttributes) + " attributes per category"
+	}
+	seen := map[string]bool{}
+	for i := range defs {
+		def := &defs[i]
+		def.Name = strings.ToLower(strings.TrimSpace(def.Name))
+		if !attributeNamePattern.MatchString(def.Name) {
+			return "Invalid attribute name " + strconv.Quote(def.Name)
+		}
+		if seen[def.Name] {
+			return "Duplicate attribute " + def.Name
+		}
+		seen[def.Name] = true
+
+		switch def.Type {
+		case AttributeText, AttributeBoolean:
+		case AttributeNumber:
+			if def.Min != nil && def.Max != nil && *def.Min > *def.Max {
+				return def.Name + ": min is above max"
+			}
+		case AttributeEnum:
+			if len(def.Values) == 0 {
+				return def.Name + ": an enum needs values"
+			}
+			for j, value := range def.Values {
+				if def.Values[j] = canonicalText(value); def.Values[j] == "" {
+					return def.Name + ": enum values can't be empty"
+				}
+			}
+		default:
+			return def.Name + ": type must be text, number, boolean or enum"
+		}
+		if def.Type != AttributeEnum {
+			def.Values = nil
+		}
+		if def.Type != AttributeNumber {
+			def.Min, def.Max, def.Unit = nil, nil, ""
+		}
+	}
+	return ""
+}
+
+// categorySchema is the category's effective schema: its ancestors'
+// definitions from the root down, then its own, later ones replacing
+// earlier ones of the same name.
+func categorySchema(ctx context.Context, category *Category) ([]AttributeDef, error) {
+	levels := []*Category{category}
+	if len(category.Ancestors) > 0 {
+		cursor, err := productService.db.Collection("categories").Find(ctx, bson.M{"_id": bson.M{"$in": category.Ancestors}})
+		if err != nil {
+			return nil, err
+		}
+		var ancestors []Category
+		if err := cursor.All(ctx, &ancestors); err != nil {
+			return nil, err
+		}
+		depth := map[string]int{}
+		for i, id := range category.Ancestors {
+			depth[id] = i
+		}
+		sort.Slice(ancestors, func(i, j int) bool { return depth[ancestors[i].ID] < depth[ancestors[j].ID] })
+		levels = nil
+		for i := range ancestors {
+			levels = append(levels, &ancestors[i])
+		}
+		levels = append(levels, category)
+	}
+
+	schema := []AttributeDef{}
+	index := map[string]int{}
+	for _, level := range levels {
+		for _, def := range level.Attributes {
+			if level.ID != category.ID {
+				def.InheritedFrom = level.ID
+			}
+			if i, ok := index[def.Name]; ok {
+				schema[i] = def
+				continue
+			}
+			index[def.Name] = len(schema)
+			schema = append(schema, def)
+		}
+	}
+	return schema, nil
+}
+
+// productSchema is the effective schema of the category with the given ID,
+// empty for uncategorized products.
+func productSchema(ctx context.Context, categoryID string) ([]AttributeDef, error) {
+	if categoryID == "" {
+		return nil, nil
+	}
+	category, err := findCategory(ctx, categoryID)
+	if err != nil {
+		return nil, err
+	}
+	return categorySchema(ctx, category)
+}
+
+// canonicalText is the stored form of text and enum values.
+func canonicalText(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// attributeValue checks a value against its definition and returns it in
+// canonical form.
+func attributeValue(def *AttributeDef, value string) (string, string) {
+	switch def.Type {
+	case AttributeNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", "must be a number"
+		}
+		if def.Min != nil && n < *def.Min {
+			return "", "must be at least " + formatFloat(*def.Min)
+		}
+		if def.Max != nil && n > *def.Max {
+			return "", "must be at most " + formatFloat(*def.Max)
+		}
+		return formatFloat(n), ""
+	case AttributeBoolean:
+		switch strings.ToLower(value) {
+		case "true", "yes", "1":
+			return "true", ""
+		case "false", "no", "0":
+			return "false", ""
+		}
+		return "", "must be true or false"
+	case AttributeEnum:
+		for _, allowed := range def.Values {
+			if strings.EqualFold(allowed, value) {
+				return canonicalText(allowed), ""
+			}
+		}
+		return "", "must be one of " + strings.Join(def.Values, ", ")
+	}
+	return canonicalText(value), ""
+}
+
+// applySchema normalizes the product's attributes and checks them against
+// the schema, returning what's wrong per attribute. Attributes the schema
+// doesn't define are kept as free-form text.
+func applySchema(p *Product, schema []AttributeDef) map[string]string {
+	attributes := normalizeAttributes(p.Attributes)
+	problems := map[string]string{}
+	for i := range schema {
+		def := &schema[i]
+		value, ok := attributes[def.Name]
+		if !ok || value == "" {
+			delete(attributes, def.Name)
+			if def.Required {
+				problems[def.Name] = "is required"
+			}
+			continue
+		}
+		canonical, msg := attributeValue(def, value)
+		if msg != "" {
+			problems[def.Name] = msg
+			continue
+		}
+		attributes[def.Name] = canonical
+	}
+	if len(attributes) == 0 {
+		attributes = nil
+	}
+	p.Attributes = attributes
+	return problems
+}
+
+// checkAttributes validates the product against its category's schema,
+// writing a 400 that lists the problems if it doesn't fit.
+func checkAttributes(c *gin.Context, p *Product) bool {
+	schema, err := productSchema(c.Request.Context(), p.CategoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attribute schema"})
+		return false
+	}
+	if problems := applySchema(p, schema); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attributes", "attributes": problems})
+		return false
+	}
+	return true
+}
+
+// schemaProblems formats applySchema's problems as one message, for
+// imports.
+func schemaProblems(problems map[string]string) string {
+	messages := make([]string, 0, len(problems))
+	for name, msg := range problems {
+		messages = append(messages, "attribute "+name+" "+msg)
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, "; ")
+}
+
+// getCategoryAttributes returns the category's effective schema.
+func getCategoryAttributes(c *gin.Context) {
+	category, err := findCategory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	schema, err := categorySchema(c.Request.Context(), category)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attribute schema"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"category_id": category.ID, "attributes": schema})
+}
+
+// putCategoryAttributes replaces the attributes the category itself
+// defines. Products are checked against the new schema when next saved.
+func putCategoryAttributes(c *gin.Context) {
+	var req struct {
+		Attributes []AttributeDef `json:"attributes" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := validateAttributeDefs(req.Attributes); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	ctx := c.Request.Context()
+	category, err := findCategory(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	_, err = productService.db.Collection("categories").UpdateOne(ctx, bson.M{"_id": category.ID},
+		bson.M{"$set": bson.M{"attributes": req.Attributes, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update category"})
+		return
+	}
+
+	category.Attributes = req.Attributes
+	schema, err := categorySchema(ctx, category)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attribute schema"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"category_id": category.ID, "attributes": schema})
+}
+
+// filterValues is what a filter value may be stored as. The filter doesn't
+// know the attribute's type, so numbers and booleans also match their
+// canonical forms.
+func filterValues(value string) []string {
+	values := []string{canonicalText(value)}
+	if n, err := strconv.ParseFloat(values[0], 64); err == nil && formatFloat(n) != values[0] {
+		values = append(values, formatFloat(n))
+	}
+	switch values[0] {
+	case "yes", "1":
+		values = append(values, "true")
+	case "no", "0":
+		values = append(values, "false")
+	}
+	return values
+}
+
+// attributesParam reads ?attr:<name>=a,b filters, named like the import
+// columns. Products must match every attribute, with any of its values.
+func attributesParam(c *gin.Context) (map[string][]string, bool) {
+	filters := map[string][]string{}
+	for key, values := range c.Request.URL.Query() {
+		name, ok := strings.CutPrefix(key, attributeColumnPrefix)
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !attributeNamePattern.MatchString(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attribute " + strconv.Quote(name)})
+			return nil, false
+		}
+		for _, value := range values {
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					filters[name] = append(filters[name], filterValues(v)...)
+				}
+			}
+		}
+	}
+	if len(filters) > maxAttributeFilters {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxAttributeFilters) + " attribute filters"})
+		return nil, false
+	}
+	return filters, true
+}
+
+// attributeFilter narrows a product query to ?attr:<name>= filters.
+func attributeFilter(c *gin.Context, filter bson.M) bool {
+	filters, ok := attributesParam(c)
+	for name, values := range filters {
+		filter["attributes."+name] = bson.M{"$in": values}
+	}
+	return ok
+}
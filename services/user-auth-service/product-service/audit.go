@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every edit to a product is recorded in product_audit with who made it,
+// the fields it changed, and the product as saved, which it can be
+// reverted to. Figures kept up to date automatically, such as stock,
+// ratings and views, aren't part of the diff, and edits made in bulk, such
+// as tag merges and brand renames, aren't recorded. Revisions are kept for
+// PRODUCT_AUDIT_RETENTION (default a year).
+const (
+	AuditCreated            = "created"
+	AuditUpdated            = "updated"
+	AuditDeleted            = "deleted"
+	AuditStatusChanged      = "status_changed"
+	AuditVariantsChanged    = "variants_changed"
+	AuditMediaChanged       = "media_changed"
+	AuditTranslationChanged = "translation_changed"
+	AuditFilesChanged       = "files_changed"
+	AuditImported           = "imported"
+	AuditReverted           = "reverted"
+	AuditScheduleChanged    = "schedule_changed"
+	AuditScheduledPublish   = "scheduled_publish"
+	AuditScheduledUnpublish = "scheduled_unpublish"
+)
+
+var auditRetention = envDuration("PRODUCT_AUDIT_RETENTION", 365*24*time.Hour)
+
+// auditIgnoredFields are bookkeeping, or maintained by the service rather
+// than edited.
+var auditIgnoredFields = map[string]bool{
+	"_id": true, "updated_at": true, "quality": true, "stock": true, "rating": true, "reviews": true,
+	"views": true, "popularity": true, "previous_slugs": true,
+}
+
+// ProductRevision is one recorded edit.
+type ProductRevision struct {
+	ID             string        `bson:"_id" json:"id"`
+	ProductID      string        `bson:"product_id" json:"product_id"`
+	Action         string        `bson:"action" json:"action"`
+	ActorID        string        `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	ImpersonatedBy string        `bson:"impersonated_by,omitempty" json:"impersonated_by,omitempty"`
+	IP             string        `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent      string        `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	Changes        []FieldChange `bson:"changes" json:"changes"`
+	// What the action was about, such as the revision reverted to
+	Data bson.M `bson:"data,omitempty" json:"data,omitempty"`
+	// The product as saved; none once deleted
+	Snapshot  *Product  `bson:"snapshot,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// FieldChange is a top-level product field's value before and after an
+// edit, null where it was or became unset.
+type FieldChange struct {
+	Field string      `bson:"field" json:"field"`
+	Old   interface{} `bson:"old" json:"old"`
+	New   interface{} `bson:"new" json:"new"`
+}
+
+func setupAudit() {
+	_, err := productService.db.Collection("product_audit").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(auditRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to create audit indexes: %v", err)
+	}
+}
+
+// productFields is the product as stored, by field.
+func productFields(p *Product) bson.M {
+	fields := bson.M{}
+	if p == nil {
+		return fields
+	}
+	if data, err := bson.Marshal(p); err == nil {
+		bson.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// diffProducts lists the fields that differ, by name.
+func diffProducts(before, after *Product) []FieldChange {
+	old, updated := productFields(before), productFields(after)
+	names := []string{}
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range updated {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		if !auditIgnoredFields[name] && !reflect.DeepEqual(old[name], updated[name]) {
+			changes = append(changes, FieldChange{Field: name, Old: old[name], New: updated[name]})
+		}
+	}
+	return changes
+}
+
+// newRevision describes the change from before to after, either of which
+// is nil for a product that didn't or no longer exists.
+func newRevision(productID, action string, before, after *Product) ProductRevision {
+	return ProductRevision{
+		ID:        primitive.NewObjectID().Hex(),
+		ProductID: productID,
+		Action:    action,
+		Changes:   diffProducts(before, after),
+		Snapshot:  after,
+		CreatedAt: time.Now(),
+	}
+}
+
+// recordProductChange records an edit made by the request, reading the
+// product as it now is. Edits that change nothing tracked aren't recorded.
+func recordProductChange(c *gin.Context, action, productID string, before *Product, data bson.M) {
+	rev, ok := storedRevision(c.Request.Context(), action, productID, before)
+	if !ok {
+		return
+	}
+	rev.Data = data
+	rev.ActorID = callerID(c)
+	rev.ImpersonatedBy = c.GetString("impersonated_by")
+	rev.IP = c.ClientIP()
+	rev.UserAgent = c.Request.UserAgent()
+	insertRevision(c.Request.Context(), rev)
+}
+
+// recordServiceChange records an edit the service made on its own, such as
+// a scheduled publication.
+func recordServiceChange(ctx context.Context, action, productID string, before *Product, data bson.M) {
+	if rev, ok := storedRevision(ctx, action, productID, before); ok {
+		rev.Data = data
+		insertRevision(ctx, rev)
+	}
+}
+
+// storedRevision describes the change from before to the product as it's
+// stored, reporting false if nothing tracked changed.
+func storedRevision(ctx context.Context, action, productID string, before *Product) (ProductRevision, bool) {
+	var after *Product
+	var stored Product
+	if err := productService.db.Collection("products").FindOne(ctx, bson.M{"_id": productID}).Decode(&stored); err == nil {
+		after = &stored
+	}
+	rev := newRevision(productID, action, before, after)
+	return rev, before == nil || after == nil || len(rev.Changes) > 0
+}
+
+func insertRevision(ctx context.Context, rev ProductRevision) {
+	if _, err := productService.db.Collection("product_audit").InsertOne(ctx, rev); err != nil {
+		log.Printf("Failed to record %s of product %s: %v", rev.Action, rev.ProductID, err)
+	}
+}
+
+// updateAudited applies update to the product and records the edit. It
+// returns mongo.ErrNoDocuments if the product doesn't exist.
+func updateAudited(c *gin.Context, action, productID string, update bson.M) error {
+	var before Product
+	err := productService.db.Collection("products").FindOneAndUpdate(c.Request.Context(), bson.M{"_id": productID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&before)
+	if err != nil {
+		return err
+	}
+	recordProductChange(c, action, productID, &before, nil)
+	return nil
+}
+
+// listProductAudit pages through a product's revisions, newest first.
+func listProductAudit(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+
+	ctx := c.Request.Context()
+	filter := bson.M{"product_id": c.Param("id")}
+	collection := productService.db.Collection("product_audit")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit trail"})
+		return
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64((page-1)*perPage)).
+		SetLimit(int64(perPage)).
+		SetProjection(bson.M{"snapshot": 0}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit trail"})
+		return
+	}
+	revisions := []ProductRevision{}
+	if err := cursor.All(ctx, &revisions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode audit trail"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions, "total": total, "page": page, "per_page": perPage})
+}
+
+func findRevision(c *gin.Context) (*ProductRevision, bool) {
+	var rev ProductRevision
+	err := productService.db.Collection("product_audit").FindOne(c.Request.Context(),
+		bson.M{"_id": c.Param("revisionId"), "product_id": c.Param("id")}).Decode(&rev)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return nil, false
+	}
+	return &rev, true
+}
+
+// getProductRevision shows a revision with the product as it was saved.
+func getProductRevision(c *gin.Context) {
+	rev, ok := findRevision(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revision": rev, "product": rev.Snapshot})
+}
+
+// revertProduct restores a product to how a revision saved it, re-creating
+// it as a draft if it has since been deleted. Stock, ratings, views and
+// digital files stay as they are.
+func revertProduct(c *gin.Context) {
+	rev, ok := findRevision(c)
+	if !ok {
+		return
+	}
+	if rev.Snapshot == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Revision has no version to revert to"})
+		return
+	}
+	ctx := c.Request.Context()
+	product := *rev.Snapshot
+	product.ID = rev.ProductID
+	data := bson.M{"revision_id": rev.ID}
+
+	collection := productService.db.Collection("products")
+	var current Product
+	err := collection.FindOne(ctx, bson.M{"_id": product.ID}).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		product.Status = StatusDraft
+		product.Stock, product.Rating, product.Reviews, product.Views, product.Popularity = 0, 0, 0, 0, 0
+		product.Files = nil
+		if !assignProductSlug(c, &product, nil) || !checkPublishable(c, &product, nil) {
+			return
+		}
+		product.UpdatedAt = time.Now()
+		_, err = collection.InsertOne(ctx, product)
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": duplicateProductError(err)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert product"})
+			return
+		}
+		invalidateProduct(ctx, "")
+		publishProductSaved(ctx, &product, true, 0)
+		recordProductChange(c, AuditReverted, product.ID, nil, data)
+		c.JSON(http.StatusOK, gin.H{"message": "Product restored as a draft", "product": product})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert product"})
+		return
+	}
+
+	if !checkTransition(c, &current, product.Status) {
+		return
+	}
+	product.Stock, product.Rating, product.Reviews = current.Stock, current.Rating, current.Reviews
+	product.Views, product.Popularity = current.Views, current.Popularity
+	product.CreatedAt = current.CreatedAt
+	// Stored files may be gone since; they're managed on their own
+	product.Files = current.Files
+	if !assignProductSlug(c, &product, &current) || !checkPublishable(c, &product, &current) {
+		return
+	}
+	product.UpdatedAt = time.Now()
+
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": product.ID}, product)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": duplicateProductError(err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert product"})
+		return
+	}
+	invalidateProduct(ctx, product.ID)
+	publishProductSaved(ctx, &product, false, current.Price)
+	recordProductChange(c, AuditReverted, product.ID, &current, data)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Product reverted", "product": product})
+}
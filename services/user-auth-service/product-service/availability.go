@@ -0,0 +1,41 @@
+package main
+
+// Storefront reads carry an availability computed from the mirrored stock
+// level, so clients don't each interpret the raw count. Stock at or below
+// the low-stock threshold (the product's low_stock_threshold, or
+// LOW_STOCK_THRESHOLD, default 5, as the inventory service's badges use)
+// is low; products out of stock are on backorder if they take orders
+// anyway. Digital products are always in stock.
+const (
+	AvailabilityInStock    = "in_stock"
+	AvailabilityLowStock   = "low_stock"
+	AvailabilityBackorder  = "backorder"
+	AvailabilityOutOfStock = "out_of_stock"
+)
+
+func defaultLowStockThreshold() int {
+	return envInt("LOW_STOCK_THRESHOLD", 5)
+}
+
+func (p *Product) availability() string {
+	threshold := defaultLowStockThreshold()
+	if p.LowStockThreshold != nil {
+		threshold = *p.LowStockThreshold
+	}
+	switch {
+	case p.Digital || p.Stock > threshold:
+		return AvailabilityInStock
+	case p.Stock > 0:
+		return AvailabilityLowStock
+	case p.Backorder:
+		return AvailabilityBackorder
+	default:
+		return AvailabilityOutOfStock
+	}
+}
+
+func setAvailability(products []Product) {
+	for i := range products {
+		products[i].Availability = products[i].availability()
+	}
+}
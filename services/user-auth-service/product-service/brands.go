@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Brand is a manufacturer or label products are sold under. Products link
+// to it by brand_id and carry its name, like categories.
+type Brand struct {
+	ID          string    `bson:"_id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	Slug        string    `bson:"slug" json:"slug"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	LogoURL     string    `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+const brandLandingProducts = 20
+
+// setupBrands creates the brand indexes and turns the brand attribute
+// products had before brands existed into brands.
+func setupBrands() {
+	ctx := context.Background()
+	_, err := productService.db.Collection("brands").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create brand indexes: %v", err)
+	}
+	_, err = productService.db.Collection("products").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "brand_id", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	migrateProductBrands(ctx)
+}
+
+func migrateProductBrands(ctx context.Context) {
+	products := productService.db.Collection("products")
+	attribute := "attributes." + brandAttribute
+	unlinked := bson.M{"brand_id": bson.M{"$exists": false}, attribute: bson.M{"$nin": bson.A{"", nil}}}
+	names, err := products.Distinct(ctx, attribute, unlinked)
+	if err != nil {
+		log.Printf("Failed to migrate product brands: %v", err)
+		return
+	}
+
+	for _, raw := range names {
+		name, _ := raw.(string)
+		slug := slugify(name)
+		if slug == "" {
+			continue
+		}
+
+		var brand Brand
+		err := productService.db.Collection("brands").FindOne(ctx, bson.M{"slug": slug}).Decode(&brand)
+		if err == mongo.ErrNoDocuments {
+			brand = Brand{
+				ID:        primitive.NewObjectID().Hex(),
+				Name:      name,
+				Slug:      slug,
+				CreatedAt: time.Now(),
+				UpdatedAt: time.Now(),
+			}
+			_, err = productService.db.Collection("brands").InsertOne(ctx, brand)
+		}
+		if err != nil {
+			log.Printf("Failed to migrate brand %q: %v", name, err)
+			continue
+		}
+
+		products.UpdateMany(ctx,
+			bson.M{"brand_id": bson.M{"$exists": false}, attribute: name},
+			bson.M{"$set": bson.M{"brand_id": brand.ID, "brand": brand.Name}})
+	}
+}
+
+// findBrand looks a brand up by ID or slug.
+func findBrand(ctx context.Context, ref string) (*Brand, error) {
+	var brand Brand
+	err := productService.db.Collection("brands").FindOne(ctx,
+		bson.M{"$or": bson.A{bson.M{"_id": ref}, bson.M{"slug": ref}}}).Decode(&brand)
+	if err != nil {
+		return nil, err
+	}
+	return &brand, nil
+}
+
+// assignBrand validates a product's brand_id, adding to problems if the
+// brand doesn't exist, and copies the brand's name into the product's
+// brand field.
+func assignBrand(ctx context.Context, product *Product, problems map[string]string) {
+	if product.BrandID == "" {
+		product.Brand = ""
+		return
+	}
+	var brand Brand
+	err := productService.db.Collection("brands").FindOne(ctx, bson.M{"_id": product.BrandID}).Decode(&brand)
+	if err != nil {
+		problems["brand_id"] = "must be an existing brand"
+		return
+	}
+	product.Brand = brand.Name
+}
+
+// brandParam resolves ?brand= to brand IDs, any of which products may
+// have. Brands are given by ID or slug, comma separated; it writes an error
+// and returns false if one is unknown.
+func brandParam(c *gin.Context) ([]string, bool) {
+	value := c.Query("brand")
+	if value == "" {
+		return nil, true
+	}
+	ids := []string{}
+	for _, ref := range strings.Split(value, ",") {
+		if ref = strings.TrimSpace(ref); ref == "" {
+			continue
+		}
+		brand, err := findBrand(c.Request.Context(), ref)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Brand not found"})
+			return nil, false
+		}
+		ids = append(ids, brand.ID)
+	}
+	return ids, true
+}
+
+// brandFilter narrows a product query to ?brand=.
+func brandFilter(c *gin.Context, filter bson.M) bool {
+	ids, ok := brandParam(c)
+	if ok && ids != nil {
+		filter["brand_id"] = bson.M{"$in": ids}
+	}
+	return ok
+}
+
+func listBrands(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := productService.db.Collection("brands").Find(c.Request.Context(), bson.M{}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch brands"})
+		return
+	}
+	brands := []Brand{}
+	if err := cursor.All(c.Request.Context(), &brands); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode brands"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"brands": brands, "count": len(brands)})
+}
+
+// getBrand is a brand's landing page: the brand, how many published
+// products it has and in which categories, and its products, most
+// popular first unless ?sort= says otherwise.
+func getBrand(c *gin.Context) {
+	ctx := c.Request.Context()
+	brand, err := findBrand(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Brand not found"})
+		return
+	}
+
+	products := productService.db.Collection("products")
+	filter := publishedFilter(bson.M{"brand_id": brand.ID})
+	opts := options.Find().SetLimit(brandLandingProducts).
+		SetSort(bson.D{{Key: "popularity", Value: -1}, {Key: "views", Value: -1}, {Key: "_id", Value: 1}})
+	if !listingSort(c, opts) {
+		return
+	}
+	cursor, err := products.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	listed := []Product{}
+	if err := cursor.All(ctx, &listed); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
+		return
+	}
+	localizeProducts(listed, storefrontLocales(c))
+	setAvailability(listed)
+
+	total, err := products.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count products"})
+		return
+	}
+	cursor, err = products.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": "$category_id", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		{{Key: "$limit", Value: maxCategoryFacets}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count categories"})
+		return
+	}
+	categories := []categoryFacet{}
+	for cursor.Next(ctx) {
+		var row struct {
+			ID    string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		if cursor.Decode(&row) == nil && row.ID != "" {
+			categories = append(categories, categoryFacet{ID: row.ID, Count: row.Count})
+		}
+	}
+	cursor.Close(ctx)
+
+	c.JSON(http.StatusOK, gin.H{
+		"brand":      brand,
+		"total":      total,
+		"categories": nameCategoryFacets(ctx, categories),
+		"products":   listed,
+		"count":      len(listed),
+	})
+}
+
+type brandRequest struct {
+	Name        *string `json:"name"`
+	Slug        *string `json:"slug"`
+	Description *string `json:"description"`
+	LogoURL     *string `json:"logo_url"`
+}
+
+func createBrand(c *gin.Context) {
+	var req brandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	brand := Brand{
+		ID:        primitive.NewObjectID().Hex(),
+		Name:      strings.TrimSpace(*req.Name),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if req.Slug != nil {
+		brand.Slug = slugify(*req.Slug)
+	}
+	if brand.Slug == "" {
+		brand.Slug = slugify(brand.Name)
+	}
+	if brand.Slug == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Brand needs a slug"})
+		return
+	}
+	if req.Description != nil {
+		brand.Description = *req.Description
+	}
+	if req.LogoURL != nil {
+		brand.LogoURL = strings.TrimSpace(*req.LogoURL)
+	}
+
+	if _, err := productService.db.Collection("brands").InsertOne(c.Request.Context(), brand); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A brand with this slug already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create brand"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, brand)
+}
+
+// updateBrand changes a brand; renaming it renames it on its products.
+func updateBrand(c *gin.Context) {
+	var req brandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	brand, err := findBrand(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Brand not found"})
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	renamed := false
+	if req.Name != nil && strings.TrimSpace(*req.Name) != "" {
+		name := strings.TrimSpace(*req.Name)
+		renamed = name != brand.Name
+		brand.Name = name
+		set["name"] = name
+	}
+	if req.Slug != nil {
+		if brand.Slug = slugify(*req.Slug); brand.Slug == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Brand needs a slug"})
+			return
+		}
+		set["slug"] = brand.Slug
+	}
+	if req.Description != nil {
+		brand.Description = *req.Description
+		set["description"] = brand.Description
+	}
+	if req.LogoURL != nil {
+		brand.LogoURL = strings.TrimSpace(*req.LogoURL)
+		set["logo_url"] = brand.LogoURL
+	}
+	brand.UpdatedAt = set["updated_at"].(time.Time)
+
+	if _, err := productService.db.Collection("brands").UpdateOne(ctx, bson.M{"_id": brand.ID}, bson.M{"$set": set}); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A brand with this slug already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update brand"})
+		return
+	}
+	if renamed {
+		_, err := productService.db.Collection("products").UpdateMany(ctx,
+			bson.M{"brand_id": brand.ID}, bson.M{"$set": bson.M{"brand": brand.Name}})
+		if err != nil {
+			log.Printf("Failed to rename brand %s on products: %v", brand.ID, err)
+		}
+		invalidateCatalog(ctx)
+	}
+
+	c.JSON(http.StatusOK, brand)
+}
+
+func deleteBrand(c *gin.Context) {
+	ctx := c.Request.Context()
+	brand, err := findBrand(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Brand not found"})
+		return
+	}
+	if n, _ := productService.db.Collection("products").CountDocuments(ctx, bson.M{"brand_id": brand.ID}); n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Brand has products", "products": n})
+		return
+	}
+
+	if _, err := productService.db.Collection("brands").DeleteOne(ctx, bson.M{"_id": brand.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete brand"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Brand deleted successfully"})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Product detail and storefront listings are cached in Redis for
+// PRODUCT_CACHE_TTL (default 5m) and PRODUCT_LISTING_CACHE_TTL (default 1m);
+// 0 turns either off. Keys carry generation counters: writes to one product
+// drop its entry and bump the listing generation, and writes to many at
+// once bump the catalog generation, which every key includes. Entries of
+// old generations are never read again and expire on their own.
+var (
+	productCacheTTL = envDuration("PRODUCT_CACHE_TTL", 5*time.Minute)
+	listingCacheTTL = envDuration("PRODUCT_LISTING_CACHE_TTL", time.Minute)
+)
+
+// Redis is only a shortcut; reads fall back to Mongo when it's slow or down
+const cacheTimeout = 200 * time.Millisecond
+
+const (
+	catalogGenerationKey = "cache:products:generation"
+	listingGenerationKey = "cache:products:listing:generation"
+)
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d >= 0 {
+		return d
+	}
+	return fallback
+}
+
+func cacheContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cacheTimeout)
+}
+
+// generations reads the catalog and listing generations; missing counters
+// read as 0.
+func generations(ctx context.Context) (catalog, listing string, err error) {
+	values, err := redisClient.MGet(ctx, catalogGenerationKey, listingGenerationKey).Result()
+	if err != nil {
+		return "", "", err
+	}
+	catalog, listing = "0", "0"
+	if s, ok := values[0].(string); ok {
+		catalog = s
+	}
+	if s, ok := values[1].(string); ok {
+		listing = s
+	}
+	return catalog, listing, nil
+}
+
+func productCacheKey(ctx context.Context, id string) (string, error) {
+	catalog, _, err := generations(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "cache:product:" + catalog + ":" + id, nil
+}
+
+// cachedProduct returns the stored product document, or nil on a miss.
+func cachedProduct(ctx context.Context, id string) *Product {
+	if productCacheTTL == 0 {
+		return nil
+	}
+	ctx, cancel := cacheContext(ctx)
+	defer cancel()
+
+	key, err := productCacheKey(ctx, id)
+	if err != nil {
+		return nil
+	}
+	data, err := redisClient.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Product cache read failed: %v", err)
+		}
+		return nil
+	}
+	var product Product
+	if err := bson.Unmarshal(data, &product); err != nil {
+		return nil
+	}
+	return &product
+}
+
+// cacheProduct stores the product document as read from Mongo, before any
+// per-request decoration.
+func cacheProduct(ctx context.Context, p *Product) {
+	if productCacheTTL == 0 {
+		return
+	}
+	ctx, cancel := cacheContext(ctx)
+	defer cancel()
+
+	data, err := bson.Marshal(p)
+	if err != nil {
+		return
+	}
+	key, err := productCacheKey(ctx, p.ID)
+	if err == nil {
+		err = redisClient.Set(ctx, key, data, productCacheTTL).Err()
+	}
+	if err != nil {
+		log.Printf("Product cache write failed: %v", err)
+	}
+}
+
+// listingCacheKey identifies a listing by its path and query string. Only
+// storefront listings are cached; staff asking for other states always read
+// Mongo.
+func listingCacheKey(ctx context.Context, c *gin.Context) (string, bool) {
+	if listingCacheTTL == 0 || (c.Query("status") != "" && c.Query("status") != StatusPublished) {
+		return "", false
+	}
+	catalog, listing, err := generations(ctx)
+	if err != nil {
+		return "", false
+	}
+	return "cache:products:listing:" + catalog + ":" + listing + ":" + listingID(c), true
+}
+
+// listingID hashes what identifies a listing. Encode sorts the parameters,
+// so their order doesn't matter. Listings are localized, so the locales
+// they were resolved for count too.
+func listingID(c *gin.Context) string {
+	sum := sha1.Sum([]byte(c.Request.URL.Path + "?" + c.Request.URL.Query().Encode() + "|" + strings.Join(localeChain(c), ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// serveCachedListing writes the cached response for the request's listing
+// if there is one. Otherwise it returns the key to store the response under,
+// or "" if it shouldn't be cached.
+func serveCachedListing(c *gin.Context) (key string, served bool) {
+	ctx, cancel := cacheContext(c.Request.Context())
+	defer cancel()
+
+	key, ok := listingCacheKey(ctx, c)
+	if !ok {
+		return "", false
+	}
+	data, err := redisClient.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Listing cache read failed: %v", err)
+		}
+		return key, false
+	}
+	c.Header("X-Cache", "HIT")
+	writeListing(c, data, true)
+	return key, true
+}
+
+// cacheListing stores a listing response under a key from
+// serveCachedListing.
+func cacheListing(ctx context.Context, key string, data []byte) {
+	ctx, cancel := cacheContext(ctx)
+	defer cancel()
+	if err := redisClient.Set(ctx, key, data, listingCacheTTL).Err(); err != nil {
+		log.Printf("Listing cache write failed: %v", err)
+	}
+}
+
+// invalidateProduct drops a product's cached detail and every cached
+// listing, after the product is created, changed or deleted. New products
+// have nothing cached yet and pass an empty id.
+func invalidateProduct(ctx context.Context, id string) {
+	ctx, cancel := cacheContext(ctx)
+	defer cancel()
+
+	pipe := redisClient.TxPipeline()
+	pipe.Incr(ctx, listingGenerationKey)
+	key, err := productCacheKey(ctx, id)
+	if err == nil {
+		if id != "" {
+			pipe.Del(ctx, key)
+		}
+		_, err = pipe.Exec(ctx)
+	}
+	if err != nil {
+		log.Printf("Failed to invalidate cache of product %s: %v", id, err)
+	}
+}
+
+// invalidateCatalog drops everything cached, after writes that touch many
+// products at once.
+func invalidateCatalog(ctx context.Context) {
+	ctx, cancel := cacheContext(ctx)
+	defer cancel()
+	if err := redisClient.Incr(ctx, catalogGenerationKey).Err(); err != nil {
+		log.Printf("Failed to invalidate product cache: %v", err)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Category is a node in the catalog tree. Ancestors holds the IDs from the
+// root down to the parent, so a subtree is one indexed query and products
+// only need to reference their own category.
+type Category struct {
+	ID   string `bson:"_id" json:"id"`
+	Name string `bson:"name" json:"name"`
+	Slug string `bson:"slug" json:"slug"`
+	// Slugs it had before, which redirect to the current one
+	PreviousSlugs []string `bson:"previous_slugs,omitempty" json:"-"`
+	Description   string   `bson:"description,omitempty" json:"description,omitempty"`
+	// Search engine title and description
+	MetaTitle       string `bson:"meta_title,omitempty" json:"meta_title,omitempty"`
+	MetaDescription string `bson:"meta_description,omitempty" json:"meta_description,omitempty"`
+	// Content in other locales, see i18n.go
+	Translations Translations `bson:"translations,omitempty" json:"-"`
+	Locale       string       `bson:"-" json:"locale,omitempty"`
+	ParentID     string       `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Ancestors    []string     `bson:"ancestors" json:"ancestors"`
+	Position     int          `bson:"position" json:"position"`
+	// Typed attributes of its products, see attributes.go
+	Attributes []AttributeDef `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	CreatedAt  time.Time      `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time      `bson:"updated_at" json:"updated_at"`
+}
+
+// CategoryNode is a category with its children, for the tree endpoint.
+type CategoryNode struct {
+	Category
+	Children []*CategoryNode `json:"children"`
+}
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(s string) string {
+	return strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// setupCategories creates the category indexes and turns the free-text
+// categories products had before the tree existed into root categories.
+func setupCategories() {
+	ctx := context.Background()
+	categories := productService.db.Collection("categories")
+	_, err := categories.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "ancestors", Value: 1}}},
+		{Keys: bson.D{{Key: "parent_id", Value: 1}, {Key: "position", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create category indexes: %v", err)
+	}
+	_, err = productService.db.Collection("products").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "category_id", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	migrateProductCategories(ctx)
+}
+
+func migrateProductCategories(ctx context.Context) {
+	products := productService.db.Collection("products")
+	unlinked := bson.M{"category_id": bson.M{"$exists": false}, "category": bson.M{"$nin": bson.A{"", nil}}}
+	names, err := products.Distinct(ctx, "category", unlinked)
+	if err != nil {
+		log.Printf("Failed to migrate product categories: %v", err)
+		return
+	}
+
+	for _, raw := range names {
+		name, _ := raw.(string)
+		slug := slugify(name)
+		if slug == "" {
+			continue
+		}
+
+		var category Category
+		err := productService.db.Collection("categories").FindOne(ctx, bson.M{"slug": slug}).Decode(&category)
+		if err == mongo.ErrNoDocuments {
+			category = Category{
+				ID:        primitive.NewObjectID().Hex(),
+				Name:      name,
+				Slug:      slug,
+				Ancestors: []string{},
+				CreatedAt: time.Now(),
+				UpdatedAt: time.Now(),
+			}
+			_, err = productService.db.Collection("categories").InsertOne(ctx, category)
+		}
+		if err != nil {
+			log.Printf("Failed to migrate category %q: %v", name, err)
+			continue
+		}
+
+		products.UpdateMany(ctx,
+			bson.M{"category_id": bson.M{"$exists": false}, "category": name},
+			bson.M{"$set": bson.M{"category_id": category.ID, "category": category.Name}})
+	}
+}
+
+// findCategory looks a category up by ID or slug.
+func findCategory(ctx context.Context, ref string) (*Category, error) {
+	var category Category
+	err := productService.db.Collection("categories").FindOne(ctx,
+		bson.M{"$or": bson.A{bson.M{"_id": ref}, bson.M{"slug": ref}}}).Decode(&category)
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// subtreeIDs returns the category and every category below it.
+func subtreeIDs(ctx context.Context, category *Category) ([]string, error) {
+	ids, err := productService.db.Collection("categories").Distinct(ctx, "_id", bson.M{"ancestors": category.ID})
+	if err != nil {
+		return nil, err
+	}
+	subtree := []string{category.ID}
+	for _, id := range ids {
+		if s, ok := id.(string); ok {
+			subtree = append(subtree, s)
+		}
+	}
+	return subtree, nil
+}
+
+// categoryFilter narrows a product query to the subtree of ?category=, an
+// ID or slug. It writes a 404 and returns false for unknown categories.
+func categoryFilter(c *gin.Context, filter bson.M) bool {
+	ids, ok := categoryParam(c)
+	if ok && ids != nil {
+		filter["category_id"] = bson.M{"$in": ids}
+	}
+	return ok
+}
+
+// categoryParam resolves ?category= to the IDs of its subtree, or nil when
+// it isn't set. It writes an error and returns false if it can't.
+func categoryParam(c *gin.Context) ([]string, bool) {
+	ref := c.Query("category")
+	if ref == "" {
+		return nil, true
+	}
+	category, err := findCategory(c.Request.Context(), ref)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return nil, false
+	}
+	ids, err := subtreeIDs(c.Request.Context(), category)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch categories"})
+		return nil, false
+	}
+	return ids, true
+}
+
+// assignCategory validates a product's category_id, adding to problems if
+// the category doesn't exist, and copies the category's name into the
+// product's category field.
+func assignCategory(ctx context.Context, product *Product, problems map[string]string) {
+	if product.CategoryID == "" {
+		return
+	}
+	var category Category
+	err := productService.db.Collection("categories").FindOne(ctx, bson.M{"_id": product.CategoryID}).Decode(&category)
+	if err != nil {
+		problems["category_id"] = "must be an existing category"
+		return
+	}
+	product.Category = category.Name
+}
+
+// ancestorsFor returns the ancestors a child of parentID has.
+func ancestorsFor(ctx context.Context, parentID string) ([]string, error) {
+	if parentID == "" {
+		return []string{}, nil
+	}
+	var parent Category
+	if err := productService.db.Collection("categories").FindOne(ctx, bson.M{"_id": parentID}).Decode(&parent); err != nil {
+		return nil, err
+	}
+	return append(parent.Ancestors, parent.ID), nil
+}
+
+func createCategory(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Slug        string `json:"slug"`
+		Description string `json:"description"`
+		ParentID    string `json:"parent_id"`
+		Position    int    `json:"position"`
+
+		MetaTitle       string `json:"meta_title"`
+		MetaDescription string `json:"meta_description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ancestors, err := ancestorsFor(c.Request.Context(), req.ParentID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parent category not found"})
+		return
+	}
+
+	category := Category{
+		ID:          primitive.NewObjectID().Hex(),
+		Name:        req.Name,
+		Slug:        normalizeSlug(req.Slug),
+		Description: req.Description,
+		ParentID:    req.ParentID,
+		Ancestors:   ancestors,
+		Position:    req.Position,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+
+		MetaTitle:       req.MetaTitle,
+		MetaDescription: req.MetaDescription,
+	}
+	if category.Slug != "" {
+		if taken, err := slugTaken(c.Request.Context(), "categories", category.Slug, ""); err != nil || taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "A category with this slug already exists"})
+			return
+		}
+	} else if category.Slug, err = uniqueSlug(c.Request.Context(), "categories", req.Name, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign slug"})
+		return
+	}
+	if category.Slug == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Category needs a slug"})
+		return
+	}
+
+	if _, err := productService.db.Collection("categories").InsertOne(context.Background(), category); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create category"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, category)
+}
+
+func listCategories(c *gin.Context) {
+	categories, err := loadCategories(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch categories"})
+		return
+	}
+	localizeCategories(categories, storefrontLocales(c))
+
+	c.JSON(http.StatusOK, gin.H{"categories": categories, "count": len(categories)})
+}
+
+func loadCategories(ctx context.Context) ([]Category, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "position", Value: 1}, {Key: "name", Value: 1}})
+	cursor, err := productService.db.Collection("categories").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	categories := []Category{}
+	if err := cursor.All(ctx, &categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// getCategoryTree returns the whole tree, or the subtree under ?root=.
+func getCategoryTree(c *gin.Context) {
+	categories, err := loadCategories(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch categories"})
+		return
+	}
+	localizeCategories(categories, storefrontLocales(c))
+
+	nodes := make(map[string]*CategoryNode, len(categories))
+	for _, category := range categories {
+		nodes[category.ID] = &CategoryNode{Category: category, Children: []*CategoryNode{}}
+	}
+	roots := []*CategoryNode{}
+	// categories is sorted, so children are appended in order
+	for _, category := range categories {
+		node := nodes[category.ID]
+		if parent, ok := nodes[category.ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	if ref := c.Query("root"); ref != "" {
+		for _, node := range nodes {
+			if node.ID == ref || node.Slug == ref {
+				c.JSON(http.StatusOK, gin.H{"tree": []*CategoryNode{node}})
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tree": roots})
+}
+
+// getCategory returns a category with its breadcrumb trail. Slugs the
+// category used to have redirect to the current one.
+func getCategory(c *gin.Context) {
+	category, err := findCategory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if redirectCategory(c, c.Param("id")) {
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	breadcrumbs := []Category{}
+	if len(category.Ancestors) > 0 {
+		cursor, err := productService.db.Collection("categories").Find(c.Request.Context(), bson.M{"_id": bson.M{"$in": category.Ancestors}})
+		if err == nil {
+			cursor.All(c.Request.Context(), &breadcrumbs)
+		}
+		depth := map[string]int{}
+		for i, id := range category.Ancestors {
+			depth[id] = i
+		}
+		sort.Slice(breadcrumbs, func(i, j int) bool { return depth[breadcrumbs[i].ID] < depth[breadcrumbs[j].ID] })
+	}
+	chain := storefrontLocales(c)
+	localizeCategory(category, chain)
+	localizeCategories(breadcrumbs, chain)
+	c.Header("Content-Language", category.Locale)
+
+	c.JSON(http.StatusOK, gin.H{"category": category, "breadcrumbs": breadcrumbs})
+}
+
+// updateCategory renames, reorders or moves a category. Moving it carries
+// its whole subtree along.
+func updateCategory(c *gin.Context) {
+	var req struct {
+		Name        *string `json:"name"`
+		Slug        *string `json:"slug"`
+		Description *string `json:"description"`
+		ParentID    *string `json:"parent_id"`
+		Position    *int    `json:"position"`
+
+		MetaTitle       *string `json:"meta_title"`
+		MetaDescription *string `json:"meta_description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	categories := productService.db.Collection("categories")
+	var category Category
+	if err := categories.FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&category); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if req.Name != nil && *req.Name != "" {
+		set["name"] = *req.Name
+	}
+	if req.Slug != nil && normalizeSlug(*req.Slug) != category.Slug {
+		slug := normalizeSlug(*req.Slug)
+		if slug == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Category needs a slug"})
+			return
+		}
+		if taken, err := slugTaken(ctx, "categories", slug, category.ID); err != nil || taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "A category with this slug already exists"})
+			return
+		}
+		set["slug"] = slug
+		set["previous_slugs"] = rememberSlug(category.PreviousSlugs, category.Slug, slug)
+	}
+	if req.Description != nil {
+		set["description"] = *req.Description
+	}
+	if req.Position != nil {
+		set["position"] = *req.Position
+	}
+	if req.MetaTitle != nil {
+		set["meta_title"] = *req.MetaTitle
+	}
+	if req.MetaDescription != nil {
+		set["meta_description"] = *req.MetaDescription
+	}
+
+	moved := req.ParentID != nil && *req.ParentID != category.ParentID
+	var ancestors []string
+	if moved {
+		var err error
+		ancestors, err = ancestorsFor(ctx, *req.ParentID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parent category not found"})
+			return
+		}
+		for _, id := range ancestors {
+			if id == category.ID {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A category can't be moved under itself"})
+				return
+			}
+		}
+		set["parent_id"] = *req.ParentID
+		set["ancestors"] = ancestors
+	}
+
+	if _, err := categories.UpdateOne(ctx, bson.M{"_id": category.ID}, bson.M{"$set": set}); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug already in use"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update category"})
+		return
+	}
+
+	if moved {
+		if err := moveDescendants(ctx, &category, ancestors); err != nil {
+			log.Printf("Failed to move descendants of category %s: %v", category.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move subcategories"})
+			return
+		}
+	}
+	if name, ok := set["name"]; ok {
+		productService.db.Collection("products").UpdateMany(ctx,
+			bson.M{"category_id": category.ID}, bson.M{"$set": bson.M{"category": name}})
+		invalidateCatalog(ctx)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Category updated successfully"})
+}
+
+// moveDescendants rewrites the ancestors of every category below one that
+// moved: the old path down to the category is replaced by the new one.
+func moveDescendants(ctx context.Context, category *Category, ancestors []string) error {
+	categories := productService.db.Collection("categories")
+	cursor, err := categories.Find(ctx, bson.M{"ancestors": category.ID})
+	if err != nil {
+		return err
+	}
+	var descendants []Category
+	if err := cursor.All(ctx, &descendants); err != nil {
+		return err
+	}
+
+	depth := len(category.Ancestors)
+	for _, d := range descendants {
+		path := append(append([]string{}, ancestors...), d.Ancestors[depth:]...)
+		if _, err := categories.UpdateOne(ctx, bson.M{"_id": d.ID}, bson.M{"$set": bson.M{"ancestors": path}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCategory removes an empty category. Subcategories and products
+// have to be moved out first.
+func deleteCategory(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if n, _ := productService.db.Collection("categories").CountDocuments(ctx, bson.M{"parent_id": id}); n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category has subcategories"})
+		return
+	}
+	if n, _ := productService.db.Collection("products").CountDocuments(ctx, bson.M{"category_id": id}); n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category has products", "products": n})
+		return
+	}
+
+	result, err := productService.db.Collection("categories").DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Category deleted successfully"})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Product detail and listings carry an ETag, hashed from the response
+// body, and a Last-Modified, so browsers and CDNs can revalidate with
+// If-None-Match or If-Modified-Since and get a 304 without the body. A
+// product's Last-Modified is its updated_at; a listing's is when its ETag
+// last changed. They're marked no-cache: clients may store them but must
+// revalidate, which costs a cache lookup rather than a download. Responses
+// staff see with drafts are private.
+
+// How long a listing's ETag is remembered. Once forgotten it's stamped
+// afresh, which only costs clients a full response.
+const listingModifiedTTL = 7 * 24 * time.Hour
+
+// writeConditional writes a JSON response body, or 304 Not Modified if the
+// client's copy is current.
+func writeConditional(c *gin.Context, data []byte, lastModified time.Time, public bool) {
+	etag := etagOf(data)
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if public {
+		c.Header("Cache-Control", "public, no-cache")
+	} else {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+
+	if notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+func etagOf(data []byte) string {
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// notModified evaluates the request's preconditions. If-None-Match takes
+// precedence, and matches weakly, since compression proxies weaken ETags.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.IsZero() && !lastModified.Truncate(time.Second).After(since)
+}
+
+// writeListing writes a listing with writeConditional. Its Last-Modified
+// is when the listing's ETag last changed rather than the latest updated_at
+// of its products, which stays put when products leave the listing or
+// their stock or ranking changes.
+func writeListing(c *gin.Context, data []byte, public bool) {
+	writeConditional(c, data, listingLastModified(c, etagOf(data)), public)
+}
+
+// listingLastModified returns when the listing was first served with etag,
+// remembering the listing's current ETag in Redis and stamping a new one
+// with the current time. It's zero, so only the ETag is sent, when Redis is
+// unavailable.
+func listingLastModified(c *gin.Context, etag string) time.Time {
+	ctx, cancel := cacheContext(c.Request.Context())
+	defer cancel()
+
+	key := "cache:products:listing:modified:" + listingID(c)
+	seen, err := redisClient.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return time.Time{}
+	}
+	if stamp, ok := strings.CutPrefix(seen, etag+" "); ok {
+		if t, err := time.Parse(time.RFC3339, stamp); err == nil {
+			return t
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := redisClient.Set(ctx, key, etag+" "+now.Format(time.RFC3339), listingModifiedTTL).Err(); err != nil {
+		log.Printf("Failed to record listing ETag: %v", err)
+		return time.Time{}
+	}
+	return now
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DigitalFile is a file delivered to buyers of a digital product. Files sit
+// in the private bucket and are never listed on the product itself; buyers
+// get time-limited links once their order is paid.
+type DigitalFile struct {
+	ID          string    `bson:"id" json:"id"`
+	FileName    string    `bson:"file_name" json:"file_name"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int64     `bson:"size" json:"size"`
+	Key         string    `bson:"key" json:"-"`
+	UploadedAt  time.Time `bson:"uploaded_at" json:"uploaded_at"`
+}
+
+// Download links last DIGITAL_DOWNLOAD_TTL (default 15m); uploads are
+// capped at DIGITAL_FILE_MAX_BYTES (default 2 GiB).
+var (
+	downloadTTL        = envDuration("DIGITAL_DOWNLOAD_TTL", 15*time.Minute)
+	maxDigitalFileSize = int64(envInt("DIGITAL_FILE_MAX_BYTES", 2<<30))
+)
+
+const maxDigitalFiles = 20
+
+func storageConfigured(c *gin.Context) bool {
+	if storage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "File storage is not configured"})
+		return false
+	}
+	return true
+}
+
+// listDigitalFiles shows staff the files attached to a product.
+func listDigitalFiles(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	files := product.Files
+	if files == nil {
+		files = []DigitalFile{}
+	}
+	c.JSON(http.StatusOK, gin.H{"files": files, "count": len(files)})
+}
+
+// uploadDigitalFile attaches the multipart "file" to a digital product.
+func uploadDigitalFile(c *gin.Context) {
+	if !storageConfigured(c) {
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	if !product.Digital {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Files can only be attached to digital products"})
+		return
+	}
+	if len(product.Files) >= maxDigitalFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many files on this product"})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if header.Size > maxDigitalFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+		return
+	}
+	body, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer body.Close()
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	file := DigitalFile{
+		ID:          primitive.NewObjectID().Hex(),
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+		UploadedAt:  time.Now(),
+	}
+	// Names only matter on download, where they're set by the link
+	file.Key = "digital/" + product.ID + "/" + file.ID
+
+	if err := storage.put(c.Request.Context(), file.Key, file.ContentType, body, file.Size); err != nil {
+		log.Printf("Failed to upload file for product %s: %v", product.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store file"})
+		return
+	}
+	err = updateAudited(c, AuditFilesChanged, product.ID,
+		bson.M{"$push": bson.M{"files": file}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), product.ID)
+
+	c.JSON(http.StatusCreated, file)
+}
+
+func deleteDigitalFile(c *gin.Context) {
+	if !storageConfigured(c) {
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	var file *DigitalFile
+	for i := range product.Files {
+		if product.Files[i].ID == c.Param("fileId") {
+			file = &product.Files[i]
+		}
+	}
+	if file == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	err := updateAudited(c, AuditFilesChanged, product.ID,
+		bson.M{"$pull": bson.M{"files": bson.M{"id": file.ID}}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), product.ID)
+	// Links already issued stop working once the object is gone
+	if err := storage.delete(context.Background(), file.Key); err != nil {
+		log.Printf("Failed to delete stored file %s: %v", file.Key, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted"})
+}
+
+// getDownloads issues links to a digital product's files for a customer
+// with a paid order for it. Links expire after downloadTTL; the customer
+// asks again for fresh ones.
+func getDownloads(c *gin.Context) {
+	if !storageConfigured(c) {
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	if !product.Digital {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Product is not digital"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	purchased, err := purchasedProduct(c.Request.Context(), userID, product.ID)
+	if err != nil {
+		log.Printf("Failed to check purchases for %s: %v", userID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Couldn't verify the purchase, try again shortly"})
+		return
+	}
+	if !purchased {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No paid order includes this product"})
+		return
+	}
+
+	expiresAt := time.Now().Add(downloadTTL)
+	downloads := make([]gin.H, 0, len(product.Files))
+	for _, file := range product.Files {
+		downloads = append(downloads, gin.H{
+			"id":         file.ID,
+			"file_name":  file.FileName,
+			"size":       file.Size,
+			"url":        storage.presign(file.Key, file.FileName, downloadTTL),
+			"expires_at": expiresAt,
+		})
+	}
+	log.Printf("Issued %d download links for product %s to %s", len(downloads), product.ID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"product_id": product.ID, "downloads": downloads, "count": len(downloads)})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// copySKU is a placeholder SKU for a copy, unique through the copy's ID,
+// for the merchandiser to replace.
+func copySKU(sku, suffix string) string {
+	if sku == "" {
+		return ""
+	}
+	return sku + "-COPY-" + strings.ToUpper(suffix)
+}
+
+// duplicateProduct clones a product into a new draft, for merchandisers
+// adding items similar to an existing one. Content, pricing, attributes,
+// translations, media and variants are copied; the copy's SKUs are
+// placeholders, and it starts without stock, ratings, views or digital
+// files.
+func duplicateProduct(c *gin.Context) {
+	ctx := c.Request.Context()
+	var source Product
+	if err := productService.db.Collection("products").FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&source); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	product := source
+	product.ID = primitive.NewObjectID().Hex()
+	suffix := product.ID[len(product.ID)-6:]
+	product.Name = source.Name + " (copy)"
+	product.SKU = copySKU(source.SKU, suffix)
+	product.Slug, product.PreviousSlugs = "", nil
+	product.Status = StatusDraft
+	product.Stock, product.Rating, product.Reviews = 0, 0, 0
+	product.Views, product.Popularity = 0, 0
+	product.Files = nil
+
+	// Gallery items keep their IDs, so variants still point at their media
+	product.Media = append(Gallery(nil), source.Media...)
+	product.Variants = make([]Variant, len(source.Variants))
+	for i, v := range source.Variants {
+		v.ID = primitive.NewObjectID().Hex()
+		v.SKU = copySKU(v.SKU, suffix)
+		v.Stock = 0
+		product.Variants[i] = v
+	}
+	if len(product.Variants) == 0 {
+		product.Variants = nil
+	}
+
+	if !assignProductSlug(c, &product, nil) {
+		return
+	}
+	score := scoreProduct(&product)
+	product.Quality = &score
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = time.Now()
+
+	_, err := productService.db.Collection("products").InsertOne(context.Background(), product)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": duplicateProductError(err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to duplicate product"})
+		return
+	}
+	invalidateProduct(ctx, "")
+	publishProductSaved(ctx, &product, true, 0)
+	recordProductChange(c, AuditCreated, product.ID, nil, bson.M{"duplicated_from": source.ID})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Product duplicated successfully",
+		"product_id": product.ID,
+		"product":    product,
+	})
+}
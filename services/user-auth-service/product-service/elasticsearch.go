@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Product search is served from Elasticsearch (or OpenSearch, which speaks
+// the same API) when ELASTICSEARCH_URL is set. The index follows the
+// products collection's change stream, falling back to polling updated_at
+// where Mongo doesn't support one. A full sync every hour, and after any
+// failed write, corrects drift and drops deleted products. Synonyms come
+// from the search lexicon and are expanded at query time, so lexicon edits
+// apply without reindexing. While the cluster is unreachable, search uses
+// the Mongo text index instead.
+const (
+	elasticTimeout      = 2 * time.Second
+	elasticRetryAfter   = 30 * time.Second
+	elasticSyncInterval = time.Hour
+	elasticSyncCheck    = time.Minute
+	elasticPoll         = 10 * time.Second
+	elasticBulkSize     = 500
+)
+
+type elasticIndex struct {
+	endpoint string
+	name     string
+	username string
+	password string
+	client   *http.Client
+
+	mu sync.Mutex
+	// Searches skip the cluster until then, after a failure
+	downUntil time.Time
+	// The index exists and has been synced at least once
+	ready bool
+	// A write failed, so the next check runs a full sync
+	stale    bool
+	lastSync time.Time
+}
+
+// elastic is nil when ELASTICSEARCH_URL isn't set.
+var elastic *elasticIndex
+
+type elasticError struct {
+	status int
+	body   string
+}
+
+func (e *elasticError) Error() string {
+	return fmt.Sprintf("elasticsearch returned %d: %s", e.status, e.body)
+}
+
+func elasticStatus(err error) int {
+	var e *elasticError
+	if errors.As(err, &e) {
+		return e.status
+	}
+	return 0
+}
+
+// elasticProduct is the indexed form of a published product.
+type elasticProduct struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	CategoryID  string   `json:"category_id,omitempty"`
+	BrandID     string   `json:"brand_id,omitempty"`
+	Price       float64  `json:"price"`
+	InStock     bool     `json:"in_stock"`
+	Rating      float64  `json:"rating"`
+	// Indexed as keywords for attribute filters
+	Attributes map[string]string `json:"attributes,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	// Set on every write; a full sync deletes documents it didn't touch
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+func newElasticProduct(p *Product, syncedAt time.Time) elasticProduct {
+	return elasticProduct{
+		Name:        p.Name,
+		Description: p.Description,
+		Tags:        p.Tags,
+		Category:    p.Category,
+		CategoryID:  p.CategoryID,
+		BrandID:     p.BrandID,
+		Price:       p.Price,
+		InStock:     p.Stock > 0 || p.Digital,
+		Rating:      p.Rating,
+		Attributes:  p.Attributes,
+		CreatedAt:   p.CreatedAt,
+		SyncedAt:    syncedAt,
+	}
+}
+
+var elasticMapping = gin.H{
+	"mappings": gin.H{
+		"dynamic_templates": []gin.H{
+			{"attributes": gin.H{"path_match": "attributes.*", "mapping": gin.H{"type": "keyword"}}},
+		},
+		"properties": gin.H{
+			"name": gin.H{
+				"type":     "text",
+				"analyzer": "english",
+				"fields":   gin.H{"raw": gin.H{"type": "keyword"}},
+			},
+			"description": gin.H{"type": "text", "analyzer": "english"},
+			"tags": gin.H{
+				"type":     "text",
+				"analyzer": "english",
+				"fields":   gin.H{"keyword": gin.H{"type": "keyword"}},
+			},
+			"category":    gin.H{"type": "keyword"},
+			"category_id": gin.H{"type": "keyword"},
+			"brand_id":    gin.H{"type": "keyword"},
+			"price":       gin.H{"type": "double"},
+			"in_stock":    gin.H{"type": "boolean"},
+			"rating":      gin.H{"type": "float"},
+			"created_at":  gin.H{"type": "date"},
+			"synced_at":   gin.H{"type": "date"},
+		},
+	},
+}
+
+func startElasticsearch() {
+	endpoint := strings.TrimRight(os.Getenv("ELASTICSEARCH_URL"), "/")
+	if endpoint == "" {
+		log.Printf("ELASTICSEARCH_URL not set, searching with MongoDB")
+		return
+	}
+	name := os.Getenv("ELASTICSEARCH_INDEX")
+	if name == "" {
+		name = "products"
+	}
+
+	elastic = &elasticIndex{
+		endpoint: endpoint,
+		name:     name,
+		username: os.Getenv("ELASTICSEARCH_USERNAME"),
+		password: os.Getenv("ELASTICSEARCH_PASSWORD"),
+		client:   &http.Client{},
+		stale:    true,
+	}
+	go elastic.syncLoop(context.Background())
+	go elastic.follow(context.Background())
+}
+
+func (e *elasticIndex) do(ctx context.Context, method, path, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, e.endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &elasticError{status: resp.StatusCode, body: string(msg)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (e *elasticIndex) doJSON(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	return e.do(ctx, method, path, "application/json", reader, out)
+}
+
+// available reports whether searches should go to the cluster.
+func (e *elasticIndex) available() bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ready && time.Now().After(e.downUntil)
+}
+
+// failed takes the cluster out of search for a while. Rejected queries
+// only fall back once, since the cluster itself is fine.
+func (e *elasticIndex) failed(err error) {
+	log.Printf("Elasticsearch search failed, using MongoDB: %v", err)
+	if status := elasticStatus(err); status >= 400 && status < 500 {
+		return
+	}
+	e.mu.Lock()
+	e.downUntil = time.Now().Add(elasticRetryAfter)
+	e.mu.Unlock()
+}
+
+func (e *elasticIndex) markStale() {
+	e.mu.Lock()
+	e.stale = true
+	e.mu.Unlock()
+}
+
+// ensureIndex creates the index with its mapping if it doesn't exist yet,
+// and adds fields introduced since to an existing one. Documents pick the
+// new fields up at the next full sync, which runs at startup.
+func (e *elasticIndex) ensureIndex(ctx context.Context) (created bool, err error) {
+	err = e.do(ctx, http.MethodHead, "/"+e.name, "", nil, nil)
+	if err == nil {
+		return false, e.doJSON(ctx, http.MethodPut, "/"+e.name+"/_mapping", elasticMapping["mappings"], nil)
+	}
+	if elasticStatus(err) != http.StatusNotFound {
+		return false, err
+	}
+	err = e.doJSON(ctx, http.MethodPut, "/"+e.name, elasticMapping, nil)
+	// Another instance may have just created it
+	if elasticStatus(err) == http.StatusBadRequest && strings.Contains(err.Error(), "resource_already_exists") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (e *elasticIndex) docPath(id string) string {
+	return "/" + e.name + "/_doc/" + url.PathEscape(id)
+}
+
+// apply indexes a changed product, or removes it once it's deleted or
+// unpublished.
+func (e *elasticIndex) apply(ctx context.Context, id string, p *Product) error {
+	ctx, cancel := context.WithTimeout(ctx, elasticTimeout)
+	defer cancel()
+
+	if p == nil || !p.published() {
+		err := e.do(ctx, http.MethodDelete, e.docPath(id), "", nil, nil)
+		if elasticStatus(err) == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	return e.doJSON(ctx, http.MethodPut, e.docPath(id), newElasticProduct(p, time.Now()), nil)
+}
+
+// bulk writes a batch of index and delete actions.
+func (e *elasticIndex) bulk(ctx context.Context, body *bytes.Buffer) error {
+	var resp struct {
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+	if err := e.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body, &resp); err != nil {
+		return err
+	}
+	if !resp.Errors {
+		return nil
+	}
+	failed := 0
+	var first interface{}
+	for _, item := range resp.Items {
+		for _, result := range item {
+			if reason, ok := result["error"]; ok {
+				if first == nil {
+					first = reason
+				}
+				failed++
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d bulk actions failed, first: %v", failed, first)
+}
+
+// syncProducts writes every product matching filter to the index, and
+// removes the unpublished ones.
+func (e *elasticIndex) syncProducts(ctx context.Context, filter bson.M, syncedAt time.Time) (int, error) {
+	cursor, err := productService.db.Collection("products").Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	n, batched := 0, 0
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		err := e.bulk(ctx, &body)
+		body.Reset()
+		batched = 0
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			continue
+		}
+		target := gin.H{"_index": e.name, "_id": product.ID}
+		if product.published() {
+			encoder.Encode(gin.H{"index": target})
+			encoder.Encode(newElasticProduct(&product, syncedAt))
+		} else {
+			encoder.Encode(gin.H{"delete": target})
+		}
+		n++
+		if batched++; batched == elasticBulkSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// fullSync reindexes the whole catalog and deletes documents for products
+// that no longer exist.
+func (e *elasticIndex) fullSync(ctx context.Context) (int, error) {
+	created, err := e.ensureIndex(ctx)
+	if err != nil {
+		e.markStale()
+		return 0, err
+	}
+
+	e.mu.Lock()
+	// An existing index can serve searches while it's brought up to date
+	if !created {
+		e.ready = true
+	}
+	e.stale = false
+	e.mu.Unlock()
+
+	started := time.Now().Truncate(time.Millisecond)
+	n, err := e.syncProducts(ctx, bson.M{}, started)
+	if err == nil {
+		err = e.doJSON(ctx, http.MethodPost, "/"+e.name+"/_delete_by_query?conflicts=proceed",
+			gin.H{"query": gin.H{"range": gin.H{"synced_at": gin.H{"lt": started}}}}, nil)
+	}
+	if err != nil {
+		e.markStale()
+		return n, err
+	}
+
+	e.mu.Lock()
+	e.ready = true
+	e.lastSync = started
+	e.mu.Unlock()
+	return n, nil
+}
+
+// syncLoop runs a full sync hourly, and within a minute of a failed write.
+func (e *elasticIndex) syncLoop(ctx context.Context) {
+	for {
+		e.mu.Lock()
+		due := e.stale || time.Since(e.lastSync) >= elasticSyncInterval
+		e.mu.Unlock()
+
+		if due {
+			if n, err := e.fullSync(ctx); err != nil {
+				log.Printf("Search index sync failed: %v", err)
+			} else {
+				log.Printf("Synced %d products to the search index", n)
+			}
+		}
+		time.Sleep(elasticSyncCheck)
+	}
+}
+
+// follow indexes product changes as they happen.
+func (e *elasticIndex) follow(ctx context.Context) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	for {
+		stream, err := productService.db.Collection("products").Watch(ctx, mongo.Pipeline{}, opts)
+		if err != nil {
+			log.Printf("Product change stream unavailable, polling instead: %v", err)
+			e.poll(ctx, elasticSyncInterval)
+			continue
+		}
+
+		// Catch up on anything that changed while the stream was closed
+		e.markStale()
+
+		for stream.Next(ctx) {
+			var event struct {
+				OperationType string `bson:"operationType"`
+				DocumentKey   struct {
+					ID string `bson:"_id"`
+				} `bson:"documentKey"`
+				UpdateDescription struct {
+					UpdatedFields bson.M `bson:"updatedFields"`
+				} `bson:"updateDescription"`
+				FullDocument *Product `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&event); err != nil {
+				log.Printf("Failed to decode product change: %v", err)
+				continue
+			}
+			// Quality rescoring touches every product hourly but isn't indexed
+			if _, ok := event.UpdateDescription.UpdatedFields["quality"]; ok && len(event.UpdateDescription.UpdatedFields) == 1 {
+				continue
+			}
+
+			if err := e.apply(ctx, event.DocumentKey.ID, event.FullDocument); err != nil {
+				log.Printf("Failed to index product %s: %v", event.DocumentKey.ID, err)
+				e.markStale()
+			}
+		}
+		log.Printf("Product change stream closed: %v", stream.Err())
+		stream.Close(ctx)
+		time.Sleep(elasticPoll)
+	}
+}
+
+// poll indexes products updated since the previous pass, for the given
+// duration. Deleted products are removed by the next full sync.
+func (e *elasticIndex) poll(ctx context.Context, d time.Duration) {
+	since := time.Now()
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		time.Sleep(elasticPoll)
+		next := time.Now()
+		if _, err := e.syncProducts(ctx, bson.M{"updated_at": bson.M{"$gte": since}}, next); err != nil {
+			log.Printf("Failed to index updated products: %v", err)
+			e.markStale()
+			continue
+		}
+		since = next
+	}
+}
+
+// search runs a query with typo tolerance and returns the best hits, with
+// highlights, and facet counts over everything that matched.
+func (e *elasticIndex) search(ctx context.Context, terms [][]string, f searchFilters) ([]searchHit, searchFacets, error) {
+	ctx, cancel := context.WithTimeout(ctx, elasticTimeout)
+	defer cancel()
+
+	query := gin.H{"match_all": gin.H{}}
+	if len(terms) > 0 {
+		// Each term matches if any of its synonyms does; short queries need
+		// every term, longer ones most of them
+		groups := make([]gin.H, 0, len(terms))
+		for _, alternatives := range terms {
+			matches := make([]gin.H, 0, len(alternatives))
+			for _, alt := range alternatives {
+				matches = append(matches, gin.H{"multi_match": gin.H{
+					"query":         alt,
+					"fields":        []string{"name^10", "tags^5", "description"},
+					"operator":      "and",
+					"fuzziness":     "AUTO",
+					"prefix_length": 1,
+				}})
+			}
+			groups = append(groups, gin.H{"bool": gin.H{"should": matches}})
+		}
+		query = gin.H{"bool": gin.H{"should": groups, "minimum_should_match": "2<75%"}}
+	}
+
+	filter, postFilter := f.elastic()
+	body := gin.H{
+		"size":    maxSearchHits,
+		"_source": []string{"category", "category_id"},
+		"query":   gin.H{"bool": gin.H{"must": query, "filter": filter}},
+		// Price and stock filters apply after the facets are counted, so the
+		// facets still show the other options
+		"post_filter": gin.H{"bool": gin.H{"filter": postFilter}},
+		"aggs": gin.H{
+			"categories": gin.H{"terms": gin.H{"field": "category_id", "size": maxCategoryFacets}},
+			"prices":     gin.H{"range": gin.H{"field": "price", "ranges": elasticPriceRanges()}},
+			"in_stock":   gin.H{"terms": gin.H{"field": "in_stock"}},
+		},
+		"highlight": gin.H{
+			"pre_tags":  []string{"<mark>"},
+			"post_tags": []string{"</mark>"},
+			"encoder":   "html",
+			"fields": gin.H{
+				"name":        gin.H{"number_of_fragments": 0},
+				"tags":        gin.H{"number_of_fragments": 0},
+				"description": gin.H{"fragment_size": snippetLength, "number_of_fragments": 1},
+			},
+		},
+	}
+	if len(terms) == 0 {
+		body["sort"] = []gin.H{{"name.raw": "asc"}}
+	}
+
+	type bucket struct {
+		Key         interface{} `json:"key"`
+		KeyAsString string      `json:"key_as_string"`
+		DocCount    int         `json:"doc_count"`
+	}
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				ID        string              `json:"_id"`
+				Score     float64             `json:"_score"`
+				Source    elasticProduct      `json:"_source"`
+				Highlight map[string][]string `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Aggregations struct {
+			Categories struct {
+				Buckets []bucket `json:"buckets"`
+			} `json:"categories"`
+			Prices struct {
+				Buckets []bucket `json:"buckets"`
+			} `json:"prices"`
+			InStock struct {
+				Buckets []bucket `json:"buckets"`
+			} `json:"in_stock"`
+		} `json:"aggregations"`
+	}
+	if err := e.doJSON(ctx, http.MethodPost, "/"+e.name+"/_search", body, &resp); err != nil {
+		return nil, searchFacets{}, err
+	}
+
+	hits := make([]searchHit, 0, len(resp.Hits.Hits))
+	for _, h := range resp.Hits.Hits {
+		hit := searchHit{ID: h.ID, Category: h.Source.Category, Score: h.Score}
+		if len(h.Highlight) > 0 {
+			hit.Highlights = map[string]string{}
+			for field, fragments := range h.Highlight {
+				hit.Highlights[field] = strings.Join(fragments, ", ")
+			}
+		}
+		hits = append(hits, hit)
+	}
+
+	facets := newSearchFacets()
+	for _, b := range resp.Aggregations.Categories.Buckets {
+		if id, ok := b.Key.(string); ok {
+			facets.Categories = append(facets.Categories, categoryFacet{ID: id, Count: b.DocCount})
+		}
+	}
+	for i, b := range resp.Aggregations.Prices.Buckets {
+		if i < len(facets.Prices) {
+			facets.Prices[i].Count = b.DocCount
+		}
+	}
+	for _, b := range resp.Aggregations.InStock.Buckets {
+		if b.KeyAsString == "true" {
+			facets.Availability.InStock = b.DocCount
+		} else {
+			facets.Availability.OutOfStock = b.DocCount
+		}
+	}
+	return hits, facets, nil
+}
+
+func elasticPriceRanges() []gin.H {
+	ranges := make([]gin.H, 0, len(priceBreaks)+1)
+	for _, bucket := range newSearchFacets().Prices {
+		r := gin.H{"from": bucket.From}
+		if bucket.To != nil {
+			r["to"] = *bucket.To
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// reindexSearch runs a full sync on request, e.g. after restoring a backup.
+func reindexSearch(c *gin.Context) {
+	if elastic == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elasticsearch isn't configured"})
+		return
+	}
+	n, err := elastic.fullSync(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Reindex failed: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Search index rebuilt", "products": n})
+}
+
+func getSearchStatus(c *gin.Context) {
+	if elastic == nil {
+		c.JSON(http.StatusOK, gin.H{"engine": "mongo", "elasticsearch": false})
+		return
+	}
+	elastic.mu.Lock()
+	defer elastic.mu.Unlock()
+	engine := "mongo"
+	if elastic.ready && time.Now().After(elastic.downUntil) {
+		engine = "elasticsearch"
+	}
+	status := gin.H{
+		"engine":        engine,
+		"elasticsearch": true,
+		"index":         elastic.name,
+		"ready":         elastic.ready,
+		"stale":         elastic.stale,
+	}
+	if !elastic.lastSync.IsZero() {
+		status["last_sync"] = elastic.lastSync
+	}
+	c.JSON(http.StatusOK, status)
+}
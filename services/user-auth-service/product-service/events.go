@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Catalog changes are appended to a Redis stream (PRODUCT_EVENTS_STREAM,
+// default "events:products") for the search indexer, cache invalidators,
+// feeds and so on to consume with consumer groups instead of polling the
+// API. Each entry has the fields id, type, product_id, occurred_at and data
+// (a JSON object). Figures kept up to date in bulk, such as stock, ratings
+// and views, don't raise events.
+const (
+	EventProductCreated = "product.created"
+	EventProductUpdated = "product.updated"
+	EventProductDeleted = "product.deleted"
+	// Also raised with product.updated, with data.old_price and
+	// data.new_price
+	EventProductPriceChanged = "product.price_changed"
+)
+
+// productEventsMaxLen caps the stream; consumers that fall further behind
+// than this lose events.
+const productEventsMaxLen = 1000000
+
+func productEventsStream() string {
+	return envString("PRODUCT_EVENTS_STREAM", "events:products")
+}
+
+// setupEvents registers the consumer groups named in
+// PRODUCT_EVENT_CONSUMERS (comma separated), so they receive events from
+// the first start on even before their consumers run.
+func setupEvents() {
+	for _, name := range strings.Split(os.Getenv("PRODUCT_EVENT_CONSUMERS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		err := redisClient.XGroupCreateMkStream(context.Background(), productEventsStream(), name, "$").Err()
+		if err != nil && !isBusyGroup(err) {
+			log.Printf("Failed to register event consumer %s: %v", name, err)
+		}
+	}
+}
+
+func isBusyGroup(err error) bool {
+	return strings.HasPrefix(err.Error(), "BUSYGROUP")
+}
+
+// publishProductEvent emits an event. Publishing is best effort: a broker
+// outage is logged and never fails the request.
+func publishProductEvent(ctx context.Context, eventType, productID string, data bson.M) {
+	if data == nil {
+		data = bson.M{}
+	}
+	payload, _ := json.Marshal(data)
+
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: productEventsStream(),
+		MaxLen: productEventsMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"id":          primitive.NewObjectID().Hex(),
+			"type":        eventType,
+			"product_id":  productID,
+			"occurred_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"data":        string(payload),
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("Failed to publish %s for %s: %v", eventType, productID, err)
+	}
+}
+
+// publishProductSaved emits product.created, or product.updated and
+// product.price_changed if the price moved from oldPrice.
+func publishProductSaved(ctx context.Context, p *Product, created bool, oldPrice float64) {
+	data := bson.M{"sku": p.SKU, "slug": p.Slug, "status": p.Status}
+	if created {
+		publishProductEvent(ctx, EventProductCreated, p.ID, data)
+		return
+	}
+	publishProductEvent(ctx, EventProductUpdated, p.ID, data)
+	if p.Price != oldPrice {
+		publishProductEvent(ctx, EventProductPriceChanged, p.ID, bson.M{"old_price": oldPrice, "new_price": p.Price})
+	}
+}
+
+// publishProductUpdated emits product.updated for a change made outside
+// the product itself, such as to its variants, media or translations.
+func publishProductUpdated(ctx context.Context, productID string) {
+	publishProductEvent(ctx, EventProductUpdated, productID, nil)
+}
+
+// EventConsumer is a consumer group reading the product events stream.
+type EventConsumer struct {
+	Name      string `json:"name"`
+	Consumers int64  `json:"consumers"`
+	// Delivered but not yet acknowledged
+	Pending int64 `json:"pending"`
+	// Not yet delivered
+	Lag             int64  `json:"lag"`
+	LastDeliveredID string `json:"last_delivered_id"`
+}
+
+func listEventConsumers(c *gin.Context) {
+	groups, err := redisClient.XInfoGroups(c.Request.Context(), productEventsStream()).Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch event consumers"})
+		return
+	}
+	consumers := []EventConsumer{}
+	for _, group := range groups {
+		consumers = append(consumers, EventConsumer{
+			Name:            group.Name,
+			Consumers:       group.Consumers,
+			Pending:         group.Pending,
+			Lag:             group.Lag,
+			LastDeliveredID: group.LastDeliveredID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"stream": productEventsStream(), "consumers": consumers})
+}
+
+// registerEventConsumer creates a consumer group that receives events from
+// now on, or from the oldest event still in the stream.
+func registerEventConsumer(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required,max=100"`
+		From string `json:"from" binding:"omitempty,oneof=latest earliest"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	start := "$"
+	if req.From == "earliest" {
+		start = "0"
+	}
+
+	err := redisClient.XGroupCreateMkStream(c.Request.Context(), productEventsStream(), req.Name, start).Err()
+	if err != nil && isBusyGroup(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event consumer already registered"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register event consumer"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Event consumer registered", "stream": productEventsStream(), "name": req.Name})
+}
+
+func deleteEventConsumer(c *gin.Context) {
+	n, err := redisClient.XGroupDestroy(c.Request.Context(), productEventsStream(), c.Param("name")).Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete event consumer"})
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Event consumer not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Event consumer deleted"})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Facet counts for storefront filter sidebars, aggregated in Mongo over
+// every product matching a search, unlike the search endpoint's Mongo
+// facets, which only cover the hits it ranks. As in Elasticsearch, price
+// and availability filters apply to the total but not to the counts, so
+// the sidebar keeps offering the other price ranges.
+const (
+	maxValueFacets = 20
+	// Brands were kept in this attribute before they were linked; it's
+	// left out of the attribute facets in favour of the brand facet
+	brandAttribute = "brand"
+)
+
+type valueFacet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type brandFacet struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Slug  string `json:"slug"`
+	Count int    `json:"count"`
+}
+
+type ratingFacet struct {
+	// Products rated this or more
+	Min   int `json:"min"`
+	Count int `json:"count"`
+}
+
+type attributeFacet struct {
+	Name   string       `json:"name"`
+	Label  string       `json:"label,omitempty"`
+	Type   string       `json:"type"`
+	Unit   string       `json:"unit,omitempty"`
+	Values []valueFacet `json:"values"`
+}
+
+// facetAttributes returns the attributes offered as filters: those marked
+// facet in the category's schema, or in any category's without one.
+func facetAttributes(ctx context.Context, categoryRef string) ([]AttributeDef, error) {
+	var schema []AttributeDef
+	if categoryRef != "" {
+		category, err := findCategory(ctx, categoryRef)
+		if err != nil {
+			return nil, err
+		}
+		if schema, err = categorySchema(ctx, category); err != nil {
+			return nil, err
+		}
+	} else {
+		categories, err := loadCategories(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, category := range categories {
+			schema = append(schema, category.Attributes...)
+		}
+	}
+
+	facets := []AttributeDef{}
+	seen := map[string]bool{}
+	for _, def := range schema {
+		if def.Facet && def.Name != brandAttribute && !seen[def.Name] {
+			seen[def.Name] = true
+			facets = append(facets, def)
+		}
+	}
+	return facets, nil
+}
+
+// nameBrandFacets fills in brand names and slugs, dropping brands that no
+// longer exist.
+func nameBrandFacets(ctx context.Context, facets []brandFacet) []brandFacet {
+	if len(facets) == 0 {
+		return facets
+	}
+	ids := make([]string, 0, len(facets))
+	for _, f := range facets {
+		ids = append(ids, f.ID)
+	}
+	cursor, err := productService.db.Collection("brands").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return facets
+	}
+	var brands []Brand
+	if err := cursor.All(ctx, &brands); err != nil {
+		return facets
+	}
+	byID := make(map[string]*Brand, len(brands))
+	for i := range brands {
+		byID[brands[i].ID] = &brands[i]
+	}
+
+	named := make([]brandFacet, 0, len(facets))
+	for _, f := range facets {
+		if brand, ok := byID[f.ID]; ok {
+			f.Name, f.Slug = brand.Name, brand.Slug
+			named = append(named, f)
+		}
+	}
+	return named
+}
+
+// valueFacetStages counts the values of a field, most common first.
+func valueFacetStages(field string) bson.A {
+	return bson.A{
+		bson.M{"$match": bson.M{field: bson.M{"$nin": bson.A{"", nil}}}},
+		bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+		bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		bson.M{"$limit": maxValueFacets},
+	}
+}
+
+// getFacets returns facet counts for the products a search with the same
+// parameters would match: ?q= and the filters of searchProducts.
+func getFacets(c *gin.Context) {
+	filters, ok := parseSearchFilters(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	attributes, err := facetAttributes(ctx, c.Query("category"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attribute schema"})
+		return
+	}
+	names := make(bson.A, 0, len(attributes))
+	for _, def := range attributes {
+		names = append(names, def.Name)
+	}
+
+	// Price and availability narrow the total only
+	counted := filters
+	counted.minPrice, counted.maxPrice, counted.inStock = nil, nil, false
+	match := counted.mongo()
+	if terms := tuning.terms(normalizeQuery(c.Query("q"))); len(terms) > 0 {
+		match["$text"] = bson.M{"$search": textSearch(terms)}
+	}
+	narrowed := filters.mongo()
+	total := bson.M{}
+	for _, field := range []string{"price", "$or"} {
+		if condition, ok := narrowed[field]; ok {
+			total[field] = condition
+		}
+	}
+
+	boundaries := bson.A{}
+	for _, from := range priceBreaks {
+		boundaries = append(boundaries, from)
+	}
+	boundaries = append(boundaries, math.MaxFloat64)
+
+	cursor, err := productService.db.Collection("products").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$facet", Value: bson.M{
+			"total":      bson.A{bson.M{"$match": total}, bson.M{"$count": "count"}},
+			"categories": valueFacetStages("category_id"),
+			"brands":     valueFacetStages("brand_id"),
+			"prices": bson.A{
+				bson.M{"$bucket": bson.M{"groupBy": "$price", "boundaries": boundaries, "default": "other"}},
+			},
+			"ratings": bson.A{
+				bson.M{"$match": bson.M{"rating": bson.M{"$gte": 1}}},
+				bson.M{"$group": bson.M{"_id": bson.M{"$floor": "$rating"}, "count": bson.M{"$sum": 1}}},
+			},
+			"availability": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"$or": bson.A{bson.M{"$gt": bson.A{"$stock", 0}}, bson.M{"$eq": bson.A{"$digital", true}}}},
+					"count": bson.M{"$sum": 1},
+				}},
+			},
+			"attributes": bson.A{
+				bson.M{"$project": bson.M{"attributes": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$attributes", bson.M{}}}}}},
+				bson.M{"$unwind": "$attributes"},
+				bson.M{"$match": bson.M{"attributes.k": bson.M{"$in": names}, "attributes.v": bson.M{"$ne": ""}}},
+				bson.M{"$group": bson.M{"_id": bson.M{"name": "$attributes.k", "value": "$attributes.v"}, "count": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id.value", Value: 1}}},
+			},
+		}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count facets"})
+		return
+	}
+	var results []struct {
+		Total []struct {
+			Count int `bson:"count"`
+		} `bson:"total"`
+		Categories []struct {
+			ID    string `bson:"_id"`
+			Count int    `bson:"count"`
+		} `bson:"categories"`
+		Brands []struct {
+			ID    string `bson:"_id"`
+			Count int    `bson:"count"`
+		} `bson:"brands"`
+		Prices []struct {
+			From  interface{} `bson:"_id"`
+			Count int         `bson:"count"`
+		} `bson:"prices"`
+		Ratings []struct {
+			Floor float64 `bson:"_id"`
+			Count int     `bson:"count"`
+		} `bson:"ratings"`
+		Availability []struct {
+			InStock bool `bson:"_id"`
+			Count   int  `bson:"count"`
+		} `bson:"availability"`
+		Attributes []struct {
+			ID struct {
+				Name  string `bson:"name"`
+				Value string `bson:"value"`
+			} `bson:"_id"`
+			Count int `bson:"count"`
+		} `bson:"attributes"`
+	}
+	if err := cursor.All(ctx, &results); err != nil || len(results) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count facets"})
+		return
+	}
+	result := results[0]
+
+	facets := newSearchFacets()
+	for _, row := range result.Categories {
+		facets.Categories = append(facets.Categories, categoryFacet{ID: row.ID, Count: row.Count})
+	}
+	facets.Categories = nameCategoryFacets(ctx, facets.Categories)
+	for _, row := range result.Prices {
+		from, ok := row.From.(float64)
+		if !ok {
+			continue
+		}
+		for i := range facets.Prices {
+			if facets.Prices[i].From == from {
+				facets.Prices[i].Count = row.Count
+			}
+		}
+	}
+	for _, row := range result.Availability {
+		if row.InStock {
+			facets.Availability.InStock = row.Count
+		} else {
+			facets.Availability.OutOfStock = row.Count
+		}
+	}
+
+	brands := []brandFacet{}
+	for _, row := range result.Brands {
+		brands = append(brands, brandFacet{ID: row.ID, Count: row.Count})
+	}
+	brands = nameBrandFacets(ctx, brands)
+
+	// Ratings are cumulative: 4 and up includes the 5s
+	ratings := []ratingFacet{}
+	perFloor := map[int]int{}
+	for _, row := range result.Ratings {
+		perFloor[int(row.Floor)] += row.Count
+	}
+	cumulative := 0
+	for min := 5; min >= 1; min-- {
+		cumulative += perFloor[min]
+		if min < 5 {
+			ratings = append(ratings, ratingFacet{Min: min, Count: cumulative})
+		}
+	}
+
+	values := map[string][]valueFacet{}
+	for _, row := range result.Attributes {
+		if len(values[row.ID.Name]) < maxValueFacets {
+			values[row.ID.Name] = append(values[row.ID.Name], valueFacet{Value: row.ID.Value, Count: row.Count})
+		}
+	}
+	// In schema order, which merchandisers control
+	attributeFacets := []attributeFacet{}
+	for _, def := range attributes {
+		if len(values[def.Name]) == 0 {
+			continue
+		}
+		attributeFacets = append(attributeFacets, attributeFacet{
+			Name: def.Name, Label: def.Label, Type: def.Type, Unit: def.Unit, Values: values[def.Name],
+		})
+	}
+
+	count := 0
+	if len(result.Total) > 0 {
+		count = result.Total[0].Count
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":        count,
+		"categories":   facets.Categories,
+		"brands":       brands,
+		"prices":       facets.Prices,
+		"ratings":      ratings,
+		"availability": facets.Availability,
+		"attributes":   attributeFacets,
+	})
+}
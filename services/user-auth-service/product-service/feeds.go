@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Catalog feeds for Google Merchant Center (RSS XML) and Meta commerce
+// catalogs (CSV) are generated from published products every
+// FEED_REFRESH_INTERVAL (default 6h) and stored in the private bucket.
+// Merchant tools fetch them on their own schedule from a signed URL under
+// /api/v1/feeds, which needs FEED_SIGNING_SECRET and redirects to a
+// short-lived download link. Prices are in FEED_CURRENCY (default
+// DEFAULT_CURRENCY, or USD) and links point at APP_BASE_URL.
+const (
+	FeedGoogle   = "google"
+	FeedFacebook = "facebook"
+)
+
+var feedFormats = map[string]struct {
+	key, fileName, contentType string
+}{
+	FeedGoogle:   {"feeds/google.xml", "google.xml", "application/xml"},
+	FeedFacebook: {"feeds/facebook.csv", "facebook.csv", "text/csv"},
+}
+
+var (
+	feedRefreshInterval = envDuration("FEED_REFRESH_INTERVAL", 6*time.Hour)
+	feedURLTTL          = envDuration("FEED_URL_TTL", 365*24*time.Hour)
+)
+
+// Feed downloads redirect to presigned links this short-lived
+const feedDownloadTTL = 5 * time.Minute
+
+// Google reads at most this many additional images
+const maxAdditionalImages = 10
+
+// Feed is the state of a generated feed.
+type Feed struct {
+	Name        string    `bson:"_id" json:"name"`
+	Items       int       `bson:"items" json:"items"`
+	Skipped     int       `bson:"skipped" json:"skipped"`
+	Size        int       `bson:"size" json:"size"`
+	GeneratedAt time.Time `bson:"generated_at" json:"generated_at"`
+}
+
+func feedCurrency() string {
+	return envString("FEED_CURRENCY", envString("DEFAULT_CURRENCY", "USD"))
+}
+
+func productURL(p *Product) string {
+	ref := p.Slug
+	if ref == "" {
+		ref = p.ID
+	}
+	return strings.TrimSuffix(envString("APP_BASE_URL", "http://localhost:3000"), "/") + "/products/" + ref
+}
+
+// startFeeds regenerates the feeds on schedule. The Redis key makes one
+// instance do it per interval.
+func startFeeds() {
+	if storage == nil {
+		log.Printf("File storage is not configured, catalog feeds are off")
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		for {
+			claimed, err := redisClient.SetNX(ctx, "feeds:refresh", 1, feedRefreshInterval*9/10).Result()
+			if err != nil {
+				log.Printf("Failed to schedule feed generation: %v", err)
+			}
+			if claimed {
+				if err := generateFeeds(ctx); err != nil {
+					log.Printf("Feed generation failed: %v", err)
+				}
+			}
+			time.Sleep(feedRefreshInterval / 10)
+		}
+	}()
+}
+
+type googleItem struct {
+	XMLName          xml.Name `xml:"item"`
+	ID               string   `xml:"g:id"`
+	Title            string   `xml:"title"`
+	Description      string   `xml:"description"`
+	Link             string   `xml:"link"`
+	ImageLink        string   `xml:"g:image_link"`
+	AdditionalImages []string `xml:"g:additional_image_link"`
+	Availability     string   `xml:"g:availability"`
+	Price            string   `xml:"g:price"`
+	Brand            string   `xml:"g:brand,omitempty"`
+	GTIN             string   `xml:"g:gtin,omitempty"`
+	MPN              string   `xml:"g:mpn,omitempty"`
+	IdentifierExists string   `xml:"g:identifier_exists,omitempty"`
+	Condition        string   `xml:"g:condition"`
+	ProductType      string   `xml:"g:product_type,omitempty"`
+}
+
+var facebookColumns = []string{
+	"id", "title", "description", "availability", "condition", "price", "link", "image_link",
+	"additional_image_link", "brand", "gtin", "product_type",
+}
+
+// feedImages returns the product's primary image and up to
+// maxAdditionalImages others.
+func feedImages(p *Product) (string, []string) {
+	primary, ok := p.gallery().primaryImage()
+	if !ok {
+		return "", nil
+	}
+	additional := []string{}
+	for _, item := range p.gallery() {
+		if item.Type == MediaImage && item.ID != primary.ID && len(additional) < maxAdditionalImages {
+			additional = append(additional, item.URL)
+		}
+	}
+	return primary.URL, additional
+}
+
+// generateFeeds writes every feed from one pass over the published
+// catalog. Products without an image or a price are left out, as both
+// platforms reject them.
+func generateFeeds(ctx context.Context) error {
+	cursor, err := productService.db.Collection("products").Find(ctx, publishedFilter(bson.M{}),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var google bytes.Buffer
+	google.WriteString(xml.Header)
+	google.WriteString(`<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0"><channel>`)
+	google.WriteString("<title>Product catalog</title><link>" + envString("APP_BASE_URL", "http://localhost:3000") + "</link>")
+	googleEncoder := xml.NewEncoder(&google)
+
+	var facebook bytes.Buffer
+	facebookWriter := csv.NewWriter(&facebook)
+	facebookWriter.Write(facebookColumns)
+
+	items, skipped := 0, 0
+	currency := feedCurrency()
+	for cursor.Next(ctx) {
+		var p Product
+		if err := cursor.Decode(&p); err != nil {
+			log.Printf("Failed to decode product for feeds: %v", err)
+			skipped++
+			continue
+		}
+		image, additional := feedImages(&p)
+		if image == "" || p.Price <= 0 {
+			skipped++
+			continue
+		}
+
+		id := p.SKU
+		if id == "" {
+			id = p.ID
+		}
+		description := p.Description
+		if description == "" {
+			description = p.Name
+		}
+		price := strconv.FormatFloat(p.Price, 'f', 2, 64) + " " + currency
+		availability := p.availability()
+
+		item := googleItem{
+			ID: id, Title: p.Name, Description: description, Link: productURL(&p),
+			ImageLink: image, AdditionalImages: additional, Availability: googleAvailability(availability),
+			Price: price, Brand: p.Brand, GTIN: p.GTIN, MPN: p.SKU, Condition: "new", ProductType: p.Category,
+		}
+		if p.GTIN == "" && p.Brand == "" {
+			item.IdentifierExists = "no"
+		}
+		if err := googleEncoder.Encode(item); err != nil {
+			return err
+		}
+
+		facebookWriter.Write([]string{
+			id, p.Name, description, facebookAvailability(availability), "new", price, productURL(&p), image,
+			strings.Join(additional, ","), p.Brand, p.GTIN, p.Category,
+		})
+		items++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := googleEncoder.Flush(); err != nil {
+		return err
+	}
+	google.WriteString("</channel></rss>\n")
+	facebookWriter.Flush()
+	if err := facebookWriter.Error(); err != nil {
+		return err
+	}
+
+	for name, data := range map[string][]byte{FeedGoogle: google.Bytes(), FeedFacebook: facebook.Bytes()} {
+		format := feedFormats[name]
+		if err := storage.put(ctx, format.key, format.contentType, bytes.NewReader(data), int64(len(data))); err != nil {
+			return err
+		}
+		feed := Feed{Name: name, Items: items, Skipped: skipped, Size: len(data), GeneratedAt: time.Now()}
+		_, err := productService.db.Collection("feeds").ReplaceOne(ctx, bson.M{"_id": name}, feed, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Generated catalog feeds with %d products, %d skipped", items, skipped)
+	return nil
+}
+
+func googleAvailability(availability string) string {
+	switch availability {
+	case AvailabilityBackorder:
+		return "backorder"
+	case AvailabilityOutOfStock:
+		return "out_of_stock"
+	default:
+		return "in_stock"
+	}
+}
+
+func facebookAvailability(availability string) string {
+	switch availability {
+	case AvailabilityBackorder:
+		return "available for order"
+	case AvailabilityOutOfStock:
+		return "out of stock"
+	default:
+		return "in stock"
+	}
+}
+
+// feedSignature signs a feed name and expiry.
+func feedSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("FEED_SIGNING_SECRET")))
+	mac.Write([]byte(name + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func feedSigningConfigured(c *gin.Context) bool {
+	if os.Getenv("FEED_SIGNING_SECRET") == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Feed signing is not configured"})
+		return false
+	}
+	return true
+}
+
+// listFeeds shows staff when each feed was last generated.
+func listFeeds(c *gin.Context) {
+	cursor, err := productService.db.Collection("feeds").Find(c.Request.Context(), bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch feeds"})
+		return
+	}
+	feeds := []Feed{}
+	if err := cursor.All(c.Request.Context(), &feeds); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode feeds"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feeds": feeds, "refresh_interval": feedRefreshInterval.String()})
+}
+
+// refreshFeeds regenerates the feeds now, e.g. after a large import.
+func refreshFeeds(c *gin.Context) {
+	if !storageConfigured(c) {
+		return
+	}
+	if err := generateFeeds(c.Request.Context()); err != nil {
+		log.Printf("Feed generation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate feeds"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Feeds generated"})
+}
+
+// getFeedURL issues the signed URL merchant tools fetch a feed from, valid
+// for FEED_URL_TTL (default a year).
+func getFeedURL(c *gin.Context) {
+	name := c.Param("feed")
+	if _, ok := feedFormats[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+	if !feedSigningConfigured(c) {
+		return
+	}
+	expiresAt := time.Now().Add(feedURLTTL)
+	expires := expiresAt.Unix()
+	path := "/api/v1/feeds/" + name + "?expires=" + strconv.FormatInt(expires, 10) + "&signature=" + feedSignature(name, expires)
+	c.JSON(http.StatusOK, gin.H{"feed": name, "path": path, "expires_at": expiresAt})
+}
+
+// downloadFeed checks a signed feed URL and redirects to the feed.
+func downloadFeed(c *gin.Context) {
+	name := c.Param("feed")
+	format, ok := feedFormats[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed not found"})
+		return
+	}
+	if !feedSigningConfigured(c) || !storageConfigured(c) {
+		return
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(c.Query("signature")), []byte(feedSignature(name, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired feed link"})
+		return
+	}
+	var feed Feed
+	if err := productService.db.Collection("feeds").FindOne(c.Request.Context(), bson.M{"_id": name}).Decode(&feed); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feed has not been generated yet"})
+		return
+	}
+	c.Header("Last-Modified", feed.GeneratedAt.UTC().Format(http.TimeFormat))
+	c.Redirect(http.StatusFound, storage.presign(format.key, format.fileName, feedDownloadTTL))
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Products and categories are written in CATALOG_DEFAULT_LOCALE (default
+// "en") and may carry translations into other locales. CATALOG_LOCALES,
+// when set, limits which locales can be translated into and served.
+//
+// Storefront reads resolve a chain of locales from ?locale=, or else from
+// Accept-Language in order of preference, each followed by its bare
+// language: "fr-CA, de;q=0.5" gives fr-CA, fr, de. Every field comes from
+// the first locale in the chain that translates it, and from the default
+// content otherwise.
+var (
+	defaultLocale  = normalizeLocale(envString("CATALOG_DEFAULT_LOCALE", "en"))
+	catalogLocales = parseLocales(os.Getenv("CATALOG_LOCALES"))
+)
+
+const (
+	maxRequestedLocales         = 5
+	maxLocalizedName            = 200
+	maxLocalizedDescription     = 10000
+	maxLocalizedMetaTitle       = 200
+	maxLocalizedMetaDescription = 500
+)
+
+// LocalizedContent is a product's or category's customer-facing text in
+// one locale. Empty fields fall back along the chain.
+type LocalizedContent struct {
+	Name            string `bson:"name,omitempty" json:"name,omitempty"`
+	Description     string `bson:"description,omitempty" json:"description,omitempty"`
+	MetaTitle       string `bson:"meta_title,omitempty" json:"meta_title,omitempty"`
+	MetaDescription string `bson:"meta_description,omitempty" json:"meta_description,omitempty"`
+}
+
+// Translations maps locales to their content.
+type Translations map[string]LocalizedContent
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-([A-Z]{2}|[0-9]{3}))?$`)
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// normalizeLocale canonicalizes a language tag such as "pt_br" to "pt-BR",
+// returning "" if it isn't a language with an optional region.
+func normalizeLocale(tag string) string {
+	parts := strings.SplitN(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"), "-", 2)
+	locale := strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		locale += "-" + strings.ToUpper(parts[1])
+	}
+	if !localePattern.MatchString(locale) {
+		return ""
+	}
+	return locale
+}
+
+func parseLocales(list string) map[string]bool {
+	if list == "" {
+		return nil
+	}
+	locales := map[string]bool{}
+	for _, tag := range strings.Split(list, ",") {
+		if locale := normalizeLocale(tag); locale != "" {
+			locales[locale] = true
+		}
+	}
+	return locales
+}
+
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(locale, "-")
+	return language
+}
+
+// translatable reports whether content can be kept in the locale.
+func translatable(locale string) bool {
+	if locale == "" || locale == defaultLocale {
+		return false
+	}
+	return catalogLocales == nil || catalogLocales[locale]
+}
+
+// requestedLocales returns the caller's locales, most preferred first.
+func requestedLocales(c *gin.Context) []string {
+	if locale := normalizeLocale(c.Query("locale")); locale != "" {
+		return []string{locale}
+	}
+
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var preferences []weighted
+	for _, entry := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(entry, ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if locale := normalizeLocale(tag); locale != "" && q > 0 {
+			preferences = append(preferences, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+
+	locales := make([]string, 0, len(preferences))
+	for _, p := range preferences {
+		if len(locales) == maxRequestedLocales {
+			break
+		}
+		locales = append(locales, p.locale)
+	}
+	return locales
+}
+
+// localeChain returns the translated locales to look content up in, in
+// order. It ends where the caller accepts the default locale, whose
+// content needs no translation; an empty chain serves the default content.
+func localeChain(c *gin.Context) []string {
+	chain := []string{}
+	seen := map[string]bool{}
+	for _, locale := range requestedLocales(c) {
+		for _, candidate := range []string{locale, localeLanguage(locale)} {
+			if candidate == defaultLocale || candidate == localeLanguage(defaultLocale) {
+				return chain
+			}
+			if !seen[candidate] && translatable(candidate) {
+				seen[candidate] = true
+				chain = append(chain, candidate)
+			}
+		}
+	}
+	return chain
+}
+
+// localize resolves content along the chain, returning the locale the
+// name came from.
+func (t Translations) localize(chain []string, content *LocalizedContent) string {
+	locale := defaultLocale
+	var name, description, metaTitle, metaDescription bool
+	for _, candidate := range chain {
+		translated, ok := t[candidate]
+		if !ok {
+			continue
+		}
+		if !name && translated.Name != "" {
+			content.Name, name, locale = translated.Name, true, candidate
+		}
+		if !description && translated.Description != "" {
+			content.Description, description = translated.Description, true
+		}
+		if !metaTitle && translated.MetaTitle != "" {
+			content.MetaTitle, metaTitle = translated.MetaTitle, true
+		}
+		if !metaDescription && translated.MetaDescription != "" {
+			content.MetaDescription, metaDescription = translated.MetaDescription, true
+		}
+	}
+	return locale
+}
+
+// localizeProduct replaces the product's text with its translation for
+// the chain.
+func localizeProduct(p *Product, chain []string) {
+	content := LocalizedContent{p.Name, p.Description, p.MetaTitle, p.MetaDescription}
+	p.Locale = p.Translations.localize(chain, &content)
+	p.Name, p.Description, p.MetaTitle, p.MetaDescription = content.Name, content.Description, content.MetaTitle, content.MetaDescription
+}
+
+func localizeProducts(products []Product, chain []string) {
+	for i := range products {
+		localizeProduct(&products[i], chain)
+	}
+}
+
+func localizeCategory(category *Category, chain []string) {
+	content := LocalizedContent{category.Name, category.Description, category.MetaTitle, category.MetaDescription}
+	category.Locale = category.Translations.localize(chain, &content)
+	category.Name, category.Description, category.MetaTitle, category.MetaDescription = content.Name, content.Description, content.MetaTitle, content.MetaDescription
+}
+
+func localizeCategories(categories []Category, chain []string) {
+	for i := range categories {
+		localizeCategory(&categories[i], chain)
+	}
+}
+
+// storefrontLocales returns the caller's locale chain and tells HTTP
+// caches that the response depends on it.
+func storefrontLocales(c *gin.Context) []string {
+	c.Header("Vary", "Accept-Language")
+	return localeChain(c)
+}
+
+// translationLocale reads the :locale parameter, writing a 400 if content
+// can't be translated into it.
+func translationLocale(c *gin.Context) (string, bool) {
+	locale := normalizeLocale(c.Param("locale"))
+	if !translatable(locale) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported locale " + strconv.Quote(c.Param("locale")) +
+			"; the default locale " + defaultLocale + " is edited on the resource itself"})
+		return "", false
+	}
+	return locale, true
+}
+
+func bindLocalizedContent(c *gin.Context) (LocalizedContent, bool) {
+	var content LocalizedContent
+	if err := c.ShouldBindJSON(&content); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return content, false
+	}
+	content.Name = strings.TrimSpace(content.Name)
+	content.MetaTitle = strings.TrimSpace(content.MetaTitle)
+	content.MetaDescription = strings.TrimSpace(content.MetaDescription)
+
+	var msg string
+	switch {
+	case content == LocalizedContent{}:
+		msg = "A translation needs at least one field"
+	case len(content.Name) > maxLocalizedName:
+		msg = "name is too long"
+	case len(content.Description) > maxLocalizedDescription:
+		msg = "description is too long"
+	case len(content.MetaTitle) > maxLocalizedMetaTitle:
+		msg = "meta_title is too long"
+	case len(content.MetaDescription) > maxLocalizedMetaDescription:
+		msg = "meta_description is too long"
+	}
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return content, false
+	}
+	return content, true
+}
+
+func translationsResponse(key, id string, translations Translations) gin.H {
+	if translations == nil {
+		translations = Translations{}
+	}
+	return gin.H{key: id, "default_locale": defaultLocale, "translations": translations}
+}
+
+func getProductTranslations(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, translationsResponse("product_id", product.ID, product.Translations))
+}
+
+// putProductTranslation replaces the product's content in :locale.
+func putProductTranslation(c *gin.Context) {
+	locale, ok := translationLocale(c)
+	if !ok {
+		return
+	}
+	content, ok := bindLocalizedContent(c)
+	if !ok {
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	err := updateAudited(c, AuditTranslationChanged, product.ID,
+		bson.M{"$set": bson.M{"translations." + locale: content, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save translation"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), product.ID)
+	publishProductUpdated(c.Request.Context(), product.ID)
+
+	c.JSON(http.StatusOK, gin.H{"product_id": product.ID, "locale": locale, "translation": content})
+}
+
+func deleteProductTranslation(c *gin.Context) {
+	locale, ok := translationLocale(c)
+	if !ok {
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	if _, ok := product.Translations[locale]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Translation not found"})
+		return
+	}
+
+	err := updateAudited(c, AuditTranslationChanged, product.ID,
+		bson.M{"$unset": bson.M{"translations." + locale: ""}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete translation"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), product.ID)
+	publishProductUpdated(c.Request.Context(), product.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Translation deleted"})
+}
+
+func getCategoryTranslations(c *gin.Context) {
+	category, err := findCategory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	c.JSON(http.StatusOK, translationsResponse("category_id", category.ID, category.Translations))
+}
+
+// putCategoryTranslation replaces the category's content in :locale.
+func putCategoryTranslation(c *gin.Context) {
+	locale, ok := translationLocale(c)
+	if !ok {
+		return
+	}
+	content, ok := bindLocalizedContent(c)
+	if !ok {
+		return
+	}
+	category, err := findCategory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	_, err = productService.db.Collection("categories").UpdateOne(c.Request.Context(), bson.M{"_id": category.ID},
+		bson.M{"$set": bson.M{"translations." + locale: content, "updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save translation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"category_id": category.ID, "locale": locale, "translation": content})
+}
+
+func deleteCategoryTranslation(c *gin.Context) {
+	locale, ok := translationLocale(c)
+	if !ok {
+		return
+	}
+	category, err := findCategory(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	if _, ok := category.Translations[locale]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Translation not found"})
+		return
+	}
+
+	_, err = productService.db.Collection("categories").UpdateOne(c.Request.Context(), bson.M{"_id": category.ID},
+		bson.M{"$unset": bson.M{"translations." + locale: ""}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete translation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Translation deleted"})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	// Decoders for the accepted upload formats
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Uploaded product images are scaled to fit each rendition's box, keeping
+// their proportions and never enlarging, and re-encoded as JPEG, which
+// also strips metadata such as GPS tags. The renditions are stored under
+// images/<product>/<media>/ in the bucket and added to the gallery as an
+// image whose URL is the large one and thumbnail the smallest.
+type imageRendition struct {
+	name string
+	size int
+}
+
+// Largest first, each scaled from the one before
+var imageRenditions = []imageRendition{
+	{"large", 1600},
+	{"medium", 800},
+	{"thumbnail", 200},
+}
+
+const (
+	maxImagePixels   = 50_000_000
+	imageJPEGQuality = 85
+	imageContentType = "image/jpeg"
+)
+
+var maxImageBytes = int64(envInt("PRODUCT_IMAGE_MAX_BYTES", 20<<20))
+
+// uploadProductImage answers POST /api/v1/products/:id/images with the
+// multipart "image", and optionally "alt", "position" and "primary".
+func uploadProductImage(c *gin.Context) {
+	if !storageConfigured(c) {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImageBytes+1<<20)
+
+	header, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image file is required"})
+		return
+	}
+	if header.Size > maxImageBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Image too large"})
+		return
+	}
+	alt := c.PostForm("alt")
+	if len(alt) > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "alt must be at most 500 characters"})
+		return
+	}
+	var position *int
+	if p := c.PostForm("position"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "position must be a number"})
+			return
+		}
+		position = &n
+	}
+	primary := c.PostForm("primary") == "true"
+
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+
+	// Check dimensions before decoding so a small file can't expand into a
+	// huge bitmap
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image must be a JPEG, PNG or GIF"})
+		return
+	}
+	if config.Width*config.Height > maxImagePixels {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image dimensions are too large"})
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image must be a JPEG, PNG or GIF"})
+		return
+	}
+
+	item := MediaItem{
+		ID:         primitive.NewObjectID().Hex(),
+		Type:       MediaImage,
+		Alt:        alt,
+		Renditions: map[string]string{},
+	}
+	for _, r := range imageRenditions {
+		img = fitImage(img, r.size)
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: imageJPEGQuality}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image"})
+			return
+		}
+		key := imageKey(product.ID, item.ID, r.name)
+		if err := storage.put(c.Request.Context(), key, imageContentType, &out, int64(out.Len())); err != nil {
+			log.Printf("Failed to store image for product %s: %v", product.ID, err)
+			deleteImageFiles(product.ID, item)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store image"})
+			return
+		}
+		item.Renditions[r.name] = storage.publicURL(key)
+	}
+	item.URL = item.Renditions[imageRenditions[0].name]
+	item.ThumbnailURL = item.Renditions[imageRenditions[len(imageRenditions)-1].name]
+
+	item = insertMedia(product, item, position, primary)
+	if err := saveGallery(c, product.Media); err != nil {
+		deleteImageFiles(product.ID, item)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add image"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+func imageKey(productID, mediaID, rendition string) string {
+	return "images/" + productID + "/" + mediaID + "/" + rendition + ".jpg"
+}
+
+// deleteImageFiles removes an uploaded image's renditions from the bucket.
+// It's best effort; a leftover file costs storage, not correctness.
+func deleteImageFiles(productID string, item MediaItem) {
+	if storage == nil {
+		return
+	}
+	for name := range item.Renditions {
+		if err := storage.delete(context.Background(), imageKey(productID, item.ID, name)); err != nil {
+			log.Printf("Failed to delete image %s of product %s: %v", item.ID, productID, err)
+		}
+	}
+}
+
+// fitImage scales img down to fit within a size pixel square, averaging
+// each output pixel over the source pixels it covers. Images that already
+// fit are only flattened.
+func fitImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/bounds.Dx())
+		} else {
+			w, h = max(1, w*size/bounds.Dy()), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy0, sy1 := bounds.Min.Y+y*bounds.Dy()/h, bounds.Min.Y+(y+1)*bounds.Dy()/h
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < w; x++ {
+			sx0, sx1 := bounds.Min.X+x*bounds.Dx()/w, bounds.Min.X+(x+1)*bounds.Dx()/w
+			if sx1 == sx0 {
+				sx1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			// JPEG has no alpha, so transparent areas become white
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
@@ -2,29 +2,88 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Product struct {
-	ID          string    `bson:"_id,omitempty" json:"id"`
-	Name        string    `bson:"name" json:"name"`
-	Description string    `bson:"description" json:"description"`
-	Price       float64   `bson:"price" json:"price"`
-	Category    string    `bson:"category" json:"category"`
-	Stock       int       `bson:"stock" json:"stock"`
-	Rating      float64   `bson:"rating" json:"rating"`
-	Reviews     int       `bson:"reviews" json:"reviews"`
-	ImageURL    string    `bson:"image_url" json:"image_url"`
-	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+	ID   string `bson:"_id,omitempty" json:"id"`
+	Name string `bson:"name" json:"name"`
+	// Storefront URL slug, see slugs.go
+	Slug          string   `bson:"slug,omitempty" json:"slug,omitempty"`
+	PreviousSlugs []string `bson:"previous_slugs,omitempty" json:"-"`
+	// Merchant's stock keeping unit, unique; bulk imports match on it
+	SKU         string `bson:"sku,omitempty" json:"sku,omitempty"`
+	Description string `bson:"description" json:"description"`
+	// Search engine title and description, defaulting to the name and
+	// description
+	MetaTitle       string  `bson:"meta_title,omitempty" json:"meta_title,omitempty"`
+	MetaDescription string  `bson:"meta_description,omitempty" json:"meta_description,omitempty"`
+	Price           float64 `bson:"price" json:"price"`
+	Category        string  `bson:"category" json:"category"`
+	CategoryID      string  `bson:"category_id,omitempty" json:"category_id,omitempty"`
+	// Linked like the category, see brands.go
+	Brand   string `bson:"brand,omitempty" json:"brand,omitempty"`
+	BrandID string `bson:"brand_id,omitempty" json:"brand_id,omitempty"`
+	// GTIN (EAN/UPC barcode) and free-form attributes such as material
+	GTIN       string            `bson:"gtin,omitempty" json:"gtin,omitempty"`
+	Attributes map[string]string `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	// Draft, published or archived, see workflow.go
+	Status  string        `bson:"status,omitempty" json:"status,omitempty"`
+	Quality *QualityScore `bson:"quality,omitempty" json:"-"`
+	// When a draft goes live and a published product comes down, see
+	// schedule.go
+	PublishAt   *time.Time `bson:"publish_at,omitempty" json:"publish_at,omitempty"`
+	UnpublishAt *time.Time `bson:"unpublish_at,omitempty" json:"unpublish_at,omitempty"`
+	// Mirrored from the inventory service, see stock_sync.go
+	Stock   int     `bson:"stock" json:"stock"`
+	Rating  float64 `bson:"rating" json:"rating"`
+	Reviews int     `bson:"reviews" json:"reviews"`
+	// Sold while out of stock, and the level at which stock is low, see
+	// availability.go
+	Backorder         bool   `bson:"backorder" json:"backorder"`
+	LowStockThreshold *int   `bson:"low_stock_threshold,omitempty" json:"low_stock_threshold,omitempty"`
+	Availability      string `bson:"-" json:"availability,omitempty"`
+	// Counted and scored from product page views, see views.go
+	Views      int64   `bson:"views,omitempty" json:"views"`
+	Popularity float64 `bson:"popularity,omitempty" json:"-"`
+	ImageURL   string  `bson:"image_url" json:"image_url"`
+	// Search keywords, indexed with the name and description
+	Tags  []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	Media Gallery  `bson:"media,omitempty" json:"media"`
+	// Sizes, colours and so on, see variants.go
+	Variants []Variant `bson:"variants,omitempty" json:"variants,omitempty"`
+	Customs  *Customs  `bson:"customs,omitempty" json:"customs,omitempty"`
+	Drop     bool      `bson:"drop" json:"drop"`
+	Digital  bool      `bson:"digital" json:"digital"`
+	// Delivered to buyers of digital products, see digital.go
+	Files []DigitalFile `bson:"files,omitempty" json:"-"`
+	// Content in other locales, managed through its own endpoints, see i18n.go
+	Translations Translations `bson:"translations,omitempty" json:"-"`
+	// The locale a storefront read resolved the name to
+	Locale     string     `bson:"-" json:"locale,omitempty"`
+	RestockETA *time.Time `bson:"-" json:"restock_eta,omitempty"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// Customs holds the data needed to declare a product on international
+// shipments (CN22 / commercial invoice).
+type Customs struct {
+	HSCode          string  `bson:"hs_code" json:"hs_code"`
+	CountryOfOrigin string  `bson:"country_of_origin" json:"country_of_origin"`
+	Value           float64 `bson:"value" json:"value"`
+	WeightKg        float64 `bson:"weight_kg" json:"weight_kg"`
 }
 
 type ProductService struct {
@@ -50,20 +109,35 @@ func main() {
 
 	db := client.Database("ecommerce")
 	productService = &ProductService{db: db}
+	connectRedis()
+	setupStorage()
+	verifier = newTokenVerifier()
+	startSearchTuning()
+	setupCategories()
+	startQualityScoring()
+	setupVariants()
+	setupSearchIndex()
+	startElasticsearch()
+	setupReviews()
+	setupQuestions()
+	setupImports()
+	setupAssociations()
+	setupTags()
+	setupAttributes()
+	setupBrands()
+	setupSlugs()
+	startRatingAggregation()
+	startStockSync()
+	setupViews()
+	setupEvents()
+	startFeeds()
+	setupSuggestions()
+	setupAudit()
+	startScheduler()
+	startRecommendations()
 
 	router := gin.Default()
-
-	// Health Check
-	router.GET("/health", healthCheck)
-	router.GET("/ready", readinessCheck)
-
-	// Product Routes
-	router.GET("/api/v1/products", listProducts)
-	router.GET("/api/v1/products/:id", getProduct)
-	router.POST("/api/v1/products", createProduct)
-	router.PUT("/api/v1/products/:id", updateProduct)
-	router.DELETE("/api/v1/products/:id", deleteProduct)
-	router.GET("/api/v1/products/search", searchProducts)
+	setupRoutes(router)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -76,6 +150,151 @@ func main() {
 	}
 }
 
+// setupRoutes registers every route, with the middleware guarding it.
+func setupRoutes(router *gin.Engine) {
+	// Health Check
+	router.GET("/health", healthCheck)
+	router.GET("/ready", readinessCheck)
+
+	// Product Routes
+	router.GET("/api/v1/products", listProducts)
+	router.GET("/api/v1/products/:id", getProduct)
+	router.POST("/api/v1/products", scopedAuthMiddleware, requirePermission("products:write"), createProduct)
+	router.PUT("/api/v1/products/:id", scopedAuthMiddleware, requirePermission("products:write"), updateProduct)
+	router.DELETE("/api/v1/products/:id", scopedAuthMiddleware, requirePermission("products:write"), deleteProduct)
+	router.POST("/api/v1/products/:id/duplicate", scopedAuthMiddleware, requirePermission("products:write"), duplicateProduct)
+	router.GET("/api/v1/products/:id/audit", scopedAuthMiddleware, requirePermission("products:audit"), listProductAudit)
+	router.GET("/api/v1/products/:id/audit/:revisionId", scopedAuthMiddleware, requirePermission("products:audit"), getProductRevision)
+	router.POST("/api/v1/products/:id/audit/:revisionId/revert", scopedAuthMiddleware, requirePermission("products:write"), revertProduct)
+	router.GET("/api/v1/products/search", searchProducts)
+	router.GET("/api/v1/products/suggest", suggest)
+	router.GET("/api/v1/products/facets", getFacets)
+	router.GET("/api/v1/products/trending", getTrendingProducts)
+	router.GET("/api/v1/products/slug/:slug", getProductBySlug)
+
+	// Bulk Import/Export Routes
+	router.POST("/api/v1/products/import", scopedAuthMiddleware, requirePermission("products:import"), importProducts)
+	router.GET("/api/v1/products/imports", scopedAuthMiddleware, requirePermission("products:import"), listImportJobs)
+	router.GET("/api/v1/products/imports/:jobId", scopedAuthMiddleware, requirePermission("products:import"), getImportJob)
+	router.GET("/api/v1/products/export", scopedAuthMiddleware, requirePermission("products:export"), exportProducts)
+
+	// Search Merchandising Routes
+	router.GET("/api/v1/search/rules", listSearchRules)
+	router.PUT("/api/v1/search/rules/:query", scopedAuthMiddleware, requirePermission("products:write"), putSearchRule)
+	router.DELETE("/api/v1/search/rules/:query", scopedAuthMiddleware, requirePermission("products:write"), deleteSearchRule)
+	router.GET("/api/v1/search/lexicon", getSearchLexicon)
+	router.PUT("/api/v1/search/lexicon", scopedAuthMiddleware, requirePermission("products:write"), putSearchLexicon)
+
+	// Search Index Routes
+	router.GET("/api/v1/search/status", getSearchStatus)
+	router.POST("/api/v1/search/reindex", scopedAuthMiddleware, requirePermission("products:write"), reindexSearch)
+
+	// Recently Viewed Routes
+	router.GET("/api/v1/me/recently-viewed", getRecentlyViewed)
+	router.POST("/api/v1/me/recently-viewed", addRecentlyViewed)
+	router.DELETE("/api/v1/me/recently-viewed", clearRecentlyViewed)
+
+	// Variant Routes
+	router.GET("/api/v1/products/:id/variants", listVariants)
+	router.GET("/api/v1/products/:id/variants/resolve", resolveVariant)
+	router.POST("/api/v1/products/:id/variants", scopedAuthMiddleware, requirePermission("products:write"), addVariant)
+	router.PUT("/api/v1/products/:id/variants/:variantId", scopedAuthMiddleware, requirePermission("products:write"), updateVariant)
+	router.DELETE("/api/v1/products/:id/variants/:variantId", scopedAuthMiddleware, requirePermission("products:write"), deleteVariant)
+
+	// Publication Routes
+	router.POST("/api/v1/products/:id/publish", scopedAuthMiddleware, requirePermission("products:write"), publishProduct)
+	router.POST("/api/v1/products/:id/unpublish", scopedAuthMiddleware, requirePermission("products:write"), unpublishProduct)
+	router.POST("/api/v1/products/:id/archive", scopedAuthMiddleware, requirePermission("products:write"), archiveProduct)
+	router.POST("/api/v1/products/:id/restore", scopedAuthMiddleware, requirePermission("products:write"), restoreProduct)
+	router.PUT("/api/v1/products/:id/schedule", scopedAuthMiddleware, requirePermission("products:write"), scheduleProduct)
+	router.GET("/api/v1/products/quality", scopedAuthMiddleware, requirePermission("products:read"), getQualityReport)
+
+	// Category Routes
+	router.GET("/api/v1/categories", listCategories)
+	router.GET("/api/v1/categories/tree", getCategoryTree)
+	router.GET("/api/v1/categories/:id", getCategory)
+	router.POST("/api/v1/categories", scopedAuthMiddleware, requirePermission("products:write"), createCategory)
+	router.PUT("/api/v1/categories/:id", scopedAuthMiddleware, requirePermission("products:write"), updateCategory)
+	router.DELETE("/api/v1/categories/:id", scopedAuthMiddleware, requirePermission("products:write"), deleteCategory)
+	router.GET("/api/v1/categories/:id/attributes", getCategoryAttributes)
+	router.PUT("/api/v1/categories/:id/attributes", scopedAuthMiddleware, requirePermission("products:write"), putCategoryAttributes)
+
+	// Brand Routes
+	router.GET("/api/v1/brands", listBrands)
+	router.GET("/api/v1/brands/:id", getBrand)
+	router.POST("/api/v1/brands", scopedAuthMiddleware, requirePermission("products:brands"), createBrand)
+	router.PUT("/api/v1/brands/:id", scopedAuthMiddleware, requirePermission("products:brands"), updateBrand)
+	router.DELETE("/api/v1/brands/:id", scopedAuthMiddleware, requirePermission("products:brands"), deleteBrand)
+
+	// Tag Routes
+	router.GET("/api/v1/tags", listTags)
+	router.POST("/api/v1/tags/merge", scopedAuthMiddleware, requirePermission("products:tags"), mergeTagsHandler)
+	router.PUT("/api/v1/tags/:tag", scopedAuthMiddleware, requirePermission("products:tags"), renameTag)
+	router.DELETE("/api/v1/tags/:tag", scopedAuthMiddleware, requirePermission("products:tags"), deleteTag)
+
+	// Digital File Routes
+	router.GET("/api/v1/products/:id/files", scopedAuthMiddleware, requirePermission("products:files"), listDigitalFiles)
+	router.POST("/api/v1/products/:id/files", scopedAuthMiddleware, requirePermission("products:files"), uploadDigitalFile)
+	router.DELETE("/api/v1/products/:id/files/:fileId", scopedAuthMiddleware, requirePermission("products:files"), deleteDigitalFile)
+	router.GET("/api/v1/products/:id/downloads", authMiddleware, getDownloads)
+
+	// Translation Routes
+	router.GET("/api/v1/products/:id/translations", scopedAuthMiddleware, requirePermission("i18n:read"), getProductTranslations)
+	router.PUT("/api/v1/products/:id/translations/:locale", scopedAuthMiddleware, requirePermission("i18n:write"), putProductTranslation)
+	router.DELETE("/api/v1/products/:id/translations/:locale", scopedAuthMiddleware, requirePermission("i18n:write"), deleteProductTranslation)
+	router.GET("/api/v1/categories/:id/translations", scopedAuthMiddleware, requirePermission("i18n:read"), getCategoryTranslations)
+	router.PUT("/api/v1/categories/:id/translations/:locale", scopedAuthMiddleware, requirePermission("i18n:write"), putCategoryTranslation)
+	router.DELETE("/api/v1/categories/:id/translations/:locale", scopedAuthMiddleware, requirePermission("i18n:write"), deleteCategoryTranslation)
+
+	// Association Routes
+	router.GET("/api/v1/products/:id/related", getRelatedProducts)
+	router.GET("/api/v1/products/:id/also-bought", getAlsoBought)
+	router.GET("/api/v1/products/:id/links", listProductLinks)
+	router.PUT("/api/v1/products/:id/links/:type", scopedAuthMiddleware, requirePermission("products:write"), putProductLinks)
+	router.DELETE("/api/v1/products/:id/links/:type/:relatedId", scopedAuthMiddleware, requirePermission("products:write"), deleteProductLink)
+
+	// Review Routes
+	router.GET("/api/v1/products/:id/reviews", listProductReviews)
+	router.POST("/api/v1/products/:id/reviews", authMiddleware, createReview)
+	router.PUT("/api/v1/reviews/:id", authMiddleware, updateReview)
+	router.DELETE("/api/v1/reviews/:id", authMiddleware, deleteReview)
+	router.GET("/api/v1/me/reviews", authMiddleware, listMyReviews)
+	router.GET("/api/v1/reviews/moderation", scopedAuthMiddleware, requirePermission("reviews:moderate"), listModerationQueue)
+	router.PUT("/api/v1/reviews/:id/moderation", scopedAuthMiddleware, requirePermission("reviews:moderate"), moderateReview)
+
+	// Question Routes
+	router.GET("/api/v1/products/:id/questions", listProductQuestions)
+	router.POST("/api/v1/products/:id/questions", authMiddleware, createQuestion)
+	router.GET("/api/v1/questions/:id/answers", listQuestionAnswers)
+	router.POST("/api/v1/questions/:id/answers", authMiddleware, createAnswer)
+	router.DELETE("/api/v1/questions/:id", authMiddleware, deleteQuestion)
+	router.DELETE("/api/v1/answers/:id", authMiddleware, deleteAnswer)
+	router.POST("/api/v1/questions/:id/votes", authMiddleware, voteHelpful("questions"))
+	router.POST("/api/v1/answers/:id/votes", authMiddleware, voteHelpful("answers"))
+	router.GET("/api/v1/questions/moderation", scopedAuthMiddleware, requirePermission("questions:moderate"), listQuestionModerationQueue)
+	router.PUT("/api/v1/questions/:id/moderation", scopedAuthMiddleware, requirePermission("questions:moderate"), moderatePost("questions"))
+	router.PUT("/api/v1/answers/:id/moderation", scopedAuthMiddleware, requirePermission("questions:moderate"), moderatePost("answers"))
+
+	// Feed Routes
+	router.GET("/api/v1/feeds", scopedAuthMiddleware, requirePermission("products:feeds"), listFeeds)
+	router.POST("/api/v1/feeds/refresh", scopedAuthMiddleware, requirePermission("products:feeds"), refreshFeeds)
+	router.GET("/api/v1/feeds/:feed/url", scopedAuthMiddleware, requirePermission("products:feeds"), getFeedURL)
+	router.GET("/api/v1/feeds/:feed", downloadFeed)
+
+	// Event Routes
+	router.GET("/api/v1/products/events/consumers", scopedAuthMiddleware, requirePermission("products:events"), listEventConsumers)
+	router.POST("/api/v1/products/events/consumers", scopedAuthMiddleware, requirePermission("products:events"), registerEventConsumer)
+	router.DELETE("/api/v1/products/events/consumers/:name", scopedAuthMiddleware, requirePermission("products:events"), deleteEventConsumer)
+
+	// Media Routes
+	router.GET("/api/v1/products/:id/media", getProductMedia)
+	router.POST("/api/v1/products/:id/media", scopedAuthMiddleware, requirePermission("products:write"), addProductMedia)
+	router.POST("/api/v1/products/:id/images", scopedAuthMiddleware, requirePermission("products:write"), uploadProductImage)
+	router.PUT("/api/v1/products/:id/media/order", scopedAuthMiddleware, requirePermission("products:write"), reorderProductMedia)
+	router.PUT("/api/v1/products/:id/media/:mediaId", scopedAuthMiddleware, requirePermission("products:write"), updateProductMedia)
+	router.DELETE("/api/v1/products/:id/media/:mediaId", scopedAuthMiddleware, requirePermission("products:write"), deleteProductMedia)
+}
+
 func healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status": "healthy",
@@ -104,10 +323,22 @@ func readinessCheck(c *gin.Context) {
 }
 
 func listProducts(c *gin.Context) {
+	cacheKey, served := serveCachedListing(c)
+	if served {
+		return
+	}
 	collection := productService.db.Collection("products")
-	
+
+	filter := bson.M{}
+	if !statusFilter(c, filter) || !categoryFilter(c, filter) || !brandFilter(c, filter) || !tagFilter(c, filter) || !attributeFilter(c, filter) {
+		return
+	}
+
 	opts := options.Find().SetLimit(20)
-	cursor, err := collection.Find(context.Background(), bson.M{}, opts)
+	if !listingSort(c, opts) {
+		return
+	}
+	cursor, err := collection.Find(context.Background(), filter, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
@@ -119,71 +350,201 @@ func listProducts(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
 		return
 	}
+	localizeProducts(products, storefrontLocales(c))
+	setAvailability(products)
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"products": products,
 		"count": len(products),
-	})
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode products"})
+		return
+	}
+	if cacheKey != "" {
+		cacheListing(c.Request.Context(), cacheKey, data)
+	}
+	writeListing(c, data, c.Query("status") == "" || c.Query("status") == StatusPublished)
 }
 
 func getProduct(c *gin.Context) {
-	id := c.Param("id")
+	showProduct(c, c.Param("id"))
+}
+
+// showProduct writes the product as the storefront sees it.
+func showProduct(c *gin.Context, id string) {
 	collection := productService.db.Collection("products")
 
-	var product Product
-	err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&product)
-	if err != nil {
+	product := cachedProduct(c.Request.Context(), id)
+	if product == nil {
+		var stored Product
+		if err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&stored); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		product = &stored
+		cacheProduct(c.Request.Context(), product)
+	}
+	if !product.published() && !callerCan(c, "products:read") {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
+	product.Media = product.gallery()
+	localizeProduct(product, storefrontLocales(c))
+	product.Availability = product.availability()
+	c.Header("Content-Language", product.Locale)
+	recordView(c, product.ID)
+	if product.published() {
+		countView(c, product.ID)
+	}
+	if product.Stock <= 0 && !product.Digital {
+		product.RestockETA = fetchRestockETA(c.Request.Context(), product.ID)
+	}
 
-	c.JSON(http.StatusOK, product)
+	data, err := json.Marshal(product)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode product"})
+		return
+	}
+	writeConditional(c, data, product.UpdatedAt, product.published())
 }
 
 func createProduct(c *gin.Context) {
 	var product Product
-	if err := c.ShouldBindJSON(&product); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindProduct(c, &product) {
+		return
+	}
+
+	// Variants are managed through their own endpoints, ratings are
+	// aggregated from reviews, stock comes from the inventory service and
+	// views are counted
+	product.Variants = nil
+	product.Rating, product.Reviews = 0, 0
+	product.Stock = 0
+	product.Views, product.Popularity = 0, 0
+	problems := productProblems(&product)
+	if product.Status == StatusArchived {
+		problems["status"] = "must be draft or published for new products"
+	}
+	assignCategory(c.Request.Context(), &product, problems)
+	assignBrand(c.Request.Context(), &product, problems)
+	if !checkProduct(c, problems) {
+		return
+	}
+
+	if !checkAttributes(c, &product) || !checkPublishable(c, &product, nil) {
+		return
+	}
+	if !assignProductSlug(c, &product, nil) {
 		return
 	}
 
+	product.ID = primitive.NewObjectID().Hex()
 	product.CreatedAt = time.Now()
 	product.UpdatedAt = time.Now()
 
 	collection := productService.db.Collection("products")
-	result, err := collection.InsertOne(context.Background(), product)
+	_, err := collection.InsertOne(context.Background(), product)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": duplicateProductError(err)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
 		return
 	}
+	invalidateProduct(c.Request.Context(), "")
+	publishProductSaved(c.Request.Context(), &product, true, 0)
+	recordProductChange(c, AuditCreated, product.ID, nil, nil)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Product created successfully",
-		"product_id": result.InsertedID,
+		"product_id": product.ID,
 	})
 }
 
 func updateProduct(c *gin.Context) {
 	id := c.Param("id")
 	var product Product
-	if err := c.ShouldBindJSON(&product); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindProduct(c, &product) {
+		return
+	}
+
+	// Variants are managed through their own endpoints
+	product.Variants = nil
+	problems := productProblems(&product)
+	assignCategory(c.Request.Context(), &product, problems)
+	assignBrand(c.Request.Context(), &product, problems)
+	if !checkProduct(c, problems) {
+		return
+	}
+
+	if !checkAttributes(c, &product) {
 		return
 	}
 
-	product.UpdatedAt = time.Now()
 	collection := productService.db.Collection("products")
-	
+	var current Product
+	if err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&current); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if !checkTransition(c, &current, product.Status) {
+		return
+	}
+	// Score the product as it will be saved; media is managed separately
+	if product.Status == "" {
+		product.Status = current.Status
+	}
+	if product.Media == nil {
+		product.Media = current.Media
+	}
+	// image_url follows the gallery once there is one
+	if image, ok := product.Media.primaryImage(); ok {
+		product.ImageURL = image.URL
+	}
+	product.Rating, product.Reviews = current.Rating, current.Reviews
+	product.Stock = current.Stock
+	product.Views, product.Popularity = current.Views, current.Popularity
+	if !checkPublishable(c, &product, &current) || !assignProductSlug(c, &product, &current) {
+		return
+	}
+
+	product.UpdatedAt = time.Now()
+
+	// A schedule the new status makes moot is dropped unless set again here
+	update := bson.M{"$set": product}
+	if product.Status != productStatus(&current) {
+		unset := staleSchedule(product.Status)
+		if product.PublishAt != nil {
+			delete(unset, "publish_at")
+		}
+		if product.UnpublishAt != nil {
+			delete(unset, "unpublish_at")
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+	}
 	_, err := collection.UpdateOne(
 		context.Background(),
 		bson.M{"_id": id},
-		bson.M{"$set": product},
+		update,
 	)
 
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": duplicateProductError(err)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
 		return
 	}
+	invalidateProduct(c.Request.Context(), id)
+	product.ID = id
+	publishProductSaved(c.Request.Context(), &product, false, current.Price)
+	recordProductChange(c, AuditUpdated, id, &current, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Product updated successfully"})
 }
@@ -192,41 +553,107 @@ func deleteProduct(c *gin.Context) {
 	id := c.Param("id")
 	collection := productService.db.Collection("products")
 
-	result, err := collection.DeleteOne(context.Background(), bson.M{"_id": id})
-	if err != nil || result.DeletedCount == 0 {
+	var deleted Product
+	if err := collection.FindOneAndDelete(context.Background(), bson.M{"_id": id}).Decode(&deleted); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
+	productService.db.Collection("reviews").DeleteMany(context.Background(), bson.M{"product_id": id})
+	deleteLinksTo(context.Background(), id)
+	invalidateProduct(c.Request.Context(), id)
+	publishProductEvent(c.Request.Context(), EventProductDeleted, id, nil)
+	recordProductChange(c, AuditDeleted, id, &deleted, nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
 }
 
 func searchProducts(c *gin.Context) {
-	query := c.Query("q")
-	collection := productService.db.Collection("products")
+	query := normalizeQuery(c.Query("q"))
+	terms := tuning.terms(query)
 
-	opts := options.Find().SetLimit(20)
-	cursor, err := collection.Find(context.Background(), bson.M{
-		"$or": []bson.M{
-			{"name": bson.M{"$regex": query, "$options": "i"}},
-			{"description": bson.M{"$regex": query, "$options": "i"}},
-		},
-	}, opts)
+	filters, ok := parseSearchFilters(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+
+	// Rank the candidates, then load only the page being shown
+	ctx := c.Request.Context()
+	engine := "mongo"
+	var hits []searchHit
+	var facets searchFacets
+	var err error
+	if elastic.available() {
+		if hits, facets, err = elastic.search(ctx, terms, filters); err == nil {
+			engine = "elasticsearch"
+		} else {
+			elastic.failed(err)
+		}
+	}
+	if engine == "mongo" {
+		if hits, err = findSearchHits(ctx, terms, filters.mongo()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+			return
+		}
+		facets = facetsFromHits(hits)
+	}
+	facets.Categories = nameCategoryFacets(ctx, facets.Categories)
+	hits = merchandise(ctx, query, hits)
 
+	total := len(hits)
+	from := (page - 1) * perPage
+	if from > total {
+		from = total
+	}
+	to := from + perPage
+	if to > total {
+		to = total
+	}
+	ids := make([]string, 0, to-from)
+	byID := make(map[string]searchHit, to-from)
+	for _, h := range hits[from:to] {
+		ids = append(ids, h.ID)
+		byID[h.ID] = h
+	}
+
+	products, err := loadProductsInOrder(ctx, ids)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var products []Product
-	if err = cursor.All(context.Background(), &products); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
-		return
+	localizeProducts(products, storefrontLocales(c))
+	setAvailability(products)
+	marker := newHighlighter(terms)
+	results := make([]searchResult, 0, len(products))
+	for i := range products {
+		hit := byID[products[i].ID]
+		highlights := hit.Highlights
+		if highlights == nil {
+			highlights = marker.highlights(&products[i])
+		}
+		results = append(results, searchResult{
+			Product:    products[i],
+			Score:      hit.Score,
+			Highlights: highlights,
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"products": products,
-		"count": len(products),
+		"products": results,
+		"count":    len(results),
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+		"facets":   facets,
+		"engine":   engine,
 	})
 }
\ No newline at end of file
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// writeRoutes change the catalog and need products:write.
+var writeRoutes = []struct{ method, path string }{
+	{http.MethodPost, "/api/v1/products"},
+	{http.MethodPut, "/api/v1/products/p1"},
+	{http.MethodDelete, "/api/v1/products/p1"},
+	{http.MethodPost, "/api/v1/products/p1/archive"},
+	{http.MethodPost, "/api/v1/products/p1/restore"},
+	{http.MethodPut, "/api/v1/products/p1/links/related"},
+	{http.MethodDelete, "/api/v1/products/p1/links/related/p2"},
+	{http.MethodPost, "/api/v1/products/p1/variants"},
+	{http.MethodPut, "/api/v1/products/p1/variants/v1"},
+	{http.MethodDelete, "/api/v1/products/p1/variants/v1"},
+	{http.MethodPost, "/api/v1/categories"},
+	{http.MethodPut, "/api/v1/categories/c1"},
+	{http.MethodDelete, "/api/v1/categories/c1"},
+	{http.MethodPut, "/api/v1/categories/c1/attributes"},
+	{http.MethodPut, "/api/v1/search/rules/shoes"},
+	{http.MethodDelete, "/api/v1/search/rules/shoes"},
+	{http.MethodPut, "/api/v1/search/lexicon"},
+	{http.MethodPost, "/api/v1/search/reindex"},
+}
+
+func testRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	verifier = newTokenVerifier()
+	// Nothing listens here, so no token reads as revoked
+	redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 50 * time.Millisecond, MaxRetries: -1})
+	router := gin.New()
+	setupRoutes(router)
+	return router
+}
+
+func testToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(verifier.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func serve(router *gin.Engine, method, path, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestWriteRoutesNeedProductsWrite(t *testing.T) {
+	router := testRouter(t)
+	customer := testToken(t, jwt.MapClaims{"sub": "u1", "role": "customer", "permissions": []string{}})
+	reader := testToken(t, jwt.MapClaims{"sub": "u2", "role": "support", "permissions": []string{"products:read"}})
+	refresh := testToken(t, jwt.MapClaims{"sub": "u3", "role": "catalog", "permissions": []string{"products:write"}, "typ": "refresh"})
+
+	for _, route := range writeRoutes {
+		if got := serve(router, route.method, route.path, ""); got != http.StatusUnauthorized {
+			t.Errorf("%s %s anonymously: got %d, want 401", route.method, route.path, got)
+		}
+		if got := serve(router, route.method, route.path, refresh); got != http.StatusUnauthorized {
+			t.Errorf("%s %s with a refresh token: got %d, want 401", route.method, route.path, got)
+		}
+		for _, token := range []string{customer, reader} {
+			if got := serve(router, route.method, route.path, token); got != http.StatusForbidden {
+				t.Errorf("%s %s without products:write: got %d, want 403", route.method, route.path, got)
+			}
+		}
+	}
+}
+
+func TestQualityReportNeedsProductsRead(t *testing.T) {
+	router := testRouter(t)
+	customer := testToken(t, jwt.MapClaims{"sub": "u1", "role": "customer", "permissions": []string{}})
+
+	if got := serve(router, http.MethodGet, "/api/v1/products/quality", ""); got != http.StatusUnauthorized {
+		t.Errorf("anonymously: got %d, want 401", got)
+	}
+	if got := serve(router, http.MethodGet, "/api/v1/products/quality", customer); got != http.StatusForbidden {
+		t.Errorf("as a customer: got %d, want 403", got)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MediaImage = "image"
+	MediaVideo = "video"
+	MediaEmbed = "embed"
+)
+
+// MediaItem is one entry in a product's gallery: an image, a hosted video
+// file, or a YouTube/Vimeo embed.
+type MediaItem struct {
+	ID           string `bson:"id" json:"id"`
+	Type         string `bson:"type" json:"type"`
+	URL          string `bson:"url" json:"url"`
+	ThumbnailURL string `bson:"thumbnail_url,omitempty" json:"thumbnail_url,omitempty"`
+	Alt          string `bson:"alt,omitempty" json:"alt,omitempty"`
+	Position     int    `bson:"position" json:"position"`
+	// Images only; the primary image stands for the product in listings
+	// and image_url
+	Primary bool `bson:"primary,omitempty" json:"primary,omitempty"`
+	// Embeds only
+	Provider   string `bson:"provider,omitempty" json:"provider,omitempty"`
+	ExternalID string `bson:"external_id,omitempty" json:"external_id,omitempty"`
+	EmbedURL   string `bson:"embed_url,omitempty" json:"embed_url,omitempty"`
+	// Uploaded images only, the URL of each size; see images.go
+	Renditions map[string]string `bson:"renditions,omitempty" json:"renditions,omitempty"`
+}
+
+// Gallery is a product's media, kept sorted by Position.
+type Gallery []MediaItem
+
+func (g Gallery) sorted() Gallery {
+	sort.SliceStable(g, func(i, j int) bool { return g[i].Position < g[j].Position })
+	return g
+}
+
+// primaryImage returns the image designated primary, or else the first
+// image.
+func (g Gallery) primaryImage() (MediaItem, bool) {
+	first, found := MediaItem{}, false
+	for _, item := range g.sorted() {
+		if item.Type != MediaImage {
+			continue
+		}
+		if item.Primary {
+			return item, true
+		}
+		if !found {
+			first, found = item, true
+		}
+	}
+	return first, found
+}
+
+// makePrimary designates the item with the ID as the primary image.
+func (g Gallery) makePrimary(id string) {
+	for i := range g {
+		g[i].Primary = g[i].ID == id
+	}
+}
+
+// gallery returns the product's media, falling back to the legacy single
+// image for products created before galleries existed.
+func (p *Product) gallery() Gallery {
+	if len(p.Media) == 0 && p.ImageURL != "" {
+		return Gallery{{ID: "legacy", Type: MediaImage, URL: p.ImageURL}}
+	}
+	if p.Media == nil {
+		return Gallery{}
+	}
+	return p.Media.sorted()
+}
+
+var videoExtensions = map[string]bool{".mp4": true, ".webm": true, ".mov": true, ".m4v": true}
+
+var (
+	youtubePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	vimeoPattern   = regexp.MustCompile(`^[0-9]+$`)
+)
+
+type MediaRequest struct {
+	Type         string `json:"type" binding:"required,oneof=image video embed"`
+	URL          string `json:"url" binding:"required,url"`
+	ThumbnailURL string `json:"thumbnail_url" binding:"omitempty,url"`
+	Alt          string `json:"alt" binding:"max=500"`
+	Position     *int   `json:"position"`
+	Primary      bool   `json:"primary"`
+}
+
+// newMediaItem validates a request and fills in what can be derived from
+// the URL, such as embed IDs and thumbnails.
+func newMediaItem(req MediaRequest) (MediaItem, error) {
+	item := MediaItem{
+		ID:           primitive.NewObjectID().Hex(),
+		Type:         req.Type,
+		URL:          req.URL,
+		ThumbnailURL: req.ThumbnailURL,
+		Alt:          req.Alt,
+	}
+
+	switch req.Type {
+	case MediaVideo:
+		u, _ := url.Parse(req.URL)
+		if !videoExtensions[strings.ToLower(path.Ext(u.Path))] {
+			return item, errors.New("video must be an mp4, webm, mov or m4v file")
+		}
+	case MediaEmbed:
+		provider, externalID, err := parseEmbedURL(req.URL)
+		if err != nil {
+			return item, err
+		}
+		item.Provider = provider
+		item.ExternalID = externalID
+		switch provider {
+		case "youtube":
+			item.EmbedURL = "https://www.youtube-nocookie.com/embed/" + externalID
+			if item.ThumbnailURL == "" {
+				item.ThumbnailURL = "https://i.ytimg.com/vi/" + externalID + "/hqdefault.jpg"
+			}
+		case "vimeo":
+			item.EmbedURL = "https://player.vimeo.com/video/" + externalID
+			if item.ThumbnailURL == "" {
+				item.ThumbnailURL = vimeoThumbnail(externalID)
+			}
+		}
+	}
+
+	return item, nil
+}
+
+// parseEmbedURL recognises the usual YouTube and Vimeo link shapes.
+func parseEmbedURL(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", errors.New("invalid embed URL")
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch host {
+	case "youtube.com", "m.youtube.com", "youtube-nocookie.com":
+		id := u.Query().Get("v")
+		if len(segments) == 2 && (segments[0] == "embed" || segments[0] == "shorts") {
+			id = segments[1]
+		}
+		if youtubePattern.MatchString(id) {
+			return "youtube", id, nil
+		}
+	case "youtu.be":
+		if youtubePattern.MatchString(segments[0]) {
+			return "youtube", segments[0], nil
+		}
+	case "vimeo.com", "player.vimeo.com":
+		id := segments[len(segments)-1]
+		if vimeoPattern.MatchString(id) {
+			return "vimeo", id, nil
+		}
+	}
+
+	return "", "", errors.New("embed URL must be a YouTube or Vimeo video")
+}
+
+var oembedClient = &http.Client{Timeout: 5 * time.Second}
+
+// vimeoThumbnail looks the thumbnail up through Vimeo's oEmbed API. It's
+// best effort; the gallery still works without one.
+func vimeoThumbnail(id string) string {
+	resp, err := oembedClient.Get("https://vimeo.com/api/oembed.json?url=" + url.QueryEscape("https://vimeo.com/"+id))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil {
+		return ""
+	}
+	return body.ThumbnailURL
+}
+
+func getProductMedia(c *gin.Context) {
+	var product Product
+	err := productService.db.Collection("products").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"media": product.gallery()})
+}
+
+func addProductMedia(c *gin.Context) {
+	var req MediaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	item, err := newMediaItem(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Primary && item.Type != MediaImage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only images can be primary"})
+		return
+	}
+
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	item = insertMedia(product, item, req.Position, req.Primary)
+	if err := saveGallery(c, product.Media); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add media"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+// insertMedia adds the item to the product's gallery, at the end unless a
+// position is given, and returns it as placed.
+func insertMedia(product *Product, item MediaItem, position *int, primary bool) MediaItem {
+	// The legacy image becomes the first gallery entry
+	gallery := product.Media.sorted()
+	if len(gallery) == 0 && product.ImageURL != "" {
+		gallery = Gallery{{ID: primitive.NewObjectID().Hex(), Type: MediaImage, URL: product.ImageURL}}
+	}
+
+	item.Position = len(gallery)
+	if position != nil && *position >= 0 && *position < len(gallery) {
+		item.Position = *position
+		for i := range gallery {
+			if gallery[i].Position >= item.Position {
+				gallery[i].Position++
+			}
+		}
+	}
+	gallery = append(gallery, item).sorted()
+	if primary {
+		gallery.makePrimary(item.ID)
+		item.Primary = true
+	}
+
+	product.Media = gallery
+	return item
+}
+
+// reorderProductMedia takes the full list of media IDs in their new order.
+func reorderProductMedia(c *gin.Context) {
+	var req struct {
+		IDs []string `json:"ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var product Product
+	err := productService.db.Collection("products").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	byID := map[string]MediaItem{}
+	for _, item := range product.Media {
+		byID[item.ID] = item
+	}
+	if len(req.IDs) != len(byID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids must list every media item exactly once"})
+		return
+	}
+
+	gallery := make(Gallery, 0, len(req.IDs))
+	for position, id := range req.IDs {
+		item, ok := byID[id]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids must list every media item exactly once"})
+			return
+		}
+		delete(byID, id)
+		item.Position = position
+		gallery = append(gallery, item)
+	}
+
+	if err := saveGallery(c, gallery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder media"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"media": gallery})
+}
+
+// updateProductMedia edits an item's alt text and thumbnail, and designates
+// an image as the product's primary one.
+func updateProductMedia(c *gin.Context) {
+	var req struct {
+		Alt          *string `json:"alt" binding:"omitempty,max=500"`
+		ThumbnailURL *string `json:"thumbnail_url"`
+		Primary      *bool   `json:"primary"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ThumbnailURL != nil && *req.ThumbnailURL != "" && !validURL(*req.ThumbnailURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "thumbnail_url must be an http or https URL"})
+		return
+	}
+
+	var product Product
+	err := productService.db.Collection("products").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	gallery := product.Media.sorted()
+	index := -1
+	for i := range gallery {
+		if gallery[i].ID == c.Param("mediaId") {
+			index = i
+		}
+	}
+	if index < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+	item := &gallery[index]
+	if req.Alt != nil {
+		item.Alt = *req.Alt
+	}
+	if req.ThumbnailURL != nil {
+		item.ThumbnailURL = *req.ThumbnailURL
+	}
+	if req.Primary != nil {
+		switch {
+		case *req.Primary && item.Type != MediaImage:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only images can be primary"})
+			return
+		case *req.Primary:
+			gallery.makePrimary(item.ID)
+		default:
+			item.Primary = false
+		}
+	}
+
+	if err := saveGallery(c, gallery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update media"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gallery[index])
+}
+
+func deleteProductMedia(c *gin.Context) {
+	var product Product
+	err := productService.db.Collection("products").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&product)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	gallery := Gallery{}
+	var removed MediaItem
+	for _, item := range product.Media.sorted() {
+		if item.ID == c.Param("mediaId") {
+			removed = item
+			continue
+		}
+		item.Position = len(gallery)
+		gallery = append(gallery, item)
+	}
+	if len(gallery) == len(product.Media) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+
+	if err := saveGallery(c, gallery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete media"})
+		return
+	}
+	productService.db.Collection("products").UpdateOne(context.Background(),
+		bson.M{"_id": c.Param("id"), "variants.0": bson.M{"$exists": true}},
+		bson.M{"$pull": bson.M{"variants.$[].media_ids": c.Param("mediaId")}})
+	invalidateProduct(c.Request.Context(), c.Param("id"))
+	deleteImageFiles(product.ID, removed)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Media deleted successfully"})
+}
+
+// saveGallery stores the gallery and keeps image_url pointing at the
+// primary image for clients that predate galleries.
+func saveGallery(c *gin.Context, gallery Gallery) error {
+	productID := c.Param("id")
+	set := bson.M{"media": gallery, "updated_at": time.Now()}
+	if image, ok := gallery.primaryImage(); ok {
+		set["image_url"] = image.URL
+	}
+
+	err := updateAudited(c, AuditMediaChanged, productID, bson.M{"$set": set})
+	if err == nil {
+		invalidateProduct(context.Background(), productID)
+		publishProductUpdated(context.Background(), productID)
+	}
+	return err
+}
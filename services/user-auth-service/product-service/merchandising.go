@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchRule merchandises the results of one query: pinned products are
+// shown first in the given order, buried ones last, and category boosts
+// scale the relevance of products in those categories.
+type SearchRule struct {
+	Query          string             `bson:"_id" json:"query"`
+	Pinned         []string           `bson:"pinned" json:"pinned"`
+	Buried         []string           `bson:"buried" json:"buried"`
+	CategoryBoosts map[string]float64 `bson:"category_boosts" json:"category_boosts"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// SearchLexicon holds the synonym groups, stopwords and store-wide
+// category boosts applied to every query.
+type SearchLexicon struct {
+	Synonyms       [][]string         `bson:"synonyms" json:"synonyms"`
+	Stopwords      []string           `bson:"stopwords" json:"stopwords"`
+	CategoryBoosts map[string]float64 `bson:"category_boosts" json:"category_boosts"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+const lexiconID = "lexicon"
+
+// searchTuning caches rules and the lexicon in memory. Writes reload it
+// locally and other instances pick changes up on the next refresh, so
+// nothing needs reindexing.
+type searchTuning struct {
+	mu        sync.RWMutex
+	rules     map[string]SearchRule
+	synonyms  map[string][]string
+	stopwords map[string]bool
+	lexicon   SearchLexicon
+}
+
+var tuning = &searchTuning{}
+
+const tuningRefreshInterval = 30 * time.Second
+
+func startSearchTuning() {
+	if err := tuning.reload(context.Background()); err != nil {
+		log.Printf("Failed to load search rules: %v", err)
+	}
+	go func() {
+		for range time.Tick(tuningRefreshInterval) {
+			if err := tuning.reload(context.Background()); err != nil {
+				log.Printf("Failed to refresh search rules: %v", err)
+			}
+		}
+	}()
+}
+
+func (t *searchTuning) reload(ctx context.Context) error {
+	cursor, err := productService.db.Collection("search_rules").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var list []SearchRule
+	if err := cursor.All(ctx, &list); err != nil {
+		return err
+	}
+
+	var lexicon SearchLexicon
+	productService.db.Collection("search_settings").FindOne(ctx, bson.M{"_id": lexiconID}).Decode(&lexicon)
+
+	rules := map[string]SearchRule{}
+	for _, rule := range list {
+		rules[rule.Query] = rule
+	}
+
+	// Synonyms are symmetric within a group
+	synonyms := map[string][]string{}
+	for _, group := range lexicon.Synonyms {
+		for _, term := range group {
+			synonyms[term] = group
+		}
+	}
+
+	stopwords := map[string]bool{}
+	for _, word := range lexicon.Stopwords {
+		stopwords[word] = true
+	}
+
+	t.mu.Lock()
+	t.rules, t.synonyms, t.stopwords, t.lexicon = rules, synonyms, stopwords, lexicon
+	t.mu.Unlock()
+	return nil
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// normalizeQuery lowercases and collapses whitespace so rules match however
+// the query was typed.
+func normalizeQuery(q string) string {
+	return whitespace.ReplaceAllString(strings.ToLower(strings.TrimSpace(q)), " ")
+}
+
+// terms splits a query into its non-stopword terms, each expanded with its
+// synonyms.
+func (t *searchTuning) terms(query string) [][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var terms [][]string
+	for _, word := range strings.Fields(query) {
+		if t.stopwords[word] {
+			continue
+		}
+		if group, ok := t.synonyms[word]; ok {
+			terms = append(terms, group)
+		} else {
+			terms = append(terms, []string{word})
+		}
+	}
+	return terms
+}
+
+func (t *searchTuning) rule(query string) (SearchRule, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rule, ok := t.rules[query]
+	return rule, ok
+}
+
+func (t *searchTuning) categoryBoost(rule SearchRule, category string) float64 {
+	if boost, ok := rule.CategoryBoosts[category]; ok {
+		return boost
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if boost, ok := t.lexicon.CategoryBoosts[category]; ok {
+		return boost
+	}
+	return 1
+}
+
+// merchandise orders search hits: pinned products first in rule order,
+// then by text score scaled by category boosts, with buried products last.
+func merchandise(ctx context.Context, query string, hits []searchHit) []searchHit {
+	rule, _ := tuning.rule(query)
+
+	buried := map[string]bool{}
+	for _, id := range rule.Buried {
+		buried[id] = true
+	}
+	pinnedAt := map[string]int{}
+	for i, id := range rule.Pinned {
+		pinnedAt[id] = i
+	}
+
+	// Pinned products are shown even when they don't match the query
+	found := map[string]bool{}
+	for _, h := range hits {
+		found[h.ID] = true
+	}
+	var missing []string
+	for _, id := range rule.Pinned {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		opts := options.Find().SetProjection(bson.M{"category": 1})
+		cursor, err := productService.db.Collection("products").Find(ctx, publishedFilter(bson.M{"_id": bson.M{"$in": missing}}), opts)
+		if err == nil {
+			var extra []searchHit
+			if cursor.All(ctx, &extra) == nil {
+				hits = append(hits, extra...)
+			}
+		}
+	}
+
+	scores := make(map[string]float64, len(hits))
+	for _, h := range hits {
+		scores[h.ID] = h.Score * tuning.categoryBoost(rule, h.Category)
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		pa, aPinned := pinnedAt[a.ID]
+		pb, bPinned := pinnedAt[b.ID]
+		if aPinned || bPinned {
+			return aPinned && (!bPinned || pa < pb)
+		}
+		if buried[a.ID] != buried[b.ID] {
+			return !buried[a.ID]
+		}
+		return scores[a.ID] > scores[b.ID]
+	})
+	return hits
+}
+
+func listSearchRules(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := productService.db.Collection("search_rules").Find(context.Background(), bson.M{}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch search rules"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	rules := []SearchRule{}
+	if err := cursor.All(context.Background(), &rules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode search rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+func putSearchRule(c *gin.Context) {
+	var rule SearchRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule.Query = normalizeQuery(c.Param("query"))
+	if rule.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	for category, boost := range rule.CategoryBoosts {
+		if boost <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Boost for " + category + " must be positive"})
+			return
+		}
+	}
+	rule.UpdatedAt = time.Now()
+
+	_, err := productService.db.Collection("search_rules").ReplaceOne(context.Background(),
+		bson.M{"_id": rule.Query}, rule, options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save search rule"})
+		return
+	}
+	tuning.reload(context.Background())
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func deleteSearchRule(c *gin.Context) {
+	result, err := productService.db.Collection("search_rules").DeleteOne(context.Background(),
+		bson.M{"_id": normalizeQuery(c.Param("query"))})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search rule not found"})
+		return
+	}
+	tuning.reload(context.Background())
+
+	c.JSON(http.StatusOK, gin.H{"message": "Search rule deleted successfully"})
+}
+
+func getSearchLexicon(c *gin.Context) {
+	tuning.mu.RLock()
+	lexicon := tuning.lexicon
+	tuning.mu.RUnlock()
+
+	c.JSON(http.StatusOK, lexicon)
+}
+
+// putSearchLexicon replaces whichever of synonyms, stopwords and
+// category_boosts the request includes.
+func putSearchLexicon(c *gin.Context) {
+	var req struct {
+		Synonyms       *[][]string         `json:"synonyms"`
+		Stopwords      *[]string           `json:"stopwords"`
+		CategoryBoosts *map[string]float64 `json:"category_boosts"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if req.Synonyms != nil {
+		groups := [][]string{}
+		for _, group := range *req.Synonyms {
+			var normalized []string
+			for _, term := range group {
+				if term = normalizeQuery(term); term != "" {
+					normalized = append(normalized, term)
+				}
+			}
+			if len(normalized) > 1 {
+				groups = append(groups, normalized)
+			}
+		}
+		set["synonyms"] = groups
+	}
+	if req.Stopwords != nil {
+		words := []string{}
+		for _, word := range *req.Stopwords {
+			if word = normalizeQuery(word); word != "" {
+				words = append(words, word)
+			}
+		}
+		set["stopwords"] = words
+	}
+	if req.CategoryBoosts != nil {
+		for category, boost := range *req.CategoryBoosts {
+			if boost <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Boost for " + category + " must be positive"})
+				return
+			}
+		}
+		set["category_boosts"] = *req.CategoryBoosts
+	}
+
+	_, err := productService.db.Collection("search_settings").UpdateOne(context.Background(),
+		bson.M{"_id": lexiconID}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save search settings"})
+		return
+	}
+	tuning.reload(context.Background())
+
+	getSearchLexicon(c)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// csvExportColumns are written in this order, followed by an attr:<name>
+// column per attribute in the catalog. Products with a SKU import back
+// unchanged; rows without one are rejected on import, since the importer
+// matches products by SKU.
+var csvExportColumns = []string{
+	"id", "sku", "name", "description", "price", "category", "category_id", "brand", "brand_id", "gtin", "status", "stock",
+	"image_url", "tags", "drop", "digital", "backorder", "low_stock_threshold", "hs_code", "country_of_origin", "customs_value",
+	"weight_kg",
+}
+
+// csvFormulaPrefixes start cells spreadsheets evaluate as formulas.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// escapeCSVCell keeps a cell from being run as a formula when the export is
+// opened in a spreadsheet, by prefixing a quote. unescapeCSVCell undoes it
+// on import.
+func escapeCSVCell(value string) string {
+	if value != "" && strings.ContainsRune(csvFormulaPrefixes, rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func unescapeCSVCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(value[1])) {
+		return value[1:]
+	}
+	return value
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func csvExportRecord(p *Product, attributes []string) []string {
+	customs := Customs{}
+	if p.Customs != nil {
+		customs = *p.Customs
+	}
+	record := []string{
+		p.ID, p.SKU, p.Name, p.Description, formatFloat(p.Price), p.Category, p.CategoryID, p.Brand, p.BrandID, p.GTIN, p.Status,
+		strconv.Itoa(p.Stock), p.ImageURL, strings.Join(p.Tags, "|"), strconv.FormatBool(p.Drop),
+		strconv.FormatBool(p.Digital), strconv.FormatBool(p.Backorder), "", customs.HSCode, customs.CountryOfOrigin, "", "",
+	}
+	if p.LowStockThreshold != nil {
+		record[17] = strconv.Itoa(*p.LowStockThreshold)
+	}
+	if p.Customs != nil {
+		record[20], record[21] = formatFloat(customs.Value), formatFloat(customs.WeightKg)
+	}
+	for _, name := range attributes {
+		record = append(record, p.Attributes[name])
+	}
+	for i := range record {
+		record[i] = escapeCSVCell(record[i])
+	}
+	return record
+}
+
+// catalogAttributes lists every attribute name used in the catalog.
+func catalogAttributes(c *gin.Context, filter bson.M) ([]string, error) {
+	cursor, err := productService.db.Collection("products").Aggregate(c.Request.Context(), mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.M{"attributes": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$attributes", bson.M{}}}}}}},
+		{{Key: "$unwind", Value: "$attributes"}},
+		{{Key: "$group", Value: bson.M{"_id": "$attributes.k"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []struct {
+		Name string `bson:"_id"`
+	}
+	if err := cursor.All(c.Request.Context(), &names); err != nil {
+		return nil, err
+	}
+	attributes := make([]string, 0, len(names))
+	for _, n := range names {
+		attributes = append(attributes, n.Name)
+	}
+	sort.Strings(attributes)
+	return attributes, nil
+}
+
+// exportProducts streams the catalog, drafts included, as CSV or JSON Lines
+// (?format=, csv by default) in the format importProducts reads. ?status=
+// and ?category= narrow it down.
+func exportProducts(c *gin.Context) {
+	format := c.DefaultQuery("format", importFormatCSV)
+	if format != importFormatCSV && format != importFormatJSONL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or jsonl"})
+		return
+	}
+
+	filter := bson.M{}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+		if status == StatusPublished {
+			filter = publishedFilter(bson.M{})
+		}
+	}
+	if !categoryFilter(c, filter) {
+		return
+	}
+
+	var attributes []string
+	if format == importFormatCSV {
+		var err error
+		if attributes, err = catalogAttributes(c, filter); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export products"})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"quality": 0})
+	cursor, err := productService.db.Collection("products").Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export products"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	filename := "products-" + time.Now().Format("20060102") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	if format == importFormatCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+
+	// Headers are sent by now, so a failure can only cut the file short
+	if format == importFormatCSV {
+		w := csv.NewWriter(c.Writer)
+		header := append([]string{}, csvExportColumns...)
+		for _, name := range attributes {
+			header = append(header, attributeColumnPrefix+name)
+		}
+		w.Write(header)
+		for cursor.Next(ctx) {
+			var product Product
+			if err := cursor.Decode(&product); err != nil {
+				continue
+			}
+			w.Write(csvExportRecord(&product, attributes))
+		}
+		w.Flush()
+		return
+	}
+
+	encoder := json.NewEncoder(c.Writer)
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			continue
+		}
+		encoder.Encode(product)
+	}
+}
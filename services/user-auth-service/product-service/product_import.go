@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Bulk catalog import. A file is CSV with a header row, or JSON Lines with
+// one product per line, and rows are matched to the catalog by SKU: a new
+// SKU creates a product, a known one updates only the fields the row
+// carries. Blank CSV cells leave the field as it is. Media and variants have
+// their own endpoints and ratings come from reviews, so none are imported.
+//
+// The file is parsed up front so a malformed one is rejected straight away;
+// rows are then validated and written by a background job whose progress
+// is kept in product_imports.
+
+// ImportJob tracks one uploaded file. Errors holds the first
+// maxImportErrors rejected rows, by line number.
+type ImportJob struct {
+	ID         string        `bson:"_id" json:"id"`
+	Filename   string        `bson:"filename" json:"filename"`
+	Format     string        `bson:"format" json:"format"`
+	DryRun     bool          `bson:"dry_run" json:"dry_run"`
+	Status     string        `bson:"status" json:"status"`
+	Total      int           `bson:"total" json:"total"`
+	Processed  int           `bson:"processed" json:"processed"`
+	Created    int           `bson:"created" json:"created"`
+	Updated    int           `bson:"updated" json:"updated"`
+	Failed     int           `bson:"failed" json:"failed"`
+	Errors     []ImportError `bson:"errors" json:"errors"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedBy  string        `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time     `bson:"updated_at" json:"updated_at"`
+	FinishedAt *time.Time    `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+type ImportError struct {
+	Line  int    `bson:"line" json:"line"`
+	SKU   string `bson:"sku,omitempty" json:"sku,omitempty"`
+	Error string `bson:"error" json:"error"`
+}
+
+const (
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+	// A running job that stopped reporting progress, because the replica
+	// running it went away
+	ImportInterrupted = "interrupted"
+)
+
+const (
+	importFormatCSV   = "csv"
+	importFormatJSONL = "jsonl"
+	importBatchSize   = 200
+	maxImportErrors   = 100
+	importStaleAfter  = 5 * time.Minute
+)
+
+func maxImportBytes() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("MAX_IMPORT_BYTES"), 10, 64); err == nil {
+		return v
+	}
+	return 50 << 20
+}
+
+func setupImports() {
+	_, err := productService.db.Collection("products").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "sku", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"sku": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
+
+// importRow is one product read from the file, with the fields it sets.
+// categoryRef is a category name, slug or ID to resolve.
+type importRow struct {
+	line        int
+	product     Product
+	fields      map[string]bool
+	categoryRef string
+	err         string
+}
+
+// importFields copies each importable field, by its JSON name, from a
+// parsed row onto the product being written.
+var importFields = map[string]func(dst, src *Product){
+	"name":        func(dst, src *Product) { dst.Name = src.Name },
+	"description": func(dst, src *Product) { dst.Description = src.Description },
+	"price":       func(dst, src *Product) { dst.Price = src.Price },
+	"category_id": func(dst, src *Product) { dst.CategoryID = src.CategoryID },
+	"brand_id":    func(dst, src *Product) { dst.BrandID = src.BrandID },
+	"gtin":        func(dst, src *Product) { dst.GTIN = src.GTIN },
+	"attributes":  func(dst, src *Product) { dst.Attributes = normalizeAttributes(src.Attributes) },
+	"status":      func(dst, src *Product) { dst.Status = src.Status },
+	"image_url":   func(dst, src *Product) { dst.ImageURL = src.ImageURL },
+	"tags":        func(dst, src *Product) { dst.Tags = normalizeTags(src.Tags) },
+	"customs":     func(dst, src *Product) { dst.Customs = src.Customs },
+	"drop":        func(dst, src *Product) { dst.Drop = src.Drop },
+	"digital":     func(dst, src *Product) { dst.Digital = src.Digital },
+	// CSV spreads customs over columns
+	"hs_code":           func(dst, src *Product) { customsOf(dst).HSCode = src.Customs.HSCode },
+	"country_of_origin": func(dst, src *Product) { customsOf(dst).CountryOfOrigin = src.Customs.CountryOfOrigin },
+	"customs_value":     func(dst, src *Product) { customsOf(dst).Value = src.Customs.Value },
+	"weight_kg":         func(dst, src *Product) { customsOf(dst).WeightKg = src.Customs.WeightKg },
+	// See availability.go
+	"backorder":           func(dst, src *Product) { dst.Backorder = src.Backorder },
+	"low_stock_threshold": func(dst, src *Product) { dst.LowStockThreshold = src.LowStockThreshold },
+}
+
+func customsOf(p *Product) *Customs {
+	if p.Customs == nil {
+		p.Customs = &Customs{}
+	}
+	return p.Customs
+}
+
+// csvColumns parses a non-blank cell into the row's product. Attribute
+// columns are named attr:<attribute>.
+var csvColumns = map[string]func(p *Product, value string) error{
+	"sku":               func(p *Product, v string) error { p.SKU = v; return nil },
+	"name":              func(p *Product, v string) error { p.Name = v; return nil },
+	"description":       func(p *Product, v string) error { p.Description = v; return nil },
+	"price":             func(p *Product, v string) (err error) { p.Price, err = strconv.ParseFloat(v, 64); return },
+	"category_id":       func(p *Product, v string) error { p.CategoryID = v; return nil },
+	"brand_id":          func(p *Product, v string) error { p.BrandID = v; return nil },
+	"gtin":              func(p *Product, v string) error { p.GTIN = v; return nil },
+	"status":            func(p *Product, v string) error { p.Status = v; return nil },
+	"image_url":         func(p *Product, v string) error { p.ImageURL = v; return nil },
+	"tags":              func(p *Product, v string) error { p.Tags = splitTags(v); return nil },
+	"drop":              func(p *Product, v string) (err error) { p.Drop, err = strconv.ParseBool(v); return },
+	"digital":           func(p *Product, v string) (err error) { p.Digital, err = strconv.ParseBool(v); return },
+	"hs_code":           func(p *Product, v string) error { customsOf(p).HSCode = v; return nil },
+	"country_of_origin": func(p *Product, v string) error { customsOf(p).CountryOfOrigin = v; return nil },
+	"customs_value":     func(p *Product, v string) (err error) { customsOf(p).Value, err = strconv.ParseFloat(v, 64); return },
+	"weight_kg":         func(p *Product, v string) (err error) { customsOf(p).WeightKg, err = strconv.ParseFloat(v, 64); return },
+	// See availability.go
+	"backorder": func(p *Product, v string) (err error) { p.Backorder, err = strconv.ParseBool(v); return },
+	"low_stock_threshold": func(p *Product, v string) error {
+		n, err := strconv.Atoi(v)
+		p.LowStockThreshold = &n
+		return err
+	},
+}
+
+const attributeColumnPrefix = "attr:"
+
+// exportOnlyColumns are written by exports for reference and skipped on
+// import; stock comes from the inventory service.
+var exportOnlyColumns = map[string]bool{"id": true, "stock": true, "brand": true}
+
+// Tags are separated by | in CSV.
+func splitTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, "|") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func parseCSVImport(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	hasSKU := false
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		header[i] = column
+		_, known := csvColumns[column]
+		if !known && !exportOnlyColumns[column] && column != "category" && !strings.HasPrefix(column, attributeColumnPrefix) {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+		hasSKU = hasSKU || column == "sku"
+	}
+	if !hasSKU {
+		return nil, errors.New("the sku column is required")
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) || parseErr.Err != csv.ErrFieldCount {
+				return nil, err
+			}
+			rows = append(rows, importRow{line: parseErr.StartLine, err: "wrong number of columns"})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := importRow{line: line, fields: map[string]bool{}}
+		for i, column := range header {
+			value := unescapeCSVCell(strings.TrimSpace(record[i]))
+			switch {
+			case value == "" || exportOnlyColumns[column]:
+				continue
+			case column == "category":
+				row.categoryRef = value
+			case strings.HasPrefix(column, attributeColumnPrefix):
+				if row.product.Attributes == nil {
+					row.product.Attributes = map[string]string{}
+				}
+				row.product.Attributes[strings.TrimPrefix(column, attributeColumnPrefix)] = value
+				row.fields[column] = true
+			default:
+				if err := csvColumns[column](&row.product, value); err != nil && row.err == "" {
+					row.err = "invalid " + column + " " + strconv.Quote(value)
+				}
+				if column != "sku" {
+					row.fields[column] = true
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseJSONLImport(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+
+	var rows []importRow
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		row := importRow{line: line, fields: map[string]bool{}}
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(data, &keys); err != nil {
+			row.err = "invalid JSON"
+			rows = append(rows, row)
+			continue
+		}
+		if err := json.Unmarshal(data, &row.product); err != nil {
+			row.err = err.Error()
+			rows = append(rows, row)
+			continue
+		}
+		for key := range keys {
+			if _, ok := importFields[key]; ok && key != "hs_code" && key != "country_of_origin" && key != "customs_value" && key != "weight_kg" {
+				row.fields[key] = true
+			}
+		}
+		// Exports carry both; the ID wins
+		if _, ok := keys["category"]; ok && !row.fields["category_id"] {
+			row.categoryRef = row.product.Category
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// apply copies the row's fields onto the product, which is either the
+// stored product with that SKU or a new one.
+func (row *importRow) apply(p *Product) {
+	for field := range row.fields {
+		if name, ok := strings.CutPrefix(field, attributeColumnPrefix); ok {
+			if p.Attributes == nil {
+				p.Attributes = map[string]string{}
+			}
+			p.Attributes[strings.ToLower(name)] = row.product.Attributes[name]
+			continue
+		}
+		importFields[field](p, &row.product)
+	}
+	p.SKU = row.product.SKU
+}
+
+// importTransitionError holds imports to the same workflow as the API: new
+// products start as draft or published, existing ones move only along
+// allowed transitions.
+func importTransitionError(p *Product, found bool, stored string) string {
+	if !found {
+		if p.Status == StatusArchived {
+			return "new products must be draft or published"
+		}
+		return ""
+	}
+	return transitionError(stored, p.Status)
+}
+
+// validateImported checks the product as it will be saved over before, nil
+// for new products, and scores it, returning why it can't be saved.
+func validateImported(p *Product, before *Product) string {
+	if problems := productProblems(p); len(problems) > 0 {
+		return fieldProblems(problems)
+	}
+
+	score := scoreProduct(p)
+	p.Quality = &score
+	if p.publishing(before) && score.Score < publishThreshold() {
+		return fmt.Sprintf("too incomplete to publish (score %d, needs %d), missing %s",
+			score.Score, publishThreshold(), strings.Join(score.Missing, ", "))
+	}
+	return ""
+}
+
+// importer runs one job, caching category and brand lookups across its
+// rows.
+type importer struct {
+	job        *ImportJob
+	categories map[string]*Category
+	brands     map[string]*Brand
+	schemas    map[string][]AttributeDef
+}
+
+func (im *importer) resolveCategory(ctx context.Context, row *importRow, p *Product) string {
+	ref, byID := row.categoryRef, false
+	if row.fields["category_id"] {
+		ref, byID = p.CategoryID, true
+	}
+	if ref == "" {
+		if byID {
+			p.Category = ""
+		}
+		return ""
+	}
+
+	category, ok := im.categories[ref]
+	if !ok {
+		var err error
+		if category, err = findCategory(ctx, ref); err != nil && !byID {
+			category, err = findCategory(ctx, slugify(ref))
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			return "failed to look up category"
+		}
+		im.categories[ref] = category
+	}
+	if category == nil {
+		if byID {
+			return "unknown category_id " + strconv.Quote(ref)
+		}
+		return "unknown category " + strconv.Quote(ref)
+	}
+	p.CategoryID, p.Category = category.ID, category.Name
+	return ""
+}
+
+// resolveBrand links the product to its brand_id's brand.
+func (im *importer) resolveBrand(ctx context.Context, p *Product) string {
+	if p.BrandID == "" {
+		p.Brand = ""
+		return ""
+	}
+	brand, ok := im.brands[p.BrandID]
+	if !ok {
+		var found Brand
+		err := productService.db.Collection("brands").FindOne(ctx, bson.M{"_id": p.BrandID}).Decode(&found)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return "failed to look up brand"
+		}
+		if err == nil {
+			brand = &found
+		}
+		im.brands[p.BrandID] = brand
+	}
+	if brand == nil {
+		return "unknown brand_id " + strconv.Quote(p.BrandID)
+	}
+	p.Brand = brand.Name
+	return ""
+}
+
+// checkAttributes validates the product against its category's schema,
+// caching schemas across rows.
+func (im *importer) checkAttributes(ctx context.Context, p *Product) string {
+	schema, ok := im.schemas[p.CategoryID]
+	if !ok {
+		var err error
+		if schema, err = productSchema(ctx, p.CategoryID); err != nil {
+			return "failed to look up attribute schema"
+		}
+		im.schemas[p.CategoryID] = schema
+	}
+	return schemaProblems(applySchema(p, schema))
+}
+
+func (im *importer) reject(row *importRow, message string) {
+	im.job.Failed++
+	if len(im.job.Errors) < maxImportErrors {
+		im.job.Errors = append(im.job.Errors, ImportError{Line: row.line, SKU: row.product.SKU, Error: message})
+	}
+}
+
+func (im *importer) run(ctx context.Context, rows []importRow) {
+	// Later rows for a SKU already in the file are rejected
+	firstLine := map[string]int{}
+	for start := 0; start < len(rows); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[start:end]
+		if err := im.runBatch(ctx, batch, firstLine); err != nil {
+			im.finish(ctx, ImportFailed, err.Error())
+			return
+		}
+		im.job.Processed = end
+		im.save(ctx)
+	}
+	if !im.job.DryRun {
+		assignMissingSlugs(ctx)
+	}
+	im.finish(ctx, ImportCompleted, "")
+}
+
+func (im *importer) runBatch(ctx context.Context, batch []importRow, firstLine map[string]int) error {
+	skus := []string{}
+	for i := range batch {
+		if sku := batch[i].product.SKU; sku != "" {
+			skus = append(skus, sku)
+		}
+	}
+	existing := map[string]Product{}
+	cursor, err := productService.db.Collection("products").Find(ctx, bson.M{"sku": bson.M{"$in": skus}})
+	if err != nil {
+		return err
+	}
+	var stored []Product
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+	for _, p := range stored {
+		existing[p.SKU] = p
+	}
+
+	var models []mongo.WriteModel
+	var written []*importRow
+	var saved []Product
+	for i := range batch {
+		row := &batch[i]
+		if row.err == "" && row.product.SKU == "" {
+			row.err = "sku is required"
+		}
+		if line, seen := firstLine[row.product.SKU]; seen && row.err == "" {
+			row.err = fmt.Sprintf("sku already imported on line %d", line)
+		}
+		if row.err != "" {
+			im.reject(row, row.err)
+			continue
+		}
+		firstLine[row.product.SKU] = row.line
+
+		product, found := existing[row.product.SKU]
+		row.apply(&product)
+		if msg := importTransitionError(&product, found, existing[row.product.SKU].Status); msg != "" {
+			im.reject(row, msg)
+			continue
+		}
+		if msg := im.resolveCategory(ctx, row, &product); msg != "" {
+			im.reject(row, msg)
+			continue
+		}
+		if msg := im.resolveBrand(ctx, &product); msg != "" {
+			im.reject(row, msg)
+			continue
+		}
+		if msg := im.checkAttributes(ctx, &product); msg != "" {
+			im.reject(row, msg)
+			continue
+		}
+		var before *Product
+		if found {
+			stored := existing[row.product.SKU]
+			before = &stored
+		}
+		if msg := validateImported(&product, before); msg != "" {
+			im.reject(row, msg)
+			continue
+		}
+
+		if im.job.DryRun {
+			if found {
+				im.job.Updated++
+			} else {
+				im.job.Created++
+			}
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"sku": product.SKU}).
+			SetUpdate(importUpdate(&product)).
+			SetUpsert(true))
+		written = append(written, row)
+		saved = append(saved, product)
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	result, err := productService.db.Collection("products").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if err != nil && !errors.As(err, &bulkErr) {
+		return err
+	}
+	failed := map[int]bool{}
+	for _, writeErr := range bulkErr.WriteErrors {
+		im.reject(written[writeErr.Index], "failed to save: "+writeErr.Message)
+		failed[writeErr.Index] = true
+	}
+	if result != nil {
+		im.job.Created += int(result.UpsertedCount)
+		im.job.Updated += int(result.MatchedCount)
+	}
+	invalidateCatalog(ctx)
+
+	var revisions []interface{}
+	for i := range saved {
+		if failed[i] {
+			continue
+		}
+		p := &saved[i]
+		if result != nil {
+			if id, ok := result.UpsertedIDs[int64(i)].(string); ok {
+				p.ID = id
+				publishProductSaved(ctx, p, true, 0)
+				revisions = append(revisions, im.revision(p, nil))
+				continue
+			}
+		}
+		publishProductSaved(ctx, p, false, existing[p.SKU].Price)
+		before := existing[p.SKU]
+		if rev := im.revision(p, &before); len(rev.Changes) > 0 {
+			revisions = append(revisions, rev)
+		}
+	}
+	if len(revisions) > 0 {
+		if _, err := productService.db.Collection("product_audit").InsertMany(ctx, revisions); err != nil {
+			log.Printf("Failed to record import %s in product audit: %v", im.job.ID, err)
+		}
+	}
+	return nil
+}
+
+// revision records an imported row against whoever started the import.
+func (im *importer) revision(p, before *Product) ProductRevision {
+	rev := newRevision(p.ID, AuditImported, before, p)
+	rev.ActorID = im.job.CreatedBy
+	rev.Data = bson.M{"import_id": im.job.ID}
+	return rev
+}
+
+// importUpdate writes every importable field of the merged product, and
+// starts new products with an ID and no ratings.
+func importUpdate(p *Product) bson.M {
+	now := time.Now()
+	return bson.M{
+		"$set": bson.M{
+			"sku":         p.SKU,
+			"name":        p.Name,
+			"description": p.Description,
+			"price":       p.Price,
+			"category":    p.Category,
+			"category_id": p.CategoryID,
+			"brand":       p.Brand,
+			"brand_id":    p.BrandID,
+			"gtin":        p.GTIN,
+			"attributes":  p.Attributes,
+			"status":      p.Status,
+			"image_url":   p.ImageURL,
+			"tags":        p.Tags,
+			"customs":     p.Customs,
+			"drop":        p.Drop,
+			"digital":     p.Digital,
+			"quality":     p.Quality,
+			"updated_at":  now,
+			// See availability.go
+			"backorder":           p.Backorder,
+			"low_stock_threshold": p.LowStockThreshold,
+		},
+		"$setOnInsert": bson.M{
+			"_id":        primitive.NewObjectID().Hex(),
+			"rating":     0,
+			"reviews":    0,
+			"stock":      0,
+			"created_at": now,
+		},
+	}
+}
+
+func (im *importer) save(ctx context.Context) {
+	im.job.UpdatedAt = time.Now()
+	if _, err := productService.db.Collection("product_imports").ReplaceOne(ctx, bson.M{"_id": im.job.ID}, im.job); err != nil {
+		log.Printf("Failed to save import job %s: %v", im.job.ID, err)
+	}
+}
+
+func (im *importer) finish(ctx context.Context, status, message string) {
+	now := time.Now()
+	im.job.Status = status
+	im.job.Error = message
+	im.job.FinishedAt = &now
+	im.save(ctx)
+	log.Printf("Import %s %s: %d created, %d updated, %d failed of %d",
+		im.job.ID, status, im.job.Created, im.job.Updated, im.job.Failed, im.job.Total)
+}
+
+// importFormat takes ?format= or the file extension.
+func importFormat(c *gin.Context, filename string) string {
+	format := strings.ToLower(c.PostForm("format"))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	if format == "ndjson" || format == "json" {
+		format = importFormatJSONL
+	}
+	return format
+}
+
+// importProducts accepts a multipart file and starts the job. With
+// dry_run=true the rows are only validated and counted.
+func importProducts(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if file.Size > maxImportBytes() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+		return
+	}
+	format := importFormat(c, file.Filename)
+	if format != importFormatCSV && format != importFormatJSONL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or jsonl"})
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer f.Close()
+	var rows []importRow
+	if format == importFormatCSV {
+		rows, err = parseCSVImport(f)
+	} else {
+		rows, err = parseJSONLImport(f)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + format + " file: " + err.Error()})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file has no products"})
+		return
+	}
+
+	now := time.Now()
+	job := &ImportJob{
+		ID:        primitive.NewObjectID().Hex(),
+		Filename:  file.Filename,
+		Format:    format,
+		DryRun:    c.PostForm("dry_run") == "true",
+		Status:    ImportRunning,
+		Total:     len(rows),
+		Errors:    []ImportError{},
+		CreatedBy: c.GetString("user_id"),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := productService.db.Collection("product_imports").InsertOne(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start import"})
+		return
+	}
+
+	im := &importer{job: job, categories: map[string]*Category{}, brands: map[string]*Brand{}, schemas: map[string][]AttributeDef{}}
+	go im.run(context.Background(), rows)
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// reportStale shows jobs that stopped reporting progress as interrupted.
+func (job *ImportJob) reportStale() {
+	if job.Status == ImportRunning && time.Since(job.UpdatedAt) > importStaleAfter {
+		job.Status = ImportInterrupted
+	}
+}
+
+func getImportJob(c *gin.Context) {
+	var job ImportJob
+	if err := productService.db.Collection("product_imports").FindOne(c.Request.Context(), bson.M{"_id": c.Param("jobId")}).Decode(&job); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+		return
+	}
+	job.reportStale()
+
+	c.JSON(http.StatusOK, job)
+}
+
+func listImportJobs(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(50).
+		SetProjection(bson.M{"errors": 0})
+	cursor, err := productService.db.Collection("product_imports").Find(c.Request.Context(), bson.M{}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch imports"})
+		return
+	}
+	jobs := []ImportJob{}
+	if err := cursor.All(c.Request.Context(), &jobs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode imports"})
+		return
+	}
+	for i := range jobs {
+		jobs[i].reportStale()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imports": jobs, "count": len(jobs)})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Publication states, see workflow.go for the transitions between them.
+// Products from before publication existed have no status and count as
+// published.
+const (
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+// QualityScore rates how complete a product's data is, out of 100.
+// Missing names the checks that didn't get full marks.
+type QualityScore struct {
+	Score    int       `bson:"score" json:"score"`
+	Missing  []string  `bson:"missing" json:"missing"`
+	ScoredAt time.Time `bson:"scored_at" json:"scored_at"`
+}
+
+// qualityCheck is one completeness criterion. credit returns the fraction
+// of weight earned, from 0 to 1.
+type qualityCheck struct {
+	name   string
+	weight int
+	credit func(p *Product) float64
+}
+
+// Targets for full marks, from PRODUCT_QUALITY_MIN_IMAGES (default 3),
+// PRODUCT_QUALITY_MIN_DESCRIPTION (characters, default 200) and
+// PRODUCT_QUALITY_MIN_ATTRIBUTES (default 3).
+var (
+	minImages      = envInt("PRODUCT_QUALITY_MIN_IMAGES", 3)
+	minDescription = envInt("PRODUCT_QUALITY_MIN_DESCRIPTION", 200)
+	minAttributes  = envInt("PRODUCT_QUALITY_MIN_ATTRIBUTES", 3)
+)
+
+var qualityChecks = []qualityCheck{
+	{"images", 25, func(p *Product) float64 {
+		images := 0
+		for _, item := range p.gallery() {
+			if item.Type == MediaImage {
+				images++
+			}
+		}
+		return fraction(images, minImages)
+	}},
+	{"description", 20, func(p *Product) float64 {
+		return fraction(len([]rune(strings.TrimSpace(p.Description))), minDescription)
+	}},
+	{"attributes", 20, func(p *Product) float64 {
+		filled := 0
+		for _, value := range p.Attributes {
+			if strings.TrimSpace(value) != "" {
+				filled++
+			}
+		}
+		return fraction(filled, minAttributes)
+	}},
+	{"category", 15, func(p *Product) float64 {
+		if p.CategoryID != "" {
+			return 1
+		}
+		return 0
+	}},
+	{"gtin", 20, func(p *Product) float64 {
+		if validGTIN(p.GTIN) {
+			return 1
+		}
+		return 0
+	}},
+}
+
+func envInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n >= 0 {
+		return n
+	}
+	return fallback
+}
+
+func fraction(have, want int) float64 {
+	if want <= 0 || have >= want {
+		return 1
+	}
+	return float64(have) / float64(want)
+}
+
+// validGTIN accepts GTIN-8, -12 (UPC), -13 (EAN) and -14 with a correct
+// check digit.
+func validGTIN(gtin string) bool {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	sum := 0
+	for i := len(gtin) - 2; i >= 0; i-- {
+		d := int(gtin[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		// Weights alternate 3, 1, 3... leftwards from the check digit
+		if (len(gtin)-2-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	check := int(gtin[len(gtin)-1] - '0')
+	return check >= 0 && check <= 9 && (10-sum%10)%10 == check
+}
+
+func scoreProduct(p *Product) QualityScore {
+	var total float64
+	score := QualityScore{Missing: []string{}, ScoredAt: time.Now()}
+	for _, check := range qualityChecks {
+		credit := check.credit(p)
+		total += credit * float64(check.weight)
+		if credit < 1 {
+			score.Missing = append(score.Missing, check.name)
+		}
+	}
+	score.Score = int(total + 0.5)
+	return score
+}
+
+// publishThreshold is the lowest score a product may be published with,
+// from PRODUCT_PUBLISH_MIN_SCORE (default 60).
+func publishThreshold() int {
+	return envInt("PRODUCT_PUBLISH_MIN_SCORE", 60)
+}
+
+func (p *Product) published() bool {
+	return productStatus(p) == StatusPublished
+}
+
+// publishing reports whether saving p over before explicitly moves it to
+// published. Products without a status count as published for the
+// storefront, but only an explicit transition is held to the threshold, so
+// legacy products and clients that don't send a status keep working.
+func (p *Product) publishing(before *Product) bool {
+	return p.Status == StatusPublished && (before == nil || productStatus(before) != StatusPublished)
+}
+
+// checkPublishable scores the product and writes a 422 if the save would
+// publish it but it scores below the threshold. before is the stored
+// product, nil for new ones.
+func checkPublishable(c *gin.Context, p *Product, before *Product) bool {
+	score := scoreProduct(p)
+	p.Quality = &score
+	if !p.publishing(before) || score.Score >= publishThreshold() {
+		return true
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":     "Product data is too incomplete to publish",
+		"code":      "quality_below_threshold",
+		"score":     score.Score,
+		"threshold": publishThreshold(),
+		"missing":   score.Missing,
+	})
+	return false
+}
+
+// publishedFilter hides drafts and archived products from storefront
+// queries.
+func publishedFilter(filter bson.M) bson.M {
+	filter["status"] = bson.M{"$nin": bson.A{StatusDraft, StatusArchived}}
+	return filter
+}
+
+func publishProduct(c *gin.Context) {
+	setProductStatus(c, StatusPublished)
+}
+
+func unpublishProduct(c *gin.Context) {
+	setProductStatus(c, StatusDraft)
+}
+
+func setProductStatus(c *gin.Context, status string) {
+	id := c.Param("id")
+	collection := productService.db.Collection("products")
+
+	var product Product
+	if err := collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&product); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if !checkTransition(c, &product, status) {
+		return
+	}
+	before := product
+	product.Status = status
+	if !checkPublishable(c, &product, &before) {
+		return
+	}
+
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":     status,
+		"quality":    product.Quality,
+		"updated_at": time.Now(),
+	}, "$unset": staleSchedule(status)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), id)
+	publishProductSaved(c.Request.Context(), &product, false, product.Price)
+	recordProductChange(c, AuditStatusChanged, id, &before, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Product " + status, "quality": product.Quality})
+}
+
+const qualityScoringInterval = time.Hour
+
+// startQualityScoring rescores every product periodically, so media and
+// other changes made outside product updates are reflected.
+func startQualityScoring() {
+	go func() {
+		for {
+			if n, err := rescoreProducts(context.Background()); err != nil {
+				log.Printf("Product quality scoring failed: %v", err)
+			} else {
+				log.Printf("Scored %d products", n)
+			}
+			time.Sleep(qualityScoringInterval)
+		}
+	}()
+}
+
+func rescoreProducts(ctx context.Context) (int, error) {
+	collection := productService.db.Collection("products")
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			continue
+		}
+		score := scoreProduct(&product)
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": product.ID}, bson.M{"$set": bson.M{"quality": score}}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, cursor.Err()
+}
+
+// getQualityReport lists products by completeness, worst first, with a
+// summary of which checks fail most. ?below= limits it to products under a
+// score and ?status= to draft, published or archived products.
+func getQualityReport(c *gin.Context) {
+	filter := bson.M{}
+	if below, err := strconv.Atoi(c.Query("below")); err == nil {
+		filter["quality.score"] = bson.M{"$lt": below}
+	}
+	switch c.Query("status") {
+	case StatusDraft, StatusArchived:
+		filter["status"] = c.Query("status")
+	case StatusPublished:
+		publishedFilter(filter)
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "quality.score", Value: 1}, {Key: "name", Value: 1}}).SetLimit(500)
+	cursor, err := productService.db.Collection("products").Find(context.Background(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	var products []Product
+	if err := cursor.All(context.Background(), &products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
+		return
+	}
+
+	threshold := publishThreshold()
+	missing := map[string]int{}
+	rows := make([]gin.H, 0, len(products))
+	total := 0
+	for i := range products {
+		p := &products[i]
+		if p.Quality == nil {
+			score := scoreProduct(p)
+			p.Quality = &score
+		}
+		for _, name := range p.Quality.Missing {
+			missing[name]++
+		}
+		total += p.Quality.Score
+		rows = append(rows, gin.H{
+			"id":          p.ID,
+			"name":        p.Name,
+			"status":      productStatus(p),
+			"score":       p.Quality.Score,
+			"missing":     p.Quality.Missing,
+			"publishable": p.Quality.Score >= threshold,
+			"scored_at":   p.Quality.ScoredAt,
+		})
+	}
+
+	average := 0
+	if len(rows) > 0 {
+		average = total / len(rows)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"threshold":     threshold,
+		"average_score": average,
+		"missing":       missing,
+		"products":      rows,
+		"count":         len(rows),
+	})
+}
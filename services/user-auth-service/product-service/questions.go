@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Question is a customer's question about a product. Customers and staff
+// answer it; questions and customer answers wait for moderation like
+// reviews, while staff answers are published straight away. Shoppers vote
+// questions and answers helpful or not, and the most helpful come first.
+type Question struct {
+	ID             string     `bson:"_id" json:"id"`
+	ProductID      string     `bson:"product_id" json:"product_id"`
+	UserID         string     `bson:"user_id" json:"user_id"`
+	Body           string     `bson:"body" json:"body"`
+	Status         string     `bson:"status" json:"status"`
+	ModerationNote string     `bson:"moderation_note,omitempty" json:"moderation_note,omitempty"`
+	ModeratedBy    string     `bson:"moderated_by,omitempty" json:"-"`
+	ModeratedAt    *time.Time `bson:"moderated_at,omitempty" json:"moderated_at,omitempty"`
+	// Approved answers
+	Answers int   `bson:"answers" json:"answers"`
+	Votes   Votes `bson:",inline" json:"votes"`
+	// Filled in on the public listing
+	ApprovedAnswers []Answer  `bson:"-" json:"approved_answers,omitempty"`
+	CreatedAt       time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// Answer is a reply to a question.
+type Answer struct {
+	ID         string `bson:"_id" json:"id"`
+	QuestionID string `bson:"question_id" json:"question_id"`
+	ProductID  string `bson:"product_id" json:"product_id"`
+	UserID     string `bson:"user_id" json:"user_id"`
+	Body       string `bson:"body" json:"body"`
+	// Written by staff on the store's behalf
+	Staff bool `bson:"staff" json:"staff"`
+	// The author had a paid order for the product when they answered
+	VerifiedPurchase bool       `bson:"verified_purchase" json:"verified_purchase"`
+	Status           string     `bson:"status" json:"status"`
+	ModerationNote   string     `bson:"moderation_note,omitempty" json:"moderation_note,omitempty"`
+	ModeratedBy      string     `bson:"moderated_by,omitempty" json:"-"`
+	ModeratedAt      *time.Time `bson:"moderated_at,omitempty" json:"moderated_at,omitempty"`
+	Votes            Votes      `bson:",inline" json:"votes"`
+	CreatedAt        time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// Votes counts helpfulness votes. Score, helpful minus unhelpful, orders
+// the listing.
+type Votes struct {
+	Helpful   int `bson:"helpful_votes" json:"helpful"`
+	Unhelpful int `bson:"unhelpful_votes" json:"unhelpful"`
+	Score     int `bson:"score" json:"score"`
+}
+
+type postRequest struct {
+	Body string `json:"body" binding:"required,min=10,max=2000"`
+}
+
+const maxAnswersShown = 3
+
+var helpfulFirst = bson.D{{Key: "score", Value: -1}, {Key: "created_at", Value: -1}}
+
+func setupQuestions() {
+	ctx := context.Background()
+	_, err := productService.db.Collection("questions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "status", Value: 1}, {Key: "score", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create question indexes: %v", err)
+	}
+	_, err = productService.db.Collection("answers").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "question_id", Value: 1}, {Key: "status", Value: 1}, {Key: "score", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create answer indexes: %v", err)
+	}
+	_, err = productService.db.Collection("qa_votes").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "target_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create vote indexes: %v", err)
+	}
+}
+
+// canPost is canReview for questions and answers.
+func canPost(c *gin.Context) bool {
+	if c.GetString("role") == "guest" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Sign in to ask or answer questions"})
+		return false
+	}
+	if c.GetString("impersonated_by") != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Questions can't be posted while impersonating a customer"})
+		return false
+	}
+	return true
+}
+
+// refreshAnswerCount recounts a question's approved answers.
+func refreshAnswerCount(ctx context.Context, questionID string) {
+	n, err := productService.db.Collection("answers").CountDocuments(ctx,
+		bson.M{"question_id": questionID, "status": ReviewApproved})
+	if err == nil {
+		_, err = productService.db.Collection("questions").UpdateOne(ctx,
+			bson.M{"_id": questionID}, bson.M{"$set": bson.M{"answers": n}})
+	}
+	if err != nil {
+		log.Printf("Failed to count answers of question %s: %v", questionID, err)
+	}
+}
+
+// listProductQuestions shows a product's approved questions, most helpful
+// first, each with its most helpful approved answers. ?answered=true keeps
+// only answered questions.
+func listProductQuestions(c *gin.Context) {
+	ctx := c.Request.Context()
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+
+	filter := bson.M{"product_id": c.Param("id"), "status": ReviewApproved}
+	if c.Query("answered") == "true" {
+		filter["answers"] = bson.M{"$gt": 0}
+	}
+
+	collection := productService.db.Collection("questions")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch questions"})
+		return
+	}
+	opts := options.Find().SetSort(helpfulFirst).SetSkip(int64((page - 1) * perPage)).SetLimit(int64(perPage))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch questions"})
+		return
+	}
+	questions := []Question{}
+	if err := cursor.All(ctx, &questions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode questions"})
+		return
+	}
+
+	ids := make([]string, 0, len(questions))
+	for _, q := range questions {
+		ids = append(ids, q.ID)
+	}
+	cursor, err = productService.db.Collection("answers").Find(ctx,
+		bson.M{"question_id": bson.M{"$in": ids}, "status": ReviewApproved},
+		options.Find().SetSort(bson.D{{Key: "staff", Value: -1}, {Key: "score", Value: -1}, {Key: "created_at", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch answers"})
+		return
+	}
+	var answers []Answer
+	if err := cursor.All(ctx, &answers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode answers"})
+		return
+	}
+	byQuestion := map[string][]Answer{}
+	for _, a := range answers {
+		if len(byQuestion[a.QuestionID]) < maxAnswersShown {
+			byQuestion[a.QuestionID] = append(byQuestion[a.QuestionID], a)
+		}
+	}
+	for i := range questions {
+		questions[i].ApprovedAnswers = byQuestion[questions[i].ID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"questions": questions,
+		"count":     len(questions),
+		"total":     total,
+		"page":      page,
+		"per_page":  perPage,
+	})
+}
+
+// listQuestionAnswers shows all of a question's approved answers, staff
+// answers first and then the most helpful.
+func listQuestionAnswers(c *gin.Context) {
+	ctx := c.Request.Context()
+	var question Question
+	err := productService.db.Collection("questions").FindOne(ctx,
+		bson.M{"_id": c.Param("id"), "status": ReviewApproved}).Decode(&question)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Question not found"})
+		return
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "staff", Value: -1}, {Key: "score", Value: -1}, {Key: "created_at", Value: -1}})
+	cursor, err := productService.db.Collection("answers").Find(ctx,
+		bson.M{"question_id": question.ID, "status": ReviewApproved}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch answers"})
+		return
+	}
+	answers := []Answer{}
+	if err := cursor.All(ctx, &answers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode answers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"question": question, "answers": answers, "count": len(answers)})
+}
+
+func createQuestion(c *gin.Context) {
+	if !canPost(c) {
+		return
+	}
+	var req postRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	productID := c.Param("id")
+	if n, _ := productService.db.Collection("products").CountDocuments(ctx, publishedFilter(bson.M{"_id": productID})); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	question := Question{
+		ID:        primitive.NewObjectID().Hex(),
+		ProductID: productID,
+		UserID:    c.GetString("user_id"),
+		Body:      req.Body,
+		Status:    ReviewPending,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if _, err := productService.db.Collection("questions").InsertOne(ctx, question); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create question"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, question)
+}
+
+// createAnswer answers an approved question. Staff with questions:answer
+// answer for the store, without moderation.
+func createAnswer(c *gin.Context) {
+	if !canPost(c) {
+		return
+	}
+	var req postRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var question Question
+	err := productService.db.Collection("questions").FindOne(ctx,
+		bson.M{"_id": c.Param("id"), "status": ReviewApproved}).Decode(&question)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Question not found"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	staff := hasPermission(c, "questions:answer")
+	answer := Answer{
+		ID:         primitive.NewObjectID().Hex(),
+		QuestionID: question.ID,
+		ProductID:  question.ProductID,
+		UserID:     userID,
+		Body:       req.Body,
+		Staff:      staff,
+		Status:     ReviewPending,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	if staff {
+		answer.Status = ReviewApproved
+	} else {
+		answer.VerifiedPurchase = verifiedPurchase(ctx, userID, question.ProductID)
+	}
+	if _, err := productService.db.Collection("answers").InsertOne(ctx, answer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create answer"})
+		return
+	}
+	if staff {
+		refreshAnswerCount(ctx, question.ID)
+	}
+
+	c.JSON(http.StatusCreated, answer)
+}
+
+// deleteQuestion removes a question and its answers. Authors can delete
+// their own; moderators can delete any.
+func deleteQuestion(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"_id": c.Param("id")}
+	if !hasPermission(c, "questions:moderate") {
+		filter["user_id"] = c.GetString("user_id")
+	}
+
+	var question Question
+	if err := productService.db.Collection("questions").FindOneAndDelete(ctx, filter).Decode(&question); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Question not found"})
+		return
+	}
+	if _, err := productService.db.Collection("answers").DeleteMany(ctx, bson.M{"question_id": question.ID}); err != nil {
+		log.Printf("Failed to delete answers of question %s: %v", question.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Question deleted"})
+}
+
+func deleteAnswer(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"_id": c.Param("id")}
+	if !hasPermission(c, "questions:moderate") {
+		filter["user_id"] = c.GetString("user_id")
+	}
+
+	var answer Answer
+	if err := productService.db.Collection("answers").FindOneAndDelete(ctx, filter).Decode(&answer); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Answer not found"})
+		return
+	}
+	if answer.Status == ReviewApproved {
+		refreshAnswerCount(ctx, answer.QuestionID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Answer deleted"})
+}
+
+// voteHelpful records the caller's vote on a question or answer. Voting
+// again replaces the vote, and authors can't vote on their own posts.
+func voteHelpful(collection string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Helpful *bool `json:"helpful" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		userID := c.GetString("user_id")
+		targets := productService.db.Collection(collection)
+		var target struct {
+			UserID string `bson:"user_id"`
+		}
+		err := targets.FindOne(ctx, bson.M{"_id": c.Param("id"), "status": ReviewApproved}).Decode(&target)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		if target.UserID == userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can't vote on your own post"})
+			return
+		}
+
+		var previous struct {
+			Helpful bool `bson:"helpful"`
+		}
+		err = productService.db.Collection("qa_votes").FindOneAndUpdate(ctx,
+			bson.M{"target_id": c.Param("id"), "user_id": userID},
+			bson.M{"$set": bson.M{"helpful": *req.Helpful, "voted_at": time.Now()}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+		).Decode(&previous)
+		inc := bson.M{}
+		switch {
+		case err == mongo.ErrNoDocuments:
+			if *req.Helpful {
+				inc = bson.M{"helpful_votes": 1, "score": 1}
+			} else {
+				inc = bson.M{"unhelpful_votes": 1, "score": -1}
+			}
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record vote"})
+			return
+		case previous.Helpful != *req.Helpful:
+			if *req.Helpful {
+				inc = bson.M{"helpful_votes": 1, "unhelpful_votes": -1, "score": 2}
+			} else {
+				inc = bson.M{"helpful_votes": -1, "unhelpful_votes": 1, "score": -2}
+			}
+		}
+
+		// Repeating a vote changes nothing
+		var votes Votes
+		if len(inc) > 0 {
+			err = targets.FindOneAndUpdate(ctx, bson.M{"_id": c.Param("id")}, bson.M{"$inc": inc},
+				options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&votes)
+		} else {
+			err = targets.FindOne(ctx, bson.M{"_id": c.Param("id")}).Decode(&votes)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record vote"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "votes": votes})
+	}
+}
+
+// listQuestionModerationQueue lists questions and customer answers by
+// status, oldest first; pending by default.
+func listQuestionModerationQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", ReviewPending)
+	if status != ReviewPending && status != ReviewApproved && status != ReviewRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, approved or rejected"})
+		return
+	}
+	filter := bson.M{"status": status}
+	if productID := c.Query("product_id"); productID != "" {
+		filter["product_id"] = productID
+	}
+
+	ctx := c.Request.Context()
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(200)
+	cursor, err := productService.db.Collection("questions").Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch questions"})
+		return
+	}
+	questions := []Question{}
+	if err := cursor.All(ctx, &questions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode questions"})
+		return
+	}
+	cursor, err = productService.db.Collection("answers").Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch answers"})
+		return
+	}
+	answers := []Answer{}
+	if err := cursor.All(ctx, &answers); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode answers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"questions": questions, "answers": answers})
+}
+
+// moderatePost approves or rejects a question or answer.
+func moderatePost(collection string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Status string `json:"status" binding:"required,oneof=approved rejected"`
+			Note   string `json:"note" binding:"max=1000"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Status == ReviewRejected && req.Note == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A note is required to reject a post"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		var moderated bson.M
+		err := productService.db.Collection(collection).FindOneAndUpdate(ctx,
+			bson.M{"_id": c.Param("id")},
+			bson.M{"$set": bson.M{
+				"status":          req.Status,
+				"moderation_note": req.Note,
+				"moderated_by":    c.GetString("user_id"),
+				"moderated_at":    time.Now(),
+			}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&moderated)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		if questionID, ok := moderated["question_id"].(string); ok {
+			refreshAnswerCount(ctx, questionID)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "status": req.Status})
+	}
+}
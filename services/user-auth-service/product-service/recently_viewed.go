@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Recently viewed products are kept per shopper as a capped Redis list,
+// newest first. Signed-in customers and guests are identified by their
+// token; clients without one send a random X-Session-ID. Once a session
+// signs in, its history is folded into the account's.
+var (
+	recentlyViewedMax = envInt("RECENTLY_VIEWED_MAX", 20)
+	recentlyViewedTTL = 30 * 24 * time.Hour
+	// Views a client IP may post per minute
+	recentlyViewedRate = envInt("RECENTLY_VIEWED_RATE_PER_MINUTE", 60)
+)
+
+const recentlyViewedTimeout = 500 * time.Millisecond
+
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// recentlyViewedKey returns the list for the caller, and the anonymous
+// session's list when a signed-in caller still sends one.
+func recentlyViewedKey(c *gin.Context) (key, sessionKey string) {
+	if sessionID := c.GetHeader("X-Session-ID"); sessionIDPattern.MatchString(sessionID) {
+		sessionKey = "recent:session:" + sessionID
+	}
+	if userID := viewerID(c); userID != "" {
+		return "recent:user:" + userID, sessionKey
+	}
+	return sessionKey, ""
+}
+
+// recordView moves productID to the front of the caller's list. It's best
+// effort and runs in the background, so Redis never slows the page down.
+func recordView(c *gin.Context, productID string) {
+	key, sessionKey := recentlyViewedKey(c)
+	if key == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recentlyViewedTimeout)
+		defer cancel()
+		if sessionKey != "" {
+			mergeSessionViews(ctx, key, sessionKey)
+		}
+
+		pipe := redisClient.TxPipeline()
+		pipe.LRem(ctx, key, 0, productID)
+		pipe.LPush(ctx, key, productID)
+		pipe.LTrim(ctx, key, 0, int64(recentlyViewedMax-1))
+		pipe.Expire(ctx, key, recentlyViewedTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to record view of %s: %v", productID, err)
+		}
+	}()
+}
+
+// mergeSessionViews appends the anonymous session's views after the
+// account's own and drops the session list.
+func mergeSessionViews(ctx context.Context, key, sessionKey string) {
+	session, err := redisClient.LRange(ctx, sessionKey, 0, -1).Result()
+	if err != nil || len(session) == 0 {
+		return
+	}
+	pipe := redisClient.TxPipeline()
+	for _, id := range session {
+		pipe.LRem(ctx, key, 0, id)
+		pipe.RPush(ctx, key, id)
+	}
+	pipe.LTrim(ctx, key, 0, int64(recentlyViewedMax-1))
+	pipe.Expire(ctx, key, recentlyViewedTTL)
+	pipe.Del(ctx, sessionKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to merge recently viewed for %s: %v", key, err)
+	}
+}
+
+// allowViewPost counts a posted view against the client IP's budget for
+// the current minute. Redis errors let the view through, as recording it is
+// best effort anyway.
+func allowViewPost(ctx context.Context, ip string) bool {
+	key := "recent:rate:" + ip + ":" + strconv.FormatInt(time.Now().Unix()/60, 10)
+	pipe := redisClient.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to rate limit recently viewed for %s: %v", ip, err)
+		return true
+	}
+	return count.Val() <= int64(recentlyViewedRate)
+}
+
+// addRecentlyViewed records a view for pages that don't fetch the product
+// through this service, such as CDN-cached product pages. Only published
+// products are recorded, and each client IP is rate limited, since the
+// views also feed popularity.
+func addRecentlyViewed(c *gin.Context) {
+	var req struct {
+		ProductID string `json:"product_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key, _ := recentlyViewedKey(c); key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign in or send an X-Session-ID header"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if !allowViewPost(ctx, c.ClientIP()) {
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+		return
+	}
+	if n, _ := productService.db.Collection("products").CountDocuments(ctx, publishedFilter(bson.M{"_id": req.ProductID})); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	recordView(c, req.ProductID)
+	countView(c, req.ProductID)
+	c.Status(http.StatusNoContent)
+}
+
+// getRecentlyViewed returns the caller's recently viewed products with
+// their current price and availability, newest first. ?exclude= leaves out
+// the product on screen and ?limit= caps the row.
+func getRecentlyViewed(c *gin.Context) {
+	key, sessionKey := recentlyViewedKey(c)
+	if key == "" {
+		c.JSON(http.StatusOK, gin.H{"products": []gin.H{}, "count": 0})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), recentlyViewedTimeout)
+	defer cancel()
+	if sessionKey != "" {
+		mergeSessionViews(ctx, key, sessionKey)
+	}
+	ids, err := redisClient.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Recently viewed is unavailable"})
+		return
+	}
+
+	limit := recentlyViewedMax
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	exclude := c.Query("exclude")
+
+	cursor, err := productService.db.Collection("products").Find(c.Request.Context(),
+		publishedFilter(bson.M{"_id": bson.M{"$in": ids}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	var found []Product
+	if err := cursor.All(c.Request.Context(), &found); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
+		return
+	}
+	byID := make(map[string]*Product, len(found))
+	for i := range found {
+		byID[found[i].ID] = &found[i]
+	}
+
+	// Deleted and unpublished products drop out of the row
+	chain := storefrontLocales(c)
+	products := []gin.H{}
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok || id == exclude {
+			continue
+		}
+		localizeProduct(p, chain)
+		products = append(products, gin.H{
+			"id":           p.ID,
+			"name":         p.Name,
+			"price":        p.Price,
+			"image_url":    p.ImageURL,
+			"in_stock":     p.Stock > 0 || p.Digital,
+			"stock":        p.Stock,
+			"availability": p.availability(),
+		})
+		if len(products) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"products": products, "count": len(products)})
+}
+
+func clearRecentlyViewed(c *gin.Context) {
+	key, sessionKey := recentlyViewedKey(c)
+	if key == "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	keys := []string{key}
+	if sessionKey != "" {
+		keys = append(keys, sessionKey)
+	}
+	if err := redisClient.Del(c.Request.Context(), keys...).Err(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Recently viewed is unavailable"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// "Customers also bought" recommendations are the products most often in
+// the same paid orders, as the order service aggregates them over the last
+// RECOMMENDATION_WINDOW_DAYS (default 180). They're refreshed into the
+// recommendations collection every RECOMMENDATION_REFRESH_INTERVAL
+// (default 6h) and served like listings, cached until the catalog or the
+// recommendations change.
+var recommendationRefreshInterval = envDuration("RECOMMENDATION_REFRESH_INTERVAL", 6*time.Hour)
+
+const (
+	// Pairs bought together fewer times are coincidence
+	minCoPurchaseOrders    = 2
+	maxRecommendations     = 20
+	defaultRecommendations = 8
+	recommendationBatch    = 500
+)
+
+// Aggregating every order takes a while
+var recommendationClient = &http.Client{Timeout: time.Minute}
+
+// CoPurchase is a product bought in the same orders as another.
+type CoPurchase struct {
+	ProductID string `bson:"product_id" json:"product_id"`
+	Orders    int    `bson:"orders" json:"orders"`
+}
+
+// Recommendation lists what's bought with a product, most often first.
+type Recommendation struct {
+	ProductID  string       `bson:"_id" json:"product_id"`
+	Related    []CoPurchase `bson:"related" json:"related"`
+	ComputedAt time.Time    `bson:"computed_at" json:"computed_at"`
+}
+
+// startRecommendations refreshes recommendations on schedule. The Redis key
+// makes one instance do it per interval.
+func startRecommendations() {
+	go func() {
+		ctx := context.Background()
+		for {
+			claimed, err := redisClient.SetNX(ctx, "recommendations:refresh", 1, recommendationRefreshInterval*9/10).Result()
+			if err != nil {
+				log.Printf("Failed to schedule recommendation refresh: %v", err)
+			}
+			if claimed {
+				if n, err := refreshRecommendations(ctx); err != nil {
+					log.Printf("Recommendation refresh failed: %v", err)
+				} else {
+					log.Printf("Refreshed recommendations for %d products", n)
+				}
+			}
+			time.Sleep(recommendationRefreshInterval / 10)
+		}
+	}()
+}
+
+// fetchCoPurchases asks the order service what's bought with what.
+func fetchCoPurchases(ctx context.Context) (map[string][]CoPurchase, error) {
+	query := "?days=" + strconv.Itoa(envInt("RECOMMENDATION_WINDOW_DAYS", 180)) +
+		"&min_orders=" + strconv.Itoa(minCoPurchaseOrders) +
+		"&limit=" + strconv.Itoa(maxRecommendations)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderServiceURL()+"/api/v1/orders/co-purchases"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := recommendationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	var body struct {
+		Products map[string][]CoPurchase `json:"products"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Products, nil
+}
+
+// refreshRecommendations rewrites every product's recommendations, then
+// drops those of products no longer bought with anything. It returns how
+// many products have recommendations. If the order service can't be
+// reached, the last ones stay.
+func refreshRecommendations(ctx context.Context) (int, error) {
+	products, err := fetchCoPurchases(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	computedAt := time.Now()
+	collection := productService.db.Collection("recommendations")
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	for productID, related := range products {
+		rec := Recommendation{ProductID: productID, Related: related, ComputedAt: computedAt}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": productID}).SetReplacement(rec).SetUpsert(true))
+		if len(models) >= recommendationBatch {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if _, err := collection.DeleteMany(ctx, bson.M{"computed_at": bson.M{"$lt": computedAt}}); err != nil {
+		return 0, err
+	}
+	invalidateProduct(ctx, "")
+	return len(products), nil
+}
+
+// getAlsoBought answers GET /api/v1/products/:id/also-bought with the
+// published products customers bought along with this one. ?limit= caps
+// them (default 8, at most 20).
+func getAlsoBought(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecommendations)))
+	if err != nil || limit < 1 || limit > maxRecommendations {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 20"})
+		return
+	}
+	cacheKey, served := serveCachedListing(c)
+	if served {
+		return
+	}
+
+	ctx := c.Request.Context()
+	var product Product
+	if err := productService.db.Collection("products").FindOne(ctx, publishedFilter(bson.M{"_id": c.Param("id")})).Decode(&product); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	var rec Recommendation
+	err = productService.db.Collection("recommendations").FindOne(ctx, bson.M{"_id": product.ID}).Decode(&rec)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recommendations"})
+		return
+	}
+	ids := make([]string, 0, len(rec.Related))
+	for _, related := range rec.Related {
+		ids = append(ids, related.ProductID)
+	}
+	candidates, err := loadProductsInOrder(ctx, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recommendations"})
+		return
+	}
+
+	products := []Product{}
+	for _, p := range candidates {
+		if p.published() && len(products) < limit {
+			p.Media = p.gallery()
+			products = append(products, p)
+		}
+	}
+	localizeProducts(products, storefrontLocales(c))
+	setAvailability(products)
+
+	data, err := json.Marshal(gin.H{"products": products, "count": len(products)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode products"})
+		return
+	}
+	if cacheKey != "" {
+		cacheListing(ctx, cacheKey, data)
+	}
+	writeListing(c, data, true)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var inventoryClient = &http.Client{Timeout: 2 * time.Second}
+
+func inventoryServiceURL() string {
+	if u := os.Getenv("INVENTORY_SERVICE_URL"); u != "" {
+		return u
+	}
+	return "http://inventory-service:8006"
+}
+
+// fetchRestockETA asks the inventory service when an out-of-stock product
+// is expected back, from its open purchase orders and transfers. It's best
+// effort; nil means no restock is scheduled or the lookup failed.
+func fetchRestockETA(ctx context.Context, productID string) *time.Time {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		inventoryServiceURL()+"/api/v1/inventory/"+url.PathEscape(productID)+"/restock", nil)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := inventoryClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		RestockETA time.Time `json:"restock_eta"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil {
+		return nil
+	}
+	return &body.RestockETA
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Review is a customer's rating of a product, at most one per customer and
+// product. New and edited reviews wait for moderation; only approved ones
+// are shown and count towards the product's Rating and Reviews.
+type Review struct {
+	ID        string `bson:"_id" json:"id"`
+	ProductID string `bson:"product_id" json:"product_id"`
+	UserID    string `bson:"user_id" json:"user_id"`
+	Rating    int    `bson:"rating" json:"rating"`
+	Title     string `bson:"title" json:"title"`
+	Body      string `bson:"body" json:"body"`
+	// The reviewer had a paid order for the product when they last wrote it
+	VerifiedPurchase bool       `bson:"verified_purchase" json:"verified_purchase"`
+	Status           string     `bson:"status" json:"status"`
+	ModerationNote   string     `bson:"moderation_note,omitempty" json:"moderation_note,omitempty"`
+	ModeratedBy      string     `bson:"moderated_by,omitempty" json:"-"`
+	ModeratedAt      *time.Time `bson:"moderated_at,omitempty" json:"moderated_at,omitempty"`
+	CreatedAt        time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// RatingSummary is the breakdown of a product's approved reviews.
+// Distribution counts reviews per star, "1" to "5".
+type RatingSummary struct {
+	Average      float64        `json:"average"`
+	Count        int            `json:"count"`
+	Distribution map[string]int `json:"distribution"`
+}
+
+type reviewRequest struct {
+	Rating int    `json:"rating" binding:"required,min=1,max=5"`
+	Title  string `json:"title" binding:"max=200"`
+	Body   string `json:"body" binding:"max=5000"`
+}
+
+const ratingAggregationInterval = 15 * time.Minute
+
+var reviewSorts = map[string]bson.D{
+	"newest":  {{Key: "created_at", Value: -1}},
+	"highest": {{Key: "rating", Value: -1}, {Key: "created_at", Value: -1}},
+	"lowest":  {{Key: "rating", Value: 1}, {Key: "created_at", Value: -1}},
+}
+
+func setupReviews() {
+	_, err := productService.db.Collection("reviews").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "product_id", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create review indexes: %v", err)
+	}
+}
+
+var orderClient = &http.Client{Timeout: 2 * time.Second}
+
+func orderServiceURL() string {
+	if u := os.Getenv("ORDER_SERVICE_URL"); u != "" {
+		return u
+	}
+	return "http://order-service:8004"
+}
+
+// purchasedStatuses are the order states in which the customer has paid.
+var purchasedStatuses = map[string]bool{"paid": true, "shipped": true, "delivered": true, "fulfilled": true}
+
+// verifiedPurchase checks whether the customer bought the product. It's
+// best effort; if the order service can't be reached the review is simply
+// not marked verified.
+func verifiedPurchase(ctx context.Context, userID, productID string) bool {
+	purchased, err := purchasedProduct(ctx, userID, productID)
+	if err != nil {
+		log.Printf("Failed to check purchases for %s: %v", userID, err)
+	}
+	return purchased
+}
+
+// purchasedProduct checks the customer's order history for a paid order
+// containing the product.
+func purchasedProduct(ctx context.Context, userID, productID string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		orderServiceURL()+"/api/v1/orders/user/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := orderClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Orders []struct {
+			Status string `json:"status"`
+			Items  []struct {
+				ProductID string `json:"product_id"`
+			} `json:"items"`
+		} `json:"orders"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("order service returned %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, err
+	}
+
+	for _, order := range body.Orders {
+		if !purchasedStatuses[order.Status] {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.ProductID == productID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// canReview rejects guests and staff impersonating a customer, who can
+// shop but mustn't speak for the customer.
+func canReview(c *gin.Context) bool {
+	if c.GetString("role") == "guest" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Sign in to review products"})
+		return false
+	}
+	if c.GetString("impersonated_by") != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Reviews can't be written while impersonating a customer"})
+		return false
+	}
+	return true
+}
+
+// ratingSummary aggregates the approved reviews of a product.
+func ratingSummary(ctx context.Context, productID string) (RatingSummary, error) {
+	summary := RatingSummary{Distribution: map[string]int{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0}}
+
+	cursor, err := productService.db.Collection("reviews").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"product_id": productID, "status": ReviewApproved}}},
+		{{Key: "$group", Value: bson.M{"_id": "$rating", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return summary, err
+	}
+	var stars []struct {
+		Rating int `bson:"_id"`
+		Count  int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &stars); err != nil {
+		return summary, err
+	}
+
+	total := 0
+	for _, s := range stars {
+		summary.Distribution[strconv.Itoa(s.Rating)] = s.Count
+		summary.Count += s.Count
+		total += s.Rating * s.Count
+	}
+	if summary.Count > 0 {
+		summary.Average = roundRating(float64(total) / float64(summary.Count))
+	}
+	return summary, nil
+}
+
+func roundRating(average float64) float64 {
+	return math.Round(average*100) / 100
+}
+
+// refreshProductRating brings one product's Rating and Reviews up to date
+// straight after one of its reviews changes. The aggregation job repairs
+// anything this misses.
+func refreshProductRating(ctx context.Context, productID string) {
+	summary, err := ratingSummary(ctx, productID)
+	if err != nil {
+		log.Printf("Failed to aggregate ratings for product %s: %v", productID, err)
+		return
+	}
+	setProductRating(ctx, productID, summary.Average, summary.Count)
+}
+
+func setProductRating(ctx context.Context, productID string, average float64, count int) {
+	result, err := productService.db.Collection("products").UpdateOne(ctx,
+		bson.M{"_id": productID, "$or": bson.A{bson.M{"rating": bson.M{"$ne": average}}, bson.M{"reviews": bson.M{"$ne": count}}}},
+		bson.M{"$set": bson.M{"rating": average, "reviews": count, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		log.Printf("Failed to update rating of product %s: %v", productID, err)
+		return
+	}
+	if result.ModifiedCount > 0 {
+		invalidateProduct(ctx, productID)
+	}
+}
+
+// startRatingAggregation recomputes every product's rating periodically,
+// so the stored figures can't drift from the approved reviews.
+func startRatingAggregation() {
+	go func() {
+		for {
+			if n, err := aggregateRatings(context.Background()); err != nil {
+				log.Printf("Rating aggregation failed: %v", err)
+			} else {
+				log.Printf("Aggregated ratings for %d products", n)
+			}
+			time.Sleep(ratingAggregationInterval)
+		}
+	}()
+}
+
+func aggregateRatings(ctx context.Context) (int, error) {
+	cursor, err := productService.db.Collection("reviews").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": ReviewApproved}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$product_id",
+			"average": bson.M{"$avg": "$rating"},
+			"count":   bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	rated := []string{}
+	for cursor.Next(ctx) {
+		var row struct {
+			ProductID string  `bson:"_id"`
+			Average   float64 `bson:"average"`
+			Count     int     `bson:"count"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		setProductRating(ctx, row.ProductID, roundRating(row.Average), row.Count)
+		rated = append(rated, row.ProductID)
+	}
+	if err := cursor.Err(); err != nil {
+		return len(rated), err
+	}
+
+	// Products whose last approved review went away
+	result, err := productService.db.Collection("products").UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$nin": rated}, "$or": bson.A{bson.M{"rating": bson.M{"$ne": 0}}, bson.M{"reviews": bson.M{"$ne": 0}}}},
+		bson.M{"$set": bson.M{"rating": 0, "reviews": 0, "updated_at": time.Now()}},
+	)
+	if err == nil && result.ModifiedCount > 0 {
+		invalidateCatalog(ctx)
+	}
+	return len(rated), err
+}
+
+// listProductReviews shows a product's approved reviews with its rating
+// summary. ?sort= is newest (default), highest or lowest, and
+// ?verified=true keeps only verified purchases.
+func listProductReviews(c *gin.Context) {
+	ctx := c.Request.Context()
+	productID := c.Param("id")
+
+	sort, ok := reviewSorts[c.DefaultQuery("sort", "newest")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be newest, highest or lowest"})
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+
+	filter := bson.M{"product_id": productID, "status": ReviewApproved}
+	if c.Query("verified") == "true" {
+		filter["verified_purchase"] = true
+	}
+
+	collection := productService.db.Collection("reviews")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+	opts := options.Find().SetSort(sort).SetSkip(int64((page - 1) * perPage)).SetLimit(int64(perPage))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+	reviews := []Review{}
+	if err := cursor.All(ctx, &reviews); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode reviews"})
+		return
+	}
+
+	summary, err := ratingSummary(ctx, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize ratings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reviews":  reviews,
+		"count":    len(reviews),
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+		"summary":  summary,
+	})
+}
+
+func createReview(c *gin.Context) {
+	if !canReview(c) {
+		return
+	}
+	var req reviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	productID := c.Param("id")
+	var product Product
+	if err := productService.db.Collection("products").FindOne(ctx, publishedFilter(bson.M{"_id": productID})).Decode(&product); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	review := Review{
+		ID:               primitive.NewObjectID().Hex(),
+		ProductID:        productID,
+		UserID:           userID,
+		Rating:           req.Rating,
+		Title:            req.Title,
+		Body:             req.Body,
+		VerifiedPurchase: verifiedPurchase(ctx, userID, productID),
+		Status:           ReviewPending,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if _, err := productService.db.Collection("reviews").InsertOne(ctx, review); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "You have already reviewed this product"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create review"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, review)
+}
+
+// updateReview lets the author rewrite their review, which sends it back to
+// moderation.
+func updateReview(c *gin.Context) {
+	if !canReview(c) {
+		return
+	}
+	var req reviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := productService.db.Collection("reviews")
+	var review Review
+	err := collection.FindOne(ctx, bson.M{"_id": c.Param("id"), "user_id": c.GetString("user_id")}).Decode(&review)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+
+	wasApproved := review.Status == ReviewApproved
+	review.Rating = req.Rating
+	review.Title = req.Title
+	review.Body = req.Body
+	review.VerifiedPurchase = verifiedPurchase(ctx, review.UserID, review.ProductID)
+	review.Status = ReviewPending
+	review.ModerationNote = ""
+	review.ModeratedBy = ""
+	review.ModeratedAt = nil
+	review.UpdatedAt = time.Now()
+	if _, err := collection.ReplaceOne(ctx, bson.M{"_id": review.ID}, review); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update review"})
+		return
+	}
+	if wasApproved {
+		refreshProductRating(ctx, review.ProductID)
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// deleteReview removes a review. Authors can delete their own; moderators
+// can delete any.
+func deleteReview(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"_id": c.Param("id")}
+	if !hasPermission(c, "reviews:moderate") {
+		filter["user_id"] = c.GetString("user_id")
+	}
+
+	var review Review
+	if err := productService.db.Collection("reviews").FindOneAndDelete(ctx, filter).Decode(&review); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+	if review.Status == ReviewApproved {
+		refreshProductRating(ctx, review.ProductID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review deleted"})
+}
+
+// listMyReviews shows the caller's reviews in every status, so they can see
+// what is still waiting for moderation or was rejected and why.
+func listMyReviews(c *gin.Context) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := productService.db.Collection("reviews").Find(c.Request.Context(), bson.M{"user_id": c.GetString("user_id")}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+	reviews := []Review{}
+	if err := cursor.All(c.Request.Context(), &reviews); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode reviews"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reviews": reviews, "count": len(reviews)})
+}
+
+// listModerationQueue lists reviews by status, oldest first; pending by
+// default.
+func listModerationQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", ReviewPending)
+	if status != ReviewPending && status != ReviewApproved && status != ReviewRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, approved or rejected"})
+		return
+	}
+	filter := bson.M{"status": status}
+	if productID := c.Query("product_id"); productID != "" {
+		filter["product_id"] = productID
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(200)
+	cursor, err := productService.db.Collection("reviews").Find(c.Request.Context(), filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+		return
+	}
+	reviews := []Review{}
+	if err := cursor.All(c.Request.Context(), &reviews); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode reviews"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reviews": reviews, "count": len(reviews)})
+}
+
+func moderateReview(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=approved rejected"`
+		Note   string `json:"note" binding:"max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Status == ReviewRejected && req.Note == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A note is required to reject a review"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	var review Review
+	err := productService.db.Collection("reviews").FindOneAndUpdate(ctx,
+		bson.M{"_id": c.Param("id")},
+		bson.M{"$set": bson.M{
+			"status":          req.Status,
+			"moderation_note": req.Note,
+			"moderated_by":    c.GetString("user_id"),
+			"moderated_at":    now,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&review)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+	refreshProductRating(ctx, review.ProductID)
+
+	c.JSON(http.StatusOK, review)
+}
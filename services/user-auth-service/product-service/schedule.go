@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Drafts with a publish_at go live at that time, for launches, and
+// published products with an unpublish_at go back to draft, for seasonal
+// items, so they can be scheduled again next season. A worker checks every
+// PRODUCT_SCHEDULE_INTERVAL (default a minute). A draft that no longer
+// meets the publishing threshold when it's due stays a draft and loses its
+// publish_at, which the audit trail records.
+var scheduleInterval = envDuration("PRODUCT_SCHEDULE_INTERVAL", time.Minute)
+
+// ScheduleRequest sets or, when left out, clears a product's schedule.
+type ScheduleRequest struct {
+	PublishAt   *time.Time `json:"publish_at"`
+	UnpublishAt *time.Time `json:"unpublish_at"`
+}
+
+func startScheduler() {
+	_, err := productService.db.Collection("products").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "publish_at", Value: 1}}},
+		{Keys: bson.D{{Key: "unpublish_at", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create schedule indexes: %v", err)
+	}
+
+	// One instance runs the schedule per interval
+	go func() {
+		ctx := context.Background()
+		for {
+			claimed, err := redisClient.SetNX(ctx, "products:schedule", 1, scheduleInterval*9/10).Result()
+			if err != nil {
+				log.Printf("Failed to claim product schedule: %v", err)
+			}
+			if claimed {
+				if err := runSchedule(ctx); err != nil {
+					log.Printf("Product schedule failed: %v", err)
+				}
+			}
+			time.Sleep(scheduleInterval / 10)
+		}
+	}()
+}
+
+// staleSchedule lists the schedule fields that moving to status makes
+// moot: the publish time once published, the unpublish time once taken
+// down.
+func staleSchedule(status string) bson.M {
+	unset := bson.M{}
+	if status == StatusPublished || status == StatusArchived {
+		unset["publish_at"] = ""
+	}
+	if status == StatusDraft || status == StatusArchived {
+		unset["unpublish_at"] = ""
+	}
+	return unset
+}
+
+// runSchedule publishes and unpublishes the products that are due.
+func runSchedule(ctx context.Context) error {
+	now := time.Now()
+	collection := productService.db.Collection("products")
+
+	var due []Product
+	cursor, err := collection.Find(ctx, bson.M{"status": StatusDraft, "publish_at": bson.M{"$lte": now}})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &due); err != nil {
+		return err
+	}
+	for i := range due {
+		before := due[i]
+		p := &due[i]
+		p.Status = StatusPublished
+		score := scoreProduct(p)
+		p.Quality = &score
+
+		action, data := AuditScheduledPublish, bson.M(nil)
+		update := bson.M{
+			"$set":   bson.M{"status": StatusPublished, "quality": p.Quality, "updated_at": now},
+			"$unset": staleSchedule(StatusPublished),
+		}
+		if score.Score < publishThreshold() {
+			log.Printf("Scheduled publication of product %s skipped, quality %d is below %d", p.ID, score.Score, publishThreshold())
+			p.Status = StatusDraft
+			action, data = AuditScheduleChanged, bson.M{"reason": "quality_below_threshold"}
+			update = bson.M{"$set": bson.M{"quality": p.Quality, "updated_at": now}, "$unset": bson.M{"publish_at": ""}}
+		}
+
+		// Staff may have changed the product since it was read
+		result, err := collection.UpdateOne(ctx, bson.M{"_id": p.ID, "status": StatusDraft, "publish_at": before.PublishAt}, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		if p.Status == StatusPublished {
+			invalidateProduct(ctx, p.ID)
+			publishProductSaved(ctx, p, false, p.Price)
+		}
+		recordServiceChange(ctx, action, p.ID, &before, data)
+	}
+
+	// Products from before publication existed have no status
+	due = nil
+	cursor, err = collection.Find(ctx, publishedFilter(bson.M{"unpublish_at": bson.M{"$lte": now}}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &due); err != nil {
+		return err
+	}
+	for i := range due {
+		before := due[i]
+		p := &due[i]
+		p.Status = StatusDraft
+		result, err := collection.UpdateOne(ctx,
+			publishedFilter(bson.M{"_id": p.ID, "unpublish_at": before.UnpublishAt}),
+			bson.M{"$set": bson.M{"status": StatusDraft, "updated_at": now}, "$unset": staleSchedule(StatusDraft)})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		invalidateProduct(ctx, p.ID)
+		publishProductSaved(ctx, p, false, p.Price)
+		recordServiceChange(ctx, AuditScheduledUnpublish, p.ID, &before, nil)
+	}
+	return nil
+}
+
+// scheduleProduct sets when a product is published and unpublished. Only
+// drafts can be scheduled to publish, and archived products have to be
+// restored first. A product scheduled to publish has to meet the
+// publishing threshold already.
+func scheduleProduct(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	problems := map[string]string{}
+	status := productStatus(product)
+	if req.PublishAt != nil && status != StatusDraft {
+		problems["publish_at"] = "can only be set on drafts"
+	}
+	if req.UnpublishAt != nil {
+		if status == StatusArchived {
+			problems["unpublish_at"] = "can't be set on archived products"
+		} else if !req.UnpublishAt.After(time.Now()) {
+			problems["unpublish_at"] = "must be in the future"
+		} else if req.PublishAt != nil && !req.UnpublishAt.After(*req.PublishAt) {
+			problems["unpublish_at"] = "must be after publish_at"
+		}
+	}
+	if !checkProduct(c, problems) {
+		return
+	}
+	if req.PublishAt != nil {
+		launch := *product
+		launch.Status = StatusPublished
+		if !checkPublishable(c, &launch, product) {
+			return
+		}
+	}
+
+	set, unset := bson.M{"updated_at": time.Now()}, bson.M{}
+	for field, at := range map[string]*time.Time{"publish_at": req.PublishAt, "unpublish_at": req.UnpublishAt} {
+		if at != nil {
+			set[field] = at
+		} else {
+			unset[field] = ""
+		}
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if err := updateAudited(c, AuditScheduleChanged, product.ID, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule product"})
+		return
+	}
+	invalidateProduct(c.Request.Context(), product.ID)
+
+	c.JSON(http.StatusOK, gin.H{"product_id": product.ID, "publish_at": req.PublishAt, "unpublish_at": req.UnpublishAt})
+}
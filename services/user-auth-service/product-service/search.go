@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search runs on a MongoDB text index over name, tags and description,
+// weighted so name matches count most. Text search stems English words
+// and ranks by how many terms match and where; synonyms from the lexicon
+// are added to the query as alternatives.
+const (
+	searchIndexName = "product_search"
+	// Hits merchandised per query; results beyond this aren't reachable by
+	// paging
+	maxSearchHits  = 500
+	defaultPerPage = 20
+	maxPerPage     = 100
+	snippetLength  = 160
+)
+
+// searchHit is a matching product's ID and rank, enough to merchandise,
+// count facets and paginate before loading the products on the page.
+type searchHit struct {
+	ID         string  `bson:"_id"`
+	Category   string  `bson:"category"`
+	CategoryID string  `bson:"category_id"`
+	Price      float64 `bson:"price"`
+	Stock      int     `bson:"stock"`
+	Digital    bool    `bson:"digital"`
+	Score      float64 `bson:"score"`
+	// Marked up by Elasticsearch; Mongo hits are highlighted locally
+	Highlights map[string]string `bson:"-"`
+}
+
+// searchFilters narrow a search: ?category= (with its subcategories),
+// ?min_price=, ?max_price=, ?in_stock=true, ?tags= and ?attr:<name>=.
+type searchFilters struct {
+	categoryIDs []string
+	brandIDs    []string
+	minPrice    *float64
+	maxPrice    *float64
+	inStock     bool
+	tags        []string
+	attributes  map[string][]string
+}
+
+func parseSearchFilters(c *gin.Context) (searchFilters, bool) {
+	var f searchFilters
+	var ok bool
+	if f.categoryIDs, ok = categoryParam(c); !ok {
+		return f, false
+	}
+	if f.brandIDs, ok = brandParam(c); !ok {
+		return f, false
+	}
+	if f.minPrice, ok = priceParam(c, "min_price"); !ok {
+		return f, false
+	}
+	if f.maxPrice, ok = priceParam(c, "max_price"); !ok {
+		return f, false
+	}
+	f.inStock = c.Query("in_stock") == "true"
+	if f.tags, ok = tagsParam(c); !ok {
+		return f, false
+	}
+	if f.attributes, ok = attributesParam(c); !ok {
+		return f, false
+	}
+	return f, true
+}
+
+func priceParam(c *gin.Context, name string) (*float64, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, true
+	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil || price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+		return nil, false
+	}
+	return &price, true
+}
+
+func (f searchFilters) mongo() bson.M {
+	filter := publishedFilter(bson.M{})
+	if f.categoryIDs != nil {
+		filter["category_id"] = bson.M{"$in": f.categoryIDs}
+	}
+	if f.brandIDs != nil {
+		filter["brand_id"] = bson.M{"$in": f.brandIDs}
+	}
+	price := bson.M{}
+	if f.minPrice != nil {
+		price["$gte"] = *f.minPrice
+	}
+	if f.maxPrice != nil {
+		price["$lte"] = *f.maxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+	if f.inStock {
+		filter["$or"] = bson.A{bson.M{"stock": bson.M{"$gt": 0}}, bson.M{"digital": true}}
+	}
+	if len(f.tags) > 0 {
+		filter["tags"] = bson.M{"$all": f.tags}
+	}
+	for name, values := range f.attributes {
+		filter["attributes."+name] = bson.M{"$in": values}
+	}
+	return filter
+}
+
+// elastic returns the query filters, and the post filters applied after
+// facets are counted.
+func (f searchFilters) elastic() (filter, postFilter []gin.H) {
+	filter, postFilter = []gin.H{}, []gin.H{}
+	if f.categoryIDs != nil {
+		filter = append(filter, gin.H{"terms": gin.H{"category_id": f.categoryIDs}})
+	}
+	if f.brandIDs != nil {
+		filter = append(filter, gin.H{"terms": gin.H{"brand_id": f.brandIDs}})
+	}
+	for _, tag := range f.tags {
+		filter = append(filter, gin.H{"term": gin.H{"tags.keyword": tag}})
+	}
+	for name, values := range f.attributes {
+		filter = append(filter, gin.H{"terms": gin.H{"attributes." + name: values}})
+	}
+	price := gin.H{}
+	if f.minPrice != nil {
+		price["gte"] = *f.minPrice
+	}
+	if f.maxPrice != nil {
+		price["lte"] = *f.maxPrice
+	}
+	if len(price) > 0 {
+		postFilter = append(postFilter, gin.H{"range": gin.H{"price": price}})
+	}
+	if f.inStock {
+		postFilter = append(postFilter, gin.H{"term": gin.H{"in_stock": true}})
+	}
+	return filter, postFilter
+}
+
+// Price facet buckets run from each break to the next, the last open ended.
+var priceBreaks = []float64{0, 25, 50, 100, 250}
+
+const maxCategoryFacets = 20
+
+type categoryFacet struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Slug  string `json:"slug"`
+	Count int    `json:"count"`
+}
+
+type priceFacet struct {
+	From  float64  `json:"from"`
+	To    *float64 `json:"to,omitempty"`
+	Count int      `json:"count"`
+}
+
+type searchFacets struct {
+	Categories   []categoryFacet `json:"categories"`
+	Prices       []priceFacet    `json:"prices"`
+	Availability struct {
+		InStock    int `json:"in_stock"`
+		OutOfStock int `json:"out_of_stock"`
+	} `json:"availability"`
+}
+
+func newSearchFacets() searchFacets {
+	facets := searchFacets{Categories: []categoryFacet{}}
+	for i, from := range priceBreaks {
+		bucket := priceFacet{From: from}
+		if i+1 < len(priceBreaks) {
+			to := priceBreaks[i+1]
+			bucket.To = &to
+		}
+		facets.Prices = append(facets.Prices, bucket)
+	}
+	return facets
+}
+
+// facetsFromHits counts facets for Mongo results, which unlike
+// Elasticsearch's only cover the hits returned.
+func facetsFromHits(hits []searchHit) searchFacets {
+	facets := newSearchFacets()
+	categories := map[string]int{}
+	for _, h := range hits {
+		if h.CategoryID != "" {
+			if _, ok := categories[h.CategoryID]; !ok {
+				facets.Categories = append(facets.Categories, categoryFacet{ID: h.CategoryID})
+			}
+			categories[h.CategoryID]++
+		}
+		for i := len(facets.Prices) - 1; i >= 0; i-- {
+			if h.Price >= facets.Prices[i].From {
+				facets.Prices[i].Count++
+				break
+			}
+		}
+		if h.Stock > 0 || h.Digital {
+			facets.Availability.InStock++
+		} else {
+			facets.Availability.OutOfStock++
+		}
+	}
+
+	for i := range facets.Categories {
+		facets.Categories[i].Count = categories[facets.Categories[i].ID]
+	}
+	sort.SliceStable(facets.Categories, func(i, j int) bool {
+		return facets.Categories[i].Count > facets.Categories[j].Count
+	})
+	if len(facets.Categories) > maxCategoryFacets {
+		facets.Categories = facets.Categories[:maxCategoryFacets]
+	}
+	return facets
+}
+
+// nameCategoryFacets fills in category names and slugs, dropping
+// categories that have since been deleted.
+func nameCategoryFacets(ctx context.Context, facets []categoryFacet) []categoryFacet {
+	if len(facets) == 0 {
+		return facets
+	}
+	ids := make([]string, 0, len(facets))
+	for _, f := range facets {
+		ids = append(ids, f.ID)
+	}
+	cursor, err := productService.db.Collection("categories").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return facets
+	}
+	var categories []Category
+	if err := cursor.All(ctx, &categories); err != nil {
+		return facets
+	}
+	byID := make(map[string]Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+
+	named := make([]categoryFacet, 0, len(facets))
+	for _, f := range facets {
+		if category, ok := byID[f.ID]; ok {
+			f.Name, f.Slug = category.Name, category.Slug
+			named = append(named, f)
+		}
+	}
+	return named
+}
+
+func setupSearchIndex() {
+	_, err := productService.db.Collection("products").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "name", Value: "text"}, {Key: "tags", Value: "text"}, {Key: "description", Value: "text"}},
+		Options: options.Index().
+			SetName(searchIndexName).
+			SetWeights(bson.M{"name": 10, "tags": 5, "description": 1}).
+			SetDefaultLanguage("english"),
+	})
+	if err != nil {
+		log.Printf("Failed to create search index: %v", err)
+	}
+}
+
+// textSearch builds the $text search string: every term and synonym, any
+// of which may match. Multi-word synonyms aren't quoted, since $text treats
+// a quoted phrase as required.
+func textSearch(terms [][]string) string {
+	var words []string
+	for _, alternatives := range terms {
+		for _, alt := range alternatives {
+			words = append(words, strings.Fields(strings.ReplaceAll(alt, `"`, ""))...)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// findSearchHits returns the best matches for terms under filter, ranked
+// by text score. Without terms every product matches, alphabetically.
+func findSearchHits(ctx context.Context, terms [][]string, filter bson.M) ([]searchHit, error) {
+	opts := options.Find().SetLimit(maxSearchHits)
+	projection := bson.M{"category": 1, "category_id": 1, "price": 1, "stock": 1, "digital": 1}
+	if len(terms) > 0 {
+		filter["$text"] = bson.M{"$search": textSearch(terms)}
+		score := bson.M{"$meta": "textScore"}
+		projection["score"] = score
+		opts.SetSort(bson.M{"score": score})
+	} else {
+		opts.SetSort(bson.D{{Key: "name", Value: 1}})
+	}
+	opts.SetProjection(projection)
+
+	cursor, err := productService.db.Collection("products").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	hits := []searchHit{}
+	if err := cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// loadProductsInOrder fetches products by ID, keeping the order of ids.
+func loadProductsInOrder(ctx context.Context, ids []string) ([]Product, error) {
+	cursor, err := productService.db.Collection("products").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var found []Product
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Product, len(found))
+	for _, p := range found {
+		byID[p.ID] = p
+	}
+
+	products := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			products = append(products, p)
+		}
+	}
+	return products, nil
+}
+
+// searchResult is a product as returned by search, with its relevance and
+// the matching parts of its text marked up.
+type searchResult struct {
+	Product
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+// highlighter marks query terms in product text. Words are matched by
+// prefix so stemmed matches ("boots" for "boot") are marked too.
+type highlighter struct {
+	pattern *regexp.Regexp
+}
+
+func newHighlighter(terms [][]string) *highlighter {
+	var stems []string
+	for _, alternatives := range terms {
+		for _, alt := range alternatives {
+			for _, word := range strings.Fields(alt) {
+				stem := strings.TrimSuffix(word, "s")
+				if len(stem) >= 2 {
+					stems = append(stems, regexp.QuoteMeta(stem))
+				}
+			}
+		}
+	}
+	if len(stems) == 0 {
+		return &highlighter{}
+	}
+	return &highlighter{pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(stems, "|") + `)\w*`)}
+}
+
+// mark escapes text as HTML and wraps matched words in <mark>.
+func (h *highlighter) mark(text string) (string, bool) {
+	if h.pattern == nil || !h.pattern.MatchString(text) {
+		return html.EscapeString(text), false
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range h.pattern.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:loc[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[loc[0]:loc[1]]))
+		b.WriteString("</mark>")
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String(), true
+}
+
+// snippet returns about snippetLength characters of text around the first
+// match, highlighted.
+func (h *highlighter) snippet(text string) (string, bool) {
+	if h.pattern == nil {
+		return "", false
+	}
+	loc := h.pattern.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+	runes := []rune(text)
+
+	center := len([]rune(text[:loc[0]]))
+	start := center - snippetLength/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+	// Don't cut words in half
+	for start > 0 && runes[start-1] != ' ' && center-start < snippetLength/2 {
+		start--
+	}
+	for end < len(runes) && runes[end] != ' ' && end-center < snippetLength {
+		end++
+	}
+
+	marked, _ := h.mark(string(runes[start:end]))
+	if start > 0 {
+		marked = "…" + marked
+	}
+	if end < len(runes) {
+		marked += "…"
+	}
+	return marked, true
+}
+
+// highlights returns the product's name and a description snippet with
+// the query terms marked, for the fields that matched.
+func (h *highlighter) highlights(p *Product) map[string]string {
+	result := map[string]string{}
+	if name, ok := h.mark(p.Name); ok {
+		result["name"] = name
+	}
+	if snippet, ok := h.snippet(p.Description); ok {
+		result["description"] = snippet
+	}
+	var tags []string
+	for _, tag := range p.Tags {
+		if h.pattern != nil && h.pattern.MatchString(tag) {
+			tags = append(tags, html.EscapeString(tag))
+		}
+	}
+	if len(tags) > 0 {
+		result["tags"] = strings.Join(tags, ", ")
+	}
+	return result
+}
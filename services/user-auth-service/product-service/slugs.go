@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Products and categories are addressed in storefront URLs by slug. A slug
+// is unique among the current and previous slugs of its collection, so
+// links to a slug that has since changed can be redirected to the new
+// one. Slugs are generated from the name, with -2, -3 and so on appended
+// on collision, and kept when the name changes; they only change when one
+// is given explicitly.
+const (
+	maxSlugLength     = 80
+	maxPreviousSlugs  = 20
+	maxSlugCollisions = 50
+)
+
+// setupSlugs indexes slugs and gives products without one a slug.
+func setupSlugs() {
+	ctx := context.Background()
+	_, err := productService.db.Collection("products").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "slug", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"slug": bson.M{"$type": "string"}}),
+		},
+		{Keys: bson.D{{Key: "previous_slugs", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create slug indexes: %v", err)
+	}
+	_, err = productService.db.Collection("categories").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "previous_slugs", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	go assignMissingSlugs(ctx)
+}
+
+// normalizeSlug slugifies s and caps its length.
+func normalizeSlug(s string) string {
+	slug := slugify(s)
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
+
+// slugTaken reports whether another document of the collection has or had
+// the slug.
+func slugTaken(ctx context.Context, collection, slug, exceptID string) (bool, error) {
+	filter := bson.M{"$or": bson.A{bson.M{"slug": slug}, bson.M{"previous_slugs": slug}}}
+	if exceptID != "" {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+	n, err := productService.db.Collection(collection).CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// uniqueSlug derives a free slug from name.
+func uniqueSlug(ctx context.Context, collection, name, exceptID string) (string, error) {
+	base := normalizeSlug(name)
+	if base == "" {
+		return "", nil
+	}
+	for n := 1; n <= maxSlugCollisions; n++ {
+		slug := base
+		if n > 1 {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken, err := slugTaken(ctx, collection, slug, exceptID)
+		if err != nil || !taken {
+			return slug, err
+		}
+	}
+	return "", fmt.Errorf("no free slug for %q", name)
+}
+
+// rememberSlug adds the slug being replaced to the previous ones, dropping
+// the slug coming back into use and the oldest beyond maxPreviousSlugs.
+func rememberSlug(previous []string, old, replacement string) []string {
+	kept := []string{}
+	for _, slug := range previous {
+		if slug != old && slug != replacement {
+			kept = append(kept, slug)
+		}
+	}
+	kept = append(kept, old)
+	if len(kept) > maxPreviousSlugs {
+		kept = kept[len(kept)-maxPreviousSlugs:]
+	}
+	return kept
+}
+
+// assignProductSlug settles the slug of a product being created, or
+// updated from current. It writes an error and returns false if the slug
+// asked for is in use.
+func assignProductSlug(c *gin.Context, p *Product, current *Product) bool {
+	ctx := c.Request.Context()
+	exceptID := ""
+	p.PreviousSlugs = nil
+	if current != nil {
+		exceptID = current.ID
+		p.PreviousSlugs = current.PreviousSlugs
+	}
+
+	requested := normalizeSlug(p.Slug)
+	var err error
+	switch {
+	case requested != "" && (current == nil || requested != current.Slug):
+		var taken bool
+		if taken, err = slugTaken(ctx, "products", requested, exceptID); err == nil && taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug is already in use"})
+			return false
+		}
+		p.Slug = requested
+	case current != nil && current.Slug != "":
+		p.Slug = current.Slug
+	default:
+		p.Slug, err = uniqueSlug(ctx, "products", p.Name, exceptID)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign slug"})
+		return false
+	}
+
+	if current != nil && current.Slug != "" && p.Slug != current.Slug {
+		p.PreviousSlugs = rememberSlug(current.PreviousSlugs, current.Slug, p.Slug)
+	}
+	return true
+}
+
+// assignMissingSlugs gives products created before slugs, or by imports,
+// a slug from their name.
+func assignMissingSlugs(ctx context.Context) {
+	products := productService.db.Collection("products")
+	cursor, err := products.Find(ctx, bson.M{"slug": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		log.Printf("Failed to assign product slugs: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	assigned := 0
+	for cursor.Next(ctx) {
+		var row struct {
+			ID   string `bson:"_id"`
+			Name string `bson:"name"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		slug, err := uniqueSlug(ctx, "products", row.Name, row.ID)
+		if err == nil && slug != "" {
+			_, err = products.UpdateOne(ctx, bson.M{"_id": row.ID, "slug": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"slug": slug}})
+		}
+		if err != nil {
+			log.Printf("Failed to assign slug to product %s: %v", row.ID, err)
+			continue
+		}
+		assigned++
+	}
+	if assigned > 0 {
+		log.Printf("Assigned slugs to %d products", assigned)
+		invalidateCatalog(ctx)
+	}
+}
+
+// duplicateProductError says which unique product field a write collided
+// on.
+func duplicateProductError(err error) string {
+	if strings.Contains(err.Error(), "slug") {
+		return "Slug is already in use"
+	}
+	return "A product with this SKU already exists"
+}
+
+// redirectPath is path with the request's query string.
+func redirectPath(c *gin.Context, path string) string {
+	if query := c.Request.URL.RawQuery; query != "" {
+		return path + "?" + query
+	}
+	return path
+}
+
+// getProductBySlug serves a product by slug, like getProduct. Slugs the
+// product used to have redirect permanently to the current one.
+func getProductBySlug(c *gin.Context) {
+	slug := c.Param("slug")
+	var found struct {
+		ID   string `bson:"_id"`
+		Slug string `bson:"slug"`
+	}
+	err := productService.db.Collection("products").FindOne(c.Request.Context(),
+		bson.M{"$or": bson.A{bson.M{"slug": slug}, bson.M{"previous_slugs": slug}}},
+		options.FindOne().SetProjection(bson.M{"slug": 1})).Decode(&found)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if found.Slug != slug {
+		c.Redirect(http.StatusMovedPermanently, redirectPath(c, "/api/v1/products/slug/"+url.PathEscape(found.Slug)))
+		return
+	}
+	showProduct(c, found.ID)
+}
+
+// redirectCategory redirects a lookup by a category's previous slug to its
+// current one, returning false if ref isn't one.
+func redirectCategory(c *gin.Context, ref string) bool {
+	var category Category
+	err := productService.db.Collection("categories").FindOne(c.Request.Context(), bson.M{"previous_slugs": ref}).Decode(&category)
+	if err != nil {
+		return false
+	}
+	c.Redirect(http.StatusMovedPermanently, redirectPath(c, "/api/v1/categories/"+url.PathEscape(category.Slug)))
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A product's stock mirrors the quantity the inventory service has
+// available for it across warehouses, pulled every STOCK_SYNC_INTERVAL
+// (default 30s). It can't be set through product writes; stock moves
+// through the inventory service. Digital products carry no inventory.
+// Variants are stocked under their SKU and mirrored the same way.
+var stockSyncInterval = envDuration("STOCK_SYNC_INTERVAL", 30*time.Second)
+
+const stockSyncBatch = 500
+
+// The whole catalog's levels come in one response
+var stockClient = &http.Client{Timeout: 10 * time.Second}
+
+func startStockSync() {
+	if stockSyncInterval == 0 {
+		return
+	}
+	go func() {
+		for {
+			if n, err := syncStock(context.Background()); err != nil {
+				log.Printf("Stock sync failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Updated stock of %d products", n)
+			}
+			time.Sleep(stockSyncInterval)
+		}
+	}()
+}
+
+// fetchStockLevels returns the available quantity per product; products
+// the inventory service doesn't stock are absent.
+func fetchStockLevels(ctx context.Context) (map[string]int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, inventoryServiceURL()+"/api/v1/inventory/levels", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := stockClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory service returned %d", resp.StatusCode)
+	}
+	var body struct {
+		Levels map[string]int `json:"levels"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Levels, nil
+}
+
+// syncStock writes the inventory service's levels onto the products whose
+// stock differs, returning how many changed. If the levels can't be
+// fetched, products keep their last known stock.
+func syncStock(ctx context.Context) (int, error) {
+	levels, err := fetchStockLevels(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	products := productService.db.Collection("products")
+	opts := options.Find().SetProjection(bson.M{"stock": 1, "digital": 1, "variants.sku": 1, "variants.stock": 1})
+	cursor, err := products.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var models []mongo.WriteModel
+	changed := 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		result, err := products.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		if result != nil {
+			changed += int(result.ModifiedCount)
+		}
+		return err
+	}
+
+	var writeErr error
+	for writeErr == nil && cursor.Next(ctx) {
+		var row struct {
+			ID       string `bson:"_id"`
+			Stock    int    `bson:"stock"`
+			Digital  bool   `bson:"digital"`
+			Variants []struct {
+				SKU   string `bson:"sku"`
+				Stock int    `bson:"stock"`
+			} `bson:"variants"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		set := bson.M{}
+		stock := levels[row.ID]
+		if row.Digital {
+			stock = 0
+		}
+		if stock != row.Stock {
+			set["stock"] = stock
+		}
+		// Variants are matched by SKU as they may be reordered meanwhile
+		var filters []interface{}
+		for _, v := range row.Variants {
+			if row.Digital || levels[v.SKU] == v.Stock {
+				continue
+			}
+			name := fmt.Sprintf("v%d", len(filters))
+			set["variants.$["+name+"].stock"] = levels[v.SKU]
+			filters = append(filters, bson.M{name + ".sku": v.SKU})
+		}
+		if len(set) == 0 {
+			continue
+		}
+		set["updated_at"] = time.Now()
+		model := mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": row.ID}).
+			SetUpdate(bson.M{"$set": set})
+		if len(filters) > 0 {
+			model.SetArrayFilters(options.ArrayFilters{Filters: filters})
+		}
+		models = append(models, model)
+		if len(models) >= stockSyncBatch {
+			writeErr = flush()
+		}
+	}
+	if writeErr == nil {
+		writeErr = flush()
+	}
+	if changed > 0 {
+		invalidateCatalog(ctx)
+	}
+	if writeErr != nil {
+		return changed, writeErr
+	}
+	return changed, cursor.Err()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// objectStore keeps private files in an S3-compatible bucket (AWS S3 or
+// MinIO), configured by S3_ENDPOINT, S3_REGION, S3_BUCKET,
+// S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY. Objects are addressed
+// path-style, which both support, and are only readable through presigned
+// URLs, except product images: the bucket policy must let anyone read
+// images/, and they're served from IMAGE_BASE_URL (a CDN, say), falling
+// back to the bucket URL.
+type objectStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// Where public objects are served from
+	imageURL string
+	client   *http.Client
+}
+
+// Uploads are streamed, so the payload isn't part of the signature
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var storage *objectStore
+
+func setupStorage() {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	storage = &objectStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		imageURL:  strings.TrimSuffix(os.Getenv("IMAGE_BASE_URL"), "/"),
+		client:    &http.Client{Timeout: 30 * time.Minute},
+	}
+	if storage.imageURL == "" {
+		storage.imageURL = storage.endpoint + "/" + bucket
+	}
+}
+
+func (s *objectStore) objectURL(key string) *url.URL {
+	u, _ := url.Parse(s.endpoint)
+	u.Path = "/" + s.bucket + "/" + key
+	return u
+}
+
+// publicURL is where a public object, such as a product image, is served.
+func (s *objectStore) publicURL(key string) string {
+	return s.imageURL + "/" + key
+}
+
+// put uploads size bytes from body under key.
+func (s *objectStore) put(ctx context.Context, key, contentType string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	return s.do(req)
+}
+
+func (s *objectStore) delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req)
+}
+
+func (s *objectStore) do(req *http.Request) error {
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage returned %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+// presign returns a URL that downloads the object until ttl has passed,
+// saved under fileName.
+func (s *objectStore) presign(key, fileName string, ttl time.Duration) string {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	u := s.objectURL(key)
+	query := url.Values{
+		"X-Amz-Algorithm":              {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":             {s.accessKey + "/" + scope},
+		"X-Amz-Date":                   {amzDate},
+		"X-Amz-Expires":                {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders":          {"host"},
+		"response-content-disposition": {`attachment; filename="` + strings.ReplaceAll(fileName, `"`, "") + `"`},
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := s.signature(now, scope, amzDate, canonicalRequest)
+	return u.String() + "&X-Amz-Signature=" + signature
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *objectStore) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	signature := s.signature(now, scope, amzDate, canonicalRequest)
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *objectStore) signature(now time.Time, scope, amzDate, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery encodes a query the way SigV4 expects: sorted, with
+// spaces as %20 rather than +.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, url.QueryEscape(k)+"="+strings.ReplaceAll(url.QueryEscape(query.Get(k)), "+", "%20"))
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search-as-you-type suggestions come from their own collection, rebuilt
+// from published products, categories and brands every
+// SUGGEST_REBUILD_INTERVAL (default 10m). Each entry lists the prefixes of
+// its words, so a lookup is an index match on what's been typed, already
+// ranked by weight: popularity for products, the number of published
+// products for categories and brands. Answers are cached briefly in Redis.
+const (
+	SuggestProduct  = "product"
+	SuggestCategory = "category"
+	SuggestBrand    = "brand"
+)
+
+var suggestRebuildInterval = envDuration("SUGGEST_REBUILD_INTERVAL", 10*time.Minute)
+
+const (
+	// Longer words match on their first maxSuggestPrefix characters
+	maxSuggestPrefix = 20
+	suggestCacheTTL  = time.Minute
+	suggestBatchSize = 1000
+)
+
+// How many suggestions of each type a lookup returns by default
+var suggestLimits = map[string]int{SuggestProduct: 5, SuggestCategory: 3, SuggestBrand: 3}
+
+const maxSuggestLimit = 10
+
+// Suggestion is an entry of the suggestions collection.
+type Suggestion struct {
+	ID       string    `bson:"_id" json:"-"`
+	Type     string    `bson:"type" json:"type"`
+	Text     string    `bson:"text" json:"text"`
+	RefID    string    `bson:"ref_id" json:"id"`
+	Slug     string    `bson:"slug,omitempty" json:"slug,omitempty"`
+	Prefixes []string  `bson:"prefixes" json:"-"`
+	Weight   float64   `bson:"weight" json:"-"`
+	BuiltAt  time.Time `bson:"built_at" json:"-"`
+}
+
+func setupSuggestions() {
+	_, err := productService.db.Collection("suggestions").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "prefixes", Value: 1}, {Key: "type", Value: 1}, {Key: "weight", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	// One instance rebuilds per interval
+	go func() {
+		ctx := context.Background()
+		for {
+			claimed, err := redisClient.SetNX(ctx, "suggestions:rebuild", 1, suggestRebuildInterval*9/10).Result()
+			if err != nil {
+				log.Printf("Failed to schedule suggestion rebuild: %v", err)
+			}
+			if claimed {
+				if err := rebuildSuggestions(ctx); err != nil {
+					log.Printf("Suggestion rebuild failed: %v", err)
+				}
+			}
+			time.Sleep(suggestRebuildInterval / 10)
+		}
+	}()
+}
+
+// suggestWords splits text into lowercase words.
+func suggestWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// truncatePrefix caps word at maxSuggestPrefix characters.
+func truncatePrefix(word string) string {
+	runes := []rune(word)
+	if len(runes) > maxSuggestPrefix {
+		runes = runes[:maxSuggestPrefix]
+	}
+	return string(runes)
+}
+
+// suggestPrefixes lists every prefix of every word of text.
+func suggestPrefixes(text string) []string {
+	seen := map[string]bool{}
+	prefixes := []string{}
+	for _, word := range suggestWords(text) {
+		runes := []rune(truncatePrefix(word))
+		for n := 1; n <= len(runes); n++ {
+			if prefix := string(runes[:n]); !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// publishedCounts counts published products per value of field.
+func publishedCounts(ctx context.Context, field string) (map[string]int, error) {
+	cursor, err := productService.db.Collection("products").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: publishedFilter(bson.M{field: bson.M{"$nin": bson.A{nil, ""}}})}},
+		{{Key: "$group", Value: bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID    string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.ID] = row.Count
+	}
+	return counts, nil
+}
+
+// rebuildSuggestions rewrites every suggestion, then drops those for
+// products, categories and brands that are gone.
+func rebuildSuggestions(ctx context.Context) error {
+	builtAt := time.Now()
+	collection := productService.db.Collection("suggestions")
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	add := func(s Suggestion) error {
+		s.ID = s.Type + ":" + s.RefID
+		s.Prefixes = suggestPrefixes(s.Text)
+		s.BuiltAt = builtAt
+		if len(s.Prefixes) == 0 {
+			return nil
+		}
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": s.ID}).SetReplacement(s).SetUpsert(true))
+		if len(models) >= suggestBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	cursor, err := productService.db.Collection("products").Find(ctx, publishedFilter(bson.M{}),
+		options.Find().SetProjection(bson.M{"name": 1, "slug": 1, "popularity": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var p Product
+		if err := cursor.Decode(&p); err != nil {
+			continue
+		}
+		if err := add(Suggestion{Type: SuggestProduct, Text: p.Name, RefID: p.ID, Slug: p.Slug, Weight: p.Popularity}); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	categoryCounts, err := publishedCounts(ctx, "category_id")
+	if err != nil {
+		return err
+	}
+	var categories []Category
+	cursor, err = productService.db.Collection("categories").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &categories); err != nil {
+		return err
+	}
+	for _, category := range categories {
+		weight := float64(categoryCounts[category.ID])
+		if err := add(Suggestion{Type: SuggestCategory, Text: category.Name, RefID: category.ID, Slug: category.Slug, Weight: weight}); err != nil {
+			return err
+		}
+	}
+
+	brandCounts, err := publishedCounts(ctx, "brand_id")
+	if err != nil {
+		return err
+	}
+	var brands []Brand
+	cursor, err = productService.db.Collection("brands").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &brands); err != nil {
+		return err
+	}
+	for _, brand := range brands {
+		// Brands with nothing to show would lead to an empty page
+		if brandCounts[brand.ID] == 0 {
+			continue
+		}
+		weight := float64(brandCounts[brand.ID])
+		if err := add(Suggestion{Type: SuggestBrand, Text: brand.Name, RefID: brand.ID, Slug: brand.Slug, Weight: weight}); err != nil {
+			return err
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	_, err = collection.DeleteMany(ctx, bson.M{"built_at": bson.M{"$lt": builtAt}})
+	return err
+}
+
+// findSuggestions returns up to limit suggestions of the type with a word
+// starting with each of words.
+func findSuggestions(ctx context.Context, words []string, suggestType string, limit int) ([]Suggestion, error) {
+	prefixes := make(bson.A, 0, len(words))
+	for _, word := range words {
+		prefixes = append(prefixes, truncatePrefix(word))
+	}
+	cursor, err := productService.db.Collection("suggestions").Find(ctx,
+		bson.M{"prefixes": bson.M{"$all": prefixes}, "type": suggestType},
+		options.Find().
+			SetSort(bson.D{{Key: "weight", Value: -1}}).
+			SetLimit(int64(limit)).
+			SetProjection(bson.M{"prefixes": 0}))
+	if err != nil {
+		return nil, err
+	}
+	suggestions := []Suggestion{}
+	err = cursor.All(ctx, &suggestions)
+	return suggestions, err
+}
+
+// suggest answers GET /api/v1/products/suggest?q= with product, category
+// and brand suggestions for what's been typed so far. ?limit= caps the
+// products.
+func suggest(c *gin.Context) {
+	query := normalizeQuery(c.Query("q"))
+	words := suggestWords(query)
+	if len(words) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limits := map[string]int{}
+	for suggestType, limit := range suggestLimits {
+		limits[suggestType] = limit
+	}
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxSuggestLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 10"})
+			return
+		}
+		limits[SuggestProduct] = limit
+	}
+
+	cacheKey := "suggest:" + strings.Join(words, " ") + ":" + c.DefaultQuery("limit", "")
+	cacheCtx, cancel := cacheContext(c.Request.Context())
+	cached, err := redisClient.Get(cacheCtx, cacheKey).Bytes()
+	cancel()
+	if err == nil {
+		c.Header("X-Cache", "HIT")
+		c.Data(http.StatusOK, "application/json; charset=utf-8", cached)
+		return
+	}
+
+	response := gin.H{"query": query}
+	for _, group := range []struct{ suggestType, key string }{
+		{SuggestProduct, "products"},
+		{SuggestCategory, "categories"},
+		{SuggestBrand, "brands"},
+	} {
+		suggestions, err := findSuggestions(c.Request.Context(), words, group.suggestType, limits[group.suggestType])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch suggestions"})
+			return
+		}
+		response[group.key] = suggestions
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode suggestions"})
+		return
+	}
+	cacheCtx, cancel = cacheContext(c.Request.Context())
+	defer cancel()
+	if err := redisClient.Set(cacheCtx, cacheKey, data, suggestCacheTTL).Err(); err != nil {
+		log.Printf("Suggestion cache write failed: %v", err)
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tags are stored trimmed, lowercased and without duplicates, so filters
+// and merges compare them exactly.
+
+const (
+	maxTagLength = 50
+	maxTagFilter = 10
+)
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func normalizeTags(tags []string) []string {
+	if tags == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+func validateTags(tags []string) string {
+	for _, tag := range tags {
+		if len(tag) > maxTagLength {
+			return "Tags can be at most " + strconv.Itoa(maxTagLength) + " characters"
+		}
+	}
+	return ""
+}
+
+func setupTags() {
+	ctx := context.Background()
+	products := productService.db.Collection("products")
+	_, err := products.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "tags", Value: 1}}})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	// Tags written before they were normalized
+	normalized := bson.M{"$filter": bson.M{
+		"input": bson.M{"$setUnion": bson.A{bson.M{"$map": bson.M{
+			"input": "$tags",
+			"in":    bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$$this"}}},
+		}}}},
+		"cond": bson.M{"$ne": bson.A{"$$this", ""}},
+	}}
+	result, err := products.UpdateMany(ctx,
+		bson.M{"tags.0": bson.M{"$exists": true}, "$expr": bson.M{"$ne": bson.A{"$tags", normalized}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"tags": normalized, "updated_at": time.Now()}}}},
+	)
+	if err != nil {
+		log.Printf("Failed to normalize product tags: %v", err)
+		return
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Normalized tags on %d products", result.ModifiedCount)
+		invalidateCatalog(ctx)
+	}
+}
+
+// tagsParam reads ?tags=a,b. Products must carry all of them.
+func tagsParam(c *gin.Context) ([]string, bool) {
+	value := c.Query("tags")
+	if value == "" {
+		return nil, true
+	}
+	tags := normalizeTags(strings.Split(value, ","))
+	if len(tags) > maxTagFilter {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxTagFilter) + " tags"})
+		return nil, false
+	}
+	return tags, true
+}
+
+// tagFilter narrows a product query to ?tags=.
+func tagFilter(c *gin.Context, filter bson.M) bool {
+	tags, ok := tagsParam(c)
+	if ok && len(tags) > 0 {
+		filter["tags"] = bson.M{"$all": tags}
+	}
+	return ok
+}
+
+// listTags lists tags with the number of products carrying each, drafts
+// included, most used first. ?prefix= narrows it for autocomplete.
+func listTags(c *gin.Context) {
+	match := bson.M{}
+	if prefix := normalizeTag(c.Query("prefix")); prefix != "" {
+		match["tags"] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	cursor, err := productService.db.Collection("products").Aggregate(c.Request.Context(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"tags.0": bson.M{"$exists": true}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tags"})
+		return
+	}
+	var rows []struct {
+		Tag   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(c.Request.Context(), &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode tags"})
+		return
+	}
+
+	tags := make([]gin.H, 0, len(rows))
+	for _, row := range rows {
+		tags = append(tags, gin.H{"tag": row.Tag, "products": row.Count})
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags, "count": len(tags)})
+}
+
+// mergeTags replaces the from tags with into on every product carrying any
+// of them, returning how many products changed.
+func mergeTags(ctx context.Context, from []string, into string) (int64, error) {
+	products := productService.db.Collection("products")
+	filter := bson.M{"tags": bson.M{"$in": from}}
+	now := time.Now()
+	result, err := products.UpdateMany(ctx, filter, bson.M{"$addToSet": bson.M{"tags": into}, "$set": bson.M{"updated_at": now}})
+	if err != nil {
+		return 0, err
+	}
+
+	remove := []string{}
+	for _, tag := range from {
+		if tag != into {
+			remove = append(remove, tag)
+		}
+	}
+	if len(remove) > 0 {
+		_, err = products.UpdateMany(ctx, bson.M{"tags": bson.M{"$in": remove}},
+			bson.M{"$pull": bson.M{"tags": bson.M{"$in": remove}}, "$set": bson.M{"updated_at": now}})
+	}
+	if result.MatchedCount > 0 {
+		invalidateCatalog(ctx)
+	}
+	return result.MatchedCount, err
+}
+
+// renameTag renames a tag across the catalog. Renaming to a tag that's
+// already in use merges the two.
+func renameTag(c *gin.Context) {
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tag, name := normalizeTag(c.Param("tag")), normalizeTag(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if msg := validateTags([]string{name}); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	n, err := mergeTags(c.Request.Context(), []string{tag}, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename tag"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tag": name, "products": n})
+}
+
+func mergeTagsHandler(c *gin.Context) {
+	var req struct {
+		Tags []string `json:"tags" binding:"required,min=1"`
+		Into string   `json:"into" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, into := normalizeTags(req.Tags), normalizeTag(req.Into)
+	if into == "" || len(from) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tags and into are required"})
+		return
+	}
+	if msg := validateTags([]string{into}); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	n, err := mergeTags(c.Request.Context(), from, into)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge tags"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tag": into, "products": n})
+}
+
+func deleteTag(c *gin.Context) {
+	tag := normalizeTag(c.Param("tag"))
+	result, err := productService.db.Collection("products").UpdateMany(c.Request.Context(),
+		bson.M{"tags": tag},
+		bson.M{"$pull": bson.M{"tags": tag}, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tag"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	invalidateCatalog(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{"message": "Tag deleted", "products": result.ModifiedCount})
+}
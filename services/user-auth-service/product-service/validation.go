@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bindProduct reads a product being created or updated, writing an error
+// and returning false if it's malformed.
+func bindProduct(c *gin.Context, p *Product) bool {
+	if err := c.ShouldBindJSON(p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	p.Tags = normalizeTags(p.Tags)
+	return true
+}
+
+// productProblems checks the fields a product is written with, through
+// the API or an import, returning what's wrong with each invalid one by
+// its JSON name. Content is held to the same lengths as its translations.
+func productProblems(p *Product) map[string]string {
+	problems := map[string]string{}
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		problems["name"] = "is required"
+	case len(p.Name) > maxLocalizedName:
+		problems["name"] = tooLong(maxLocalizedName)
+	}
+	if len(p.Description) > maxLocalizedDescription {
+		problems["description"] = tooLong(maxLocalizedDescription)
+	}
+	if len(p.MetaTitle) > maxLocalizedMetaTitle {
+		problems["meta_title"] = tooLong(maxLocalizedMetaTitle)
+	}
+	if len(p.MetaDescription) > maxLocalizedMetaDescription {
+		problems["meta_description"] = tooLong(maxLocalizedMetaDescription)
+	}
+	if p.Price <= 0 {
+		problems["price"] = "must be greater than 0"
+	}
+	if p.Status != "" && p.Status != StatusDraft && p.Status != StatusPublished && p.Status != StatusArchived {
+		problems["status"] = "must be draft, published or archived"
+	}
+	if p.ImageURL != "" && !validURL(p.ImageURL) {
+		problems["image_url"] = "must be an http or https URL"
+	}
+	if p.GTIN != "" && !validGTIN(p.GTIN) {
+		problems["gtin"] = "must be a valid GTIN"
+	}
+	for _, tag := range p.Tags {
+		if len(tag) > maxTagLength {
+			problems["tags"] = "can each be at most " + strconv.Itoa(maxTagLength) + " characters"
+			break
+		}
+	}
+	if p.PublishAt != nil && p.UnpublishAt != nil && !p.UnpublishAt.After(*p.PublishAt) {
+		problems["unpublish_at"] = "must be after publish_at"
+	}
+	if p.LowStockThreshold != nil && *p.LowStockThreshold < 0 {
+		problems["low_stock_threshold"] = "can't be negative"
+	}
+	if p.Customs != nil {
+		if p.Customs.Value < 0 {
+			problems["customs.value"] = "can't be negative"
+		}
+		if p.Customs.WeightKg < 0 {
+			problems["customs.weight_kg"] = "can't be negative"
+		}
+	}
+	return problems
+}
+
+// tooLong says a field is longer than max.
+func tooLong(max int) string {
+	return "can be at most " + strconv.Itoa(max) + " characters"
+}
+
+// validURL reports whether s is an absolute http or https URL.
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// checkProduct writes an error listing problems and returns false if there
+// are any.
+func checkProduct(c *gin.Context, problems map[string]string) bool {
+	if len(problems) == 0 {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product", "fields": problems})
+	return false
+}
+
+// fieldProblems formats productProblems' problems as one message, for
+// imports.
+func fieldProblems(problems map[string]string) string {
+	messages := make([]string, 0, len(problems))
+	for name, msg := range problems {
+		messages = append(messages, name+" "+msg)
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, "; ")
+}
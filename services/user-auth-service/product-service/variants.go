@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Variant is a purchasable version of a product, such as size M in red.
+// Every variant of a product has the same attribute names and a distinct
+// combination of values. Its SKU is unique across the catalog, and the
+// inventory service stocks the variant under it; Stock mirrors what's
+// available there, like a product's (see stock_sync.go).
+type Variant struct {
+	ID         string            `bson:"id" json:"id"`
+	SKU        string            `bson:"sku" json:"sku"`
+	Attributes map[string]string `bson:"attributes" json:"attributes"`
+	// Added to the product's price
+	PriceDelta float64 `bson:"price_delta" json:"price_delta"`
+	Stock      int     `bson:"stock" json:"stock"`
+	// Gallery items shown when the variant is selected
+	MediaIDs []string `bson:"media_ids,omitempty" json:"media_ids,omitempty"`
+}
+
+type VariantRequest struct {
+	SKU        string            `json:"sku" binding:"required"`
+	Attributes map[string]string `json:"attributes" binding:"required,min=1"`
+	PriceDelta float64           `json:"price_delta"`
+	MediaIDs   []string          `json:"media_ids"`
+}
+
+// setupVariants makes SKUs unique across products. Within a product they
+// are checked when variants are saved.
+func setupVariants() {
+	_, err := productService.db.Collection("products").Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "variants.sku", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"variants.sku": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
+
+func normalizeAttributes(attributes map[string]string) map[string]string {
+	normalized := make(map[string]string, len(attributes))
+	for name, value := range attributes {
+		normalized[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return normalized
+}
+
+func sameAttributeNames(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func sameAttributes(a, b map[string]string) bool {
+	if !sameAttributeNames(a, b) {
+		return false
+	}
+	for name, value := range a {
+		if !strings.EqualFold(b[name], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateVariant checks a variant against the product's other variants
+// (all but skip) and its gallery.
+func validateVariant(product *Product, v *Variant, skip string) string {
+	for name, value := range v.Attributes {
+		if name == "" || value == "" {
+			return "Attribute names and values can't be empty"
+		}
+	}
+	for _, other := range product.Variants {
+		if other.ID == skip {
+			continue
+		}
+		if other.SKU == v.SKU {
+			return "SKU already used by another variant"
+		}
+		if !sameAttributeNames(other.Attributes, v.Attributes) {
+			return "Variants of a product must all have the same attributes"
+		}
+		if sameAttributes(other.Attributes, v.Attributes) {
+			return "A variant with these attributes already exists"
+		}
+	}
+	if product.Price+v.PriceDelta < 0 {
+		return "Variant price can't be negative"
+	}
+	media := map[string]bool{}
+	for _, item := range product.gallery() {
+		media[item.ID] = true
+	}
+	for _, id := range v.MediaIDs {
+		if !media[id] {
+			return "Unknown media ID " + id
+		}
+	}
+	return ""
+}
+
+func loadProduct(c *gin.Context) (*Product, bool) {
+	var product Product
+	if err := productService.db.Collection("products").FindOne(context.Background(), bson.M{"_id": c.Param("id")}).Decode(&product); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return nil, false
+	}
+	return &product, true
+}
+
+func saveVariants(c *gin.Context, productID string, variants []Variant) bool {
+	err := updateAudited(c, AuditVariantsChanged, productID,
+		bson.M{"$set": bson.M{"variants": variants, "updated_at": time.Now()}})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "SKU already used by another product"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save variants"})
+		return false
+	}
+	invalidateProduct(c.Request.Context(), productID)
+	publishProductUpdated(c.Request.Context(), productID)
+	return true
+}
+
+// variantView is a variant with its resolved price.
+func variantView(product *Product, v Variant) gin.H {
+	return gin.H{
+		"id":          v.ID,
+		"sku":         v.SKU,
+		"attributes":  v.Attributes,
+		"price_delta": v.PriceDelta,
+		"price":       product.Price + v.PriceDelta,
+		"stock":       v.Stock,
+		"in_stock":    v.Stock > 0 || product.Digital,
+		"media_ids":   v.MediaIDs,
+	}
+}
+
+func listVariants(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	variants := make([]gin.H, 0, len(product.Variants))
+	for _, v := range product.Variants {
+		variants = append(variants, variantView(product, v))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"variants": variants, "options": variantOptions(product.Variants)})
+}
+
+// variantOptions lists each attribute's values across variants, e.g.
+// {"size": ["S", "M"], "color": ["red"]}, in the order first seen.
+func variantOptions(variants []Variant) map[string][]string {
+	values := map[string][]string{}
+	seen := map[string]bool{}
+	for _, v := range variants {
+		names := make([]string, 0, len(v.Attributes))
+		for name := range v.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key := name + "\x00" + strings.ToLower(v.Attributes[name])
+			if !seen[key] {
+				seen[key] = true
+				values[name] = append(values[name], v.Attributes[name])
+			}
+		}
+	}
+	return values
+}
+
+func addVariant(c *gin.Context) {
+	var req VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	variant := Variant{
+		ID:         primitive.NewObjectID().Hex(),
+		SKU:        strings.TrimSpace(req.SKU),
+		Attributes: normalizeAttributes(req.Attributes),
+		PriceDelta: req.PriceDelta,
+		MediaIDs:   req.MediaIDs,
+	}
+	if msg := validateVariant(product, &variant, ""); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if !saveVariants(c, product.ID, append(product.Variants, variant)) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, variantView(product, variant))
+}
+
+func updateVariant(c *gin.Context) {
+	var req VariantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	index := -1
+	for i, v := range product.Variants {
+		if v.ID == c.Param("variantId") {
+			index = i
+		}
+	}
+	if index < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+		return
+	}
+
+	variant := Variant{
+		ID:         product.Variants[index].ID,
+		SKU:        strings.TrimSpace(req.SKU),
+		Attributes: normalizeAttributes(req.Attributes),
+		PriceDelta: req.PriceDelta,
+		MediaIDs:   req.MediaIDs,
+	}
+	// A new SKU waits for the next stock sync
+	if variant.SKU == product.Variants[index].SKU {
+		variant.Stock = product.Variants[index].Stock
+	}
+	// Skipping itself lets a product's only variant change attribute names
+	if msg := validateVariant(product, &variant, variant.ID); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	product.Variants[index] = variant
+	if !saveVariants(c, product.ID, product.Variants) {
+		return
+	}
+
+	c.JSON(http.StatusOK, variantView(product, variant))
+}
+
+func deleteVariant(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+
+	variants := []Variant{}
+	for _, v := range product.Variants {
+		if v.ID != c.Param("variantId") {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == len(product.Variants) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+		return
+	}
+
+	if !saveVariants(c, product.ID, variants) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Variant deleted successfully"})
+}
+
+// resolveVariant finds the variant matching the attributes selected so
+// far, given as query parameters (?size=M&color=red). A complete selection
+// returns the variant; either way the response lists the values still
+// available for each attribute, so the storefront can disable the rest.
+func resolveVariant(c *gin.Context) {
+	product, ok := loadProduct(c)
+	if !ok {
+		return
+	}
+	if len(product.Variants) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product has no variants"})
+		return
+	}
+
+	selection := map[string]string{}
+	for name, values := range c.Request.URL.Query() {
+		if _, ok := product.Variants[0].Attributes[strings.ToLower(name)]; ok && len(values) > 0 {
+			selection[strings.ToLower(name)] = values[0]
+		}
+	}
+
+	// A value stays available if some variant matches it together with the
+	// rest of the selection
+	available := map[string][]string{}
+	var match *Variant
+	for i, v := range product.Variants {
+		if sameAttributes(v.Attributes, selection) {
+			match = &product.Variants[i]
+		}
+		for name, value := range v.Attributes {
+			compatible := true
+			for selected, want := range selection {
+				if selected != name && !strings.EqualFold(v.Attributes[selected], want) {
+					compatible = false
+					break
+				}
+			}
+			if compatible && (v.Stock > 0 || product.Digital) && !containsFold(available[name], value) {
+				available[name] = append(available[name], value)
+			}
+		}
+	}
+
+	response := gin.H{"selection": selection, "available": available}
+	if match == nil {
+		if len(selection) == len(product.Variants[0].Attributes) {
+			response["error"] = "No variant matches this selection"
+			c.JSON(http.StatusNotFound, response)
+			return
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	response["variant"] = variantView(product, *match)
+	c.JSON(http.StatusOK, response)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
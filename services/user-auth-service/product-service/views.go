@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Product views are counted in a Redis hash and flushed to Mongo every
+// VIEW_FLUSH_INTERVAL (default 1m): onto the product's running total and
+// into per-day counts in product_views. A shopper's repeat views within
+// viewDedupWindow count once.
+//
+// Popularity is recomputed from the daily counts every
+// TRENDING_INTERVAL (default 15m): views over the last trendingWindow,
+// each day's weighing half as much every trendingHalfLife. It orders the
+// trending listing. Neither figure invalidates the cache, so cached pages
+// lag behind by up to their TTL.
+var (
+	viewFlushInterval = envDuration("VIEW_FLUSH_INTERVAL", time.Minute)
+	trendingInterval  = envDuration("TRENDING_INTERVAL", 15*time.Minute)
+)
+
+const (
+	pendingViewsKey  = "views:pending"
+	flushingViewsKey = "views:flushing"
+	viewDedupWindow  = 30 * time.Minute
+	viewCountTimeout = 500 * time.Millisecond
+
+	trendingWindow   = 7 * 24 * time.Hour
+	trendingHalfLife = 2 * 24 * time.Hour
+	// Daily counts are kept a while longer than trending needs
+	viewHistoryRetention = 30 * 24 * time.Hour
+
+	defaultTrendingLimit = 20
+	maxTrendingLimit     = 50
+)
+
+// setupViews indexes products by popularity and expires old daily counts.
+func setupViews() {
+	ctx := context.Background()
+	_, err := productService.db.Collection("products").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "popularity", Value: -1}, {Key: "views", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+	_, err = productService.db.Collection("product_views").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "day", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(viewHistoryRetention.Seconds())),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+
+	go func() {
+		for {
+			time.Sleep(viewFlushInterval)
+			if n, err := flushViews(context.Background()); err != nil {
+				log.Printf("Failed to flush product views: %v", err)
+			} else if n > 0 {
+				log.Printf("Flushed views of %d products", n)
+			}
+		}
+	}()
+	go func() {
+		for {
+			if n, err := scorePopularity(context.Background()); err != nil {
+				log.Printf("Popularity scoring failed: %v", err)
+			} else {
+				log.Printf("Scored popularity of %d products", n)
+			}
+			time.Sleep(trendingInterval)
+		}
+	}()
+}
+
+// countView records a view of the product by the caller. Like recordView
+// it's best effort and runs in the background.
+func countView(c *gin.Context, productID string) {
+	viewer, _ := recentlyViewedKey(c)
+	if viewer == "" {
+		viewer = "ip:" + c.ClientIP()
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), viewCountTimeout)
+		defer cancel()
+		first, err := redisClient.SetNX(ctx, "views:seen:"+viewer+":"+productID, 1, viewDedupWindow).Result()
+		if err == nil && first {
+			err = redisClient.HIncrBy(ctx, pendingViewsKey, productID, 1).Err()
+		}
+		if err != nil {
+			log.Printf("Failed to count view of %s: %v", productID, err)
+		}
+	}()
+}
+
+// flushViews moves the pending counts to Mongo, returning how many
+// products they covered. Counts are set aside under flushingViewsKey first,
+// so views keep being counted meanwhile; a failed flush is retried from
+// there next time.
+func flushViews(ctx context.Context) (int, error) {
+	exists, err := redisClient.Exists(ctx, flushingViewsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		if err := redisClient.Rename(ctx, pendingViewsKey, flushingViewsKey).Err(); err != nil {
+			// Nothing was viewed since the last flush
+			if redis.HasErrorPrefix(err, "ERR no such key") {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	counts, err := redisClient.HGetAll(ctx, flushingViewsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var totals, daily []mongo.WriteModel
+	for productID, value := range counts {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			continue
+		}
+		totals = append(totals, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": productID}).
+			SetUpdate(bson.M{"$inc": bson.M{"views": n}}))
+		daily = append(daily, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": productID + ":" + day.Format("20060102")}).
+			SetUpdate(bson.M{
+				"$inc":         bson.M{"views": n},
+				"$setOnInsert": bson.M{"product_id": productID, "day": day},
+			}).
+			SetUpsert(true))
+	}
+	if len(totals) > 0 {
+		unordered := options.BulkWrite().SetOrdered(false)
+		if _, err := productService.db.Collection("products").BulkWrite(ctx, totals, unordered); err != nil {
+			return 0, err
+		}
+		if _, err := productService.db.Collection("product_views").BulkWrite(ctx, daily, unordered); err != nil {
+			return 0, err
+		}
+	}
+	if err := redisClient.Del(ctx, flushingViewsKey).Err(); err != nil {
+		return 0, err
+	}
+	return len(totals), nil
+}
+
+// scorePopularity recomputes every product's popularity from the daily
+// counts, returning how many products have one.
+func scorePopularity(ctx context.Context) (int, error) {
+	now := time.Now()
+	cursor, err := productService.db.Collection("product_views").Find(ctx,
+		bson.M{"day": bson.M{"$gte": now.Add(-trendingWindow)}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	scores := map[string]float64{}
+	for cursor.Next(ctx) {
+		var row struct {
+			ProductID string    `bson:"product_id"`
+			Day       time.Time `bson:"day"`
+			Views     int64     `bson:"views"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			continue
+		}
+		age := now.Sub(row.Day).Hours() / trendingHalfLife.Hours()
+		scores[row.ProductID] += float64(row.Views) * math.Pow(0.5, age)
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+
+	products := productService.db.Collection("products")
+	scored := make([]string, 0, len(scores))
+	models := make([]mongo.WriteModel, 0, len(scores))
+	for productID, score := range scores {
+		scored = append(scored, productID)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": productID}).
+			SetUpdate(bson.M{"$set": bson.M{"popularity": math.Round(score*100) / 100}}))
+	}
+	if len(models) > 0 {
+		if _, err := products.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return 0, err
+		}
+	}
+	// Products nobody looked at lately drop out of trending
+	_, err = products.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$nin": scored}, "popularity": bson.M{"$gt": 0}},
+		bson.M{"$unset": bson.M{"popularity": ""}})
+	if err != nil {
+		return 0, err
+	}
+	return len(scored), nil
+}
+
+// listingSort applies ?sort= to a product listing: "trending" puts the
+// most popular first and "popular" the most viewed of all time. Listings
+// are unsorted by default.
+func listingSort(c *gin.Context, opts *options.FindOptions) bool {
+	switch c.Query("sort") {
+	case "":
+	case "trending":
+		opts.SetSort(bson.D{{Key: "popularity", Value: -1}, {Key: "views", Value: -1}, {Key: "_id", Value: 1}})
+	case "popular":
+		opts.SetSort(bson.D{{Key: "views", Value: -1}, {Key: "_id", Value: 1}})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be trending or popular"})
+		return false
+	}
+	return true
+}
+
+// getTrendingProducts returns the published products with the most recent
+// attention, optionally within a ?category= subtree. ?limit= caps the
+// list.
+func getTrendingProducts(c *gin.Context) {
+	filter := bson.M{"popularity": bson.M{"$gt": 0}}
+	if !categoryFilter(c, filter) {
+		return
+	}
+	limit := defaultTrendingLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = min(n, maxTrendingLimit)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "popularity", Value: -1}, {Key: "views", Value: -1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := productService.db.Collection("products").Find(c.Request.Context(), publishedFilter(filter), opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+		return
+	}
+	products := []Product{}
+	if err := cursor.All(c.Request.Context(), &products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode products"})
+		return
+	}
+	localizeProducts(products, storefrontLocales(c))
+	setAvailability(products)
+
+	c.JSON(http.StatusOK, gin.H{"products": products, "count": len(products)})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Products are prepared as drafts, published to the storefront and archived
+// once retired. Archived products keep their reviews, links and order
+// history but have to go back to draft before they can be republished.
+var statusTransitions = map[string][]string{
+	StatusDraft:     {StatusPublished, StatusArchived},
+	StatusPublished: {StatusDraft, StatusArchived},
+	StatusArchived:  {StatusDraft},
+}
+
+// productStatus is the product's state, treating products from before
+// publication existed as published.
+func productStatus(p *Product) string {
+	if p.Status == "" {
+		return StatusPublished
+	}
+	return p.Status
+}
+
+// transitionError says why a product can't move from one state to another,
+// or returns "" if it can. Staying in the same state is always allowed.
+func transitionError(from, to string) string {
+	if from == "" {
+		from = StatusPublished
+	}
+	if to == "" || to == from {
+		return ""
+	}
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return ""
+		}
+	}
+	return "A product can't go from " + from + " to " + to
+}
+
+// checkTransition writes a 409 if the product can't move to status.
+func checkTransition(c *gin.Context, p *Product, status string) bool {
+	msg := transitionError(p.Status, status)
+	if msg == "" {
+		return true
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   msg,
+		"code":    "invalid_transition",
+		"status":  productStatus(p),
+		"allowed": statusTransitions[productStatus(p)],
+	})
+	return false
+}
+
+func archiveProduct(c *gin.Context) {
+	setProductStatus(c, StatusArchived)
+}
+
+// restoreProduct brings an archived product back as a draft.
+func restoreProduct(c *gin.Context) {
+	setProductStatus(c, StatusDraft)
+}
+
+// statusFilter applies ?status= to a product listing. The storefront only
+// sees published products; staff with products:read can ask for draft,
+// archived or all, or several comma-separated.
+func statusFilter(c *gin.Context, filter bson.M) bool {
+	value := c.Query("status")
+	if value == "" || value == StatusPublished {
+		publishedFilter(filter)
+		return true
+	}
+	if !callerCan(c, "products:read") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only staff can list unpublished products"})
+		return false
+	}
+	if value == "all" {
+		return true
+	}
+
+	statuses := bson.A{}
+	for _, status := range strings.Split(value, ",") {
+		if _, ok := statusTransitions[status]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be draft, published, archived or all"})
+			return false
+		}
+		statuses = append(statuses, status)
+		if status == StatusPublished {
+			// Products from before publication existed have no status
+			statuses = append(statuses, nil)
+		}
+	}
+	filter["status"] = bson.M{"$in": statuses}
+	return true
+}
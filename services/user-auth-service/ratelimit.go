@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimit allows Requests per Window.
+type rateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+var throttledRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_rate_limited_requests_total",
+	Help: "Requests rejected by the auth rate limiter.",
+}, []string{"route", "scope"})
+
+// fixedWindowScript increments the counter for the current window and sets
+// its expiry on first use, returning the count and remaining TTL in ms.
+var fixedWindowScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// parseRateLimit reads a limit such as "5/15m" from env, falling back to def.
+func parseRateLimit(env, def string) rateLimit {
+	raw := os.Getenv(env)
+	if raw == "" {
+		raw = def
+	}
+
+	parts := strings.SplitN(raw, "/", 2)
+	if len(parts) == 2 {
+		requests, errN := strconv.Atoi(parts[0])
+		window, errW := time.ParseDuration(parts[1])
+		if errN == nil && errW == nil && requests > 0 && window > 0 {
+			return rateLimit{Requests: requests, Window: window}
+		}
+	}
+
+	log.Printf("Invalid %s %q, using %s", env, raw, def)
+	return parseRateLimit("", def)
+}
+
+// allow records a hit against key and reports whether it is within limit,
+// plus how long until the window resets. Redis errors fail open so an outage
+// doesn't lock everyone out.
+func allow(ctx context.Context, key string, limit rateLimit) (bool, time.Duration) {
+	result, err := fixedWindowScript.Run(ctx, redisClient, []string{key}, limit.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		log.Printf("Rate limiter unavailable: %v", err)
+		return true, 0
+	}
+
+	return result[0] <= int64(limit.Requests), time.Duration(result[1]) * time.Millisecond
+}
+
+// rateLimitMiddleware throttles a route per client IP and, when the request
+// body names an account, per email as well.
+func rateLimitMiddleware(route string, perIP, perAccount *rateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		if perIP != nil {
+			key := fmt.Sprintf("ratelimit:%s:ip:%s", route, c.ClientIP())
+			if ok, retryAfter := allow(ctx, key, *perIP); !ok {
+				throttle(c, route, "ip", retryAfter)
+				return
+			}
+		}
+
+		if perAccount != nil {
+			if email := peekEmail(c); email != "" {
+				key := fmt.Sprintf("ratelimit:%s:account:%s", route, email)
+				if ok, retryAfter := allow(ctx, key, *perAccount); !ok {
+					throttle(c, route, "account", retryAfter)
+					return
+				}
+			}
+		}
+
+		c.Next()
+	}
+}
+
+func throttle(c *gin.Context, route, scope string, retryAfter time.Duration) {
+	throttledRequests.WithLabelValues(route, scope).Inc()
+
+	seconds := int(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests", "retry_after": seconds})
+	c.Abort()
+}
+
+// peekEmail reads the email from a JSON body without consuming it.
+func peekEmail(c *gin.Context) string {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	json.Unmarshal(body, &req)
+	return strings.ToLower(strings.TrimSpace(req.Email))
+}
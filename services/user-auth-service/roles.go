@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Role maps a role name, as stored on users, to the permissions it grants.
+// Permissions are "resource:action" strings; "*" grants everything and
+// "orders:*" everything on orders.
+type Role struct {
+	Name        string    `bson:"_id" json:"name"`
+	Description string    `bson:"description" json:"description"`
+	Permissions []string  `bson:"permissions" json:"permissions"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+	// Default permissions already granted, see setupRoles
+	Seeded []string `bson:"seeded_permissions,omitempty" json:"-"`
+}
+
+// defaultRoles seed the roles collection. They are the starting point for
+// each role, not a record of what it grants now: admins edit roles through
+// putRole. Permissions added here later are granted to existing roles on
+// the next start.
+var defaultRoles = []Role{
+	{Name: "customer", Description: "Shopper account", Permissions: []string{}},
+	{Name: guestRole, Description: "Anonymous shopper", Permissions: []string{}},
+	{Name: "support", Description: "Customer support", Permissions: []string{
+		"users:read", "users:tags:write", "users:notes:write", "orders:read", "orders:hold", "payments:refund",
+		"reviews:moderate", "questions:moderate", "questions:answer",
+	}},
+	{Name: "warehouse", Description: "Warehouse staff", Permissions: []string{
+		"orders:read", "orders:fulfill", "inventory:read", "inventory:adjust", "inventory:receive",
+	}},
+	{Name: "finance", Description: "Payments and reconciliation", Permissions: []string{
+		"orders:read", "payments:offline", "payments:refunds:read",
+	}},
+	{Name: "catalog", Description: "Catalog management", Permissions: []string{
+		"products:read", "products:write",
+	}},
+	{Name: "translator", Description: "Storefront translations", Permissions: []string{
+		"i18n:read", "i18n:write",
+	}},
+	{Name: builtinAdminRole, Description: "Full access", Permissions: []string{"*"}},
+}
+
+// roleCache keeps role permissions in memory. Writes invalidate it locally
+// and, through Redis pub/sub, on every other replica.
+type roleCache struct {
+	mu       sync.RWMutex
+	roles    map[string][]string
+	loadedAt time.Time
+}
+
+var roles = &roleCache{}
+
+const (
+	roleCacheTTL      = 5 * time.Minute
+	roleInvalidations = "auth:roles:invalidate"
+)
+
+func setupRoles() {
+	collection := authService.db.Collection("roles")
+	for _, role := range defaultRoles {
+		if err := seedRole(context.Background(), role); err != nil {
+			log.Printf("Failed to seed role %s: %v", role.Name, err)
+		}
+	}
+
+	// Undo any edit made to the admin role before it was locked
+	_, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": builtinAdminRole},
+		bson.M{"$set": bson.M{"permissions": []string{"*"}}},
+	)
+	if err != nil {
+		log.Printf("Failed to restore the admin role: %v", err)
+	}
+
+	roles.reload(context.Background())
+
+	go func() {
+		for range redisClient.Subscribe(context.Background(), roleInvalidations).Channel() {
+			roles.reload(context.Background())
+		}
+	}()
+}
+
+// seedRole creates a default role, or grants an existing one the default
+// permissions it hasn't been given yet. Each default is granted once and
+// remembered in seeded_permissions, so one an admin took away stays away.
+// Roles seeded before this was tracked get every missing default once.
+func seedRole(ctx context.Context, role Role) error {
+	collection := authService.db.Collection("roles")
+
+	var stored Role
+	err := collection.FindOne(ctx, bson.M{"_id": role.Name}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		role.Seeded = role.Permissions
+		role.UpdatedAt = time.Now()
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": role.Name},
+			bson.M{"$setOnInsert": role}, options.Update().SetUpsert(true))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, p := range role.Permissions {
+		if !containsString(stored.Seeded, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": role.Name}, bson.M{
+		"$addToSet": bson.M{
+			"permissions":        bson.M{"$each": missing},
+			"seeded_permissions": bson.M{"$each": missing},
+		},
+		"$set": bson.M{"updated_at": time.Now()},
+	})
+	if err == nil {
+		log.Printf("Granted role %s its new default permissions %v", role.Name, missing)
+	}
+	return err
+}
+
+func (rc *roleCache) reload(ctx context.Context) {
+	cursor, err := authService.db.Collection("roles").Find(ctx, bson.M{})
+	if err != nil {
+		log.Printf("Failed to load roles: %v", err)
+		return
+	}
+
+	var loaded []Role
+	if err := cursor.All(ctx, &loaded); err != nil {
+		log.Printf("Failed to decode roles: %v", err)
+		return
+	}
+
+	byName := map[string][]string{}
+	for _, role := range loaded {
+		byName[role.Name] = role.Permissions
+	}
+
+	rc.mu.Lock()
+	rc.roles = byName
+	rc.loadedAt = time.Now()
+	rc.mu.Unlock()
+}
+
+// invalidate reloads the cache here and tells the other replicas to.
+func (rc *roleCache) invalidate(ctx context.Context) {
+	rc.reload(ctx)
+	if err := redisClient.Publish(ctx, roleInvalidations, "").Err(); err != nil {
+		log.Printf("Failed to broadcast role invalidation: %v", err)
+	}
+}
+
+func (rc *roleCache) permissions(role string) []string {
+	rc.mu.RLock()
+	stale := time.Since(rc.loadedAt) > roleCacheTTL
+	perms := rc.roles[role]
+	rc.mu.RUnlock()
+
+	if stale {
+		go rc.reload(context.Background())
+	}
+	if perms == nil {
+		return []string{}
+	}
+	return perms
+}
+
+func (rc *roleCache) exists(role string) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	_, ok := rc.roles[role]
+	return ok
+}
+
+func grants(perms []string, permission string) bool {
+	for _, p := range perms {
+		if p == "*" || p == permission {
+			return true
+		}
+		if strings.HasSuffix(p, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessClaims builds the claims of an unscoped access token, embedding
+// the role's permissions so downstream services don't need to look them up.
+func accessClaims(tenantID, userID, email, role string, expiresAt time.Time) jwt.MapClaims {
+	return newClaims(tenantID, userID, role).email(email).permissions(role, nil).expiresAt(expiresAt).build()
+}
+
+// requirePermission only lets requests through whose role grants
+// permission, and whose token's scopes do if it is scoped. Permissions are
+// resolved from the cache, or for service tokens the service client
+// config, rather than the token so revoking one takes effect immediately.
+// It must run after scopedAuthMiddleware.
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := callerPermissions(c)
+		scopes, scoped := c.Get("scopes")
+		if !grants(granted, permission) || (scoped && !grants(scopes.([]string), permission)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// callerPermissions returns what the caller's role, or service client,
+// grants.
+func callerPermissions(c *gin.Context) []string {
+	if client := c.GetString("service_client"); client != "" {
+		return serviceClientPermissions[client]
+	}
+	return roles.permissions(c.GetString("role"))
+}
+
+// grantsAll reports whether perms grant every one of wanted, so that
+// nobody hands out more than they hold themselves.
+func grantsAll(perms, wanted []string) bool {
+	for _, p := range wanted {
+		if !grants(perms, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func listRoles(c *gin.Context) {
+	cursor, err := authService.db.Collection("roles").Find(context.Background(), bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch roles"})
+		return
+	}
+	defer cursor.Close(context.Background())
+
+	result := []Role{}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roles": result})
+}
+
+// builtinAdminRole always grants everything, so there is always a role
+// that can repair the others; it can't be edited or deleted.
+const builtinAdminRole = "admin"
+
+func putRole(c *gin.Context) {
+	if c.Param("name") == builtinAdminRole {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The built-in admin role can't be edited"})
+		return
+	}
+
+	var req struct {
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !grantsAll(callerPermissions(c), req.Permissions) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "A role can't grant permissions you don't have"})
+		return
+	}
+
+	role := Role{
+		Name:        c.Param("name"),
+		Description: req.Description,
+		Permissions: req.Permissions,
+		UpdatedAt:   time.Now(),
+	}
+	// Updated rather than replaced to keep seeded_permissions
+	_, err := authService.db.Collection("roles").UpdateOne(context.Background(),
+		bson.M{"_id": role.Name},
+		bson.M{"$set": bson.M{"description": role.Description, "permissions": role.Permissions, "updated_at": role.UpdatedAt}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save role"})
+		return
+	}
+	roles.invalidate(context.Background())
+
+	recordAudit(c, AuditEvent{Type: "role.updated", Data: bson.M{"role": role.Name, "permissions": role.Permissions}})
+
+	c.JSON(http.StatusOK, role)
+}
+
+func deleteRole(c *gin.Context) {
+	name := c.Param("name")
+
+	inUse, err := authService.db.Collection("users").CountDocuments(context.Background(), bson.M{"role": name})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role usage"})
+		return
+	}
+	if inUse > 0 || name == "customer" || name == guestRole || name == builtinAdminRole {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role is in use"})
+		return
+	}
+
+	result, err := authService.db.Collection("roles").DeleteOne(context.Background(), bson.M{"_id": name})
+	if err != nil || result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	roles.invalidate(context.Background())
+
+	recordAudit(c, AuditEvent{Type: "role.deleted", Data: bson.M{"role": name}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
+}
+
+// setUserRole assigns a role to a user. Staff roles can only go to accounts
+// on a STAFF_EMAIL_DOMAINS address, and callers can only move accounts
+// between roles whose permissions they hold themselves. Existing refresh
+// tokens are revoked so the new permissions are picked up on next login.
+func setUserRole(c *gin.Context) {
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !roles.exists(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+	granted := callerPermissions(c)
+	if !grantsAll(granted, roles.permissions(req.Role)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't assign a role with permissions you don't have"})
+		return
+	}
+
+	userID := c.Param("id")
+	users := authService.db.Collection("users")
+	var user User
+	if err := users.FindOne(context.Background(), tenantUserFilter(c, userID)).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !grantsAll(granted, roles.permissions(user.Role)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't change the role of an account with permissions you don't have"})
+		return
+	}
+	if err := policy.checkRole(user.Email, req.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := users.UpdateOne(context.Background(),
+		tenantUserFilter(c, userID),
+		bson.M{"$set": bson.M{"role": req.Role}, "$inc": bson.M{"token_version": 1}},
+	)
+	if err != nil || result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "user.role_changed", UserID: userID, Data: bson.M{"role": req.Role}})
+	publishUserEvent(c.Request.Context(), EventUserUpdated, userID, bson.M{"fields": []string{"role"}, "role": req.Role})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
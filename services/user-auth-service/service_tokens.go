@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Services call each other's protected routes with short-lived service
+// tokens from the OAuth client credentials grant, rather than a static
+// token copied between deployments. A service signs in with the Basic
+// credentials it already has for introspection (INTROSPECTION_CLIENTS) and
+// gets the permissions SERVICE_CLIENT_PERMISSIONS grants it, e.g.
+// {"order-service": ["promotions:redeem", "users:read", "inventory:reserve"],
+// "payment-service": ["orders:status"]}.
+
+const (
+	serviceRole      = "service"
+	serviceSubPrefix = "service:"
+	serviceTokenTTL  = 5 * time.Minute
+)
+
+var serviceClientPermissions map[string][]string
+
+func setupServiceClients() {
+	serviceClientPermissions = map[string][]string{}
+	if raw := os.Getenv("SERVICE_CLIENT_PERMISSIONS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &serviceClientPermissions); err != nil {
+			log.Printf("Invalid SERVICE_CLIENT_PERMISSIONS, service tokens are disabled: %v", err)
+			serviceClientPermissions = map[string][]string{}
+		}
+	}
+}
+
+// authenticateClient checks a service's Basic credentials against
+// INTROSPECTION_CLIENTS and returns its client id.
+func authenticateClient(c *gin.Context, realm string) (string, bool) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	expected, known := introspectionClients[clientID]
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return "", false
+	}
+	return clientID, true
+}
+
+// issueServiceToken implements the client credentials grant. The token has
+// no refresh token; services fetch a new one when it runs out.
+func issueServiceToken(c *gin.Context) {
+	clientID, ok := authenticateClient(c, "service-token")
+	if !ok {
+		return
+	}
+	if grantType := c.PostForm("grant_type"); grantType != "" && grantType != "client_credentials" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	permissions := serviceClientPermissions[clientID]
+	if len(permissions) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "unauthorized_client"})
+		return
+	}
+
+	expiry := time.Now().Add(serviceTokenTTL)
+	token, err := authService.keys.sign(newClaims(tenantID(c), serviceSubPrefix+clientID, serviceRole).
+		set("permissions", permissions).
+		set("scope", strings.Join(permissions, " ")).
+		expiresAt(expiry).
+		build())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue service token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(serviceTokenTTL.Seconds()),
+	})
+}
+
+// serviceClient returns the client id a service token was issued to, or ""
+// for any other token.
+func serviceClient(claims jwt.MapClaims) string {
+	role, _ := claims["role"].(string)
+	sub, _ := claims["sub"].(string)
+	if role != serviceRole || !strings.HasPrefix(sub, serviceSubPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(sub, serviceSubPrefix)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// socialProvider is a consumer identity provider customers can sign in
+// with and link to their account. Unlike corporate SSO, an existing
+// account with the same email is never linked automatically: its owner has
+// to confirm from their inbox or link while signed in.
+type socialProvider struct {
+	name     string
+	issuer   string
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// Apple posts the callback as a form when email is requested
+	formPost bool
+}
+
+// socialState is what the authorization request remembers until the
+// callback. UserID is set when a signed-in user is linking. BindingHash is
+// the hash of the socialBindingCookie set on the browser that started the
+// request.
+type socialState struct {
+	Nonce       string `json:"nonce"`
+	UserID      string `json:"user_id,omitempty"`
+	Tenant      string `json:"tenant"`
+	BindingHash string `json:"binding_hash"`
+}
+
+const (
+	identityLinkTTL = time.Hour
+	// socialBindingCookie ties an authorization request to the browser that
+	// started it, so a callback URL carrying someone else's state can't
+	// sign a victim in to, or link, the wrong account.
+	socialBindingCookie = "social_binding"
+)
+
+var socialProviders = map[string]*socialProvider{}
+
+// setupSocialLogin configures Google (GOOGLE_CLIENT_ID, GOOGLE_CLIENT_SECRET,
+// GOOGLE_REDIRECT_URL) and Apple (APPLE_CLIENT_ID, APPLE_CLIENT_SECRET,
+// APPLE_REDIRECT_URL). Apple's client secret is the signed JWT generated
+// from the Sign in with Apple key, which has to be rotated before it
+// expires.
+func setupSocialLogin() {
+	for _, p := range []struct {
+		name, issuer, env string
+		formPost          bool
+	}{
+		{"google", "https://accounts.google.com", "GOOGLE", false},
+		{"apple", "https://appleid.apple.com", "APPLE", true},
+	} {
+		clientID := os.Getenv(p.env + "_CLIENT_ID")
+		if clientID == "" {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		provider, err := oidc.NewProvider(ctx, p.issuer)
+		cancel()
+		if err != nil {
+			log.Printf("OIDC discovery for %s failed, %s sign-in disabled: %v", p.issuer, p.name, err)
+			continue
+		}
+
+		socialProviders[p.name] = &socialProvider{
+			name:   p.name,
+			issuer: p.issuer,
+			config: oauth2.Config{
+				ClientID:     clientID,
+				ClientSecret: os.Getenv(p.env + "_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv(p.env + "_REDIRECT_URL"),
+				Endpoint:     provider.Endpoint(),
+				Scopes:       []string{oidc.ScopeOpenID, "email", "name"},
+			},
+			verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+			formPost: p.formPost,
+		}
+	}
+}
+
+func loadSocialProvider(c *gin.Context) (*socialProvider, bool) {
+	provider, ok := socialProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown sign-in provider"})
+	}
+	return provider, ok
+}
+
+// title is a provider name as shown in emails, e.g. "Google".
+func (p *socialProvider) title() string {
+	return cases.Title(language.English).String(p.name)
+}
+
+// authorizationURL starts an authorization request, remembering state
+// until the callback and binding it to this browser with a cookie.
+func (p *socialProvider) authorizationURL(c *gin.Context, userID string) (string, bool) {
+	state, _ := newOneTimeToken()
+	nonce, _ := newOneTimeToken()
+	binding, bindingHash := newOneTimeToken()
+
+	data, _ := json.Marshal(socialState{Nonce: nonce, UserID: userID, Tenant: tenantID(c), BindingHash: bindingHash})
+	if err := redisClient.Set(c.Request.Context(), "social:state:"+state, data, oidcStateTTL).Err(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Sign-in temporarily unavailable"})
+		return "", false
+	}
+
+	// Form-post callbacks are cross-site POSTs, which Lax cookies don't
+	// accompany
+	sameSite := http.SameSiteLaxMode
+	if p.formPost {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     socialBindingCookie,
+		Value:    binding,
+		Path:     "/api/v1/auth/social/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(nonce)}
+	if p.formPost {
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+	}
+	return p.config.AuthCodeURL(state, opts...), true
+}
+
+func socialLogin(c *gin.Context) {
+	provider, ok := loadSocialProvider(c)
+	if !ok {
+		return
+	}
+	if url, ok := provider.authorizationURL(c, ""); ok {
+		c.Redirect(http.StatusFound, url)
+	}
+}
+
+// startIdentityLink returns the URL a signed-in user follows to link a
+// provider to their account.
+func startIdentityLink(c *gin.Context) {
+	provider, ok := loadSocialProvider(c)
+	if !ok {
+		return
+	}
+	if url, ok := provider.authorizationURL(c, c.GetString("user_id")); ok {
+		c.JSON(http.StatusOK, gin.H{"authorization_url": url})
+	}
+}
+
+// socialIdentity is the verified result of a provider callback.
+type socialIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+func (p *socialProvider) exchange(c *gin.Context, nonce string) (*socialIdentity, bool) {
+	ctx := c.Request.Context()
+	oauthToken, err := p.config.Exchange(ctx, c.Request.FormValue("code"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in code exchange failed"})
+		return nil, false
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in response missing id_token"})
+		return nil, false
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid id_token"})
+		return nil, false
+	}
+
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil || claims.Email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Provider did not return an email"})
+		return nil, false
+	}
+
+	// Apple sends email_verified as a string
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return &socialIdentity{
+		Subject:       idToken.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}, true
+}
+
+func identityFilter(tenant, issuer, subject string) bson.M {
+	return bson.M{"tenant_id": tenant, "identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+}
+
+// socialCallback completes both sign-ins and links.
+func socialCallback(c *gin.Context) {
+	provider, ok := loadSocialProvider(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	raw, err := redisClient.GetDel(ctx, "social:state:"+c.Request.FormValue("state")).Result()
+	var state socialState
+	if err != nil || json.Unmarshal([]byte(raw), &state) != nil || state.Tenant != tenantID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in state"})
+		return
+	}
+	binding, err := c.Cookie(socialBindingCookie)
+	if err != nil || state.BindingHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hashToken(binding)), []byte(state.BindingHash)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in state"})
+		return
+	}
+	c.SetCookie(socialBindingCookie, "", -1, "/api/v1/auth/social/", "", true, true)
+
+	identity, ok := provider.exchange(c, state.Nonce)
+	if !ok {
+		return
+	}
+
+	collection := authService.db.Collection("users")
+	var user User
+	err = collection.FindOne(ctx, identityFilter(state.Tenant, provider.issuer, identity.Subject)).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+	found := err == nil
+
+	if state.UserID != "" {
+		linkIdentity(c, provider, identity, state.UserID, found, &user)
+		return
+	}
+
+	if found {
+		completeSocialLogin(c, provider, &user)
+		return
+	}
+
+	// Unverified emails neither create accounts nor reach the owner of one
+	if !identity.EmailVerified {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Provider email is not verified"})
+		return
+	}
+
+	// An account already uses this email; only its owner may link it
+	var existing User
+	if err := collection.FindOne(ctx, emailFilter(c, identity.Email)).Decode(&existing); err == nil {
+		requestIdentityLink(c, provider, identity, &existing)
+		return
+	}
+
+	user = User{
+		Email:      identity.Email,
+		Name:       identity.Name,
+		Role:       "customer",
+		Active:     true,
+		TenantID:   state.Tenant,
+		CreatedAt:  time.Now(),
+		Identities: []Identity{{Provider: provider.name, Issuer: provider.issuer, Subject: identity.Subject, LinkedAt: time.Now()}},
+	}
+	result, err := collection.InsertOne(ctx, user)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+	user.ID = idString(result.InsertedID)
+	publishUserEvent(ctx, EventUserRegistered, user.ID, bson.M{
+		"email": user.Email, "name": user.Name, "role": user.Role, "source": provider.name,
+	})
+
+	completeSocialLogin(c, provider, &user)
+}
+
+func completeSocialLogin(c *gin.Context, provider *socialProvider, user *User) {
+	if !user.Active {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated", "code": "account_deactivated"})
+		return
+	}
+	if !requirePolicyAcceptance(c, user) {
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "login.social", UserID: user.ID, ActorID: user.ID, Data: bson.M{"provider": provider.name}})
+
+	accessToken, refreshToken, expiresIn := generateTokens(user.TenantID, user.ID, user.Email, user.Role, user.TokenVersion)
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    expiresIn,
+	})
+}
+
+// linkIdentity attaches the identity to the signed-in user who started the
+// link. An identity already attached to another account means the user has
+// two accounts, which they can merge instead.
+func linkIdentity(c *gin.Context, provider *socialProvider, identity *socialIdentity, userID string, found bool, owner *User) {
+	if found {
+		if owner.ID == userID {
+			c.JSON(http.StatusOK, gin.H{"message": "Already linked"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "This " + provider.name + " account already signs in to another account. Merge the accounts to combine them.",
+			"code":  "identity_in_use",
+		})
+		return
+	}
+
+	var user User
+	if err := authService.db.Collection("users").FindOne(c.Request.Context(), userFilter(userID)).Decode(&user); err != nil || !user.Active {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !attachIdentity(c, &user, provider, identity.Subject) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account linked", "provider": provider.name})
+}
+
+func attachIdentity(c *gin.Context, user *User, provider *socialProvider, subject string) bool {
+	_, err := authService.db.Collection("users").UpdateOne(c.Request.Context(), userFilter(user.ID), bson.M{
+		"$push": bson.M{"identities": Identity{Provider: provider.name, Issuer: provider.issuer, Subject: subject, LinkedAt: time.Now()}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link account"})
+		return false
+	}
+
+	recordAudit(c, AuditEvent{Type: "identity.linked", UserID: user.ID, ActorID: user.ID, Data: bson.M{"provider": provider.name}})
+	sendEmail(user.Email, "New sign-in method added",
+		"Sign-in with "+provider.title()+" was added to your account. If this wasn't you, remove it from your account settings and reset your password right away.")
+	return true
+}
+
+// requestIdentityLink emails the owner of the account with the same email
+// a link that attaches the identity and signs them in. Nothing changes
+// until they confirm. The provider must have verified the email, or anyone
+// could send account owners link requests.
+func requestIdentityLink(c *gin.Context, provider *socialProvider, identity *socialIdentity, owner *User) {
+	if !identity.EmailVerified {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Provider email is not verified"})
+		return
+	}
+
+	now := time.Now()
+	token, tokenHash := newOneTimeToken()
+	_, err := authService.db.Collection("identity_links").InsertOne(c.Request.Context(), bson.M{
+		"user_id":    owner.ID,
+		"provider":   provider.name,
+		"subject":    identity.Subject,
+		"token_hash": tokenHash,
+		"expires_at": now.Add(identityLinkTTL),
+		"used":       false,
+		"created_at": now,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	sendEmail(owner.Email, "Confirm sign-in with "+provider.title(),
+		"Someone tried to sign in with "+provider.title()+" using this email address. "+
+			"To use it to sign in to your account from now on, confirm within the hour:\n\n"+
+			appURL("/account/identities/confirm?token="+token)+
+			"\n\nIf this wasn't you, ignore this email.")
+
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "An account with this email already exists. We've emailed you a link to connect it, or sign in and link it from your account settings.",
+		"code":  "account_exists",
+	})
+}
+
+// confirmIdentityLink completes a link requested by requestIdentityLink.
+func confirmIdentityLink(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var link struct {
+		UserID   string `bson:"user_id"`
+		Provider string `bson:"provider"`
+		Subject  string `bson:"subject"`
+	}
+	err := authService.db.Collection("identity_links").FindOneAndUpdate(ctx,
+		bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"used": true, "used_at": time.Now()}},
+	).Decode(&link)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	provider, ok := socialProviders[link.Provider]
+	var user User
+	if !ok || authService.db.Collection("users").FindOne(ctx, userFilter(link.UserID)).Decode(&user) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	// The identity may have been linked elsewhere in the meantime
+	if n, _ := authService.db.Collection("users").CountDocuments(ctx, identityFilter(user.TenantID, provider.issuer, link.Subject)); n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "This " + provider.name + " account is already linked", "code": "identity_in_use"})
+		return
+	}
+	if !attachIdentity(c, &user, provider, link.Subject) {
+		return
+	}
+
+	completeSocialLogin(c, provider, &user)
+}
+
+func listIdentities(c *gin.Context) {
+	var user User
+	if err := authService.db.Collection("users").FindOne(c.Request.Context(), userFilter(c.GetString("user_id"))).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	identities := user.Identities
+	if identities == nil {
+		identities = []Identity{}
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities, "has_password": user.Password != ""})
+}
+
+// unlinkIdentity removes a provider from the account, as long as the user
+// still has another way to sign in. Social-only users can add a password
+// through the password reset flow first.
+func unlinkIdentity(c *gin.Context) {
+	provider := c.Param("provider")
+	var user User
+	if err := authService.db.Collection("users").FindOne(c.Request.Context(), userFilter(c.GetString("user_id"))).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	remaining := 0
+	linked := false
+	for _, identity := range user.Identities {
+		if identity.Provider == provider {
+			linked = true
+		} else {
+			remaining++
+		}
+	}
+	if !linked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider is not linked"})
+		return
+	}
+	if remaining == 0 && user.Password == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Set a password before removing your only sign-in method", "code": "last_sign_in_method"})
+		return
+	}
+
+	_, err := authService.db.Collection("users").UpdateOne(c.Request.Context(), userFilter(user.ID),
+		bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink provider"})
+		return
+	}
+
+	recordAudit(c, AuditEvent{Type: "identity.unlinked", UserID: user.ID, ActorID: user.ID, Data: bson.M{"provider": provider}})
+	c.JSON(http.StatusOK, gin.H{"message": "Provider unlinked"})
+}
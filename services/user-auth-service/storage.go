@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// objectStore writes public files to an S3-compatible bucket (AWS S3 or
+// MinIO), configured by S3_ENDPOINT, S3_REGION, S3_BUCKET,
+// S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY. Objects are addressed
+// path-style, which both support. Files are served from CDN_BASE_URL,
+// falling back to the bucket URL.
+type objectStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	cdnURL    string
+	client    *http.Client
+}
+
+var storage *objectStore
+
+func setupStorage() {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return
+	}
+
+	storage = &objectStore{
+		endpoint:  strings.TrimSuffix(envOr("S3_ENDPOINT", "https://s3.amazonaws.com"), "/"),
+		region:    envOr("S3_REGION", "us-east-1"),
+		bucket:    bucket,
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		cdnURL:    strings.TrimSuffix(os.Getenv("CDN_BASE_URL"), "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if storage.cdnURL == "" {
+		storage.cdnURL = storage.endpoint + "/" + bucket
+	}
+}
+
+// put uploads body under key and returns its public URL.
+func (s *objectStore) put(ctx context.Context, key, contentType string, body []byte) (string, error) {
+	objectURL := s.endpoint + "/" + s.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("storage returned %d: %s", resp.StatusCode, detail)
+	}
+	return s.cdnURL + "/" + key, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *objectStore) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "cache-control;content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "cache-control:" + req.Header.Get("Cache-Control") + "\n" +
+		"content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
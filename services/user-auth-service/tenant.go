@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Each storefront served by this deployment is a tenant. Users belong to
+// exactly one tenant, the same email may register separately with each, and
+// tokens only work against the tenant that issued them.
+//
+// The tenant is resolved per request from TENANT_HEADER (default
+// X-Tenant-ID), else from the subdomain of TENANT_BASE_DOMAIN (e.g.
+// "acme.shop.example.com" -> "acme"), else DEFAULT_TENANT. When TENANTS is
+// set, only the listed tenants are served.
+var (
+	tenantHeader     = envOr("TENANT_HEADER", "X-Tenant-ID")
+	tenantBaseDomain = strings.ToLower(os.Getenv("TENANT_BASE_DOMAIN"))
+	defaultTenant    = envOr("DEFAULT_TENANT", "default")
+	knownTenants     = map[string]bool{}
+)
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func setupTenants() {
+	for _, t := range strings.Split(os.Getenv("TENANTS"), ",") {
+		if t = strings.TrimSpace(strings.ToLower(t)); t != "" {
+			knownTenants[t] = true
+		}
+	}
+	if len(knownTenants) > 0 {
+		knownTenants[defaultTenant] = true
+	}
+}
+
+func resolveTenant(c *gin.Context) string {
+	if tenant := strings.ToLower(strings.TrimSpace(c.GetHeader(tenantHeader))); tenant != "" {
+		return tenant
+	}
+
+	if tenantBaseDomain != "" {
+		host := strings.ToLower(c.Request.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if sub := strings.TrimSuffix(host, "."+tenantBaseDomain); sub != host && !strings.Contains(sub, ".") {
+			return sub
+		}
+	}
+
+	return defaultTenant
+}
+
+// tenantMiddleware resolves the request's tenant and rejects unknown ones.
+func tenantMiddleware(c *gin.Context) {
+	tenant := resolveTenant(c)
+	if !tenantPattern.MatchString(tenant) || (len(knownTenants) > 0 && !knownTenants[tenant]) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown store"})
+		c.Abort()
+		return
+	}
+	c.Set("tenant_id", tenant)
+	c.Next()
+}
+
+func tenantID(c *gin.Context) string {
+	if tenant := c.GetString("tenant_id"); tenant != "" {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// tokenTenant returns the tenant a token was issued for. Tokens from before
+// tenants existed belong to the default one.
+func tokenTenant(claims map[string]interface{}) string {
+	if tid, ok := claims["tid"].(string); ok && tid != "" {
+		return tid
+	}
+	return defaultTenant
+}
+
+// emailFilter matches the account with email in the request's tenant.
+func emailFilter(c *gin.Context, email string) bson.M {
+	return bson.M{"tenant_id": tenantID(c), "email": email}
+}
+
+// tenantUserFilter matches a user by ID only within the request's tenant,
+// for admin routes that take a user ID from the URL.
+func tenantUserFilter(c *gin.Context, id string) bson.M {
+	filter := userFilter(id)
+	filter["tenant_id"] = tenantID(c)
+	return filter
+}
+
+// migrateTenants assigns users created before tenants existed to the
+// default tenant and moves the unique email index to (tenant_id, email).
+func migrateTenants(db *mongo.Database) {
+	users := db.Collection("users")
+	result, err := users.UpdateMany(context.Background(),
+		bson.M{"tenant_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"tenant_id": defaultTenant}})
+	if err != nil {
+		log.Printf("Failed to assign users to the default tenant: %v", err)
+		return
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Assigned %d users to tenant %s", result.ModifiedCount, defaultTenant)
+	}
+
+	// Ignore the error when the old index is already gone
+	users.Indexes().DropOne(context.Background(), "email_1")
+
+	_, err = users.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// userSortFields are the orders the admin user list supports, each backed
+// by an index starting with (tenant_id, field).
+var userSortFields = map[string]string{
+	"created_at": "created_at",
+	"email":      "email",
+	"name":       "name",
+}
+
+const (
+	defaultUserPageSize = 25
+	maxUserPageSize     = 100
+)
+
+// userCursor marks where the previous page ended. It is BSON encoded so
+// the sort value and _id keep their types (dates, ObjectIDs) between pages.
+type userCursor struct {
+	Value interface{} `bson:"v"`
+	ID    interface{} `bson:"id"`
+}
+
+func encodeUserCursor(value, id bson.RawValue) string {
+	data, err := bson.Marshal(bson.M{"v": value, "id": id})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeUserCursor(s string) (*userCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var cursor userCursor
+	if err := bson.Unmarshal(data, &cursor); err != nil || cursor.ID == nil {
+		return nil, false
+	}
+	return &cursor, true
+}
+
+// userSearchFilter builds the filter for the query parameters. Queries
+// containing "@" match emails by prefix; anything else uses the text index
+// over name and email, which matches whole words.
+func userSearchFilter(c *gin.Context) (bson.M, bool) {
+	filter := bson.M{"tenant_id": tenantID(c)}
+
+	if query := strings.TrimSpace(c.Query("query")); query != "" {
+		if strings.Contains(query, "@") {
+			filter["email"] = bson.M{"$regex": "^" + regexp.QuoteMeta(strings.ToLower(query))}
+		} else {
+			filter["$text"] = bson.M{"$search": query}
+		}
+	}
+	if role := c.Query("role"); role != "" {
+		filter["role"] = role
+	}
+	if active := c.Query("active"); active != "" {
+		value, err := strconv.ParseBool(active)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"})
+			return nil, false
+		}
+		filter["active"] = value
+	}
+	return filter, true
+}
+
+// searchUsers lists the store's users, newest first unless sort says
+// otherwise ("email", "-created_at", ...), a page at a time.
+func searchUsers(c *gin.Context) {
+	filter, ok := userSearchFilter(c)
+	if !ok {
+		return
+	}
+
+	sortParam := c.DefaultQuery("sort", "-created_at")
+	direction := 1
+	if strings.HasPrefix(sortParam, "-") {
+		direction = -1
+		sortParam = sortParam[1:]
+	}
+	sortField, ok := userSortFields[sortParam]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of created_at, email, name"})
+		return
+	}
+
+	limit := defaultUserPageSize
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxUserPageSize {
+		limit = maxUserPageSize
+	}
+
+	ctx := context.Background()
+	collection := authService.db.Collection("users")
+
+	// Counts cover every match, not just the page
+	total, byRole, err := countUsers(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count users"})
+		return
+	}
+
+	pageFilter := filter
+	if raw := c.Query("cursor"); raw != "" {
+		after, ok := decodeUserCursor(raw)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		op := "$gt"
+		if direction < 0 {
+			op = "$lt"
+		}
+		pageFilter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{sortField: bson.M{op: after.Value}},
+			bson.M{sortField: after.Value, "_id": bson.M{op: after.ID}},
+		}}}}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: sortField, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, pageFilter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	users := []User{}
+	var lastValue, lastID bson.RawValue
+	for len(users) < limit && cursor.Next(ctx) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode users"})
+			return
+		}
+		users = append(users, user)
+		lastID = cursor.Current.Lookup("_id")
+		if lastValue, err = cursor.Current.LookupErr(sortField); err != nil {
+			lastValue = bson.RawValue{Type: bsontype.Null}
+		}
+	}
+
+	var nextCursor string
+	if cursor.Next(ctx) {
+		nextCursor = encodeUserCursor(lastValue, lastID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":       users,
+		"count":       len(users),
+		"total":       total,
+		"by_role":     byRole,
+		"next_cursor": nextCursor,
+	})
+}
+
+func countUsers(ctx context.Context, filter bson.M) (int, map[string]int, error) {
+	cursor, err := authService.db.Collection("users").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": "$role", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var groups []struct {
+		Role  string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return 0, nil, err
+	}
+
+	total := 0
+	byRole := map[string]int{}
+	for _, g := range groups {
+		total += g.Count
+		byRole[g.Role] = g.Count
+	}
+	return total, byRole, nil
+}
+
+// createUserSearchIndexes backs the admin user list: a text index for
+// name/email search and one per sort order.
+func createUserSearchIndexes(db *mongo.Database) {
+	_, err := db.Collection("users").Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "name", Value: "text"}, {Key: "email", Value: "text"}},
+			Options: options.Index().SetName("users_search_text").SetWeights(bson.M{"email": 2, "name": 1}),
+		},
+		{Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "role", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		log.Printf("Failed to create index: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Room is the queue for one product drop. Shoppers get sequential queue
+// numbers on join and are admitted in order at AdmitRate per second.
+type Room struct {
+	ProductID    string    `bson:"_id" json:"product_id"`
+	Active       bool      `bson:"active" json:"active"`
+	AdmitRate    int       `bson:"admit_rate" json:"admit_rate"`
+	NextSeq      int       `bson:"next_seq" json:"next_seq"`
+	AdmittedUpTo int       `bson:"admitted_up_to" json:"admitted_up_to"`
+	LastAdmitAt  time.Time `bson:"last_admit_at" json:"last_admit_at"`
+	UpdatedAt    time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type WaitingRoomService struct {
+	db     *mongo.Database
+	secret []byte
+}
+
+var waitingRoomService *WaitingRoomService
+
+const (
+	queueTicketTTL   = 2 * time.Hour
+	admittedTokenTTL = 10 * time.Minute
+)
+
+func main() {
+	mongoURI := os.Getenv("MONGODB_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database("ecommerce")
+	waitingRoomService = &WaitingRoomService{
+		db:     db,
+		secret: []byte(os.Getenv("WAITING_ROOM_SECRET")),
+	}
+
+	if len(waitingRoomService.secret) == 0 {
+		waitingRoomService.secret = []byte("waiting-room-secret-change-in-production")
+	}
+
+	verifier = newTokenVerifier()
+	go runAdmitter()
+
+	router := gin.Default()
+
+	router.GET("/health", healthCheck)
+	router.GET("/ready", readinessCheck)
+
+	router.PUT("/api/v1/waiting-room/:productId", scopedAuthMiddleware, requirePermission("waiting_room:manage"), configureRoom)
+	router.GET("/api/v1/waiting-room/:productId", getRoom)
+	// Tickets and admissions are the caller's own; shoppers who haven't
+	// signed in queue with a guest token
+	router.POST("/api/v1/waiting-room/:productId/join", authMiddleware, joinQueue)
+	router.GET("/api/v1/waiting-room/:productId/status", authMiddleware, queueStatus)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8010"
+	}
+
+	log.Printf("Waiting Room Service starting on port %s", port)
+	if err := router.Run(":" + port); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+func healthCheck(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "healthy",
+		"service": "waiting-room-service",
+		"timestamp": time.Now(),
+	})
+}
+
+func readinessCheck(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := waitingRoomService.db.Client().Ping(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "not ready",
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ready",
+		"service": "waiting-room-service",
+	})
+}
+
+// runAdmitter advances every active room once per second, never past the
+// last queue number handed out, so admissions don't pile up for shoppers
+// who haven't joined yet. The last_admit_at guard makes the update safe to
+// run from several replicas at once.
+func runAdmitter() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	collection := waitingRoomService.db.Collection("waiting_rooms")
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		cursor, err := collection.Find(ctx, bson.M{"active": true})
+		if err != nil {
+			cancel()
+			log.Printf("Failed to load waiting rooms: %v", err)
+			continue
+		}
+
+		var rooms []Room
+		if err := cursor.All(ctx, &rooms); err != nil {
+			log.Printf("Failed to decode waiting rooms: %v", err)
+		}
+
+		now := time.Now()
+		for _, room := range rooms {
+			_, err := collection.UpdateOne(ctx,
+				bson.M{"_id": room.ProductID, "active": true, "last_admit_at": bson.M{"$lte": now.Add(-time.Second)}},
+				bson.A{bson.M{"$set": bson.M{
+					"admitted_up_to": bson.M{"$min": bson.A{
+						bson.M{"$add": bson.A{"$admitted_up_to", room.AdmitRate}}, "$next_seq",
+					}},
+					"last_admit_at": now,
+				}}},
+			)
+			if err != nil {
+				log.Printf("Failed to admit users for %s: %v", room.ProductID, err)
+			}
+		}
+		cancel()
+	}
+}
+
+func configureRoom(c *gin.Context) {
+	productID := c.Param("productId")
+	var req struct {
+		Active    bool `json:"active"`
+		AdmitRate int  `json:"admit_rate" binding:"required,min=1"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	collection := waitingRoomService.db.Collection("waiting_rooms")
+	_, err := collection.UpdateOne(
+		context.Background(),
+		bson.M{"_id": productID},
+		bson.M{
+			"$set": bson.M{"active": req.Active, "admit_rate": req.AdmitRate, "updated_at": time.Now()},
+			"$setOnInsert": bson.M{"next_seq": 0, "admitted_up_to": 0, "last_admit_at": time.Time{}},
+		},
+		options.Update().SetUpsert(true),
+	)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to configure waiting room"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Waiting room configured"})
+}
+
+func getRoom(c *gin.Context) {
+	collection := waitingRoomService.db.Collection("waiting_rooms")
+
+	var room Room
+	err := collection.FindOne(context.Background(), bson.M{"_id": c.Param("productId")}).Decode(&room)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waiting room not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, room)
+}
+
+func joinQueue(c *gin.Context) {
+	productID := c.Param("productId")
+	collection := waitingRoomService.db.Collection("waiting_rooms")
+
+	var room Room
+	err := collection.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": productID, "active": true},
+		bson.M{"$inc": bson.M{"next_seq": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&room)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active waiting room for this product"})
+		return
+	}
+
+	ticket, err := signToken("queue", productID, c.GetString("user_id"), room.NextSeq, queueTicketTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue queue ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"queue_ticket": ticket,
+		"position":     room.NextSeq - room.AdmittedUpTo,
+	})
+}
+
+// queueStatus reports the caller's position and, once their number has been
+// admitted, hands out the short-lived token checkout requires.
+func queueStatus(c *gin.Context) {
+	productID := c.Param("productId")
+
+	claims, err := parseToken(c.GetHeader("X-Queue-Ticket"), "queue", productID)
+	if err != nil || claims["sub"] != c.GetString("user_id") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid queue ticket"})
+		return
+	}
+	seq := int(claims["seq"].(float64))
+
+	collection := waitingRoomService.db.Collection("waiting_rooms")
+	var room Room
+	err = collection.FindOne(context.Background(), bson.M{"_id": productID}).Decode(&room)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waiting room not found"})
+		return
+	}
+
+	if seq > room.AdmittedUpTo {
+		position := seq - room.AdmittedUpTo
+		c.JSON(http.StatusOK, gin.H{
+			"admitted":            false,
+			"position":            position,
+			"estimated_wait_secs": position / max(room.AdmitRate, 1),
+		})
+		return
+	}
+
+	token, err := signToken("admitted", productID, c.GetString("user_id"), seq, admittedTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue admission token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"admitted":       true,
+		"admitted_token": token,
+		"expires_in":     int(admittedTokenTTL.Seconds()),
+	})
+}
+
+// signToken issues a queue ticket or admission to userID. An admission's
+// jti is its place in the queue, so however often it's reissued the order
+// service accepts only one order with it.
+func signToken(typ, productID, userID string, seq int, ttl time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ": typ,
+		"pid": productID,
+		"sub": userID,
+		"jti": fmt.Sprintf("%s:%d", productID, seq),
+		"seq": seq,
+		"exp": time.Now().Add(ttl).Unix(),
+		"iat": time.Now().Unix(),
+	})
+	return token.SignedString(waitingRoomService.secret)
+}
+
+func parseToken(tokenString, typ, productID string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(strings.TrimSpace(tokenString), func(token *jwt.Token) (interface{}, error) {
+		return waitingRoomService.secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["typ"] != typ || claims["pid"] != productID {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if _, ok := claims["seq"].(float64); !ok {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}